@@ -0,0 +1,74 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// The sticky load balancing of a builder keeps the builds of a key on the
+// same pod, and its layer cache.  By default the key is the directory of the
+// build context, --pod-affinity-key chooses another, eg. the Dockerfile of
+// each service of a monorepo built from its root.
+
+const (
+	// PodAffinityContextDir keys the build by the path of its context
+	PodAffinityContextDir = "context-dir"
+	// PodAffinityDockerfileHash keys the build by the hash of the path of its
+	// Dockerfile
+	PodAffinityDockerfileHash = "dockerfile-hash"
+	// PodAffinityGitRemote keys the build by the origin remote of the git
+	// checkout of its context, all the builds of a repository sharing a pod
+	PodAffinityGitRemote = "git-remote"
+
+	podAffinityCustomPrefix = "custom:"
+)
+
+// PodAffinityKey returns the key of the build of contextDir and dockerfile,
+// empty for contextDir/Dockerfile, by source, custom:KEY giving the key
+func PodAffinityKey(ctx context.Context, source, contextDir, dockerfile string) (string, error) {
+	switch source {
+	case "", PodAffinityContextDir:
+		if abs, err := filepath.Abs(contextDir); err == nil {
+			return abs, nil
+		}
+		return contextDir, nil
+	case PodAffinityDockerfileHash:
+		if dockerfile == "-" || urlutil.IsURL(dockerfile) || dockerfile == "" && (contextDir == "-" || urlutil.IsGitURL(contextDir) || urlutil.IsURL(contextDir)) {
+			return "", errors.Errorf("--pod-affinity-key %s requires a local Dockerfile", source)
+		}
+		if dockerfile == "" {
+			dockerfile = filepath.Join(contextDir, "Dockerfile")
+		}
+		abs, err := filepath.Abs(dockerfile)
+		if err != nil {
+			return "", err
+		}
+		return digest.FromString(abs).String(), nil
+	case PodAffinityGitRemote:
+		if urlutil.IsGitURL(contextDir) {
+			// The repository without the ref and subdirectory of the build
+			return strings.SplitN(contextDir, "#", 2)[0], nil
+		}
+		if contextDir == "-" || urlutil.IsURL(contextDir) {
+			return "", errors.Errorf("--pod-affinity-key %s requires a git context or a local one in a git checkout", source)
+		}
+		remote, err := gitOutput(ctx, contextDir, nil, nil, "config", "--get", "remote.origin.url")
+		if err != nil || remote == "" {
+			return "", errors.Errorf("--pod-affinity-key %s requires the context to be in a git checkout with an origin remote", source)
+		}
+		return remote, nil
+	}
+	if strings.HasPrefix(source, podAffinityCustomPrefix) {
+		if key := strings.TrimPrefix(source, podAffinityCustomPrefix); key != "" {
+			return key, nil
+		}
+	}
+	return "", errors.Errorf("invalid --pod-affinity-key %q, use %s, %s, %s or %sKEY", source, PodAffinityContextDir, PodAffinityDockerfileHash, PodAffinityGitRemote, podAffinityCustomPrefix)
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PodAffinityKey(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	abs, err := filepath.Abs("testdata")
+	require.NoError(t, err)
+
+	key, err := PodAffinityKey(ctx, "", "testdata", "")
+	require.NoError(t, err)
+	require.Equal(t, abs, key)
+	key, err = PodAffinityKey(ctx, PodAffinityContextDir, "testdata", "")
+	require.NoError(t, err)
+	require.Equal(t, abs, key)
+
+	// The services of a monorepo built from its root
+	api, err := PodAffinityKey(ctx, PodAffinityDockerfileHash, ".", "api/Dockerfile")
+	require.NoError(t, err)
+	web, err := PodAffinityKey(ctx, PodAffinityDockerfileHash, ".", "web/Dockerfile")
+	require.NoError(t, err)
+	require.NotEqual(t, api, web)
+	key, err = PodAffinityKey(ctx, PodAffinityDockerfileHash, "testdata", "")
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString(filepath.Join(abs, "Dockerfile")).String(), key)
+	_, err = PodAffinityKey(ctx, PodAffinityDockerfileHash, "-", "")
+	require.Error(t, err)
+	_, err = PodAffinityKey(ctx, PodAffinityDockerfileHash, ".", "https://example.com/Dockerfile")
+	require.Error(t, err)
+
+	key, err = PodAffinityKey(ctx, PodAffinityGitRemote, "https://github.com/org/repo.git#main:api", "")
+	require.NoError(t, err)
+	require.Equal(t, "https://github.com/org/repo.git", key)
+	_, err = PodAffinityKey(ctx, PodAffinityGitRemote, "-", "")
+	require.Error(t, err)
+
+	key, err = PodAffinityKey(ctx, "custom:team-a", ".", "")
+	require.NoError(t, err)
+	require.Equal(t, "team-a", key)
+	for _, source := range []string{"custom:", "hostname"} {
+		_, err = PodAffinityKey(ctx, source, ".", "")
+		require.Error(t, err, source)
+	}
+}
+
+func Test_PodAffinityKeyGitRemote(t *testing.T) {
+	t.Parallel()
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	_, err := PodAffinityKey(ctx, PodAffinityGitRemote, dir, "")
+	require.Error(t, err)
+	cmd := exec.Command("git", "remote", "add", "origin", "https://github.com/org/repo.git")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	key, err := PodAffinityKey(ctx, PodAffinityGitRemote, filepath.Join(dir, "app"), "")
+	require.NoError(t, err)
+	require.Equal(t, "https://github.com/org/repo.git", key)
+}
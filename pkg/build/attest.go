@@ -0,0 +1,170 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+// Attestations produced outside of the build, such as test results or a
+// license scan, are attached with --attest as the predicate of an in-toto
+// statement.  The statement about the image digest is only known once the
+// image is pushed, so the referrer carries the bare predicate and its type,
+// and is wrapped in its statement when it is pushed or written out.
+//
+// The SBOM and SLSA provenance attestations of buildx are requested the same
+// way, with type=sbom and type=provenance or the --sbom and --provenance
+// shorthands.  buildkitd of the builder predates attestations, so the CLI
+// generates them, see provenance.go and sbom.go.
+
+// AnnotationPredicateType is the annotation of the in-toto predicate type of
+// a custom attestation
+const AnnotationPredicateType = "in-toto.io/predicate-type"
+
+// AttestationOpts are the attestations the CLI generates for a build
+type AttestationOpts struct {
+	// Provenance is the provenance mode, min or max, empty for none
+	Provenance string
+	// SBOMGenerator is the scanner image generating the SBOM, empty for none
+	SBOMGenerator string
+}
+
+// Enabled reports if any attestation is generated
+func (o AttestationOpts) Enabled() bool {
+	return o.Provenance != "" || o.SBOMGenerator != ""
+}
+
+// ParseAttestations parses attestations to attach to pushed images in the form
+// "type=custom,predicate=<path>,predicateType=<URI>",
+// "type=provenance[,mode=<min|max>]" or "type=sbom[,generator=<image>]", the
+// latter two disabled again with disabled=true.  It returns the custom
+// attestations and the attestations to generate.
+func ParseAttestations(in []string) ([]imagetools.Referrer, AttestationOpts, error) {
+	var refs []imagetools.Referrer
+	var opts AttestationOpts
+	for _, s := range in {
+		fields, err := csv.NewReader(strings.NewReader(s)).Read()
+		if err != nil {
+			return nil, opts, err
+		}
+		attrs := map[string]string{}
+		for _, field := range fields {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, opts, errors.Errorf("invalid value %s", field)
+			}
+			attrs[strings.ToLower(parts[0])] = parts[1]
+		}
+		typ := attrs["type"]
+		delete(attrs, "type")
+		disabled := false
+		if v, ok := attrs["disabled"]; ok && typ != "custom" {
+			if disabled, err = strconv.ParseBool(v); err != nil {
+				return nil, opts, errors.Errorf("invalid disabled value %q", v)
+			}
+			delete(attrs, "disabled")
+		}
+		switch typ {
+		case "custom":
+			ref, err := parseCustomAttestation(s, attrs)
+			if err != nil {
+				return nil, opts, err
+			}
+			refs = append(refs, ref)
+		case "provenance":
+			mode, err := provenanceMode(attrs)
+			if err != nil {
+				return nil, opts, err
+			}
+			if opts.Provenance = mode; disabled {
+				opts.Provenance = ""
+			}
+		case "sbom":
+			generator, ok := attrs["generator"]
+			delete(attrs, "generator")
+			if err := unexpectedAttestationKeys(s, attrs); err != nil {
+				return nil, opts, err
+			}
+			if !ok {
+				generator = DefaultSBOMGenerator
+			}
+			if _, err := reference.ParseNormalizedNamed(generator); err != nil {
+				return nil, opts, errors.Wrapf(err, "invalid SBOM generator %q", generator)
+			}
+			if opts.SBOMGenerator = generator; disabled {
+				opts.SBOMGenerator = ""
+			}
+		default:
+			return nil, opts, errors.Errorf("unsupported attestation type %q", typ)
+		}
+	}
+	return refs, opts, nil
+}
+
+// AttestationShorthand returns the --attest value of the --sbom or
+// --provenance flag of typ set to value, a boolean or the attributes of the
+// attestation
+func AttestationShorthand(typ, value string) string {
+	if b, err := strconv.ParseBool(value); err == nil {
+		if b {
+			return "type=" + typ
+		}
+		return "type=" + typ + ",disabled=true"
+	}
+	return "type=" + typ + "," + value
+}
+
+func parseCustomAttestation(s string, attrs map[string]string) (imagetools.Referrer, error) {
+	file, predicateType := attrs["predicate"], attrs["predicatetype"]
+	delete(attrs, "predicate")
+	delete(attrs, "predicatetype")
+	if err := unexpectedAttestationKeys(s, attrs); err != nil {
+		return imagetools.Referrer{}, err
+	}
+	if file == "" || predicateType == "" {
+		return imagetools.Referrer{}, errors.Errorf("invalid attestation %q, predicate and predicateType are required", s)
+	}
+	if u, err := url.Parse(predicateType); err != nil || u.Scheme == "" {
+		return imagetools.Referrer{}, errors.Errorf("invalid predicateType %q, it must be a URI", predicateType)
+	}
+	dt, err := ioutil.ReadFile(file)
+	if err != nil {
+		return imagetools.Referrer{}, errors.Wrap(err, "failed to read predicate")
+	}
+	if !json.Valid(dt) {
+		return imagetools.Referrer{}, errors.Errorf("predicate %s is not JSON", file)
+	}
+	return imagetools.Referrer{
+		ArtifactType: imagetools.ArtifactTypeInToto,
+		Data:         dt,
+		Annotations:  map[string]string{AnnotationPredicateType: predicateType},
+	}, nil
+}
+
+func unexpectedAttestationKeys(s string, attrs map[string]string) error {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return errors.Errorf("unexpected key '%s' in '%s'", keys[0], s)
+}
+
+// isCustomAttestation reports if ref is the bare predicate of an attestation
+// attached with --attest
+func isCustomAttestation(ref imagetools.Referrer) bool {
+	return ref.Annotations[AnnotationPredicateType] != ""
+}
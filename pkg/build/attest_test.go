@@ -0,0 +1,97 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+func Test_ParseAttestations(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "attest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	predicate := filepath.Join(dir, "tests.json")
+	require.NoError(t, ioutil.WriteFile(predicate, []byte(`{"passed":12,"failed":0}`), 0644))
+	notJSON := filepath.Join(dir, "tests.txt")
+	require.NoError(t, ioutil.WriteFile(notJSON, []byte("12 passed"), 0644))
+
+	refs, generated, err := ParseAttestations([]string{"type=custom,predicate=" + predicate + ",predicateType=https://example.com/test-results/v1"})
+	require.NoError(t, err)
+	assert.False(t, generated.Enabled())
+	require.Len(t, refs, 1)
+	assert.Equal(t, imagetools.ArtifactTypeInToto, refs[0].ArtifactType)
+	assert.Equal(t, "https://example.com/test-results/v1", refs[0].Annotations[AnnotationPredicateType])
+	assert.Equal(t, []byte(`{"passed":12,"failed":0}`), refs[0].Data)
+
+	for _, s := range []string{
+		"type=sbom,predicate=" + predicate + ",predicateType=https://example.com/test-results/v1",
+		"type=custom,predicateType=https://example.com/test-results/v1",
+		"type=custom,predicate=" + predicate,
+		"type=custom,predicate=" + predicate + ",predicateType=test-results",
+		"type=custom,predicate=" + notJSON + ",predicateType=https://example.com/test-results/v1",
+		"type=custom,predicate=" + filepath.Join(dir, "missing") + ",predicateType=https://example.com/test-results/v1",
+		"type=custom,file=" + predicate + ",predicateType=https://example.com/test-results/v1",
+		"type=provenance,mode=full",
+		"type=provenance,generator=example/scanner",
+		"type=sbom,mode=max",
+		"type=sbom,generator=Invalid Image",
+		"type=sbom,disabled=maybe",
+	} {
+		_, _, err := ParseAttestations([]string{s})
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_ParseAttestationsGenerated(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		in       []string
+		expected AttestationOpts
+	}{
+		{in: []string{"type=provenance"}, expected: AttestationOpts{Provenance: ProvenanceModeMin}},
+		{in: []string{"type=provenance,mode=max"}, expected: AttestationOpts{Provenance: ProvenanceModeMax}},
+		{in: []string{"type=sbom"}, expected: AttestationOpts{SBOMGenerator: DefaultSBOMGenerator}},
+		{in: []string{"type=sbom,generator=registry.example.com/scanner:v1"}, expected: AttestationOpts{SBOMGenerator: "registry.example.com/scanner:v1"}},
+		{in: []string{"type=sbom", AttestationShorthand("sbom", "false")}, expected: AttestationOpts{}},
+		{in: []string{AttestationShorthand("sbom", "true"), AttestationShorthand("provenance", "mode=max")}, expected: AttestationOpts{Provenance: ProvenanceModeMax, SBOMGenerator: DefaultSBOMGenerator}},
+	} {
+		refs, generated, err := ParseAttestations(tc.in)
+		require.NoError(t, err, tc.in)
+		assert.Empty(t, refs, tc.in)
+		assert.Equal(t, tc.expected, generated, tc.in)
+	}
+}
+
+func Test_statementReferrers(t *testing.T) {
+	t.Parallel()
+	dgst := digest.FromString("image")
+	opt := Options{
+		Tags: []string{"registry.example.com/app:v1"},
+		Referrers: []imagetools.Referrer{
+			{ArtifactType: imagetools.ArtifactTypeSPDX, Data: []byte(`{"spdxVersion":"SPDX-2.2"}`)},
+			{ArtifactType: imagetools.ArtifactTypeInToto, Data: []byte(`{"passed":12}`), Annotations: map[string]string{AnnotationPredicateType: "https://example.com/test-results/v1"}},
+		},
+	}
+	refs, err := statementReferrers(opt, dgst.String())
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	assert.Equal(t, opt.Referrers[0], refs[0], "only custom attestations are wrapped")
+
+	var st inTotoStatement
+	require.NoError(t, json.Unmarshal(refs[1].Data, &st))
+	assert.Equal(t, InTotoStatementType, st.Type)
+	assert.Equal(t, "https://example.com/test-results/v1", st.PredicateType)
+	assert.Equal(t, []inTotoSubject{{Name: "registry.example.com/app:v1", Digest: map[string]string{"sha256": dgst.Encoded()}}}, st.Subject)
+	assert.JSONEq(t, `{"passed":12}`, string(st.Predicate))
+	assert.Equal(t, []byte(`{"passed":12}`), opt.Referrers[1].Data, "the options are left as they were")
+}
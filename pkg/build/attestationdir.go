@@ -0,0 +1,149 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+// Pipelines archiving the attestations of their images separately from the
+// registry get them written as in-toto statements, one file per attestation,
+// about the image digest the build produced.  Attestations already in-toto
+// statements are written as attached, the other JSON artifacts are the
+// predicate of a statement of their type.  Signatures aren't attestations and
+// are left out.
+
+// InTotoStatementType is the type of the in-toto statements written
+const InTotoStatementType = "https://in-toto.io/Statement/v0.1"
+
+// PredicateTypeSPDX is the in-toto predicate type of SPDX SBOMs
+const PredicateTypeSPDX = "https://spdx.dev/Document"
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// attestationFileRe matches the characters kept in attestation file names
+var attestationFileRe = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// WriteAttestations writes the attestations attached to the image of opt to
+// dir, and returns the files written
+func WriteAttestations(dir string, opt Options, res *client.SolveResponse) ([]string, error) {
+	if len(opt.Referrers) == 0 {
+		return nil, nil
+	}
+	if res == nil || res.ExporterResponse["containerimage.digest"] == "" {
+		return nil, errors.Errorf("the build didn't report the digest of its image")
+	}
+	dgst, err := digest.Parse(res.ExporterResponse["containerimage.digest"])
+	if err != nil {
+		return nil, err
+	}
+	subjects := attestationSubjects(opt, dgst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var files []string
+	used := map[string]int{}
+	for _, ref := range opt.Referrers {
+		var name string
+		switch ref.ArtifactType {
+		case imagetools.ArtifactTypeNotarySignature, imagetools.ArtifactTypeCosignSignature:
+			continue
+		case imagetools.ArtifactTypeSPDX:
+			name = "sbom"
+		case imagetools.ArtifactTypeInToto:
+			name = "provenance"
+			if isCustomAttestation(ref) {
+				name = attestationFileRe.ReplaceAllString(strings.TrimPrefix(strings.TrimPrefix(ref.Annotations[AnnotationPredicateType], "https://"), "http://"), "-")
+			}
+		default:
+			name = attestationFileRe.ReplaceAllString(ref.ArtifactType, "-")
+		}
+		dt, err := inTotoAttestation(ref, subjects)
+		if err != nil {
+			return files, err
+		}
+		used[name]++
+		if used[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, used[name])
+		}
+		file := filepath.Join(dir, name+".intoto.json")
+		if err := ioutil.WriteFile(file, dt, 0644); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// attestationSubjects are the names the image of opt is tagged with, at dgst
+func attestationSubjects(opt Options, dgst digest.Digest) []inTotoSubject {
+	names := append([]string{}, opt.Tags...)
+	for _, e := range opt.Exports {
+		if e.Type == "image" && e.Attrs["name"] != "" {
+			names = append(names, strings.Split(e.Attrs["name"], ",")...)
+		}
+	}
+	if len(names) == 0 {
+		// The statement needs a subject name, an untagged image only has its digest
+		names = []string{dgst.String()}
+	}
+	res := make([]inTotoSubject, 0, len(names))
+	seen := map[string]struct{}{}
+	for _, n := range names {
+		if _, ok := seen[n]; ok {
+			continue
+		}
+		seen[n] = struct{}{}
+		res = append(res, inTotoSubject{
+			Name:   n,
+			Digest: map[string]string{dgst.Algorithm().String(): dgst.Encoded()},
+		})
+	}
+	return res
+}
+
+// inTotoAttestation returns the referrer as an in-toto statement about the
+// subjects, the referrer itself if it is one
+func inTotoAttestation(ref imagetools.Referrer, subjects []inTotoSubject) ([]byte, error) {
+	var st inTotoStatement
+	if err := json.Unmarshal(ref.Data, &st); err == nil && st.Type != "" && st.PredicateType != "" && !isCustomAttestation(ref) {
+		return ref.Data, nil
+	}
+	if !json.Valid(ref.Data) {
+		return nil, errors.Errorf("the %s attestation is not JSON, it can't be written as an in-toto statement", ref.ArtifactType)
+	}
+	predicateType := ref.ArtifactType
+	switch {
+	case isCustomAttestation(ref):
+		predicateType = ref.Annotations[AnnotationPredicateType]
+	case ref.ArtifactType == imagetools.ArtifactTypeSPDX:
+		predicateType = PredicateTypeSPDX
+	}
+	return json.MarshalIndent(inTotoStatement{
+		Type:          InTotoStatementType,
+		PredicateType: predicateType,
+		Subject:       subjects,
+		Predicate:     ref.Data,
+	}, "", "  ")
+}
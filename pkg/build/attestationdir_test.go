@@ -0,0 +1,65 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+func Test_WriteAttestations(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "attestations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dgst := digest.FromString("image")
+	statement := `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","subject":[],"predicate":{}}`
+	opt := Options{
+		Tags: []string{"registry.example.com/app:v1"},
+		Referrers: []imagetools.Referrer{
+			{ArtifactType: imagetools.ArtifactTypeSPDX, Data: []byte(`{"spdxVersion":"SPDX-2.2"}`)},
+			{ArtifactType: imagetools.ArtifactTypeInToto, Data: []byte(statement)},
+			{ArtifactType: imagetools.ArtifactTypeCosignSignature, Data: []byte("signature")},
+			{ArtifactType: "application/vnd.example.tests+json", Data: []byte(`{"passed":12}`)},
+			{ArtifactType: imagetools.ArtifactTypeInToto, Data: []byte(`{"licenses":["Apache-2.0"]}`), Annotations: map[string]string{AnnotationPredicateType: "https://example.com/license-scan/v1"}},
+		},
+	}
+	files, err := WriteAttestations(dir, opt, &client.SolveResponse{ExporterResponse: map[string]string{"containerimage.digest": dgst.String()}})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "sbom.intoto.json"),
+		filepath.Join(dir, "provenance.intoto.json"),
+		filepath.Join(dir, "application-vnd-example-tests-json.intoto.json"),
+		filepath.Join(dir, "example-com-license-scan-v1.intoto.json"),
+	}, files)
+
+	dt, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	var st inTotoStatement
+	require.NoError(t, json.Unmarshal(dt, &st))
+	require.Equal(t, InTotoStatementType, st.Type)
+	require.Equal(t, PredicateTypeSPDX, st.PredicateType)
+	require.Equal(t, []inTotoSubject{{Name: "registry.example.com/app:v1", Digest: map[string]string{"sha256": dgst.Encoded()}}}, st.Subject)
+	require.JSONEq(t, `{"spdxVersion":"SPDX-2.2"}`, string(st.Predicate))
+
+	dt, err = ioutil.ReadFile(files[1])
+	require.NoError(t, err)
+	require.Equal(t, statement, string(dt), "already a statement")
+
+	dt, err = ioutil.ReadFile(files[3])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(dt, &st))
+	require.Equal(t, "https://example.com/license-scan/v1", st.PredicateType)
+
+	opt.Referrers = []imagetools.Referrer{{ArtifactType: "application/vnd.example.scan", Data: []byte("not json")}}
+	_, err = WriteAttestations(dir, opt, &client.SolveResponse{ExporterResponse: map[string]string{"containerimage.digest": dgst.String()}})
+	require.Error(t, err)
+}
@@ -0,0 +1,392 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// A bake file defines the images of a project as targets, and groups of
+// targets built together.  The targets are read from the JSON format of
+// docker buildx bake, which is also what `docker buildx bake --print` prints
+// for an HCL file, or from the build sections of the services of a compose
+// file.  Each target is an independent build, and a bake runs them all at
+// once so the builder's pods share them.
+
+// BakeDefaultFiles are the bake files read when none is given, those found
+// are merged in order
+var BakeDefaultFiles = []string{
+	"docker-compose.yml",
+	"docker-compose.yaml",
+	"docker-bake.json",
+	"docker-bake.override.json",
+}
+
+// BakeConfig are the groups and targets of bake files
+type BakeConfig struct {
+	Groups  map[string]*BakeGroup  `json:"group,omitempty"`
+	Targets map[string]*BakeTarget `json:"target"`
+}
+
+// BakeGroup names targets, or other groups, built together
+type BakeGroup struct {
+	Targets []string `json:"targets"`
+}
+
+// BakeTarget is the build of an image, the fields it leaves empty are
+// inherited from the targets it Inherits
+type BakeTarget struct {
+	Inherits         []string          `json:"inherits,omitempty"`
+	Context          string            `json:"context,omitempty"`
+	Dockerfile       string            `json:"dockerfile,omitempty"`
+	DockerfileInline string            `json:"dockerfile-inline,omitempty"`
+	Args             map[string]string `json:"args,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	Target           string            `json:"target,omitempty"`
+	Platforms        []string          `json:"platforms,omitempty"`
+	CacheFrom        []string          `json:"cache-from,omitempty"`
+	CacheTo          []string          `json:"cache-to,omitempty"`
+	Secrets          []string          `json:"secret,omitempty"`
+	SSH              []string          `json:"ssh,omitempty"`
+	Outputs          []string          `json:"output,omitempty"`
+	Pull             *bool             `json:"pull,omitempty"`
+	NoCache          *bool             `json:"no-cache,omitempty"`
+}
+
+// ReadBakeFiles reads and merges the bake files, later files override the
+// targets of earlier ones
+func ReadBakeFiles(files []string) (*BakeConfig, error) {
+	res := &BakeConfig{Groups: map[string]*BakeGroup{}, Targets: map[string]*BakeTarget{}}
+	for _, f := range files {
+		dt, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		c, err := ParseBakeFile(f, dt)
+		if err != nil {
+			return nil, err
+		}
+		for name, g := range c.Groups {
+			res.Groups[name] = g
+		}
+		for name, t := range c.Targets {
+			if prev, ok := res.Targets[name]; ok {
+				mergeBakeTarget(prev, t)
+				continue
+			}
+			res.Targets[name] = t
+		}
+	}
+	return res, nil
+}
+
+// ParseBakeFile parses the bake file named filename, by its extension
+func ParseBakeFile(filename string, dt []byte) (*BakeConfig, error) {
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".hcl":
+		return nil, errors.Errorf("%s: HCL bake files are not supported, convert it with `docker buildx bake -f %s --print > docker-bake.json`", filename, filename)
+	case ".yml", ".yaml":
+		c, err := parseCompose(filepath.Dir(filename), dt)
+		return c, errors.Wrapf(err, "failed to parse compose file %s", filename)
+	}
+	var c BakeConfig
+	if err := json.Unmarshal(dt, &c); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse bake file %s", filename)
+	}
+	return &c, nil
+}
+
+// Resolve returns the targets named, expanding the groups and inheritance.
+// Without names the "default" group is built, all targets if there is none.
+func (c *BakeConfig) Resolve(names []string) (map[string]*BakeTarget, error) {
+	if len(names) == 0 {
+		if _, ok := c.Groups["default"]; ok {
+			names = []string{"default"}
+		} else if _, ok := c.Targets["default"]; ok {
+			names = []string{"default"}
+		} else {
+			for name := range c.Targets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.Errorf("no targets to build")
+	}
+	res := map[string]*BakeTarget{}
+	if err := c.resolveNames(names, res, map[string]bool{}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *BakeConfig) resolveNames(names []string, res map[string]*BakeTarget, groups map[string]bool) error {
+	for _, name := range names {
+		if g, ok := c.Groups[name]; ok {
+			if groups[name] {
+				return errors.Errorf("group %s includes itself", name)
+			}
+			groups[name] = true
+			if err := c.resolveNames(g.Targets, res, groups); err != nil {
+				return err
+			}
+			delete(groups, name)
+			continue
+		}
+		if _, ok := res[name]; ok {
+			continue
+		}
+		t, err := c.resolveTarget(name, map[string]bool{})
+		if err != nil {
+			return err
+		}
+		res[name] = t
+	}
+	return nil
+}
+
+// resolveTarget returns the target name with the fields it inherits
+func (c *BakeConfig) resolveTarget(name string, visited map[string]bool) (*BakeTarget, error) {
+	t, ok := c.Targets[name]
+	if !ok {
+		return nil, errors.Errorf("target %s not found", name)
+	}
+	if visited[name] {
+		return nil, errors.Errorf("target %s inherits from itself", name)
+	}
+	visited[name] = true
+	res := &BakeTarget{}
+	for _, parent := range t.Inherits {
+		p, err := c.resolveTarget(parent, visited)
+		if err != nil {
+			return nil, err
+		}
+		mergeBakeTarget(res, p)
+	}
+	mergeBakeTarget(res, t)
+	res.Inherits = nil
+	delete(visited, name)
+	return res, nil
+}
+
+// mergeBakeTarget overrides the fields of dst set by src, the args and
+// labels are merged
+func mergeBakeTarget(dst, src *BakeTarget) {
+	if len(src.Inherits) > 0 {
+		dst.Inherits = src.Inherits
+	}
+	if src.Context != "" {
+		dst.Context = src.Context
+	}
+	if src.Dockerfile != "" {
+		dst.Dockerfile = src.Dockerfile
+	}
+	if src.DockerfileInline != "" {
+		dst.DockerfileInline = src.DockerfileInline
+	}
+	for k, v := range src.Args {
+		if dst.Args == nil {
+			dst.Args = map[string]string{}
+		}
+		dst.Args[k] = v
+	}
+	for k, v := range src.Labels {
+		if dst.Labels == nil {
+			dst.Labels = map[string]string{}
+		}
+		dst.Labels[k] = v
+	}
+	if src.Target != "" {
+		dst.Target = src.Target
+	}
+	for _, f := range []struct{ dst, src *[]string }{
+		{&dst.Tags, &src.Tags},
+		{&dst.Platforms, &src.Platforms},
+		{&dst.CacheFrom, &src.CacheFrom},
+		{&dst.CacheTo, &src.CacheTo},
+		{&dst.Secrets, &src.Secrets},
+		{&dst.SSH, &src.SSH},
+		{&dst.Outputs, &src.Outputs},
+	} {
+		if len(*f.src) > 0 {
+			*f.dst = *f.src
+		}
+	}
+	if src.Pull != nil {
+		dst.Pull = src.Pull
+	}
+	if src.NoCache != nil {
+		dst.NoCache = src.NoCache
+	}
+}
+
+// Options returns the build options of the target, its secrets and ssh
+// agents are attached to the session of the build
+func (t *BakeTarget) Options() (Options, error) {
+	contextPath := t.Context
+	if contextPath == "" {
+		contextPath = "."
+	}
+	opt := Options{
+		Inputs: Inputs{
+			ContextPath:      contextPath,
+			DockerfileInline: t.DockerfileInline,
+		},
+		Tags:      t.Tags,
+		Labels:    t.Labels,
+		BuildArgs: t.Args,
+		Target:    t.Target,
+	}
+	if t.Dockerfile != "" && t.DockerfileInline == "" {
+		// Relative to the context, as with docker buildx bake
+		opt.Inputs.DockerfilePath = t.Dockerfile
+		if !filepath.IsAbs(t.Dockerfile) && isLocalDir(contextPath) && !isRemoteDockerfile(t.Dockerfile) {
+			opt.Inputs.DockerfilePath = filepath.Join(contextPath, t.Dockerfile)
+		}
+	}
+	if t.Pull != nil && *t.Pull {
+		opt.PullPolicy = PullAlways
+	}
+	if t.NoCache != nil {
+		opt.NoCache = *t.NoCache
+	}
+	var err error
+	if opt.Platforms, err = platformutil.Parse(t.Platforms); err != nil {
+		return opt, err
+	}
+	if opt.CacheFrom, err = ParseCacheEntry(t.CacheFrom); err != nil {
+		return opt, err
+	}
+	if opt.CacheTo, err = ParseCacheEntry(t.CacheTo); err != nil {
+		return opt, err
+	}
+	if opt.Exports, err = ParseOutputs(t.Outputs); err != nil {
+		return opt, err
+	}
+	if len(opt.Exports) > 1 {
+		return opt, errors.Errorf("only one output is supported per target")
+	}
+	secrets, err := ParseSecretSpecs(t.Secrets, nil)
+	if err != nil {
+		return opt, err
+	}
+	ssh, err := ParseSSHSpecs(t.SSH)
+	if err != nil {
+		return opt, err
+	}
+	opt.Session = append(opt.Session, secrets, ssh)
+	return opt, nil
+}
+
+// composeFile are the parts of a compose file describing image builds
+type composeFile struct {
+	Services map[string]struct {
+		Image string        `json:"image"`
+		Build *composeBuild `json:"build"`
+	} `json:"services"`
+}
+
+type composeBuild struct {
+	Context    string        `json:"context"`
+	Dockerfile string        `json:"dockerfile"`
+	Args       composeValues `json:"args"`
+	Labels     composeValues `json:"labels"`
+	Target     string        `json:"target"`
+	CacheFrom  []string      `json:"cache_from"`
+	CacheTo    []string      `json:"cache_to"`
+	Tags       []string      `json:"tags"`
+	Platforms  []string      `json:"platforms"`
+}
+
+// UnmarshalJSON accepts the short syntax of build, the context alone
+func (b *composeBuild) UnmarshalJSON(dt []byte) error {
+	var context string
+	if err := json.Unmarshal(dt, &context); err == nil {
+		*b = composeBuild{Context: context}
+		return nil
+	}
+	type build composeBuild
+	return json.Unmarshal(dt, (*build)(b))
+}
+
+// composeValues are the args or labels of a compose build, a map or a list
+// of KEY=VALUE
+type composeValues map[string]string
+
+func (v *composeValues) UnmarshalJSON(dt []byte) error {
+	var list []string
+	if err := json.Unmarshal(dt, &list); err == nil {
+		*v = composeValues{}
+		for _, kv := range list {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) == 1 {
+				// Unset, taken from the environment by compose
+				continue
+			}
+			(*v)[parts[0]] = parts[1]
+		}
+		return nil
+	}
+	var m map[string]*string
+	if err := json.Unmarshal(dt, &m); err != nil {
+		return err
+	}
+	*v = composeValues{}
+	for k, s := range m {
+		if s != nil {
+			(*v)[k] = *s
+		}
+	}
+	return nil
+}
+
+// parseCompose returns a target for each service of a compose file built
+// from a context, paths are relative to the directory dir of the file
+func parseCompose(dir string, dt []byte) (*BakeConfig, error) {
+	js, err := yaml.ToJSON(dt)
+	if err != nil {
+		return nil, err
+	}
+	var f composeFile
+	if err := json.Unmarshal(js, &f); err != nil {
+		return nil, err
+	}
+	c := &BakeConfig{Targets: map[string]*BakeTarget{}}
+	for name, s := range f.Services {
+		if s.Build == nil {
+			continue
+		}
+		t := &BakeTarget{
+			Context:    s.Build.Context,
+			Dockerfile: s.Build.Dockerfile,
+			Args:       s.Build.Args,
+			Labels:     s.Build.Labels,
+			Target:     s.Build.Target,
+			CacheFrom:  s.Build.CacheFrom,
+			CacheTo:    s.Build.CacheTo,
+			Platforms:  s.Build.Platforms,
+		}
+		if t.Context == "" {
+			t.Context = "."
+		}
+		if !filepath.IsAbs(t.Context) && isLocalDir(filepath.Join(dir, t.Context)) {
+			t.Context = filepath.Join(dir, t.Context)
+		}
+		if s.Image != "" {
+			t.Tags = append(t.Tags, s.Image)
+		}
+		t.Tags = append(t.Tags, s.Build.Tags...)
+		c.Targets[name] = t
+	}
+	return c, nil
+}
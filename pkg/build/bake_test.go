@@ -0,0 +1,117 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testBakeFile = `{
+  "group": {
+    "default": {"targets": ["api", "web"]},
+    "all": {"targets": ["default", "tools"]}
+  },
+  "target": {
+    "_common": {"args": {"GO_VERSION": "1.16"}, "platforms": ["linux/amd64"]},
+    "api": {"inherits": ["_common"], "context": "api", "tags": ["registry.example.com/api:v1"]},
+    "web": {"inherits": ["_common"], "context": "web", "dockerfile": "build/Dockerfile", "args": {"NODE_VERSION": "14"}},
+    "tools": {"context": "tools", "target": "tools"}
+  }
+}`
+
+func Test_BakeConfigResolve(t *testing.T) {
+	t.Parallel()
+	c, err := ParseBakeFile("docker-bake.json", []byte(testBakeFile))
+	require.NoError(t, err)
+
+	targets, err := c.Resolve(nil)
+	require.NoError(t, err)
+	require.Len(t, targets, 2)
+	require.Equal(t, "api", targets["api"].Context)
+	require.Equal(t, map[string]string{"GO_VERSION": "1.16"}, targets["api"].Args)
+	require.Equal(t, []string{"linux/amd64"}, targets["api"].Platforms)
+	require.Equal(t, map[string]string{"GO_VERSION": "1.16", "NODE_VERSION": "14"}, targets["web"].Args)
+	require.Empty(t, targets["web"].Inherits)
+
+	targets, err = c.Resolve([]string{"all"})
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+	require.Equal(t, "tools", targets["tools"].Target)
+
+	_, err = c.Resolve([]string{"missing"})
+	require.Error(t, err)
+
+	c.Targets["_common"].Inherits = []string{"api"}
+	_, err = c.Resolve([]string{"api"})
+	require.Error(t, err, "inheritance cycle")
+}
+
+func Test_BakeTargetOptions(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "bake")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	noCache := true
+	opt, err := (&BakeTarget{
+		Context:    dir,
+		Dockerfile: "build/Dockerfile",
+		Tags:       []string{"app:v1"},
+		Platforms:  []string{"linux/arm64"},
+		CacheFrom:  []string{"type=registry,ref=app:cache"},
+		Outputs:    []string{"type=image,push=true"},
+		NoCache:    &noCache,
+	}).Options()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "build", "Dockerfile"), opt.Inputs.DockerfilePath)
+	require.Equal(t, "arm64", opt.Platforms[0].Architecture)
+	require.Equal(t, "registry", opt.CacheFrom[0].Type)
+	require.Equal(t, "image", opt.Exports[0].Type)
+	require.True(t, opt.NoCache)
+	require.Len(t, opt.Session, 2)
+
+	_, err = (&BakeTarget{Platforms: []string{"linux/arm64/v8/extra"}}).Options()
+	require.Error(t, err)
+}
+
+func Test_ParseBakeFileCompose(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "compose")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "api"), 0755))
+	compose := `
+services:
+  api:
+    image: registry.example.com/api:v1
+    build:
+      context: ./api
+      dockerfile: Dockerfile.prod
+      args:
+        - VERSION=1
+        - UNSET
+      labels:
+        team: backend
+  web:
+    build: ./web
+  db:
+    image: postgres:13
+`
+	c, err := ParseBakeFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose))
+	require.NoError(t, err)
+	require.Len(t, c.Targets, 2)
+	api := c.Targets["api"]
+	require.Equal(t, filepath.Join(dir, "api"), api.Context)
+	require.Equal(t, "Dockerfile.prod", api.Dockerfile)
+	require.Equal(t, map[string]string{"VERSION": "1"}, api.Args)
+	require.Equal(t, map[string]string{"team": "backend"}, api.Labels)
+	require.Equal(t, []string{"registry.example.com/api:v1"}, api.Tags)
+	require.Equal(t, "./web", c.Targets["web"].Context, "not a local directory")
+
+	_, err = ParseBakeFile("docker-bake.hcl", []byte(`target "api" {}`))
+	require.Error(t, err)
+}
@@ -4,6 +4,7 @@ package build
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -15,6 +16,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/images"
@@ -35,6 +38,7 @@ import (
 	"github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -48,10 +52,14 @@ type Options struct {
 	Tags        []string
 	Labels      map[string]string
 	BuildArgs   map[string]string
-	Pull        bool
+	PullPolicy  string
 	ImageIDFile string
 	ExtraHosts  []string
 	NetworkMode string
+	// CgroupParent is the parent cgroup used for RUN containers on the builder
+	CgroupParent string
+	// Limits limit the RUN containers of the build, see BuildLimits
+	Limits *BuildLimits
 
 	NoCache   bool
 	Target    string
@@ -65,12 +73,53 @@ type Options struct {
 	Allow []entitlements.Entitlement
 	// DockerTarget
 	FrontendImage string
+	// FrontendOpts are passed through to the frontend verbatim and take
+	// precedence over any attributes derived from other options
+	FrontendOpts map[string]string
+	// Priority orders this build in the builder's queue, higher runs first
+	Priority int
+
+	// Referrers are attached to the pushed image, stored as selected by ReferrersMode
+	Referrers     []imagetools.Referrer
+	ReferrersMode string
+	// Extracts are copied from their stages to local destinations in the same solve
+	Extracts []Extract
+	// Squash exports the image with its whole filesystem in a single layer
+	Squash bool
+	// ReplicateContext also uploads the build context to a standby builder pod during the build
+	ReplicateContext bool
+	// RunCacheProject keys the persisted RUN cache mounts on builders using the project scope
+	RunCacheProject string
+	// HostMounts mount host paths allowed by the builder in the RUN instructions
+	HostMounts []HostMount
+	// ScratchSize is the scratch space the build needs on the builder pod, see checkScratchSize
+	ScratchSize string
+	// BuildID identifies the build in the logs and events of the builder
+	BuildID string
+	// Capacity fails the build before solving on a builder pod without the space it needs, see checkCapacity
+	Capacity *CapacityCheck
+	// LoadTo loads the image on more nodes than those of the builder pods, see ParseLoadTo
+	LoadTo *LoadTo
 }
 
 type Inputs struct {
 	ContextPath    string
 	DockerfilePath string
-	InStream       io.Reader
+	// DockerfileChecksum pins the content of a DockerfilePath URL
+	DockerfileChecksum string
+	// DockerfileInline is the Dockerfile content, instead of DockerfilePath
+	DockerfileInline string
+	InStream         io.Reader
+	SourcePolicy     *SourcePolicy
+	// Lockfile pins the base images, after the SourcePolicy
+	Lockfile *Lockfile
+	// DNS is the resolver of the RUN instructions, served by the secrets of the Session
+	DNS *DNSConfig
+	// Cached pins the base images to the records of the cache of the builder
+	// pod, for PullNever
+	Cached []*client.UsageInfo
+	// NamedContexts are the --build-context contexts by name, see ParseNamedContexts
+	NamedContexts map[string]string
 }
 
 type DriverInfo struct {
@@ -101,6 +150,12 @@ type driverPair struct {
 	driverIndex int
 	platforms   []specs.Platform
 	so          *client.SolveOpt
+	// runCache persists the RUN cache mounts of the build if the builder is configured to
+	runCache *runCache
+	// hostMounts are synced to the builder pod before the build
+	hostMounts *hostMounts
+	// info of the driver, read once per build
+	info *driver.Info
 }
 
 func driverIndexes(m map[string][]driverPair) []int {
@@ -126,7 +181,30 @@ func allIndexes(l int) []int {
 	return out
 }
 
-func ensureBooted(ctx context.Context, drivers []DriverInfo, idxs []int, pw progress.Writer) (map[string]map[string]*client.Client, error) {
+// driverPlatforms returns the platforms each driver builds
+func driverPlatforms(m map[string][]driverPair) map[int][]specs.Platform {
+	res := map[int][]specs.Platform{}
+	seen := map[int]map[string]struct{}{}
+	for _, dps := range m {
+		for _, dp := range dps {
+			if seen[dp.driverIndex] == nil {
+				seen[dp.driverIndex] = map[string]struct{}{}
+			}
+			for _, p := range dp.platforms {
+				k := platforms.Format(p)
+				if _, ok := seen[dp.driverIndex][k]; !ok {
+					seen[dp.driverIndex][k] = struct{}{}
+					res[dp.driverIndex] = append(res[dp.driverIndex], p)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// ensureBooted boots the drivers, choosing the builder nodes of each able to
+// build its platforms natively when they have some
+func ensureBooted(ctx context.Context, drivers []DriverInfo, idxs []int, platformsByDriver map[int][]specs.Platform, pw progress.Writer) (map[string]map[string]*client.Client, error) {
 	lock := sync.Mutex{}
 	clients := map[string]map[string]*client.Client{} // [driverName][chosenNodeName]
 	eg, ctx := errgroup.WithContext(ctx)
@@ -137,7 +215,7 @@ func ensureBooted(ctx context.Context, drivers []DriverInfo, idxs []int, pw prog
 		lock.Unlock()
 		func(i int) {
 			eg.Go(func() error {
-				builderClients, err := driver.Boot(ctx, drivers[i].Driver, pw)
+				builderClients, err := driver.Boot(driver.WithPlatforms(ctx, platformsByDriver[i]), drivers[i].Driver, pw)
 				if err != nil {
 					return err
 				}
@@ -202,7 +280,7 @@ func resolveDrivers(ctx context.Context, drivers []DriverInfo, opt map[string]Op
 		for k, opt := range opt {
 			m[k] = []driverPair{{driverIndex: 0, platforms: opt.Platforms}}
 		}
-		clients, err := ensureBooted(ctx, drivers, driverIndexes(m), pw)
+		clients, err := ensureBooted(ctx, drivers, driverIndexes(m), driverPlatforms(m), pw)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -212,7 +290,7 @@ func resolveDrivers(ctx context.Context, drivers []DriverInfo, opt map[string]Op
 	// map based on existing platforms
 	if !undetectedPlatform {
 		m := splitToDriverPairs(availablePlatforms, opt)
-		clients, err := ensureBooted(ctx, drivers, driverIndexes(m), pw)
+		clients, err := ensureBooted(ctx, drivers, driverIndexes(m), driverPlatforms(m), pw)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -220,7 +298,7 @@ func resolveDrivers(ctx context.Context, drivers []DriverInfo, opt map[string]Op
 	}
 
 	// boot all drivers in k
-	clients, err := ensureBooted(ctx, drivers, allIndexes(len(drivers)), pw)
+	clients, err := ensureBooted(ctx, drivers, allIndexes(len(drivers)), nil, pw)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -286,7 +364,7 @@ func toRepoOnly(in string) (string, error) {
 }
 
 // TODO - this could use some optimization...
-func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Options, dl dockerLoadCallback) (solveOpt *client.SolveOpt, release func(), err error) {
+func toSolveOpt(ctx context.Context, d driver.Driver, info *driver.Info, multiDriver bool, opt Options, dl dockerLoadCallback) (solveOpt *client.SolveOpt, release func(), err error) {
 	defers := make([]func(), 0, 2)
 	releaseF := func() {
 		for _, f := range defers {
@@ -310,6 +388,10 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 		}
 	}
 
+	if len(opt.Extracts) > 0 && (multiDriver || len(opt.Platforms) > 1) {
+		return nil, nil, errors.Errorf("extract can't be used when building for multiple platforms")
+	}
+
 	// inline cache from build arg
 	if v, ok := opt.BuildArgs["BUILDKIT_INLINE_CACHE"]; ok {
 		if v, _ := strconv.ParseBool(v); v {
@@ -320,6 +402,13 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 		}
 	}
 
+	if info.SharedCache != "" {
+		// The options are shared by the builds on each driver
+		imports, exports := sharedCacheEntries(info.SharedCache, opt)
+		opt.CacheFrom = append(append([]client.CacheOptionsEntry{}, opt.CacheFrom...), imports...)
+		opt.CacheTo = append(append([]client.CacheOptionsEntry{}, opt.CacheTo...), exports...)
+	}
+
 	for _, e := range opt.CacheTo {
 		if e.Type != "inline" && !d.Features()[driver.CacheExport] {
 			return nil, nil, notSupported(d, driver.CacheExport)
@@ -375,23 +464,19 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 		}
 	}
 
-	// fill in image exporter names from tags
-	if len(opt.Tags) > 0 {
-		tags := make([]string, len(opt.Tags))
-		for i, tag := range opt.Tags {
-			ref, err := reference.Parse(tag)
-			if err != nil {
-				return nil, nil, errors.Wrapf(err, "invalid tag %q", tag)
-			}
-			tags[i] = ref.String()
-		}
-		for i, e := range opt.Exports {
-			switch e.Type {
-			case "image", "oci", "docker":
-				opt.Exports[i].Attrs["name"] = strings.Join(tags, ",")
+	for i, e := range opt.Exports {
+		if e.Type == ExporterPVC {
+			if opt.Exports[i], err = pvcExport(e, info.OutputClaims, info.OutputClaimDir); err != nil {
+				return nil, nil, err
 			}
 		}
-	} else {
+	}
+
+	// fill in image exporter names from tags
+	if err := NameOutputs(opt.Exports, opt.Tags); err != nil {
+		return nil, nil, err
+	}
+	if len(opt.Tags) == 0 {
 		for _, e := range opt.Exports {
 			if e.Type == "image" && e.Attrs["name"] == "" && e.Attrs["push"] != "" {
 				if ok, _ := strconv.ParseBool(e.Attrs["push"]); ok {
@@ -416,7 +501,9 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 			return nil, nil, notSupported(d, driver.OCIExporter)
 		}
 		if e.Type == "docker" {
-			if !driverFeatures[driver.DockerExporter] {
+			// A docker archive written to a file is exported by buildkitd
+			// alone, only loading it needs the docker runtime
+			if e.Output == nil && !driverFeatures[driver.DockerExporter] {
 				return nil, nil, notSupported(d, driver.DockerExporter)
 			}
 			// If the runtime is docker and we're not in
@@ -469,7 +556,7 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 			// TODO - figure out how to wire this up so the exporter output type is oci instead of image
 
 			// If an Output (file) is already specified, let it pass through
-			if e.Output == nil && multiNode {
+			if e.Output == nil && (multiNode || opt.LoadTo != nil) {
 				// TODO - Explore if there's a model to avoid having to transfer to the builder node
 				opt.Exports[i].Type = "oci" // TODO - this most likely means the image isn't saved locally too
 				w, cancel, err := dl("")
@@ -505,8 +592,8 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 	}
 	defers = append(defers, releaseLoad)
 
-	if opt.Pull {
-		so.FrontendAttrs["image-resolve-mode"] = "pull"
+	if mode := imageResolveMode(opt.PullPolicy); mode != "" {
+		so.FrontendAttrs["image-resolve-mode"] = mode
 	}
 	if opt.Target != "" {
 		so.FrontendAttrs["target"] = opt.Target
@@ -517,6 +604,11 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 	for k, v := range opt.BuildArgs {
 		so.FrontendAttrs["build-arg:"+k] = v
 	}
+	for k, v := range proxyArgs(info) {
+		if _, ok := opt.BuildArgs[k]; !ok {
+			so.FrontendAttrs["build-arg:"+k] = v
+		}
+	}
 	for k, v := range opt.Labels {
 		so.FrontendAttrs["label:"+k] = v
 	}
@@ -550,6 +642,18 @@ func toSolveOpt(ctx context.Context, d driver.Driver, multiDriver bool, opt Opti
 	}
 	so.FrontendAttrs["add-hosts"] = extraHosts
 
+	if opt.CgroupParent != "" {
+		so.FrontendAttrs["cgroup-parent"] = opt.CgroupParent
+	}
+
+	for k, v := range opt.FrontendOpts {
+		so.FrontendAttrs[k] = v
+	}
+
+	if err := checkEntitlements(info.AllowedEntitlements, so.AllowedEntitlements); err != nil {
+		return nil, nil, err
+	}
+
 	return &so, releaseF, nil
 }
 
@@ -558,16 +662,69 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 		return nil, errors.Errorf("driver required for build")
 	}
 
+	for _, o := range opt {
+		if HasPVCOutput(o.Exports) {
+			return nil, errors.Errorf("pvc outputs are written by builds running on the builder, use BuildDetached")
+		}
+	}
+
 	drivers, err = filterAvailableDrivers(drivers)
 	if err != nil {
 		return nil, errors.Wrapf(err, "no valid drivers found")
 	}
+	priority := 0
+	buildID := ""
+	for _, o := range opt {
+		if o.Priority > priority {
+			priority = o.Priority
+		}
+		buildID = o.BuildID
+	}
+	if buildID != "" {
+		ctx = driver.WithBuildID(ctx, buildID)
+	}
 	m, clients, err := resolveDrivers(ctx, drivers, opt, pw)
 	if err != nil {
 		close(pw.Status())
 		<-pw.Done()
 		return nil, err
 	}
+	if err := applyDefaultPlatform(ctx, drivers, clients, m, opt, pw); err != nil {
+		close(pw.Status())
+		<-pw.Done()
+		return nil, err
+	}
+
+	ctx, cancelPreempted := context.WithCancel(ctx)
+	defer cancelPreempted()
+	var preempted int32
+	for i, di := range drivers {
+		if sameDriver(drivers, i) {
+			continue
+		}
+		release, preemptedCh, err := waitForBuildSlot(ctx, di.Driver, buildID, priority, pw)
+		if err != nil {
+			close(pw.Status())
+			<-pw.Done()
+			return nil, err
+		}
+		defer release()
+		if preemptedCh != nil {
+			go func() {
+				select {
+				case <-preemptedCh:
+					atomic.StoreInt32(&preempted, 1)
+					cancelPreempted()
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+	defer func() {
+		if err != nil && atomic.LoadInt32(&preempted) == 1 {
+			err = driver.ErrPreempted
+		}
+	}()
 
 	defers := make([]func(), 0, 2)
 	defer func() {
@@ -579,28 +736,52 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 	}()
 
 	var auth imagetools.Auth
+	var authProvider session.Attachable
 
 	mw := progress.NewMultiWriter(pw)
 	eg, ctx := errgroup.WithContext(ctx)
+	infos := map[int]*driver.Info{}
 	for k, opt := range opt {
 		multiDriver := len(m[k]) > 1
 		for i, dp := range m[k] {
 			d := drivers[dp.driverIndex].Driver
 			driverName := drivers[dp.driverIndex].Name
 			opt.Platforms = dp.platforms
+			info, ok := infos[dp.driverIndex]
+			if !ok {
+				if info, err = d.Info(ctx); err != nil {
+					return nil, err
+				}
+				infos[dp.driverIndex] = info
+			}
+			m[k][i].info = info
 
 			// TODO - this is also messy and wont work for multi-driver scenarios (no that it's possible yet...)
 			if auth == nil {
 				auth = d.GetAuthWrapper(registrySecretName)
-				opt.Session = append(opt.Session, d.GetAuthProvider(registrySecretName, os.Stderr))
+				authProvider = d.GetAuthProvider(registrySecretName, os.Stderr)
 			}
-			so, release, err := toSolveOpt(ctx, d, multiDriver, opt, func(arg string) (io.WriteCloser, func(), error) {
+			// Every target needs the auth provider, not only the first one
+			sessionOpt := opt
+			sessionOpt.Session = append(opt.Session[:len(opt.Session):len(opt.Session)], authProvider)
+			if opt.PullPolicy == PullNever {
+				for _, c := range clients[driverName] {
+					du, err := c.DiskUsage(ctx)
+					if err != nil {
+						return nil, errors.Wrap(err, "failed to read the cache of the builder")
+					}
+					// Not nil, so the images are checked even if the cache is empty
+					sessionOpt.Inputs.Cached = append([]*client.UsageInfo{}, du...)
+					break
+				}
+			}
+			so, release, err := toSolveOpt(ctx, d, info, multiDriver, sessionOpt, func(arg string) (io.WriteCloser, func(), error) {
 				// Set up loader based on first found type (only 1 supported)
 				for _, entry := range opt.Exports {
 					if entry.Type == "docker" {
-						return newDockerLoader(ctx, d, kubeClientConfig, driverName, mw)
+						return newDockerLoader(ctx, d, kubeClientConfig, driverName, opt.LoadTo, mw)
 					} else if entry.Type == "oci" {
-						return newContainerdLoader(ctx, d, kubeClientConfig, driverName, mw)
+						return newContainerdLoader(ctx, d, kubeClientConfig, driverName, opt.LoadTo, mw)
 					}
 				}
 				// TODO - Push scenario?  (or is this a "not reached" scenario now?)
@@ -611,6 +792,18 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 			}
 			defers = append(defers, release)
 			m[k][i].so = so
+			if err := checkScratchSize(info, opt.ScratchSize); err != nil {
+				return nil, err
+			}
+			if m[k][i].runCache, err = newRunCache(info, opt, so); err != nil {
+				return nil, err
+			}
+			// After the run cache, which namespaces the cache mount IDs
+			m[k][i].hostMounts, release, err = newHostMounts(info, opt, so)
+			if err != nil {
+				return nil, err
+			}
+			defers = append(defers, release)
 		}
 	}
 
@@ -626,6 +819,8 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 			multiDriver := len(m[k]) > 1
 
 			res := make([]*client.SolveResponse, len(dps))
+			runCacheNodes := make([]string, len(dps))
+			runCachePlatforms := make([]*specs.Platform, len(dps))
 			wg := &sync.WaitGroup{}
 			wg.Add(len(dps))
 
@@ -641,17 +836,30 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 				default:
 				}
 
+				for i, dp := range dps {
+					if dp.runCache != nil && res[i] != nil {
+						// A failed save doesn't fail the build, the cache mounts are
+						// saved again by the next build
+						_ = writeRunCache(pw, "[internal] saving cache mounts", func() error {
+							return dp.runCache.save(ctx, drivers[dp.driverIndex].Driver, runCacheNodes[i], runCachePlatforms[i])
+						})
+					}
+				}
+
 				respMu.Lock()
 				resp[k] = res[0]
 				respMu.Unlock()
 				if len(res) == 1 {
 					if opt.ImageIDFile != "" {
-						return ioutil.WriteFile(opt.ImageIDFile, []byte(res[0].ExporterResponse["containerimage.digest"]), 0644)
+						if err := ioutil.WriteFile(opt.ImageIDFile, []byte(res[0].ExporterResponse["containerimage.digest"]), 0644); err != nil {
+							return err
+						}
 					}
-					return nil
+					return pushReferrers(ctx, pw, auth, pushedNames(dps[0].so.Exports), res[0], opt)
 				}
 
 				if pushNames != "" {
+					var merged *client.SolveResponse
 					progress.Write(pw, fmt.Sprintf("merging manifest list %s", pushNames), func() error {
 						descs := make([]specs.Descriptor, 0, len(res))
 
@@ -676,7 +884,9 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 								return err
 							}
 							if opt.ImageIDFile != "" {
-								return ioutil.WriteFile(opt.ImageIDFile, []byte(desc.Digest), 0644)
+								if err := ioutil.WriteFile(opt.ImageIDFile, []byte(desc.Digest), 0644); err != nil {
+									return err
+								}
 							}
 							itpush := imagetools.New(imagetools.Opt{
 								Auth: auth,
@@ -692,16 +902,18 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 								}
 							}
 
-							respMu.Lock()
-							resp[k] = &client.SolveResponse{
+							merged = &client.SolveResponse{
 								ExporterResponse: map[string]string{
 									"containerimage.digest": desc.Digest.String(),
 								},
 							}
+							respMu.Lock()
+							resp[k] = merged
 							respMu.Unlock()
 						}
 						return nil
 					})
+					return pushReferrers(ctx, pw, auth, strings.Split(pushNames, ","), merged, opt)
 				}
 				return nil
 			})
@@ -739,8 +951,9 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 
 					// TODO this is a little mess - could use some refactoring
 					var c *client.Client
-					for _, client := range clients[drivers[dp.driverIndex].Name] {
-						c = client
+					var node string
+					for n, client := range clients[drivers[dp.driverIndex].Name] {
+						c, node = client, n
 						break
 					}
 
@@ -756,8 +969,105 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 
 					eg.Go(func() error {
 						defer wg.Done()
-						rr, err := c.Solve(ctx, nil, so, statusCh)
+						d := drivers[dp.driverIndex].Driver
+						if opt.BuildID != "" {
+							if err := d.RecordBuild(ctx, node, opt.BuildID); err != nil {
+								logrus.Debug(err)
+							}
+						}
+						if err := checkCapabilities(ctx, c, node, opt, dp.platforms); err != nil {
+							return err
+						}
+						var before *CacheStats
+						if opt.Capacity != nil {
+							if err := writeRunCache(pw, "[internal] checking builder capacity", func() error {
+								return checkCapacity(ctx, d, node, opt.Capacity)
+							}); err != nil {
+								return err
+							}
+							before, _ = GetCacheStats(ctx, c, 0)
+						}
+						var native *specs.Platform
+						if dp.runCache != nil || dp.hostMounts != nil {
+							var err error
+							if native, err = nativePlatform(ctx, clients[drivers[dp.driverIndex].Name]); err != nil {
+								return err
+							}
+						}
+						if dp.hostMounts != nil {
+							if err := writeRunCache(pw, "[internal] syncing host paths", func() error {
+								return dp.hostMounts.sync(ctx, d, node, native)
+							}); err != nil {
+								return err
+							}
+						}
+						if dp.runCache != nil {
+							if err := writeRunCache(pw, "[internal] restoring cache mounts", func() error {
+								return dp.runCache.restore(ctx, d, node, native)
+							}); err != nil {
+								return err
+							}
+						}
+						limits := opt.Limits
+						if len(dp.info.BuildIOLimits) > 0 && opt.CgroupParent == "" {
+							limits = limits.withBuilderIO(dp.info.BuildIOLimits)
+						}
+						if limits.limited() {
+							var cgroup string
+							if err := writeRunCache(pw, "[internal] limiting the build resources", func() error {
+								var err error
+								cgroup, err = limitBuild(ctx, d, node, limits)
+								return err
+							}); err != nil {
+								return err
+							}
+							defer func() {
+								if err := unlimitBuild(context.Background(), d, node, cgroup); err != nil {
+									logrus.Debugf("failed to remove the cgroup of the build on %s: %s", node, err)
+								}
+							}()
+							attrs := make(map[string]string, len(so.FrontendAttrs)+1)
+							for k, v := range so.FrontendAttrs {
+								attrs[k] = v
+							}
+							attrs["cgroup-parent"] = cgroup
+							so.FrontendAttrs = attrs
+						}
+						if opt.ReplicateContext {
+							stop := startContextReplication(ctx, d, node, &so)
+							defer stop()
+						}
+						if dp.info.GCThreshold > 0 {
+							stop := startCacheGuard(ctx, d, c, node, CacheGuard{Threshold: dp.info.GCThreshold, KeepStorage: dp.info.GCKeepStorage})
+							defer stop()
+						}
+						var rr *client.SolveResponse
+						var err error
+						solveCh, start := statusCh, time.Now()
+						var graph *progress.Graph
+						var recorded <-chan struct{}
+						if opt.BuildID != "" && statusCh != nil {
+							graph = progress.NewGraph()
+							solveCh, recorded = recordSolveStatus(statusCh, graph)
+						}
+						if len(opt.Extracts) > 0 || opt.Squash {
+							rr, err = solveWithGateway(ctx, c, so, opt.Extracts, opt.Squash, solveCh)
+						} else {
+							rr, err = c.Solve(ctx, nil, so, solveCh)
+						}
+						if opt.BuildID != "" {
+							if recorded != nil {
+								<-recorded
+							}
+							r := newHistoryRecord(opt.BuildID, k, node, dp.platforms, so, start, rr, err, graph)
+							if err := writeHistoryRecord(ctx, d, r); err != nil {
+								logrus.Debug(err)
+							}
+						}
 						if err != nil {
+							if IsConnectionLost(err) && ctx.Err() == nil {
+								return &NodeLostError{Node: node, Err: err}
+							}
 							// Try to give a slightly more helpful error message if the use
 							// hasn't wired up a kubernetes secret for push/pull properly
 							if strings.Contains(strings.ToLower(err.Error()), "401 unauthorized") {
@@ -766,7 +1076,16 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, ku
 							}
 							return err
 						}
+						if rr.ExporterResponse == nil {
+							rr.ExporterResponse = map[string]string{}
+						}
+						rr.ExporterResponse[ExporterResponsePod] = node
 						res[i] = rr
+						if opt.Capacity != nil {
+							recordDiskUsage(ctx, c, opt.Capacity, before)
+						}
+						runCacheNodes[i] = node
+						runCachePlatforms[i] = native
 						return nil
 					})
 
@@ -804,7 +1123,7 @@ func createTempDockerfile(r io.Reader) (string, error) {
 }
 
 func LoadInputs(inp Inputs, target *client.SolveOpt) (func(), error) {
-	if inp.ContextPath == "" {
+	if inp.ContextPath == "" && inp.DockerfileInline == "" && inp.DockerfilePath != "-" {
 		return nil, errors.New("please specify build context (e.g. \".\" for the current directory)")
 	}
 
@@ -816,8 +1135,24 @@ func LoadInputs(inp Inputs, target *client.SolveOpt) (func(), error) {
 		dockerfileDir    string
 		dockerfileName   = inp.DockerfilePath
 		toRemove         []string
+		remoteContext    bool
 	)
 
+	if inp.DockerfileInline != "" {
+		if inp.DockerfilePath != "" {
+			return nil, errors.Errorf("a Dockerfile path can't be combined with an inline Dockerfile")
+		}
+		dockerfileReader = strings.NewReader(inp.DockerfileInline)
+	}
+	if inp.ContextPath == "" {
+		// Contextless build, COPY and ADD can only use remote sources
+		inp.ContextPath, err = ioutil.TempDir("", "empty-dir")
+		if err != nil {
+			return nil, err
+		}
+		toRemove = append(toRemove, inp.ContextPath)
+	}
+
 	switch {
 	case inp.ContextPath == "-":
 		if inp.DockerfilePath == "-" {
@@ -836,7 +1171,7 @@ func LoadInputs(inp Inputs, target *client.SolveOpt) (func(), error) {
 			target.FrontendAttrs["context"] = up.Add(buf)
 			target.Session = append(target.Session, up)
 		} else {
-			if inp.DockerfilePath != "" {
+			if inp.DockerfilePath != "" || dockerfileReader != nil {
 				return nil, errDockerfileConflict
 			}
 			// stdin is dockerfile
@@ -847,12 +1182,22 @@ func LoadInputs(inp Inputs, target *client.SolveOpt) (func(), error) {
 		}
 
 	case isLocalDir(inp.ContextPath):
-		target.LocalDirs["context"] = inp.ContextPath
-		switch inp.DockerfilePath {
-		case "-":
+		target.LocalDirs["context"] = longPath(inp.ContextPath)
+		// A stable key lets buildkit reuse the context transferred by earlier
+		// solves of this directory, such as other images of the same command,
+		// so only the changes are sent again
+		if abs, err := filepath.Abs(inp.ContextPath); err == nil {
+			target.SharedKey = digest.FromString(abs).Encoded()
+		}
+		switch {
+		case dockerfileReader != nil:
+			// inline Dockerfile
+		case inp.DockerfilePath == "-":
 			dockerfileReader = inp.InStream
-		case "":
+		case inp.DockerfilePath == "":
 			dockerfileDir = inp.ContextPath
+		case isRemoteDockerfile(inp.DockerfilePath):
+			// fetched below
 		default:
 			dockerfileDir = filepath.Dir(inp.DockerfilePath)
 			dockerfileName = filepath.Base(inp.DockerfilePath)
@@ -863,10 +1208,22 @@ func LoadInputs(inp Inputs, target *client.SolveOpt) (func(), error) {
 			return nil, errors.Errorf("Dockerfile from stdin is not supported with remote contexts")
 		}
 		target.FrontendAttrs["context"] = inp.ContextPath
+		remoteContext = true
 	default:
 		return nil, errors.Errorf("unable to prepare context: path %q not found", inp.ContextPath)
 	}
 
+	if isRemoteDockerfile(inp.DockerfilePath) {
+		dockerfileDir, err = fetchDockerfile(context.TODO(), inp.DockerfilePath, inp.DockerfileChecksum)
+		if err != nil {
+			return nil, err
+		}
+		toRemove = append(toRemove, dockerfileDir)
+		dockerfileName = "Dockerfile"
+	} else if inp.DockerfileChecksum != "" {
+		return nil, errors.Errorf("a Dockerfile checksum requires a Dockerfile URL")
+	}
+
 	if dockerfileReader != nil {
 		dockerfileDir, err = createTempDockerfile(dockerfileReader)
 		if err != nil {
@@ -879,10 +1236,55 @@ func LoadInputs(inp Inputs, target *client.SolveOpt) (func(), error) {
 	if dockerfileName == "" {
 		dockerfileName = "Dockerfile"
 	}
+
+	if inp.DNS != nil && dockerfileDir == "" {
+		return nil, errors.Errorf("--dns requires a local Dockerfile")
+	}
+	if inp.SourcePolicy != nil || inp.Lockfile != nil || inp.DNS != nil || inp.Cached != nil {
+		if dockerfileDir == "" {
+			return nil, errors.Errorf("source policies, lockfiles and --pull=never require a local Dockerfile")
+		}
+		dt, err := ioutil.ReadFile(filepath.Join(dockerfileDir, dockerfileName))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read Dockerfile for source policy")
+		}
+		if inp.SourcePolicy != nil {
+			if dt, err = inp.SourcePolicy.Apply(dt); err != nil {
+				return nil, err
+			}
+		}
+		if inp.Lockfile != nil {
+			if dt, err = rewriteFromImages(dt, inp.Lockfile.pin); err != nil {
+				return nil, err
+			}
+		}
+		if inp.Cached != nil {
+			if dt, err = pinCachedImages(dt, inp.Cached); err != nil {
+				return nil, err
+			}
+		}
+		if inp.DNS != nil {
+			dt = addDNSMount(dt)
+		}
+		dockerfileDir, err = createTempDockerfile(bytes.NewReader(dt))
+		if err != nil {
+			return nil, err
+		}
+		toRemove = append(toRemove, dockerfileDir)
+		dockerfileName = "Dockerfile"
+	}
 	target.FrontendAttrs["filename"] = dockerfileName
 
+	if err := loadNamedContexts(inp.NamedContexts, target); err != nil {
+		return nil, err
+	}
+
 	if dockerfileDir != "" {
-		target.LocalDirs["dockerfile"] = dockerfileDir
+		target.LocalDirs["dockerfile"] = longPath(dockerfileDir)
+		if remoteContext {
+			// Read the Dockerfile from the local dir instead of the remote context
+			target.FrontendAttrs["dockerfilekey"] = "dockerfile"
+		}
 	}
 
 	release := func() {
@@ -899,22 +1301,13 @@ func notSupported(d driver.Driver, f driver.Feature) error {
 
 type dockerLoadCallback func(name string) (io.WriteCloser, func(), error)
 
-func newDockerLoader(ctx context.Context, d driver.Driver, kubeClientConfig clientcmd.ClientConfig, builderName string, mw *progress.MultiWriter) (io.WriteCloser, func(), error) {
-	nodeNames := []string{}
-	// TODO this isn't quite right - we need a better "list only pods from one instance" func
-	builders, err := d.List(ctx)
+func newDockerLoader(ctx context.Context, d driver.Driver, kubeClientConfig clientcmd.ClientConfig, builderName string, loadTo *LoadTo, mw *progress.MultiWriter) (io.WriteCloser, func(), error) {
+	nodeNames, release, err := loadPods(ctx, d, builderName, "docker", loadTo)
 	if err != nil {
 		return nil, nil, err
 	}
-	for _, builder := range builders {
-		if builder.Name != builderName {
-			continue
-		}
-		for _, node := range builder.Nodes {
-			nodeNames = append(nodeNames, node.Name)
-		}
-	}
 	if len(nodeNames) == 0 {
+		release()
 		return nil, nil, fmt.Errorf("no builders found for %s", builderName)
 	}
 	// TODO revamp this flow to return a list of pods
@@ -948,6 +1341,7 @@ func newDockerLoader(ctx context.Context, d driver.Driver, kubeClientConfig clie
 			dockerclient.WithHost("http://"+nodeName), // TODO nuke
 		)
 		if err != nil {
+			release()
 			return nil, nil, fmt.Errorf("failed to set up docker client via proxy: %w", err)
 		}
 
@@ -987,6 +1381,7 @@ func newDockerLoader(ctx context.Context, d driver.Driver, kubeClientConfig clie
 		for _, pr := range readers {
 			pr.Close()
 		}
+		release()
 	}, nil
 }
 
@@ -1025,25 +1420,15 @@ func (w *waitingWriter) Close() error {
 	return err
 }
 
-func newContainerdLoader(ctx context.Context, d driver.Driver, kubeClientConfig clientcmd.ClientConfig, builderName string, mw *progress.MultiWriter) (io.WriteCloser, func(), error) {
-	nodeNames := []string{}
-	// TODO this isn't quite right - we need a better "list only pods from one instance" func
+func newContainerdLoader(ctx context.Context, d driver.Driver, kubeClientConfig clientcmd.ClientConfig, builderName string, loadTo *LoadTo, mw *progress.MultiWriter) (io.WriteCloser, func(), error) {
 	// TODO revamp this flow to return a list of pods
 
-	builders, err := d.List(ctx)
+	// For containerd, we never have to load on the node where it was built
+	// TODO - we may want to filter the source node, but when we switch the output.Type to "oci" we need to load it everywhere anyway
+	nodeNames, release, err := loadPods(ctx, d, builderName, "containerd", loadTo)
 	if err != nil {
 		return nil, nil, err
 	}
-	for _, builder := range builders {
-		if builder.Name != builderName {
-			continue
-		}
-		for _, node := range builder.Nodes {
-			// For containerd, we never have to load on the node where it was built
-			// TODO - we may want to filter the source node, but when we switch the output.Type to "oci" we need to load it everywhere anyway
-			nodeNames = append(nodeNames, node.Name)
-		}
-	}
 
 	readers := make([]*io.PipeReader, len(nodeNames))
 	writers := make([]io.Writer, len(nodeNames))
@@ -1071,6 +1456,7 @@ func newContainerdLoader(ctx context.Context, d driver.Driver, kubeClientConfig
 			}),
 		)
 		if err != nil {
+			release()
 			return nil, nil, fmt.Errorf("failed to set up docker client via proxy: %w", err)
 		}
 
@@ -1132,5 +1518,6 @@ func newContainerdLoader(ctx context.Context, d driver.Driver, kubeClientConfig
 		for _, pr := range readers {
 			pr.Close()
 		}
+		release()
 	}, nil
 }
@@ -0,0 +1,48 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadInputsInline(t *testing.T) {
+	t.Parallel()
+	so := &client.SolveOpt{FrontendAttrs: map[string]string{}, LocalDirs: map[string]string{}}
+	release, err := LoadInputs(Inputs{DockerfileInline: "FROM busybox\n"}, so)
+	require.NoError(t, err)
+	dt, err := ioutil.ReadFile(filepath.Join(so.LocalDirs["dockerfile"], "Dockerfile"))
+	require.NoError(t, err)
+	require.Equal(t, "FROM busybox\n", string(dt))
+	entries, err := ioutil.ReadDir(so.LocalDirs["context"])
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	release()
+	_, err = os.Stat(so.LocalDirs["context"])
+	require.True(t, os.IsNotExist(err))
+
+	_, err = LoadInputs(Inputs{DockerfileInline: "FROM busybox\n", DockerfilePath: "Dockerfile"}, so)
+	require.Error(t, err)
+	_, err = LoadInputs(Inputs{}, so)
+	require.Error(t, err)
+}
+
+func Test_driverPlatforms(t *testing.T) {
+	t.Parallel()
+	amd64 := specs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := specs.Platform{OS: "linux", Architecture: "arm64"}
+	m := map[string][]driverPair{
+		"default": {{driverIndex: 0, platforms: []specs.Platform{amd64, arm64}}},
+		"tests":   {{driverIndex: 0, platforms: []specs.Platform{amd64}}},
+	}
+	res := driverPlatforms(m)
+	require.Len(t, res, 1)
+	require.ElementsMatch(t, []specs.Platform{amd64, arm64}, res[0])
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/moby/buildkit/identity"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// buildkitd has no per-solve resource controls, but runs the RUN containers
+// of a solve under the cgroup parent it is given.  A build with limits
+// creates a cgroup of its own on the builder pod, limited as asked, and
+// gives it as the cgroup parent of the solve, so the RUN containers of the
+// build share its limits and a runaway build can't starve the others on the
+// pod.  The cgroup is removed once the solve ends.  Creating cgroups takes
+// a writable cgroup filesystem, ie. a builder created without --rootless.
+// The disk I/O of the builds of a builder may be throttled by default, the
+// limits given to a build overriding those of the builder.
+
+// buildLimitsCgroup holds the cgroups of the limited builds, under the cgroup
+// root of the pod
+const buildLimitsCgroup = "buildkit-builds"
+
+// cfsPeriod is the CPU period of the cgroup v1 CPU quota, in microseconds
+const cfsPeriod = 100000
+
+// BuildLimits are the limits of the RUN containers of a build, 0 for none
+type BuildLimits struct {
+	// CPUMillis is the CPU limit in thousandths of a CPU
+	CPUMillis int64
+	// Memory is the memory limit in bytes
+	Memory int64
+	// IO throttle the disk I/O, on every disk of the node
+	IO driver.IOLimits
+}
+
+// ParseBuildLimits parses the --build-cpu-limit and --build-memory-limit
+// quantities and the --build-io-limits, nil if none is given
+func ParseBuildLimits(cpu, memory, io string) (*BuildLimits, error) {
+	if cpu == "" && memory == "" && io == "" {
+		return nil, nil
+	}
+	l := &BuildLimits{}
+	var err error
+	if l.IO, err = driver.ParseIOLimits(io); err != nil {
+		return nil, errors.Wrap(err, "invalid --build-io-limits")
+	}
+	if cpu != "" {
+		q, err := resource.ParseQuantity(cpu)
+		if err != nil || q.Sign() <= 0 {
+			return nil, errors.Errorf("invalid --build-cpu-limit %q, use a CPU quantity like 2 or 500m", cpu)
+		}
+		l.CPUMillis = q.MilliValue()
+	}
+	if memory != "" {
+		q, err := resource.ParseQuantity(memory)
+		if err != nil || q.Sign() <= 0 {
+			return nil, errors.Errorf("invalid --build-memory-limit %q, use a quantity like 4Gi", memory)
+		}
+		l.Memory = q.Value()
+	}
+	return l, nil
+}
+
+// withBuilderIO returns the limits of l, the disk I/O limits overriding
+// those of the builder, io
+func (l *BuildLimits) withBuilderIO(io driver.IOLimits) *BuildLimits {
+	res := &BuildLimits{IO: io}
+	if l != nil {
+		res.CPUMillis, res.Memory, res.IO = l.CPUMillis, l.Memory, io.Override(l.IO)
+	}
+	return res
+}
+
+// limited reports whether l limits anything
+func (l *BuildLimits) limited() bool {
+	return l != nil && (l.CPUMillis > 0 || l.Memory > 0 || l.IO.Limited())
+}
+
+// limitBuild creates the cgroup of a solve limited by l on pod, and returns
+// its path, the cgroup parent of the solve
+func limitBuild(ctx context.Context, d driver.Driver, pod string, l *BuildLimits) (string, error) {
+	cgroup := buildLimitsCgroup + "/" + identity.NewID()
+	stderr := &strings.Builder{}
+	if err := d.Exec(ctx, pod, []string{"sh", "-c", buildLimitsScript(cgroup, l)}, nil, ioutil.Discard, stderr); err != nil {
+		return "", errors.Wrapf(err, "failed to limit the build on %s, it needs a builder created without --rootless: %s", pod, strings.TrimSpace(stderr.String()))
+	}
+	return cgroup, nil
+}
+
+// unlimitBuild removes the cgroup of a solve limited by limitBuild
+func unlimitBuild(ctx context.Context, d driver.Driver, pod, cgroup string) error {
+	script := fmt.Sprintf("for dir in /sys/fs/cgroup/%[1]s /sys/fs/cgroup/*/%[1]s; do [ ! -d \"$dir\" ] || rmdir \"$dir\"; done", cgroup)
+	return d.Exec(ctx, pod, []string{"sh", "-c", script}, nil, ioutil.Discard, ioutil.Discard)
+}
+
+// buildLimitsScript generates the script creating the cgroup limited by l,
+// of cgroup v2 or v1 as the pod runs.  The controllers of cgroup v2 are only
+// delegated to the cgroups of a cgroup without processes of its own, so the
+// processes at the root of the pod move to an init cgroup first, as
+// docker-in-docker does.
+func buildLimitsScript(cgroup string, l *BuildLimits) string {
+	lines := []string{
+		"set -e",
+		"root=/sys/fs/cgroup",
+		"if [ -f $root/cgroup.controllers ]; then",
+		"  if [ ! -d $root/" + buildLimitsCgroup + " ]; then",
+		"    mkdir -p $root/init",
+		"    xargs -rn1 < $root/cgroup.procs > $root/init/cgroup.procs 2>/dev/null || true",
+		"    sed -e 's/ / +/g' -e 's/^/+/' < $root/cgroup.controllers > $root/cgroup.subtree_control",
+		"    mkdir -p $root/" + buildLimitsCgroup,
+		"    sed -e 's/ / +/g' -e 's/^/+/' < $root/" + buildLimitsCgroup + "/cgroup.controllers > $root/" + buildLimitsCgroup + "/cgroup.subtree_control",
+		"  fi",
+		"  cg=$root/" + cgroup,
+		"  mkdir -p $cg",
+	}
+	lines = append(lines, l.v2Lines()...)
+	lines = append(lines, "else")
+	lines = append(lines, l.v1Lines(cgroup)...)
+	lines = append(lines, "fi")
+	return strings.Join(lines, "\n")
+}
+
+// v2Lines write the limits of the cgroup v2 $cg
+func (l *BuildLimits) v2Lines() []string {
+	var lines []string
+	if l.CPUMillis > 0 {
+		lines = append(lines, fmt.Sprintf("  echo '%d %d' > $cg/cpu.max", l.CPUMillis*cfsPeriod/1000, cfsPeriod))
+	}
+	if l.Memory > 0 {
+		lines = append(lines, fmt.Sprintf("  echo %d > $cg/memory.max", l.Memory))
+	}
+	var io []string
+	for _, k := range ioLimitKeys {
+		if v := l.IO[k.limit]; v > 0 {
+			io = append(io, fmt.Sprintf("%s=%d", k.v2, v))
+		}
+	}
+	if len(io) > 0 {
+		// Partitions and virtual disks take no limits
+		lines = append(lines, fmt.Sprintf("  for dev in $(cat /sys/block/*/dev); do echo \"$dev %s\" > $cg/io.max 2>/dev/null || true; done", strings.Join(io, " ")))
+	}
+	return lines
+}
+
+// ioLimitKeys are the keys of the disk I/O limits in cgroup v2 io.max and
+// the files of cgroup v1 blkio
+var ioLimitKeys = []struct {
+	limit, v2, v1 string
+}{
+	{driver.IOReadBPS, "rbps", "blkio.throttle.read_bps_device"},
+	{driver.IOWriteBPS, "wbps", "blkio.throttle.write_bps_device"},
+	{driver.IOReadIOPS, "riops", "blkio.throttle.read_iops_device"},
+	{driver.IOWriteIOPS, "wiops", "blkio.throttle.write_iops_device"},
+}
+
+// v1Lines create cgroup in the cgroup v1 hierarchies of the limits and
+// write them
+func (l *BuildLimits) v1Lines(cgroup string) []string {
+	var lines []string
+	if l.CPUMillis > 0 {
+		dir := "$root/cpu/" + cgroup
+		lines = append(lines,
+			"  mkdir -p "+dir,
+			fmt.Sprintf("  echo %d > %s/cpu.cfs_period_us", cfsPeriod, dir),
+			fmt.Sprintf("  echo %d > %s/cpu.cfs_quota_us", l.CPUMillis*cfsPeriod/1000, dir),
+		)
+	}
+	if l.Memory > 0 {
+		dir := "$root/memory/" + cgroup
+		lines = append(lines,
+			"  mkdir -p "+dir,
+			fmt.Sprintf("  echo %d > %s/memory.limit_in_bytes", l.Memory, dir),
+		)
+	}
+	if l.IO.Limited() {
+		dir := "$root/blkio/" + cgroup
+		lines = append(lines, "  mkdir -p "+dir)
+		for _, k := range ioLimitKeys {
+			if v := l.IO[k.limit]; v > 0 {
+				lines = append(lines, fmt.Sprintf("  for dev in $(cat /sys/block/*/dev); do echo \"$dev %d\" > %s/%s 2>/dev/null || true; done", v, dir, k.v1))
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+func Test_ParseBuildLimits(t *testing.T) {
+	t.Parallel()
+	l, err := ParseBuildLimits("", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	l, err = ParseBuildLimits("500m", "4Gi", "")
+	require.NoError(t, err)
+	assert.Equal(t, &BuildLimits{CPUMillis: 500, Memory: 4 << 30}, l)
+
+	l, err = ParseBuildLimits("2", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, &BuildLimits{CPUMillis: 2000}, l)
+
+	l, err = ParseBuildLimits("", "", "read-bps=0,write-bps=10Mi")
+	require.NoError(t, err)
+	assert.Equal(t, &BuildLimits{IO: driver.IOLimits{driver.IOReadBPS: 0, driver.IOWriteBPS: 10 << 20}}, l)
+
+	for _, tc := range [][3]string{{"two", "", ""}, {"", "lots", ""}, {"0", "", ""}, {"", "-1Gi", ""}, {"", "", "write-bps=fast"}} {
+		_, err := ParseBuildLimits(tc[0], tc[1], tc[2])
+		assert.Error(t, err, tc)
+	}
+}
+
+func Test_buildLimitsScript(t *testing.T) {
+	t.Parallel()
+	script := buildLimitsScript("buildkit-builds/abc", &BuildLimits{CPUMillis: 1500, Memory: 1 << 30})
+	assert.Contains(t, script, "cg=$root/buildkit-builds/abc\n")
+	// cgroup v2
+	assert.Contains(t, script, "echo '150000 100000' > $cg/cpu.max\n")
+	assert.Contains(t, script, "echo 1073741824 > $cg/memory.max\n")
+	// cgroup v1
+	assert.Contains(t, script, "mkdir -p $root/cpu/buildkit-builds/abc\n")
+	assert.Contains(t, script, "echo 150000 > $root/cpu/buildkit-builds/abc/cpu.cfs_quota_us\n")
+	assert.Contains(t, script, "echo 1073741824 > $root/memory/buildkit-builds/abc/memory.limit_in_bytes\n")
+
+	script = buildLimitsScript("buildkit-builds/abc", &BuildLimits{Memory: 1 << 30})
+	assert.NotContains(t, script, "cpu.max")
+	assert.NotContains(t, script, "$root/cpu/")
+}
+
+func Test_buildLimitsIO(t *testing.T) {
+	t.Parallel()
+	builder := driver.IOLimits{driver.IOReadBPS: 100 << 20, driver.IOWriteBPS: 50 << 20}
+	var none *BuildLimits
+	assert.False(t, none.limited())
+	l := none.withBuilderIO(builder)
+	assert.True(t, l.limited())
+	assert.Equal(t, builder, l.IO)
+
+	// The build lifts the read limit of the builder and adds an IOPS one
+	l = (&BuildLimits{CPUMillis: 1000, IO: driver.IOLimits{driver.IOReadBPS: 0, driver.IOWriteIOPS: 500}}).withBuilderIO(builder)
+	assert.Equal(t, &BuildLimits{CPUMillis: 1000, IO: driver.IOLimits{driver.IOReadBPS: 0, driver.IOWriteBPS: 50 << 20, driver.IOWriteIOPS: 500}}, l)
+	assert.False(t, (&BuildLimits{IO: driver.IOLimits{driver.IOReadBPS: 0}}).limited())
+
+	script := buildLimitsScript("buildkit-builds/abc", l)
+	assert.Contains(t, script, `echo "$dev wbps=52428800 wiops=500" > $cg/io.max`)
+	assert.Contains(t, script, `echo "$dev 52428800" > $root/blkio/buildkit-builds/abc/blkio.throttle.write_bps_device`)
+	assert.Contains(t, script, `echo "$dev 500" > $root/blkio/buildkit-builds/abc/blkio.throttle.write_iops_device`)
+	assert.NotContains(t, script, "read_bps")
+}
@@ -45,6 +45,9 @@ func ParseCacheEntry(in []string) ([]client.CacheOptionsEntry, error) {
 		if im.Type == "" {
 			return nil, errors.Errorf("type required form> %q", in)
 		}
+		if err := validateCacheEntry(im); err != nil {
+			return nil, errors.Wrapf(err, "invalid cache %q", in)
+		}
 		imports = append(imports, im)
 	}
 	return imports, nil
@@ -58,3 +61,24 @@ func isRefOnlyFormat(in []string) bool {
 	}
 	return true
 }
+
+// validateCacheEntry checks the attributes of the cache backends the builder
+// can't report until the end of the build
+func validateCacheEntry(e client.CacheOptionsEntry) error {
+	switch e.Type {
+	case "registry":
+		if e.Attrs["ref"] == "" {
+			return errors.Errorf("ref required for registry cache, eg. type=registry,ref=user/app:cache")
+		}
+	case "local":
+		if e.Attrs["src"] == "" && e.Attrs["dest"] == "" {
+			return errors.Errorf("src or dest required for local cache")
+		}
+	}
+	switch e.Attrs["mode"] {
+	case "", "min", "max":
+	default:
+		return errors.Errorf("mode must be min or max, not %q", e.Attrs["mode"])
+	}
+	return nil
+}
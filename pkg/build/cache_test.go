@@ -24,3 +24,22 @@ func Test_ParseCacheEntry(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, resp, 1)
 }
+
+func Test_ParseCacheEntryRegistry(t *testing.T) {
+	t.Parallel()
+	resp, err := ParseCacheEntry([]string{"type=registry,ref=registry.acme.com/app:cache,mode=max"})
+	assert.NoError(t, err)
+	assert.Len(t, resp, 1)
+	assert.Equal(t, "registry", resp[0].Type)
+	assert.Equal(t, "registry.acme.com/app:cache", resp[0].Attrs["ref"])
+	assert.Equal(t, "max", resp[0].Attrs["mode"])
+
+	_, err = ParseCacheEntry([]string{"type=registry"})
+	assert.Error(t, err)
+	_, err = ParseCacheEntry([]string{"type=registry,ref=app:cache,mode=all"})
+	assert.Error(t, err)
+	_, err = ParseCacheEntry([]string{"type=local"})
+	assert.Error(t, err)
+	_, err = ParseCacheEntry([]string{"type=inline"})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// buildkitd only collects the garbage of its cache between builds, a build
+// filling the disk of its pod fails with ENOSPC.  While a build solves, the
+// cache guard polls the disk of the pod and once the GC threshold of the
+// builder is used, prunes the cache records no build uses, least recently
+// used first, until the disk is back under the threshold.  The cache isn't
+// pruned below the keep storage of the builder.
+
+const (
+	cacheGuardInterval = 10 * time.Second
+	// cacheGuardMargin is how far under the threshold the disk is pruned to,
+	// in percent of the disk, so the next poll doesn't prune again
+	cacheGuardMargin = 10
+)
+
+// CacheGuard prunes the cache of a builder pod while it builds
+type CacheGuard struct {
+	// Threshold is the percentage of the disk used at which the cache is pruned
+	Threshold int
+	// KeepStorage is the size of the cache never pruned
+	KeepStorage int64
+}
+
+// startCacheGuard polls the disk of the builder pod node until stopped
+func startCacheGuard(ctx context.Context, d driver.Driver, c *client.Client, node string, guard CacheGuard) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cacheGuardInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := guardCache(ctx, d, c, node, guard); err != nil && ctx.Err() == nil {
+				logrus.Debugf("failed to check the disk of builder pod %s: %s", node, err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// guardCache prunes the cache of the builder pod node if its disk is used
+// past the threshold
+func guardCache(ctx context.Context, d driver.Driver, c *client.Client, node string, guard CacheGuard) error {
+	buf := &bytes.Buffer{}
+	if err := d.Exec(ctx, node, []string{"sh", "-c", diskScript}, nil, buf, ioutil.Discard); err != nil {
+		return err
+	}
+	size, available, err := parseDiskUsage(strings.TrimSpace(buf.String()))
+	if err != nil {
+		return err
+	}
+	if !guard.exceeded(size, available) {
+		return nil
+	}
+	stats, err := GetCacheStats(ctx, c, 0)
+	if err != nil {
+		return err
+	}
+	keep, ok := guard.keepStorage(size, available, stats.Size)
+	if !ok {
+		logrus.Warnf("builder pod %s has used %d%% of its disk, its cache can't be pruned further", node, usedPercent(size, available))
+		return nil
+	}
+	res, err := Prune(ctx, c, PruneOpt{KeepStorage: keep})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("builder pod %s has used %d%% of its disk, pruned %s of its cache", node, usedPercent(size, available), FormatBytes(res.Reclaimed))
+	return nil
+}
+
+func usedPercent(size, available int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - available) * 100 / size
+}
+
+// exceeded is true once the disk is used at the threshold
+func (g CacheGuard) exceeded(size, available int64) bool {
+	return g.Threshold > 0 && size > 0 && (size-available)*100 >= int64(g.Threshold)*size
+}
+
+// keepStorage returns the size of the cache to keep to use the threshold
+// minus the margin of the disk, false if the cache can't be pruned that far
+func (g CacheGuard) keepStorage(size, available, cacheSize int64) (int64, bool) {
+	target := int64(g.Threshold-cacheGuardMargin) * size / 100
+	if target < 0 {
+		target = 0
+	}
+	keep := cacheSize - (size - available - target)
+	if keep < g.KeepStorage {
+		keep = g.KeepStorage
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	if keep >= cacheSize {
+		return 0, false
+	}
+	return keep, true
+}
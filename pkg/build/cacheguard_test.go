@@ -0,0 +1,49 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseDiskUsage(t *testing.T) {
+	t.Parallel()
+	size, available, err := parseDiskUsage("overlay 1000 900 100 90% /var/lib/buildkit")
+	require.NoError(t, err)
+	require.Equal(t, int64(1000*1024), size)
+	require.Equal(t, int64(100*1024), available)
+	_, _, err = parseDiskUsage("overlay many 900 100 90% /var/lib/buildkit")
+	require.Error(t, err)
+}
+
+func Test_CacheGuard(t *testing.T) {
+	t.Parallel()
+	g := CacheGuard{Threshold: 90}
+	require.False(t, g.exceeded(1000, 200))
+	require.True(t, g.exceeded(1000, 100))
+	require.False(t, CacheGuard{}.exceeded(1000, 0))
+
+	// 900 used of which 600 cache, 100 more than 80% to free
+	keep, ok := g.keepStorage(1000, 100, 600)
+	require.True(t, ok)
+	require.Equal(t, int64(500), keep)
+
+	// Never below the keep storage
+	g.KeepStorage = 550
+	keep, ok = g.keepStorage(1000, 100, 600)
+	require.True(t, ok)
+	require.Equal(t, int64(550), keep)
+
+	// The cache is already at the keep storage
+	g.KeepStorage = 600
+	_, ok = g.keepStorage(1000, 100, 600)
+	require.False(t, ok)
+
+	// Not enough cache to get under the threshold, all of it is pruned
+	g.KeepStorage = 0
+	keep, ok = g.keepStorage(1000, 50, 100)
+	require.True(t, ok)
+	require.Equal(t, int64(0), keep)
+}
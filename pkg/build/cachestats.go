@@ -0,0 +1,88 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+)
+
+// Builds routed to the same pod reuse its cache.  The cache statistics of
+// each pod, read from buildkitd's disk usage, show whether they do: a pod
+// with little cache or without the base images of a project builds it cold.
+
+// CacheStats summarizes the build cache of a builder pod
+type CacheStats struct {
+	Size    int64
+	Entries int
+	// Repositories are the image repositories with the most layers cached, largest first
+	Repositories []RepositoryUsage
+	// Reclaimable is the size of the records a prune would remove, not in use
+	Reclaimable int64
+	// LastUsed is when a build last used a record, zero if none was
+	LastUsed time.Time
+}
+
+// RepositoryUsage is the size of the layers of an image repository in the cache
+type RepositoryUsage struct {
+	Name string
+	Size int64
+}
+
+// GetCacheStats reads the cache statistics of the pod of c, with the top
+// repositories
+func GetCacheStats(ctx context.Context, c *client.Client, top int) (*CacheStats, error) {
+	du, err := c.DiskUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cacheStats(du, top), nil
+}
+
+func cacheStats(du []*client.UsageInfo, top int) *CacheStats {
+	res := &CacheStats{Entries: len(du)}
+	repos := map[string]int64{}
+	for _, u := range du {
+		res.Size += u.Size
+		if !u.InUse {
+			res.Reclaimable += u.Size
+		}
+		if u.LastUsedAt != nil && u.LastUsedAt.After(res.LastUsed) {
+			res.LastUsed = *u.LastUsedAt
+		}
+		if name := pulledRepository(u.Description); name != "" {
+			repos[name] += u.Size
+		}
+	}
+	for name, size := range repos {
+		res.Repositories = append(res.Repositories, RepositoryUsage{Name: name, Size: size})
+	}
+	sort.Slice(res.Repositories, func(i, j int) bool {
+		if res.Repositories[i].Size == res.Repositories[j].Size {
+			return res.Repositories[i].Name < res.Repositories[j].Name
+		}
+		return res.Repositories[i].Size > res.Repositories[j].Size
+	})
+	if len(res.Repositories) > top {
+		res.Repositories = res.Repositories[:top]
+	}
+	return res
+}
+
+// pulledRepository returns the repository of a layer buildkitd describes as
+// "pulled from <ref>", "" for other records
+func pulledRepository(description string) string {
+	if !strings.HasPrefix(description, "pulled from ") {
+		return ""
+	}
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(description, "pulled from "))
+	if err != nil {
+		return ""
+	}
+	return named.Name()
+}
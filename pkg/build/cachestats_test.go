@@ -0,0 +1,39 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cacheStats(t *testing.T) {
+	t.Parallel()
+	used := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	earlier := used.Add(-time.Hour)
+	du := []*client.UsageInfo{
+		{Size: 100, InUse: true, LastUsedAt: &earlier, Description: "pulled from docker.io/library/golang:1.16@sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		{Size: 50, Description: "pulled from docker.io/library/golang:1.16@sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		{Size: 60, Description: "pulled from docker.io/library/alpine:latest"},
+		{Size: 10, Description: "pulled from registry.local/team/base:1"},
+		{Size: 7, Description: "mount / from exec /bin/sh -c go build", LastUsedAt: &used},
+		{Size: 3, Description: "local source for context"},
+	}
+	stats := cacheStats(du, 2)
+	require.Equal(t, int64(230), stats.Size)
+	require.Equal(t, 6, stats.Entries)
+	require.Equal(t, int64(130), stats.Reclaimable)
+	require.Equal(t, used, stats.LastUsed)
+	require.Equal(t, []RepositoryUsage{
+		{Name: "docker.io/library/golang", Size: 150},
+		{Name: "docker.io/library/alpine", Size: 60},
+	}, stats.Repositories)
+
+	stats = cacheStats(nil, 5)
+	require.Equal(t, int64(0), stats.Size)
+	require.Empty(t, stats.Repositories)
+	require.True(t, stats.LastUsed.IsZero())
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// buildkitd has no API to cancel the solve of another client, it cancels a
+// solve when its session goes away.  The session of a build runs over the
+// buildctl dial-stdio connection of the CLI to the builder pod, tagged with
+// the build ID in its environment, so killing that buildctl cancels the build
+// and frees its workers and locks.  Builds connecting over port-forward or
+// tcp tie their connection to a sentinel process tagged the same way, the
+// CLI closes the connection once the sentinel is killed.  The CLI of the
+// build fails with the closed connection.
+
+// CancelledBuild is a build cancelled on a builder pod
+type CancelledBuild struct {
+	// ID is the build cancelled, empty for all the builds of Node
+	ID   string
+	Node string
+}
+
+// cancelScript kills the buildctl connections and sentinels tagged with the
+// build ID $1, or with any build ID and the buildctl of the detached builds
+// if empty, and prints how many it killed.  Interrupting a detached build
+// lets it record its exit, the connections are killed outright.
+var cancelScript = `n=0
+for p in /proc/[0-9]*; do
+  env=$(tr '\0' '\n' < $p/environ 2>/dev/null) || continue
+  sig=KILL
+  if [ -n "$1" ]; then
+    echo "$env" | grep -qx "` + driver.BuildIDEnv + `=$1" || continue
+  elif [ "$(cat $p/comm 2>/dev/null)" = buildctl ] && echo "$env" | grep -q "^DOCKER_CONFIG=` + DetachedBuildDir + `/"; then
+    sig=INT
+  else
+    echo "$env" | grep -q "^` + driver.BuildIDEnv + `=" || continue
+  fi
+  kill -$sig ${p#/proc/} 2>/dev/null && n=$((n+1))
+done
+echo $n`
+
+// CancelBuild cancels the running build id on the builder, attached or
+// detached, or all of the running builds if id is empty
+func CancelBuild(ctx context.Context, d driver.Driver, id string) ([]CancelledBuild, error) {
+	if id != "" {
+		if err := validateDetachedID(id); err != nil {
+			return nil, err
+		}
+		if db, err := DetachedBuildStatus(ctx, d, id); err == nil {
+			if db.State != DetachedStateRunning {
+				return nil, errors.Errorf("build %q already finished (%s)", id, db.State)
+			}
+			if err := CancelDetachedBuild(ctx, d, id); err != nil {
+				return nil, err
+			}
+			return []CancelledBuild{{ID: id, Node: db.Node}}, nil
+		}
+	}
+	info, err := d.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []CancelledBuild
+	for _, node := range info.DynamicNodes {
+		buf := &bytes.Buffer{}
+		if err := d.Exec(ctx, node.Name, []string{"sh", "-c", cancelScript, "sh", id}, nil, buf, ioutil.Discard); err != nil {
+			return res, errors.Wrapf(err, "failed to cancel builds on %s", node.Name)
+		}
+		if n, _ := strconv.Atoi(strings.TrimSpace(buf.String())); n > 0 {
+			res = append(res, CancelledBuild{ID: id, Node: node.Name})
+		}
+	}
+	if id != "" && len(res) == 0 {
+		if records, err := BuildHistory(ctx, d); err == nil {
+			for _, r := range records {
+				if r.BuildID == id {
+					return nil, errors.Errorf("build %q already finished (%s)", id, r.Status())
+				}
+			}
+		}
+		return nil, errors.Errorf("build %q is not running on the builder", id)
+	}
+	return res, nil
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/store"
+)
+
+// cancelDriver answers the scripts of CancelBuild for its pods, which run
+// the builds of running, the detached builds of detached and recorded the
+// builds of history
+type cancelDriver struct {
+	driver.Driver
+	running  map[string]string
+	detached map[string]string
+	history  map[string]string
+
+	mu      sync.Mutex
+	scripts []string
+}
+
+func (d *cancelDriver) Info(ctx context.Context) (*driver.Info, error) {
+	return &driver.Info{
+		Status: driver.Running,
+		DynamicNodes: []store.Node{
+			{Name: "pod-a"},
+			{Name: "pod-b"},
+		},
+	}, nil
+}
+
+func (d *cancelDriver) Exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	script := cmd[2]
+	d.mu.Lock()
+	d.scripts = append(d.scripts, script)
+	d.mu.Unlock()
+	switch {
+	case script == cancelScript:
+		n := "0"
+		if id, running := cmd[4], d.running[name]; running != "" && (id == "" || id == running) {
+			n = "1"
+		}
+		_, err := io.WriteString(stdout, n+"\n")
+		return err
+	case strings.HasPrefix(script, "cd "+DetachedBuildDir):
+		if stdout != nil {
+			_, err := io.WriteString(stdout, d.detached[name])
+			return err
+		}
+	case strings.HasPrefix(script, "cat "+HistoryDir):
+		_, err := io.WriteString(stdout, d.history[name])
+		return err
+	}
+	return nil
+}
+
+func Test_CancelBuild(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	d := &cancelDriver{running: map[string]string{"pod-b": "abc123"}}
+	res, err := CancelBuild(ctx, d, "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, []CancelledBuild{{ID: "abc123", Node: "pod-b"}}, res)
+
+	res, err = CancelBuild(ctx, d, "")
+	require.NoError(t, err)
+	assert.Equal(t, []CancelledBuild{{Node: "pod-b"}}, res, "--all")
+
+	_, err = CancelBuild(ctx, d, "def456")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not running on the builder")
+
+	_, err = CancelBuild(ctx, d, "../etc")
+	require.Error(t, err, "invalid ID")
+}
+
+func Test_CancelBuildDetached(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	d := &cancelDriver{detached: map[string]string{"pod-a": DetachedStateRunning + "\n"}}
+	res, err := CancelBuild(ctx, d, "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, []CancelledBuild{{ID: "abc123", Node: "pod-a"}}, res)
+	assert.Contains(t, d.scripts, "kill -INT $(cat "+detachedDir("abc123")+"/pid)")
+
+	for state, want := range map[string]string{
+		"exited 0\n": DetachedStateDone,
+		"exited 2\n": DetachedStateFailed,
+	} {
+		d := &cancelDriver{detached: map[string]string{"pod-a": state}}
+		_, err := CancelBuild(ctx, d, "abc123")
+		require.Error(t, err, state)
+		assert.Contains(t, err.Error(), "already finished ("+want+")")
+		for _, script := range d.scripts {
+			assert.NotEqual(t, cancelScript, script, "a finished build is not looked up")
+		}
+	}
+}
+
+func Test_CancelBuildFinished(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	d := &cancelDriver{history: map[string]string{
+		"pod-b": `{"ref":"r1","buildID":"abc123","pod":"pod-b","error":"exit code 1"}` + "\n",
+	}}
+	_, err := CancelBuild(ctx, d, "abc123")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `build "abc123" already finished (`+DetachedStateFailed+")")
+
+	_, err = CancelBuild(ctx, d, "def456")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not running on the builder")
+}
+
+func Test_cancelScript(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	id := "cancel" + time.Now().Format("150405.000000000")
+	tagged := exec.Command("sleep", "30")
+	tagged.Env = []string{driver.BuildIDEnv + "=" + id}
+	other := exec.Command("sleep", "30")
+	other.Env = []string{driver.BuildIDEnv + "=" + id + "x"}
+	require.NoError(t, tagged.Start())
+	defer func() { _ = tagged.Process.Kill() }()
+	require.NoError(t, other.Start())
+	defer func() { _ = other.Process.Kill() }()
+
+	out := &bytes.Buffer{}
+	cmd := exec.Command("sh", "-c", cancelScript, "sh", id)
+	cmd.Stdout = out
+	require.NoError(t, cmd.Run())
+	assert.Equal(t, "1", strings.TrimSpace(out.String()))
+
+	err := tagged.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "killed")
+
+	// Only the build asked for is killed
+	done := make(chan error, 1)
+	go func() { done <- other.Wait() }()
+	select {
+	case err := <-done:
+		t.Fatalf("other build exited: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
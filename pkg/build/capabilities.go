@@ -0,0 +1,133 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/apicaps"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// An older buildkitd fails the builds using a feature it lacks with an
+// obscure error once the build reaches it, if at all.  Builds needing one of
+// the features below query the capabilities of the buildkitd they connected
+// to first, and fail right away naming the feature.  The platforms of its
+// workers are checked too, though only warned about: a platform neither run
+// natively nor emulated fails the RUN instructions, the other ones build.
+
+// Capabilities are the features of the buildkitd of a builder pod
+type Capabilities struct {
+	// Caps are those of the gateway API, LLBCaps those of the build definitions
+	Caps    apicaps.CapSet
+	LLBCaps apicaps.CapSet
+	// Platforms are those the workers run, natively or emulated
+	Platforms []specs.Platform
+}
+
+// QueryCapabilities reads the capabilities of the buildkitd of c
+func QueryCapabilities(ctx context.Context, c *client.Client) (*Capabilities, error) {
+	var res *Capabilities
+	_, err := c.Build(ctx, client.SolveOpt{}, "", func(ctx context.Context, gc gateway.Client) (*gateway.Result, error) {
+		opts := gc.BuildOpts()
+		res = &Capabilities{Caps: opts.Caps, LLBCaps: opts.LLBCaps}
+		for _, w := range opts.Workers {
+			res.Platforms = append(res.Platforms, w.Platforms...)
+		}
+		return nil, nil
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query the capabilities of the builder")
+	}
+	return res, nil
+}
+
+// capRequirement is a feature of a build and the capability it needs
+type capRequirement struct {
+	feature string
+	id      apicaps.CapID
+	// llb is set for the capabilities of the build definitions
+	llb bool
+}
+
+// capRequirements returns the capabilities the build of opt needs
+func capRequirements(opt Options) []capRequirement {
+	var res []capRequirement
+	gha := false
+	for _, e := range append(append([]client.CacheOptionsEntry{}, opt.CacheFrom...), opt.CacheTo...) {
+		if e.Type == "gha" && !gha {
+			res = append(res, capRequirement{feature: "the gha cache backend", id: pb.CapRemoteCacheGHA, llb: true})
+			gha = true
+		}
+	}
+	if imageResolveMode(opt.PullPolicy) != "" {
+		res = append(res, capRequirement{feature: "--pull=" + opt.PullPolicy, id: pb.CapSourceImageResolveMode, llb: true})
+	}
+	if len(opt.Extracts) > 0 || opt.Squash {
+		res = append(res, capRequirement{feature: "--extract and --squash", id: gatewaypb.CapSolveBase})
+	}
+	return res
+}
+
+// missing returns the features of reqs caps lacks
+func (caps *Capabilities) missing(reqs []capRequirement) []string {
+	var res []string
+	for _, r := range reqs {
+		set := caps.Caps
+		if r.llb {
+			set = caps.LLBCaps
+		}
+		if err := set.Supports(r.id); err != nil {
+			res = append(res, r.feature+" ("+string(r.id)+")")
+		}
+	}
+	return res
+}
+
+// missingPlatforms returns the platforms caps neither runs natively nor
+// emulates
+func (caps *Capabilities) missingPlatforms(requested []specs.Platform) []string {
+	var res []string
+	for _, p := range requested {
+		matcher := platforms.Only(p)
+		found := false
+		for _, wp := range caps.Platforms {
+			if matcher.Match(wp) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, platforms.Format(p))
+		}
+	}
+	return res
+}
+
+// checkCapabilities fails the build of opt on the builder pod node of c if
+// its buildkitd lacks a feature it needs
+func checkCapabilities(ctx context.Context, c *client.Client, node string, opt Options, requested []specs.Platform) error {
+	reqs := capRequirements(opt)
+	if len(reqs) == 0 && len(requested) == 0 {
+		return nil
+	}
+	caps, err := QueryCapabilities(ctx, c)
+	if err != nil {
+		return err
+	}
+	if missing := caps.missingPlatforms(requested); len(missing) > 0 {
+		logrus.Warnf("builder pod %s neither runs nor emulates %s, their RUN instructions will fail, create the builder with --binfmt-image to emulate them", node, strings.Join(missing, ", "))
+	}
+	if missing := caps.missing(reqs); len(missing) > 0 {
+		return errors.Errorf("builder pod %s lacks %s, upgrade its BuildKit with kubectl buildkit create --image", node, strings.Join(missing, ", "))
+	}
+	return nil
+}
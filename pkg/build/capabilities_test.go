@@ -0,0 +1,51 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/pb"
+	capspb "github.com/moby/buildkit/util/apicaps/pb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_capRequirements(t *testing.T) {
+	t.Parallel()
+	require.Empty(t, capRequirements(Options{PullPolicy: PullMissing}))
+
+	reqs := capRequirements(Options{
+		CacheFrom:  []client.CacheOptionsEntry{{Type: "gha"}, {Type: "registry"}},
+		CacheTo:    []client.CacheOptionsEntry{{Type: "gha"}},
+		PullPolicy: PullNever,
+		Squash:     true,
+	})
+	require.Len(t, reqs, 3)
+	require.Equal(t, pb.CapRemoteCacheGHA, reqs[0].id)
+	require.Equal(t, pb.CapSourceImageResolveMode, reqs[1].id)
+	require.Equal(t, gatewaypb.CapSolveBase, reqs[2].id)
+}
+
+func Test_Capabilities(t *testing.T) {
+	t.Parallel()
+	caps := &Capabilities{
+		Caps: gatewaypb.Caps.CapSet([]capspb.APICap{{ID: string(gatewaypb.CapSolveBase), Enabled: true}}),
+		LLBCaps: pb.Caps.CapSet([]capspb.APICap{
+			{ID: string(pb.CapSourceImageResolveMode), Enabled: true},
+			{ID: string(pb.CapRemoteCacheGHA), Enabled: false},
+		}),
+		Platforms: []specs.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+	}
+	reqs := capRequirements(Options{
+		CacheTo:    []client.CacheOptionsEntry{{Type: "gha"}},
+		PullPolicy: PullAlways,
+		Squash:     true,
+	})
+	require.Equal(t, []string{"the gha cache backend (cache.gha)"}, caps.missing(reqs))
+
+	require.Empty(t, caps.missingPlatforms([]specs.Platform{{OS: "linux", Architecture: "arm64"}}))
+	require.Equal(t, []string{"linux/s390x"}, caps.missingPlatforms([]specs.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "s390x"}}))
+}
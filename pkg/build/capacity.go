@@ -0,0 +1,180 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// A build running out of disk space on the builder pod fails with ENOSPC
+// long after it started.  The capacity check compares what the chosen pod has
+// left against an estimate before solving: the disk space is the size of the
+// build context plus the most the previous builds of the image took, as
+// recorded on the client after each of them, and the memory is as requested.
+
+// CapacityCheck fails a build upfront on a builder pod without the disk space
+// or memory it needs
+type CapacityCheck struct {
+	// Disk is the estimated disk space the build needs
+	Disk int64
+	// Memory is the memory the build needs, 0 to not check it
+	Memory int64
+	// Record is called with the disk space the build took on the pod, if set
+	Record func(size int64)
+}
+
+// diskScript prints the disk usage of the buildkit state
+const diskScript = `for d in /var/lib/buildkit /home/user/.local/share/buildkit; do [ -d $d ] && df -Pk $d | tail -n 1 && break; done`
+
+// capacityScript prints the disk space left for the buildkit state, then the
+// memory limit and usage of the pod's cgroup, v2 or else v1
+const capacityScript = diskScript + `
+cat /sys/fs/cgroup/memory.max /sys/fs/cgroup/memory.current 2>/dev/null || cat /sys/fs/cgroup/memory/memory.limit_in_bytes /sys/fs/cgroup/memory/memory.usage_in_bytes 2>/dev/null || true`
+
+// checkCapacity fails unless the builder pod node has what the build needs
+func checkCapacity(ctx context.Context, d driver.Driver, node string, check *CapacityCheck) error {
+	buf := &bytes.Buffer{}
+	if err := d.Exec(ctx, node, []string{"sh", "-c", capacityScript}, nil, buf, ioutil.Discard); err != nil {
+		return errors.Wrapf(err, "failed to read the capacity of builder pod %s", node)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	disk, err := parseDiskAvailable(lines[0])
+	if err != nil {
+		return err
+	}
+	if disk < check.Disk {
+		return errors.Errorf("builder pod %s has %s of disk space left, the build is estimated to need %s: prune its cache, build on a larger replica class with --size or a builder created with --scratch-size", node, FormatBytes(disk), FormatBytes(check.Disk))
+	}
+	if check.Memory == 0 {
+		return nil
+	}
+	memory, limited, err := parseMemoryAvailable(lines[1:])
+	if err != nil {
+		return err
+	}
+	if limited && memory < check.Memory {
+		return errors.Errorf("builder pod %s has %s of memory left, the build needs %s: build on a larger replica class with --size", node, FormatBytes(memory), FormatBytes(check.Memory))
+	}
+	return nil
+}
+
+// parseDiskAvailable returns the available bytes of a line of df -Pk
+func parseDiskAvailable(line string) (int64, error) {
+	_, available, err := parseDiskUsage(line)
+	return available, err
+}
+
+// parseDiskUsage returns the size and available bytes of a line of df -Pk
+func parseDiskUsage(line string) (int64, int64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 {
+		return 0, 0, errors.Errorf("unexpected disk usage %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "unexpected disk usage %q", line)
+	}
+	available, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "unexpected disk usage %q", line)
+	}
+	return size * 1024, available * 1024, nil
+}
+
+// parseMemoryAvailable returns the memory left from the limit and usage of
+// a cgroup, and false if the memory isn't limited
+func parseMemoryAvailable(lines []string) (int64, bool, error) {
+	if len(lines) < 2 {
+		return 0, false, errors.Errorf("the memory of the builder pod is unknown, its cgroup is not readable")
+	}
+	limit := strings.TrimSpace(lines[0])
+	if limit == "max" {
+		return 0, false, nil
+	}
+	max, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "unexpected memory limit %q", limit)
+	}
+	used, err := strconv.ParseInt(strings.TrimSpace(lines[1]), 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "unexpected memory usage %q", lines[1])
+	}
+	// cgroup v1 reports no limit as the largest page aligned value
+	if max >= 1<<62 {
+		return 0, false, nil
+	}
+	if used > max {
+		used = max
+	}
+	return max - used, true, nil
+}
+
+// recordDiskUsage calls the Record of check with how much the cache of the
+// builder pod grew since before
+func recordDiskUsage(ctx context.Context, c *client.Client, check *CapacityCheck, before *CacheStats) {
+	if check.Record == nil || before == nil {
+		return
+	}
+	after, err := GetCacheStats(ctx, c, 0)
+	if err != nil {
+		return
+	}
+	if grown := after.Size - before.Size; grown > 0 {
+		check.Record(grown)
+	}
+}
+
+type peakDiskUsage struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func peakDiskUsageFile(dir, name string) string {
+	return filepath.Join(dir, digest.FromString(name).Encoded()+".json")
+}
+
+// LoadPeakDiskUsage returns the most disk space a build of name was recorded
+// to take in dir, 0 if none was
+func LoadPeakDiskUsage(dir, name string) (int64, error) {
+	dt, err := ioutil.ReadFile(peakDiskUsageFile(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var u peakDiskUsage
+	if err := json.Unmarshal(dt, &u); err != nil {
+		return 0, errors.Wrapf(err, "invalid disk usage record of %s", name)
+	}
+	return u.Size, nil
+}
+
+// RecordPeakDiskUsage records in dir the disk space a build of name took, if
+// more than recorded before
+func RecordPeakDiskUsage(dir, name string, size int64) error {
+	peak, err := LoadPeakDiskUsage(dir, name)
+	if err == nil && peak >= size {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dt, err := json.Marshal(peakDiskUsage{Name: name, Size: size})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(peakDiskUsageFile(dir, name), dt, 0644)
+}
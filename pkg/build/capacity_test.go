@@ -0,0 +1,74 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+type capacityDriver struct {
+	driver.Driver
+	out string
+}
+
+func (d capacityDriver) Exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	_, err := io.WriteString(stdout, d.out)
+	return err
+}
+
+func Test_checkCapacity(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	df := "/dev/sda1 10485760 8388608 2097152 80% /var/lib/buildkit\n"
+	require.NoError(t, checkCapacity(ctx, capacityDriver{out: df}, "pod", &CapacityCheck{Disk: 1 << 30}))
+	require.Error(t, checkCapacity(ctx, capacityDriver{out: df}, "pod", &CapacityCheck{Disk: 3 << 30}))
+
+	cgroup := df + "4294967296\n1073741824\n"
+	require.NoError(t, checkCapacity(ctx, capacityDriver{out: cgroup}, "pod", &CapacityCheck{Memory: 2 << 30}))
+	require.Error(t, checkCapacity(ctx, capacityDriver{out: cgroup}, "pod", &CapacityCheck{Memory: 4 << 30}))
+	require.NoError(t, checkCapacity(ctx, capacityDriver{out: df + "max\n1073741824\n"}, "pod", &CapacityCheck{Memory: 64 << 30}))
+	require.Error(t, checkCapacity(ctx, capacityDriver{out: df}, "pod", &CapacityCheck{Memory: 1 << 30}), "unreadable cgroup")
+	require.Error(t, checkCapacity(ctx, capacityDriver{out: "df: not found\n"}, "pod", &CapacityCheck{}))
+}
+
+func Test_parseMemoryAvailable(t *testing.T) {
+	t.Parallel()
+	free, limited, err := parseMemoryAvailable([]string{"9223372036854771712", "1073741824"})
+	require.NoError(t, err)
+	assert.False(t, limited, "cgroup v1 without a limit")
+	assert.Zero(t, free)
+
+	free, limited, err = parseMemoryAvailable([]string{"1073741824", "2147483648"})
+	require.NoError(t, err)
+	assert.True(t, limited)
+	assert.Zero(t, free)
+
+	_, _, err = parseMemoryAvailable([]string{"lots", "1"})
+	assert.Error(t, err)
+}
+
+func Test_RecordPeakDiskUsage(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "capacity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	peak, err := LoadPeakDiskUsage(dir, "registry.example.com/app:v1")
+	require.NoError(t, err)
+	assert.Zero(t, peak)
+
+	require.NoError(t, RecordPeakDiskUsage(dir, "registry.example.com/app:v1", 2<<30))
+	require.NoError(t, RecordPeakDiskUsage(dir, "registry.example.com/app:v1", 1<<30))
+	require.NoError(t, RecordPeakDiskUsage(dir, "registry.example.com/other:v1", 3<<30))
+	peak, err = LoadPeakDiskUsage(dir, "registry.example.com/app:v1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2<<30), peak, "only the peak is kept")
+}
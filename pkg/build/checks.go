@@ -0,0 +1,363 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The builder image predates BuildKit's built-in Dockerfile checks, so a
+// subset of the same rules is evaluated on the client before the build starts.
+
+const (
+	CheckOutputSARIF = "sarif"
+	CheckOutputJUnit = "junit"
+)
+
+type CheckRule struct {
+	ID          string
+	Description string
+}
+
+// CheckRules lists the rules evaluated by CheckDockerfile
+var CheckRules = []CheckRule{
+	{"ConsistentInstructionCasing", "All commands within the Dockerfile should use the same casing (either upper or lower)"},
+	{"DuplicateStageName", "Stage names should be unique"},
+	{"FromAsCasing", "The 'as' keyword should match the case of the 'from' keyword"},
+	{"JSONArgsRecommended", "JSON arguments recommended for ENTRYPOINT/CMD to prevent unintended behavior related to OS signals"},
+	{"LegacyKeyValueFormat", "Legacy key/value format with whitespace separator should not be used"},
+	{"MaintainerDeprecated", "The MAINTAINER instruction is deprecated, use a label instead to define an image author"},
+	{"StageNameCasing", "Stage names should be lowercase"},
+	{"WorkdirRelativePath", "Relative workdir without an absolute workdir declared within the build can have unexpected results if the base image changes"},
+}
+
+type CheckResult struct {
+	Rule    string
+	Message string
+	Line    int
+}
+
+type dockerfileInstruction struct {
+	cmd  string
+	args []string
+	line int
+}
+
+// CheckDockerfile evaluates CheckRules against a Dockerfile
+func CheckDockerfile(dockerfile []byte) ([]CheckResult, error) {
+	instructions, err := splitInstructions(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	var results []CheckResult
+	add := func(rule string, line int, format string, args ...interface{}) {
+		results = append(results, CheckResult{Rule: rule, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	upper, lower := 0, 0
+	for _, inst := range instructions {
+		if inst.cmd == strings.ToUpper(inst.cmd) {
+			upper++
+		} else if inst.cmd == strings.ToLower(inst.cmd) {
+			lower++
+		}
+	}
+
+	stages := map[string]int{}
+	absWorkdir := false
+	for _, inst := range instructions {
+		cmd := strings.ToUpper(inst.cmd)
+		if upper >= lower && inst.cmd != cmd || upper < lower && inst.cmd != strings.ToLower(inst.cmd) {
+			expected := "uppercase"
+			if upper < lower {
+				expected = "lowercase"
+			}
+			add("ConsistentInstructionCasing", inst.line, "Command '%s' should match the case of the command majority (%s)", inst.cmd, expected)
+		}
+		switch cmd {
+		case "FROM":
+			absWorkdir = false
+			args := withoutFlags(inst.args)
+			if len(args) < 3 || !strings.EqualFold(args[1], "as") {
+				continue
+			}
+			fromUpper := inst.cmd == strings.ToUpper(inst.cmd)
+			asUpper := args[1] == strings.ToUpper(args[1])
+			if fromUpper != asUpper {
+				add("FromAsCasing", inst.line, "'%s' and '%s' keywords' casing do not match", args[1], inst.cmd)
+			}
+			name := args[2]
+			if name != strings.ToLower(name) {
+				add("StageNameCasing", inst.line, "Stage name '%s' should be lowercase", name)
+			}
+			if prev, ok := stages[strings.ToLower(name)]; ok {
+				add("DuplicateStageName", inst.line, "Duplicate stage name '%s', stage names should be unique (first defined on line %d)", name, prev)
+			} else {
+				stages[strings.ToLower(name)] = inst.line
+			}
+		case "MAINTAINER":
+			add("MaintainerDeprecated", inst.line, "Maintainer instruction is deprecated in favor of using label")
+		case "CMD", "ENTRYPOINT":
+			if len(inst.args) > 0 && !strings.HasPrefix(inst.args[0], "[") {
+				add("JSONArgsRecommended", inst.line, "JSON arguments recommended for %s to prevent unintended behavior related to OS signals", cmd)
+			}
+		case "ENV", "LABEL":
+			if len(inst.args) > 1 && !strings.Contains(inst.args[0], "=") {
+				add("LegacyKeyValueFormat", inst.line, "\"%s key=value\" should be used instead of legacy \"%s key value\" format", cmd, cmd)
+			}
+		case "WORKDIR":
+			if len(inst.args) == 0 {
+				continue
+			}
+			dir := inst.args[0]
+			if strings.HasPrefix(dir, "/") || strings.HasPrefix(dir, "$") {
+				absWorkdir = true
+			} else if !absWorkdir {
+				add("WorkdirRelativePath", inst.line, "Relative workdir %q can have unexpected results if the base image changes", dir)
+			}
+		}
+	}
+	return results, nil
+}
+
+// splitInstructions joins continuation lines and drops comments, heredoc
+// bodies are passed over
+func splitInstructions(dockerfile []byte) ([]dockerfileInstruction, error) {
+	var res []dockerfileInstruction
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	lineNo := 0
+	var current *dockerfileInstruction
+	var buf string
+	heredoc := ""
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if heredoc != "" {
+			if strings.TrimSpace(line) == heredoc {
+				heredoc = ""
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if current == nil && (trimmed == "" || strings.HasPrefix(trimmed, "#")) {
+			continue
+		}
+		if current == nil {
+			current = &dockerfileInstruction{line: lineNo}
+			buf = ""
+		} else if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasSuffix(trimmed, "\\") {
+			buf += strings.TrimSuffix(trimmed, "\\") + " "
+			continue
+		}
+		buf += trimmed
+		fields := strings.Fields(buf)
+		if len(fields) > 0 {
+			current.cmd = fields[0]
+			current.args = fields[1:]
+			for _, f := range current.args {
+				if strings.HasPrefix(f, "<<") {
+					heredoc = strings.Trim(strings.TrimLeft(strings.TrimPrefix(f, "<<"), "-"), `"'`)
+				}
+			}
+			res = append(res, *current)
+		}
+		current = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func withoutFlags(args []string) []string {
+	for i, a := range args {
+		if !strings.HasPrefix(a, "--") {
+			return args[i:]
+		}
+	}
+	return nil
+}
+
+// ParseCheckOutputs parses "format=filename" check report destinations
+func ParseCheckOutputs(in []string) (map[string]string, error) {
+	res := make(map[string]string, len(in))
+	for _, s := range in {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("invalid check output %q, expected format=filename", s)
+		}
+		switch parts[0] {
+		case CheckOutputSARIF, CheckOutputJUnit:
+		default:
+			return nil, errors.Errorf("unsupported check output format %q, use sarif or junit", parts[0])
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// CheckSummary summarizes the results, the number of findings of each rule
+// in rule order
+func CheckSummary(results []CheckResult) string {
+	if len(results) == 0 {
+		return "no findings"
+	}
+	counts := map[string]int{}
+	var rules []string
+	for _, r := range results {
+		if counts[r.Rule] == 0 {
+			rules = append(rules, r.Rule)
+		}
+		counts[r.Rule]++
+	}
+	sort.Strings(rules)
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = fmt.Sprintf("%s: %d", rule, counts[rule])
+	}
+	findings := "findings"
+	if len(results) == 1 {
+		findings = "finding"
+	}
+	return fmt.Sprintf("%d %s (%s)", len(results), findings, strings.Join(parts, ", "))
+}
+
+// WriteCheckReport writes the results for the named Dockerfile in the given format
+func WriteCheckReport(w io.Writer, format, dockerfile string, results []CheckResult) error {
+	switch format {
+	case CheckOutputSARIF:
+		return writeSARIF(w, dockerfile, results)
+	case CheckOutputJUnit:
+		return writeJUnit(w, dockerfile, results)
+	}
+	return errors.Errorf("unsupported check output format %q", format)
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine int `json:"startLine"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+func writeSARIF(w io.Writer, dockerfile string, results []CheckResult) error {
+	rules := make([]sarifRule, len(CheckRules))
+	for i, r := range CheckRules {
+		rules[i] = sarifRule{ID: r.ID, ShortDescription: sarifMessage{Text: r.Description}}
+	}
+	sarifResults := make([]sarifResult, len(results))
+	for i, r := range results {
+		var loc sarifLocation
+		loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(dockerfile)
+		loc.PhysicalLocation.Region.StartLine = r.Line
+		sarifResults[i] = sarifResult{
+			RuleID:    r.Rule,
+			Level:     "warning",
+			Message:   sarifMessage{Text: r.Message},
+			Locations: []sarifLocation{loc},
+		}
+	}
+	report := map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []interface{}{
+			map[string]interface{}{
+				"tool": map[string]interface{}{
+					"driver": map[string]interface{}{
+						"name":           "kubectl-buildkit",
+						"informationUri": "https://github.com/vmware-tanzu/buildkit-cli-for-kubectl",
+						"rules":          rules,
+					},
+				},
+				"results": sarifResults,
+			},
+		},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// writeJUnit reports each rule as a test case which fails if the rule has findings
+func writeJUnit(w io.Writer, dockerfile string, results []CheckResult) error {
+	suite := junitTestSuite{Name: "dockerfile checks", Tests: len(CheckRules)}
+	for _, rule := range CheckRules {
+		tc := junitTestCase{ClassName: filepath.ToSlash(dockerfile), Name: rule.ID}
+		var lines []string
+		for _, r := range results {
+			if r.Rule == rule.ID {
+				lines = append(lines, fmt.Sprintf("%s:%d: %s", filepath.ToSlash(dockerfile), r.Line, r.Message))
+			}
+		}
+		if len(lines) > 0 {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: rule.Description, Text: strings.Join(lines, "\n")}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(struct {
+		XMLName xml.Name         `xml:"testsuites"`
+		Suites  []junitTestSuite `xml:"testsuite"`
+	}{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
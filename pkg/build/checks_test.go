@@ -0,0 +1,98 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const checkDockerfile = `# syntax=docker/dockerfile:1
+FROM golang:1.16 as Builder
+MAINTAINER someone@example.com
+workdir src
+ENV GOFLAGS -mod=vendor
+RUN go build \
+    -o /out/app .
+
+FROM alpine AS builder
+COPY --from=Builder /out/app /app
+CMD /app
+`
+
+func Test_CheckDockerfile(t *testing.T) {
+	t.Parallel()
+	results, err := CheckDockerfile([]byte(checkDockerfile))
+	require.NoError(t, err)
+
+	rules := map[string]int{}
+	for _, r := range results {
+		rules[r.Rule] = r.Line
+	}
+	assert.Equal(t, map[string]int{
+		"FromAsCasing":                2,
+		"StageNameCasing":             2,
+		"MaintainerDeprecated":        3,
+		"ConsistentInstructionCasing": 4,
+		"WorkdirRelativePath":         4,
+		"LegacyKeyValueFormat":        5,
+		"DuplicateStageName":          9,
+		"JSONArgsRecommended":         11,
+	}, rules)
+
+	results, err = CheckDockerfile([]byte("FROM alpine AS base\nWORKDIR /src\nENV A=b\nCMD [\"/app\"]\n"))
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func Test_ParseCheckOutputs(t *testing.T) {
+	t.Parallel()
+	outputs, err := ParseCheckOutputs([]string{"sarif=report.sarif", "junit=checks.xml"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"sarif": "report.sarif", "junit": "checks.xml"}, outputs)
+
+	_, err = ParseCheckOutputs([]string{"html=report.html"})
+	assert.Error(t, err)
+	_, err = ParseCheckOutputs([]string{"sarif"})
+	assert.Error(t, err)
+}
+
+func Test_WriteCheckReport(t *testing.T) {
+	t.Parallel()
+	results := []CheckResult{{Rule: "MaintainerDeprecated", Message: "Maintainer instruction is deprecated in favor of using label", Line: 3}}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteCheckReport(buf, CheckOutputSARIF, "app/Dockerfile", results))
+	var sarif struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Results []sarifResult `json:"results"`
+		} `json:"runs"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &sarif))
+	assert.Equal(t, "2.1.0", sarif.Version)
+	require.Len(t, sarif.Runs, 1)
+	require.Len(t, sarif.Runs[0].Results, 1)
+	assert.Equal(t, "MaintainerDeprecated", sarif.Runs[0].Results[0].RuleID)
+	assert.Equal(t, 3, sarif.Runs[0].Results[0].Locations[0].PhysicalLocation.Region.StartLine)
+
+	buf.Reset()
+	require.NoError(t, WriteCheckReport(buf, CheckOutputJUnit, "app/Dockerfile", results))
+	assert.Contains(t, buf.String(), `<testsuite name="dockerfile checks" tests="8" failures="1">`)
+	assert.Contains(t, buf.String(), "app/Dockerfile:3: Maintainer instruction is deprecated")
+}
+
+func Test_CheckSummary(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "no findings", CheckSummary(nil))
+	require.Equal(t, "1 finding (MaintainerDeprecated: 1)", CheckSummary([]CheckResult{{Rule: "MaintainerDeprecated", Line: 3}}))
+	require.Equal(t, "3 findings (FromAsCasing: 1, WorkdirRelativePath: 2)", CheckSummary([]CheckResult{
+		{Rule: "WorkdirRelativePath", Line: 4},
+		{Rule: "FromAsCasing", Line: 2},
+		{Rule: "WorkdirRelativePath", Line: 9},
+	}))
+}
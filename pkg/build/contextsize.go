@@ -0,0 +1,145 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/pkg/errors"
+)
+
+// The local build context is uploaded to the builder, minus what its
+// .dockerignore excludes.  Measuring it first catches a context which
+// accidentally includes node_modules, .git or build outputs before GBs are
+// sent, and tells which of its entries to exclude.
+
+// ContextUsage is the size of a local build context, as sent to the builder
+type ContextUsage struct {
+	Size  int64
+	Files int
+	// Entries are the top level files and directories of the context, largest first
+	Entries []ContextEntry
+}
+
+// ContextEntry is a top level file or directory of the build context
+type ContextEntry struct {
+	Path  string
+	Size  int64
+	Files int
+	Dir   bool
+}
+
+// MeasureContext sums the size of the files of dir not excluded by its
+// .dockerignore
+func MeasureContext(dir string) (*ContextUsage, error) {
+	res := &ContextUsage{}
+	entries := map[string]*ContextEntry{}
+	err := walkContext(dir, func(rel string, fi os.FileInfo) error {
+		top := strings.SplitN(rel, "/", 2)[0]
+		e, ok := entries[top]
+		if !ok {
+			e = &ContextEntry{Path: top}
+			entries[top] = e
+		}
+		if fi.IsDir() {
+			e.Dir = true
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			e.Size += fi.Size()
+			e.Files++
+			res.Size += fi.Size()
+			res.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		res.Entries = append(res.Entries, *e)
+	}
+	sort.Slice(res.Entries, func(i, j int) bool {
+		if res.Entries[i].Size == res.Entries[j].Size {
+			return res.Entries[i].Path < res.Entries[j].Path
+		}
+		return res.Entries[i].Size > res.Entries[j].Size
+	})
+	return res, nil
+}
+
+// walkContext calls fn with the slash separated path relative to dir of the
+// files and directories of dir not excluded by its .dockerignore, in lexical
+// order
+func walkContext(dir string, fn func(rel string, fi os.FileInfo) error) error {
+	dir = longPath(dir)
+	excludes, err := readDockerignore(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read .dockerignore")
+	}
+	pm, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return errors.Wrap(err, "invalid .dockerignore")
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		excluded, err := pm.Matches(rel)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			// A later !pattern may include files of an excluded directory
+			if fi.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(rel, fi)
+	})
+}
+
+// AppendDockerignore adds the patterns the .dockerignore of dir doesn't
+// have yet to it, creating it if needed
+func AppendDockerignore(dir string, patterns []string) error {
+	filename := filepath.Join(dir, ".dockerignore")
+	dt, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing, err := readDockerignore(dir)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, e := range existing {
+		seen[e] = true
+	}
+	var add []string
+	for _, p := range patterns {
+		clean := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(p)), "/")
+		if !seen[clean] {
+			seen[clean] = true
+			add = append(add, p)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	if len(dt) > 0 && !strings.HasSuffix(string(dt), "\n") {
+		dt = append(dt, '\n')
+	}
+	dt = append(dt, strings.Join(add, "\n")+"\n"...)
+	return ioutil.WriteFile(filename, dt, 0644)
+}
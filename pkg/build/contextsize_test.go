@@ -0,0 +1,70 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeContextFiles(t *testing.T, dir string, files map[string]int) {
+	for name, size := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, make([]byte, size), 0644))
+	}
+}
+
+func Test_MeasureContext(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "context")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeContextFiles(t, dir, map[string]int{
+		"Dockerfile":                 10,
+		"node_modules/a/index.js":    1000,
+		"node_modules/b/index.js":    500,
+		"src/main.go":                100,
+		".git/objects/pack/big.pack": 5000,
+	})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte(".git\n"), 0644))
+
+	usage, err := MeasureContext(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(1615), usage.Size)
+	require.Equal(t, 5, usage.Files)
+	require.Equal(t, []ContextEntry{
+		{Path: "node_modules", Size: 1500, Files: 2, Dir: true},
+		{Path: "src", Size: 100, Files: 1, Dir: true},
+		{Path: "Dockerfile", Size: 10, Files: 1},
+		{Path: ".dockerignore", Size: 5, Files: 1},
+	}, usage.Entries)
+
+	// Exclusions include files back from an excluded directory
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte(".git\nnode_modules\n!node_modules/b\n"), 0644))
+	usage, err = MeasureContext(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(500+100+10+34), usage.Size)
+}
+
+func Test_AppendDockerignore(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "context")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, AppendDockerignore(dir, []string{"node_modules"}))
+	dt, err := ioutil.ReadFile(filepath.Join(dir, ".dockerignore"))
+	require.NoError(t, err)
+	require.Equal(t, "node_modules\n", string(dt))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("# comment\n/dist"), 0644))
+	require.NoError(t, AppendDockerignore(dir, []string{"dist", "node_modules", ".git", "node_modules"}))
+	dt, err = ioutil.ReadFile(filepath.Join(dir, ".dockerignore"))
+	require.NoError(t, err)
+	require.Equal(t, "# comment\n/dist\nnode_modules\n.git\n", string(dt))
+}
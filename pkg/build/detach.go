@@ -0,0 +1,526 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session/auth"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// A solve is cancelled by buildkitd as soon as the client session goes away, so
+// detached builds upload the build inputs into the chosen builder pod and run
+// buildctl there in the background.  The pod keeps the log and exit code of the
+// build under DetachedBuildDir until the pod is restarted, or until the
+// records of finished builds exceed the retention of the builder, which is
+// enforced on the chosen pod whenever a detached build starts.
+
+const (
+	DetachedBuildDir = "/tmp/buildkit-detached"
+
+	DetachedStateRunning = "running"
+	DetachedStateDone    = "succeeded"
+	DetachedStateFailed  = "failed"
+	// The build process vanished without recording an exit code (eg. killed)
+	DetachedStateLost = "lost"
+)
+
+type DetachedBuild struct {
+	ID       string
+	Node     string
+	State    string
+	ExitCode int
+}
+
+// BuildDetached starts the build on one of the builder pods and returns as soon
+// as the build is running.  Only outputs that complete on the builder (pushes and
+// images stored in the containerd runtime) are supported.  If grace is non-zero
+// the build is cancelled when no client stays attached for that long.
+func BuildDetached(ctx context.Context, d driver.Driver, opt Options, registrySecretName string, grace time.Duration, pw progress.Writer) (*DetachedBuild, error) {
+	defer func() {
+		close(pw.Status())
+		<-pw.Done()
+	}()
+	info, err := d.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkScratchSize(info, opt.ScratchSize); err != nil {
+		return nil, err
+	}
+	clients, err := driver.Boot(driver.WithPlatforms(ctx, opt.Platforms), d, pw)
+	if err != nil {
+		return nil, err
+	}
+	node := clients.ChosenNode.NodeName
+	var duErr error
+	if opt.PullPolicy == PullNever {
+		var du []*client.UsageInfo
+		du, duErr = clients.ChosenNode.BuildKitClient.DiskUsage(ctx)
+		opt.Inputs.Cached = append([]*client.UsageInfo{}, du...)
+	}
+	clients.ChosenNode.BuildKitClient.Close()
+	for _, n := range clients.OtherNodes {
+		n.BuildKitClient.Close()
+	}
+	if duErr != nil {
+		return nil, errors.Wrap(duErr, "failed to read the cache of the builder")
+	}
+	if info.HistoryMaxRecords > 0 || info.HistoryMaxAge > 0 {
+		if _, err := pruneDetachedBuilds(ctx, d, node, info.HistoryMaxRecords, info.HistoryMaxAge); err != nil {
+			logrus.Warnf("failed to remove old detached build records: %s", err)
+		}
+	}
+
+	so, release, err := toSolveOpt(ctx, d, info, false, opt, func(string) (io.WriteCloser, func(), error) {
+		return nil, nil, errors.Errorf("loading the image into the runtime is not supported for detached builds, use --push or a runtime with the containerd image store")
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	db := &DetachedBuild{
+		ID:    opt.BuildID,
+		Node:  node,
+		State: DetachedStateRunning,
+	}
+	if db.ID == "" {
+		db.ID = identity.NewID()
+	} else if err := d.RecordBuild(ctx, node, db.ID); err != nil {
+		logrus.Debug(err)
+	}
+	dir := detachedDir(db.ID)
+	args, err := detachedBuildArgs(so, dir)
+	if err != nil {
+		return nil, err
+	}
+	dockerConfig, err := detachedDockerConfig(ctx, d, registrySecretName, so)
+	if err != nil {
+		return nil, err
+	}
+
+	progress.Write(pw, fmt.Sprintf("[internal] uploading build inputs to %s", node), func() error {
+		err = func() error {
+			mkdir := "umask 077 && mkdir -p " + dir
+			for _, e := range so.Exports {
+				// Outputs written in the pod, to a claim
+				if dest := e.Attrs["dest"]; dest != "" && e.Output == nil {
+					mkdir += " && mkdir -p " + shellQuote(filepath.Dir(dest))
+				}
+			}
+			if err := d.Exec(ctx, node, []string{"sh", "-c", mkdir + " && cat > " + dir + "/config.json"}, bytes.NewReader(dockerConfig), nil, os.Stderr); err != nil {
+				return err
+			}
+			for _, name := range sortedKeys(so.LocalDirs) {
+				if err := uploadDir(ctx, d, node, so.LocalDirs[name], dir+"/src/"+name); err != nil {
+					return errors.Wrapf(err, "failed to upload %s", name)
+				}
+			}
+			script := detachedBuildScript(dir, args, grace)
+			return d.Exec(ctx, node, []string{"sh", "-c", "cat > " + dir + "/run.sh"}, strings.NewReader(script), nil, os.Stderr)
+		}()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress.Write(pw, fmt.Sprintf("[internal] starting detached build %s", db.ID), func() error {
+		err = d.Exec(ctx, node, []string{"sh", "-c", "nohup sh " + dir + "/run.sh > /dev/null 2>&1 &"}, nil, nil, os.Stderr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// DetachedBuildStatus looks up a detached build on the builder pods
+func DetachedBuildStatus(ctx context.Context, d driver.Driver, id string) (*DetachedBuild, error) {
+	if err := validateDetachedID(id); err != nil {
+		return nil, err
+	}
+	info, err := d.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dir := detachedDir(id)
+	script := "cd " + dir + " 2>/dev/null || exit 0; " +
+		"if [ -f exit ]; then echo exited $(cat exit); " +
+		"elif [ -f pid ] && kill -0 $(cat pid) 2>/dev/null; then echo " + DetachedStateRunning + "; " +
+		"else echo " + DetachedStateLost + "; fi"
+	for _, node := range info.DynamicNodes {
+		buf := &bytes.Buffer{}
+		if err := d.Exec(ctx, node.Name, []string{"sh", "-c", script}, nil, buf, ioutil.Discard); err != nil {
+			return nil, errors.Wrapf(err, "failed to query %s", node.Name)
+		}
+		fields := strings.Fields(buf.String())
+		if len(fields) == 0 {
+			continue
+		}
+		db := &DetachedBuild{ID: id, Node: node.Name, State: fields[0]}
+		if fields[0] == "exited" && len(fields) == 2 {
+			db.ExitCode, _ = strconv.Atoi(fields[1])
+			db.State = DetachedStateDone
+			if db.ExitCode != 0 {
+				db.State = DetachedStateFailed
+			}
+		}
+		return db, nil
+	}
+	return nil, errors.Errorf("detached build %q not found, the builder pod may have been restarted", id)
+}
+
+// AttachDetachedBuild streams the build log to out, starting offset bytes into
+// the log, until the build exits.  While attached the heartbeat of the build is
+// refreshed so builds started with a reconnect grace period keep running.
+func AttachDetachedBuild(ctx context.Context, d driver.Driver, id string, offset int64, out io.Writer) (*DetachedBuild, error) {
+	db, err := DetachedBuildStatus(ctx, d, id)
+	if err != nil {
+		return nil, err
+	}
+	dir := detachedDir(id)
+	script := fmt.Sprintf("tail -c +%d -f %s/log & T=$!; ", offset+1, dir) +
+		"while [ ! -f " + dir + "/exit ] && kill -0 $(cat " + dir + "/pid) 2>/dev/null; do touch " + dir + "/heartbeat; sleep 1; done; " +
+		"sleep 1; kill $T"
+	if err := d.Exec(ctx, db.Node, []string{"sh", "-c", script}, nil, out, os.Stderr); err != nil {
+		return nil, err
+	}
+	return DetachedBuildStatus(ctx, d, id)
+}
+
+// CancelDetachedBuild stops a running detached build
+func CancelDetachedBuild(ctx context.Context, d driver.Driver, id string) error {
+	db, err := DetachedBuildStatus(ctx, d, id)
+	if err != nil {
+		return err
+	}
+	if db.State != DetachedStateRunning {
+		return errors.Errorf("detached build %q is not running (%s)", id, db.State)
+	}
+	// Interrupting buildctl closes the session which cancels the solve on the builder
+	return d.Exec(ctx, db.Node, []string{"sh", "-c", "kill -INT $(cat " + detachedDir(id) + "/pid)"}, nil, nil, os.Stderr)
+}
+
+// PurgeDetachedCredentials removes the registry credentials uploaded for
+// detached builds from every builder pod, builds still running lose access to
+// private registries
+func PurgeDetachedCredentials(ctx context.Context, d driver.Driver) error {
+	info, err := d.Info(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range info.DynamicNodes {
+		if err := d.Exec(ctx, node.Name, []string{"sh", "-c", "rm -f " + DetachedBuildDir + "/*/config.json"}, nil, nil, os.Stderr); err != nil {
+			return errors.Wrapf(err, "failed to purge credentials on %s", node.Name)
+		}
+	}
+	return nil
+}
+
+// PruneDetachedBuilds removes the records of finished detached builds from
+// every builder pod, keeping the maxRecords most recent of each pod and
+// those finished within maxAge (0 for no limit).  It returns the IDs removed.
+func PruneDetachedBuilds(ctx context.Context, d driver.Driver, maxRecords int, maxAge time.Duration) ([]string, error) {
+	info, err := d.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, node := range info.DynamicNodes {
+		ids, err := pruneDetachedBuilds(ctx, d, node.Name, maxRecords, maxAge)
+		if err != nil {
+			return removed, errors.Wrapf(err, "failed to remove old detached builds on %s", node.Name)
+		}
+		removed = append(removed, ids...)
+	}
+	return removed, nil
+}
+
+func pruneDetachedBuilds(ctx context.Context, d driver.Driver, node string, maxRecords int, maxAge time.Duration) ([]string, error) {
+	script := detachedPruneScript(DetachedBuildDir, maxRecords, maxAge)
+	if script == "" {
+		return nil, nil
+	}
+	buf := &bytes.Buffer{}
+	if err := d.Exec(ctx, node, []string{"sh", "-c", script}, nil, buf, os.Stderr); err != nil {
+		return nil, err
+	}
+	return strings.Fields(buf.String()), nil
+}
+
+// detachedPruneScript generates the script removing the finished records under
+// dir beyond the retention limits, newest first by the time the record last
+// changed, which is when the build exited.  Running builds are never removed,
+// nor are records still being uploaded, without a pid, unless an hour old.
+func detachedPruneScript(dir string, maxRecords int, maxAge time.Duration) string {
+	var expired []string
+	if maxRecords > 0 {
+		expired = append(expired, fmt.Sprintf("[ $n -gt %d ]", maxRecords))
+	}
+	if maxAge > 0 {
+		expired = append(expired, fmt.Sprintf("[ $age -gt %d ]", int64(maxAge/time.Second)))
+	}
+	if len(expired) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`cd %s 2>/dev/null || exit 0
+now=$(date +%%s)
+n=0
+for id in $(ls -t); do
+  [ -d "$id" ] || continue
+  age=$(( now - $(stat -c %%Y "$id") ))
+  if [ ! -f "$id/exit" ]; then
+    if [ -f "$id/pid" ]; then
+      kill -0 $(cat "$id/pid") 2>/dev/null && continue
+    elif [ $age -lt 3600 ]; then
+      continue
+    fi
+  fi
+  n=$(( n + 1 ))
+  if %s; then
+    rm -rf "$id" && echo "$id"
+  fi
+done
+`, dir, strings.Join(expired, " || "))
+}
+
+func detachedDir(id string) string {
+	return DetachedBuildDir + "/" + id
+}
+
+func validateDetachedID(id string) error {
+	if id == "" {
+		return errors.Errorf("build ID required")
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return errors.Errorf("invalid build ID %q", id)
+		}
+	}
+	return nil
+}
+
+// detachedBuildArgs translates the solve options into buildctl arguments
+// with the local directories relocated under dir on the builder
+func detachedBuildArgs(so *client.SolveOpt, dir string) ([]string, error) {
+	args := []string{"build", "--progress=plain", "--frontend", so.Frontend}
+	for _, name := range sortedKeys(so.LocalDirs) {
+		args = append(args, "--local", name+"="+dir+"/src/"+name)
+	}
+	for _, k := range sortedKeys(so.FrontendAttrs) {
+		if strings.HasPrefix(k, "context:") && strings.HasPrefix(so.FrontendAttrs[k], ociLayoutScheme) {
+			return nil, errors.Errorf("OCI layout build contexts are served by the client and not supported for detached builds")
+		}
+		args = append(args, "--opt", k+"="+so.FrontendAttrs[k])
+	}
+	for _, e := range so.Exports {
+		if e.Output != nil || e.OutputDir != "" {
+			return nil, errors.Errorf("%q outputs are written on the client and not supported for detached builds", e.Type)
+		}
+		args = append(args, "--output", csvAttrs(e.Type, e.Attrs))
+	}
+	for _, e := range so.CacheExports {
+		if e.Type == "local" {
+			return nil, errors.Errorf("local cache export is not supported for detached builds")
+		}
+		args = append(args, "--export-cache", csvAttrs(e.Type, e.Attrs))
+	}
+	for _, e := range so.CacheImports {
+		if e.Type == "local" {
+			return nil, errors.Errorf("local cache import is not supported for detached builds")
+		}
+		args = append(args, "--import-cache", csvAttrs(e.Type, e.Attrs))
+	}
+	for _, ent := range so.AllowedEntitlements {
+		args = append(args, "--allow", string(ent))
+	}
+	return args, nil
+}
+
+// detachedBuildScript generates the script which runs the build on the builder.
+// With a non-zero grace period a watchdog cancels the build once no client has
+// been attached (refreshing the heartbeat file) for longer than the grace period.
+func detachedBuildScript(dir string, args []string, grace time.Duration) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	watchdog := ""
+	if grace > 0 {
+		watchdog = fmt.Sprintf(`touch heartbeat
+(
+  while kill -0 $PID 2>/dev/null; do
+    if [ $(( $(date +%%s) - $(stat -c %%Y heartbeat) )) -gt %[1]d ]; then
+      echo "no client attached for %[1]ds, cancelling build" >> log
+      kill -INT $PID
+      break
+    fi
+    sleep 5
+  done
+) &
+`, int64(grace/time.Second))
+	}
+	return fmt.Sprintf(`cd %[1]s
+export DOCKER_CONFIG=%[1]s
+buildctl %[2]s > log 2>&1 &
+PID=$!
+echo $PID > pid
+%[3]swait $PID
+echo $? > exit
+rm -rf config.json src
+`, dir, strings.Join(quoted, " "), watchdog)
+}
+
+// detachedDockerConfig resolves the registry credentials for the pushed images
+// and registry caches, since the client session can't answer auth requests
+// once the build is detached
+func detachedDockerConfig(ctx context.Context, d driver.Driver, registrySecretName string, so *client.SolveOpt) ([]byte, error) {
+	var refs []string
+	for _, e := range so.Exports {
+		if e.Attrs["name"] != "" {
+			refs = append(refs, strings.Split(e.Attrs["name"], ",")...)
+		}
+	}
+	for _, e := range append(so.CacheExports, so.CacheImports...) {
+		if e.Type == "registry" && e.Attrs["ref"] != "" {
+			refs = append(refs, e.Attrs["ref"])
+		}
+	}
+	authServer, ok := d.GetAuthProvider(registrySecretName, ioutil.Discard).(auth.AuthServer)
+	cfg := credStore{Auths: map[string]credEntry{}}
+	for _, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil || !ok {
+			continue
+		}
+		host := reference.Domain(named)
+		key := host
+		if host == "docker.io" {
+			host = "registry-1.docker.io"
+			key = "https://index.docker.io/v1/"
+		}
+		if _, found := cfg.Auths[key]; found {
+			continue
+		}
+		res, err := authServer.Credentials(ctx, &auth.CredentialsRequest{Host: host})
+		if err != nil {
+			return nil, err
+		}
+		if res.Secret == "" {
+			continue
+		}
+		if res.Username == "" {
+			cfg.Auths[key] = credEntry{IdentityToken: res.Secret}
+		} else {
+			cfg.Auths[key] = credEntry{Username: res.Username, Password: res.Secret}
+		}
+	}
+	return json.Marshal(cfg)
+}
+
+type credEntry struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+type credStore struct {
+	Auths map[string]credEntry `json:"auths"`
+}
+
+func uploadDir(ctx context.Context, d driver.Driver, node, src, dest string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDir(src, pw))
+	}()
+	err := d.Exec(ctx, node, []string{"sh", "-c", "mkdir -p " + shellQuote(dest) + " && tar -xf - -C " + shellQuote(dest)}, pr, nil, os.Stderr)
+	pr.Close()
+	return err
+}
+
+func tarDir(dir string, w io.Writer) error {
+	dir = longPath(dir)
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func csvAttrs(typ string, attrs map[string]string) string {
+	fields := []string{"type=" + typ}
+	for _, k := range sortedKeys(attrs) {
+		fields = append(fields, k+"="+attrs[k])
+	}
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/entitlements"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_detachedBuildArgs(t *testing.T) {
+	t.Parallel()
+	so := &client.SolveOpt{
+		Frontend: "dockerfile.v0",
+		FrontendAttrs: map[string]string{
+			"filename":          "Dockerfile",
+			"build-arg:VERSION": "1.0",
+		},
+		LocalDirs: map[string]string{
+			"context":    "/home/user/src",
+			"dockerfile": "/home/user/src",
+		},
+		Exports: []client.ExportEntry{{
+			Type:  "image",
+			Attrs: map[string]string{"name": "acme.com/a:1,acme.com/a:latest", "push": "true"},
+		}},
+		CacheImports: []client.CacheOptionsEntry{{
+			Type:  "registry",
+			Attrs: map[string]string{"ref": "acme.com/a:cache"},
+		}},
+		AllowedEntitlements: []entitlements.Entitlement{entitlements.EntitlementNetworkHost},
+	}
+	args, err := detachedBuildArgs(so, "/tmp/buildkit-detached/abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"build", "--progress=plain", "--frontend", "dockerfile.v0",
+		"--local", "context=/tmp/buildkit-detached/abc/src/context",
+		"--local", "dockerfile=/tmp/buildkit-detached/abc/src/dockerfile",
+		"--opt", "build-arg:VERSION=1.0",
+		"--opt", "filename=Dockerfile",
+		"--output", `type=image,"name=acme.com/a:1,acme.com/a:latest",push=true`,
+		"--import-cache", "type=registry,ref=acme.com/a:cache",
+		"--allow", "network.host",
+	}, args)
+
+	so.Exports = []client.ExportEntry{{Type: "local", OutputDir: "out"}}
+	_, err = detachedBuildArgs(so, "/tmp/buildkit-detached/abc")
+	assert.Error(t, err)
+
+	// The session serving the OCI layout ends with the client
+	so.Exports = nil
+	so.FrontendAttrs["context:base"] = "oci-layout://abc@sha256:e1c082e3d3c45cccac829840a25941e679c25d438cc8412c2fa221cf1a824e6a"
+	_, err = detachedBuildArgs(so, "/tmp/buildkit-detached/abc")
+	assert.Error(t, err)
+}
+
+func Test_shellQuote(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, `'plain'`, shellQuote("plain"))
+	assert.Equal(t, `'it'\''s $HOME'`, shellQuote("it's $HOME"))
+}
+
+func Test_validateDetachedID(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, validateDetachedID("x8m3o2wbcdx5pmmzqzj9ebvau"))
+	assert.Error(t, validateDetachedID(""))
+	assert.Error(t, validateDetachedID("abc; rm -rf /"))
+}
+
+func Test_detachedBuildScript(t *testing.T) {
+	t.Parallel()
+	script := detachedBuildScript("/tmp/buildkit-detached/abc", []string{"build", "--opt", "label:a=b c"}, 0)
+	assert.Contains(t, script, `buildctl 'build' '--opt' 'label:a=b c' > log 2>&1 &`)
+	assert.NotContains(t, script, "heartbeat")
+
+	script = detachedBuildScript("/tmp/buildkit-detached/abc", []string{"build"}, 5*time.Minute)
+	assert.Contains(t, script, "$(stat -c %Y heartbeat) )) -gt 300 ]")
+}
+
+func Test_detachedPruneScript(t *testing.T) {
+	t.Parallel()
+	assert.Empty(t, detachedPruneScript(DetachedBuildDir, 0, 0))
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "detached")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	record := func(id string, age time.Duration, files map[string]string) {
+		p := filepath.Join(dir, id)
+		require.NoError(t, os.Mkdir(p, 0700))
+		for name, content := range files {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(p, name), []byte(content), 0600))
+		}
+		require.NoError(t, os.Chtimes(p, now.Add(-age), now.Add(-age)))
+	}
+	record("running", 3*time.Hour, map[string]string{"pid": strconv.Itoa(os.Getpid())})
+	record("uploading", time.Minute, nil)
+	record("new", time.Minute, map[string]string{"exit": "0"})
+	record("recent", time.Hour, map[string]string{"exit": "1"})
+	record("lost", 2*time.Hour, map[string]string{"pid": "999999999"})
+	record("old", 48*time.Hour, map[string]string{"exit": "0"})
+
+	prune := func(maxRecords int, maxAge time.Duration) []string {
+		out, err := exec.Command("sh", "-c", detachedPruneScript(dir, maxRecords, maxAge)).Output()
+		require.NoError(t, err)
+		removed := strings.Fields(string(out))
+		sort.Strings(removed)
+		return removed
+	}
+	assert.Equal(t, []string{"old"}, prune(0, 24*time.Hour))
+	assert.Equal(t, []string{"lost", "recent"}, prune(1, 0))
+	assert.Equal(t, []string{"new"}, prune(0, time.Second))
+	left, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, left, 2, "running and uploading builds are kept")
+}
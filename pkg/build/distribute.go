@@ -0,0 +1,212 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/csv"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+)
+
+// A build solves on a single builder pod, so the independent stages of a
+// large Dockerfile share the resources of that pod.  An experimental
+// distributed build first builds the stages the target depends on, which
+// don't depend on one another, concurrently as builds of their own on the
+// pods they stick to, each exporting its cache to a registry.  The target is
+// then built on its pod from those caches, the stages are cache hits there
+// and the image is exported as usual.
+
+// DockerfileStage is a stage of a Dockerfile and the stages it uses
+type DockerfileStage struct {
+	// Name is the lower case name of the stage, empty if it has none
+	Name string
+	// Deps are the indexes of the stages it is built FROM, copies from or mounts
+	Deps []int
+}
+
+// DockerfileStages returns the stages of a Dockerfile
+func DockerfileStages(dockerfile []byte) ([]DockerfileStage, error) {
+	instructions, err := splitInstructions(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	var stages []DockerfileStage
+	names := map[string]int{}
+	// stageRef returns the index of the stage a FROM, --from or from= refers
+	// to, false if it is an image
+	stageRef := func(ref string, byIndex bool) (int, bool) {
+		if i, ok := names[strings.ToLower(ref)]; ok {
+			return i, true
+		}
+		if i, err := strconv.Atoi(ref); err == nil && byIndex && i >= 0 && i < len(stages)-1 {
+			return i, true
+		}
+		return 0, false
+	}
+	addDep := func(dep int) {
+		s := &stages[len(stages)-1]
+		for _, d := range s.Deps {
+			if d == dep {
+				return
+			}
+		}
+		s.Deps = append(s.Deps, dep)
+	}
+	for _, inst := range instructions {
+		cmd := strings.ToUpper(inst.cmd)
+		if cmd == "FROM" {
+			args := withoutFlags(inst.args)
+			if len(args) == 0 {
+				return nil, errors.Errorf("line %d: FROM requires an image", inst.line)
+			}
+			stage := DockerfileStage{}
+			if len(args) >= 3 && strings.EqualFold(args[1], "AS") {
+				stage.Name = strings.ToLower(args[2])
+			}
+			stages = append(stages, stage)
+			if i, ok := stageRef(args[0], false); ok {
+				addDep(i)
+			}
+			if stage.Name != "" {
+				names[stage.Name] = len(stages) - 1
+			}
+			continue
+		}
+		if len(stages) == 0 {
+			// ARG before the first FROM
+			continue
+		}
+		for _, a := range inst.args {
+			if !strings.HasPrefix(a, "--") {
+				break
+			}
+			switch {
+			case (cmd == "COPY" || cmd == "ADD") && strings.HasPrefix(a, "--from="):
+				if i, ok := stageRef(strings.TrimPrefix(a, "--from="), true); ok {
+					addDep(i)
+				}
+			case cmd == "RUN" && strings.HasPrefix(a, "--mount="):
+				fields, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(a, "--mount="))).Read()
+				if err != nil {
+					return nil, errors.Wrapf(err, "line %d: invalid mount %s", inst.line, a)
+				}
+				for _, f := range fields {
+					if strings.HasPrefix(f, "from=") {
+						if i, ok := stageRef(strings.TrimPrefix(f, "from="), true); ok {
+							addDep(i)
+						}
+					}
+				}
+			}
+		}
+	}
+	if len(stages) == 0 {
+		return nil, errors.Errorf("the Dockerfile has no FROM instruction")
+	}
+	return stages, nil
+}
+
+// DistributedStages returns the names of the stages target, the last stage
+// if empty, depends on that are not used by one another, in Dockerfile
+// order.  Unnamed stages can't be built on their own and stay in the build
+// of the target.  None are returned unless at least two can build at once.
+func DistributedStages(stages []DockerfileStage, target string) ([]string, error) {
+	t := len(stages) - 1
+	if target != "" {
+		t = -1
+		for i, s := range stages {
+			if s.Name == strings.ToLower(target) {
+				t = i
+			}
+		}
+		if t < 0 {
+			return nil, errors.Errorf("target stage %s could not be found", target)
+		}
+	}
+	// reachable returns the stages i is built from, directly or not
+	reachable := func(i int) map[int]bool {
+		seen := map[int]bool{}
+		next := append([]int{}, stages[i].Deps...)
+		for len(next) > 0 {
+			d := next[0]
+			next = next[1:]
+			if !seen[d] {
+				seen[d] = true
+				next = append(next, stages[d].Deps...)
+			}
+		}
+		return seen
+	}
+	deps := stages[t].Deps
+	var res []string
+	for i := 0; i < t; i++ {
+		if stages[i].Name == "" || !containsInt(deps, i) {
+			continue
+		}
+		used := false
+		for _, other := range deps {
+			if other != i && reachable(other)[i] {
+				used = true
+				break
+			}
+		}
+		if !used {
+			res = append(res, stages[i].Name)
+		}
+	}
+	if len(res) < 2 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func containsInt(l []int, v int) bool {
+	for _, i := range l {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// StageCacheRef is the reference a distributed stage exports its cache to
+// in the cache repository
+func StageCacheRef(cacheRepo, stage string) string {
+	return cacheRepo + ":" + stage
+}
+
+// DistributedStageOptions returns the options of the build of a stage of
+// opt, which only exports its cache to cacheRepo
+func DistributedStageOptions(opt Options, stage, cacheRepo string) Options {
+	o := opt
+	o.Target = stage
+	o.Tags = nil
+	// An unnamed image stays in the content store of the pod
+	o.Exports = []client.ExportEntry{{Type: "image", Attrs: map[string]string{}}}
+	o.CacheTo = []client.CacheOptionsEntry{{
+		Type:  "registry",
+		Attrs: map[string]string{"ref": StageCacheRef(cacheRepo, stage), "mode": "max"},
+	}}
+	o.ImageIDFile = ""
+	o.Referrers = nil
+	o.Extracts = nil
+	o.Squash = false
+	o.Capacity = nil
+	return o
+}
+
+// WithDistributedStages returns opt importing the caches of the stages
+// built with DistributedStageOptions
+func (o Options) WithDistributedStages(stages []string, cacheRepo string) Options {
+	o.CacheFrom = append([]client.CacheOptionsEntry{}, o.CacheFrom...)
+	for _, s := range stages {
+		o.CacheFrom = append(o.CacheFrom, client.CacheOptionsEntry{
+			Type:  "registry",
+			Attrs: map[string]string{"ref": StageCacheRef(cacheRepo, s)},
+		})
+	}
+	return o
+}
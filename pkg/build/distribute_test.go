@@ -0,0 +1,88 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const distributedDockerfile = `ARG GO=1.17
+FROM golang:${GO} AS base
+WORKDIR /src
+
+FROM base AS api
+RUN --mount=type=cache,target=/root/.cache go build ./cmd/api
+
+FROM base AS worker
+RUN go build ./cmd/worker
+
+FROM node:16 AS web
+RUN npm ci && \
+    npm run build
+
+FROM alpine
+COPY --from=api /src/api /usr/bin/
+COPY --from=worker /src/worker /usr/bin/
+COPY --from=3 /dist /var/www
+RUN --mount=type=bind,from=base,target=/src true
+`
+
+func Test_DockerfileStages(t *testing.T) {
+	t.Parallel()
+	stages, err := DockerfileStages([]byte(distributedDockerfile))
+	require.NoError(t, err)
+	require.Equal(t, []DockerfileStage{
+		{Name: "base"},
+		{Name: "api", Deps: []int{0}},
+		{Name: "worker", Deps: []int{0}},
+		{Name: "web"},
+		{Deps: []int{1, 2, 3, 0}},
+	}, stages)
+
+	_, err = DockerfileStages([]byte("ARG X\n"))
+	require.Error(t, err)
+}
+
+func Test_DistributedStages(t *testing.T) {
+	t.Parallel()
+	stages, err := DockerfileStages([]byte(distributedDockerfile))
+	require.NoError(t, err)
+
+	// base is built by the stages which use it
+	names, err := DistributedStages(stages, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"api", "worker", "web"}, names)
+
+	// A single dependency is built in the build of the target
+	names, err = DistributedStages(stages, "api")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	_, err = DistributedStages(stages, "missing")
+	require.Error(t, err)
+}
+
+func Test_DistributedStageOptions(t *testing.T) {
+	t.Parallel()
+	opt := Options{
+		Tags:        []string{"registry:5000/app"},
+		ImageIDFile: "iid",
+		BuildArgs:   map[string]string{"GO": "1.17"},
+	}
+	o := DistributedStageOptions(opt, "api", "registry:5000/cache/app")
+	require.Equal(t, "api", o.Target)
+	require.Empty(t, o.Tags)
+	require.Empty(t, o.ImageIDFile)
+	require.Equal(t, opt.BuildArgs, o.BuildArgs)
+	require.Len(t, o.Exports, 1)
+	require.Equal(t, "registry:5000/cache/app:api", o.CacheTo[0].Attrs["ref"])
+	require.Equal(t, "max", o.CacheTo[0].Attrs["mode"])
+
+	final := opt.WithDistributedStages([]string{"api", "web"}, "registry:5000/cache/app")
+	require.Len(t, final.CacheFrom, 2)
+	require.Equal(t, "registry:5000/cache/app:web", final.CacheFrom[1].Attrs["ref"])
+	require.Empty(t, opt.CacheFrom)
+	require.Equal(t, opt.Tags, final.Tags)
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/moby/buildkit/session/secrets"
+	"github.com/pkg/errors"
+)
+
+// BuildKit gives the RUN instructions the resolv.conf of the builder pod, and
+// has no per-build DNS setting.  The resolv.conf of a build with --dns is
+// served by the client as a secret instead, mounted over /etc/resolv.conf in
+// every RUN instruction of the Dockerfile.  Secrets don't change the cache
+// keys, steps cached by builds using other resolvers are reused.
+
+// dnsSecretID is the secret serving the resolv.conf of the build
+const dnsSecretID = "kubectl-build-resolv.conf"
+
+// DNSConfig is the resolver configuration of the RUN instructions
+type DNSConfig struct {
+	Nameservers   []string
+	SearchDomains []string
+	Options       []string
+}
+
+// ParseDNSConfig parses --dns, --dns-search and --dns-option values, nil
+// if none is set
+func ParseDNSConfig(nameservers, searchDomains, options []string) (*DNSConfig, error) {
+	if len(nameservers) == 0 && len(searchDomains) == 0 && len(options) == 0 {
+		return nil, nil
+	}
+	if len(nameservers) == 0 {
+		// The pod's nameservers may not resolve the search domains
+		return nil, errors.Errorf("--dns-search and --dns-option require --dns")
+	}
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return nil, errors.Errorf("invalid --dns %q, must be an IP address", ns)
+		}
+	}
+	for _, o := range options {
+		if o == "" || strings.ContainsAny(o, " \t\n") {
+			return nil, errors.Errorf("invalid --dns-option %q", o)
+		}
+	}
+	return &DNSConfig{
+		Nameservers:   nameservers,
+		SearchDomains: searchDomains,
+		Options:       options,
+	}, nil
+}
+
+// ResolvConf returns the resolv.conf of the configuration
+func (c *DNSConfig) ResolvConf() []byte {
+	var b bytes.Buffer
+	for _, ns := range c.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(c.SearchDomains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(c.SearchDomains, " "))
+	}
+	if len(c.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(c.Options, " "))
+	}
+	return b.Bytes()
+}
+
+// addDNSMount mounts the resolv.conf secret in the RUN instructions of dockerfile
+func addDNSMount(dockerfile []byte) []byte {
+	return addRunMounts(dockerfile, []string{
+		fmt.Sprintf("--mount=type=secret,id=%s,target=/etc/resolv.conf,mode=0444,required=true", dnsSecretID),
+	})
+}
+
+// dnsSecretStore serves the resolv.conf along the secrets of the build
+type dnsSecretStore struct {
+	secrets.SecretStore
+	resolvConf []byte
+}
+
+func (s *dnsSecretStore) GetSecret(ctx context.Context, id string) ([]byte, error) {
+	if id == dnsSecretID {
+		return s.resolvConf, nil
+	}
+	return s.SecretStore.GetSecret(ctx, id)
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"testing"
+
+	"github.com/moby/buildkit/session/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseDNSConfig(t *testing.T) {
+	t.Parallel()
+	c, err := ParseDNSConfig(nil, nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	c, err = ParseDNSConfig([]string{"10.0.0.10", "fd00::10"}, []string{"corp.acme.com", "acme.com"}, []string{"ndots:2"})
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.10\nnameserver fd00::10\nsearch corp.acme.com acme.com\noptions ndots:2\n", string(c.ResolvConf()))
+
+	_, err = ParseDNSConfig([]string{"dns.acme.com"}, nil, nil)
+	require.Error(t, err)
+	_, err = ParseDNSConfig(nil, []string{"acme.com"}, nil)
+	require.Error(t, err)
+	_, err = ParseDNSConfig([]string{"10.0.0.10"}, nil, []string{"ndots:2 rotate"})
+	require.Error(t, err)
+}
+
+func Test_addDNSMount(t *testing.T) {
+	t.Parallel()
+	dt := addDNSMount([]byte("FROM alpine\nRUN apk add curl\nCOPY . /src\n"))
+	require.Equal(t, "FROM alpine\nRUN --mount=type=secret,id="+dnsSecretID+",target=/etc/resolv.conf,mode=0444,required=true apk add curl\nCOPY . /src\n", string(dt))
+}
+
+type emptySecretStore struct{}
+
+func (emptySecretStore) GetSecret(ctx context.Context, id string) ([]byte, error) {
+	return nil, secrets.ErrNotFound
+}
+
+func Test_dnsSecretStore(t *testing.T) {
+	t.Parallel()
+	s := &dnsSecretStore{SecretStore: emptySecretStore{}, resolvConf: []byte("nameserver 10.0.0.10\n")}
+	dt, err := s.GetSecret(context.Background(), dnsSecretID)
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.10\n", string(dt))
+	_, err = s.GetSecret(context.Background(), "token")
+	require.Equal(t, secrets.ErrNotFound, err)
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// buildkitd detects the emulators registered in the kernel when it starts,
+// and lists the platforms they run among those of its workers.  An emulator
+// the builder installs is verified by looking for its architecture there, on
+// every pod, since each of them may run on a node it failed to install on.
+
+// VerifyEmulation fails unless every node runs the architectures of emulation
+// besides its native one, with "all" at least one other architecture
+func VerifyEmulation(ctx context.Context, nodes []driver.NodeClient, emulation []string) error {
+	if len(emulation) == 0 {
+		return nil
+	}
+	for _, n := range nodes {
+		if n.BuildKitClient == nil {
+			continue
+		}
+		ww, err := n.BuildKitClient.ListWorkers(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "listing workers of %s", n.NodeName)
+		}
+		var pp []specs.Platform
+		for _, w := range ww {
+			pp = append(pp, w.Platforms...)
+		}
+		if missing := missingEmulators(pp, emulation); len(missing) > 0 {
+			return errors.Errorf("builder pod %s doesn't emulate %s, check the logs of its binfmt init container", n.NodeName, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// compatArchs are the architectures run natively by those of 64 bit nodes
+var compatArchs = map[string]string{
+	"amd64": "386",
+	"arm64": "arm",
+}
+
+// missingEmulators returns the architectures of emulation which none of the
+// platforms is of
+func missingEmulators(pp []specs.Platform, emulation []string) []string {
+	archs := map[string]struct{}{}
+	for _, p := range pp {
+		archs[platforms.Normalize(p).Architecture] = struct{}{}
+	}
+	// The first platform is native, and runs its 32 bit variant natively too
+	native := map[string]struct{}{}
+	if len(pp) > 0 {
+		arch := platforms.Normalize(pp[0]).Architecture
+		native[arch] = struct{}{}
+		native[compatArchs[arch]] = struct{}{}
+	}
+	var missing []string
+	for _, e := range emulation {
+		if e == "all" {
+			emulated := false
+			for arch := range archs {
+				if _, ok := native[arch]; !ok {
+					emulated = true
+				}
+			}
+			if !emulated {
+				missing = append(missing, "any other architecture")
+			}
+			continue
+		}
+		arch := e
+		if p, err := platforms.Parse(e); err == nil && strings.Contains(e, "/") {
+			arch = p.Architecture
+		}
+		arch = platforms.Normalize(specs.Platform{OS: "linux", Architecture: arch}).Architecture
+		if _, ok := archs[arch]; !ok {
+			missing = append(missing, e)
+		}
+	}
+	return missing
+}
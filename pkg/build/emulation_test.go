@@ -0,0 +1,22 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_missingEmulators(t *testing.T) {
+	t.Parallel()
+	native := []specs.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "386"}}
+	emulated := append(native, specs.Platform{OS: "linux", Architecture: "arm64"}, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+
+	require.Empty(t, missingEmulators(emulated, []string{"all"}))
+	require.Empty(t, missingEmulators(emulated, []string{"arm64", "linux/arm/v7", "aarch64"}))
+	require.Equal(t, []string{"riscv64"}, missingEmulators(emulated, []string{"arm64", "riscv64"}))
+	require.Equal(t, []string{"arm64"}, missingEmulators(native, []string{"arm64"}))
+	require.Equal(t, []string{"any other architecture"}, missingEmulators(native, []string{"all"}))
+}
@@ -1,6 +1,8 @@
 package build
 
 import (
+	"strings"
+
 	"github.com/moby/buildkit/util/entitlements"
 	"github.com/pkg/errors"
 )
@@ -19,3 +21,26 @@ func ParseEntitlements(in []string) ([]entitlements.Entitlement, error) {
 	}
 	return out, nil
 }
+
+// checkEntitlements fails unless the builder allows the entitlements the
+// build requests, naming those it doesn't.  allowed is nil for a builder
+// whose allowlist isn't known, buildkitd then rejects the build itself.
+func checkEntitlements(allowed []string, requested []entitlements.Entitlement) error {
+	if allowed == nil {
+		return nil
+	}
+	var missing []string
+	for _, e := range requested {
+		ok := false
+		for _, a := range allowed {
+			ok = ok || a == string(e)
+		}
+		if !ok {
+			missing = append(missing, string(e))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return errors.Errorf("the builder doesn't allow the entitlement %s the build requests, create it with --allow-insecure-entitlement %s", strings.Join(missing, ", "), strings.Join(missing, " --allow-insecure-entitlement "))
+}
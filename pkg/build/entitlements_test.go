@@ -5,6 +5,7 @@ package build
 import (
 	"testing"
 
+	"github.com/moby/buildkit/util/entitlements"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,3 +23,18 @@ func Test_ParseEntitlements(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, resp, 2)
 }
+
+func Test_checkEntitlements(t *testing.T) {
+	t.Parallel()
+	host := []entitlements.Entitlement{entitlements.EntitlementNetworkHost}
+	both := []entitlements.Entitlement{entitlements.EntitlementNetworkHost, entitlements.EntitlementSecurityInsecure}
+	assert.NoError(t, checkEntitlements(nil, both), "unknown allowlist")
+	assert.NoError(t, checkEntitlements([]string{}, nil))
+	assert.NoError(t, checkEntitlements([]string{"network.host"}, host))
+
+	err := checkEntitlements([]string{}, host)
+	assert.EqualError(t, err, "the builder doesn't allow the entitlement network.host the build requests, create it with --allow-insecure-entitlement network.host")
+	err = checkEntitlements([]string{"network.host"}, both)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't allow the entitlement security.insecure the build")
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/pkg/errors"
+)
+
+// extractChunkSize is read per request, well below the gRPC message limit
+const extractChunkSize = 1 << 20
+
+// Symlink policies of Extract, creating symlinks on Windows needs a
+// privilege or developer mode and their targets are Linux paths
+const (
+	// ExtractSymlinksCreate creates the symlinks as they are
+	ExtractSymlinksCreate = "create"
+	// ExtractSymlinksFollow copies the files the symlinks point to
+	ExtractSymlinksFollow = "follow"
+	// ExtractSymlinksSkip leaves the symlinks out
+	ExtractSymlinksSkip = "skip"
+)
+
+// maxSymlinks is how many symlinks a path can go through when followed
+const maxSymlinks = 40
+
+// Extract copies a path of a build stage to a local destination
+type Extract struct {
+	Stage string
+	Src   string
+	Dest  string
+	// Symlinks is how symlinks are extracted, ExtractSymlinksCreate if unset
+	Symlinks string
+}
+
+// CheckExtractSymlinks validates a symlink policy of Extract
+func CheckExtractSymlinks(policy string) error {
+	switch policy {
+	case "", ExtractSymlinksCreate, ExtractSymlinksFollow, ExtractSymlinksSkip:
+		return nil
+	}
+	return errors.Errorf("invalid symlink policy %q, use %s, %s or %s", policy, ExtractSymlinksCreate, ExtractSymlinksFollow, ExtractSymlinksSkip)
+}
+
+// ParseExtract parses "stage:/path=dest"
+func ParseExtract(in []string) ([]Extract, error) {
+	var res []Extract
+	for _, s := range in {
+		parts := strings.SplitN(s, "=", 2)
+		src := strings.SplitN(parts[0], ":", 2)
+		if len(parts) != 2 || len(src) != 2 || src[0] == "" || !path.IsAbs(src[1]) || parts[1] == "" {
+			return nil, errors.Errorf("invalid extract %q, expected stage:/path=destination", s)
+		}
+		res = append(res, Extract{Stage: src[0], Src: path.Clean(src[1]), Dest: parts[1]})
+	}
+	return res, nil
+}
+
+// solveWithGateway solves the frontend as Solve would, and within the same
+// solve copies the extract paths from the snapshots of their stages and
+// squashes the result if requested
+func solveWithGateway(ctx context.Context, c *client.Client, so client.SolveOpt, extracts []Extract, squash bool, statusCh chan *client.SolveStatus) (*client.SolveResponse, error) {
+	frontend := so.Frontend
+	attrs := so.FrontendAttrs
+	inputs := map[string]*pb.Definition{}
+	for k, st := range so.FrontendInputs {
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			// Build closes it otherwise
+			if statusCh != nil {
+				close(statusCh)
+			}
+			return nil, err
+		}
+		inputs[k] = def.ToPB()
+	}
+	var cacheImports []gateway.CacheOptionsEntry
+	for _, e := range so.CacheImports {
+		cacheImports = append(cacheImports, gateway.CacheOptionsEntry{Type: e.Type, Attrs: e.Attrs})
+	}
+	so.Frontend = ""
+	so.FrontendInputs = nil
+
+	return c.Build(ctx, so, "", func(ctx context.Context, gc gateway.Client) (*gateway.Result, error) {
+		res, err := gc.Solve(ctx, gateway.SolveRequest{
+			Frontend:       frontend,
+			FrontendOpt:    attrs,
+			FrontendInputs: inputs,
+			CacheImports:   cacheImports,
+		})
+		if err != nil {
+			return nil, err
+		}
+		stages := map[string]gateway.Reference{}
+		for _, e := range extracts {
+			ref, ok := stages[e.Stage]
+			if !ok {
+				stageAttrs := make(map[string]string, len(attrs)+1)
+				for k, v := range attrs {
+					stageAttrs[k] = v
+				}
+				stageAttrs["target"] = e.Stage
+				r, err := gc.Solve(ctx, gateway.SolveRequest{
+					Frontend:       frontend,
+					FrontendOpt:    stageAttrs,
+					FrontendInputs: inputs,
+					CacheImports:   cacheImports,
+				})
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to build stage %s for extraction", e.Stage)
+				}
+				if ref, err = r.SingleRef(); err != nil {
+					return nil, errors.Wrap(err, "extract requires a single platform build")
+				}
+				stages[e.Stage] = ref
+			}
+			if err := extractPath(ctx, ref, e.Src, longPath(e.Dest), e.Symlinks, 0); err != nil {
+				return nil, errors.Wrapf(err, "failed to extract %s:%s", e.Stage, e.Src)
+			}
+		}
+		if squash {
+			return squashResult(ctx, gc, res)
+		}
+		return res, nil
+	}, statusCh)
+}
+
+// extractPath copies src of ref to dest.  Directories are copied recursively,
+// a file is copied into dest if it's an existing directory.  links is the
+// number of symlinks followed to src.
+func extractPath(ctx context.Context, ref gateway.Reference, src, dest, symlinks string, links int) error {
+	st, err := ref.StatFile(ctx, gateway.StatRequest{Path: src})
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(st.Mode)
+	switch {
+	case mode.IsDir():
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		entries, err := ref.ReadDir(ctx, gateway.ReadDirRequest{Path: src})
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := path.Base(e.Path)
+			if name == "." || name == ".." || name == "/" {
+				continue
+			}
+			if err := extractPath(ctx, ref, path.Join(src, name), filepath.Join(dest, name), symlinks, links); err != nil {
+				return err
+			}
+		}
+		return nil
+	case mode&os.ModeSymlink != 0:
+		switch symlinks {
+		case ExtractSymlinksSkip:
+			return nil
+		case ExtractSymlinksFollow:
+			if links >= maxSymlinks {
+				return errors.Errorf("too many levels of symbolic links at %s", src)
+			}
+			target := st.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(src), target)
+			}
+			return extractPath(ctx, ref, target, dest, symlinks, links+1)
+		}
+		_ = os.Remove(dest)
+		if err := os.Symlink(st.Linkname, dest); err != nil {
+			return errors.Wrap(err, "failed to create symlink, extract with --extract-symlinks=follow or skip instead")
+		}
+		return nil
+	case mode.IsRegular():
+		if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+			dest = filepath.Join(dest, path.Base(src))
+		}
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		for offset := 0; ; {
+			dt, err := ref.ReadFile(ctx, gateway.ReadRequest{
+				Filename: src,
+				Range:    &gateway.FileRange{Offset: offset, Length: extractChunkSize},
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(dt); err != nil {
+				return err
+			}
+			if len(dt) < extractChunkSize {
+				return f.Close()
+			}
+			offset += len(dt)
+		}
+	default:
+		// Devices, sockets and pipes aren't build artifacts
+		return nil
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseExtract(t *testing.T) {
+	t.Parallel()
+	res, err := ParseExtract([]string{"test:/reports=./reports", "build:/dist/=out=1"})
+	require.NoError(t, err)
+	require.Equal(t, []Extract{
+		{Stage: "test", Src: "/reports", Dest: "./reports"},
+		{Stage: "build", Src: "/dist", Dest: "out=1"},
+	}, res)
+
+	for _, s := range []string{"test:/reports", "/reports=./reports", "test:reports=./reports", "test:/reports="} {
+		_, err = ParseExtract([]string{s})
+		require.Error(t, err, s)
+	}
+}
+
+func Test_CheckExtractSymlinks(t *testing.T) {
+	t.Parallel()
+	for _, p := range []string{"", ExtractSymlinksCreate, ExtractSymlinksFollow, ExtractSymlinksSkip} {
+		require.NoError(t, CheckExtractSymlinks(p), p)
+	}
+	require.Error(t, CheckExtractSymlinks("copy"))
+}
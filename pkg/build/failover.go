@@ -0,0 +1,67 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"strings"
+
+	"github.com/moby/buildkit/util/grpcerrors"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+)
+
+// A builder pod evicted or killed for running out of memory takes the
+// connection of the build down with it, the build itself didn't fail.  The
+// build fails with a NodeLostError naming the pod, the CLI runs it again on
+// another pod of the builder, excluding the lost one.
+
+// connectionLostErrors are the messages of the gRPC connection to buildkitd
+// going away
+var connectionLostErrors = []string{
+	"transport is closing",
+	"error reading from server",
+	"connection closed before server preface received",
+}
+
+// NodeLostError is the failure of a build losing its connection to the
+// builder pod Node
+type NodeLostError struct {
+	Node string
+	Err  error
+}
+
+func (e *NodeLostError) Error() string {
+	return errors.Wrapf(e.Err, "lost the connection to builder pod %s", e.Node).Error()
+}
+
+func (e *NodeLostError) Unwrap() error {
+	return e.Err
+}
+
+// IsConnectionLost reports whether err is the connection to buildkitd going
+// away, rather than the build failing
+func IsConnectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	if grpcerrors.Code(err) == codes.Unavailable {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range connectionLostErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// LostNode returns the builder pod the build failing with err lost its
+// connection to, false if it didn't
+func LostNode(err error) (string, bool) {
+	var lost *NodeLostError
+	if errors.As(err, &lost) {
+		return lost.Node, true
+	}
+	return "", false
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_IsConnectionLost(t *testing.T) {
+	t.Parallel()
+	require.False(t, IsConnectionLost(nil))
+	require.True(t, IsConnectionLost(status.Error(codes.Unavailable, "connection error")))
+	require.True(t, IsConnectionLost(errors.New("rpc error: code = Unavailable desc = transport is closing")))
+	require.True(t, IsConnectionLost(errors.Wrap(errors.New("error reading from server: EOF"), "failed to solve")))
+	require.False(t, IsConnectionLost(status.Error(codes.Canceled, "context canceled")))
+	require.False(t, IsConnectionLost(errors.New(`executor failed running [/bin/sh -c make]: exit code: 2`)))
+}
+
+func Test_LostNode(t *testing.T) {
+	t.Parallel()
+	err := &NodeLostError{Node: "buildkit-abc", Err: errors.New("transport is closing")}
+	node, ok := LostNode(errors.Wrap(err, "build failed"))
+	require.True(t, ok)
+	require.Equal(t, "buildkit-abc", node)
+	require.EqualError(t, err, "lost the connection to builder pod buildkit-abc: transport is closing")
+
+	_, ok = LostNode(errors.New("executor failed running"))
+	require.False(t, ok)
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// A multi-platform build on a single builder pod emulates the platforms
+// foreign to its node, which is many times slower than building natively.
+// When the builder has pods on nodes of several of the platforms built, the
+// builder is split into one driver per architecture: each boots on a pod of a
+// node of its architecture and builds its platforms by digest, then the
+// images are assembled into a single index pushed to the tags.  The platforms
+// no node runs are built with emulation by the first driver.
+
+// FanOutDrivers splits the builder di into a driver per architecture of the
+// platforms built with builder pods running on nodes of that architecture.
+// di is returned alone unless at least two architectures have such nodes.
+func FanOutDrivers(ctx context.Context, di DriverInfo, opt map[string]Options) ([]DriverInfo, error) {
+	var requested []specs.Platform
+	seen := map[string]struct{}{}
+	for _, o := range opt {
+		for _, p := range o.Platforms {
+			k := platforms.Format(p)
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				requested = append(requested, p)
+			}
+		}
+	}
+	if len(requested) < 2 {
+		return []DriverInfo{di}, nil
+	}
+	info, err := di.Driver.Info(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the builder nodes")
+	}
+	native := map[string]struct{}{}
+	for _, n := range info.DynamicNodes {
+		for _, p := range n.Platforms {
+			native[p.OS+"/"+p.Architecture] = struct{}{}
+		}
+	}
+	return fanOutPlatforms(di, requested, native), nil
+}
+
+// fanOutPlatforms groups the platforms by the architectures in native,
+// keyed by os/arch, and returns a driver for each group
+func fanOutPlatforms(di DriverInfo, requested []specs.Platform, native map[string]struct{}) []DriverInfo {
+	var res []DriverInfo
+	var emulated []specs.Platform
+	byArch := map[string]int{}
+	for _, p := range requested {
+		arch := p.OS + "/" + p.Architecture
+		if _, ok := native[arch]; !ok {
+			emulated = append(emulated, p)
+			continue
+		}
+		i, ok := byArch[arch]
+		if !ok {
+			i = len(res)
+			byArch[arch] = i
+			res = append(res, DriverInfo{
+				Driver: di.Driver,
+				Name:   di.Name + "/" + arch,
+			})
+		}
+		res[i].Platform = append(res[i].Platform, p)
+	}
+	if len(res) < 2 {
+		return []DriverInfo{di}
+	}
+	res[0].Platform = append(res[0].Platform, emulated...)
+	return res
+}
+
+// sameDriver reports if the drivers before drivers[i] include its driver,
+// the builder split by FanOutDrivers is only queued for once
+func sameDriver(drivers []DriverInfo, i int) bool {
+	for _, di := range drivers[:i] {
+		if di.Driver == drivers[i].Driver {
+			return true
+		}
+	}
+	return false
+}
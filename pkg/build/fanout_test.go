@@ -0,0 +1,42 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fanOutPlatforms(t *testing.T) {
+	t.Parallel()
+	amd64 := specs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := specs.Platform{OS: "linux", Architecture: "arm64"}
+	arm64v8 := specs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	s390x := specs.Platform{OS: "linux", Architecture: "s390x"}
+	di := DriverInfo{Name: "buildkit"}
+
+	res := fanOutPlatforms(di, []specs.Platform{amd64, arm64, arm64v8, s390x}, map[string]struct{}{
+		"linux/amd64": {},
+		"linux/arm64": {},
+	})
+	require.Len(t, res, 2)
+	require.Equal(t, "buildkit/linux/amd64", res[0].Name)
+	require.Equal(t, []specs.Platform{amd64, s390x}, res[0].Platform, "emulated by the first driver")
+	require.Equal(t, "buildkit/linux/arm64", res[1].Name)
+	require.Equal(t, []specs.Platform{arm64, arm64v8}, res[1].Platform)
+
+	// A single native architecture doesn't need splitting
+	res = fanOutPlatforms(di, []specs.Platform{amd64, s390x}, map[string]struct{}{"linux/amd64": {}})
+	require.Equal(t, []DriverInfo{di}, res)
+}
+
+func Test_sameDriver(t *testing.T) {
+	t.Parallel()
+	d := &capacityDriver{}
+	drivers := []DriverInfo{{Name: "a", Driver: d}, {Name: "b", Driver: d}, {Name: "c", Driver: &capacityDriver{}}}
+	require.False(t, sameDriver(drivers, 0))
+	require.True(t, sameDriver(drivers, 1))
+	require.False(t, sameDriver(drivers, 2))
+}
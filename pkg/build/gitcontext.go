@@ -0,0 +1,81 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A local build context inside a git checkout can be sent as the files git
+// tracks at a revision instead of the working tree.  The files are checked out
+// to a temporary directory with git plumbing: the revision is read into a
+// private index, or with the staged changes the index of the checkout is used
+// as is, so untracked files, build outputs and unstaged edits never reach the
+// builder and the context is the same on every machine.
+
+// ExportGitContext checks out the files of the git checkout of dir tracked at
+// rev, or tracked in the index with staged, to a temporary directory.  It
+// returns the directory matching dir within it, and a func removing it.
+func ExportGitContext(ctx context.Context, dir, rev string, staged bool) (string, func(), error) {
+	if staged && rev != "HEAD" {
+		return "", nil, errors.Errorf("staged changes can only be added to HEAD, not %s", rev)
+	}
+	prefix, err := gitOutput(ctx, dir, nil, nil, "rev-parse", "--show-prefix")
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "%s is not in a git checkout", dir)
+	}
+	tmp, err := ioutil.TempDir("", "git-context")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	var env []string
+	if !staged {
+		env = []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}
+		if _, err := gitOutput(ctx, dir, env, nil, "read-tree", rev+"^{tree}"); err != nil {
+			cleanup()
+			return "", nil, errors.Wrapf(err, "failed to read revision %s", rev)
+		}
+	}
+	// Both list and check out the paths relative to dir, only the files
+	// under it are exported
+	files, err := gitOutput(ctx, dir, env, nil, "ls-files", "-z", "--cached")
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	root := filepath.Join(tmp, "tree") + string(filepath.Separator)
+	if _, err := gitOutput(ctx, dir, env, strings.NewReader(files), "checkout-index", "-z", "--stdin", "--prefix="+root); err != nil {
+		cleanup()
+		return "", nil, errors.Wrap(err, "failed to check out the build context")
+	}
+	contextDir := filepath.Join(root, filepath.FromSlash(prefix))
+	if err := os.MkdirAll(contextDir, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return contextDir, cleanup, nil
+}
+
+func gitOutput(ctx context.Context, dir string, env []string, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
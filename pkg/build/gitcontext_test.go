@@ -0,0 +1,85 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func gitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-repo")
+	require.NoError(t, err)
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	writeContextFiles(t, dir, map[string]int{"Dockerfile": 1, "app/main.go": 2})
+	run("init", "-q")
+	run("add", ".")
+	run("commit", "-q", "-m", "initial")
+	// Working tree changes, staged and not
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app", "staged.go"), []byte("s"), 0644))
+	run("add", "app/staged.go")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app", "main.go"), []byte("unstaged"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "untracked"), []byte("u"), 0644))
+	return dir
+}
+
+func contextFiles(t *testing.T, dir string) map[string]string {
+	res := map[string]string{}
+	require.NoError(t, filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if fi.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			dt, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			res[filepath.ToSlash(rel)] = string(dt)
+		}
+		return nil
+	}))
+	return res
+}
+
+func Test_ExportGitContext(t *testing.T) {
+	t.Parallel()
+	repo := gitRepo(t)
+	defer os.RemoveAll(repo)
+	ctx := context.Background()
+
+	dir, cleanup, err := ExportGitContext(ctx, repo, "HEAD", false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"Dockerfile": "\x00", "app/main.go": "\x00\x00"}, contextFiles(t, dir))
+	cleanup()
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+
+	dir, cleanup, err = ExportGitContext(ctx, repo, "HEAD", true)
+	require.NoError(t, err)
+	defer cleanup()
+	require.Equal(t, map[string]string{"Dockerfile": "\x00", "app/main.go": "\x00\x00", "app/staged.go": "s"}, contextFiles(t, dir))
+
+	// A subdirectory of the checkout only exports its files
+	dir, cleanup, err = ExportGitContext(ctx, filepath.Join(repo, "app"), "HEAD", false)
+	require.NoError(t, err)
+	defer cleanup()
+	require.Equal(t, "app", filepath.Base(dir))
+	require.Equal(t, map[string]string{"main.go": "\x00\x00"}, contextFiles(t, dir))
+
+	_, _, err = ExportGitContext(ctx, repo, "HEAD~1", true)
+	require.Error(t, err)
+	_, _, err = ExportGitContext(ctx, repo, "no-such-revision", false)
+	require.Error(t, err)
+}
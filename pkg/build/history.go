@@ -0,0 +1,249 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/identity"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// buildkitd only gained a build history API in v0.11, so each build records
+// itself on the builder pod which ran it: when the solve returns, succeeded
+// or failed, the CLI writes a record of the build under HistoryDir in the
+// pod.  The history of the builder is the records of all its pods, kept
+// until the pod is restarted or the records exceed the retention of the
+// builder, enforced on the pod whenever a build records itself.
+
+// HistoryDir keeps the build records of a builder pod
+const HistoryDir = "/tmp/buildkit-history"
+
+// HistoryRecord is the record of a build
+type HistoryRecord struct {
+	// Ref identifies the record, BuildID the build, which has a record per
+	// target and builder pod it solved on
+	Ref     string `json:"ref"`
+	BuildID string `json:"buildID"`
+	Target  string `json:"target,omitempty"`
+	Pod     string `json:"pod"`
+	// Platforms are the platforms built on the pod
+	Platforms []string      `json:"platforms,omitempty"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	// Error is why the build failed, empty if it succeeded
+	Error string `json:"error,omitempty"`
+	// Steps are the build steps run, of which CachedSteps were cache hits
+	Steps       int `json:"steps"`
+	CachedSteps int `json:"cachedSteps"`
+	// Exporters are the types of the outputs of the build
+	Exporters []string `json:"exporters,omitempty"`
+	Image     string   `json:"image,omitempty"`
+	Digest    string   `json:"digest,omitempty"`
+}
+
+// Status is how the build ended
+func (r *HistoryRecord) Status() string {
+	if r.Error != "" {
+		return DetachedStateFailed
+	}
+	return DetachedStateDone
+}
+
+// newHistoryRecord records the solve of target on pod, which returned rr or
+// failed with solveErr, with the steps of graph if any
+func newHistoryRecord(buildID, target, pod string, pp []specs.Platform, so client.SolveOpt, start time.Time, rr *client.SolveResponse, solveErr error, graph *progress.Graph) *HistoryRecord {
+	r := &HistoryRecord{
+		Ref:      identity.NewID(),
+		BuildID:  buildID,
+		Target:   target,
+		Pod:      pod,
+		Start:    start,
+		Duration: time.Since(start),
+	}
+	for _, p := range pp {
+		r.Platforms = append(r.Platforms, platforms.Format(p))
+	}
+	if solveErr != nil {
+		r.Error = solveErr.Error()
+	}
+	if graph != nil {
+		var report BuildReport
+		report.AddSteps(graph.Vertexes())
+		r.Steps, r.CachedSteps = report.Steps, report.CachedSteps
+	}
+	for _, e := range so.Exports {
+		r.Exporters = append(r.Exporters, e.Type)
+		if r.Image == "" && e.Attrs["name"] != "" {
+			r.Image = strings.Split(e.Attrs["name"], ",")[0]
+		}
+	}
+	if rr != nil {
+		r.Digest = rr.ExporterResponse["containerimage.digest"]
+	}
+	return r
+}
+
+// recordSolveStatus forwards the status of a solve to statusCh, recording
+// it in graph, the returned channel is closed once the solve closed its
+// status channel and all of it was recorded
+func recordSolveStatus(statusCh chan *client.SolveStatus, graph *progress.Graph) (chan *client.SolveStatus, <-chan struct{}) {
+	in := make(chan *client.SolveStatus)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for st := range in {
+			graph.Record(st)
+			statusCh <- st
+		}
+		close(statusCh)
+	}()
+	return in, done
+}
+
+// writeHistoryRecord writes r on its pod, removing the records beyond the
+// retention of the builder
+func writeHistoryRecord(ctx context.Context, d driver.Driver, r *HistoryRecord) error {
+	dt, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	script := "mkdir -p " + HistoryDir + " && cat > " + HistoryDir + "/" + r.Ref + ".json"
+	if info, err := d.Info(ctx); err == nil {
+		if prune := historyPruneScript(HistoryDir, info.HistoryMaxRecords, info.HistoryMaxAge); prune != "" {
+			script += " && " + prune
+		}
+	}
+	if err := d.Exec(ctx, r.Pod, []string{"sh", "-c", script}, bytes.NewReader(append(dt, '\n')), ioutil.Discard, os.Stderr); err != nil {
+		return errors.Wrapf(err, "failed to record build %s on pod %s", r.BuildID, r.Pod)
+	}
+	return nil
+}
+
+// BuildHistory returns the build records of the builder pods, most recent
+// first.  Pods which can't be read are left out with a warning.
+func BuildHistory(ctx context.Context, d driver.Driver) ([]HistoryRecord, error) {
+	info, err := d.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []HistoryRecord
+	for _, node := range info.DynamicNodes {
+		buf := &bytes.Buffer{}
+		script := "cat " + HistoryDir + "/*.json 2>/dev/null || true"
+		if err := d.Exec(ctx, node.Name, []string{"sh", "-c", script}, nil, buf, ioutil.Discard); err != nil {
+			logrus.Warnf("failed to read the build history of %s: %s", node.Name, err)
+			continue
+		}
+		records, err := parseHistoryRecords(buf)
+		if err != nil {
+			logrus.Warnf("invalid build history on %s: %s", node.Name, err)
+		}
+		res = append(res, records...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start.After(res[j].Start)
+	})
+	return res, nil
+}
+
+// parseHistoryRecords reads the stream of records of a pod, a record cut off
+// by a restart ends it
+func parseHistoryRecords(r io.Reader) ([]HistoryRecord, error) {
+	var res []HistoryRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec HistoryRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return res, nil
+			}
+			return res, err
+		}
+		res = append(res, rec)
+	}
+}
+
+// InspectBuild returns the records of the build ref, a record or a build
+// ID, the latter having a record per target and pod
+func InspectBuild(ctx context.Context, d driver.Driver, ref string) ([]HistoryRecord, error) {
+	if err := validateDetachedID(ref); err != nil {
+		return nil, err
+	}
+	records, err := BuildHistory(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	var res []HistoryRecord
+	for _, r := range records {
+		if r.Ref == ref || r.BuildID == ref {
+			res = append(res, r)
+		}
+	}
+	if len(res) == 0 {
+		return nil, errors.Errorf("build %q not found in the history, the builder pod may have been restarted", ref)
+	}
+	return res, nil
+}
+
+// PruneBuildHistory removes the build records of every builder pod beyond
+// maxRecords per pod and maxAge (0 for no limit), it returns the refs removed
+func PruneBuildHistory(ctx context.Context, d driver.Driver, maxRecords int, maxAge time.Duration) ([]string, error) {
+	script := historyPruneScript(HistoryDir, maxRecords, maxAge)
+	if script == "" {
+		return nil, nil
+	}
+	info, err := d.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, node := range info.DynamicNodes {
+		buf := &bytes.Buffer{}
+		if err := d.Exec(ctx, node.Name, []string{"sh", "-c", script}, nil, buf, os.Stderr); err != nil {
+			return removed, errors.Wrapf(err, "failed to remove old build records on %s", node.Name)
+		}
+		removed = append(removed, strings.Fields(buf.String())...)
+	}
+	return removed, nil
+}
+
+// historyPruneScript generates the script removing the records under dir
+// beyond the retention limits, newest first, printing their refs
+func historyPruneScript(dir string, maxRecords int, maxAge time.Duration) string {
+	var expired []string
+	if maxRecords > 0 {
+		expired = append(expired, fmt.Sprintf("[ $n -gt %d ]", maxRecords))
+	}
+	if maxAge > 0 {
+		expired = append(expired, fmt.Sprintf("[ $(( now - $(stat -c %%Y \"$f\") )) -gt %d ]", int64(maxAge/time.Second)))
+	}
+	if len(expired) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`(cd %s 2>/dev/null || exit 0
+now=$(date +%%s)
+n=0
+for f in $(ls -t); do
+  case "$f" in *.json) ;; *) continue ;; esac
+  n=$(( n + 1 ))
+  if %s; then
+    rm -f "$f" && echo "${f%%.json}"
+  fi
+done)`, dir, strings.Join(expired, " || "))
+}
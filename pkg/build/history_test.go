@@ -0,0 +1,105 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+func Test_newHistoryRecord(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	graph := progress.NewGraph()
+	statusCh := make(chan *client.SolveStatus)
+	solveCh, recorded := recordSolveStatus(statusCh, graph)
+	go func() {
+		for range statusCh {
+		}
+	}()
+	solveCh <- &client.SolveStatus{Vertexes: []*client.Vertex{
+		{Digest: digest.FromString("a"), Name: "[1/2] FROM alpine", Started: &now, Completed: &now, Cached: true},
+		{Digest: digest.FromString("b"), Name: "[2/2] RUN make", Started: &now, Completed: &now},
+		{Digest: digest.FromString("c"), Name: "[internal] load build context", Started: &now, Completed: &now},
+	}}
+	close(solveCh)
+	<-recorded
+
+	so := client.SolveOpt{Exports: []client.ExportEntry{{Type: "image", Attrs: map[string]string{"name": "acme.com/a:1,acme.com/a:latest", "push": "true"}}}}
+	rr := &client.SolveResponse{ExporterResponse: map[string]string{"containerimage.digest": "sha256:abc"}}
+	r := newHistoryRecord("build1", "default", "buildkit-0", []specs.Platform{{OS: "linux", Architecture: "arm64"}}, so, now.Add(-time.Minute), rr, nil, graph)
+	assert.NotEmpty(t, r.Ref)
+	assert.Equal(t, "build1", r.BuildID)
+	assert.Equal(t, "buildkit-0", r.Pod)
+	assert.Equal(t, []string{"linux/arm64"}, r.Platforms)
+	assert.Equal(t, 2, r.Steps)
+	assert.Equal(t, 1, r.CachedSteps)
+	assert.Equal(t, []string{"image"}, r.Exporters)
+	assert.Equal(t, "acme.com/a:1", r.Image)
+	assert.Equal(t, "sha256:abc", r.Digest)
+	assert.Equal(t, DetachedStateDone, r.Status())
+	assert.True(t, r.Duration >= time.Minute)
+
+	r = newHistoryRecord("build1", "default", "buildkit-0", nil, so, now, nil, errors.New("failed to solve"), nil)
+	assert.Equal(t, DetachedStateFailed, r.Status())
+	assert.Empty(t, r.Digest)
+}
+
+func Test_parseHistoryRecords(t *testing.T) {
+	t.Parallel()
+	records, err := parseHistoryRecords(strings.NewReader(`{"ref":"a","buildID":"b1","pod":"p"}
+{"ref":"b","buildID":"b2","pod":"p","error":"failed"}
+`))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "b", records[1].Ref)
+	assert.Equal(t, DetachedStateFailed, records[1].Status())
+
+	// A record cut off by a restart of the pod
+	records, err = parseHistoryRecords(strings.NewReader(`{"ref":"a","buildID":"b1"}
+{"ref":"b","bui`))
+	assert.Error(t, err)
+	assert.Len(t, records, 1)
+}
+
+func Test_historyPruneScript(t *testing.T) {
+	t.Parallel()
+	assert.Empty(t, historyPruneScript(HistoryDir, 0, 0))
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "history")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for ref, age := range map[string]time.Duration{"new": time.Minute, "recent": time.Hour, "old": 48 * time.Hour} {
+		p := filepath.Join(dir, ref+".json")
+		require.NoError(t, ioutil.WriteFile(p, []byte("{}\n"), 0600))
+		require.NoError(t, os.Chtimes(p, now.Add(-age), now.Add(-age)))
+	}
+	prune := func(maxRecords int, maxAge time.Duration) []string {
+		out, err := exec.Command("sh", "-c", historyPruneScript(dir, maxRecords, maxAge)).Output()
+		require.NoError(t, err)
+		removed := strings.Fields(string(out))
+		sort.Strings(removed)
+		return removed
+	}
+	assert.Equal(t, []string{"old"}, prune(0, 24*time.Hour))
+	assert.Equal(t, []string{"recent"}, prune(1, 0))
+	assert.Empty(t, prune(1, 24*time.Hour))
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// BuildKit only mounts build results into RUN instructions, not directories
+// of the node.  Builders created with allowed host paths mount them in their
+// pods instead, and a build mounting one first syncs it into a cache mount of
+// the builder pod, which is added read-only to every RUN instruction of the
+// Dockerfile.  The sync is skipped as long as the files of the host path keep
+// their size and modification time.  Otherwise only the changed files are
+// sent, the local source of the host path shares its snapshot across builds,
+// and only the changed files are copied into the cache mount.
+
+// HostMount mounts a host path of the builder's nodes in the RUN instructions
+type HostMount struct {
+	Source string
+	Target string
+}
+
+// ParseHostMounts parses --mount-host values, src:dst[:ro].  Host paths are
+// always mounted read-only, writes to a copy would be silently lost.
+func ParseHostMounts(in []string) ([]HostMount, error) {
+	out := make([]HostMount, 0, len(in))
+	for _, v := range in {
+		parts := strings.Split(v, ":")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro") {
+			return nil, errors.Errorf("invalid host mount %q, use src:dst[:ro], host paths are mounted read-only", v)
+		}
+		m := HostMount{Source: parts[0], Target: parts[1]}
+		if !path.IsAbs(m.Source) || !path.IsAbs(m.Target) {
+			return nil, errors.Errorf("invalid host mount %q, both paths must be absolute", v)
+		}
+		if !hostMountPath.MatchString(m.Source) || !hostMountPath.MatchString(m.Target) {
+			return nil, errors.Errorf("invalid host mount %q, paths may only contain letters, digits and . _ - + @ /", v)
+		}
+		m.Source, m.Target = path.Clean(m.Source), path.Clean(m.Target)
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// hostMountPath matches the paths a host mount may have, which end up in the
+// mount flags of the Dockerfile and the sync script run on the builder pod
+var hostMountPath = regexp.MustCompile(`^[A-Za-z0-9._@+/-]+$`)
+
+// hostPathAllowed reports whether src is one of the allowed paths, or below one
+func hostPathAllowed(src string, allowed []string) bool {
+	for _, p := range allowed {
+		if src == p || strings.HasPrefix(src, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type hostMount struct {
+	HostMount
+	// id of the cache mount, as named by the dockerfile frontend
+	id string
+	// dir is the host path in the builder pod
+	dir string
+}
+
+// hostMounts are the host paths mounted by a build
+type hostMounts struct {
+	mounts []hostMount
+	image  string
+}
+
+// newHostMounts checks the host mounts of the build against the paths the
+// builder allows, and adds them to the RUN instructions of the Dockerfile.
+// The returned func removes the rewritten Dockerfile.
+func newHostMounts(info *driver.Info, opt Options, so *client.SolveOpt) (*hostMounts, func(), error) {
+	if len(opt.HostMounts) == 0 {
+		return nil, func() {}, nil
+	}
+	dir, ok := so.LocalDirs["dockerfile"]
+	if !ok {
+		return nil, nil, errors.Errorf("--mount-host requires a local Dockerfile")
+	}
+	filename := so.FrontendAttrs["filename"]
+	if filename == "" {
+		filename = "Dockerfile"
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read Dockerfile for host mounts")
+	}
+
+	hm := &hostMounts{image: info.RunCacheImage}
+	flags := make([]string, 0, len(opt.HostMounts))
+	for _, m := range opt.HostMounts {
+		if !hostPathAllowed(m.Source, info.HostPaths) {
+			return nil, nil, errors.Errorf("host path %s is not allowed by the builder, create it with --allow-host-path", m.Source)
+		}
+		id := "host-path:" + m.Source
+		hm.mounts = append(hm.mounts, hostMount{
+			HostMount: m,
+			id:        so.FrontendAttrs["build-arg:"+cacheMountNSArg] + "/" + id,
+			dir:       path.Join(info.HostPathDir, m.Source),
+		})
+		flags = append(flags, fmt.Sprintf("--mount=type=cache,id=%s,target=%s,sharing=shared,ro", id, m.Target))
+	}
+
+	dockerfileDir, err := createTempDockerfile(bytes.NewReader(addRunMounts(dt, flags)))
+	if err != nil {
+		return nil, nil, err
+	}
+	so.LocalDirs["dockerfile"] = dockerfileDir
+	so.FrontendAttrs["filename"] = "Dockerfile"
+	return hm, func() { os.RemoveAll(dockerfileDir) }, nil
+}
+
+// addRunMounts adds the mount flags to the RUN instructions of a Dockerfile
+func addRunMounts(dockerfile []byte, flags []string) []byte {
+	lines := strings.Split(string(dockerfile), "\n")
+	continued := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		// Comments and empty lines don't end a continued instruction
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !continued && len(trimmed) > 3 && strings.EqualFold(trimmed[:3], "RUN") && (trimmed[3] == ' ' || trimmed[3] == '\t') {
+			at := strings.Index(line, trimmed[:3]) + 3
+			lines[i] = line[:at] + " " + strings.Join(flags, " ") + line[at:]
+		}
+		continued = strings.HasSuffix(trimmed, "\\")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// sync copies the host paths which changed since the last build into their
+// cache mounts on the builder pod
+func (hm *hostMounts) sync(ctx context.Context, d driver.Driver, node string, platform *specs.Platform) error {
+	for _, m := range hm.mounts {
+		run := llb.Image(hm.image).Run(
+			llb.Args([]string{"sh", "-c", "cmp -s /stamp/stamp /synced/stamp && exit 0; " + copyChangedScript + " && cp /stamp/stamp /synced/stamp", "sh", "/src", "/cache"}),
+			llb.IgnoreCache,
+			llb.WithCustomNamef("[internal] syncing host path %s", m.Source),
+		)
+		run.AddMount("/src", llb.Local("src", llb.SharedKeyHint(m.dir)), llb.Readonly)
+		run.AddMount("/stamp", llb.Local("stamp"), llb.Readonly)
+		run.AddMount("/cache", llb.Scratch(), llb.AsPersistentCacheDir(m.id, llb.CacheMountLocked))
+		run.AddMount("/synced", llb.Scratch(), llb.AsPersistentCacheDir(m.id+".synced", llb.CacheMountLocked))
+		script := syncHostPathScript(m.dir)
+		if err := solveInPod(ctx, d, node, run.Root(), platform, script); err != nil {
+			return errors.Wrapf(err, "failed to sync host path %s", m.Source)
+		}
+	}
+	return nil
+}
+
+// copyChangedScript updates the copy $2 of the directory $1.  Entries of the
+// copy which were removed, changed type, size or modification time are
+// deleted, and the missing ones copied over again.
+const copyChangedScript = `cd "$2" && find . -mindepth 1 -depth | while IFS= read -r f; do
+	if [ -d "$f" ] && [ ! -L "$f" ]; then
+		[ -d "$1/$f" ] && [ ! -L "$1/$f" ] || rm -rf "$f"
+	elif [ "$(stat -c '%F %s %Y' "$f")" != "$(stat -c '%F %s %Y' "$1/$f" 2>/dev/null)" ]; then
+		rm -f "$f"
+	fi
+done && cp -an "$1/." "$2/"`
+
+// syncHostPathScript generates the script solving the sync of the host path
+// dir in the builder pod
+func syncHostPathScript(dir string) string {
+	// The stamp lists the size and modification time of every file
+	return fmt.Sprintf("stamp=$(mktemp -d) && trap 'rm -rf $stamp' EXIT && find %[1]s -exec stat -c '%%n %%s %%Y' {} + | sort > $stamp/stamp && buildctl build --progress=plain --local src=%[1]s --local stamp=$stamp", shellQuote(dir))
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseHostMounts(t *testing.T) {
+	t.Parallel()
+	mounts, err := ParseHostMounts([]string{"/data:/data:ro", "/mnt/mirror/:/mirror"})
+	require.NoError(t, err)
+	require.Equal(t, []HostMount{{Source: "/data", Target: "/data"}, {Source: "/mnt/mirror", Target: "/mirror"}}, mounts)
+
+	for _, v := range []string{"/data", "/data:/data:rw", "data:/data", "/data:/a,b",
+		"/data;rm -rf /:/data", "/data$(id):/data", "/data`id`:/data", "/data|id:/data", "/data:/da ta", "/data'x:/data"} {
+		_, err := ParseHostMounts([]string{v})
+		require.Error(t, err, v)
+	}
+}
+
+func Test_hostPathAllowed(t *testing.T) {
+	t.Parallel()
+	allowed := []string{"/data", "/mnt/mirror"}
+	require.True(t, hostPathAllowed("/data", allowed))
+	require.True(t, hostPathAllowed("/data/train", allowed))
+	require.False(t, hostPathAllowed("/database", allowed))
+	require.False(t, hostPathAllowed("/mnt", allowed))
+}
+
+func Test_addRunMounts(t *testing.T) {
+	t.Parallel()
+	dockerfile := `FROM python
+# RUN in a comment
+RUN pip install \
+    # run with the data
+    -r requirements.txt
+  run ["python", "train.py"]
+COPY . /src
+`
+	expected := `FROM python
+# RUN in a comment
+RUN --mount=type=cache,id=a,target=/a pip install \
+    # run with the data
+    -r requirements.txt
+  run --mount=type=cache,id=a,target=/a ["python", "train.py"]
+COPY . /src
+`
+	require.Equal(t, expected, string(addRunMounts([]byte(dockerfile), []string{"--mount=type=cache,id=a,target=/a"})))
+}
+
+func Test_syncHostPathScript(t *testing.T) {
+	t.Parallel()
+	script := syncHostPathScript("/host-paths/data/it's")
+	require.Contains(t, script, `find '/host-paths/data/it'\''s' -exec`)
+	require.Contains(t, script, `--local src='/host-paths/data/it'\''s' --local`)
+}
+
+func Test_copyChangedScript(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	src, err := ioutil.TempDir("", "hostmount-src")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "hostmount-dst")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+	copyChanged := func() {
+		out, err := exec.Command("sh", "-c", copyChangedScript, "sh", src, dst).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	write := func(name, content string, mtime time.Time) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644))
+		require.NoError(t, os.Chtimes(filepath.Join(src, name), mtime, mtime))
+	}
+	read := func(name string) string {
+		dt, err := ioutil.ReadFile(filepath.Join(dst, name))
+		require.NoError(t, err)
+		return string(dt)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	write("kept", "kept", old)
+	write("changed", "a", old)
+	write("dir/removed", "removed", old)
+	write("dir/sub/older", "new", old)
+	copyChanged()
+	require.Equal(t, "kept", read("kept"))
+	require.Equal(t, "removed", read("dir/removed"))
+
+	kept, err := os.Stat(filepath.Join(dst, "kept"))
+	require.NoError(t, err)
+
+	write("changed", "b", old.Add(time.Minute))
+	write("dir/sub/older", "old", old.Add(-time.Minute))
+	write("dir/with space", "space", old)
+	require.NoError(t, os.Remove(filepath.Join(src, "dir/removed")))
+	copyChanged()
+	// Unchanged files are not copied again
+	fi, err := os.Stat(filepath.Join(dst, "kept"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(kept, fi))
+	require.Equal(t, "b", read("changed"))
+	require.Equal(t, "old", read("dir/sub/older"))
+	require.Equal(t, "space", read("dir/with space"))
+	_, err = os.Stat(filepath.Join(dst, "dir/removed"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/csv"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+)
+
+// ImageSet is an additional image built from the same context in one command
+type ImageSet struct {
+	Dockerfile string
+	Tags       []string
+	Target     string
+}
+
+// ParseImageSets parses "file=<Dockerfile>,tag=<tag>[,tag=<tag>][,target=<stage>]"
+func ParseImageSets(in []string) ([]ImageSet, error) {
+	var res []ImageSet
+	for _, s := range in {
+		fields, err := csv.NewReader(strings.NewReader(s)).Read()
+		if err != nil {
+			return nil, err
+		}
+		set := ImageSet{}
+		for _, field := range fields {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid value %s", field)
+			}
+			switch strings.ToLower(parts[0]) {
+			case "file":
+				set.Dockerfile = parts[1]
+			case "tag":
+				set.Tags = append(set.Tags, parts[1])
+			case "target":
+				set.Target = parts[1]
+			default:
+				return nil, errors.Errorf("unexpected key '%s' in '%s'", parts[0], field)
+			}
+		}
+		if set.Dockerfile == "" && set.Target == "" {
+			return nil, errors.Errorf("invalid image %q, file or target is required", s)
+		}
+		res = append(res, set)
+	}
+	return res, nil
+}
+
+// WithImageSet returns a copy of opt building the image of set instead.  The
+// exports are copied as the exporter attributes are filled in per image.
+func (opt Options) WithImageSet(set ImageSet) Options {
+	if set.Dockerfile != "" {
+		opt.Inputs.DockerfilePath = set.Dockerfile
+	}
+	if set.Target != "" {
+		opt.Target = set.Target
+	}
+	opt.Tags = set.Tags
+	opt.ImageIDFile = ""
+	opt.Extracts = nil
+	exports := make([]client.ExportEntry, len(opt.Exports))
+	for i, e := range opt.Exports {
+		attrs := make(map[string]string, len(e.Attrs))
+		for k, v := range e.Attrs {
+			attrs[k] = v
+		}
+		e.Attrs = attrs
+		exports[i] = e
+	}
+	opt.Exports = exports
+	return opt
+}
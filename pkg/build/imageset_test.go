@@ -0,0 +1,39 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseImageSets(t *testing.T) {
+	t.Parallel()
+	sets, err := ParseImageSets([]string{"file=api/Dockerfile,tag=acme/api:1,tag=acme/api:latest", "target=worker,tag=acme/worker"})
+	require.NoError(t, err)
+	require.Equal(t, []ImageSet{
+		{Dockerfile: "api/Dockerfile", Tags: []string{"acme/api:1", "acme/api:latest"}},
+		{Target: "worker", Tags: []string{"acme/worker"}},
+	}, sets)
+
+	_, err = ParseImageSets([]string{"tag=acme/api"})
+	require.Error(t, err)
+	_, err = ParseImageSets([]string{"file=Dockerfile,name=acme/api"})
+	require.Error(t, err)
+}
+
+func Test_WithImageSet(t *testing.T) {
+	t.Parallel()
+	opt := Options{
+		Inputs:  Inputs{ContextPath: ".", DockerfilePath: "Dockerfile"},
+		Tags:    []string{"acme/web"},
+		Exports: []client.ExportEntry{{Type: "image", Attrs: map[string]string{"push": "true"}}},
+	}
+	o := opt.WithImageSet(ImageSet{Dockerfile: "api/Dockerfile", Tags: []string{"acme/api"}})
+	require.Equal(t, "api/Dockerfile", o.Inputs.DockerfilePath)
+	require.Equal(t, []string{"acme/api"}, o.Tags)
+	o.Exports[0].Attrs["name"] = "acme/api"
+	require.NotContains(t, opt.Exports[0].Attrs, "name")
+}
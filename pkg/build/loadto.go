@@ -0,0 +1,70 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// A loaded image is only in the runtime of the nodes of the builder pods, a
+// Deployment with replicas on other nodes can't start without pulling it.
+// With --load-to the image is loaded on every node, or the nodes of a label
+// selector, through the builder pods on them and loader pods on the others.
+
+// LoadToAllNodes loads the image on every node of the cluster
+const LoadToAllNodes = "all-nodes"
+
+// LoadTo selects the nodes the image is loaded on, beyond those of the
+// builder pods
+type LoadTo struct {
+	// NodeSelector is the label selector of the nodes, every node if empty
+	NodeSelector string
+}
+
+// ParseLoadTo parses --load-to, all-nodes or nodeSelector=SELECTOR, nil if
+// it's empty
+func ParseLoadTo(s string) (*LoadTo, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s == LoadToAllNodes {
+		return &LoadTo{}, nil
+	}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] != "nodeSelector" || parts[1] == "" {
+		return nil, errors.Errorf("invalid --load-to %q, use %s or nodeSelector=SELECTOR", s, LoadToAllNodes)
+	}
+	if _, err := labels.Parse(parts[1]); err != nil {
+		return nil, errors.Wrapf(err, "invalid node selector %q", parts[1])
+	}
+	return &LoadTo{NodeSelector: parts[1]}, nil
+}
+
+// loadPods returns the pods the image is loaded into runtime through, the
+// builder pods of builderName or those the driver selects for loadTo, and
+// the func releasing them
+func loadPods(ctx context.Context, d driver.Driver, builderName, runtime string, loadTo *LoadTo) ([]string, func(), error) {
+	if loadTo == nil {
+		builders, err := d.List(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		// TODO this isn't quite right - we need a better "list only pods from one instance" func
+		for _, builder := range builders {
+			if builder.Name == builderName {
+				return loadNodes(builder.Nodes, runtime), func() {}, nil
+			}
+		}
+		return nil, func() {}, nil
+	}
+	nodes, release, err := d.LoadPods(ctx, loadTo.NodeSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	return loadNodes(nodes, runtime), release, nil
+}
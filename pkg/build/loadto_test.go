@@ -0,0 +1,55 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+func Test_ParseLoadTo(t *testing.T) {
+	t.Parallel()
+	loadTo, err := ParseLoadTo("")
+	require.NoError(t, err)
+	require.Nil(t, loadTo)
+	loadTo, err = ParseLoadTo("all-nodes")
+	require.NoError(t, err)
+	require.Equal(t, &LoadTo{}, loadTo)
+	loadTo, err = ParseLoadTo("nodeSelector=pool=web,zone in (a,b)")
+	require.NoError(t, err)
+	require.Equal(t, "pool=web,zone in (a,b)", loadTo.NodeSelector)
+
+	for _, s := range []string{"some-nodes", "nodeSelector=", "selector=pool=web", "nodeSelector=pool in web"} {
+		_, err := ParseLoadTo(s)
+		require.Error(t, err, s)
+	}
+}
+
+type loadToDriver struct {
+	driver.Driver
+	selector string
+	released bool
+}
+
+func (d *loadToDriver) LoadPods(_ context.Context, nodeSelector string) ([]driver.Node, func(), error) {
+	d.selector = nodeSelector
+	return []driver.Node{
+		{Name: "builder-0", Runtime: "containerd"},
+		{Name: "builder-load-x", Runtime: "containerd"},
+		{Name: "builder-load-y", Runtime: "docker"},
+	}, func() { d.released = true }, nil
+}
+
+func Test_loadPods(t *testing.T) {
+	t.Parallel()
+	d := &loadToDriver{}
+	names, release, err := loadPods(context.Background(), d, "builder", "containerd", &LoadTo{NodeSelector: "pool=web"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"builder-0", "builder-load-x"}, names)
+	require.Equal(t, "pool=web", d.selector)
+	release()
+	require.True(t, d.released)
+}
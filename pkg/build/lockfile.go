@@ -0,0 +1,151 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// A lockfile records the digests the base images of a Dockerfile resolved to.
+// Like source policies, it is applied on the client by pinning the FROM
+// instructions of the Dockerfile to the locked digests, so every build of the
+// same lockfile starts from the same images.  Images the Dockerfile already
+// pins to a digest aren't locked.
+
+const lockfileVersion = 1
+
+// Lockfile maps the base images of a Dockerfile, as normalized tagged
+// references, to their digest
+type Lockfile struct {
+	Version int               `json:"version"`
+	Images  map[string]string `json:"images"`
+}
+
+// imageResolver resolves an image reference to its descriptor, see imagetools.Resolver
+type imageResolver interface {
+	Resolve(ctx context.Context, in string) (string, ocispec.Descriptor, error)
+}
+
+// LoadLockfile reads a lockfile written by WriteFile
+func LoadLockfile(filename string) (*Lockfile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read lockfile")
+	}
+	var l Lockfile
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, errors.Wrapf(err, "malformed lockfile %s", filename)
+	}
+	if l.Version != lockfileVersion {
+		return nil, errors.Errorf("unsupported lockfile version %d in %s", l.Version, filename)
+	}
+	return &l, nil
+}
+
+func (l *Lockfile) WriteFile(filename string) error {
+	// Maps are written in key order, keeping diffs of the lockfile readable
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// BaseImages returns the images a Dockerfile builds on or copies from not
+// pinned to a digest, as normalized tagged references, once rewritten by the
+// source policy
+func BaseImages(dockerfile []byte, policy *SourcePolicy) ([]string, error) {
+	seen := map[string]bool{}
+	var res []string
+	_, err := rewriteFromImages(dockerfile, func(image string) (string, error) {
+		if policy != nil {
+			var err error
+			if image, err = policy.Evaluate(image); err != nil {
+				return "", err
+			}
+		}
+		key, pinned, err := lockKey(image)
+		if err != nil {
+			return "", err
+		}
+		if !pinned && !seen[key] {
+			seen[key] = true
+			res = append(res, key)
+		}
+		return image, nil
+	})
+	return res, err
+}
+
+// LockBaseImages resolves the images to their current digest
+func LockBaseImages(ctx context.Context, r imageResolver, images []string) (*Lockfile, error) {
+	l := &Lockfile{Version: lockfileVersion, Images: map[string]string{}}
+	for _, image := range images {
+		_, desc, err := r.Resolve(ctx, image)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve %s", image)
+		}
+		l.Images[image] = desc.Digest.String()
+	}
+	return l, nil
+}
+
+// Verify fails if any of the images isn't locked, or doesn't resolve to the
+// locked digest anymore
+func (l *Lockfile) Verify(ctx context.Context, r imageResolver, images []string) error {
+	var missing, drifted []string
+	for _, image := range images {
+		locked, ok := l.Images[image]
+		if !ok {
+			missing = append(missing, image)
+			continue
+		}
+		_, desc, err := r.Resolve(ctx, image)
+		if err != nil {
+			return errors.Wrapf(err, "failed to resolve %s", image)
+		}
+		if desc.Digest.String() != locked {
+			drifted = append(drifted, image+" (locked "+locked+", now "+desc.Digest.String()+")")
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		return errors.Errorf("base images not pinned by the lockfile: %s, update it with --lock", strings.Join(missing, ", "))
+	case len(drifted) > 0:
+		return errors.Errorf("base images drifted from the lockfile: %s, update it with --lock", strings.Join(drifted, ", "))
+	}
+	return nil
+}
+
+// pin returns the image pinned to its locked digest
+func (l *Lockfile) pin(image string) (string, error) {
+	key, pinned, err := lockKey(image)
+	if err != nil || pinned {
+		return image, err
+	}
+	dgst, ok := l.Images[key]
+	if !ok {
+		return "", errors.Errorf("base image %s is not pinned by the lockfile", key)
+	}
+	return key + "@" + dgst, nil
+}
+
+// lockKey returns the normalized tagged reference of image, and whether it
+// is pinned to a digest already
+func lockKey(image string) (string, bool, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "invalid image reference %q", image)
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		return named.String(), true, nil
+	}
+	return reference.TagNameOnly(named).String(), false, nil
+}
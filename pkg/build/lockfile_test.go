@@ -0,0 +1,85 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver map[string]digest.Digest
+
+func (r fakeResolver) Resolve(ctx context.Context, in string) (string, ocispec.Descriptor, error) {
+	dgst, ok := r[in]
+	if !ok {
+		return "", ocispec.Descriptor{}, errors.Errorf("%s: not found", in)
+	}
+	return in, ocispec.Descriptor{Digest: dgst}, nil
+}
+
+const lockDockerfile = `FROM golang:1.16 AS build
+FROM --platform=$BUILDPLATFORM alpine
+FROM build
+FROM busybox@sha256:0000000000000000000000000000000000000000000000000000000000000000
+FROM scratch
+FROM ${BASE}
+FROM golang:1.16
+`
+
+func Test_BaseImages(t *testing.T) {
+	t.Parallel()
+	images, err := BaseImages([]byte(lockDockerfile), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/library/golang:1.16", "docker.io/library/alpine:latest"}, images)
+
+	policy, err := ParseSourcePolicy([]byte(`{"rules":[{"action":"CONVERT","selector":{"identifier":"docker-image://docker.io/library/alpine:latest"},"updates":{"identifier":"docker-image://mirror.local/alpine:3.13"}}]}`))
+	require.NoError(t, err)
+	images, err = BaseImages([]byte(lockDockerfile), policy)
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/library/golang:1.16", "mirror.local/alpine:3.13"}, images)
+}
+
+func Test_Lockfile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	images := []string{"docker.io/library/golang:1.16", "docker.io/library/alpine:latest"}
+	r := fakeResolver{
+		"docker.io/library/golang:1.16":   digest.FromString("golang"),
+		"docker.io/library/alpine:latest": digest.FromString("alpine"),
+	}
+	l, err := LockBaseImages(ctx, r, images)
+	require.NoError(t, err)
+	require.NoError(t, l.Verify(ctx, r, images))
+
+	dir, err := ioutil.TempDir("", "lockfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "Dockerfile.lock")
+	require.NoError(t, l.WriteFile(filename))
+	loaded, err := LoadLockfile(filename)
+	require.NoError(t, err)
+	require.Equal(t, l, loaded)
+
+	pinned, err := rewriteFromImages([]byte(lockDockerfile), loaded.pin)
+	require.NoError(t, err)
+	require.Contains(t, string(pinned), "FROM docker.io/library/golang:1.16@"+digest.FromString("golang").String()+" AS build\n")
+	require.Contains(t, string(pinned), "FROM --platform=$BUILDPLATFORM docker.io/library/alpine:latest@"+digest.FromString("alpine").String()+"\n")
+	require.Contains(t, string(pinned), "FROM busybox@sha256:0000000000000000000000000000000000000000000000000000000000000000\n")
+
+	r["docker.io/library/alpine:latest"] = digest.FromString("alpine moved")
+	err = l.Verify(ctx, r, images)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "drifted")
+
+	err = l.Verify(ctx, r, append(images, "docker.io/library/debian:latest"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not pinned")
+}
@@ -0,0 +1,15 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import "path/filepath"
+
+// longPath returns p as an absolute path.  On Windows the os package only
+// handles paths longer than MAX_PATH (260 characters) when they are absolute,
+// a relative path into a deep node_modules or build tree fails to open.
+func longPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// An image pushed to several registries, a primary and its disaster
+// recovery or region-local mirrors, is pushed once by the build to the
+// primary tag, then promoted from there to every mirror in parallel.  The
+// builder copies the layers, and each mirror succeeds or fails on its own:
+// an unreachable mirror doesn't fail the push to the others.  The tags of
+// a build spanning several registries are pushed alike: the build pushes
+// those of the registry of the first tag, and the image is promoted to the
+// others with the credentials the registry secret has for each.
+
+// MirrorResult is the outcome of the push of an image to a mirror
+type MirrorResult struct {
+	Source      string
+	Destination string
+	Desc        ocispec.Descriptor
+	Err         error
+}
+
+// MirrorRefs returns the destinations of the image tagged tag for the
+// --push-to values: a registry host, such as registry.example.com:5000,
+// mirrors the repository and tag of tag there, any other value is the
+// destination reference itself
+func MirrorRefs(tag string, pushTo []string) ([]string, error) {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tag %q", tag)
+	}
+	named = reference.TagNameOnly(named)
+	res := make([]string, 0, len(pushTo))
+	for _, dst := range pushTo {
+		if IsRegistryHost(dst) {
+			dst = dst + "/" + reference.Path(named)
+			if tagged, ok := named.(reference.Tagged); ok {
+				dst += ":" + tagged.Tag()
+			}
+		}
+		if _, err := reference.ParseNormalizedNamed(dst); err != nil {
+			return nil, errors.Wrapf(err, "invalid --push-to %q", dst)
+		}
+		res = append(res, dst)
+	}
+	return res, nil
+}
+
+// SplitRegistryTags splits tags into those of the registry of the first tag,
+// which the build pushes, and those of other registries, promoted from it
+func SplitRegistryTags(tags []string) (primary, others []string, err error) {
+	domain := ""
+	for i, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid tag %q", tag)
+		}
+		if i == 0 {
+			domain = reference.Domain(named)
+		}
+		if reference.Domain(named) == domain {
+			primary = append(primary, tag)
+		} else {
+			others = append(others, tag)
+		}
+	}
+	return primary, others, nil
+}
+
+// IsRegistryHost reports if s is a registry host alone, not a repository
+func IsRegistryHost(s string) bool {
+	if strings.Contains(s, "/") {
+		return false
+	}
+	// As the distribution reference grammar tells a domain from a path
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// PushMirrors promotes the image src to every destination in parallel, the
+// results are in the order of destinations.  Each promotion reports its
+// progress under the name of its destination.
+func PushMirrors(ctx context.Context, d driver.Driver, src string, destinations []string, policy *SourcePolicy, registrySecretName, referrersMode string, pw progress.Writer) []MirrorResult {
+	res := make([]MirrorResult, len(destinations))
+	mw := progress.NewMultiWriter(pw)
+	writers := make([]progress.Writer, len(destinations))
+	for i, dst := range destinations {
+		writers[i] = mw.WithPrefix(dst, true)
+	}
+	var wg sync.WaitGroup
+	for i, dst := range destinations {
+		wg.Add(1)
+		go func(i int, dst string) {
+			defer wg.Done()
+			desc, err := Promote(ctx, d, src, dst, policy, registrySecretName, referrersMode, writers[i])
+			res[i] = MirrorResult{Source: src, Destination: dst, Desc: desc, Err: err}
+		}(i, dst)
+	}
+	wg.Wait()
+	return res
+}
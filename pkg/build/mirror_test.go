@@ -0,0 +1,62 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MirrorRefs(t *testing.T) {
+	t.Parallel()
+	refs, err := MirrorRefs("registry.example.com/team/app:v1", []string{
+		"dr.example.com",
+		"localhost:5000",
+		"eu.example.com/mirror/app:stable",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"dr.example.com/team/app:v1",
+		"localhost:5000/team/app:v1",
+		"eu.example.com/mirror/app:stable",
+	}, refs)
+
+	refs, err = MirrorRefs("app", []string{"dr.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"dr.example.com/library/app:latest"}, refs)
+
+	_, err = MirrorRefs("app:v1", []string{"dr.example.com/UPPER"})
+	require.Error(t, err)
+}
+
+func Test_IsRegistryHost(t *testing.T) {
+	t.Parallel()
+	require.True(t, IsRegistryHost("registry.example.com"))
+	require.True(t, IsRegistryHost("registry:5000"))
+	require.True(t, IsRegistryHost("localhost"))
+	require.False(t, IsRegistryHost("app"))
+	require.False(t, IsRegistryHost("registry.example.com/app"))
+}
+
+func Test_SplitRegistryTags(t *testing.T) {
+	t.Parallel()
+	primary, others, err := SplitRegistryTags([]string{
+		"registry.example.com/team/app:v1",
+		"app:v1",
+		"registry.example.com/team/app",
+		"docker.io/team/app:v1",
+		"eu.example.com:5000/app:v1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"registry.example.com/team/app:v1", "registry.example.com/team/app"}, primary)
+	require.Equal(t, []string{"app:v1", "docker.io/team/app:v1", "eu.example.com:5000/app:v1"}, others)
+
+	primary, others, err = SplitRegistryTags([]string{"app", "team/app:v1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "team/app:v1"}, primary)
+	require.Empty(t, others)
+
+	_, _, err = SplitRegistryTags([]string{"app", "UPPER"})
+	require.Error(t, err)
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/ociindex"
+	"github.com/moby/buildkit/identity"
+	sessioncontent "github.com/moby/buildkit/session/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// A named context replaces an image or stage of the Dockerfile, or adds one
+// its FROM and COPY --from can refer to, passed to the frontend as the
+// context:<name> attribute.  Images (docker-image://) and remote contexts are
+// resolved by the builder.  An OCI layout (oci-layout://), such as one written
+// by --output type=oci, is served to the builder from the client by the
+// session, so exported images feed new builds without going through a
+// registry.  A local directory is uploaded like the build context.
+
+const ociLayoutScheme = "oci-layout://"
+
+// ParseNamedContexts parses the --build-context name=value flags
+func ParseNamedContexts(in []string) (map[string]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	res := make(map[string]string, len(in))
+	for _, s := range in {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid build context %q, use name=value", s)
+		}
+		if strings.ContainsAny(parts[0], " \t") {
+			return nil, errors.Errorf("invalid build context name %q", parts[0])
+		}
+		if _, ok := res[parts[0]]; ok {
+			return nil, errors.Errorf("build context %q given twice", parts[0])
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// loadNamedContexts sets the frontend attributes of the named contexts, and
+// the local directories and content stores the session serves them with
+func loadNamedContexts(contexts map[string]string, target *client.SolveOpt) error {
+	stores := map[string]content.Store{}
+	for name, v := range contexts {
+		switch {
+		case strings.HasPrefix(v, dockerImageScheme), urlutil.IsGitURL(v), urlutil.IsURL(v):
+			target.FrontendAttrs["context:"+name] = v
+		case strings.HasPrefix(v, ociLayoutScheme):
+			id := identity.NewID()
+			store, dgst, err := openOCILayout(strings.TrimPrefix(v, ociLayoutScheme))
+			if err != nil {
+				return errors.Wrapf(err, "invalid build context %s", name)
+			}
+			stores["oci:"+id] = store
+			target.FrontendAttrs["context:"+name] = ociLayoutScheme + id + "@" + dgst.String()
+		case isLocalDir(v):
+			// The context and Dockerfile keep their own directories
+			key := name
+			if key == "context" || key == "dockerfile" {
+				key = "_" + key
+			}
+			target.LocalDirs[key] = longPath(v)
+			target.FrontendAttrs["context:"+name] = "local:" + key
+		default:
+			return errors.Errorf("invalid build context %s: %q is not an image, OCI layout, URL or directory", name, v)
+		}
+	}
+	if len(stores) == 0 {
+		return nil
+	}
+	for _, c := range append(append([]client.CacheOptionsEntry{}, target.CacheImports...), target.CacheExports...) {
+		if c.Type == "local" {
+			// The client serves a single content session, the local cache has its own
+			return errors.Errorf("OCI layout build contexts can't be combined with a local cache")
+		}
+	}
+	n := len(target.Session)
+	target.Session = append(target.Session[:n:n], sessioncontent.NewAttachable(stores))
+	return nil
+}
+
+// openOCILayout opens the OCI layout dir[:tag][@digest], returning the
+// digest of the image of tag, or of its only image without a tag
+func openOCILayout(in string) (content.Store, digest.Digest, error) {
+	dir, dgst := in, ""
+	if i := strings.LastIndex(in, "@"); i >= 0 {
+		dir, dgst = in[:i], in[i+1:]
+	}
+	var tag string
+	// A colon in the last element of the path is a tag, not a drive letter
+	if i := strings.LastIndex(dir, ":"); i > 1 && !strings.ContainsAny(dir[i+1:], `/\`) {
+		dir, tag = dir[:i], dir[i+1:]
+	}
+	// The store would be created in a missing directory
+	if !isLocalDir(dir) {
+		return nil, "", errors.Errorf("OCI layout %s not found", dir)
+	}
+	store, err := local.NewStore(dir)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to open OCI layout %s", dir)
+	}
+	if dgst == "" {
+		idx, err := ociindex.ReadIndexJSONFileLocked(filepath.Join(dir, "index.json"))
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to read OCI layout %s", dir)
+		}
+		desc, err := layoutImage(idx, tag)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "OCI layout %s", dir)
+		}
+		dgst = desc.Digest.String()
+	}
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid digest %q", dgst)
+	}
+	if _, err := store.Info(context.TODO(), d); err != nil {
+		return nil, "", errors.Wrapf(err, "OCI layout %s has no %s", dir, d)
+	}
+	return store, d, nil
+}
+
+// layoutImage returns the image of the index of an OCI layout tagged tag,
+// its only image if tag is empty
+func layoutImage(idx *ocispec.Index, tag string) (ocispec.Descriptor, error) {
+	if tag == "" {
+		if len(idx.Manifests) == 1 {
+			return idx.Manifests[0], nil
+		}
+		tag = "latest"
+	}
+	for _, m := range idx.Manifests {
+		if m.Annotations[ocispec.AnnotationRefName] == tag {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, errors.Errorf("no image tagged %q, add the tag or digest to the path", tag)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseNamedContexts(t *testing.T) {
+	t.Parallel()
+	contexts, err := ParseNamedContexts([]string{"base=docker-image://alpine:3.14", "src=./src"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"base": "docker-image://alpine:3.14", "src": "./src"}, contexts)
+
+	for _, in := range []string{"base", "=./src", "base=", "my base=./src"} {
+		_, err := ParseNamedContexts([]string{in})
+		require.Error(t, err, in)
+	}
+	_, err = ParseNamedContexts([]string{"base=./a", "base=./b"})
+	require.Error(t, err)
+}
+
+// writeOCILayout writes an OCI layout with a single manifest tagged tag
+func writeOCILayout(t *testing.T, tag string) (string, digest.Digest) {
+	dir, err := ioutil.TempDir("", "layout")
+	require.NoError(t, err)
+	dt := []byte(`{"schemaVersion":2}`)
+	dgst := digest.FromBytes(dt)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", dgst.Encoded()), dt, 0644))
+	idx, err := json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      dgst,
+		Size:        int64(len(dt)),
+		Annotations: map[string]string{ocispec.AnnotationRefName: tag},
+	}}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), idx, 0644))
+	return dir, dgst
+}
+
+func Test_loadNamedContexts(t *testing.T) {
+	t.Parallel()
+	layout, dgst := writeOCILayout(t, "v1")
+	defer os.RemoveAll(layout)
+	so := &client.SolveOpt{FrontendAttrs: map[string]string{}, LocalDirs: map[string]string{}}
+	require.NoError(t, loadNamedContexts(map[string]string{
+		"alpine":  "docker-image://alpine:3.14",
+		"app":     "oci-layout://" + layout + ":v1",
+		"context": layout,
+	}, so))
+	require.Equal(t, "docker-image://alpine:3.14", so.FrontendAttrs["context:alpine"])
+	require.True(t, strings.HasPrefix(so.FrontendAttrs["context:app"], ociLayoutScheme))
+	require.True(t, strings.HasSuffix(so.FrontendAttrs["context:app"], "@"+dgst.String()))
+	require.Equal(t, "local:_context", so.FrontendAttrs["context:context"])
+	require.Equal(t, longPath(layout), so.LocalDirs["_context"])
+	require.Len(t, so.Session, 1)
+
+	// The only image of the layout is taken without a tag
+	_, found, err := openOCILayout(layout)
+	require.NoError(t, err)
+	require.Equal(t, dgst, found)
+	_, _, err = openOCILayout(layout + ":v2")
+	require.Error(t, err)
+	_, _, err = openOCILayout(filepath.Join(layout, "missing"))
+	require.Error(t, err)
+
+	so = &client.SolveOpt{FrontendAttrs: map[string]string{}, CacheImports: []client.CacheOptionsEntry{{Type: "local", Attrs: map[string]string{"src": "cache"}}}}
+	require.Error(t, loadNamedContexts(map[string]string{"app": "oci-layout://" + layout}, so))
+	require.Error(t, loadNamedContexts(map[string]string{"app": "not-a-context"}, so))
+}
@@ -6,13 +6,21 @@ import (
 	"encoding/csv"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/containerd/console"
+	"github.com/docker/distribution/reference"
 	"github.com/moby/buildkit/client"
 	"github.com/pkg/errors"
 )
 
+// ExporterPVC writes the image to a PersistentVolumeClaim mounted in the
+// builder pods, see pvcExport
+const ExporterPVC = "pvc"
+
 func ParseOutputs(inp []string) ([]client.ExportEntry, error) {
 	var outs []client.ExportEntry
 	if len(inp) == 0 {
@@ -93,16 +101,26 @@ func ParseOutputs(inp []string) ([]client.ExportEntry, error) {
 				if err == nil && fi.IsDir() {
 					return nil, errors.Errorf("destination file %s is a directory", dest)
 				}
-				f, err := os.Create(dest)
-				if err != nil {
-					return nil, errors.Errorf("failed to open %s", err)
-				}
-				out.Output = wrapWriteCloser(f)
+				out.Output = createOnWrite(dest)
 			}
 			delete(out.Attrs, "dest")
 		case "registry":
 			out.Type = client.ExporterImage
 			out.Attrs["push"] = "true"
+		case ExporterPVC:
+			if out.Attrs["name"] == "" || out.Attrs["dest"] == "" {
+				return nil, errors.Errorf("name and dest are required for pvc output")
+			}
+			switch out.Attrs["format"] {
+			case "":
+				out.Attrs["format"] = client.ExporterOCI
+			case client.ExporterOCI, client.ExporterTar:
+			default:
+				return nil, errors.Errorf("invalid pvc output format %q, use oci or tar", out.Attrs["format"])
+			}
+			// The name attribute of the exporters is the image name
+			out.Attrs["claim"] = out.Attrs["name"]
+			delete(out.Attrs, "name")
 		}
 
 		outs = append(outs, out)
@@ -110,6 +128,157 @@ func ParseOutputs(inp []string) ([]client.ExportEntry, error) {
 	return outs, nil
 }
 
+// NormalizeTags validates the tags and drops those naming the same image as an
+// earlier one, eg. foo:latest after foo, keeping the order and spelling of the
+// first
+func NormalizeTags(tags []string) ([]string, error) {
+	res := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		ref, err := reference.Parse(tag)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag %q", tag)
+		}
+		key := imageKey(ref.String())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, ref.String())
+	}
+	return res, nil
+}
+
+// imageKey is the fully qualified image tag, the same for every spelling
+func imageKey(tag string) string {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return tag
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// isNamedOutput reports whether the output exports an image named by the tags
+func isNamedOutput(e client.ExportEntry) bool {
+	switch e.Type {
+	case client.ExporterImage, client.ExporterOCI, client.ExporterDocker, ExporterPVC, "runtime":
+		return true
+	}
+	return false
+}
+
+// NameOutputs names the image, oci and docker outputs after the tags.  An
+// output with its own name attribute keeps it, tags naming it differently are
+// an error rather than one of the two winning.  It may be called again on the
+// outputs it named.
+func NameOutputs(exports []client.ExportEntry, tags []string) error {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+	for i, e := range exports {
+		if !isNamedOutput(e) {
+			continue
+		}
+		if e.Attrs["name"] == "" {
+			if len(tags) > 0 {
+				exports[i].Attrs["name"] = strings.Join(tags, ",")
+			}
+			continue
+		}
+		names, err := NormalizeTags(strings.Split(e.Attrs["name"], ","))
+		if err != nil {
+			return err
+		}
+		if len(tags) > 0 && !sameNames(names, tags) {
+			return errors.Errorf("the %s output is named %s and tagged %s, give the names either with --tag or in --output", e.Type, strings.Join(names, ","), strings.Join(tags, ","))
+		}
+		exports[i].Attrs["name"] = strings.Join(names, ",")
+	}
+	return nil
+}
+
+// sameNames reports whether the normalized tags a and b name the same images
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := func(tags []string) []string {
+		res := make([]string, len(tags))
+		for i, tag := range tags {
+			res[i] = imageKey(tag)
+		}
+		sort.Strings(res)
+		return res
+	}
+	ka, kb := keys(a), keys(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HasPVCOutput reports whether one of the outputs is written to a claim
+func HasPVCOutput(outputs []client.ExportEntry) bool {
+	for _, e := range outputs {
+		if e.Type == ExporterPVC {
+			return true
+		}
+	}
+	return false
+}
+
+// PVC outputs are written by buildctl running in the builder pod, the way
+// detached builds run, so the exported image goes from buildkitd straight to
+// the claim mounted in the pod rather than through the client.
+
+// pvcExport translates a pvc output into an exporter writing to the claim
+// mounted in the builder pods at claimDir
+func pvcExport(e client.ExportEntry, claims []string, claimDir string) (client.ExportEntry, error) {
+	claim := e.Attrs["claim"]
+	found := false
+	for _, c := range claims {
+		found = found || c == claim
+	}
+	if !found {
+		return e, errors.Errorf("claim %s is not mounted by the builder, create it with --output-claim=%s", claim, claim)
+	}
+	out := client.ExportEntry{Type: e.Attrs["format"], Attrs: map[string]string{}}
+	for k, v := range e.Attrs {
+		switch k {
+		case "claim", "format":
+		case "dest":
+			dest := path.Clean("/" + v)
+			if dest == "/" {
+				return e, errors.Errorf("invalid pvc output dest %q", v)
+			}
+			out.Attrs["dest"] = path.Join(claimDir, claim, dest)
+		default:
+			out.Attrs[k] = v
+		}
+	}
+	return out, nil
+}
+
+// createOnWrite creates the archive file dest once the exporter writes it,
+// so a failed build doesn't leave an empty archive behind
+func createOnWrite(dest string) func(map[string]string) (io.WriteCloser, error) {
+	return func(map[string]string) (io.WriteCloser, error) {
+		if dir := filepath.Dir(dest); dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+		}
+		f, err := os.Create(dest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", dest)
+		}
+		return f, nil
+	}
+}
+
 func wrapWriteCloser(wc io.WriteCloser) func(map[string]string) (io.WriteCloser, error) {
 	return func(map[string]string) (io.WriteCloser, error) {
 		return wc, nil
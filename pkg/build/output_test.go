@@ -3,10 +3,14 @@
 package build
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/moby/buildkit/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_ParseOutputs(t *testing.T) {
@@ -35,6 +39,21 @@ func Test_ParseOutputs(t *testing.T) {
 		os.Remove(filename)
 	}()
 
+	dir, err := ioutil.TempDir("", "outputs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "images", "image.tar")
+	resp, err = ParseOutputs([]string{"type=docker,dest=" + archive})
+	require.NoError(t, err)
+	require.Len(t, resp, 1)
+	_, err = os.Stat(archive)
+	assert.True(t, os.IsNotExist(err), "the archive is created when it is written")
+	w, err := resp[0].Output(nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, err = os.Stat(archive)
+	assert.NoError(t, err)
+
 	resp, err = ParseOutputs([]string{"type=local"})
 	assert.Error(t, err)
 	assert.Len(t, resp, 0)
@@ -55,3 +74,62 @@ func Test_ParseOutputs(t *testing.T) {
 	assert.Error(t, err)
 	assert.Len(t, resp, 0)
 }
+
+func Test_pvcExport(t *testing.T) {
+	t.Parallel()
+	outs, err := ParseOutputs([]string{"type=pvc,name=artifacts,dest=/images/app.tar"})
+	assert.NoError(t, err)
+	assert.True(t, HasPVCOutput(outs))
+	assert.Equal(t, map[string]string{"claim": "artifacts", "dest": "/images/app.tar", "format": "oci"}, outs[0].Attrs)
+	assert.Nil(t, outs[0].Output)
+
+	e, err := pvcExport(outs[0], []string{"cache", "artifacts"}, "/var/lib/buildkit-outputs")
+	assert.NoError(t, err)
+	assert.Equal(t, "oci", e.Type)
+	assert.Equal(t, map[string]string{"dest": "/var/lib/buildkit-outputs/artifacts/images/app.tar"}, e.Attrs)
+
+	_, err = pvcExport(outs[0], []string{"cache"}, "/var/lib/buildkit-outputs")
+	assert.Error(t, err)
+
+	outs, err = ParseOutputs([]string{"type=pvc,name=artifacts,dest=../../etc/passwd,format=tar"})
+	assert.NoError(t, err)
+	e, err = pvcExport(outs[0], []string{"artifacts"}, "/out")
+	assert.NoError(t, err)
+	assert.Equal(t, "/out/artifacts/etc/passwd", e.Attrs["dest"])
+
+	for _, v := range []string{"type=pvc,dest=/a.tar", "type=pvc,name=artifacts", "type=pvc,name=a,dest=/a.tar,format=docker"} {
+		_, err := ParseOutputs([]string{v})
+		assert.Error(t, err, v)
+	}
+}
+
+func Test_NormalizeTags(t *testing.T) {
+	t.Parallel()
+	tags, err := NormalizeTags([]string{"acme/app", "acme/app:latest", "docker.io/acme/app:1.0", "acme/app:1.0", "registry:5000/app"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme/app", "docker.io/acme/app:1.0", "registry:5000/app"}, tags)
+
+	_, err = NormalizeTags([]string{"Acme/App"})
+	require.Error(t, err)
+}
+
+func Test_NameOutputs(t *testing.T) {
+	t.Parallel()
+	exports := []client.ExportEntry{{Type: "image", Attrs: map[string]string{"push": "true"}}}
+	require.NoError(t, NameOutputs(exports, []string{"acme/app:1.0", "acme/app:1.0", "acme/app"}))
+	require.Equal(t, "acme/app:1.0,acme/app", exports[0].Attrs["name"])
+	// Naming the outputs it named again changes nothing
+	require.NoError(t, NameOutputs(exports, []string{"acme/app:1.0", "acme/app"}))
+	require.Equal(t, "acme/app:1.0,acme/app", exports[0].Attrs["name"])
+
+	// An output named in --output keeps its names, deduplicated
+	exports = []client.ExportEntry{{Type: "oci", Attrs: map[string]string{"name": "acme/app,acme/app:latest"}}}
+	require.NoError(t, NameOutputs(exports, nil))
+	require.Equal(t, "acme/app", exports[0].Attrs["name"])
+	require.NoError(t, NameOutputs(exports, []string{"docker.io/acme/app:latest"}))
+	require.Error(t, NameOutputs(exports, []string{"acme/other"}))
+
+	exports = []client.ExportEntry{{Type: "local", OutputDir: "out", Attrs: map[string]string{}}}
+	require.NoError(t, NameOutputs(exports, []string{"acme/app"}))
+	require.NotContains(t, exports[0].Attrs, "name")
+}
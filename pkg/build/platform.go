@@ -0,0 +1,91 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// applyDefaultPlatform picks the platform of targets built without explicit
+// platforms: the builder's configured default platform, or else its native
+// platform.  A warning is shown when the result won't run on this machine.
+func applyDefaultPlatform(ctx context.Context, drivers []DriverInfo, clients map[string]map[string]*client.Client, m map[string][]driverPair, opt map[string]Options, pw progress.Writer) error {
+	warned := map[string]struct{}{}
+	for k, o := range opt {
+		if len(o.Platforms) != 0 || len(m[k]) != 1 {
+			continue
+		}
+		di := drivers[m[k][0].driverIndex]
+		native, err := nativePlatform(ctx, clients[di.Name])
+		if err != nil {
+			return err
+		}
+		target := native
+		if info, err := di.Driver.Info(ctx); err == nil && info.DefaultPlatform != "" {
+			pp, err := platformutil.Parse([]string{info.DefaultPlatform})
+			if err != nil {
+				return errors.Wrapf(err, "invalid default platform of builder %s", di.Name)
+			}
+			// Leave native builds alone, they don't need a platform request
+			if native == nil || platforms.Format(pp[0]) != platforms.Format(*native) {
+				m[k][0].platforms = pp
+			}
+			target = &pp[0]
+		}
+		if target == nil {
+			continue
+		}
+		local := platforms.DefaultSpec()
+		if !platformMismatch(*target, local) {
+			continue
+		}
+		ps := platforms.Format(*target)
+		if _, ok := warned[ps]; ok {
+			continue
+		}
+		warned[ps] = struct{}{}
+		progress.Write(pw, fmt.Sprintf("WARNING: building for %s which differs from this machine (%s/%s), use --platform or create the builder with --default-platform to choose the target platform", ps, local.OS, local.Architecture), func() error { return nil })
+	}
+	return nil
+}
+
+// nativePlatform returns the first platform of the builder's first worker
+func nativePlatform(ctx context.Context, clients map[string]*client.Client) (*specs.Platform, error) {
+	for _, c := range clients {
+		if c == nil {
+			continue
+		}
+		ww, err := c.ListWorkers(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing workers")
+		}
+		for _, w := range ww {
+			if len(w.Platforms) > 0 {
+				p := platforms.Normalize(w.Platforms[0])
+				return &p, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// platformMismatch reports if images for target can't run natively on the
+// local machine.  Only the architecture is compared as the OS of a desktop
+// is typically not linux while its container VM is.
+func platformMismatch(target, local specs.Platform) bool {
+	target = platforms.Normalize(target)
+	local = platforms.Normalize(local)
+	if target.Architecture != local.Architecture {
+		return true
+	}
+	// arm/v6 images still run on arm/v7 machines
+	return target.Architecture == "arm" && target.Variant > local.Variant
+}
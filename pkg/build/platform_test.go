@@ -0,0 +1,20 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_platformMismatch(t *testing.T) {
+	t.Parallel()
+	amd64 := specs.Platform{OS: "linux", Architecture: "amd64"}
+	require.False(t, platformMismatch(amd64, specs.Platform{OS: "darwin", Architecture: "amd64"}))
+	require.True(t, platformMismatch(amd64, specs.Platform{OS: "darwin", Architecture: "arm64"}))
+	require.False(t, platformMismatch(specs.Platform{OS: "linux", Architecture: "arm64"}, specs.Platform{OS: "darwin", Architecture: "arm64", Variant: "v8"}))
+	require.False(t, platformMismatch(specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+	require.True(t, platformMismatch(specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}))
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/session"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// Promoting an image copies it to another repository, typically from a
+// staging to a production registry, keeping its digest.  The layers are
+// copied by the builder: a build of each platform image of the source is
+// pushed by digest to the destination, so they never go through the client.
+// The client then pushes the original index, manifests and configs, which
+// only reference blobs present in the destination now, along with the
+// attestation manifests of the index and the referrers of the image.
+
+// platformsKey is the result metadata listing the platforms of a multi-platform result
+const platformsKey = "refs.platforms"
+
+type exportPlatform struct {
+	ID       string           `json:"id"`
+	Platform ocispec.Platform `json:"platform"`
+}
+
+// Promote copies the image src to dst with all its platforms and
+// attestations, and returns the descriptor pushed.  The source is evaluated
+// against the source policy like base images, the destination must be allowed
+// by it as is.
+func Promote(ctx context.Context, d driver.Driver, src, dst string, policy *SourcePolicy, registrySecretName, referrersMode string, pw progress.Writer) (desc ocispec.Descriptor, err error) {
+	// The solve closes the status channel once it ran
+	solved := false
+	defer func() {
+		if !solved {
+			close(pw.Status())
+		}
+		<-pw.Done()
+	}()
+	if policy != nil {
+		if src, err = policy.Evaluate(src); err != nil {
+			return desc, err
+		}
+		if err := checkDestinationPolicy(policy, dst); err != nil {
+			return desc, err
+		}
+	}
+	srcName, err := reference.ParseNormalizedNamed(src)
+	if err != nil {
+		return desc, errors.Wrapf(err, "invalid image reference %q", src)
+	}
+	dstName, err := reference.ParseNormalizedNamed(dst)
+	if err != nil {
+		return desc, errors.Wrapf(err, "invalid image reference %q", dst)
+	}
+	if _, ok := dstName.(reference.Canonical); ok {
+		return desc, errors.Errorf("the destination %s can't be a digest, it keeps the digest of the source", dst)
+	}
+	dstName = reference.TagNameOnly(dstName)
+
+	tree, err := imagetools.New(imagetools.Opt{Auth: d.GetAuthWrapper(registrySecretName)}).FetchTree(ctx, srcName.String())
+	if err != nil {
+		return desc, errors.Wrapf(err, "failed to fetch %s", src)
+	}
+
+	var treePlatforms []ocispec.Platform
+	for _, img := range tree.Images {
+		treePlatforms = append(treePlatforms, img.Platform)
+	}
+	clients, err := driver.Boot(driver.WithPlatforms(ctx, treePlatforms), d, pw)
+	if err != nil {
+		return desc, err
+	}
+	defer func() {
+		clients.ChosenNode.BuildKitClient.Close()
+		for _, n := range clients.OtherNodes {
+			n.BuildKitClient.Close()
+		}
+	}()
+	if len(tree.Images) > 0 {
+		solved = true
+		if err := pushImageLayers(ctx, clients.ChosenNode.BuildKitClient, d.GetAuthProvider(registrySecretName, os.Stderr), reference.TrimNamed(srcName), reference.TrimNamed(dstName), tree, pw); err != nil {
+			return desc, errors.Wrapf(err, "failed to copy the layers of %s", src)
+		}
+	}
+
+	// Pushes are tracked per resolver, not per registry, the source and
+	// destination registries may be the same
+	r := imagetools.New(imagetools.Opt{Auth: d.GetAuthWrapper(registrySecretName)})
+	if err := r.PushTree(ctx, dstName, tree); err != nil {
+		return desc, err
+	}
+	subjects := []ocispec.Descriptor{tree.Root}
+	for _, img := range tree.Images {
+		if img.Manifest.Digest != tree.Root.Digest {
+			subjects = append(subjects, img.Manifest)
+		}
+	}
+	for _, s := range subjects {
+		if _, err := r.CopyReferrers(ctx, srcName, dstName, s.Digest, referrersMode); err != nil {
+			return desc, errors.Wrapf(err, "failed to copy the referrers of %s", s.Digest)
+		}
+	}
+	return tree.Root, nil
+}
+
+// checkDestinationPolicy fails unless the policy allows ref without rewriting it
+func checkDestinationPolicy(policy *SourcePolicy, ref string) error {
+	evaluated, err := policy.Evaluate(ref)
+	if err != nil {
+		return errors.Wrap(err, "destination")
+	}
+	want, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return errors.Wrapf(err, "invalid image reference %q", ref)
+	}
+	if evaluated != reference.TagNameOnly(want).String() {
+		return errors.Errorf("destination %q is rewritten to %q by the source policy, promote to it directly", ref, evaluated)
+	}
+	return nil
+}
+
+// pushImageLayers builds the platform images of the tree from the source
+// manifests and pushes them to the repository of dst by digest, which pushes
+// their layers.  The configs are kept so the layers match the manifests.
+func pushImageLayers(ctx context.Context, c *client.Client, auth session.Attachable, src, dst reference.Named, tree *imagetools.ImageTree, pw progress.Writer) error {
+	so := client.SolveOpt{
+		Exports: []client.ExportEntry{{
+			Type: "image",
+			Attrs: map[string]string{
+				"name":           dst.Name(),
+				"push":           "true",
+				"push-by-digest": "true",
+			},
+		}},
+		Session: []session.Attachable{auth},
+	}
+	_, err := c.Build(ctx, so, "", func(ctx context.Context, gc gateway.Client) (*gateway.Result, error) {
+		res := gateway.NewResult()
+		var exported []exportPlatform
+		for _, img := range tree.Images {
+			ref, err := reference.WithDigest(src, img.Manifest.Digest)
+			if err != nil {
+				return nil, err
+			}
+			def, err := llb.Image(ref.String(), llb.Platform(img.Platform)).Marshal(ctx, llb.Platform(img.Platform))
+			if err != nil {
+				return nil, err
+			}
+			r, err := gc.Solve(ctx, gateway.SolveRequest{Definition: def.ToPB()})
+			if err != nil {
+				return nil, err
+			}
+			single, err := r.SingleRef()
+			if err != nil {
+				return nil, err
+			}
+			id := platforms.Format(img.Platform)
+			res.AddRef(id, single)
+			res.AddMeta(imageConfigKey+"/"+id, img.Config)
+			exported = append(exported, exportPlatform{ID: id, Platform: img.Platform})
+		}
+		dt, err := json.Marshal(struct {
+			Platforms []exportPlatform `json:"platforms"`
+		}{exported})
+		if err != nil {
+			return nil, err
+		}
+		res.AddMeta(platformsKey, dt)
+		return res, nil
+	}, pw.Status())
+	return err
+}
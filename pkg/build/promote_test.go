@@ -0,0 +1,25 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkDestinationPolicy(t *testing.T) {
+	t.Parallel()
+	policy, err := ParseSourcePolicy([]byte(`{"rules": [
+		{"action": "DENY", "selector": {"identifier": "docker-image://docker.io/*", "matchType": "WILDCARD"}},
+		{"action": "CONVERT", "selector": {"identifier": "docker-image://prod.local/legacy/*", "matchType": "WILDCARD"}, "updates": {"identifier": "docker-image://prod.local/app/$1"}}
+	]}`))
+	require.NoError(t, err)
+
+	require.NoError(t, checkDestinationPolicy(policy, "prod.local/app/web:v1"))
+	require.NoError(t, checkDestinationPolicy(policy, "prod.local/app/web"))
+	require.Error(t, checkDestinationPolicy(policy, "acme/web:v1"))
+	err = checkDestinationPolicy(policy, "prod.local/legacy/web:v1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "prod.local/app/web:v1")
+}
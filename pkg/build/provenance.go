@@ -0,0 +1,214 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
+)
+
+// The SLSA provenance of an image is put together on the client before the
+// build, from what the CLI knows of it: the git checkout and Dockerfile it is
+// built from, the frontend parameters, and the base images resolved to their
+// digest as materials.  It is attached as a custom attestation, wrapped in
+// the statement about the image digest once it is pushed.  The min mode
+// records the frontend, target and platforms, max also the build args,
+// labels and frontend options, which may carry values not meant to be
+// published with the image.
+
+const (
+	// PredicateTypeSLSAProvenance is the in-toto predicate type of the provenance
+	PredicateTypeSLSAProvenance = "https://slsa.dev/provenance/v0.2"
+	// ProvenanceBuilderID identifies the CLI as the builder of the provenance
+	ProvenanceBuilderID = "https://github.com/vmware-tanzu/buildkit-cli-for-kubectl"
+
+	ProvenanceModeMin = "min"
+	ProvenanceModeMax = "max"
+
+	provenanceBuildType = "https://mobyproject.org/buildkit@v1"
+)
+
+// ProvenanceConfigSource is the source the build was configured from
+type ProvenanceConfigSource struct {
+	URI string `json:"uri,omitempty"`
+	// Digest is the git commit of the source
+	Digest map[string]string `json:"digest,omitempty"`
+	// EntryPoint is the Dockerfile of the build
+	EntryPoint string `json:"entryPoint,omitempty"`
+}
+
+// ProvenanceMaterial is a base image of the build
+type ProvenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	Builder    provenanceBuilder    `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation provenanceInvocation `json:"invocation"`
+	Metadata   provenanceMetadata   `json:"metadata"`
+	Materials  []ProvenanceMaterial `json:"materials,omitempty"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type provenanceInvocation struct {
+	ConfigSource ProvenanceConfigSource `json:"configSource"`
+	Parameters   provenanceParameters   `json:"parameters"`
+}
+
+type provenanceParameters struct {
+	Frontend string            `json:"frontend"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+type provenanceMetadata struct {
+	BuildInvocationID string                 `json:"buildInvocationID,omitempty"`
+	BuildStartedOn    *time.Time             `json:"buildStartedOn,omitempty"`
+	Completeness      provenanceCompleteness `json:"completeness"`
+	Reproducible      bool                   `json:"reproducible"`
+}
+
+type provenanceCompleteness struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+// ProvenanceOpt is what the provenance of a build records besides its options
+type ProvenanceOpt struct {
+	// Mode is ProvenanceModeMin or ProvenanceModeMax
+	Mode   string
+	Source ProvenanceConfigSource
+	// Materials are the base images, nil if they aren't known
+	Materials []ProvenanceMaterial
+	Started   time.Time
+}
+
+// provenanceMode returns the mode attribute of a type=provenance attestation
+func provenanceMode(attrs map[string]string) (string, error) {
+	mode, ok := attrs["mode"]
+	delete(attrs, "mode")
+	if err := unexpectedAttestationKeys("type=provenance", attrs); err != nil {
+		return "", err
+	}
+	if !ok {
+		return ProvenanceModeMin, nil
+	}
+	if mode != ProvenanceModeMin && mode != ProvenanceModeMax {
+		return "", errors.Errorf("invalid provenance mode %q, use min or max", mode)
+	}
+	return mode, nil
+}
+
+// NewProvenance returns the provenance of the build of opt as a custom
+// attestation
+func NewProvenance(opt Options, p ProvenanceOpt) (imagetools.Referrer, error) {
+	pred := provenancePredicate{
+		Builder:   provenanceBuilder{ID: ProvenanceBuilderID},
+		BuildType: provenanceBuildType,
+		Invocation: provenanceInvocation{
+			ConfigSource: p.Source,
+			Parameters:   provenanceParameters{Frontend: "dockerfile.v0", Args: map[string]string{}},
+		},
+		Metadata: provenanceMetadata{
+			BuildInvocationID: opt.BuildID,
+			Completeness: provenanceCompleteness{
+				Parameters: p.Mode == ProvenanceModeMax,
+				Materials:  p.Materials != nil,
+			},
+		},
+		Materials: p.Materials,
+	}
+	if !p.Started.IsZero() {
+		started := p.Started.UTC()
+		pred.Metadata.BuildStartedOn = &started
+	}
+	args := pred.Invocation.Parameters.Args
+	if opt.FrontendImage != "" {
+		pred.Invocation.Parameters.Frontend = "gateway.v0"
+		args["source"] = opt.FrontendImage
+	}
+	if opt.Target != "" {
+		args["target"] = opt.Target
+	}
+	if len(opt.Platforms) > 0 {
+		args["platform"] = strings.Join(platformutil.Format(opt.Platforms), ",")
+	}
+	if p.Mode == ProvenanceModeMax {
+		for k, v := range opt.BuildArgs {
+			args["build-arg:"+k] = v
+		}
+		for k, v := range opt.Labels {
+			args["label:"+k] = v
+		}
+		for k, v := range opt.FrontendOpts {
+			args[k] = v
+		}
+	}
+	dt, err := json.MarshalIndent(pred, "", "  ")
+	if err != nil {
+		return imagetools.Referrer{}, err
+	}
+	return imagetools.Referrer{
+		ArtifactType: imagetools.ArtifactTypeInToto,
+		Data:         dt,
+		Annotations:  map[string]string{AnnotationPredicateType: PredicateTypeSLSAProvenance},
+	}, nil
+}
+
+// ProvenanceMaterials resolves the base images to their digest, as returned
+// by FromImages
+func ProvenanceMaterials(ctx context.Context, r imageResolver, images []string) ([]ProvenanceMaterial, error) {
+	res := []ProvenanceMaterial{}
+	for _, image := range images {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid image reference %q", image)
+		}
+		var dgst digest.Digest
+		if c, ok := named.(reference.Canonical); ok {
+			dgst = c.Digest()
+		} else {
+			_, desc, err := r.Resolve(ctx, reference.TagNameOnly(named).String())
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to resolve %s", image)
+			}
+			dgst = desc.Digest
+		}
+		uri := "pkg:docker/" + named.Name()
+		if t, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+			uri += "@" + t.Tag()
+		}
+		res = append(res, ProvenanceMaterial{
+			URI:    uri,
+			Digest: map[string]string{dgst.Algorithm().String(): dgst.Encoded()},
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].URI < res[j].URI })
+	return res, nil
+}
+
+// GitProvenanceSource returns the origin remote and commit of rev of the git
+// checkout dir
+func GitProvenanceSource(ctx context.Context, dir, rev string) (ProvenanceConfigSource, error) {
+	commit, err := gitOutput(ctx, dir, nil, nil, "rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return ProvenanceConfigSource{}, err
+	}
+	// A checkout without origin still records its commit
+	uri, _ := gitOutput(ctx, dir, nil, nil, "config", "--get", "remote.origin.url")
+	return ProvenanceConfigSource{URI: uri, Digest: map[string]string{"sha1": commit}}, nil
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+func Test_NewProvenance(t *testing.T) {
+	t.Parallel()
+	opt := Options{
+		BuildID:   "build1",
+		Target:    "release",
+		Platforms: []specs.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+		BuildArgs: map[string]string{"VERSION": "1.2"},
+		Labels:    map[string]string{"team": "platform"},
+	}
+	started := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	materials := []ProvenanceMaterial{{URI: "pkg:docker/docker.io/library/alpine@3.14", Digest: map[string]string{"sha256": "abcd"}}}
+	source := ProvenanceConfigSource{URI: "https://github.com/example/app.git", Digest: map[string]string{"sha1": "0123"}, EntryPoint: "Dockerfile"}
+
+	ref, err := NewProvenance(opt, ProvenanceOpt{Mode: ProvenanceModeMin, Source: source, Materials: materials, Started: started})
+	require.NoError(t, err)
+	assert.Equal(t, imagetools.ArtifactTypeInToto, ref.ArtifactType)
+	assert.Equal(t, PredicateTypeSLSAProvenance, ref.Annotations[AnnotationPredicateType])
+	var pred provenancePredicate
+	require.NoError(t, json.Unmarshal(ref.Data, &pred))
+	assert.Equal(t, ProvenanceBuilderID, pred.Builder.ID)
+	assert.Equal(t, source, pred.Invocation.ConfigSource)
+	assert.Equal(t, "dockerfile.v0", pred.Invocation.Parameters.Frontend)
+	assert.Equal(t, map[string]string{"target": "release", "platform": "linux/amd64,linux/arm64"}, pred.Invocation.Parameters.Args)
+	assert.Equal(t, "build1", pred.Metadata.BuildInvocationID)
+	assert.True(t, started.Equal(*pred.Metadata.BuildStartedOn))
+	assert.Equal(t, provenanceCompleteness{Materials: true}, pred.Metadata.Completeness)
+	assert.Equal(t, materials, pred.Materials)
+
+	opt.FrontendImage = "docker/dockerfile:1.4"
+	ref, err = NewProvenance(opt, ProvenanceOpt{Mode: ProvenanceModeMax})
+	require.NoError(t, err)
+	pred = provenancePredicate{}
+	require.NoError(t, json.Unmarshal(ref.Data, &pred))
+	assert.Equal(t, "gateway.v0", pred.Invocation.Parameters.Frontend)
+	assert.Equal(t, "docker/dockerfile:1.4", pred.Invocation.Parameters.Args["source"])
+	assert.Equal(t, "1.2", pred.Invocation.Parameters.Args["build-arg:VERSION"])
+	assert.Equal(t, "platform", pred.Invocation.Parameters.Args["label:team"])
+	assert.Equal(t, provenanceCompleteness{Parameters: true}, pred.Metadata.Completeness)
+	assert.Nil(t, pred.Metadata.BuildStartedOn)
+	assert.Empty(t, pred.Materials)
+}
+
+func Test_ProvenanceMaterials(t *testing.T) {
+	t.Parallel()
+	alpine := digest.FromString("alpine")
+	golang := digest.FromString("golang")
+	r := fakeResolver{"docker.io/library/alpine:latest": alpine}
+	materials, err := ProvenanceMaterials(context.Background(), r, []string{"alpine", "golang:1.16@" + golang.String()})
+	require.NoError(t, err)
+	assert.Equal(t, []ProvenanceMaterial{
+		{URI: "pkg:docker/docker.io/library/alpine@latest", Digest: map[string]string{"sha256": alpine.Encoded()}},
+		{URI: "pkg:docker/docker.io/library/golang@1.16", Digest: map[string]string{"sha256": golang.Encoded()}},
+	}, materials)
+
+	_, err = ProvenanceMaterials(context.Background(), r, []string{"busybox"})
+	assert.Error(t, err)
+}
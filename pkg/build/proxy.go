@@ -0,0 +1,40 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"strings"
+
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// RUN steps share the network of the builder pod, they get the proxies of
+// the builder as their predefined proxy args, which are kept out of the image
+// history: they only reach the allowlisted hosts through the builder's egress
+// proxy, download through the package proxy of the pod which forwards to the
+// egress or HTTP proxy, or go through the proxies the builder was created
+// with.  A --build-arg of the same name wins.
+
+// proxyArgs returns the proxy build args of the builds on the builder of info,
+// in both cases like the frontends predefine them
+func proxyArgs(info *driver.Info) map[string]string {
+	httpProxy, httpsProxy := info.HTTPProxy, info.HTTPSProxy
+	switch {
+	case info.PackageProxy != "":
+		httpProxy, httpsProxy = info.PackageProxy, info.PackageProxy
+	case info.EgressProxy != "":
+		httpProxy, httpsProxy = info.EgressProxy, info.EgressProxy
+	}
+	args := map[string]string{}
+	for k, v := range map[string]string{
+		"HTTP_PROXY":  httpProxy,
+		"HTTPS_PROXY": httpsProxy,
+		"NO_PROXY":    info.NoProxy,
+	} {
+		if v != "" {
+			args[k] = v
+			args[strings.ToLower(k)] = v
+		}
+	}
+	return args
+}
@@ -0,0 +1,32 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+func Test_proxyArgs(t *testing.T) {
+	t.Parallel()
+	require.Empty(t, proxyArgs(&driver.Info{}))
+
+	args := proxyArgs(&driver.Info{HTTPProxy: "http://proxy:3128", NoProxy: "localhost,.internal"})
+	require.Equal(t, map[string]string{
+		"HTTP_PROXY": "http://proxy:3128",
+		"http_proxy": "http://proxy:3128",
+		"NO_PROXY":   "localhost,.internal",
+		"no_proxy":   "localhost,.internal",
+	}, args)
+
+	// The package proxy of the pod forwards to the proxy of the builder
+	args = proxyArgs(&driver.Info{HTTPProxy: "http://proxy:3128", HTTPSProxy: "http://proxy:3129", PackageProxy: "http://127.0.0.1:3129"})
+	require.Equal(t, "http://127.0.0.1:3129", args["HTTP_PROXY"])
+	require.Equal(t, "http://127.0.0.1:3129", args["https_proxy"])
+
+	args = proxyArgs(&driver.Info{EgressProxy: "http://buildkit-egress:3128"})
+	require.Equal(t, "http://buildkit-egress:3128", args["HTTPS_PROXY"])
+	require.NotContains(t, args, "NO_PROXY")
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+
+	"github.com/moby/buildkit/client"
+	"golang.org/x/sync/errgroup"
+)
+
+// PruneOpt selects the build cache removed from a builder pod
+type PruneOpt struct {
+	// All removes the cache still referenced by images, not only the unused one
+	All bool
+	// KeepStorage is the size of the cache kept, most recently used first
+	KeepStorage int64
+	// Filters select the cache records, as buildctl prune --filter
+	Filters []string
+}
+
+// PruneResult is the build cache a builder pod removed
+type PruneResult struct {
+	Reclaimed int64
+	Records   int
+}
+
+// Prune removes the build cache of the pod of c selected by opt
+func Prune(ctx context.Context, c *client.Client, opt PruneOpt) (*PruneResult, error) {
+	res := &PruneResult{}
+	ch := make(chan client.UsageInfo)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		defer close(ch)
+		return c.Prune(ctx, ch, pruneOptions(opt)...)
+	})
+	eg.Go(func() error {
+		for u := range ch {
+			res.Reclaimed += u.Size
+			res.Records++
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func pruneOptions(opt PruneOpt) []client.PruneOption {
+	opts := []client.PruneOption{client.WithKeepOpt(0, opt.KeepStorage)}
+	if opt.All {
+		opts = append(opts, client.PruneAll)
+	}
+	if len(opt.Filters) > 0 {
+		opts = append(opts, client.WithFilter(opt.Filters))
+	}
+	return opts
+}
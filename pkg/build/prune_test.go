@@ -0,0 +1,25 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pruneOptions(t *testing.T) {
+	t.Parallel()
+	info := &client.PruneInfo{}
+	for _, o := range pruneOptions(PruneOpt{}) {
+		o.SetPruneOption(info)
+	}
+	require.Equal(t, &client.PruneInfo{}, info)
+
+	info = &client.PruneInfo{}
+	for _, o := range pruneOptions(PruneOpt{All: true, KeepStorage: 10 << 30, Filters: []string{"type==regular"}}) {
+		o.SetPruneOption(info)
+	}
+	require.Equal(t, &client.PruneInfo{All: true, KeepBytes: 10 << 30, Filter: []string{"type==regular"}}, info)
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+)
+
+// The pull policy of a build controls whether its base images are resolved
+// again.  Always resolves the tags of the base images on every build and
+// pulls the images that changed, missing only pulls the images that aren't
+// in the cache of the builder pod.  Never doesn't resolve the tags at all:
+// the base images are pinned on the client to the digests the cache of the
+// pod records they were pulled at, and the build fails before it starts when
+// one isn't cached.
+
+const (
+	PullAlways  = "always"
+	PullMissing = "missing"
+	PullNever   = "never"
+)
+
+// ParsePullPolicy parses always, missing or never, and the true and false of
+// the former boolean flag
+func ParsePullPolicy(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case PullAlways, "true":
+		return PullAlways, nil
+	case PullMissing, "false", "":
+		return PullMissing, nil
+	case PullNever:
+		return PullNever, nil
+	}
+	return "", errors.Errorf("invalid pull policy %q, use always, missing or never", s)
+}
+
+// imageResolveMode returns the image-resolve-mode of the dockerfile frontend
+// for the pull policy, "" for its default
+func imageResolveMode(policy string) string {
+	switch policy {
+	case PullAlways:
+		return "pull"
+	case PullNever:
+		return "local"
+	}
+	return ""
+}
+
+// pinCachedImages pins the base images of a Dockerfile to the digests the
+// records of the cache were pulled at, the most recently used one if a tag
+// was pulled at several.  It fails with all the base images not in the cache.
+func pinCachedImages(dockerfile []byte, du []*client.UsageInfo) ([]byte, error) {
+	var missing []string
+	dt, err := rewriteFromImages(dockerfile, func(image string) (string, error) {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid image reference %q", image)
+		}
+		if _, ok := named.(reference.Canonical); !ok {
+			named = reference.TagNameOnly(named)
+		}
+		cached, ok := cachedImage(du, named)
+		if !ok {
+			missing = append(missing, named.String())
+			return image, nil
+		}
+		return cached, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("base images not in the cache of the builder: %s, build with --pull=missing to pull them", strings.Join(missing, ", "))
+	}
+	return dt, nil
+}
+
+// cachedImage returns image pinned to the digest a record of the cache was
+// pulled at, images pinned already must have been pulled at their digest
+func cachedImage(du []*client.UsageInfo, image reference.Named) (string, bool) {
+	pinned, isPinned := image.(reference.Canonical)
+	tag := ""
+	if tagged, ok := image.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	var res string
+	var last *client.UsageInfo
+	for _, u := range du {
+		if !strings.HasPrefix(u.Description, "pulled from ") {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(u.Description, "pulled from "))
+		if err != nil {
+			continue
+		}
+		canonical, ok := named.(reference.Canonical)
+		if !ok {
+			continue
+		}
+		if named.Name() != image.Name() {
+			continue
+		}
+		if isPinned {
+			if canonical.Digest() == pinned.Digest() {
+				return image.String(), true
+			}
+			continue
+		}
+		if tagged, ok := named.(reference.Tagged); !ok || tagged.Tag() != tag {
+			continue
+		}
+		if last == nil || u.LastUsedAt != nil && (last.LastUsedAt == nil || u.LastUsedAt.After(*last.LastUsedAt)) {
+			last = u
+			res = image.String() + "@" + canonical.Digest().String()
+		}
+	}
+	return res, last != nil
+}
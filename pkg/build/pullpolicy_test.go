@@ -0,0 +1,78 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParsePullPolicy(t *testing.T) {
+	t.Parallel()
+	for in, expected := range map[string]string{
+		"always":  PullAlways,
+		"Always":  PullAlways,
+		"true":    PullAlways,
+		"missing": PullMissing,
+		"false":   PullMissing,
+		"":        PullMissing,
+		"never":   PullNever,
+	} {
+		policy, err := ParsePullPolicy(in)
+		require.NoError(t, err, in)
+		require.Equal(t, expected, policy, in)
+	}
+	_, err := ParsePullPolicy("sometimes")
+	require.Error(t, err)
+
+	require.Equal(t, "pull", imageResolveMode(PullAlways))
+	require.Equal(t, "", imageResolveMode(PullMissing))
+	require.Equal(t, "local", imageResolveMode(PullNever))
+}
+
+func Test_pinCachedImages(t *testing.T) {
+	t.Parallel()
+	older := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	du := []*client.UsageInfo{
+		{LastUsedAt: &older, Description: "pulled from docker.io/library/golang:1.16@sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		{LastUsedAt: &newer, Description: "pulled from docker.io/library/golang:1.16@sha256:2222222222222222222222222222222222222222222222222222222222222222"},
+		{Description: "pulled from docker.io/library/alpine:latest@sha256:3333333333333333333333333333333333333333333333333333333333333333"},
+		{Description: "pulled from registry.local/team/base@sha256:4444444444444444444444444444444444444444444444444444444444444444"},
+		{Description: "mount / from exec /bin/sh -c go build"},
+	}
+
+	dt, err := pinCachedImages([]byte(`FROM golang:1.16 AS build
+RUN go build
+FROM alpine
+COPY --from=build /app /app
+FROM registry.local/team/base:1@sha256:4444444444444444444444444444444444444444444444444444444444444444
+FROM build
+FROM scratch
+`), du)
+	require.NoError(t, err)
+	require.Equal(t, `FROM docker.io/library/golang:1.16@sha256:2222222222222222222222222222222222222222222222222222222222222222 AS build
+RUN go build
+FROM docker.io/library/alpine:latest@sha256:3333333333333333333333333333333333333333333333333333333333333333
+COPY --from=build /app /app
+FROM registry.local/team/base:1@sha256:4444444444444444444444444444444444444444444444444444444444444444
+FROM build
+FROM scratch
+`, string(dt))
+
+	// Every missing image is reported at once
+	_, err = pinCachedImages([]byte(`FROM golang:1.17
+FROM alpine:latest
+FROM registry.local/team/base@sha256:5555555555555555555555555555555555555555555555555555555555555555
+`), du)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "docker.io/library/golang:1.17, registry.local/team/base@sha256:5555555555555555555555555555555555555555555555555555555555555555")
+	require.NotContains(t, err.Error(), "alpine")
+
+	// An empty cache has none of the images
+	_, err = pinCachedImages([]byte("FROM alpine\n"), []*client.UsageInfo{})
+	require.Error(t, err)
+}
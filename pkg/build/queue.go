@@ -0,0 +1,53 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/opencontainers/go-digest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// waitForBuildSlot blocks until the builder has capacity for this build.  The
+// queue is only shown in the progress output if the build actually has to wait.
+func waitForBuildSlot(ctx context.Context, d driver.Driver, id string, priority int, pw progress.Writer) (func(), <-chan struct{}, error) {
+	if id == "" {
+		id = identity.NewID()
+	}
+	var vtx *client.Vertex
+	release, preempted, err := d.Enqueue(ctx, id, priority, func(pos int) {
+		if vtx == nil {
+			tm := time.Now()
+			vtx = &client.Vertex{
+				Digest:  digest.FromBytes([]byte(identity.NewID())),
+				Name:    "[internal] waiting for a free build slot",
+				Started: &tm,
+			}
+			pw.Status() <- &client.SolveStatus{Vertexes: []*client.Vertex{vtx}}
+		}
+		pw.Status() <- &client.SolveStatus{
+			Logs: []*client.VertexLog{{
+				Vertex:    vtx.Digest,
+				Stream:    1,
+				Data:      []byte(fmt.Sprintf("queued, position %d\n", pos)),
+				Timestamp: time.Now(),
+			}},
+		}
+	})
+	if vtx != nil {
+		tm := time.Now()
+		vtx2 := *vtx
+		vtx2.Completed = &tm
+		if err != nil {
+			vtx2.Error = err.Error()
+		}
+		pw.Status() <- &client.SolveStatus{Vertexes: []*client.Vertex{&vtx2}}
+	}
+	return release, preempted, err
+}
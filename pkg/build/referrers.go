@@ -0,0 +1,151 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// referrerTypes are shorthands for well known artifact types
+var referrerTypes = map[string]string{
+	"sbom":       imagetools.ArtifactTypeSPDX,
+	"provenance": imagetools.ArtifactTypeInToto,
+	"notation":   imagetools.ArtifactTypeNotarySignature,
+	"cosign":     imagetools.ArtifactTypeCosignSignature,
+}
+
+// ParseReferrers parses artifacts to attach to pushed images in the form
+// "type=<sbom|provenance|notation|cosign|artifact type>,file=<path>[,mediatype=<type>]"
+func ParseReferrers(in []string) ([]imagetools.Referrer, error) {
+	var refs []imagetools.Referrer
+	for _, s := range in {
+		fields, err := csv.NewReader(strings.NewReader(s)).Read()
+		if err != nil {
+			return nil, err
+		}
+		ref := imagetools.Referrer{}
+		var file string
+		for _, field := range fields {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid value %s", field)
+			}
+			switch strings.ToLower(parts[0]) {
+			case "type":
+				ref.ArtifactType = parts[1]
+				if t, ok := referrerTypes[parts[1]]; ok {
+					ref.ArtifactType = t
+				}
+			case "file":
+				file = parts[1]
+			case "mediatype":
+				ref.MediaType = parts[1]
+			default:
+				return nil, errors.Errorf("unexpected key '%s' in '%s'", parts[0], field)
+			}
+		}
+		if ref.ArtifactType == "" || file == "" {
+			return nil, errors.Errorf("invalid artifact %q, type and file are required", s)
+		}
+		ref.Data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read artifact")
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// pushedNames returns the image names pushed by the exports
+func pushedNames(exports []client.ExportEntry) []string {
+	var names []string
+	for _, e := range exports {
+		if e.Type != "image" || e.Attrs["name"] == "" {
+			continue
+		}
+		if ok, _ := strconv.ParseBool(e.Attrs["push"]); ok {
+			names = append(names, strings.Split(e.Attrs["name"], ",")...)
+		}
+	}
+	return names
+}
+
+// pushReferrers attaches the artifacts of opt to the pushed image in each
+// repository it was pushed to
+func pushReferrers(ctx context.Context, pw progress.Writer, auth imagetools.Auth, names []string, res *client.SolveResponse, opt Options) error {
+	if len(opt.Referrers) == 0 || len(names) == 0 || res == nil {
+		return nil
+	}
+	dgst := res.ExporterResponse["containerimage.digest"]
+	if dgst == "" {
+		return nil
+	}
+	repos, err := toRepoOnly(strings.Join(names, ","))
+	if err != nil {
+		return err
+	}
+	refs, err := statementReferrers(opt, dgst)
+	if err != nil {
+		return err
+	}
+	r := imagetools.New(imagetools.Opt{Auth: auth})
+	for _, repo := range strings.Split(repos, ",") {
+		progress.Write(pw, fmt.Sprintf("pushing %d referrers to %s", len(refs), repo), func() error {
+			err = func() error {
+				name, err := reference.ParseNormalizedNamed(repo + "@" + dgst)
+				if err != nil {
+					return err
+				}
+				_, subject, err := r.Resolve(ctx, name.String())
+				if err != nil {
+					return err
+				}
+				for _, ref := range refs {
+					if _, err := r.PushReferrer(ctx, name, subject, ref, opt.ReferrersMode); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statementReferrers returns the referrers of opt with the custom
+// attestations wrapped in their in-toto statement about the image dgst
+func statementReferrers(opt Options, dgst string) ([]imagetools.Referrer, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, err
+	}
+	subjects := attestationSubjects(opt, d)
+	refs := make([]imagetools.Referrer, 0, len(opt.Referrers))
+	for _, ref := range opt.Referrers {
+		if isCustomAttestation(ref) {
+			dt, err := inTotoAttestation(ref, subjects)
+			if err != nil {
+				return nil, err
+			}
+			ref.Data = dt
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
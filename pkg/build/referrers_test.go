@@ -0,0 +1,49 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+func Test_ParseReferrers(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "referrers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sbom := filepath.Join(dir, "sbom.spdx.json")
+	require.NoError(t, ioutil.WriteFile(sbom, []byte(`{"spdxVersion":"SPDX-2.3"}`), 0644))
+
+	refs, err := ParseReferrers([]string{"type=sbom,file=" + sbom, "type=application/vnd.acme.scan+json,file=" + sbom + ",mediatype=application/json"})
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	assert.Equal(t, imagetools.ArtifactTypeSPDX, refs[0].ArtifactType)
+	assert.Equal(t, []byte(`{"spdxVersion":"SPDX-2.3"}`), refs[0].Data)
+	assert.Equal(t, "application/vnd.acme.scan+json", refs[1].ArtifactType)
+	assert.Equal(t, "application/json", refs[1].MediaType)
+
+	_, err = ParseReferrers([]string{"type=sbom"})
+	assert.Error(t, err)
+	_, err = ParseReferrers([]string{"file=" + sbom})
+	assert.Error(t, err)
+	_, err = ParseReferrers([]string{"type=sbom,file=" + filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+func Test_pushedNames(t *testing.T) {
+	t.Parallel()
+	names := pushedNames([]client.ExportEntry{
+		{Type: "image", Attrs: map[string]string{"name": "acme.com/app:1.0,acme.com/app:latest", "push": "true"}},
+		{Type: "image", Attrs: map[string]string{"name": "acme.com/other:1.0"}},
+		{Type: "local", OutputDir: "out"},
+	})
+	assert.Equal(t, []string{"acme.com/app:1.0", "acme.com/app:latest"}, names)
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// maxRemoteDockerfileSize guards against fetching something that isn't a Dockerfile
+const maxRemoteDockerfileSize = 10 << 20
+
+var remoteDockerfileTimeout = 30 * time.Second
+
+// isRemoteDockerfile reports if the Dockerfile is fetched over http(s)
+func isRemoteDockerfile(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// fetchDockerfile downloads a Dockerfile into a temporary directory, verifying
+// it against checksum (e.g. sha256:<hex>) if one is given
+func fetchDockerfile(ctx context.Context, url, checksum string) (string, error) {
+	var expected digest.Digest
+	if checksum != "" {
+		var err error
+		if expected, err = digest.Parse(checksum); err != nil {
+			return "", errors.Wrapf(err, "invalid Dockerfile checksum %q", checksum)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteDockerfileTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to fetch Dockerfile")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to fetch Dockerfile %s: %s", url, resp.Status)
+	}
+	dt, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteDockerfileSize+1))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to fetch Dockerfile")
+	}
+	if len(dt) > maxRemoteDockerfileSize {
+		return "", errors.Errorf("Dockerfile %s is larger than %d bytes", url, maxRemoteDockerfileSize)
+	}
+	if expected != "" {
+		if actual := expected.Algorithm().FromBytes(dt); actual != expected {
+			return "", errors.Errorf("Dockerfile %s has checksum %s, expected %s", url, actual, expected)
+		}
+	}
+	return createTempDockerfile(bytes.NewReader(dt))
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fetchDockerfile(t *testing.T) {
+	t.Parallel()
+	const dockerfile = "FROM busybox\nRUN true\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Dockerfile" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(dockerfile))
+	}))
+	defer srv.Close()
+
+	dir, err := fetchDockerfile(context.Background(), srv.URL+"/Dockerfile", digest.FromString(dockerfile).String())
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dt, err := ioutil.ReadFile(filepath.Join(dir, "Dockerfile"))
+	require.NoError(t, err)
+	require.Equal(t, dockerfile, string(dt))
+
+	_, err = fetchDockerfile(context.Background(), srv.URL+"/Dockerfile", digest.FromString("FROM alpine").String())
+	require.Error(t, err)
+	_, err = fetchDockerfile(context.Background(), srv.URL+"/missing", "")
+	require.Error(t, err)
+
+	so := &client.SolveOpt{FrontendAttrs: map[string]string{}, LocalDirs: map[string]string{}}
+	release, err := LoadInputs(Inputs{ContextPath: "https://github.com/acme/app.git", DockerfilePath: srv.URL + "/Dockerfile"}, so)
+	require.NoError(t, err)
+	defer release()
+	require.Equal(t, "dockerfile", so.FrontendAttrs["dockerfilekey"])
+	require.Equal(t, "Dockerfile", so.FrontendAttrs["filename"])
+	require.NotEmpty(t, so.LocalDirs["dockerfile"])
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// The build report is a short summary of a build for CI to post as a pull
+// request comment, put together on the client from what the build already
+// reported: the image and its digest, the steps served from the cache, the
+// Dockerfile check findings, and for pushed images the size of the image in
+// the registry compared with the image the tag pointed at before.
+
+// ReportOutputMarkdown is the markdown build report
+const ReportOutputMarkdown = "markdown"
+
+// BuildReport summarizes a build
+type BuildReport struct {
+	// Image is the first tag of the image, empty if it has none
+	Image  string
+	Digest string
+	// Error is why the build failed, empty if it succeeded
+	Error    string
+	Duration time.Duration
+	// Steps are the build steps run, of which CachedSteps were cache hits
+	Steps       int
+	CachedSteps int
+	// Size is the compressed size of the pushed image, 0 if unknown
+	Size int64
+	// PreviousSize is the size of the image previously tagged, 0 if unknown
+	PreviousSize int64
+	// Findings are the Dockerfile check results, nil if the checks didn't run
+	Findings []CheckResult
+}
+
+// ParseReportOutputs parses "format=filename" build report destinations
+func ParseReportOutputs(in []string) (map[string]string, error) {
+	res := make(map[string]string, len(in))
+	for _, s := range in {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("invalid report %q, expected format=filename", s)
+		}
+		if parts[0] != ReportOutputMarkdown {
+			return nil, errors.Errorf("unsupported report format %q, use markdown", parts[0])
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// AddSteps counts the completed steps of the build graph and its cache hits,
+// the internal steps of the CLI aside
+func (r *BuildReport) AddSteps(vertexes []progress.GraphVertex) {
+	for _, v := range vertexes {
+		if v.Completed == nil || strings.HasPrefix(v.Name, "[internal]") {
+			continue
+		}
+		r.Steps++
+		if v.Cached {
+			r.CachedSteps++
+		}
+	}
+}
+
+// WriteMarkdown writes the report as a markdown table
+func (r *BuildReport) WriteMarkdown(w io.Writer) error {
+	status := "succeeded"
+	if r.Error != "" {
+		status = "failed"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Build %s\n\n", status)
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	if r.Image != "" {
+		fmt.Fprintf(&b, "| Image | `%s` |\n", r.Image)
+	}
+	if r.Digest != "" {
+		fmt.Fprintf(&b, "| Digest | `%s` |\n", r.Digest)
+	}
+	if r.Size > 0 {
+		size := FormatBytes(r.Size)
+		if r.PreviousSize > 0 {
+			size += " (" + formatSizeDelta(r.Size-r.PreviousSize) + ")"
+		}
+		fmt.Fprintf(&b, "| Size | %s |\n", size)
+	}
+	if r.Steps > 0 {
+		fmt.Fprintf(&b, "| Cache | %d of %d steps cached (%d%%) |\n", r.CachedSteps, r.Steps, r.CachedSteps*100/r.Steps)
+	}
+	fmt.Fprintf(&b, "| Duration | %s |\n", r.Duration.Round(time.Second))
+	if r.Findings != nil {
+		fmt.Fprintf(&b, "| Dockerfile checks | %s |\n", findingsSummary(r.Findings))
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "\n```\n%s\n```\n", r.Error)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatSizeDelta(delta int64) string {
+	switch {
+	case delta > 0:
+		return "+" + FormatBytes(delta)
+	case delta < 0:
+		return "-" + FormatBytes(-delta)
+	}
+	return "unchanged"
+}
+
+// findingsSummary counts the findings by rule
+func findingsSummary(findings []CheckResult) string {
+	if len(findings) == 0 {
+		return "no findings"
+	}
+	var rules []string
+	counts := map[string]int{}
+	for _, f := range findings {
+		if counts[f.Rule] == 0 {
+			rules = append(rules, f.Rule)
+		}
+		counts[f.Rule]++
+	}
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = fmt.Sprintf("%s (%d)", rule, counts[rule])
+	}
+	noun := "findings"
+	if len(findings) == 1 {
+		noun = "finding"
+	}
+	return fmt.Sprintf("%d %s: %s", len(findings), noun, strings.Join(parts, ", "))
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+func Test_ParseReportOutputs(t *testing.T) {
+	t.Parallel()
+	outputs, err := ParseReportOutputs([]string{"markdown=report.md"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"markdown": "report.md"}, outputs)
+	_, err = ParseReportOutputs([]string{"markdown="})
+	require.Error(t, err)
+	_, err = ParseReportOutputs([]string{"html=report.html"})
+	require.Error(t, err)
+}
+
+func Test_BuildReport(t *testing.T) {
+	t.Parallel()
+	done := time.Now()
+	r := &BuildReport{
+		Image:        "registry.local/app:pr-12",
+		Digest:       "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		Duration:     83*time.Second + 400*time.Millisecond,
+		Size:         3 << 20,
+		PreviousSize: 2 << 20,
+		Findings:     []CheckResult{{Rule: "NoLatestTag"}, {Rule: "NoLatestTag"}, {Rule: "NoAddURL"}},
+	}
+	r.AddSteps([]progress.GraphVertex{
+		{Name: "[internal] load build context", Completed: &done},
+		{Name: "[1/3] FROM alpine", Completed: &done, Cached: true},
+		{Name: "[2/3] RUN make", Completed: &done, Cached: true},
+		{Name: "[3/3] COPY . .", Completed: &done},
+		{Name: "[4/4] RUN never completed"},
+	})
+	require.Equal(t, 3, r.Steps)
+	require.Equal(t, 2, r.CachedSteps)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.WriteMarkdown(buf))
+	require.Equal(t, "### Build succeeded\n\n"+
+		"| | |\n|---|---|\n"+
+		"| Image | `registry.local/app:pr-12` |\n"+
+		"| Digest | `sha256:1111111111111111111111111111111111111111111111111111111111111111` |\n"+
+		"| Size | "+FormatBytes(3<<20)+" (+"+FormatBytes(1<<20)+") |\n"+
+		"| Cache | 2 of 3 steps cached (66%) |\n"+
+		"| Duration | 1m23s |\n"+
+		"| Dockerfile checks | 3 findings: NoLatestTag (2), NoAddURL (1) |\n", buf.String())
+
+	failed := &BuildReport{Error: "process \"/bin/sh -c make\" did not complete successfully", Findings: []CheckResult{}}
+	buf.Reset()
+	require.NoError(t, failed.WriteMarkdown(buf))
+	require.Contains(t, buf.String(), "### Build failed")
+	require.Contains(t, buf.String(), "| Dockerfile checks | no findings |")
+	require.Contains(t, buf.String(), "```\nprocess \"/bin/sh -c make\" did not complete successfully\n```")
+	require.NotContains(t, buf.String(), "| Size |")
+}
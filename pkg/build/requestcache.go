@@ -0,0 +1,234 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Most images of a monorepo are unchanged by a commit, yet CI rebuilds all
+// of them, and even a fully cached solve uploads the context and re-exports the
+// image.  The request of a pushed build, its context files, Dockerfile and
+// options, is hashed and recorded on the client with the digest pushed.  An
+// identical request is skipped while the tags still point at that digest.
+// Base images are resolved by the builder, pin them with --lock or a source
+// policy for identical requests to mean identical images.
+
+// unchangedRequest is what identifies the result of a build
+type unchangedRequest struct {
+	Context         digest.Digest     `json:"context"`
+	Dockerfile      digest.Digest     `json:"dockerfile,omitempty"`
+	DockerfileURL   string            `json:"dockerfileURL,omitempty"`
+	DockerfileSum   string            `json:"dockerfileSum,omitempty"`
+	Tags            []string          `json:"tags"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	BuildArgs       map[string]string `json:"buildArgs,omitempty"`
+	Target          string            `json:"target,omitempty"`
+	Platforms       []string          `json:"platforms,omitempty"`
+	Exports         []string          `json:"exports"`
+	ExtraHosts      []string          `json:"extraHosts,omitempty"`
+	NetworkMode     string            `json:"networkMode,omitempty"`
+	FrontendImage   string            `json:"frontendImage,omitempty"`
+	FrontendOpts    map[string]string `json:"frontendOpts,omitempty"`
+	Lockfile        *Lockfile         `json:"lockfile,omitempty"`
+	SourcePolicy    *SourcePolicy     `json:"sourcePolicy,omitempty"`
+	Squash          bool              `json:"squash,omitempty"`
+	HostMounts      []HostMount       `json:"hostMounts,omitempty"`
+	Referrers       []string          `json:"referrers,omitempty"`
+	RunCacheProject string            `json:"runCacheProject,omitempty"`
+}
+
+// UnchangedBuild records the images pushed by a build request
+type UnchangedBuild struct {
+	Request digest.Digest `json:"request"`
+	Time    time.Time     `json:"time"`
+	// Images are the digests pushed, by tag
+	Images map[string]digest.Digest `json:"images"`
+}
+
+// RequestDigest hashes the build request of the targets, the local context
+// and Dockerfile of each are hashed with their content
+func RequestDigest(opts map[string]Options) (digest.Digest, error) {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	contexts := map[string]digest.Digest{}
+	h := sha256.New()
+	for _, name := range names {
+		opt := opts[name]
+		dir := opt.Inputs.ContextPath
+		if _, ok := contexts[dir]; !ok {
+			dgst, err := ContextDigest(dir)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to hash build context %s", dir)
+			}
+			contexts[dir] = dgst
+		}
+		req := unchangedRequest{
+			Context:         contexts[dir],
+			DockerfileSum:   opt.Inputs.DockerfileChecksum,
+			Tags:            opt.Tags,
+			Labels:          opt.Labels,
+			BuildArgs:       opt.BuildArgs,
+			Target:          opt.Target,
+			ExtraHosts:      opt.ExtraHosts,
+			NetworkMode:     opt.NetworkMode,
+			FrontendImage:   opt.FrontendImage,
+			FrontendOpts:    opt.FrontendOpts,
+			Lockfile:        opt.Inputs.Lockfile,
+			SourcePolicy:    opt.Inputs.SourcePolicy,
+			Squash:          opt.Squash,
+			HostMounts:      opt.HostMounts,
+			RunCacheProject: opt.RunCacheProject,
+		}
+		switch {
+		case opt.Inputs.DockerfileInline != "":
+			req.Dockerfile = digest.FromString(opt.Inputs.DockerfileInline)
+		case isRemoteDockerfile(opt.Inputs.DockerfilePath):
+			// Only pinned by its checksum
+			req.DockerfileURL = opt.Inputs.DockerfilePath
+		default:
+			path := opt.Inputs.DockerfilePath
+			if path == "" {
+				path = filepath.Join(dir, "Dockerfile")
+			}
+			dt, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", errors.Wrap(err, "failed to read the Dockerfile")
+			}
+			req.Dockerfile = digest.FromBytes(dt)
+		}
+		for _, p := range opt.Platforms {
+			req.Platforms = append(req.Platforms, platforms.Format(p))
+		}
+		for _, e := range opt.Exports {
+			req.Exports = append(req.Exports, csvAttrs(e.Type, e.Attrs))
+		}
+		for _, r := range opt.Referrers {
+			req.Referrers = append(req.Referrers, r.ArtifactType+"="+digest.FromBytes(r.Data).String())
+		}
+		dt, err := json.Marshal(req)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", name, dt)
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// ContextDigest hashes the paths, modes and contents of the files of the
+// local build context dir sent to the builder
+func ContextDigest(dir string) (digest.Digest, error) {
+	dir = longPath(dir)
+	h := sha256.New()
+	err := walkContext(dir, func(rel string, fi os.FileInfo) error {
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, fi.Mode())
+		switch {
+		case fi.Mode().IsRegular():
+			f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fh := sha256.New()
+			if _, err := io.Copy(fh, f); err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%x\x00", fh.Sum(nil))
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filepath.Join(dir, filepath.FromSlash(rel)))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// LoadUnchangedBuild returns the build of the request recorded under dir
+// within maxAge, nil if there is none
+func LoadUnchangedBuild(dir string, request digest.Digest, maxAge time.Duration, now time.Time) (*UnchangedBuild, error) {
+	dt, err := ioutil.ReadFile(unchangedBuildFile(dir, request))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var b UnchangedBuild
+	if err := json.Unmarshal(dt, &b); err != nil {
+		// Rebuilt and overwritten
+		return nil, nil
+	}
+	if b.Request != request || (maxAge > 0 && now.Sub(b.Time) > maxAge) {
+		return nil, nil
+	}
+	return &b, nil
+}
+
+// SaveUnchangedBuild records the build under dir
+func SaveUnchangedBuild(dir string, b *UnchangedBuild) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dt, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	// Concurrent builds of the same request write the same record
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(dt); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), unchangedBuildFile(dir, b.Request))
+}
+
+// Current reports if every tag of the build still resolves to the digest it
+// pushed, if one was moved the build must run again
+func (b *UnchangedBuild) Current(ctx context.Context, r imageResolver) (bool, error) {
+	if len(b.Images) == 0 {
+		return false, nil
+	}
+	for tag, dgst := range b.Images {
+		_, desc, err := r.Resolve(ctx, tag)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to resolve %s", tag)
+		}
+		if desc.Digest != dgst {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func unchangedBuildFile(dir string, request digest.Digest) string {
+	return filepath.Join(dir, request.Encoded()+".json")
+}
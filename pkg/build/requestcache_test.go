@@ -0,0 +1,108 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestDigest(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "context")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeContextFiles(t, dir, map[string]int{
+		"Dockerfile":  10,
+		"src/main.go": 100,
+		"build/out":   100,
+	})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("build\n"), 0644))
+	opts := func() map[string]Options {
+		return map[string]Options{"default": {
+			Inputs:    Inputs{ContextPath: dir},
+			Tags:      []string{"registry.example.com/app:v1"},
+			BuildArgs: map[string]string{"VERSION": "1"},
+		}}
+	}
+
+	base, err := RequestDigest(opts())
+	require.NoError(t, err)
+	same, err := RequestDigest(opts())
+	require.NoError(t, err)
+	require.Equal(t, base, same)
+
+	// Ignored files are not sent
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "build", "out"), []byte("changed"), 0644))
+	dgst, err := RequestDigest(opts())
+	require.NoError(t, err)
+	require.Equal(t, base, dgst)
+
+	changed := opts()
+	o := changed["default"]
+	o.BuildArgs = map[string]string{"VERSION": "2"}
+	changed["default"] = o
+	dgst, err = RequestDigest(changed)
+	require.NoError(t, err)
+	require.NotEqual(t, base, dgst)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main"), 0644))
+	dgst, err = RequestDigest(opts())
+	require.NoError(t, err)
+	require.NotEqual(t, base, dgst)
+	base = dgst
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch"), 0644))
+	dgst, err = RequestDigest(opts())
+	require.NoError(t, err)
+	require.NotEqual(t, base, dgst)
+}
+
+type staticResolver map[string]digest.Digest
+
+func (r staticResolver) Resolve(ctx context.Context, in string) (string, ocispec.Descriptor, error) {
+	return in, ocispec.Descriptor{Digest: r[in]}, nil
+}
+
+func Test_UnchangedBuild(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "requests")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	request := digest.FromString("request")
+	image := digest.FromString("image")
+
+	b, err := LoadUnchangedBuild(dir, request, time.Hour, now)
+	require.NoError(t, err)
+	require.Nil(t, b)
+
+	require.NoError(t, SaveUnchangedBuild(dir, &UnchangedBuild{
+		Request: request,
+		Time:    now.Add(-time.Minute),
+		Images:  map[string]digest.Digest{"registry.example.com/app:v1": image},
+	}))
+	b, err = LoadUnchangedBuild(dir, request, time.Hour, now)
+	require.NoError(t, err)
+	require.NotNil(t, b)
+	require.Equal(t, image, b.Images["registry.example.com/app:v1"])
+
+	b2, err := LoadUnchangedBuild(dir, request, time.Hour, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Nil(t, b2, "expired")
+
+	current, err := b.Current(context.Background(), staticResolver{"registry.example.com/app:v1": image})
+	require.NoError(t, err)
+	require.True(t, current)
+	current, err = b.Current(context.Background(), staticResolver{"registry.example.com/app:v1": digest.FromString("other")})
+	require.NoError(t, err)
+	require.False(t, current, "the tag was moved")
+}
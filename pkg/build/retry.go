@@ -0,0 +1,71 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"strings"
+	"time"
+)
+
+// Registries and their DNS fail momentarily, while the failures of a build
+// are otherwise final.  A build failing to fetch its sources with one of
+// the transient errors is worth running again, the steps already built are
+// cached by the builder.
+
+// transientPullErrors are the messages of registry and network failures
+// expected to go away
+var transientPullErrors = []string{
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"429 too many requests",
+	"i/o timeout",
+	"tls handshake timeout",
+	"connection reset by peer",
+	"connection refused",
+	"no such host",
+	"temporary failure in name resolution",
+	"unexpected eof",
+}
+
+// finalPullErrors are failures trying again doesn't fix, or that come from
+// the build itself rather than fetching its sources
+var finalPullErrors = []string{
+	"not found",
+	"manifest unknown",
+	"401 unauthorized",
+	"403 forbidden",
+	"denied",
+	"executor failed running",
+	"did not complete successfully",
+}
+
+// IsTransientPullError reports whether the build failed to fetch its base
+// images or other sources with an error expected to go away
+func IsTransientPullError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range finalPullErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+	for _, s := range transientPullErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PullRetryDelay is the backoff before retry attempt n (from 1) of a build
+func PullRetryDelay(base time.Duration, n int) time.Duration {
+	delay := base
+	for i := 1; i < n && delay < 10*time.Minute; i++ {
+		delay *= 2
+	}
+	return delay
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_IsTransientPullError(t *testing.T) {
+	t.Parallel()
+	for _, msg := range []string{
+		`failed to solve: rpc error: code = Unknown desc = failed to load cache key: failed to do request: Head "https://registry-1.docker.io/v2/library/alpine/manifests/3.13": dial tcp: lookup registry-1.docker.io: no such host`,
+		`failed to solve: rpc error: code = Unknown desc = failed to resolve source metadata for docker.io/library/alpine:3.13: unexpected status code [manifests 3.13]: 503 Service Unavailable`,
+		`failed to copy: httpReadSeeker: failed open: failed to do request: read tcp 10.0.0.2:41234->1.2.3.4:443: read: connection reset by peer`,
+	} {
+		require.True(t, IsTransientPullError(errors.New(msg)), msg)
+	}
+	for _, msg := range []string{
+		`failed to solve: rpc error: code = Unknown desc = failed to load cache key: docker.io/library/alpine:nope: not found`,
+		`failed to solve: rpc error: code = Unknown desc = failed to authorize: failed to fetch anonymous token: unexpected status: 401 Unauthorized`,
+		`failed to solve: rpc error: code = Unknown desc = executor failed running [/bin/sh -c curl https://example.com]: exit code: 22: 503 Service Unavailable`,
+		`failed to solve: rpc error: code = Unknown desc = failed to read dockerfile: open Dockerfile: no such file or directory`,
+	} {
+		require.False(t, IsTransientPullError(errors.New(msg)), msg)
+	}
+	require.False(t, IsTransientPullError(nil))
+}
+
+func Test_PullRetryDelay(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, 5*time.Second, PullRetryDelay(5*time.Second, 1))
+	require.Equal(t, 20*time.Second, PullRetryDelay(5*time.Second, 3))
+	require.Equal(t, 640*time.Second, PullRetryDelay(5*time.Second, 20))
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// RUN cache mounts live in the snapshotter of a builder pod and are lost when
+// the pod restarts.  Builders created with a run cache claim persist them: an
+// empty cache mount is seeded from the volume before the build, and copied
+// back to the volume after a successful build.  Replicas sharing the volume
+// overwrite each other's copy, the last successful build wins.
+
+// cacheMountNSArg namespaces the cache mount IDs of the dockerfile frontend
+const cacheMountNSArg = "BUILDKIT_CACHE_MOUNT_NS"
+
+// runCacheScopeProject keeps the persisted cache mounts of projects apart
+const runCacheScopeProject = "project"
+
+var (
+	mountFlagRe      = regexp.MustCompile(`--mount=(\S+)`)
+	runCacheUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// runCache is the set of RUN cache mounts of a build to persist
+type runCache struct {
+	// dir of the cache mounts in the persistent volume
+	dir   string
+	ids   []string
+	image string
+}
+
+// cacheMountIDs lists the IDs of the cache mounts of the RUN instructions of
+// a Dockerfile, as the dockerfile frontend names them.  Mounts using build
+// args can't be resolved and are skipped, as are mounts with an owner or mode
+// which the frontend keys by their initial content as well.
+func cacheMountIDs(dockerfile []byte, namespace string) []string {
+	var ids []string
+	seen := map[string]struct{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(strings.ToUpper(line), "RUN") && !strings.HasPrefix(line, "--mount=") {
+			continue
+		}
+		for _, m := range mountFlagRe.FindAllStringSubmatch(line, -1) {
+			fields, err := csv.NewReader(strings.NewReader(m[1])).Read()
+			if err != nil {
+				continue
+			}
+			var typ, id, target string
+			owned := false
+			for _, field := range fields {
+				parts := strings.SplitN(field, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				switch strings.ToLower(parts[0]) {
+				case "type":
+					typ = parts[1]
+				case "id":
+					id = parts[1]
+				case "target", "dst", "destination":
+					target = parts[1]
+				case "uid", "gid", "mode":
+					owned = true
+				}
+			}
+			if typ != "cache" || owned {
+				continue
+			}
+			if id == "" {
+				if !path.IsAbs(target) {
+					continue
+				}
+				id = path.Clean(target)
+			}
+			if strings.Contains(id, "$") {
+				continue
+			}
+			id = namespace + "/" + id
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// runCacheDir is the directory of a cache mount in the persistent volume
+func runCacheDir(root, id string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	name := strings.Trim(runCacheUnsafeRe.ReplaceAllString(id, "_"), "_.")
+	return fmt.Sprintf("%s/%s-%08x", root, name, h.Sum32())
+}
+
+// runCacheProject is the project used with the project scope, the base name of
+// the build context unless set
+func runCacheProject(opt Options, so client.SolveOpt) string {
+	if opt.RunCacheProject != "" {
+		return opt.RunCacheProject
+	}
+	if dir, ok := so.LocalDirs["context"]; ok {
+		if abs, err := filepath.Abs(dir); err == nil {
+			return filepath.Base(abs)
+		}
+	}
+	url := strings.SplitN(so.FrontendAttrs["context"], "#", 2)[0]
+	return strings.TrimSuffix(path.Base(url), ".git")
+}
+
+// newRunCache finds the cache mounts of the build if the builder persists them.
+// With the project scope the cache mount IDs are namespaced by project, so
+// projects using the same IDs don't share cache mounts on the builder either.
+func newRunCache(info *driver.Info, opt Options, so *client.SolveOpt) (*runCache, error) {
+	if info.RunCacheScope == "" {
+		return nil, nil
+	}
+	dir, ok := so.LocalDirs["dockerfile"]
+	if !ok {
+		return nil, nil
+	}
+	filename := so.FrontendAttrs["filename"]
+	if filename == "" {
+		filename = "Dockerfile"
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		return nil, nil
+	}
+	root := info.RunCacheDir
+	key := "build-arg:" + cacheMountNSArg
+	if info.RunCacheScope == runCacheScopeProject {
+		project := runCacheProject(opt, *so)
+		root = runCacheDir(root, project)
+		if _, ok := so.FrontendAttrs[key]; !ok {
+			so.FrontendAttrs[key] = project
+		}
+	}
+	ids := cacheMountIDs(dt, so.FrontendAttrs[key])
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return &runCache{dir: root, ids: ids, image: info.RunCacheImage}, nil
+}
+
+// restore seeds the empty cache mounts from the persistent volume.  Cache
+// mounts already populated on the builder are at least as recent.
+func (rc *runCache) restore(ctx context.Context, d driver.Driver, node string, platform *specs.Platform) error {
+	for _, id := range rc.ids {
+		dir := runCacheDir(rc.dir, id)
+		run := llb.Image(rc.image).Run(
+			llb.Args([]string{"sh", "-c", `[ -n "$(ls -A /cache)" ] || cp -a /src/. /cache/`}),
+			llb.IgnoreCache,
+			llb.WithCustomNamef("[internal] restoring cache mount %s", id),
+		)
+		run.AddMount("/src", llb.Local("src", llb.SharedKeyHint(dir)), llb.Readonly)
+		run.AddMount("/cache", llb.Scratch(), llb.AsPersistentCacheDir(id, llb.CacheMountShared))
+		script := fmt.Sprintf("mkdir -p %[1]s && buildctl build --progress=plain --local src=%[1]s", dir)
+		if err := solveInPod(ctx, d, node, run.Root(), platform, script); err != nil {
+			return errors.Wrapf(err, "failed to restore cache mount %s", id)
+		}
+	}
+	return nil
+}
+
+// save replaces the copy of the cache mounts in the persistent volume
+func (rc *runCache) save(ctx context.Context, d driver.Driver, node string, platform *specs.Platform) error {
+	for _, id := range rc.ids {
+		dir := runCacheDir(rc.dir, id)
+		run := llb.Image(rc.image).Run(
+			llb.Args([]string{"sh", "-c", "cp -a /cache/. /out/"}),
+			llb.IgnoreCache,
+			llb.WithCustomNamef("[internal] saving cache mount %s", id),
+		)
+		run.AddMount("/cache", llb.Scratch(), llb.AsPersistentCacheDir(id, llb.CacheMountShared), llb.Readonly)
+		out := run.AddMount("/out", llb.Scratch())
+		// Export next to the old copy and swap, so a failed save leaves it intact
+		script := fmt.Sprintf("tmp=%[1]s.$$ && buildctl build --progress=plain --output type=local,dest=$tmp && rm -rf %[1]s && mv $tmp %[1]s || { rm -rf $tmp; exit 1; }", dir)
+		if err := solveInPod(ctx, d, node, out, platform, script); err != nil {
+			return errors.Wrapf(err, "failed to save cache mount %s", id)
+		}
+	}
+	return nil
+}
+
+// solveInPod solves st with buildctl in the builder pod for the volumes which
+// aren't reachable from the client, script runs buildctl reading st from stdin
+func solveInPod(ctx context.Context, d driver.Driver, node string, st llb.State, platform *specs.Platform, script string) error {
+	var opts []llb.ConstraintsOpt
+	if platform != nil {
+		opts = append(opts, llb.Platform(*platform))
+	}
+	def, err := st.Marshal(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := llb.WriteTo(def, &buf); err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	if err := d.Exec(ctx, node, []string{"sh", "-c", script}, &buf, nil, &stderr); err != nil {
+		return errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeRunCache runs f as a progress step of pw
+func writeRunCache(pw progress.Writer, name string, f func() error) error {
+	var err error
+	progress.Write(pw, name, func() error {
+		err = f()
+		return err
+	})
+	return err
+}
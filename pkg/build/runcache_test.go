@@ -0,0 +1,39 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cacheMountIDs(t *testing.T) {
+	t.Parallel()
+	dockerfile := `FROM golang
+RUN --mount=type=cache,target=/root/.cache/go-build \
+    --mount=type=cache,id=gomod,target=/go/pkg/mod go build ./...
+RUN --mount=type=bind,target=/src --mount=type=cache,target=/root/.cache/go-build/ go test ./...
+RUN --mount=type=cache,target=/root/.npm,uid=1000 npm ci
+RUN --mount=type=cache,id=$CACHE,target=/cache true
+run --mount=target=/var/cache/apt,type=cache apt-get update
+`
+	require.Equal(t, []string{"//root/.cache/go-build", "/gomod", "//var/cache/apt"}, cacheMountIDs([]byte(dockerfile), ""))
+	require.Equal(t, []string{"app//gomod"}, cacheMountIDs([]byte("RUN --mount=type=cache,id=/gomod,target=/go true"), "app"))
+}
+
+func Test_runCacheDir(t *testing.T) {
+	t.Parallel()
+	dir := runCacheDir("/var/lib/run-cache", "/root/.cache/go-build")
+	require.True(t, strings.HasPrefix(dir, "/var/lib/run-cache/root_.cache_go-build-"))
+	require.NotEqual(t, dir, runCacheDir("/var/lib/run-cache", "/root/.cache_go-build"))
+}
+
+func Test_runCacheProject(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "app", runCacheProject(Options{}, client.SolveOpt{LocalDirs: map[string]string{"context": "/src/app/"}}))
+	require.Equal(t, "repo", runCacheProject(Options{}, client.SolveOpt{FrontendAttrs: map[string]string{"context": "https://github.com/org/repo.git#main"}}))
+	require.Equal(t, "other", runCacheProject(Options{RunCacheProject: "other"}, client.SolveOpt{}))
+}
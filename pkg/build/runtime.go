@@ -0,0 +1,78 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/containerd/containerd"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"google.golang.org/grpc"
+)
+
+// RuntimeVersion returns the version of the container runtime of the node
+// of the builder pod node, reached through the runtime socket of the pod like
+// the images loaded into the runtime
+func RuntimeVersion(ctx context.Context, d driver.Driver, node, runtime string) (string, error) {
+	switch runtime {
+	case "containerd":
+		c, err := containerd.New(node,
+			containerd.WithDefaultNamespace("k8s.io"),
+			containerd.WithDialOpts([]grpc.DialOption{
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return d.RuntimeSockProxy(ctx, node)
+				}),
+				grpc.WithInsecure(), // Nested connection on an existing secure transport
+			}),
+		)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		v, err := c.Version(ctx)
+		if err != nil {
+			return "", err
+		}
+		return "containerd " + v.Version, nil
+	case "docker":
+		c, err := dockerclient.NewClientWithOpts(
+			dockerclient.WithAPIVersionNegotiation(),
+			dockerclient.WithHTTPClient(&http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.RuntimeSockProxy(ctx, node)
+				},
+			}}),
+			dockerclient.WithHost("http://"+node),
+		)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		v, err := c.ServerVersion(ctx)
+		if err != nil {
+			return "", err
+		}
+		return "docker " + v.Version, nil
+	}
+	return "", errors.Errorf("unknown container runtime %q", runtime)
+}
+
+// loadNodes are the pods of nodes images are loaded into runtime through,
+// the pods on the nodes of the other runtimes of a builder mixing runtimes
+// are skipped
+func loadNodes(nodes []driver.Node, runtime string) []string {
+	var res []string
+	for _, node := range nodes {
+		if node.Runtime != "" && node.Runtime != runtime {
+			logrus.Warnf("image not loaded on pod %s, its node runs %s, push the image to a registry to run it there", node.Name, node.Runtime)
+			continue
+		}
+		res = append(res, node.Name)
+	}
+	return res
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// The SBOM of an image is generated once it is pushed, by a second build on
+// the same builder scanning the image by digest with a generator image of the
+// BuildKit scanner protocol, as buildx uses: the generator entrypoint runs
+// with the image mounted at BUILDKIT_SCAN_SOURCE and writes SPDX in-toto
+// statements to BUILDKIT_SCAN_DESTINATION.  The statements are exported to
+// the client and their SBOMs attached to the image like --attach type=sbom.
+// A multi-platform image is scanned for each of its platforms, and all its
+// SBOMs are attached to its index.
+
+// DefaultSBOMGenerator is the syft scanner image buildx defaults to
+const DefaultSBOMGenerator = "docker.io/docker/buildkit-syft-scanner:stable-1"
+
+const (
+	sbomScanSource      = "/run/src/core"
+	sbomScanDestination = "/run/out"
+)
+
+// SBOMScanOptions returns the options of the build running the entrypoint of
+// the generator on image for each of the platforms, exporting the SBOMs to dir
+func SBOMScanOptions(image, generator string, entrypoint []string, platforms []specs.Platform, dir string) (Options, error) {
+	if len(entrypoint) == 0 {
+		return Options{}, errors.Errorf("SBOM generator %s has no entrypoint", generator)
+	}
+	cmd, err := json.Marshal(entrypoint)
+	if err != nil {
+		return Options{}, err
+	}
+	dockerfile := fmt.Sprintf(`FROM %s AS image
+FROM --platform=$BUILDPLATFORM %s AS scanner
+ENV BUILDKIT_SCAN_SOURCE=%s BUILDKIT_SCAN_DESTINATION=%s
+WORKDIR %[4]s
+RUN --mount=type=bind,from=image,target=%[3]s %[5]s
+
+FROM scratch
+COPY --from=scanner %[4]s /
+`, image, generator, sbomScanSource, sbomScanDestination, cmd)
+	return Options{
+		Inputs:    Inputs{DockerfileInline: dockerfile},
+		Platforms: platforms,
+		Exports:   []client.ExportEntry{{Type: "local", OutputDir: dir}},
+	}, nil
+}
+
+// ReadSBOMs returns the SPDX SBOMs the scan wrote to dir, in a subdirectory
+// per platform for multi-platform images
+func ReadSBOMs(dir string) ([]imagetools.Referrer, error) {
+	var refs []imagetools.Referrer
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(fi.Name(), ".spdx.json") {
+			return err
+		}
+		dt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var st inTotoStatement
+		if err := json.Unmarshal(dt, &st); err != nil {
+			return errors.Wrapf(err, "invalid SBOM %s", fi.Name())
+		}
+		switch {
+		case st.PredicateType == PredicateTypeSPDX && len(st.Predicate) > 0:
+			dt = st.Predicate
+		case st.Type != "":
+			return errors.Errorf("SBOM %s has predicate type %q, expected %s", fi.Name(), st.PredicateType, PredicateTypeSPDX)
+		}
+		refs = append(refs, imagetools.Referrer{ArtifactType: imagetools.ArtifactTypeSPDX, Data: dt})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, errors.Errorf("the SBOM generator wrote no SPDX SBOM")
+	}
+	return refs, nil
+}
+
+// AttachReferrers attaches refs to the image of opt its build pushed, with
+// the response res
+func AttachReferrers(ctx context.Context, pw progress.Writer, auth imagetools.Auth, opt Options, res *client.SolveResponse, refs []imagetools.Referrer) error {
+	defer func() {
+		close(pw.Status())
+		<-pw.Done()
+	}()
+	exports := make([]client.ExportEntry, len(opt.Exports))
+	for i, e := range opt.Exports {
+		exports[i] = e
+		exports[i].Attrs = make(map[string]string, len(e.Attrs))
+		for k, v := range e.Attrs {
+			exports[i].Attrs[k] = v
+		}
+	}
+	if err := NameOutputs(exports, opt.Tags); err != nil {
+		return err
+	}
+	opt.Referrers = refs
+	return pushReferrers(ctx, pw, auth, pushedNames(exports), res, opt)
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+func Test_SBOMScanOptions(t *testing.T) {
+	t.Parallel()
+	opt, err := SBOMScanOptions("registry.example.com/app@sha256:abcd", DefaultSBOMGenerator, []string{"/bin/syft-scanner"}, nil, "/tmp/out")
+	require.NoError(t, err)
+	assert.Contains(t, opt.Inputs.DockerfileInline, "FROM registry.example.com/app@sha256:abcd AS image\n")
+	assert.Contains(t, opt.Inputs.DockerfileInline, "FROM --platform=$BUILDPLATFORM "+DefaultSBOMGenerator+" AS scanner\n")
+	assert.Contains(t, opt.Inputs.DockerfileInline, `RUN --mount=type=bind,from=image,target=/run/src/core ["/bin/syft-scanner"]`)
+	assert.Contains(t, opt.Inputs.DockerfileInline, "COPY --from=scanner /run/out /\n")
+	require.Len(t, opt.Exports, 1)
+	assert.Equal(t, "local", opt.Exports[0].Type)
+	assert.Equal(t, "/tmp/out", opt.Exports[0].OutputDir)
+
+	_, err = SBOMScanOptions("registry.example.com/app@sha256:abcd", "example/scanner", nil, nil, "/tmp/out")
+	assert.Error(t, err)
+}
+
+func Test_ReadSBOMs(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "sbom")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = ReadSBOMs(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "linux_amd64"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "linux_amd64", "sbom.spdx.json"), []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document","predicate":{"spdxVersion":"SPDX-2.2"}}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "linux_amd64", "notes.txt"), []byte("not an SBOM"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "raw.spdx.json"), []byte(`{"spdxVersion":"SPDX-2.3"}`), 0644))
+	refs, err := ReadSBOMs(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []imagetools.Referrer{
+		{ArtifactType: imagetools.ArtifactTypeSPDX, Data: []byte(`{"spdxVersion":"SPDX-2.2"}`)},
+		{ArtifactType: imagetools.ArtifactTypeSPDX, Data: []byte(`{"spdxVersion":"SPDX-2.3"}`)},
+	}, refs)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.spdx.json"), []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","predicate":{}}`), 0644))
+	_, err = ReadSBOMs(dir)
+	assert.Error(t, err)
+}
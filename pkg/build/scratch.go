@@ -0,0 +1,36 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The volumes of a running pod can't change, so the scratch volume is sized
+// when the builder is created.  A build stating the scratch space it needs
+// fails upfront on a builder with less, instead of running out of space or
+// getting the builder pod evicted halfway through.
+
+// checkScratchSize fails if the scratch volume of the builder is smaller than size
+func checkScratchSize(info *driver.Info, size string) error {
+	if size == "" {
+		return nil
+	}
+	need, err := resource.ParseQuantity(size)
+	if err != nil {
+		return errors.Errorf("invalid scratch size %q, use a quantity like 100Gi", size)
+	}
+	if info.ScratchSize == "" {
+		return errors.Errorf("the builder has no scratch volume, create it with --scratch-size=%s", size)
+	}
+	have, err := resource.ParseQuantity(info.ScratchSize)
+	if err != nil {
+		return errors.Wrapf(err, "invalid scratch size %q of the builder", info.ScratchSize)
+	}
+	if have.Cmp(need) < 0 {
+		return errors.Errorf("the builder scratch volume of %s is smaller than the %s requested, recreate it with --scratch-size=%s", info.ScratchSize, size, size)
+	}
+	return nil
+}
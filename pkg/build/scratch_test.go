@@ -0,0 +1,20 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+func Test_checkScratchSize(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, checkScratchSize(&driver.Info{}, ""))
+	require.NoError(t, checkScratchSize(&driver.Info{ScratchSize: "200Gi"}, "100Gi"))
+	require.NoError(t, checkScratchSize(&driver.Info{ScratchSize: "1Ti"}, "1000G"))
+	require.Error(t, checkScratchSize(&driver.Info{ScratchSize: "50Gi"}, "100Gi"))
+	require.Error(t, checkScratchSize(&driver.Info{}, "100Gi"))
+	require.Error(t, checkScratchSize(&driver.Info{ScratchSize: "200Gi"}, "lots"))
+}
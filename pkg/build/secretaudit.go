@@ -0,0 +1,127 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// Secrets reach the builder over the session and buildkit only exposes them
+// to RUN steps through a tmpfs mount which is removed when the step exits.
+// The checks here catch the ways they can still end up persisted: passing them
+// as build arguments or labels, or a RUN step copying them into the image.
+
+// MinSecretNeedle is the shortest secret fragment searched for, shorter
+// values match too much unrelated content to be meaningful
+const MinSecretNeedle = 8
+
+// secretAuditRoots are the builder directories holding the cache, content
+// store and snapshots across the supported workers
+var secretAuditRoots = []string{
+	"/var/lib/buildkit",
+	"/home/user/.local/share/buildkit",
+	"/var/lib/containerd",
+	"/tmp",
+}
+
+// SecretNeedles returns a distinctive fragment of each secret keyed by ID,
+// secrets too short to search for are omitted
+func SecretNeedles(sl []string) (map[string]string, error) {
+	fs := make([]secretsprovider.Source, 0, len(sl))
+	for _, v := range sl {
+		s, err := parseSecret(v)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, *s)
+	}
+	store, err := secretsprovider.NewStore(fs)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(fs))
+	for _, s := range fs {
+		dt, err := store.GetSecret(context.TODO(), s.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read secret %s", s.ID)
+		}
+		// The patterns are matched line by line, use the longest line
+		needle := ""
+		for _, line := range strings.Split(string(dt), "\n") {
+			if line = strings.TrimSpace(line); len(line) > len(needle) {
+				needle = line
+			}
+		}
+		if len(needle) >= MinSecretNeedle {
+			res[s.ID] = needle
+		}
+	}
+	return res, nil
+}
+
+// CheckSecretArgs fails if a secret value is passed in values, such as build
+// arguments or labels, which are recorded in the image and the build cache
+func CheckSecretArgs(needles map[string]string, kind string, values map[string]string) error {
+	for _, k := range sortedKeys(values) {
+		for _, id := range sortedKeys(needles) {
+			if strings.Contains(values[k], needles[id]) {
+				return errors.Errorf("%s %s contains the value of secret %s and would be stored in the image, use RUN --mount=type=secret,id=%s instead", kind, k, id, id)
+			}
+		}
+	}
+	return nil
+}
+
+// AuditSecrets searches the builder pods the build ran on for the secrets in
+// files written since the build started, including compressed layers in the
+// content store.  Only those pods are given the secrets to search for.  It
+// returns the offending files as pod:path.
+func AuditSecrets(ctx context.Context, d driver.Driver, pods []string, needles map[string]string, since time.Time) ([]string, error) {
+	if len(needles) == 0 {
+		return nil, nil
+	}
+	patterns := &bytes.Buffer{}
+	for _, id := range sortedKeys(needles) {
+		fmt.Fprintln(patterns, needles[id])
+	}
+	var res []string
+	for _, pod := range pods {
+		buf := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		if err := d.Exec(ctx, pod, []string{"sh", "-c", secretAuditScript(since)}, bytes.NewReader(patterns.Bytes()), buf, stderr); err != nil {
+			return nil, errors.Wrapf(err, "failed to audit %s: %s", pod, strings.TrimSpace(stderr.String()))
+		}
+		for _, f := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if f != "" {
+				res = append(res, pod+":"+f)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// secretAuditScript reads the patterns from stdin into shared memory so the
+// audit itself doesn't write the secrets to disk
+func secretAuditScript(since time.Time) string {
+	minutes := int(math.Ceil(time.Since(since).Minutes())) + 1
+	roots := make([]string, len(secretAuditRoots))
+	for i, r := range secretAuditRoots {
+		roots[i] = shellQuote(r)
+	}
+	return "P=$(mktemp /dev/shm/secret-audit.XXXXXX) || exit 1; trap 'rm -f $P' EXIT; cat > $P; " +
+		fmt.Sprintf("find %s -xdev -type f -mmin -%d 2>/dev/null | ", strings.Join(roots, " "), minutes) +
+		`while IFS= read -r f; do ` +
+		`if gzip -t "$f" 2>/dev/null; then gzip -dc "$f"; else cat "$f"; fi 2>/dev/null | grep -qF -f $P && echo "$f"; ` +
+		`done; true`
+}
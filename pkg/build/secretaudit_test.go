@@ -0,0 +1,48 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// auditDriver records the pods the audit execs in and the patterns it is
+// given, finding a file on leaky
+type auditDriver struct {
+	driver.Driver
+	leaky    string
+	pods     []string
+	patterns []string
+}
+
+func (d *auditDriver) Exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	dt, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	d.pods = append(d.pods, name)
+	d.patterns = append(d.patterns, string(dt))
+	if name == d.leaky {
+		_, err = io.WriteString(stdout, "/var/lib/buildkit/runc-overlayfs/content/blobs/sha256/abc\n")
+	}
+	return err
+}
+
+func Test_AuditSecrets(t *testing.T) {
+	t.Parallel()
+	// The other pods of the builder, only known from Info, are never given
+	// the secrets
+	d := &auditDriver{leaky: "buildkit-1"}
+	found, err := AuditSecrets(context.Background(), d, []string{"buildkit-1"}, map[string]string{"token": "s3cr3t-t0ken"}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{"buildkit-1"}, d.pods)
+	require.Equal(t, []string{"s3cr3t-t0ken\n"}, d.patterns)
+	require.Equal(t, []string{"buildkit-1:/var/lib/buildkit/runc-overlayfs/content/blobs/sha256/abc"}, found)
+}
@@ -2,6 +2,7 @@ package build
 
 import (
 	"encoding/csv"
+	"os"
 	"strings"
 
 	"github.com/moby/buildkit/session"
@@ -9,7 +10,8 @@ import (
 	"github.com/pkg/errors"
 )
 
-func ParseSecretSpecs(sl []string) (session.Attachable, error) {
+// ParseSecretSpecs parses the --secret values, dns is also served if set
+func ParseSecretSpecs(sl []string, dns *DNSConfig) (session.Attachable, error) {
 	fs := make([]secretsprovider.Source, 0, len(sl))
 	for _, v := range sl {
 		s, err := parseSecret(v)
@@ -22,6 +24,9 @@ func ParseSecretSpecs(sl []string) (session.Attachable, error) {
 	if err != nil {
 		return nil, err
 	}
+	if dns != nil {
+		return secretsprovider.NewSecretProvider(&dnsSecretStore{SecretStore: store, resolvConf: dns.ResolvConf()}), nil
+	}
 	return secretsprovider.NewSecretProvider(store), nil
 }
 
@@ -34,6 +39,7 @@ func parseSecret(value string) (*secretsprovider.Source, error) {
 
 	fs := secretsprovider.Source{}
 
+	typ := "file"
 	for _, field := range fields {
 		parts := strings.SplitN(field, "=", 2)
 		key := strings.ToLower(parts[0])
@@ -45,16 +51,34 @@ func parseSecret(value string) (*secretsprovider.Source, error) {
 		value := parts[1]
 		switch key {
 		case "type":
-			if value != "file" {
+			if value != "file" && value != "env" {
 				return nil, errors.Errorf("unsupported secret type %q", value)
 			}
+			typ = value
 		case "id":
 			fs.ID = value
 		case "source", "src":
 			fs.FilePath = value
+		case "env":
+			fs.Env = value
 		default:
 			return nil, errors.Errorf("unexpected key '%s' in '%s'", key, field)
 		}
 	}
+	if typ == "env" && fs.Env == "" {
+		// The variable named by src, or by the id
+		fs.Env, fs.FilePath = fs.FilePath, ""
+		if fs.Env == "" {
+			fs.Env = fs.ID
+		}
+	}
+	if fs.Env != "" && fs.FilePath != "" {
+		return nil, errors.Errorf("secret %s can't be read from both a file and an environment variable", fs.ID)
+	}
+	if fs.Env != "" {
+		if _, ok := os.LookupEnv(fs.Env); !ok {
+			return nil, errors.Errorf("environment variable %s of secret %s is not set", fs.Env, fs.ID)
+		}
+	}
 	return &fs, nil
 }
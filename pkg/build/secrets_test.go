@@ -3,26 +3,78 @@
 package build
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_ParseSecretSpecs(t *testing.T) {
 	t.Parallel()
-	resp, err := ParseSecretSpecs([]string{})
+	resp, err := ParseSecretSpecs([]string{}, nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, resp)
-	resp, err = ParseSecretSpecs([]string{"type=bogus"})
+	resp, err = ParseSecretSpecs([]string{"type=bogus"}, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "unsupported secret type")
 	assert.Nil(t, resp)
-	resp, err = ParseSecretSpecs([]string{"bogus=bogus"})
+	resp, err = ParseSecretSpecs([]string{"bogus=bogus"}, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "unexpected key")
 	assert.Nil(t, resp)
-	resp, err = ParseSecretSpecs([]string{"id=mysecret,src=/local/secret/path/doesnt/exist"})
+	resp, err = ParseSecretSpecs([]string{"id=mysecret,src=/local/secret/path/doesnt/exist"}, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "no such file or directory")
 	assert.Nil(t, resp)
 }
+
+func Test_SecretNeedles(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(key, []byte("-----BEGIN KEY-----\nMIIEvQIBADANBgkqhkiG9w0BAQEFAASC\n-----END KEY-----\n"), 0600))
+	short := filepath.Join(dir, "short")
+	require.NoError(t, ioutil.WriteFile(short, []byte("abc"), 0600))
+
+	needles, err := SecretNeedles([]string{"id=key,src=" + key, "id=short,src=" + short})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "MIIEvQIBADANBgkqhkiG9w0BAQEFAASC"}, needles)
+
+	assert.NoError(t, CheckSecretArgs(needles, "build argument", map[string]string{"VERSION": "1.0"}))
+	err = CheckSecretArgs(needles, "build argument", map[string]string{"KEY": "x MIIEvQIBADANBgkqhkiG9w0BAQEFAASC"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "build argument KEY contains the value of secret key")
+}
+
+func Test_parseSecretEnv(t *testing.T) {
+	os.Setenv("KUBECTL_BUILD_TEST_TOKEN", "t0ken")
+	defer os.Unsetenv("KUBECTL_BUILD_TEST_TOKEN")
+
+	s, err := parseSecret("type=env,id=token,env=KUBECTL_BUILD_TEST_TOKEN")
+	require.NoError(t, err)
+	assert.Equal(t, "KUBECTL_BUILD_TEST_TOKEN", s.Env)
+	assert.Empty(t, s.FilePath)
+
+	s, err = parseSecret("type=env,id=token,src=KUBECTL_BUILD_TEST_TOKEN")
+	require.NoError(t, err)
+	assert.Equal(t, "KUBECTL_BUILD_TEST_TOKEN", s.Env)
+	assert.Empty(t, s.FilePath)
+
+	s, err = parseSecret("type=env,id=KUBECTL_BUILD_TEST_TOKEN")
+	require.NoError(t, err)
+	assert.Equal(t, "KUBECTL_BUILD_TEST_TOKEN", s.Env)
+
+	_, err = parseSecret("type=env,id=KUBECTL_BUILD_TEST_UNSET")
+	assert.Error(t, err)
+	_, err = parseSecret("id=token,src=/tmp/token,env=KUBECTL_BUILD_TEST_TOKEN")
+	assert.Error(t, err)
+
+	resp, err := ParseSecretSpecs([]string{"type=env,id=token,env=KUBECTL_BUILD_TEST_TOKEN"}, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+}
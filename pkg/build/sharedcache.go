@@ -0,0 +1,58 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+)
+
+// Builds on a builder with a shared cache import their cache from the cache
+// registry of the builder, whichever pod they land on, and export their
+// layers to it in max mode so the RUN steps of the other stages are cached
+// too.  The cache of an image is tagged by its repository and target, so
+// unrelated builds don't overwrite each other's cache.  The builder exports
+// a single cache, a build exporting its cache with --cache-to only imports
+// the shared cache.
+
+const sharedCacheMaxTag = 128
+
+var invalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// sharedCacheEntries returns the cache imports and exports of the build of
+// opt with the shared cache repo of its builder
+func sharedCacheEntries(repo string, opt Options) (imports, exports []client.CacheOptionsEntry) {
+	ref := repo + ":" + sharedCacheTag(opt)
+	if !opt.NoCache {
+		imports = []client.CacheOptionsEntry{{Type: "registry", Attrs: map[string]string{"ref": ref}}}
+	}
+	if len(opt.CacheTo) == 0 {
+		exports = []client.CacheOptionsEntry{{Type: "registry", Attrs: map[string]string{"ref": ref, "mode": "max"}}}
+	}
+	return imports, exports
+}
+
+// sharedCacheTag is the tag of the cache of the first image of opt and its
+// target in the shared cache
+func sharedCacheTag(opt Options) string {
+	var parts []string
+	if len(opt.Tags) > 0 {
+		if named, err := reference.ParseNormalizedNamed(opt.Tags[0]); err == nil {
+			parts = append(parts, named.Name())
+		}
+	}
+	if opt.Target != "" {
+		parts = append(parts, opt.Target)
+	}
+	tag := strings.Trim(invalidTagChars.ReplaceAllString(strings.Join(parts, "-"), "-"), "-.")
+	if tag == "" {
+		return "default"
+	}
+	if len(tag) > sharedCacheMaxTag {
+		tag = tag[:sharedCacheMaxTag]
+	}
+	return tag
+}
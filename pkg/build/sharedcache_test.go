@@ -0,0 +1,35 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sharedCacheEntries(t *testing.T) {
+	t.Parallel()
+	repo := "buildkit-shared-cache:5000/cache"
+	imports, exports := sharedCacheEntries(repo, Options{Tags: []string{"myapp:1.0"}, Target: "dev"})
+	require.Equal(t, []client.CacheOptionsEntry{{Type: "registry", Attrs: map[string]string{"ref": repo + ":docker.io-library-myapp-dev"}}}, imports)
+	require.Equal(t, []client.CacheOptionsEntry{{Type: "registry", Attrs: map[string]string{"ref": repo + ":docker.io-library-myapp-dev", "mode": "max"}}}, exports)
+
+	// The builder exports a single cache, --cache-to wins
+	imports, exports = sharedCacheEntries(repo, Options{CacheTo: []client.CacheOptionsEntry{{Type: "inline"}}})
+	require.Equal(t, repo+":default", imports[0].Attrs["ref"])
+	require.Empty(t, exports)
+
+	imports, _ = sharedCacheEntries(repo, Options{NoCache: true})
+	require.Empty(t, imports)
+}
+
+func Test_sharedCacheTag(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "registry.example.com-5000-team-app", sharedCacheTag(Options{Tags: []string{"registry.example.com:5000/team/app:v1"}}))
+	require.Equal(t, "build", sharedCacheTag(Options{Target: "build"}))
+	require.Equal(t, "default", sharedCacheTag(Options{Tags: []string{"Not A Reference"}}))
+	require.Len(t, sharedCacheTag(Options{Tags: []string{"example.com/" + strings.Repeat("a", 200)}}), sharedCacheMaxTag)
+}
@@ -0,0 +1,266 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// Source policies follow the BuildKit source policy file format.  The builder
+// image shipped today predates server side policy enforcement, so policies are
+// applied on the client by rewriting the images of the Dockerfile before it
+// is sent to the builder.
+
+const (
+	SourcePolicyActionAllow   = "ALLOW"
+	SourcePolicyActionDeny    = "DENY"
+	SourcePolicyActionConvert = "CONVERT"
+
+	SourcePolicyMatchExact    = "EXACT"
+	SourcePolicyMatchWildcard = "WILDCARD"
+	SourcePolicyMatchRegex    = "REGEX"
+
+	dockerImageScheme = "docker-image://"
+)
+
+type SourcePolicy struct {
+	Rules []SourcePolicyRule `json:"rules"`
+}
+
+type SourcePolicyRule struct {
+	Action   string               `json:"action"`
+	Selector SourcePolicySelector `json:"selector"`
+	Updates  *SourcePolicyUpdate  `json:"updates,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type SourcePolicySelector struct {
+	Identifier string `json:"identifier"`
+	MatchType  string `json:"matchType,omitempty"`
+}
+
+type SourcePolicyUpdate struct {
+	Identifier string `json:"identifier"`
+}
+
+// LoadSourcePolicy reads and validates a source policy file
+func LoadSourcePolicy(filename string) (*SourcePolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read source policy")
+	}
+	return ParseSourcePolicy(data)
+}
+
+func ParseSourcePolicy(data []byte) (*SourcePolicy, error) {
+	var policy SourcePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, errors.Wrap(err, "malformed source policy")
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		rule.Action = strings.ToUpper(rule.Action)
+		switch rule.Action {
+		case SourcePolicyActionAllow, SourcePolicyActionDeny:
+		case SourcePolicyActionConvert:
+			if rule.Updates == nil || rule.Updates.Identifier == "" {
+				return nil, errors.Errorf("source policy rule %d: CONVERT requires updates.identifier", i)
+			}
+		default:
+			return nil, errors.Errorf("source policy rule %d: unsupported action %q", i, rule.Action)
+		}
+		if !strings.HasPrefix(rule.Selector.Identifier, dockerImageScheme) {
+			return nil, errors.Errorf("source policy rule %d: only %s identifiers are supported", i, dockerImageScheme)
+		}
+		var expr string
+		switch strings.ToUpper(rule.Selector.MatchType) {
+		case "", SourcePolicyMatchExact:
+			expr = "^" + regexp.QuoteMeta(rule.Selector.Identifier) + "$"
+		case SourcePolicyMatchWildcard:
+			expr = "^" + strings.NewReplacer(`\*`, "(.*)", `\?`, "(.)").Replace(regexp.QuoteMeta(rule.Selector.Identifier)) + "$"
+		case SourcePolicyMatchRegex:
+			expr = rule.Selector.Identifier
+		default:
+			return nil, errors.Errorf("source policy rule %d: unsupported match type %q", i, rule.Selector.MatchType)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "source policy rule %d: invalid selector", i)
+		}
+		rule.re = re
+	}
+	return &policy, nil
+}
+
+// Evaluate applies the policy to a single image reference and returns the
+// (possibly rewritten) reference.  Rules are evaluated in order, the first
+// matching ALLOW or DENY rule wins, and CONVERT rules are chained.
+func (p *SourcePolicy) Evaluate(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid image reference %q", ref)
+	}
+	id := dockerImageScheme + reference.TagNameOnly(named).String()
+	for _, rule := range p.Rules {
+		if !rule.re.MatchString(id) {
+			continue
+		}
+		switch rule.Action {
+		case SourcePolicyActionAllow:
+			return strings.TrimPrefix(id, dockerImageScheme), nil
+		case SourcePolicyActionDeny:
+			return "", errors.Errorf("source %q denied by source policy", ref)
+		case SourcePolicyActionConvert:
+			id = rule.re.ReplaceAllString(id, rule.Updates.Identifier)
+		}
+	}
+	return strings.TrimPrefix(id, dockerImageScheme), nil
+}
+
+// Apply rewrites the images of a Dockerfile according to the policy.
+// References to build stages and references containing build args are passed
+// through untouched.
+func (p *SourcePolicy) Apply(dockerfile []byte) ([]byte, error) {
+	return rewriteFromImages(dockerfile, p.Evaluate)
+}
+
+// rewriteFromImages replaces the images of the FROM instructions of a
+// Dockerfile, and those COPY --from and RUN --mount from= copy from, by the
+// result of fn.  References to build stages, references containing build
+// args and scratch aren't passed to fn.
+func rewriteFromImages(dockerfile []byte, fn func(image string) (string, error)) ([]byte, error) {
+	sources, err := dockerfileImageSources(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.SplitAfter(string(dockerfile), "\n")
+	// The references of an instruction are found in order, from the end of
+	// the previous one
+	var last *parser.Node
+	var pos textPos
+	for _, src := range sources {
+		if strings.Contains(src.image, "$") || strings.EqualFold(src.image, "scratch") {
+			continue
+		}
+		rewritten, err := fn(src.image)
+		if err != nil {
+			return nil, err
+		}
+		if src.node != last {
+			last, pos = src.node, textPos{line: src.node.StartLine - 1}
+		}
+		if !pos.replace(lines, src, rewritten) {
+			return nil, errors.Errorf("line %d: failed to rewrite %s", src.node.StartLine, src.image)
+		}
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// imageSource is an image reference of a Dockerfile instruction
+type imageSource struct {
+	node  *parser.Node
+	image string
+	// prefix is the text before the reference, after one of the bytes of
+	// delims
+	prefix, delims string
+}
+
+// dockerfileImageSources parses a Dockerfile and returns the images its FROM
+// instructions build on, and those COPY --from and RUN --mount from= copy
+// from.  References to build stages aren't returned.
+func dockerfileImageSources(dockerfile []byte) ([]imageSource, error) {
+	res, err := parser.Parse(bytes.NewReader(dockerfile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the Dockerfile")
+	}
+	var sources []imageSource
+	names := map[string]bool{}
+	stages := 0
+	// isStage reports whether a --from or from= refers to a stage
+	isStage := func(ref string) bool {
+		if i, err := strconv.Atoi(ref); err == nil {
+			return i >= 0 && i < stages-1
+		}
+		return names[strings.ToLower(ref)]
+	}
+	for _, n := range res.AST.Children {
+		switch strings.ToLower(n.Value) {
+		case command.From:
+			if n.Next == nil {
+				return nil, errors.Errorf("line %d: FROM requires an image", n.StartLine)
+			}
+			stages++
+			if !names[strings.ToLower(n.Next.Value)] {
+				sources = append(sources, imageSource{node: n, image: n.Next.Value, delims: " \t"})
+			}
+			if as := n.Next.Next; as != nil && strings.EqualFold(as.Value, "AS") && as.Next != nil {
+				names[strings.ToLower(as.Next.Value)] = true
+			}
+		case command.Copy, command.Add:
+			for _, f := range n.Flags {
+				if ref := strings.TrimPrefix(f, "--from="); ref != f && !isStage(ref) {
+					sources = append(sources, imageSource{node: n, image: ref, prefix: "--from=", delims: " \t"})
+				}
+			}
+		case command.Run:
+			for _, f := range n.Flags {
+				if !strings.HasPrefix(f, "--mount=") {
+					continue
+				}
+				fields, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(f, "--mount="))).Read()
+				if err != nil {
+					return nil, errors.Wrapf(err, "line %d: invalid mount %s", n.StartLine, f)
+				}
+				for _, field := range fields {
+					if ref := strings.TrimPrefix(field, "from="); ref != field && !isStage(ref) {
+						sources = append(sources, imageSource{node: n, image: ref, prefix: "from=", delims: ",="})
+					}
+				}
+			}
+		}
+	}
+	return sources, nil
+}
+
+// textPos is a position in the lines of a Dockerfile
+type textPos struct {
+	line, offset int
+}
+
+// replace replaces the next reference of src from p by image, in the lines
+// of its instruction.  The comments within the instruction are passed over.
+func (p *textPos) replace(lines []string, src imageSource, image string) bool {
+	old := src.prefix + src.image
+	for ; p.line < src.node.EndLine && p.line < len(lines); p.line, p.offset = p.line+1, 0 {
+		line := lines[p.line]
+		if p.line >= src.node.StartLine && strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for i := p.offset; ; {
+			j := strings.Index(line[i:], old)
+			if j < 0 {
+				break
+			}
+			start, end := i+j, i+j+len(old)
+			if start > 0 && strings.IndexByte(src.delims, line[start-1]) >= 0 && (end == len(line) || strings.IndexByte(" \t\r\n,\\`", line[end]) >= 0) {
+				lines[p.line] = line[:start] + src.prefix + image + line[end:]
+				p.offset = start + len(src.prefix) + len(image)
+				return true
+			}
+			i = start + 1
+		}
+	}
+	return false
+}
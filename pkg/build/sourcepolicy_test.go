@@ -0,0 +1,82 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SourcePolicy(t *testing.T) {
+	t.Parallel()
+	policy, err := ParseSourcePolicy([]byte(`{"rules": [
+		{"action": "DENY", "selector": {"identifier": "docker-image://docker.io/library/busybox:*", "matchType": "WILDCARD"}},
+		{"action": "CONVERT", "selector": {"identifier": "docker-image://docker.io/*", "matchType": "WILDCARD"},
+		 "updates": {"identifier": "docker-image://mirror.acme.com/${1}"}},
+		{"action": "CONVERT", "selector": {"identifier": "docker-image://mirror.acme.com/library/alpine:3.14"},
+		 "updates": {"identifier": "docker-image://mirror.acme.com/library/alpine@sha256:e1c082e3d3c45cccac829840a25941e679c25d438cc8412c2fa221cf1a824e6a"}}
+	]}`))
+	require.NoError(t, err)
+
+	ref, err := policy.Evaluate("golang")
+	assert.NoError(t, err)
+	assert.Equal(t, "mirror.acme.com/library/golang:latest", ref)
+
+	ref, err = policy.Evaluate("alpine:3.14")
+	assert.NoError(t, err)
+	assert.Equal(t, "mirror.acme.com/library/alpine@sha256:e1c082e3d3c45cccac829840a25941e679c25d438cc8412c2fa221cf1a824e6a", ref)
+
+	ref, err = policy.Evaluate("quay.io/foo/bar:v1")
+	assert.NoError(t, err)
+	assert.Equal(t, "quay.io/foo/bar:v1", ref)
+
+	_, err = policy.Evaluate("busybox:1.33")
+	assert.Error(t, err)
+
+	out, err := policy.Apply([]byte("FROM --platform=$BUILDPLATFORM golang AS build\nRUN go build\nFROM scratch\nCOPY --from=build /app /app\nFROM build\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "FROM --platform=$BUILDPLATFORM mirror.acme.com/library/golang:latest AS build\nRUN go build\nFROM scratch\nCOPY --from=build /app /app\nFROM build\n", string(out))
+
+	_, err = ParseSourcePolicy([]byte(`{"rules": [{"action": "CONVERT", "selector": {"identifier": "docker-image://foo"}}]}`))
+	assert.Error(t, err)
+	_, err = ParseSourcePolicy([]byte(`{"rules": [{"action": "ALLOW", "selector": {"identifier": "git://foo"}}]}`))
+	assert.Error(t, err)
+}
+
+func Test_rewriteFromImages(t *testing.T) {
+	t.Parallel()
+	dockerfile := `FROM --platform=$BUILDPLATFORM \
+	# the toolchain
+	golang:1.16 \
+	AS build
+RUN --mount=type=cache,from=registry.local/cache:1,target=/root/.cache go build
+FROM alpine
+COPY --from=build /app /app
+COPY --from=0 /go /go
+COPY --from=busybox:1.33 /bin/busybox /bin/
+COPY --from=${TOOLS} /tools /tools
+`
+	var images []string
+	out, err := rewriteFromImages([]byte(dockerfile), func(image string) (string, error) {
+		images = append(images, image)
+		return "mirror.local/" + image, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"golang:1.16", "registry.local/cache:1", "alpine", "busybox:1.33"}, images)
+	assert.Equal(t, `FROM --platform=$BUILDPLATFORM \
+	# the toolchain
+	mirror.local/golang:1.16 \
+	AS build
+RUN --mount=type=cache,from=mirror.local/registry.local/cache:1,target=/root/.cache go build
+FROM mirror.local/alpine
+COPY --from=build /app /app
+COPY --from=0 /go /go
+COPY --from=mirror.local/busybox:1.33 /bin/busybox /bin/
+COPY --from=${TOOLS} /tools /tools
+`, string(out))
+
+	_, err = FromImages([]byte(dockerfile), nil, nil)
+	require.EqualError(t, err, "line 10: base image ${TOOLS} uses build args and can't be verified")
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+)
+
+// imageConfigKey is the result metadata of the image config, suffixed with
+// "/<platform>" for multi-platform results
+const imageConfigKey = "containerimage.config"
+
+// squashResult replaces the root filesystem of each platform of res with a
+// single layer copy, including the layers of the base image
+func squashResult(ctx context.Context, gc gateway.Client, res *gateway.Result) (*gateway.Result, error) {
+	out := gateway.NewResult()
+	for k, v := range res.Metadata {
+		if k == imageConfigKey || strings.HasPrefix(k, imageConfigKey+"/") {
+			dt, err := squashConfig(v)
+			if err != nil {
+				return nil, err
+			}
+			v = dt
+		}
+		out.AddMeta(k, v)
+	}
+	if res.Ref != nil {
+		ref, err := squashRef(ctx, gc, res.Ref)
+		if err != nil {
+			return nil, err
+		}
+		out.SetRef(ref)
+	}
+	for p, r := range res.Refs {
+		ref, err := squashRef(ctx, gc, r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to squash %s", p)
+		}
+		out.AddRef(p, ref)
+	}
+	return out, nil
+}
+
+func squashRef(ctx context.Context, gc gateway.Client, ref gateway.Reference) (gateway.Reference, error) {
+	st, err := ref.ToState()
+	if err != nil {
+		return nil, err
+	}
+	squashed := llb.Scratch().File(
+		llb.Copy(st, "/", "/", &llb.CopyInfo{CopyDirContentsOnly: true}),
+		llb.WithCustomName("[internal] squashing image layers"),
+	)
+	def, err := squashed.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := gc.Solve(ctx, gateway.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, err
+	}
+	return res.SingleRef()
+}
+
+// squashConfig replaces the history of the image config with a single entry
+// for the squashed layer, the exporter fills in the layer digests
+func squashConfig(dt []byte) ([]byte, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(dt, &config); err != nil {
+		return nil, errors.Wrap(err, "invalid image config")
+	}
+	entry := map[string]interface{}{
+		"created_by": "kubectl build --squash",
+		"comment":    "squashed layers",
+	}
+	if created, ok := config["created"]; ok {
+		entry["created"] = created
+	}
+	config["history"] = []interface{}{entry}
+	delete(config, "rootfs")
+	return json.Marshal(config)
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"encoding/json"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_squashConfig(t *testing.T) {
+	t.Parallel()
+	in := `{"architecture":"amd64","os":"linux","created":"2021-10-01T00:00:00Z","config":{"Env":["PATH=/bin"]},
+"rootfs":{"type":"layers","diff_ids":["sha256:aaaa","sha256:bbbb"]},
+"history":[{"created_by":"ADD rootfs"},{"created_by":"ENV PATH=/bin","empty_layer":true},{"created_by":"RUN make"}]}`
+	dt, err := squashConfig([]byte(in))
+	require.NoError(t, err)
+	var img specs.Image
+	require.NoError(t, json.Unmarshal(dt, &img))
+	require.Len(t, img.History, 1)
+	require.False(t, img.History[0].EmptyLayer)
+	require.Equal(t, img.Created, img.History[0].Created)
+	require.Empty(t, img.RootFS.DiffIDs)
+	require.Equal(t, []string{"PATH=/bin"}, img.Config.Env)
+
+	_, err = squashConfig([]byte("not json"))
+	require.Error(t, err)
+}
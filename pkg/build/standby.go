@@ -0,0 +1,126 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+// BuildKit keeps the local sources it received and only transfers the
+// differences when a client sends the same directory again, matched by the
+// source name and the session's shared key.  Loading the build context on a
+// standby pod while the build runs thus makes a retry of the build on that
+// pod nearly free of uploads.
+
+// standbyClient connects to a builder pod other than node, nil if the
+// builder only has a single pod
+func standbyClient(ctx context.Context, d driver.Driver, node string) (*driver.NodeClient, error) {
+	clients, err := d.Clients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var standby *driver.NodeClient
+	for _, n := range append([]driver.NodeClient{clients.ChosenNode}, clients.OtherNodes...) {
+		n := n
+		if standby == nil && n.NodeName != node {
+			standby = &n
+			continue
+		}
+		n.BuildKitClient.Close()
+	}
+	return standby, nil
+}
+
+// replicateContext loads the local directories of so, other than the
+// Dockerfile, into the builder of c the way the dockerfile frontend does
+func replicateContext(ctx context.Context, c *client.Client, so *client.SolveOpt) error {
+	for name, dir := range so.LocalDirs {
+		if name == "dockerfile" {
+			continue
+		}
+		excludes, err := readDockerignore(dir)
+		if err != nil {
+			return err
+		}
+		st := llb.Local(name,
+			llb.SharedKeyHint(name),
+			llb.ExcludePatterns(excludes),
+			llb.WithCustomNamef("[internal] replicating %s", name),
+		)
+		def, err := st.Marshal(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Solve(ctx, def, client.SolveOpt{
+			LocalDirs: map[string]string{name: dir},
+			SharedKey: so.SharedKey,
+		}, nil); err != nil {
+			return errors.Wrapf(err, "failed to replicate %s", name)
+		}
+	}
+	return nil
+}
+
+// startContextReplication replicates the context to a standby pod in the
+// background, the returned func stops it.  Failures only cost the upload on
+// a retry, so they are logged.
+func startContextReplication(ctx context.Context, d driver.Driver, node string, so *client.SolveOpt) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		standby, err := standbyClient(ctx, d, node)
+		if err != nil || standby == nil {
+			logrus.Debugf("no standby pod to replicate the build context to: %v", err)
+			return
+		}
+		defer standby.BuildKitClient.Close()
+		if err := replicateContext(ctx, standby.BuildKitClient, so); err != nil && ctx.Err() == nil {
+			logrus.Warnf("failed to replicate the build context to %s: %s", standby.NodeName, err)
+			return
+		}
+		logrus.Debugf("replicated the build context to %s", standby.NodeName)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// readDockerignore reads the exclude patterns of the .dockerignore of dir
+func readDockerignore(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var excludes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		invert := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(pattern)), "/")
+		if invert {
+			pattern = "!" + pattern
+		}
+		excludes = append(excludes, pattern)
+	}
+	return excludes, scanner.Err()
+}
@@ -0,0 +1,28 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readDockerignore(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dockerignore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	excludes, err := readDockerignore(dir)
+	require.NoError(t, err)
+	require.Empty(t, excludes)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("# comment\n\n/node_modules\n*.log\n!keep.log\n  dist/  \n"), 0644))
+	excludes, err = readDockerignore(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"node_modules", "*.log", "!keep.log", "dist"}, excludes)
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/util/tracing/otlptracegrpc"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// The CLI reports each build to the observability stack of the platform: a
+// trace of the build and its steps, sent to an OpenTelemetry collector over
+// OTLP, and the metrics of the build pushed to a Prometheus Pushgateway, the
+// CLI exiting before it could be scraped.  Both are put together on the
+// client from the progress of the build, like the build report.
+
+const (
+	// ExporterResponsePod names the builder pod the build ran on in the
+	// exporter response of the build
+	ExporterResponsePod = "buildkit.mobyproject.org/pod"
+
+	// metricsJob is the Pushgateway job of the build metrics
+	metricsJob = "kubectl-buildkit"
+	// tracerName names the instrumentation of the build traces
+	tracerName = "github.com/vmware-tanzu/buildkit-cli-for-kubectl"
+)
+
+// BuildMetrics are what the telemetry of a build reports
+type BuildMetrics struct {
+	BuildReport
+	// Builder and Pod are the builder and the builder pod of the build
+	Builder string
+	Pod     string
+	Start   time.Time
+	// PushedBytes is the size of the layers the export reported pushing
+	PushedBytes int64
+}
+
+// AddGraph counts the steps and the bytes pushed of the build graph
+func (m *BuildMetrics) AddGraph(vertexes []progress.GraphVertex, pushing bool) {
+	m.AddSteps(vertexes)
+	if !pushing {
+		return
+	}
+	for _, v := range vertexes {
+		if strings.HasPrefix(v.Name, "exporting to") {
+			m.PushedBytes += v.Bytes
+		}
+	}
+}
+
+// CacheHitRatio is the share of the steps served from the cache, 0 without steps
+func (m *BuildMetrics) CacheHitRatio() float64 {
+	if m.Steps == 0 {
+		return 0
+	}
+	return float64(m.CachedSteps) / float64(m.Steps)
+}
+
+// ExportTrace sends the trace of the build to the OTLP gRPC endpoint,
+// host:port or an http:// or https:// URL
+func ExportTrace(ctx context.Context, endpoint string, m *BuildMetrics, vertexes []progress.GraphVertex) error {
+	target, secure, err := otlpTarget(endpoint)
+	if err != nil {
+		return err
+	}
+	dialOpt := grpc.WithInsecure()
+	if secure {
+		dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	cc, err := grpc.DialContext(ctx, target, dialOpt)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s", endpoint)
+	}
+	defer cc.Close()
+	return errors.Wrapf(exportTrace(ctx, otlptracegrpc.NewClient(cc), m, vertexes), "failed to export the build trace to %s", endpoint)
+}
+
+// exportTrace exports the trace of the build with the OTLP client c
+func exportTrace(ctx context.Context, c otlptrace.Client, m *BuildMetrics, vertexes []progress.GraphVertex) error {
+	exp, err := otlptrace.New(ctx, c)
+	if err != nil {
+		return err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(metricsJob))),
+	)
+	recordTrace(ctx, tp.Tracer(tracerName), m, vertexes)
+	// Flushes the spans
+	return tp.Shutdown(ctx)
+}
+
+func otlpTarget(endpoint string) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		return endpoint, false, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false, errors.Errorf("invalid OTLP endpoint %q, use host:port or an http or https URL", endpoint)
+	}
+	return u.Host, u.Scheme == "https", nil
+}
+
+// recordTrace records the span of the build, with a span per step
+func recordTrace(ctx context.Context, tracer trace.Tracer, m *BuildMetrics, vertexes []progress.GraphVertex) {
+	end := m.Start.Add(m.Duration)
+	name := "build"
+	if m.Image != "" {
+		name += " " + m.Image
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithTimestamp(m.Start), trace.WithAttributes(
+		attribute.String("buildkit.builder", m.Builder),
+		attribute.String("buildkit.pod", m.Pod),
+		attribute.String("buildkit.image", m.Image),
+		attribute.String("buildkit.digest", m.Digest),
+		attribute.Int("buildkit.steps", m.Steps),
+		attribute.Int("buildkit.cached_steps", m.CachedSteps),
+		attribute.Float64("buildkit.cache_hit_ratio", m.CacheHitRatio()),
+		attribute.Int64("buildkit.pushed_bytes", m.PushedBytes),
+	))
+	for _, v := range vertexes {
+		if v.Started == nil {
+			continue
+		}
+		_, step := tracer.Start(ctx, v.Name, trace.WithTimestamp(*v.Started), trace.WithAttributes(
+			attribute.String("buildkit.vertex", v.Digest.String()),
+			attribute.Bool("buildkit.cached", v.Cached),
+		))
+		if v.Error != "" {
+			step.SetStatus(codes.Error, v.Error)
+		}
+		stepEnd := end
+		if v.Completed != nil {
+			stepEnd = *v.Completed
+		}
+		step.End(trace.WithTimestamp(stepEnd))
+	}
+	if m.Error != "" {
+		span.SetStatus(codes.Error, m.Error)
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// PushMetrics pushes the metrics of the build to the Pushgateway at
+// gateway, grouped by the builder and the image.  Each push replaces the
+// metrics of the previous build of the image on the builder only, the
+// builds of other images are kept.
+func PushMetrics(ctx context.Context, gateway string, m *BuildMetrics) error {
+	u, err := url.Parse(gateway)
+	if err != nil || u.Host == "" {
+		return errors.Errorf("invalid Pushgateway URL %q", gateway)
+	}
+	builder := m.Builder
+	if builder == "" {
+		builder = "default"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/metrics/job/" + metricsJob + "/builder/" + url.PathEscape(builder) + "/" + groupingLabel("image", m.Image)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewBufferString(FormatMetrics(m)))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to push the build metrics")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("failed to push the build metrics to %s: %s", gateway, resp.Status)
+	}
+	return nil
+}
+
+// groupingLabel is the name/value path of a label of the grouping key,
+// base64 encoded as image references have slashes and the Pushgateway takes
+// "=" for an empty value
+func groupingLabel(name, value string) string {
+	if value == "" {
+		return name + "@base64/="
+	}
+	return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// FormatMetrics formats the metrics of the build in the Prometheus text
+// format, labeled with the image and the pod
+func FormatMetrics(m *BuildMetrics) string {
+	labels := map[string]string{"image": m.Image, "pod": m.Pod}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	set := "{" + strings.Join(pairs, ",") + "}"
+	succeeded := 1
+	if m.Error != "" {
+		succeeded = 0
+	}
+	metrics := []struct {
+		name, help string
+		value      interface{}
+	}{
+		{"build_duration_seconds", "Duration of the build", m.Duration.Seconds()},
+		{"build_succeeded", "Whether the build succeeded", succeeded},
+		{"build_steps", "Steps of the build", m.Steps},
+		{"build_cached_steps", "Steps of the build served from the cache", m.CachedSteps},
+		{"build_cache_hit_ratio", "Share of the steps of the build served from the cache", m.CacheHitRatio()},
+		{"build_pushed_bytes", "Bytes of the layers the build pushed", m.PushedBytes},
+		{"build_timestamp_seconds", "When the build started", m.Start.Unix()},
+	}
+	var b strings.Builder
+	for _, metric := range metrics {
+		name := "kubectl_buildkit_" + metric.name
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s%s %v\n", name, metric.help, name, name, set, metric.value)
+	}
+	return b.String()
+}
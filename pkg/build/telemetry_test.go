@@ -0,0 +1,149 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type recordingExporter struct {
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *recordingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func testBuildMetrics() (*BuildMetrics, []progress.GraphVertex) {
+	start := time.Unix(1600000000, 0)
+	started, done := start.Add(time.Second), start.Add(3*time.Second)
+	m := &BuildMetrics{
+		BuildReport: BuildReport{Image: "registry.local/app:1", Duration: 4 * time.Second},
+		Builder:     "buildkit",
+		Pod:         "buildkit-6f8d-x2x",
+		Start:       start,
+	}
+	vertexes := []progress.GraphVertex{
+		{Name: "[1/2] FROM alpine", Started: &started, Completed: &done, Cached: true},
+		{Name: "[2/2] RUN make", Started: &started, Completed: &done, Error: "exit code 2"},
+		{Name: "exporting to image", Started: &started, Completed: &done, Bytes: 150},
+	}
+	return m, vertexes
+}
+
+func Test_BuildMetrics(t *testing.T) {
+	t.Parallel()
+	m, vertexes := testBuildMetrics()
+	m.AddGraph(vertexes, false)
+	require.Equal(t, 3, m.Steps)
+	require.Equal(t, 1, m.CachedSteps)
+	require.Equal(t, int64(0), m.PushedBytes)
+	require.InDelta(t, 1.0/3, m.CacheHitRatio(), 0.001)
+
+	m, vertexes = testBuildMetrics()
+	m.AddGraph(vertexes, true)
+	require.Equal(t, int64(150), m.PushedBytes)
+
+	require.Equal(t, 0.0, (&BuildMetrics{}).CacheHitRatio())
+}
+
+func Test_FormatMetrics(t *testing.T) {
+	t.Parallel()
+	m, vertexes := testBuildMetrics()
+	m.AddGraph(vertexes, true)
+	out := FormatMetrics(m)
+	require.Contains(t, out, "# TYPE kubectl_buildkit_build_duration_seconds gauge\n")
+	require.Contains(t, out, `kubectl_buildkit_build_duration_seconds{image="registry.local/app:1",pod="buildkit-6f8d-x2x"} 4`+"\n")
+	require.Contains(t, out, `kubectl_buildkit_build_succeeded{image="registry.local/app:1",pod="buildkit-6f8d-x2x"} 1`+"\n")
+	require.Contains(t, out, `kubectl_buildkit_build_cached_steps{image="registry.local/app:1",pod="buildkit-6f8d-x2x"} 1`+"\n")
+	require.Contains(t, out, `kubectl_buildkit_build_pushed_bytes{image="registry.local/app:1",pod="buildkit-6f8d-x2x"} 150`+"\n")
+
+	m.Error = "failed"
+	m.Image = `quo"ted`
+	require.Contains(t, FormatMetrics(m), `kubectl_buildkit_build_succeeded{image="quo\\\"ted",pod="buildkit-6f8d-x2x"} 0`+"\n")
+}
+
+func Test_PushMetrics(t *testing.T) {
+	t.Parallel()
+	var method, path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dt, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(dt)
+	}))
+	defer srv.Close()
+	m, _ := testBuildMetrics()
+	require.NoError(t, PushMetrics(context.Background(), srv.URL+"/", m))
+	require.Equal(t, http.MethodPut, method)
+	require.Equal(t, "/metrics/job/kubectl-buildkit/builder/buildkit/image@base64/"+base64.RawURLEncoding.EncodeToString([]byte(m.Image)), path)
+	require.Equal(t, FormatMetrics(m), body)
+
+	other := *m
+	other.Image = ""
+	require.NoError(t, PushMetrics(context.Background(), srv.URL, &other))
+	require.Equal(t, "/metrics/job/kubectl-buildkit/builder/buildkit/image@base64/=", path, "builds without an image are grouped together")
+
+	require.Error(t, PushMetrics(context.Background(), "not a url", m))
+}
+
+func Test_otlpTarget(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		endpoint string
+		target   string
+		secure   bool
+		err      bool
+	}{
+		{endpoint: "otel-collector:4317", target: "otel-collector:4317"},
+		{endpoint: "http://otel-collector:4317", target: "otel-collector:4317"},
+		{endpoint: "https://otel.example.com:443", target: "otel.example.com:443", secure: true},
+		{endpoint: "ftp://otel-collector:4317", err: true},
+	} {
+		target, secure, err := otlpTarget(tc.endpoint)
+		if tc.err {
+			require.Error(t, err, tc.endpoint)
+			continue
+		}
+		require.NoError(t, err, tc.endpoint)
+		require.Equal(t, tc.target, target)
+		require.Equal(t, tc.secure, secure)
+	}
+}
+
+func Test_recordTrace(t *testing.T) {
+	t.Parallel()
+	exp := &recordingExporter{}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	m, vertexes := testBuildMetrics()
+	m.AddGraph(vertexes, true)
+	recordTrace(context.Background(), tp.Tracer(tracerName), m, vertexes)
+	require.NoError(t, tp.Shutdown(context.Background()))
+
+	require.Len(t, exp.spans, 4)
+	// The steps end before the build
+	build := exp.spans[3]
+	require.Equal(t, "build registry.local/app:1", build.Name())
+	require.Equal(t, m.Start, build.StartTime())
+	require.Equal(t, m.Start.Add(m.Duration), build.EndTime())
+	for _, step := range exp.spans[:3] {
+		require.Equal(t, build.SpanContext().SpanID(), step.Parent().SpanID())
+	}
+	require.Equal(t, "[2/2] RUN make", exp.spans[1].Name())
+	require.Equal(t, codes.Error, exp.spans[1].Status().Code)
+	require.Equal(t, *vertexes[1].Completed, exp.spans[1].EndTime())
+}
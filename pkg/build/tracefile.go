@@ -0,0 +1,155 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// A trace file holds the trace of a build sent with --otel-endpoint, in the
+// OTLP JSON file format: a JSON encoded export request per line, as the
+// file exporter of the OpenTelemetry collector writes them.  A collector
+// can import it, or 'trace view' shows the steps of the build from it.
+
+// WriteTrace writes the trace of the build to filename
+func WriteTrace(ctx context.Context, filename string, m *BuildMetrics, vertexes []progress.GraphVertex) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to create trace file")
+	}
+	if err := exportTrace(ctx, &fileClient{w: f}, m, vertexes); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write the build trace to %s", filename)
+	}
+	return f.Close()
+}
+
+// fileClient is an OTLP client writing the spans exported to w
+type fileClient struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ otlptrace.Client = &fileClient{}
+
+func (c *fileClient) Start(ctx context.Context) error {
+	return nil
+}
+
+func (c *fileClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (c *fileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	dt, err := protojson.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.w.Write(append(dt, '\n'))
+	return err
+}
+
+// ReadTrace reads the spans of a trace file
+func ReadTrace(r io.Reader) ([]*tracepb.Span, error) {
+	var res []*tracepb.Span
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err := protojson.Unmarshal(s.Bytes(), &req); err != nil {
+			return nil, errors.Wrap(err, "malformed trace, expected OTLP JSON")
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ils := range rs.InstrumentationLibrarySpans {
+				res = append(res, ils.Spans...)
+			}
+		}
+	}
+	return res, s.Err()
+}
+
+// TraceStatus returns the steps of the build the trace recorded as a solve
+// status, for a progress printer to show, and the metrics of the build
+func TraceStatus(spans []*tracepb.Span) (*client.SolveStatus, *BuildMetrics, error) {
+	var root *tracepb.Span
+	for _, s := range spans {
+		if len(s.ParentSpanId) == 0 {
+			root = s
+			break
+		}
+	}
+	if root == nil {
+		return nil, nil, errors.Errorf("the trace has no build span")
+	}
+	start := spanTime(root.StartTimeUnixNano)
+	m := &BuildMetrics{
+		BuildReport: BuildReport{
+			Image:       spanAttribute(root, "buildkit.image").GetStringValue(),
+			Digest:      spanAttribute(root, "buildkit.digest").GetStringValue(),
+			Error:       root.Status.GetMessage(),
+			Duration:    spanTime(root.EndTimeUnixNano).Sub(start),
+			Steps:       int(spanAttribute(root, "buildkit.steps").GetIntValue()),
+			CachedSteps: int(spanAttribute(root, "buildkit.cached_steps").GetIntValue()),
+		},
+		Builder:     spanAttribute(root, "buildkit.builder").GetStringValue(),
+		Pod:         spanAttribute(root, "buildkit.pod").GetStringValue(),
+		Start:       start,
+		PushedBytes: spanAttribute(root, "buildkit.pushed_bytes").GetIntValue(),
+	}
+	st := &client.SolveStatus{}
+	for _, s := range spans {
+		if s == root || string(s.ParentSpanId) != string(root.SpanId) {
+			continue
+		}
+		started, completed := spanTime(s.StartTimeUnixNano), spanTime(s.EndTimeUnixNano)
+		v := &client.Vertex{
+			Digest:    digest.Digest(spanAttribute(s, "buildkit.vertex").GetStringValue()),
+			Name:      s.Name,
+			Cached:    spanAttribute(s, "buildkit.cached").GetBoolValue(),
+			Started:   &started,
+			Completed: &completed,
+		}
+		if v.Digest == "" {
+			v.Digest = digest.FromBytes(s.SpanId)
+		}
+		if s.Status.GetCode() == tracepb.Status_STATUS_CODE_ERROR {
+			v.Error = s.Status.GetMessage()
+		}
+		st.Vertexes = append(st.Vertexes, v)
+	}
+	return st, m, nil
+}
+
+func spanTime(ns uint64) time.Time {
+	return time.Unix(0, int64(ns))
+}
+
+// spanAttribute returns the attribute key of s, nil if it has none
+func spanAttribute(s *tracepb.Span, key string) *commonpb.AnyValue {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
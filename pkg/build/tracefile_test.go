@@ -0,0 +1,55 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WriteTrace(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "trace")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "trace.otlp")
+
+	m, vertexes := testBuildMetrics()
+	m.AddGraph(vertexes, true)
+	m.Digest = "sha256:abc"
+	m.Error = "exit code 2"
+	require.NoError(t, WriteTrace(context.Background(), filename, m, vertexes))
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	spans, err := ReadTrace(f)
+	require.NoError(t, err)
+	require.Len(t, spans, 4)
+
+	st, read, err := TraceStatus(spans)
+	require.NoError(t, err)
+	require.Equal(t, m, read)
+	require.Len(t, st.Vertexes, 3)
+	byName := map[string]int{}
+	for i, v := range st.Vertexes {
+		byName[v.Name] = i
+	}
+	cached := st.Vertexes[byName["[1/2] FROM alpine"]]
+	require.True(t, cached.Cached)
+	require.Equal(t, *vertexes[0].Started, cached.Started.Local())
+	require.Equal(t, *vertexes[0].Completed, cached.Completed.Local())
+	require.Equal(t, "exit code 2", st.Vertexes[byName["[2/2] RUN make"]].Error)
+	require.NotEqual(t, cached.Digest, st.Vertexes[byName["exporting to image"]].Digest, "steps without a digest are told apart")
+
+	_, err = ReadTrace(strings.NewReader(`{"resource_spans": 1}`))
+	require.Error(t, err)
+	_, _, err = TraceStatus(nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,502 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+// A trust policy lists the keys and certificates the base images of a build
+// have to be signed with, by repository.  The signatures are verified on the
+// client before the build starts, and the build is pinned to the digests
+// they were verified for, so the builder can't pull an image the tag was
+// moved to in the meantime.  Cosign signatures are looked up with the
+// sha256-<digest>.sig tag cosign pushes them with, and Notation signatures
+// with the referrers tag scheme.
+
+const (
+	trustPolicyVersion = 1
+
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	notationMediaTypeJWS      = "application/jose+json"
+)
+
+// TrustPolicy selects how the base images of a build are verified, the first
+// entry matching an image applies and images matching none are rejected
+type TrustPolicy struct {
+	Version  int                `json:"version"`
+	Policies []TrustPolicyEntry `json:"policies"`
+}
+
+type TrustPolicyEntry struct {
+	// Images are the normalized repository names the entry applies to,
+	// where * matches any characters
+	Images []string `json:"images"`
+	// Cosign and Notation accept a signature of any of their keys or
+	// certificates, either is enough when both are set
+	Cosign   *CosignTrust   `json:"cosign,omitempty"`
+	Notation *NotationTrust `json:"notation,omitempty"`
+	// Skip trusts the images without checking their signatures
+	Skip bool `json:"skip,omitempty"`
+
+	re    []*regexp.Regexp
+	keys  []crypto.PublicKey
+	roots *x509.CertPool
+}
+
+type CosignTrust struct {
+	// Keys are PEM public key files, relative to the policy file
+	Keys []string `json:"keys"`
+}
+
+type NotationTrust struct {
+	// Certificates are PEM files of the trusted root certificates, relative
+	// to the policy file
+	Certificates []string `json:"certificates"`
+}
+
+// signatureResolver fetches images and their signatures, see imagetools.Resolver
+type signatureResolver interface {
+	imageResolver
+	Get(ctx context.Context, in string) ([]byte, ocispec.Descriptor, error)
+	GetDescriptor(ctx context.Context, in string, desc ocispec.Descriptor) ([]byte, error)
+	Referrers(ctx context.Context, in string, subject digest.Digest, artifactType string) ([]ocispec.Descriptor, error)
+}
+
+// LoadTrustPolicy reads and validates a trust policy file, and the keys and
+// certificates it refers to
+func LoadTrustPolicy(filename string) (*TrustPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read trust policy")
+	}
+	return ParseTrustPolicy(data, filepath.Dir(filename))
+}
+
+// ParseTrustPolicy parses a trust policy, the files it refers to are
+// relative to dir
+func ParseTrustPolicy(data []byte, dir string) (*TrustPolicy, error) {
+	var policy TrustPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, errors.Wrap(err, "malformed trust policy")
+	}
+	if policy.Version != trustPolicyVersion {
+		return nil, errors.Errorf("unsupported trust policy version %d", policy.Version)
+	}
+	read := func(file string) ([]byte, error) {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		return ioutil.ReadFile(file)
+	}
+	for i := range policy.Policies {
+		entry := &policy.Policies[i]
+		if len(entry.Images) == 0 {
+			return nil, errors.Errorf("trust policy %d: images are required", i)
+		}
+		if entry.Skip == (entry.Cosign != nil || entry.Notation != nil) {
+			return nil, errors.Errorf("trust policy %d: set either cosign or notation, or skip", i)
+		}
+		for _, image := range entry.Images {
+			expr := "^" + strings.Replace(regexp.QuoteMeta(image), `\*`, ".*", -1) + "$"
+			entry.re = append(entry.re, regexp.MustCompile(expr))
+		}
+		if entry.Cosign != nil {
+			if len(entry.Cosign.Keys) == 0 {
+				return nil, errors.Errorf("trust policy %d: cosign requires keys", i)
+			}
+			for _, file := range entry.Cosign.Keys {
+				dt, err := read(file)
+				if err != nil {
+					return nil, errors.Wrapf(err, "trust policy %d: failed to read cosign key", i)
+				}
+				key, err := parsePublicKey(dt)
+				if err != nil {
+					return nil, errors.Wrapf(err, "trust policy %d: invalid cosign key %s", i, file)
+				}
+				entry.keys = append(entry.keys, key)
+			}
+		}
+		if entry.Notation != nil {
+			if len(entry.Notation.Certificates) == 0 {
+				return nil, errors.Errorf("trust policy %d: notation requires certificates", i)
+			}
+			entry.roots = x509.NewCertPool()
+			for _, file := range entry.Notation.Certificates {
+				dt, err := read(file)
+				if err != nil {
+					return nil, errors.Wrapf(err, "trust policy %d: failed to read notation certificate", i)
+				}
+				if !entry.roots.AppendCertsFromPEM(dt) {
+					return nil, errors.Errorf("trust policy %d: no certificate in %s", i, file)
+				}
+			}
+		}
+	}
+	return &policy, nil
+}
+
+func parsePublicKey(dt []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(dt)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.Errorf("no PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, errors.Errorf("unsupported key type %T", key)
+}
+
+func (p *TrustPolicy) match(name string) *TrustPolicyEntry {
+	for i := range p.Policies {
+		for _, re := range p.Policies[i].re {
+			if re.MatchString(name) {
+				return &p.Policies[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Verify resolves image and checks it is signed as its entry requires, it
+// returns the digest the signature was verified for
+func (p *TrustPolicy) Verify(ctx context.Context, r signatureResolver, image string) (digest.Digest, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid image reference %q", image)
+	}
+	entry := p.match(named.Name())
+	if entry == nil {
+		return "", errors.Errorf("base image %s matches no trust policy", image)
+	}
+	_, desc, err := r.Resolve(ctx, image)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %s", image)
+	}
+	if entry.Skip {
+		return desc.Digest, nil
+	}
+	var reasons []string
+	if entry.Cosign != nil {
+		err := entry.verifyCosign(ctx, r, named.Name(), desc.Digest)
+		if err == nil {
+			return desc.Digest, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	if entry.Notation != nil {
+		err := entry.verifyNotation(ctx, r, named.Name(), desc.Digest)
+		if err == nil {
+			return desc.Digest, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return "", errors.Errorf("base image %s is not trusted: %s", image, strings.Join(reasons, "; "))
+}
+
+// VerifyBaseImages verifies the images and returns the lockfile pinning those
+// which aren't pinned yet to the digests they were verified for
+func (p *TrustPolicy) VerifyBaseImages(ctx context.Context, r signatureResolver, images []string) (*Lockfile, error) {
+	l := &Lockfile{Version: lockfileVersion, Images: map[string]string{}}
+	for _, image := range images {
+		dgst, err := p.Verify(ctx, r, image)
+		if err != nil {
+			return nil, err
+		}
+		key, pinned, err := lockKey(image)
+		if err != nil {
+			return nil, err
+		}
+		if !pinned {
+			l.Images[key] = dgst.String()
+		}
+	}
+	return l, nil
+}
+
+// cosignPayload is the simple signing payload cosign signs
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+func (e *TrustPolicyEntry) verifyCosign(ctx context.Context, r signatureResolver, repo string, dgst digest.Digest) error {
+	sigRef := repo + ":" + imagetools.ReferrersTag(dgst) + ".sig"
+	dt, _, err := r.Get(ctx, sigRef)
+	if err != nil {
+		if errdefs.IsNotFound(errors.Cause(err)) {
+			return errors.Errorf("no cosign signature")
+		}
+		return errors.Wrapf(err, "failed to fetch cosign signatures %s", sigRef)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(dt, &manifest); err != nil {
+		return errors.Wrapf(err, "invalid cosign signatures %s", sigRef)
+	}
+	for _, layer := range manifest.Layers {
+		sig, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		payload, err := r.GetDescriptor(ctx, sigRef, layer)
+		if err != nil {
+			return errors.Wrapf(err, "failed to fetch cosign signature payload of %s", sigRef)
+		}
+		if signedBy(e.keys, payload, sig) {
+			var p cosignPayload
+			if err := json.Unmarshal(payload, &p); err == nil && p.Critical.Image.DockerManifestDigest == dgst.String() {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("no cosign signature by a trusted key")
+}
+
+// signedBy checks sig is a signature of payload by one of keys, the way
+// cosign signs with them
+func signedBy(keys []crypto.PublicKey, payload, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			var rs struct{ R, S *big.Int }
+			if rest, err := asn1.Unmarshal(sig, &rs); err == nil && len(rest) == 0 && ecdsa.Verify(k, sum[:], rs.R, rs.S) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notationEnvelope is the JWS envelope of a Notation signature, in the JSON
+// serialization
+type notationEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		X5C [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type notationPayload struct {
+	TargetArtifact ocispec.Descriptor `json:"targetArtifact"`
+}
+
+func (e *TrustPolicyEntry) verifyNotation(ctx context.Context, r signatureResolver, repo string, dgst digest.Digest) error {
+	refs, err := r.Referrers(ctx, repo, dgst, imagetools.ArtifactTypeNotarySignature)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return errors.Errorf("no notation signature")
+	}
+	var reason error
+	for _, desc := range refs {
+		dt, err := r.GetDescriptor(ctx, repo+"@"+desc.Digest.String(), desc)
+		if err != nil {
+			return errors.Wrap(err, "failed to fetch notation signature")
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(dt, &manifest); err != nil {
+			return errors.Wrap(err, "invalid notation signature manifest")
+		}
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != notationMediaTypeJWS {
+				reason = errors.Errorf("unsupported notation signature envelope %s", layer.MediaType)
+				continue
+			}
+			envelope, err := r.GetDescriptor(ctx, repo+"@"+desc.Digest.String(), layer)
+			if err != nil {
+				return errors.Wrap(err, "failed to fetch notation signature envelope")
+			}
+			if reason = verifyNotationEnvelope(envelope, e.roots, dgst); reason == nil {
+				return nil
+			}
+		}
+	}
+	if reason == nil {
+		reason = errors.Errorf("no notation signature envelope")
+	}
+	return errors.Wrap(reason, "no notation signature by a trusted certificate")
+}
+
+// verifyNotationEnvelope checks the JWS envelope was signed for dgst with a
+// certificate chaining to roots
+func verifyNotationEnvelope(dt []byte, roots *x509.CertPool, dgst digest.Digest) error {
+	var env notationEnvelope
+	if err := json.Unmarshal(dt, &env); err != nil {
+		return errors.Wrap(err, "invalid notation signature envelope")
+	}
+	if len(env.Header.X5C) == 0 {
+		return errors.Errorf("notation signature without certificates")
+	}
+	var chain []*x509.Certificate
+	for _, der := range env.Header.X5C {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.Wrap(err, "invalid certificate in notation signature")
+		}
+		chain = append(chain, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return err
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(env.Protected)
+	if err != nil {
+		return errors.Wrap(err, "invalid notation signature header")
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return errors.Wrap(err, "invalid notation signature header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return errors.Wrap(err, "invalid notation signature")
+	}
+	if err := verifyJWS(header.Alg, chain[0].PublicKey, []byte(env.Protected+"."+env.Payload), sig); err != nil {
+		return err
+	}
+
+	dt, err = base64.RawURLEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return errors.Wrap(err, "invalid notation signature payload")
+	}
+	var payload notationPayload
+	if err := json.Unmarshal(dt, &payload); err != nil {
+		return errors.Wrap(err, "invalid notation signature payload")
+	}
+	if payload.TargetArtifact.Digest != dgst {
+		return errors.Errorf("notation signature is for %s", payload.TargetArtifact.Digest)
+	}
+	return nil
+}
+
+// verifyJWS checks a JWS signature of the algorithms Notation signs with
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h hash.Hash
+	var hashFunc crypto.Hash
+	switch alg {
+	case "PS256", "ES256":
+		h, hashFunc = sha256.New(), crypto.SHA256
+	case "PS384", "ES384":
+		h, hashFunc = sha512.New384(), crypto.SHA384
+	case "PS512", "ES512":
+		h, hashFunc = sha512.New(), crypto.SHA512
+	default:
+		return errors.Errorf("unsupported notation signature algorithm %q", alg)
+	}
+	h.Write(signed)
+	sum := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "PS") {
+			break
+		}
+		if err := rsa.VerifyPSS(k, hashFunc, sum, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return errors.Wrap(err, "invalid notation signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || len(sig)%2 != 0 {
+			break
+		}
+		// JWS ECDSA signatures are r and s, not ASN.1
+		n := len(sig) / 2
+		if !ecdsa.Verify(k, sum, new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])) {
+			return errors.Errorf("invalid notation signature")
+		}
+		return nil
+	}
+	return errors.Errorf("notation signature algorithm %s doesn't match its certificate", alg)
+}
+
+// FromImages returns the images a Dockerfile builds on or copies from as
+// they are built, once rewritten by the source policy and pinned by the
+// lockfile.  Images named by build args can't be known before the build and
+// fail.
+func FromImages(dockerfile []byte, policy *SourcePolicy, lockfile *Lockfile) ([]string, error) {
+	sources, err := dockerfileImageSources(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		if strings.Contains(src.image, "$") {
+			return nil, errors.Errorf("line %d: base image %s uses build args and can't be verified", src.node.StartLine, src.image)
+		}
+	}
+	seen := map[string]bool{}
+	var res []string
+	_, err = rewriteFromImages(dockerfile, func(image string) (string, error) {
+		if policy != nil {
+			var err error
+			if image, err = policy.Evaluate(image); err != nil {
+				return "", err
+			}
+		}
+		if lockfile != nil {
+			var err error
+			if image, err = lockfile.pin(image); err != nil {
+				return "", err
+			}
+		}
+		if !seen[image] {
+			seen[image] = true
+			res = append(res, image)
+		}
+		return image, nil
+	})
+	return res, err
+}
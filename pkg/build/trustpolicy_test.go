@@ -0,0 +1,271 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package build
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+)
+
+// fakeRegistry serves manifests by reference and blobs by digest
+type fakeRegistry struct {
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+	referrers map[digest.Digest][]ocispec.Descriptor
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		manifests: map[string][]byte{},
+		blobs:     map[digest.Digest][]byte{},
+		referrers: map[digest.Digest][]ocispec.Descriptor{},
+	}
+}
+
+func (r *fakeRegistry) Resolve(ctx context.Context, in string) (string, ocispec.Descriptor, error) {
+	dt, ok := r.manifests[in]
+	if !ok {
+		return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotFound, "%s", in)
+	}
+	return in, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(dt), Size: int64(len(dt))}, nil
+}
+
+func (r *fakeRegistry) Get(ctx context.Context, in string) ([]byte, ocispec.Descriptor, error) {
+	_, desc, err := r.Resolve(ctx, in)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	return r.manifests[in], desc, nil
+}
+
+func (r *fakeRegistry) GetDescriptor(ctx context.Context, in string, desc ocispec.Descriptor) ([]byte, error) {
+	dt, ok := r.blobs[desc.Digest]
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "%s", desc.Digest)
+	}
+	return dt, nil
+}
+
+func (r *fakeRegistry) Referrers(ctx context.Context, in string, subject digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	return r.referrers[subject], nil
+}
+
+func (r *fakeRegistry) addBlob(mediaType string, dt []byte, annotations map[string]string) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt)), Annotations: annotations}
+	r.blobs[desc.Digest] = dt
+	return desc
+}
+
+func (r *fakeRegistry) addImage(t *testing.T, ref string, layers ...ocispec.Descriptor) digest.Digest {
+	dt, err := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: layers})
+	require.NoError(t, err)
+	r.manifests[ref] = dt
+	r.blobs[digest.FromBytes(dt)] = dt
+	return digest.FromBytes(dt)
+}
+
+// cosignSign pushes a cosign signature of the image of repo at dgst
+func (r *fakeRegistry) cosignSign(t *testing.T, key *ecdsa.PrivateKey, repo string, dgst digest.Digest) {
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"` + repo + `"},"image":{"docker-manifest-digest":"` + dgst.String() + `"},"type":"cosign container image signature"},"optional":null}`)
+	sum := sha256.Sum256(payload)
+	rs, ss, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	require.NoError(t, err)
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{rs, ss})
+	require.NoError(t, err)
+	layer := r.addBlob("application/vnd.dev.cosign.simplesigning.v1+json", payload, map[string]string{
+		cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+	})
+	r.addImage(t, repo+":"+imagetools.ReferrersTag(dgst)+".sig", layer)
+}
+
+// notationSign pushes a Notation JWS signature of dgst by a certificate of ca
+func (r *fakeRegistry) notationSign(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, dgst digest.Digest) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	payload, err := json.Marshal(notationPayload{TargetArtifact: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst}})
+	require.NoError(t, err)
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","cty":"application/vnd.cncf.notary.payload.v1+json"}`))
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(protected + "." + encoded))
+	rs, ss, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	require.NoError(t, err)
+	sig := make([]byte, 64)
+	copy(sig[32-len(rs.Bytes()):32], rs.Bytes())
+	copy(sig[64-len(ss.Bytes()):], ss.Bytes())
+	env := notationEnvelope{Payload: encoded, Protected: protected, Signature: base64.RawURLEncoding.EncodeToString(sig)}
+	env.Header.X5C = [][]byte{der}
+	dt, err := json.Marshal(env)
+	require.NoError(t, err)
+	layer := r.addBlob(notationMediaTypeJWS, dt, nil)
+	manifest, err := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{layer}})
+	require.NoError(t, err)
+	r.referrers[dgst] = append(r.referrers[dgst], r.addBlob(ocispec.MediaTypeImageManifest, manifest, nil))
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "signing CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return ca, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func Test_TrustPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trustpolicy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cosign.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644))
+	ca, caKey, caPEM := newTestCA(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0644))
+	policyFile := filepath.Join(dir, "policy.json")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte(`{"version":1,"policies":[
+		{"images":["docker.io/library/*"],"cosign":{"keys":["cosign.pub"]}},
+		{"images":["registry.internal/*"],"notation":{"certificates":["ca.pem"]}},
+		{"images":["mirror.local/tools"],"skip":true}
+	]}`), 0644))
+	policy, err := LoadTrustPolicy(policyFile)
+	require.NoError(t, err)
+
+	r := newFakeRegistry()
+	golang := r.addImage(t, "docker.io/library/golang:1.16", r.addBlob(ocispec.MediaTypeImageLayer, []byte("golang"), nil))
+	r.cosignSign(t, key, "docker.io/library/golang", golang)
+	alpine := r.addImage(t, "docker.io/library/alpine:latest", r.addBlob(ocispec.MediaTypeImageLayer, []byte("alpine"), nil))
+	base := r.addImage(t, "registry.internal/team/base:1", r.addBlob(ocispec.MediaTypeImageLayer, []byte("base"), nil))
+	r.notationSign(t, ca, caKey, base)
+	tools := r.addImage(t, "mirror.local/tools:latest", r.addBlob(ocispec.MediaTypeImageLayer, []byte("tools"), nil))
+	r.addImage(t, "quay.io/other/image:latest")
+
+	dgst, err := policy.Verify(ctx, r, "docker.io/library/golang:1.16")
+	require.NoError(t, err)
+	require.Equal(t, golang, dgst)
+	dgst, err = policy.Verify(ctx, r, "registry.internal/team/base:1")
+	require.NoError(t, err)
+	require.Equal(t, base, dgst)
+	dgst, err = policy.Verify(ctx, r, "mirror.local/tools:latest")
+	require.NoError(t, err)
+	require.Equal(t, tools, dgst)
+
+	_, err = policy.Verify(ctx, r, "docker.io/library/alpine:latest")
+	require.EqualError(t, err, "base image docker.io/library/alpine:latest is not trusted: no cosign signature")
+	_, err = policy.Verify(ctx, r, "quay.io/other/image:latest")
+	require.EqualError(t, err, "base image quay.io/other/image:latest matches no trust policy")
+
+	// A signature of another key, or for another digest, isn't trusted
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	r.cosignSign(t, other, "docker.io/library/alpine", alpine)
+	_, err = policy.Verify(ctx, r, "docker.io/library/alpine:latest")
+	require.EqualError(t, err, "base image docker.io/library/alpine:latest is not trusted: no cosign signature by a trusted key")
+	r.cosignSign(t, key, "docker.io/library/alpine", golang)
+	sig := r.manifests["docker.io/library/alpine:"+imagetools.ReferrersTag(golang)+".sig"]
+	r.manifests["docker.io/library/alpine:"+imagetools.ReferrersTag(alpine)+".sig"] = sig
+	_, err = policy.Verify(ctx, r, "docker.io/library/alpine:latest")
+	require.EqualError(t, err, "base image docker.io/library/alpine:latest is not trusted: no cosign signature by a trusted key")
+
+	otherCA, otherKey, _ := newTestCA(t)
+	untrusted := r.addImage(t, "registry.internal/team/untrusted:1")
+	r.notationSign(t, otherCA, otherKey, untrusted)
+	_, err = policy.Verify(ctx, r, "registry.internal/team/untrusted:1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no notation signature by a trusted certificate")
+
+	l, err := policy.VerifyBaseImages(ctx, r, []string{"docker.io/library/golang:1.16", "registry.internal/team/base:1"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"docker.io/library/golang:1.16": golang.String(),
+		"registry.internal/team/base:1": base.String(),
+	}, l.Images)
+}
+
+func Test_ParseTrustPolicy(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []string{
+		`{"version":2,"policies":[]}`,
+		`{"version":1,"policies":[{"images":[],"skip":true}]}`,
+		`{"version":1,"policies":[{"images":["*"]}]}`,
+		`{"version":1,"policies":[{"images":["*"],"skip":true,"cosign":{"keys":["k"]}}]}`,
+		`{"version":1,"policies":[{"images":["*"],"cosign":{"keys":[]}}]}`,
+		`{"version":1,"policies":[{"images":["*"],"cosign":{"keys":["missing.pub"]}}]}`,
+	} {
+		_, err := ParseTrustPolicy([]byte(tc), "/nonexistent")
+		require.Error(t, err, tc)
+	}
+}
+
+func Test_FromImages(t *testing.T) {
+	t.Parallel()
+	dockerfile := []byte(`FROM golang:1.16 AS build
+FROM --platform=$BUILDPLATFORM alpine
+FROM build
+FROM busybox@sha256:0000000000000000000000000000000000000000000000000000000000000000
+FROM scratch
+FROM golang:1.16
+`)
+	images, err := FromImages(dockerfile, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"golang:1.16", "alpine", "busybox@sha256:0000000000000000000000000000000000000000000000000000000000000000"}, images)
+
+	l := &Lockfile{Version: lockfileVersion, Images: map[string]string{
+		"docker.io/library/golang:1.16":   digest.FromString("golang").String(),
+		"docker.io/library/alpine:latest": digest.FromString("alpine").String(),
+	}}
+	images, err = FromImages(dockerfile, nil, l)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"docker.io/library/golang:1.16@" + digest.FromString("golang").String(),
+		"docker.io/library/alpine:latest@" + digest.FromString("alpine").String(),
+		"busybox@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}, images)
+
+	_, err = FromImages([]byte(lockDockerfile), nil, nil)
+	require.EqualError(t, err, "line 6: base image ${BASE} uses build args and can't be verified")
+}
@@ -18,3 +18,10 @@ func Test_toBuildkitExtraHosts(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, resp, "")
 }
+
+func Test_FormatBytes(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "512B", FormatBytes(512))
+	assert.Equal(t, "1.5KiB", FormatBytes(1536))
+	assert.Equal(t, "2.0GiB", FormatBytes(2<<30))
+}
@@ -0,0 +1,160 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// attestationFlags returns the --attest values with the --sbom and
+// --provenance shorthands, which come last and win
+func attestationFlags(in buildOptions) []string {
+	res := append([]string{}, in.attest...)
+	if in.sbom != "" {
+		res = append(res, build.AttestationShorthand("sbom", in.sbom))
+	}
+	if in.provenance != "" {
+		res = append(res, build.AttestationShorthand("provenance", in.provenance))
+	}
+	return res
+}
+
+// addProvenance attaches the provenance of each target to the image it pushes.
+// The materials are the base images of a local Dockerfile, a remote one is
+// recorded without them.
+func addProvenance(ctx context.Context, in buildOptions, targets map[string]build.Options, mode, contextSource, contextPathHash string) error {
+	p := build.ProvenanceOpt{Mode: mode, Started: time.Now()}
+	dockerfile, dt, err := readLocalDockerfile(in, "--provenance")
+	switch {
+	case urlutil.IsGitURL(in.contextPath):
+		p.Source.URI = in.contextPath
+	case in.dockerfileIn == "" && err == nil:
+		rev := in.gitContext
+		if rev == "" {
+			rev = "HEAD"
+		}
+		if p.Source, err = build.GitProvenanceSource(ctx, contextSource, rev); err != nil {
+			logrus.Debugf("the provenance has no git source: %s", err)
+		}
+		if rel, err := filepath.Rel(in.contextPath, dockerfile); err == nil {
+			p.Source.EntryPoint = filepath.ToSlash(rel)
+		}
+	}
+	if dt != nil {
+		var opt build.Options
+		for _, o := range targets {
+			opt = o
+			break
+		}
+		images, err := build.FromImages(dt, opt.Inputs.SourcePolicy, opt.Inputs.Lockfile)
+		if err != nil {
+			logrus.Warnf("the provenance has no materials: %s", err)
+		} else {
+			d, err := getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash, in.size, in.nodes)
+			if err != nil {
+				return err
+			}
+			resolver := imagetools.New(imagetools.Opt{Auth: d.GetAuthWrapper(in.registrySecretName)})
+			if p.Materials, err = build.ProvenanceMaterials(ctx, resolver, images); err != nil {
+				return err
+			}
+		}
+	}
+	for name, o := range targets {
+		ref, err := build.NewProvenance(o, p)
+		if err != nil {
+			return err
+		}
+		o.Referrers = append(append([]imagetools.Referrer{}, o.Referrers...), ref)
+		targets[name] = o
+	}
+	return nil
+}
+
+// attachSBOMs scans the images the targets pushed with the generator on the
+// builder, and attaches their SBOMs.  The SBOMs are added to the referrers of
+// the targets for --attestation-dir.
+func attachSBOMs(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, targets map[string]build.Options, resp map[string]*client.SolveResponse, generator, contextPathHash string) error {
+	d, err := getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash, in.size, in.nodes)
+	if err != nil {
+		return err
+	}
+	auth := d.GetAuthWrapper(in.registrySecretName)
+	entrypoint, err := imagetools.New(imagetools.Opt{Auth: auth}).Entrypoint(ctx, generator)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the SBOM generator")
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := targets[name]
+		image, err := pushedImage(o, resp[name])
+		if err != nil {
+			return errors.Wrapf(err, "failed to scan %s", name)
+		}
+		refs, err := scanImage(ctx, in, d, image, generator, entrypoint, o)
+		if err != nil {
+			return errors.Wrapf(err, "failed to generate the SBOM of %s", image)
+		}
+		pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+		if err := build.AttachReferrers(ctx, pw, auth, o, resp[name], refs); err != nil {
+			return err
+		}
+		fmt.Fprintf(streams.ErrOut, "attached %d SBOMs to %s\n", len(refs), image)
+		o.Referrers = append(append([]imagetools.Referrer{}, o.Referrers...), refs...)
+		targets[name] = o
+	}
+	return nil
+}
+
+// pushedImage returns the first name the image of o was pushed to, by digest
+func pushedImage(o build.Options, res *client.SolveResponse) (string, error) {
+	names := pushedNames(o)
+	if len(names) == 0 || res == nil || res.ExporterResponse["containerimage.digest"] == "" {
+		return "", errors.Errorf("the build didn't report the name and digest of its image")
+	}
+	named, err := reference.ParseNormalizedNamed(names[0])
+	if err != nil {
+		return "", err
+	}
+	return named.Name() + "@" + res.ExporterResponse["containerimage.digest"], nil
+}
+
+// scanImage runs the SBOM generator on image and returns its SBOMs
+func scanImage(ctx context.Context, in buildOptions, d driver.Driver, image, generator string, entrypoint []string, o build.Options) ([]imagetools.Referrer, error) {
+	dir, err := ioutil.TempDir("", "sbom")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	scan, err := build.SBOMScanOptions(image, generator, entrypoint, o.Platforms, dir)
+	if err != nil {
+		return nil, err
+	}
+	pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+	_, err = build.Build(ctx, []build.DriverInfo{{Name: in.builder, Driver: d}}, map[string]build.Options{"sbom": scan}, in.KubeClientConfig, in.registrySecretName, pw)
+	if err != nil {
+		return nil, err
+	}
+	return build.ReadSBOMs(dir)
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type bakeOptions struct {
+	builder            string
+	files              []string
+	push               bool
+	load               bool
+	noCache            bool
+	pull               bool
+	print              bool
+	progress           string
+	registrySecretName string
+	commonKubeOptions
+}
+
+func runBake(streams genericclioptions.IOStreams, in bakeOptions, names []string) error {
+	ctx := appcontext.Context()
+
+	files := in.files
+	if len(files) == 0 {
+		for _, f := range build.BakeDefaultFiles {
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			return errors.Errorf("no bake file found, create docker-bake.json or docker-compose.yml, or set --file")
+		}
+	}
+	cfg, err := build.ReadBakeFiles(files)
+	if err != nil {
+		return err
+	}
+	targets, err := cfg.Resolve(names)
+	if err != nil {
+		return err
+	}
+	if in.print {
+		enc := json.NewEncoder(streams.Out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(build.BakeConfig{Targets: targets})
+	}
+	if in.push && in.load {
+		return errors.Errorf("push and load may not be set together at the moment")
+	}
+
+	opts := map[string]build.Options{}
+	for name, t := range targets {
+		o, err := t.Options()
+		if err != nil {
+			return errors.Wrapf(err, "target %s", name)
+		}
+		if in.noCache {
+			o.NoCache = true
+		}
+		if in.pull {
+			o.PullPolicy = build.PullAlways
+		}
+		if err := bakeOutputs(&o, in.push, in.load); err != nil {
+			return errors.Wrapf(err, "target %s", name)
+		}
+		if build.HasPVCOutput(o.Exports) {
+			return errors.Errorf("target %s: pvc outputs are not supported by bake", name)
+		}
+		o.BuildID = identity.NewID()
+		opts[name] = o
+	}
+	names = make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Each target is a build of its own, so the pod chooser of the builder
+	// places it, on the pod its context sticks to by default
+	drivers := map[string]driver.Driver{}
+	for _, name := range names {
+		contextPathHash, err := filepath.Abs(opts[name].Inputs.ContextPath)
+		if err != nil {
+			contextPathHash = opts[name].Inputs.ContextPath
+		}
+		if drivers[name], err = getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash, "", nil); err != nil {
+			return err
+		}
+	}
+	pw := progress.NewPrinter(ctx, os.Stderr, progress.MultiTargetMode(in.progress, len(opts)))
+	mw := progress.NewMultiWriter(pw)
+	writers := map[string]progress.Writer{}
+	for _, name := range names {
+		writers[name] = mw.WithPrefix(name, len(names) > 1)
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, name := range names {
+		name := name
+		eg.Go(func() error {
+			_, err := build.Build(ctx, []build.DriverInfo{{Name: in.builder, Driver: drivers[name]}}, map[string]build.Options{name: opts[name]}, in.KubeClientConfig, in.registrySecretName, writers[name])
+			return errors.Wrapf(err, "target %s", name)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	fmt.Fprintf(streams.ErrOut, "built %d targets\n", len(names))
+	return nil
+}
+
+// bakeOutputs applies --push and --load to the output of a target
+func bakeOutputs(o *build.Options, push, load bool) error {
+	exports, err := applyPushLoad(o.Exports, push, load)
+	if err != nil {
+		return err
+	}
+	o.Exports = exports
+	return build.NameOutputs(o.Exports, o.Tags)
+}
+
+func bakeCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := bakeOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "bake [OPTIONS] [TARGET...]",
+		Short: "Build the targets of a bake or compose file at once",
+		Long: `Build the targets of a bake or compose file at once
+
+Each target is built as a separate build, all of them concurrently, so they
+spread over the pods of the builder.  The targets are read from the JSON
+format of docker buildx bake, or from the services of a compose file with a
+build section.  Convert an HCL bake file with:
+  docker buildx bake -f docker-bake.hcl --print > docker-bake.json
+
+Without targets the "default" group or target is built, or every target.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runBake(streams, options, args)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringArrayVarP(&options.files, "file", "f", []string{}, "Bake or compose file, merged in order (default: docker-compose.yml, docker-bake.json and docker-bake.override.json when present)")
+	flags.BoolVar(&options.push, "push", false, "Push the images of the targets to their registries")
+	flags.BoolVar(&options.load, "load", false, "Load the images of the targets in the builder's runtime")
+	flags.BoolVar(&options.noCache, "no-cache", false, "Do not use cache when building the images")
+	flags.BoolVar(&options.pull, "pull", false, "Always attempt to pull newer versions of the base images")
+	flags.BoolVar(&options.print, "print", false, "Print the resolved targets as JSON instead of building them")
+	flags.StringVar(&options.progress, "progress", "auto", "Set type of progress output (auto, plain, tty, grouped)")
+	flags.StringVar(&options.registrySecretName, "registry-secret", "", "specify registry pull secret for pull/push operations (defaults to builder name)")
+
+	return cmd
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// buildIDHook adds the ID of the build to every log entry of the CLI, the
+// builder records the same ID with the build, see Driver.RecordBuild
+type buildIDHook string
+
+// addBuildIDHook adds the hook of the build id to the standard logger, until
+// the returned func is called
+func addBuildIDHook(id string) func() {
+	logger := logrus.StandardLogger()
+	hooks := logrus.LevelHooks{}
+	for level, h := range logger.Hooks {
+		hooks[level] = append([]logrus.Hook{}, h...)
+	}
+	logger.AddHook(buildIDHook(id))
+	return func() {
+		logger.ReplaceHooks(hooks)
+	}
+}
+
+func (h buildIDHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h buildIDHook) Fire(e *logrus.Entry) error {
+	e.Data["build"] = string(h)
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHook records the data of the entries logged
+type recordingHook struct {
+	data []logrus.Fields
+}
+
+func (h *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingHook) Fire(e *logrus.Entry) error {
+	h.data = append(h.data, e.Data)
+	return nil
+}
+
+func Test_addBuildIDHook(t *testing.T) {
+	logger := logrus.StandardLogger()
+	out := logger.Out
+	logger.SetOutput(ioutil.Discard)
+	defer logger.SetOutput(out)
+	h := &recordingHook{}
+	defer logger.ReplaceHooks(logger.ReplaceHooks(logrus.LevelHooks{}))
+	logger.AddHook(h)
+
+	remove := addBuildIDHook("abc")
+	logrus.Warn("during the build")
+	remove()
+	logrus.Warn("after the build")
+
+	require.Len(t, h.data, 2)
+	require.Equal(t, "abc", h.data[0]["build"])
+	require.NotContains(t, h.data[1], "build")
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type cancelOptions struct {
+	id  string
+	all bool
+}
+
+func runCancel(streams genericclioptions.IOStreams, rootOpts *rootOptions, cmd *cobra.Command, in cancelOptions) error {
+	ctx := appcontext.Context()
+	d, err := rootBuilderDriver(ctx, rootOpts, cmd, nil)
+	if err != nil {
+		return err
+	}
+	cancelled, err := build.CancelBuild(ctx, d, in.id)
+	printCancelled(streams.Out, rootOpts.resolved.Builder, cancelled, err)
+	return err
+}
+
+// printCancelled reports the builds cancelled on builder, or that none were
+// running unless the cancel failed with err
+func printCancelled(w io.Writer, builder string, cancelled []build.CancelledBuild, err error) {
+	for _, c := range cancelled {
+		if c.ID != "" {
+			fmt.Fprintf(w, "cancelled %s on %s\n", c.ID, c.Node)
+		} else {
+			fmt.Fprintf(w, "cancelled the builds on %s\n", c.Node)
+		}
+	}
+	if err == nil && len(cancelled) == 0 {
+		fmt.Fprintf(w, "no builds running on builder %s\n", builder)
+	}
+}
+
+func cancelCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	var options cancelOptions
+
+	cmd := &cobra.Command{
+		Use:   "cancel [ID | --all]",
+		Short: "Cancel running builds of the builder",
+		Long: `Cancel running builds of the builder
+
+Cancels the build ID printed when it started, attached or detached, or with
+--all every build running on the builder.  The solve stops on the builder
+pod, freeing its workers and locks, and the client of the build fails.`,
+		Example: `  kubectl buildkit cancel 8a3kfq2x0vn1w9h2l5rj4e7pd
+  kubectl buildkit cancel --all --builder shared`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.id = args[0]
+			}
+			if (options.id == "") == !options.all {
+				return errors.Errorf("specify either the ID of a build or --all")
+			}
+			return runCancel(streams, rootOpts, cmd, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.BoolVar(&options.all, "all", false, "Cancel all the builds running on the builder")
+
+	return cmd
+}
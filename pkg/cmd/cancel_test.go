@@ -0,0 +1,74 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func Test_cancelCmdArgs(t *testing.T) {
+	t.Parallel()
+	streams := genericclioptions.IOStreams{Out: ioutil.Discard, ErrOut: ioutil.Discard}
+	for _, args := range [][]string{
+		{},
+		{"abc123", "--all"},
+		{"abc123", "def456"},
+	} {
+		cmd := cancelCmd(streams, &rootOptions{})
+		cmd.SetArgs(args)
+		cmd.SetOut(ioutil.Discard)
+		cmd.SetErr(ioutil.Discard)
+		assert.Error(t, cmd.Execute(), "%v", args)
+	}
+}
+
+func Test_printCancelled(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name      string
+		cancelled []build.CancelledBuild
+		err       error
+		want      string
+	}{
+		{
+			name:      "build",
+			cancelled: []build.CancelledBuild{{ID: "abc123", Node: "buildkit-a"}},
+			want:      "cancelled abc123 on buildkit-a\n",
+		},
+		{
+			name:      "all",
+			cancelled: []build.CancelledBuild{{Node: "buildkit-a"}, {Node: "buildkit-b"}},
+			want:      "cancelled the builds on buildkit-a\ncancelled the builds on buildkit-b\n",
+		},
+		{
+			name: "none running",
+			want: "no builds running on builder buildkit\n",
+		},
+		{
+			name: "not running",
+			err:  errors.New(`build "abc123" is not running on the builder`),
+		},
+		{
+			name:      "failed part way",
+			cancelled: []build.CancelledBuild{{Node: "buildkit-a"}},
+			err:       errors.New("failed to cancel builds on buildkit-b"),
+			want:      "cancelled the builds on buildkit-a\n",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			buf := &bytes.Buffer{}
+			printCancelled(buf, "buildkit", tc.cancelled, tc.err)
+			require.Equal(t, tc.want, buf.String())
+		})
+	}
+}
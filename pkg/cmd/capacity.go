@@ -0,0 +1,72 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// capacityDir is where the disk space taken by the builds run with
+// --check-capacity is recorded, by image
+func capacityDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kubectl-build", "capacity"), nil
+}
+
+// setCapacityChecks estimates what each target needs on the builder pod,
+// from the size of the local build context and the most the previous builds
+// of its image took, and records what it takes this time
+func setCapacityChecks(in buildOptions, targets map[string]build.Options, contextPathHash string) error {
+	var memory int64
+	if in.buildMemory != "" {
+		q, err := resource.ParseQuantity(in.buildMemory)
+		if err != nil {
+			return errors.Errorf("invalid --build-memory %q, use a quantity like 4Gi", in.buildMemory)
+		}
+		memory = q.Value()
+	}
+	var contextSize int64
+	if in.contextPath != "-" && !urlutil.IsGitURL(in.contextPath) && !urlutil.IsURL(in.contextPath) {
+		usage, err := build.MeasureContext(in.contextPath)
+		if err != nil {
+			return errors.Wrap(err, "failed to measure the build context")
+		}
+		contextSize = usage.Size
+	}
+	dir, err := capacityDir()
+	if err != nil {
+		return err
+	}
+	for name, o := range targets {
+		// Untagged images are recorded by their context
+		key := contextPathHash
+		if len(o.Tags) > 0 {
+			key = o.Tags[0]
+		}
+		peak, err := build.LoadPeakDiskUsage(dir, key)
+		if err != nil {
+			return err
+		}
+		o.Capacity = &build.CapacityCheck{
+			Disk:   contextSize + peak,
+			Memory: memory,
+			Record: func(size int64) {
+				if err := build.RecordPeakDiskUsage(dir, key, size); err != nil {
+					logrus.Debugf("failed to record the disk usage of %s: %v", key, err)
+				}
+			},
+		}
+		targets[name] = o
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/console"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// contextEntriesShown is the number of the largest context entries listed
+// when the context is over --context-warn-size
+const contextEntriesShown = 10
+
+// checkContextSize appends the --context-exclude patterns to the
+// .dockerignore of the local build context, then measures the context.  A
+// context over --context-warn-size is broken down by its largest entries, and
+// with --context-prompt on a terminal the user may pick some to exclude before
+// the upload starts.  A context over --context-max-size fails the build.
+func checkContextSize(streams genericclioptions.IOStreams, in buildOptions) error {
+	if in.contextPath == "-" || urlutil.IsGitURL(in.contextPath) || urlutil.IsURL(in.contextPath) {
+		if len(in.contextExclude) > 0 {
+			return errors.Errorf("--context-exclude requires a local build context")
+		}
+		return nil
+	}
+	warnSize, err := parseContextSize("--context-warn-size", in.contextWarnSize)
+	if err != nil {
+		return err
+	}
+	maxSize, err := parseContextSize("--context-max-size", in.contextMaxSize)
+	if err != nil {
+		return err
+	}
+	if len(in.contextExclude) > 0 {
+		if err := build.AppendDockerignore(in.contextPath, in.contextExclude); err != nil {
+			return errors.Wrap(err, "failed to update .dockerignore")
+		}
+	}
+	if warnSize == 0 && maxSize == 0 {
+		return nil
+	}
+	usage, err := build.MeasureContext(in.contextPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to measure the build context")
+	}
+	if warnSize > 0 && usage.Size > warnSize {
+		fmt.Fprintf(streams.ErrOut, "WARNING: the build context is %s in %d files, above --context-warn-size %s, largest entries:\n", build.FormatBytes(usage.Size), usage.Files, build.FormatBytes(warnSize))
+		writeContextEntries(streams, usage)
+		if in.contextPrompt && isTerminal(streams) {
+			excludes, err := promptContextExcludes(streams, usage)
+			if err != nil {
+				return err
+			}
+			if len(excludes) > 0 {
+				if err := build.AppendDockerignore(in.contextPath, excludes); err != nil {
+					return errors.Wrap(err, "failed to update .dockerignore")
+				}
+				if usage, err = build.MeasureContext(in.contextPath); err != nil {
+					return errors.Wrap(err, "failed to measure the build context")
+				}
+				fmt.Fprintf(streams.ErrOut, "added %s to .dockerignore, the build context is now %s\n", strings.Join(excludes, ", "), build.FormatBytes(usage.Size))
+			}
+		} else {
+			fmt.Fprintf(streams.ErrOut, "exclude entries with --context-exclude, which adds them to .dockerignore\n")
+		}
+	}
+	if maxSize > 0 && usage.Size > maxSize {
+		return errors.Errorf("the build context is %s, above --context-max-size %s, exclude entries with --context-exclude or .dockerignore", build.FormatBytes(usage.Size), build.FormatBytes(maxSize))
+	}
+	return nil
+}
+
+func parseContextSize(flag, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil || q.Sign() < 0 {
+		return 0, errors.Errorf("invalid %s %q", flag, s)
+	}
+	return q.Value(), nil
+}
+
+func writeContextEntries(streams genericclioptions.IOStreams, usage *build.ContextUsage) {
+	w := tabwriter.NewWriter(streams.ErrOut, 0, 0, 2, ' ', 0)
+	for i, e := range usage.Entries {
+		if i == contextEntriesShown {
+			break
+		}
+		name := e.Path
+		if e.Dir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "  %d)\t%s\t%s\t%d files\n", i+1, name, build.FormatBytes(e.Size), e.Files)
+	}
+	w.Flush()
+}
+
+// promptContextExcludes asks which of the listed entries to exclude
+func promptContextExcludes(streams genericclioptions.IOStreams, usage *build.ContextUsage) ([]string, error) {
+	shown := len(usage.Entries)
+	if shown > contextEntriesShown {
+		shown = contextEntriesShown
+	}
+	for {
+		fmt.Fprintf(streams.ErrOut, "Entries to add to .dockerignore (e.g. 1,3), empty to build as is: ")
+		line, err := bufio.NewReader(streams.In).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, nil
+		}
+		excludes, err := parseContextSelection(strings.TrimSpace(line), usage.Entries[:shown])
+		if err == nil {
+			return excludes, nil
+		}
+		fmt.Fprintf(streams.ErrOut, "%v\n", err)
+	}
+}
+
+func parseContextSelection(s string, entries []build.ContextEntry) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var res []string
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 || n > len(entries) {
+			return nil, errors.Errorf("invalid entry %q, pick from 1 to %d", strings.TrimSpace(field), len(entries))
+		}
+		res = append(res, entries[n-1].Path)
+	}
+	return res, nil
+}
+
+// isTerminal tells whether the input of the command is an interactive terminal
+func isTerminal(streams genericclioptions.IOStreams) bool {
+	f, ok := streams.In.(*os.File)
+	if !ok {
+		return false
+	}
+	_, err := console.ConsoleFromFile(f)
+	return err == nil
+}
@@ -3,22 +3,32 @@
 package commands
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/notify"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/version"
 
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 
 	"github.com/google/shlex"
+	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/util/appcontext"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 const (
@@ -43,6 +53,76 @@ type createOptions struct {
 	progress            string
 	customConfig        string
 	envs                []string
+	allowEntitlements   []string
+	maxParallelism      int
+	maxParallelBuilds   int
+	preemptionPriority  int
+	notify              []string
+	networkPolicy       bool
+	networkPolicyEgress []string
+	egressAllow         []string
+	egressProxyImage    string
+	packageProxy        bool
+	packageProxyImage   string
+	packageProxySize    string
+	meshCompatible      bool
+	meshExcludePorts    []int
+	ipFamily            string
+	defaultPlatform     string
+	runCacheClaim       string
+	runCacheScope       string
+	patch               string
+	fromExport          string
+	scaleDownIdle       time.Duration
+	allowHostPaths      []string
+	scratchSize         string
+	scratchStorageClass string
+	outputClaims        []string
+	replicaClasses      []string
+	fallbackBuilder     string
+	readOnlyRootFS      bool
+	writablePaths       []string
+	historyMaxRecords   int
+	historyMaxAge       time.Duration
+	deploymentKind      string
+	cacheStorage        string
+	cacheSize           string
+	storageClass        string
+	binfmtImage         string
+	binfmtPlatforms     []string
+	scaleOnQueue        bool
+	replicasMin         int
+	replicasMax         int
+	tls                 bool
+	tlsSecret           string
+	nodeSelector        []string
+	tolerations         []string
+	affinity            string
+	requests            string
+	limits              string
+	priorityClass       string
+	output              string
+	dryRun              bool
+	gcThreshold         int
+	gcKeepStorage       string
+	buildIOLimits       string
+	wait                bool
+	noWait              bool
+	waitTimeout         time.Duration
+	waitInterval        time.Duration
+	waitMaxInterval     time.Duration
+	transport           string
+	adminService        bool
+	metricsPort         int
+	sharedCache         bool
+	sharedCacheImage    string
+	sharedCacheSize     string
+	httpProxy           string
+	httpsProxy          string
+	noProxy             string
+	proxyFromEnv        bool
+	securityProfile     string
+	seccompProfile      string
 }
 
 func runCreate(streams genericclioptions.IOStreams, in createOptions, rootOpts *rootOptions) error {
@@ -51,6 +131,21 @@ func runCreate(streams genericclioptions.IOStreams, in createOptions, rootOpts *
 	if in.name == "default" {
 		return errors.Errorf("default is a reserved name and cannot be used to identify builder instance")
 	}
+	if err := validateOutputFormat(in.output); err != nil {
+		return err
+	}
+	if _, err := notify.ParseSinks(in.notify); err != nil {
+		return err
+	}
+	if in.fallbackBuilder != "" {
+		if _, err := parseFallbackBuilder(in.fallbackBuilder); err != nil {
+			return err
+		}
+	}
+
+	if in.proxyFromEnv {
+		setProxyFromEnv(&in)
+	}
 
 	driverFactory := driver.GetFactory(DefaultDriver, true)
 	if driverFactory == nil {
@@ -66,36 +161,240 @@ func runCreate(streams genericclioptions.IOStreams, in createOptions, rootOpts *
 		}
 	}
 
+	// The affinity is passed and recorded by content
+	var affinity []byte
+	if in.affinity != "" {
+		dt, err := ioutil.ReadFile(in.affinity)
+		if err != nil {
+			return errors.Wrap(err, "failed to read affinity")
+		}
+		a, err := manifest.ParseAffinity(dt)
+		if err != nil {
+			return errors.Wrapf(err, "invalid affinity %s", in.affinity)
+		}
+		if affinity, err = json.Marshal(a); err != nil {
+			return err
+		}
+	}
+
+	// The notification sinks are passed as a JSON list, their URLs may hold
+	// commas
+	var notify []byte
+	if len(in.notify) > 0 {
+		if notify, err = json.Marshal(in.notify); err != nil {
+			return err
+		}
+	}
+
 	// TODO: consider swapping this out and passing the createOptions directly instead of
 	//       using a hashmap
 	driverOpts := map[string]string{
-		"image":                in.image,
-		"replicas":             strconv.Itoa(in.replicas),
-		"rootless":             strconv.FormatBool(in.rootless),
-		"loadbalance":          in.loadbalance,
-		"worker":               in.worker,
-		"containerd-namespace": in.containerdNamespace,
-		"containerd-sock":      in.containerdSock,
-		"docker-sock":          in.dockerSock,
-		"runtime":              in.runtime,
-		"custom-config":        in.customConfig,
-		"env":                  strings.Join(in.envs, ";"),
-	}
-
-	d, err := driver.GetDriver(ctx, in.name, driverFactory, rootOpts.KubeClientConfig, flags, in.configFile, driverOpts, "" /*contextPathHash*/)
+		"image":                       in.image,
+		"replicas":                    strconv.Itoa(in.replicas),
+		"rootless":                    strconv.FormatBool(in.rootless),
+		"loadbalance":                 in.loadbalance,
+		"worker":                      in.worker,
+		"containerd-namespace":        in.containerdNamespace,
+		"containerd-sock":             in.containerdSock,
+		"docker-sock":                 in.dockerSock,
+		"runtime":                     in.runtime,
+		"custom-config":               in.customConfig,
+		"env":                         strings.Join(in.envs, ";"),
+		"allow-insecure-entitlements": strings.Join(in.allowEntitlements, ","),
+		"max-parallelism":             strconv.Itoa(in.maxParallelism),
+		"max-parallel-builds":         strconv.Itoa(in.maxParallelBuilds),
+		"preemption-priority":         strconv.Itoa(in.preemptionPriority),
+		"notify":                      string(notify),
+		"network-policy":              strconv.FormatBool(in.networkPolicy),
+		"network-policy-egress":       strings.Join(in.networkPolicyEgress, ","),
+		"egress-allow":                strings.Join(in.egressAllow, ","),
+		"egress-proxy-image":          in.egressProxyImage,
+		"package-proxy":               strconv.FormatBool(in.packageProxy),
+		"package-proxy-image":         in.packageProxyImage,
+		"package-proxy-size":          in.packageProxySize,
+		"mesh-compatible":             strconv.FormatBool(in.meshCompatible),
+		"ip-family":                   in.ipFamily,
+		"default-platform":            in.defaultPlatform,
+		"run-cache-claim":             in.runCacheClaim,
+		"run-cache-scope":             in.runCacheScope,
+		"patch":                       in.patch,
+		"scale-down-idle":             in.scaleDownIdle.String(),
+		"allow-host-paths":            strings.Join(in.allowHostPaths, ","),
+		"scratch-size":                in.scratchSize,
+		"scratch-storage-class":       in.scratchStorageClass,
+		"output-claims":               strings.Join(in.outputClaims, ","),
+		"replica-classes":             strings.Join(in.replicaClasses, ";"),
+		"fallback-builder":            in.fallbackBuilder,
+		"read-only-root-fs":           strconv.FormatBool(in.readOnlyRootFS),
+		"writable-paths":              strings.Join(in.writablePaths, ","),
+		"history-max-records":         strconv.Itoa(in.historyMaxRecords),
+		"history-max-age":             in.historyMaxAge.String(),
+		"deployment-kind":             in.deploymentKind,
+		"cache-storage":               in.cacheStorage,
+		"cache-size":                  in.cacheSize,
+		"storage-class":               in.storageClass,
+		"binfmt-image":                in.binfmtImage,
+		"binfmt-platforms":            strings.Join(in.binfmtPlatforms, ","),
+		"scale-on-queue":              strconv.FormatBool(in.scaleOnQueue),
+		"replicas-min":                strconv.Itoa(in.replicasMin),
+		"replicas-max":                strconv.Itoa(in.replicasMax),
+		"tls":                         strconv.FormatBool(in.tls),
+		"tls-secret":                  in.tlsSecret,
+		"transport":                   in.transport,
+		"admin-service":               strconv.FormatBool(in.adminService),
+		"metrics-port":                strconv.Itoa(in.metricsPort),
+		"node-selector":               strings.Join(in.nodeSelector, ","),
+		"tolerations":                 strings.Join(in.tolerations, ","),
+		"affinity":                    string(affinity),
+		"requests":                    in.requests,
+		"limits":                      in.limits,
+		"priority-class":              in.priorityClass,
+		"gc-threshold":                strconv.Itoa(in.gcThreshold),
+		"gc-keep-storage":             in.gcKeepStorage,
+		"build-io-limits":             in.buildIOLimits,
+		"shared-cache":                strconv.FormatBool(in.sharedCache),
+		"shared-cache-image":          in.sharedCacheImage,
+		"shared-cache-size":           in.sharedCacheSize,
+		"http-proxy":                  in.httpProxy,
+		"https-proxy":                 in.httpsProxy,
+		"no-proxy":                    in.noProxy,
+		"security-profile":            in.securityProfile,
+		"seccomp-profile":             in.seccompProfile,
+	}
+	meshPorts := make([]string, len(in.meshExcludePorts))
+	for i, p := range in.meshExcludePorts {
+		meshPorts[i] = strconv.Itoa(p)
+	}
+	driverOpts["mesh-exclude-outbound-ports"] = strings.Join(meshPorts, ",")
+
+	configFile := in.configFile
+	if in.fromExport != "" {
+		cfg, err := loadBuilderConfig(in.fromExport)
+		if err != nil {
+			return err
+		}
+		if cfg.Driver != "" && cfg.Driver != driverFactory.Name() {
+			return errors.Errorf("builder config %s is for the %s driver", in.fromExport, cfg.Driver)
+		}
+		if in.name == "" {
+			in.name = cfg.Name
+		}
+		dir, err := ioutil.TempDir("", "buildkit-config")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if configFile, driverOpts, err = writeBuilderConfigFiles(cfg, dir); err != nil {
+			return err
+		}
+		flags = cfg.BuildkitFlags
+	}
+
+	if strings.HasSuffix(in.name, manifest.EgressProxySuffix) {
+		return errors.Errorf("builder names can't end with %s, it names the egress proxies of the builders", manifest.EgressProxySuffix)
+	}
+	d, err := driver.GetDriver(ctx, in.name, driverFactory, rootOpts.KubeClientConfig, flags, configFile, driverOpts, "" /*contextPathHash*/)
 	if err != nil {
 		return err
 	}
+	if in.dryRun {
+		return printManifests(ctx, streams.Out, in, d)
+	}
 
+	wait := driver.WaitOpt{
+		NoWait:  in.noWait || !in.wait,
+		Backoff: driver.Backoff{Initial: in.waitInterval, Max: in.waitMaxInterval},
+	}
+	ctx = driver.WithWait(ctx, wait)
+	if in.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, in.waitTimeout)
+		defer cancel()
+	}
 	pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+	if wait.NoWait {
+		// The builder has no pods to connect to yet
+		err = d.Bootstrap(ctx, func(s *client.SolveStatus) {
+			pw.Status() <- s
+		})
+		close(pw.Status())
+		<-pw.Done()
+		if err != nil {
+			return err
+		}
+		if in.output != "" {
+			return printBuilder(ctx, streams.Out, in.output, d, in.name)
+		}
+		fmt.Printf("Created %s builder %s, its pods are starting\n", driverFactory.Name(), in.name)
+		return nil
+	}
 	_, err = driver.Boot(ctx, d, pw)
 	if err != nil {
 		return err
 	}
+	if err := verifyEmulation(ctx, d); err != nil {
+		return err
+	}
+	if in.output != "" {
+		return printBuilder(ctx, streams.Out, in.output, d, in.name)
+	}
 	fmt.Printf("Created %s builder %s\n", driverFactory.Name(), in.name)
 	return nil
 }
 
+// printManifests writes the objects creating the builder of d would apply,
+// as a YAML stream or a json List
+func printManifests(ctx context.Context, w io.Writer, in createOptions, d driver.Driver) error {
+	pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+	objs, err := d.Manifests(ctx, func(s *client.SolveStatus) {
+		pw.Status() <- s
+	})
+	close(pw.Status())
+	<-pw.Done()
+	if err != nil {
+		return err
+	}
+	if in.output == outputJSON {
+		return printOutput(w, outputJSON, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "List",
+			"items":      objs,
+		})
+	}
+	for i, obj := range objs {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w, "---"); err != nil {
+				return err
+			}
+		}
+		if err := printOutput(w, outputYAML, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyEmulation fails if a builder pod doesn't run the emulators installed
+// for it
+func verifyEmulation(ctx context.Context, d driver.Driver) error {
+	info, err := d.Info(ctx)
+	if err != nil || len(info.Emulation) == 0 {
+		return err
+	}
+	nodes, err := d.NodeClients(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n.BuildKitClient != nil {
+				n.BuildKitClient.Close()
+			}
+		}
+	}()
+	return build.VerifyEmulation(ctx, nodes, info.Emulation)
+}
+
 func createCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
 	options := createOptions{}
 
@@ -114,6 +413,19 @@ Driver Specific Usage:
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) > 0 {
 				options.name = args[0]
+				rootOpts.builderArgument = args[0]
+			}
+			if options.fromExport != "" {
+				// The exported config replaces all the builder options
+				var conflict string
+				cmd.LocalNonPersistentFlags().Visit(func(f *pflag.Flag) {
+					if f.Name != "from-export" && f.Name != "progress" && f.Name != "output" && f.Name != "dry-run" {
+						conflict = f.Name
+					}
+				})
+				if conflict != "" {
+					return errors.Errorf("--%s can't be combined with --from-export", conflict)
+				}
 			}
 			if err := rootOpts.Complete(cmd, args); err != nil {
 				return err
@@ -121,6 +433,9 @@ Driver Specific Usage:
 			if err := rootOpts.Validate(); err != nil {
 				return err
 			}
+			if options.name == "" && rootOpts.resolved.BuilderSource != sourceDefault {
+				options.name = rootOpts.resolved.Builder
+			}
 			return runCreate(streams, options, rootOpts)
 		},
 		SilenceUsage: true,
@@ -129,20 +444,115 @@ Driver Specific Usage:
 	flags := cmd.Flags()
 
 	flags.StringVar(&options.flags, "buildkitd-flags", "", "Flags for buildkitd daemon")
-	flags.StringVar(&options.configFile, "config", "", "BuildKit config file")
+	flags.StringVar(&options.configFile, "buildkitd-config", "", "buildkitd.toml of the builder, eg. with registry mirrors, insecure registries, gc policies and max-parallelism, kept in its ConfigMap and mounted in its pods, which restart if it changes on an existing builder")
+	flags.StringVar(&options.configFile, "config", "", "Same as --buildkitd-config")
 	flags.StringArrayVar(&options.platform, "platform", []string{}, "Fixed platforms for current node")
 	flags.StringVar(&options.progress, "progress", "auto", "Set type of progress output [auto, plain, tty]. Use plain to show container output")
+	flags.StringVarP(&options.output, "output", "o", "", "Print the created builder as json or yaml, or the manifests of --dry-run (default yaml)")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "Print the manifests creating the builder would apply instead of applying them, to be applied by GitOps tools, builds use the builder they create")
+	flags.BoolVar(&options.wait, "wait", true, "Wait for the builder pods to be ready, reporting why pending pods aren't coming up")
+	flags.BoolVar(&options.noWait, "no-wait", false, "Return once the builder is created, without waiting for its pods (same as --wait=false)")
+	flags.DurationVar(&options.waitTimeout, "wait-timeout", 0, "Fail if the builder pods aren't ready within this time, 0 for no limit")
+	flags.DurationVar(&options.waitInterval, "wait-interval", driver.DefaultBackoff.Initial, "First interval between checks of the builder pods, doubled after each check")
+	flags.DurationVar(&options.waitMaxInterval, "wait-max-interval", driver.DefaultBackoff.Max, "Longest interval between checks of the builder pods")
 	flags.StringVar(&options.image, "image", "", fmt.Sprintf("Specify an alternate buildkit image (default: %s)", version.DefaultImage))
-	flags.StringVar(&options.runtime, "runtime", "auto", "Container runtime used by cluster [auto, docker, containerd]")
+	flags.StringVar(&options.runtime, "runtime", "auto", "Container runtime used by cluster [auto, docker, containerd, cri-o], auto detects the runtimes of the nodes")
 	flags.StringVar(&options.containerdSock, "containerd-sock", kubernetes.DefaultContainerdSockPath, "Path to the containerd.sock on the host")
 	flags.StringVar(&options.containerdNamespace, "containerd-namespace", kubernetes.DefaultContainerdNamespace, "Containerd namespace to build images in")
 	flags.StringVar(&options.dockerSock, "docker-sock", kubernetes.DefaultDockerSockPath, "Path to the docker.sock on the host")
 	flags.IntVar(&options.replicas, "replicas", 1, "BuildKit deployment replica count")
+	flags.StringVar(&options.deploymentKind, "deployment-kind", "deployment", "Run the builder pods with a Deployment of --replicas pods, a DaemonSet with a pod and layer cache on every node, which builds prefer on the node they're launched from, or a StatefulSet of --replicas pods keeping their names, and --cache-storage=pvc claims, across restarts [deployment, daemonset, statefulset]")
 	flags.BoolVar(&options.rootless, "rootless", false, "Run in rootless mode")
-	flags.StringVar(&options.loadbalance, "loadbalance", "random", "Load balancing strategy [random, sticky]")
+	flags.StringVar(&options.loadbalance, "loadbalance", "random", "Load balancing strategy [random, sticky, least-loaded], least-loaded estimates the builds of each pod by its cache records in use")
 	flags.StringVar(&options.worker, "worker", "auto", "Worker backend [auto, runc, containerd]")
 	flags.StringVar(&options.customConfig, "custom-config", "", "Name of a ConfigMap containing custom files (e.g., certs), mounted in /etc/config/ - use 'kubectl create configmap ... --from-file=...'")
+	flags.StringSliceVar(&options.allowEntitlements, "allow-insecure-entitlement", []string{}, "Entitlements builds are permitted to request with 'kubectl build --allow' [network.host, security.insecure]")
+	flags.IntVar(&options.maxParallelism, "max-parallelism", 0, "Maximum number of build steps to execute concurrently in each builder pod (0 for unlimited)")
+	flags.IntVar(&options.maxParallelBuilds, "max-parallel-builds", 0, "Maximum number of builds to run on the builder at once, additional builds wait in a queue ordered by 'build --priority' (0 for unlimited)")
+	flags.BoolVar(&options.networkPolicy, "with-network-policy", false, "Create a NetworkPolicy denying ingress to the builder pods and limiting egress to DNS and the --network-policy-egress destinations (TCP 80 and 443 if none are given)")
+	flags.StringArrayVar(&options.networkPolicyEgress, "network-policy-egress", []string{}, "Registry or proxy the builder may connect to with --with-network-policy (format: CIDR or IP, optionally with :port)")
+	flags.StringArrayVar(&options.egressAllow, "egress-allow", []string{}, "Domain (or *.domain), IP or CIDR builds may reach, all other egress is blocked by a proxy <name>-egress and NetworkPolicy (implies --with-network-policy)")
+	flags.StringVar(&options.egressProxyImage, "egress-proxy-image", "", fmt.Sprintf("Specify an alternate image for the --egress-allow proxy (default: %s)", manifest.DefaultEgressProxyImage))
+	flags.BoolVar(&options.packageProxy, "package-proxy", false, "Run a caching proxy next to buildkitd in each builder pod, builds download through it with their proxy args, caching the packages fetched over HTTP")
+	flags.StringVar(&options.packageProxyImage, "package-proxy-image", "", fmt.Sprintf("Specify an alternate squid image for the --package-proxy (default: %s)", manifest.DefaultEgressProxyImage))
+	flags.StringVar(&options.packageProxySize, "package-proxy-size", "", fmt.Sprintf("Size of the cache of the --package-proxy in each pod (default: %s)", manifest.DefaultPackageProxySize))
+	flags.StringVar(&options.securityProfile, "security-profile", manifest.SecurityProfileAuto, "Security profile of the builder pods [auto, default, restricted], restricted complies with the restricted Pod Security Standard, auto picks it in the namespaces enforcing it")
+	flags.StringVar(&options.seccompProfile, "seccomp-profile", "", "Localhost seccomp profile of the restricted builder pods, relative to the seccomp directory of the kubelet (default: RuntimeDefault)")
+	flags.StringVar(&options.httpProxy, "http-proxy", "", "Proxy buildkitd pulls through over HTTP, also passed to the builds as their http_proxy build args")
+	flags.StringVar(&options.httpsProxy, "https-proxy", "", "Proxy buildkitd pulls through over HTTPS, also passed to the builds as their https_proxy build args")
+	flags.StringVar(&options.noProxy, "no-proxy", "", "Comma separated hosts, domains and CIDRs buildkitd and the builds reach without the proxies")
+	flags.BoolVar(&options.proxyFromEnv, "proxy-from-env", false, "Set the proxies of the builder from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY of this shell, unless given with their flags")
+	flags.BoolVar(&options.sharedCache, "shared-cache", false, "Run a cache registry next to the builder, builds import their layer cache from it and export it to it, so it is shared by all the builder pods")
+	flags.StringVar(&options.sharedCacheImage, "shared-cache-image", "", fmt.Sprintf("Specify an alternate registry image for the --shared-cache (default: %s)", manifest.DefaultSharedCacheImage))
+	flags.StringVar(&options.sharedCacheSize, "shared-cache-size", "", fmt.Sprintf("Size of the claim of the --shared-cache (default: %s)", manifest.DefaultSharedCacheSize))
+	flags.BoolVar(&options.meshCompatible, "mesh-compatible", false, "Configure the builder pods for namespaces with Istio or Linkerd sidecar injection")
+	flags.IntSliceVar(&options.meshExcludePorts, "mesh-exclude-outbound-ports", manifest.DefaultMeshExcludeOutboundPorts, "Outbound ports bypassing the sidecar with --mesh-compatible")
+	flags.StringVar(&options.defaultPlatform, "default-platform", "", "Platform to build when 'kubectl build' is run without --platform (default: the builder's native platform)")
+	flags.StringVar(&options.runCacheClaim, "run-cache-claim", "", "Existing PersistentVolumeClaim to persist the RUN --mount=type=cache mounts of builds to, use a ReadWriteMany claim to share them between replicas")
+	flags.StringVar(&options.runCacheScope, "run-cache-scope", "id", "Key the persisted cache mounts by cache ID, shared by all builds, or by project [id, project]")
+	flags.StringVar(&options.patch, "patch", "", "Strategic merge patch or JSON patch (YAML or JSON) applied to the generated builder Deployment, eg. to add sidecars or volumes")
+	flags.DurationVar(&options.scaleDownIdle, "scale-down-idle", 0, "Have builds scale the builder down by the replicas which didn't build for this long, least recently used first (0 to disable)")
+	flags.BoolVar(&options.scaleOnQueue, "scale-on-queue", false, "Have builds add replicas, up to --replicas-max, when they queue on the builder pods, --max-parallel-builds is then the builds each pod runs at once (default 1), and remove them after --scale-down-idle (default "+kubernetes.DefaultScaleOnQueueIdle.String()+")")
+	flags.IntVar(&options.replicasMin, "replicas-min", 0, "Fewest replicas builds scale the builder down to (default 1)")
+	flags.IntVar(&options.replicasMax, "replicas-max", 0, "Most replicas builds scale the builder up to with --scale-on-queue")
+	flags.StringSliceVar(&options.allowHostPaths, "allow-host-path", []string{}, "Node directory builds may mount read-only with 'build --mount-host', it must exist on every node running the builder")
+	flags.StringVar(&options.scratchSize, "scratch-size", "", "Size of a generic ephemeral volume provisioned with each builder pod for the build state, instead of the node's ephemeral storage (eg. 200Gi)")
+	flags.StringVar(&options.scratchStorageClass, "scratch-storage-class", "", "Storage class of the --scratch-size volumes, the cluster default if unset")
+	flags.StringVar(&options.cacheStorage, "cache-storage", "", "Keep the layer cache of the builder pod across restarts on a PersistentVolumeClaim with 'pvc', one per pod with --deployment-kind=statefulset, deleted with the builder by 'kubectl buildkit rm' (default: the pod's ephemeral storage)")
+	flags.StringVar(&options.cacheSize, "cache-size", "", "Size of the --cache-storage=pvc claim (default "+manifest.DefaultCacheSize+")")
+	flags.StringVar(&options.storageClass, "storage-class", "", "Storage class of the --cache-storage=pvc and --shared-cache claims, the cluster default if unset")
+	flags.StringVar(&options.binfmtImage, "binfmt-image", "", "Install QEMU emulators on the nodes of the builder pods from this image of tonistiigi/binfmt, eg. mirrored to a registry of a disconnected cluster, and verify buildkitd runs them")
+	flags.StringSliceVar(&options.binfmtPlatforms, "binfmt-platforms", []string{}, "Architectures --binfmt-image installs the emulators of, eg. arm64,riscv64 (default: all of those of the image)")
+	flags.BoolVar(&options.tls, "tls", false, "Authenticate buildkitd and the CLI to each other with mutual TLS, with a CA and certificates generated in the Secret <name>-tls, only users who can read it can build")
+	flags.StringVar(&options.tlsSecret, "tls-secret", "", "Existing Secret with the CA, certificates and keys of --tls instead of generating them, with the keys "+manifest.TLSCACertKey+", "+manifest.TLSCertKey+" and "+manifest.TLSKeyKey+" of buildkitd, for the name "+manifest.TLSServerName+", and "+manifest.TLSClientCertKey+" and "+manifest.TLSClientKeyKey+" of the CLI (implies --tls)")
+	flags.StringVar(&options.transport, "transport", "auto", "How the CLI connects to buildkitd: exec buildctl dial-stdio in the pod, port-forward the TLS port of the pod through the API server, or tcp to dial the TLS port of the pod IP from within the cluster, the last two need --tls and fall back to the next one and exec. auto uses exec, or port-forward with --tls if you may port-forward to the pods but not exec in them")
+	flags.BoolVar(&options.adminService, "admin-service", false, "Expose the control API of buildkitd in the builder pods with the headless Service <name>-admin, for dashboards and controllers to read the cache of the pods and prune it with the client certificate of --tls (needs --tls)")
+	flags.IntVar(&options.metricsPort, "metrics-port", 0, "Serve the debug handlers and metrics of buildkitd on this port of the builder pods, annotated for Prometheus to scrape "+manifest.MetricsPath+", for BuildKit images which export metrics (0 to not serve them)")
+	flags.StringArrayVar(&options.nodeSelector, "node-selector", []string{}, "Label the nodes of the builder pods must have, eg. for dedicated build nodes (format: key=value)")
+	flags.StringArrayVar(&options.tolerations, "toleration", []string{}, "Taint of the nodes the builder pods tolerate, any value of the key without one and all effects without one (format: key[=value][:NoSchedule|PreferNoSchedule|NoExecute])")
+	flags.StringVar(&options.affinity, "affinity", "", "YAML or JSON file with the affinity of the builder pods, a podAntiAffinity in it replaces the spreading of the pods over the nodes")
+	flags.StringVar(&options.requests, "requests", "", "Resources requested for buildkitd in each builder pod (format: cpu=2,memory=4Gi[,ephemeral-storage=50Gi])")
+	flags.StringVar(&options.limits, "limits", "", "Resource limits of buildkitd in each builder pod, a memory limit too low gets builds OOM-killed (format: cpu=4,memory=8Gi[,ephemeral-storage=100Gi])")
+	flags.StringVar(&options.priorityClass, "priority-class", "", "PriorityClass of the builder pods, eg. to keep them from being preempted.  Creating an existing builder again rolls its pods to the new --requests, --limits and --priority-class")
+	flags.StringSliceVar(&options.outputClaims, "output-claim", []string{}, "Existing PersistentVolumeClaim builds may write their image to with 'build --output type=pvc,name=<claim>,dest=<path>'")
+	flags.StringArrayVar(&options.replicaClasses, "replica-class", []string{}, "Add a class of replicas with their own resources that builds request with 'build --size', next to the --replicas (format: name=large,replicas=2,cpu=8,memory=32Gi)")
+	flags.BoolVar(&options.readOnlyRootFS, "read-only-root-fs", false, "Run buildkitd with a read-only root filesystem, only its state, socket and temporary directories are writable")
+	flags.StringArrayVar(&options.writablePaths, "writable-path", []string{}, "Directory of the builder image kept writable with --read-only-root-fs, for custom images")
+	flags.IntVar(&options.historyMaxRecords, "history-max-records", 100, "Number of finished detached build records, and of build history records, each builder pod keeps, older records are removed when builds start (0 for no limit)")
+	flags.DurationVar(&options.historyMaxAge, "history-max-age", 7*24*time.Hour, "Remove the records of detached builds, and the build history records, finished longer ago than this when builds start (0 for no limit)")
+	flags.IntVar(&options.gcThreshold, "gc-threshold", 90, "Percentage of the disk of a builder pod used at which running builds prune the unused cache (0 to not prune during builds)")
+	flags.StringVar(&options.buildIOLimits, "build-io-limits", "", "Disk I/O limits of each build by default, on builders created without --rootless (format: read-bps=100Mi,write-bps=50Mi,read-iops=1000,write-iops=500)")
+	flags.StringVar(&options.gcKeepStorage, "gc-keep-storage", "", "Size of the most recently used cache the pruning of --gc-threshold keeps (e.g. 10Gi)")
+	flags.StringVar(&options.fallbackBuilder, "fallback-builder", "", "Builder that builds use while this one has no ready pods (format: NAME[,namespace=NS][,context=CTX])")
+	flags.StringVar(&options.fromExport, "from-export", "", "Create the builder from a configuration written by 'kubectl buildkit export-config'")
+	flags.StringVar(&options.ipFamily, "ip-family", "auto", "IP family of the services created for the builder and the builder addresses reported [auto, ipv4, ipv6, dual]")
+	flags.StringArrayVar(&options.notify, "notify", []string{}, "Default build completion notification sink for builds on this builder (webhook:<url> or slack:<url>)")
+	flags.IntVar(&options.preemptionPriority, "preemption-priority", 0, "Queued builds with at least this 'build --priority' may cancel and requeue running lower priority builds when the builder is full (0 to disable)")
 	flags.StringArrayVar(&options.envs, "env", []string{}, "Environment variable to add when create builder, like http_proxy=http://my-proxy.com:8080")
 
 	return cmd
 }
+
+// setProxyFromEnv fills in the proxies not given with their flags from the
+// environment, with the precedence of the Go HTTP client.  NO_PROXY is only
+// taken with a proxy.
+func setProxyFromEnv(in *createOptions) {
+	for _, p := range []struct {
+		value *string
+		names []string
+	}{
+		{&in.httpProxy, []string{"HTTP_PROXY", "http_proxy"}},
+		{&in.httpsProxy, []string{"HTTPS_PROXY", "https_proxy"}},
+		{&in.noProxy, []string{"NO_PROXY", "no_proxy"}},
+	} {
+		if p.value == &in.noProxy && in.httpProxy == "" && in.httpsProxy == "" {
+			return
+		}
+		for _, name := range p.names {
+			if *p.value != "" {
+				break
+			}
+			*p.value = os.Getenv(name)
+		}
+	}
+}
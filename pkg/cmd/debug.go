@@ -0,0 +1,198 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// debug info dumps in one go what troubleshooting a builder usually starts
+// with: the pods of the builder, the buildkitd workers of each running pod,
+// the container runtime of its node and the recent events of the builder.
+
+type debugInfoOptions struct {
+	builder string
+	events  int
+	commonKubeOptions
+}
+
+func runDebugInfo(streams genericclioptions.IOStreams, in debugInfoOptions) error {
+	ctx := appcontext.Context()
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	info, err := d.Info(ctx)
+	if err != nil {
+		return err
+	}
+	builders, err := d.List(ctx)
+	if err != nil {
+		return err
+	}
+	var b *driver.Builder
+	for i := range builders {
+		if builders[i].Name == in.builder {
+			b = &builders[i]
+		}
+	}
+	if b == nil {
+		return fmt.Errorf("builder %s not found", in.builder)
+	}
+
+	w := tabwriter.NewWriter(streams.Out, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", b.Name)
+	fmt.Fprintf(w, "Namespace:\t%s\n", b.Namespace)
+	fmt.Fprintf(w, "Driver:\t%s\n", b.Driver)
+	fmt.Fprintf(w, "Status:\t%s\n", info.Status)
+	if info.Runtime != "" {
+		fmt.Fprintf(w, "Runtime:\t%s\n", info.Runtime)
+	}
+	w.Flush()
+
+	fmt.Fprintf(streams.Out, "\nPods:\n")
+	nodes, err := d.NodeClients(ctx)
+	if err != nil {
+		return err
+	}
+	clients := map[string]driver.NodeClient{}
+	for _, n := range nodes {
+		clients[n.NodeName] = n
+		defer n.BuildKitClient.Close()
+	}
+	for _, n := range append(append([]driver.Node{}, b.Nodes...), b.Pending...) {
+		w := tabwriter.NewWriter(streams.Out, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(w, "Name:\t%s\n", n.Name)
+		fmt.Fprintf(w, "Status:\t%s\n", n.Status)
+		if n.Host != "" {
+			fmt.Fprintf(w, "Host:\t%s\n", n.Host)
+		}
+		runtime := n.Runtime
+		if runtime == "" {
+			runtime = info.Runtime
+		}
+		if runtime != info.Runtime {
+			fmt.Fprintf(w, "Runtime:\t%s\n", runtime)
+		}
+		if c, ok := clients[n.Name]; ok {
+			writeWorkers(ctx, w, c)
+			if runtime != "" {
+				if v, err := build.RuntimeVersion(ctx, d, n.Name, runtime); err != nil {
+					fmt.Fprintf(w, "Runtime Version:\tunavailable: %v\n", err)
+				} else {
+					fmt.Fprintf(w, "Runtime Version:\t%s\n", v)
+				}
+			}
+			stats, err := build.GetCacheStats(ctx, c.BuildKitClient, 0)
+			writeCacheStats(w, podCacheStats{stats: stats, err: err})
+		}
+		w.Flush()
+		fmt.Fprintln(streams.Out)
+	}
+
+	events, err := d.Events(ctx)
+	if err != nil {
+		return err
+	}
+	if len(events) > in.events {
+		events = events[len(events)-in.events:]
+	}
+	fmt.Fprintf(streams.Out, "Events:\n")
+	if len(events) == 0 {
+		fmt.Fprintf(streams.Out, "  <none>\n")
+		return nil
+	}
+	w = tabwriter.NewWriter(streams.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  AGE\tTYPE\tREASON\tOBJECT\tMESSAGE\n")
+	for _, e := range events {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", duration.HumanDuration(time.Since(e.Time)), e.Type, e.Reason, e.Object, strings.TrimSpace(e.Message))
+	}
+	return w.Flush()
+}
+
+// writeWorkers writes the buildkitd workers of the pod of c
+func writeWorkers(ctx context.Context, w io.Writer, c driver.NodeClient) {
+	workers, err := c.BuildKitClient.ListWorkers(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Workers:\tunavailable: %v\n", err)
+		return
+	}
+	for _, wi := range workers {
+		fmt.Fprintf(w, "Worker:\t%s\n", wi.ID)
+		fmt.Fprintf(w, "  Platforms:\t%s\n", strings.Join(platformutil.FormatInGroups(wi.Platforms), ", "))
+		keys := make([]string, 0, len(wi.Labels))
+		for k := range wi.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s:\t%s\n", k, wi.Labels[k])
+		}
+		for _, p := range wi.GCPolicy {
+			policy := "keep " + build.FormatBytes(p.KeepBytes)
+			if p.KeepDuration > 0 {
+				policy += " for " + p.KeepDuration.String()
+			}
+			if p.All {
+				policy += ", all records"
+			}
+			if len(p.Filter) > 0 {
+				policy += ", " + strings.Join(p.Filter, ",")
+			}
+			fmt.Fprintf(w, "  GC Policy:\t%s\n", policy)
+		}
+	}
+}
+
+func debugCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Troubleshoot a builder",
+	}
+
+	options := debugInfoOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+	info := &cobra.Command{
+		Use:   "info [NAME]",
+		Short: "Print the pods, buildkitd workers, container runtime and recent events of a builder",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runDebugInfo(streams, options)
+		},
+		SilenceUsage: true,
+	}
+	flags := info.Flags()
+	flags.IntVar(&options.events, "events", 20, "Number of the most recent events of the builder to show")
+
+	cmd.AddCommand(info)
+	return cmd
+}
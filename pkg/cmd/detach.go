@@ -0,0 +1,276 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func runDetachedBuild(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, opts build.Options, contextPathHash string, logFilter *progress.LogFilter) error {
+	if err := checkDetachable(in); err != nil {
+		if !in.detach && in.reconnectGrace == 0 && build.HasPVCOutput(opts.Exports) {
+			return errors.Wrap(err, "pvc outputs are written by a build running on the builder, the way detached builds run")
+		}
+		return err
+	}
+
+	d, _, _, err := buildDriverWithFallback(ctx, streams.ErrOut, in.KubeClientConfig, in.configFlags, in.builder, in.fallbackBuilder, contextPathHash, in.size, in.nodes)
+	if err != nil {
+		return err
+	}
+
+	ctx2, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	pw := progress.NewPrinter(ctx2, os.Stderr, in.progress)
+	if logFilter != nil {
+		pw = progress.Filter(pw, logFilter.Filter)
+	}
+
+	db, err := build.BuildDetached(ctx, d, opts, in.registrySecretName, in.reconnectGrace, pw)
+	if err != nil {
+		return err
+	}
+	if in.detach {
+		fmt.Fprintln(streams.Out, db.ID)
+		return nil
+	}
+	fmt.Fprintf(streams.ErrOut, "build %s started, if interrupted reattach with 'kubectl build attach %s'\n", db.ID, db.ID)
+	return attachWithReconnect(ctx, streams, d, db.ID, in.reconnectGrace)
+}
+
+// checkDetachable rejects the options which need the client connected to the
+// solve, detached builds run buildctl on the builder
+func checkDetachable(in buildOptions) error {
+	switch {
+	case in.contextPath == "-" || in.dockerfileName == "-":
+		return errors.Errorf("detached builds can't read the build context or Dockerfile from stdin")
+	case len(in.secrets) > 0 || len(in.ssh) > 0:
+		return errors.Errorf("--secret and --ssh require the client to stay connected and can't be used with --detach")
+	case in.graphFile != "" || in.traceFile != "":
+		return errors.Errorf("--graph and --trace can't be used with --detach")
+	case in.imageIDFile != "":
+		return errors.Errorf("--iidfile can't be used with --detach")
+	case in.commitStatus != "":
+		return errors.Errorf("--commit-status can't be used with --detach")
+	case len(in.attach) > 0:
+		return errors.Errorf("--attach can't be used with --detach")
+	case len(in.imageSets) > 0:
+		return errors.Errorf("--set can't be used with --detach")
+	case len(in.extract) > 0:
+		return errors.Errorf("--extract requires the client to stay connected and can't be used with --detach")
+	case in.replicateContext:
+		return errors.Errorf("--replicate-context can't be used with --detach")
+	case len(in.mountHost) > 0:
+		return errors.Errorf("--mount-host can't be used with --detach")
+	case in.squash:
+		return errors.Errorf("--squash requires the client to stay connected and can't be used with --detach")
+	case in.pullRetries > 0:
+		return errors.Errorf("--pull-retries can't be used with --detach")
+	case in.buildCPULimit != "" || in.buildMemoryLimit != "" || in.buildIOLimits != "":
+		return errors.Errorf("--build-cpu-limit, --build-memory-limit and --build-io-limits can't be used with --detach")
+	case in.distribute:
+		return errors.Errorf("--distribute can't be used with --detach")
+	case len(in.preBuildHooks) > 0 || len(in.postBuildHooks) > 0 || len(in.postPushHooks) > 0:
+		return errors.Errorf("build hooks run on the client and can't be used with --detach")
+	}
+	return nil
+}
+
+// attachWithReconnect follows the build log, reconnecting after connection
+// failures until nothing has been received from the builder for longer than grace
+func attachWithReconnect(ctx context.Context, streams genericclioptions.IOStreams, d driver.Driver, id string, grace time.Duration) error {
+	out := &offsetWriter{w: streams.Out, lastSeen: time.Now()}
+	for {
+		db, err := build.AttachDetachedBuild(ctx, d, id, out.offset, out)
+		if err == nil {
+			if db.State != build.DetachedStateDone {
+				return errors.Errorf("detached build %s %s", db.ID, detachedResult(db))
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(out.lastSeen) > grace {
+			return errors.Wrapf(err, "lost connection to build %s", id)
+		}
+		logrus.Warnf("connection to build %s lost, reconnecting: %s", id, err)
+		time.Sleep(2 * time.Second)
+		// A successful status lookup shows the builder is reachable again
+		if _, err := build.DetachedBuildStatus(ctx, d, id); err == nil {
+			out.lastSeen = time.Now()
+		}
+	}
+}
+
+// offsetWriter tracks how much of the build log has been shown so a reconnect
+// can resume where the previous connection stopped
+type offsetWriter struct {
+	w        io.Writer
+	offset   int64
+	lastSeen time.Time
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.offset += int64(n)
+	o.lastSeen = time.Now()
+	return n, err
+}
+
+type detachedOptions struct {
+	id string
+}
+
+func rootBuilderDriver(ctx context.Context, rootOpts *rootOptions, cmd *cobra.Command, args []string) (driver.Driver, error) {
+	if err := rootOpts.Complete(cmd, args); err != nil {
+		return nil, err
+	}
+	if err := rootOpts.Validate(); err != nil {
+		return nil, err
+	}
+	return getBuildDriver(ctx, rootOpts.KubeClientConfig, rootOpts.resolved.Builder, "", "", nil)
+}
+
+func runDetachedStatus(streams genericclioptions.IOStreams, d driver.Driver, in detachedOptions) error {
+	db, err := build.DetachedBuildStatus(appcontext.Context(), d, in.id)
+	if err != nil {
+		return err
+	}
+	printDetachedBuild(streams, db)
+	return nil
+}
+
+func runDetachedAttach(streams genericclioptions.IOStreams, d driver.Driver, in detachedOptions) error {
+	db, err := build.AttachDetachedBuild(appcontext.Context(), d, in.id, 0, streams.Out)
+	if err != nil {
+		return err
+	}
+	if db.State != build.DetachedStateDone {
+		return errors.Errorf("detached build %s %s", db.ID, detachedResult(db))
+	}
+	return nil
+}
+
+func runDetachedCancel(streams genericclioptions.IOStreams, d driver.Driver, in detachedOptions) error {
+	// An ID is given, CancelBuild fails if no build is cancelled
+	cancelled, err := build.CancelBuild(appcontext.Context(), d, in.id)
+	printCancelled(streams.Out, "", cancelled, err)
+	return err
+}
+
+func printDetachedBuild(streams genericclioptions.IOStreams, db *build.DetachedBuild) {
+	fmt.Fprintf(streams.Out, "ID:      %s\n", db.ID)
+	fmt.Fprintf(streams.Out, "Builder: %s\n", db.Node)
+	fmt.Fprintf(streams.Out, "Status:  %s\n", detachedResult(db))
+}
+
+func detachedResult(db *build.DetachedBuild) string {
+	if db.State == build.DetachedStateFailed {
+		return fmt.Sprintf("%s (exit code %d)", db.State, db.ExitCode)
+	}
+	return db.State
+}
+
+func detachedCmds(streams genericclioptions.IOStreams, rootOpts *rootOptions) []*cobra.Command {
+	cmds := []struct {
+		use   string
+		short string
+		run   func(genericclioptions.IOStreams, driver.Driver, detachedOptions) error
+	}{
+		{"status", "Show the status of a detached build", runDetachedStatus},
+		{"attach", "Stream the output of a detached build until it completes", runDetachedAttach},
+		{"cancel", "Cancel a running build, like 'kubectl buildkit cancel ID'", runDetachedCancel},
+	}
+	res := make([]*cobra.Command, 0, len(cmds))
+	for _, c := range cmds {
+		c := c
+		res = append(res, &cobra.Command{
+			Use:   c.use + " ID",
+			Short: c.short,
+			Args:  ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				d, err := rootBuilderDriver(appcontext.Context(), rootOpts, cmd, args)
+				if err != nil {
+					return err
+				}
+				return c.run(streams, d, detachedOptions{id: args[0]})
+			},
+			SilenceUsage: true,
+		})
+	}
+	return res
+}
+
+type pruneHistoryOptions struct {
+	maxRecords int
+	maxAge     time.Duration
+}
+
+func runPruneHistory(ctx context.Context, streams genericclioptions.IOStreams, d driver.Driver, in pruneHistoryOptions, cmd *cobra.Command) error {
+	if !cmd.Flags().Changed("max-records") || !cmd.Flags().Changed("max-age") {
+		info, err := d.Info(ctx)
+		if err != nil {
+			return err
+		}
+		if !cmd.Flags().Changed("max-records") {
+			in.maxRecords = info.HistoryMaxRecords
+		}
+		if !cmd.Flags().Changed("max-age") {
+			in.maxAge = info.HistoryMaxAge
+		}
+	}
+	if in.maxRecords <= 0 && in.maxAge <= 0 {
+		return errors.Errorf("the builder keeps build records without limits, set --max-records or --max-age")
+	}
+	removed, err := build.PruneDetachedBuilds(ctx, d, in.maxRecords, in.maxAge)
+	for _, id := range removed {
+		fmt.Fprintf(streams.Out, "removed %s\n", id)
+	}
+	if err != nil {
+		return err
+	}
+	removed, err = build.PruneBuildHistory(ctx, d, in.maxRecords, in.maxAge)
+	for _, ref := range removed {
+		fmt.Fprintf(streams.Out, "removed build record %s\n", ref)
+	}
+	return err
+}
+
+func pruneHistoryCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	var options pruneHistoryOptions
+
+	cmd := &cobra.Command{
+		Use:   "prune-history",
+		Short: "Remove the records of finished detached builds and the build history beyond the builder's retention",
+		Args:  ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := appcontext.Context()
+			d, err := rootBuilderDriver(ctx, rootOpts, cmd, args)
+			if err != nil {
+				return err
+			}
+			return runPruneHistory(ctx, streams, d, options, cmd)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.IntVar(&options.maxRecords, "max-records", 0, "Number of finished build records each builder pod keeps (default: the builder's --history-max-records)")
+	flags.DurationVar(&options.maxAge, "max-age", 0, "Remove the records of builds finished longer ago than this (default: the builder's --history-max-age)")
+
+	return cmd
+}
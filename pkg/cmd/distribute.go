@@ -0,0 +1,75 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// distributeStages builds the independent stages of the target with
+// --distribute, each on the pod it sticks to, and has the targets import
+// their caches
+func distributeStages(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, targets map[string]build.Options, contextPathHash string) error {
+	if in.distributeCache == "" {
+		return errors.Errorf("--distribute requires --distribute-cache, the registry repository the stages exchange their cache through")
+	}
+	if len(targets) > 1 {
+		return errors.Errorf("--distribute can't be used with --set")
+	}
+	_, dt, err := readLocalDockerfile(in, "--distribute")
+	if err != nil {
+		return err
+	}
+	stages, err := build.DockerfileStages(dt)
+	if err != nil {
+		return err
+	}
+	names, err := build.DistributedStages(stages, in.target)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(streams.ErrOut, "no independent stages to distribute, building on a single pod")
+		return nil
+	}
+
+	var name string
+	for name = range targets {
+		break
+	}
+	opt := targets[name]
+	// Each stage sticks to a pod of its own, where its local cache stays
+	drivers := map[string]driver.Driver{}
+	for _, s := range names {
+		if drivers[s], err = getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash+"#"+s, in.size, in.nodes); err != nil {
+			return err
+		}
+	}
+	pw := progress.NewPrinter(ctx, os.Stderr, progress.MultiTargetMode(in.progress, len(names)))
+	mw := progress.NewMultiWriter(pw)
+	eg, ctx2 := errgroup.WithContext(ctx)
+	for _, s := range names {
+		s := s
+		w := mw.WithPrefix("stage "+s, true)
+		eg.Go(func() error {
+			o := build.DistributedStageOptions(opt, s, in.distributeCache)
+			_, err := build.Build(ctx2, []build.DriverInfo{{Name: in.builder, Driver: drivers[s]}}, map[string]build.Options{s: o}, in.KubeClientConfig, in.registrySecretName, w)
+			return errors.Wrapf(err, "stage %s", s)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	fmt.Fprintf(streams.ErrOut, "built %d stages on their own builds, building the target from their cache\n", len(names))
+	targets[name] = opt.WithDistributedStages(names, in.distributeCache)
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type drainOptions struct {
+	builder string
+	pod     string
+	node    string
+	commonKubeOptions
+}
+
+func runDrain(streams genericclioptions.IOStreams, in drainOptions, drain bool) error {
+	ctx := appcontext.Context()
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	changed, err := d.Drain(ctx, in.pod, in.node, drain)
+	state := "drained"
+	if !drain {
+		state = "uncordoned"
+	}
+	for _, name := range changed {
+		fmt.Fprintf(streams.Out, "pod %s %s\n", name, state)
+	}
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		fmt.Fprintf(streams.Out, "no pods of builder %s to be %s\n", in.builder, state)
+	}
+	return nil
+}
+
+func newDrainCmd(streams genericclioptions.IOStreams, drain bool) *cobra.Command {
+	options := drainOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			if drain && options.pod == "" && options.node == "" {
+				// Draining every pod would queue all the builds
+				return errors.Errorf("specify the --pod or --node to drain")
+			}
+			return runDrain(streams, options, drain)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&options.pod, "pod", "", "Only this pod of the builder")
+	flags.StringVar(&options.node, "node", "", "Only the pods of the builder on this Kubernetes node")
+
+	return cmd
+}
+
+func drainCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	cmd := newDrainCmd(streams, true)
+	cmd.Use = "drain [OPTIONS] [NAME] (--pod POD | --node NODE)"
+	cmd.Short = "Take builder pods out of rotation, letting their running builds finish"
+	cmd.Long = `Take builder pods out of rotation, letting their running builds finish
+
+New builds aren't started on the drained pods, the builds running on them
+carry on.  The pods keep running until they are uncordoned or removed, eg. by
+draining their node for maintenance.`
+	cmd.Example = `  kubectl buildkit drain --node worker-3
+  kubectl buildkit drain shared --pod shared-7d9c6b5f4-x2k8p`
+	return cmd
+}
+
+func uncordonCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	cmd := newDrainCmd(streams, false)
+	cmd.Use = "uncordon [OPTIONS] [NAME]"
+	cmd.Short = "Put drained builder pods back in rotation"
+	cmd.Long = `Put drained builder pods back in rotation
+
+Uncordons the --pod or the pods on the --node, or every drained pod of the
+builder.`
+	return cmd
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type duOptions struct {
+	builder string
+	commonKubeOptions
+}
+
+func runDu(streams genericclioptions.IOStreams, in duOptions) error {
+	ctx := appcontext.Context()
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	stats, err := builderCacheStats(ctx, d, 0)
+	if err != nil {
+		return err
+	}
+	if len(stats) == 0 {
+		return errors.Errorf("builder %s has no running pods", in.builder)
+	}
+
+	w := tabwriter.NewWriter(streams.Out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "POD\tRECORDS\tSIZE\tRECLAIMABLE\tLAST USED")
+	var total build.CacheStats
+	failed := 0
+	for _, pod := range sortedPods(stats) {
+		s := stats[pod]
+		if s.err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\t-\t-\t-\tfailed: %v\n", pod, s.err)
+			continue
+		}
+		total.Entries += s.stats.Entries
+		total.Size += s.stats.Size
+		total.Reclaimable += s.stats.Reclaimable
+		if s.stats.LastUsed.After(total.LastUsed) {
+			total.LastUsed = s.stats.LastUsed
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", pod, s.stats.Entries, build.FormatBytes(s.stats.Size), build.FormatBytes(s.stats.Reclaimable), lastUsed(s.stats.LastUsed))
+	}
+	if len(stats) > 1 {
+		fmt.Fprintf(w, "TOTAL\t%d\t%s\t%s\t%s\n", total.Entries, build.FormatBytes(total.Size), build.FormatBytes(total.Reclaimable), lastUsed(total.LastUsed))
+	}
+	w.Flush()
+	if failed > 0 {
+		return errors.Errorf("failed to read the cache usage of %d of %d pods of builder %s", failed, len(stats), in.builder)
+	}
+	return nil
+}
+
+// sortedPods returns the pods of the cache statistics by name
+func sortedPods(stats map[string]podCacheStats) []string {
+	pods := make([]string, 0, len(stats))
+	for pod := range stats {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	return pods
+}
+
+// lastUsed renders when a cache was last used, relative to now
+func lastUsed(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return duration.HumanDuration(time.Since(t)) + " ago"
+}
+
+func duCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := duOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "du [NAME]",
+		Short: "Show the build cache disk usage of every pod of a builder",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runDu(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	return cmd
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+type exportConfigOptions struct {
+	builder string
+	output  string
+	commonKubeOptions
+}
+
+func runExportConfig(streams genericclioptions.IOStreams, in exportConfigOptions) error {
+	ctx := appcontext.Context()
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	cfg, err := d.ExportConfig(ctx)
+	if err != nil {
+		return err
+	}
+	dt, err := marshalBuilderConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if in.output == "" || in.output == "-" {
+		_, err = streams.Out.Write(dt)
+		return err
+	}
+	return ioutil.WriteFile(in.output, dt, 0644)
+}
+
+// marshalBuilderConfig renders the config as YAML, keeping the buildkitd.toml
+// and patch readable as block scalars
+func marshalBuilderConfig(cfg *driver.BuilderConfig) ([]byte, error) {
+	dt, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(dt, &m); err != nil {
+		return nil, err
+	}
+	return kyaml.Marshal(m)
+}
+
+// loadBuilderConfig reads a config written by export-config, YAML or JSON
+func loadBuilderConfig(filename string) (*driver.BuilderConfig, error) {
+	dt, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dt, err = yaml.ToJSON(dt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid builder config %s", filename)
+	}
+	cfg := &driver.BuilderConfig{}
+	if err := json.Unmarshal(dt, cfg); err != nil {
+		return nil, errors.Wrapf(err, "invalid builder config %s", filename)
+	}
+	return cfg, nil
+}
+
+// writeBuilderConfigFiles writes the file options of cfg to dir, returning
+// the buildkitd config path and the driver options pointing at the files
+func writeBuilderConfigFiles(cfg *driver.BuilderConfig, dir string) (string, map[string]string, error) {
+	driverOpts := make(map[string]string, len(cfg.DriverOpts)+1)
+	for k, v := range cfg.DriverOpts {
+		driverOpts[k] = v
+	}
+	configFile := ""
+	if cfg.BuildkitdConfig != "" {
+		configFile = filepath.Join(dir, "buildkitd.toml")
+		if err := ioutil.WriteFile(configFile, []byte(cfg.BuildkitdConfig), 0600); err != nil {
+			return "", nil, err
+		}
+	}
+	if cfg.Patch != "" {
+		driverOpts["patch"] = filepath.Join(dir, "patch.yaml")
+		if err := ioutil.WriteFile(driverOpts["patch"], []byte(cfg.Patch), 0600); err != nil {
+			return "", nil, err
+		}
+	}
+	return configFile, driverOpts, nil
+}
+
+func exportConfigCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := exportConfigOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "export-config [NAME]",
+		Short: "Export the configuration of a builder to recreate it with 'create --from-export'",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runExportConfig(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.output, "output", "o", "", "Write the configuration to a file instead of stdout")
+
+	return cmd
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// A builder may name a fallback builder, possibly in another namespace or
+// cluster, which builds run on while the builder has no ready pods.  The
+// fallback recorded on the builder can't be read if its cluster is
+// unreachable, builds which must not block name it with --fallback-builder.
+
+type fallbackBuilder struct {
+	name      string
+	namespace string
+	context   string
+}
+
+// parseFallbackBuilder parses NAME[,namespace=NS][,context=CTX]
+func parseFallbackBuilder(s string) (*fallbackBuilder, error) {
+	fields := strings.Split(s, ",")
+	fb := &fallbackBuilder{name: fields[0]}
+	if fb.name == "" || strings.Contains(fb.name, "=") {
+		return nil, errors.Errorf("invalid fallback builder %q, use NAME[,namespace=NS][,context=CTX]", s)
+	}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid fallback builder field %q", field)
+		}
+		switch parts[0] {
+		case "namespace":
+			fb.namespace = parts[1]
+		case "context":
+			fb.context = parts[1]
+		default:
+			return nil, errors.Errorf("unknown fallback builder field %q", parts[0])
+		}
+	}
+	return fb, nil
+}
+
+func (fb *fallbackBuilder) String() string {
+	s := fb.name
+	if fb.namespace != "" {
+		s += " in namespace " + fb.namespace
+	}
+	if fb.context != "" {
+		s += " of context " + fb.context
+	}
+	return s
+}
+
+// clientConfig points the kubeconfig of configFlags at the fallback's
+// context and namespace
+func (fb *fallbackBuilder) clientConfig(configFlags *genericclioptions.ConfigFlags) clientcmd.ClientConfig {
+	flags := genericclioptions.NewConfigFlags(true)
+	flags.KubeConfig = configFlags.KubeConfig
+	flags.Context = configFlags.Context
+	if fb.context != "" {
+		flags.Context = &fb.context
+	}
+	if fb.namespace != "" {
+		flags.Namespace = &fb.namespace
+	} else if fb.context == "" {
+		flags.Namespace = configFlags.Namespace
+	}
+	return flags.ToRawKubeConfigLoader()
+}
+
+// buildDriverWithFallback returns the driver of the builder, or of its
+// fallback if the builder is unreachable or has no ready pods, along with
+// the builder name and kubeconfig used.  fallback overrides the fallback
+// recorded on the builder.
+func buildDriverWithFallback(ctx context.Context, errOut io.Writer, kubeClientConfig clientcmd.ClientConfig, configFlags *genericclioptions.ConfigFlags, instance, fallback, contextPathHash, replicaClass string, nodes []string) (driver.Driver, string, clientcmd.ClientConfig, error) {
+	if instance == "" {
+		instance = "buildkit"
+	}
+	d, err := getBuildDriver(ctx, kubeClientConfig, instance, contextPathHash, replicaClass, nodes)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	info, err := d.Info(ctx)
+	reason, fallback, err := fallbackReason(info, err, fallback)
+	if err != nil {
+		return nil, "", nil, errors.Wrapf(err, "builder %s is unavailable, name a builder to fall back to with --fallback-builder", instance)
+	}
+	if reason == "" || fallback == "" {
+		return d, instance, kubeClientConfig, nil
+	}
+	fb, err := parseFallbackBuilder(fallback)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	fmt.Fprintf(errOut, "WARNING: builder %s is unavailable (%s), building on fallback builder %s\n", instance, reason, fb)
+	config := fb.clientConfig(configFlags)
+	d, err = getBuildDriver(ctx, config, fb.name, contextPathHash, "", nodes)
+	if err != nil {
+		return nil, "", nil, errors.Wrapf(err, "failed to use fallback builder %s", fb)
+	}
+	return d, fb.name, config, nil
+}
+
+// fallbackReason returns why the builder of info, or err reading it, should
+// fall back, empty if it shouldn't, and the fallback builder: fallback, else
+// the one recorded on the builder.  The builder's fallback can't be read if
+// it is unreachable, whose error is returned without a fallback.
+func fallbackReason(info *driver.Info, err error, fallback string) (string, string, error) {
+	switch {
+	case err != nil:
+		if fallback == "" {
+			return "", "", err
+		}
+		return err.Error(), fallback, nil
+	case info.Status == driver.Stopped:
+		// Builders which don't exist yet are created by the build
+		if fallback == "" {
+			fallback = info.FallbackBuilder
+		}
+		return "no ready pods", fallback, nil
+	}
+	return "", fallback, nil
+}
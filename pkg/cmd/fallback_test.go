@@ -0,0 +1,50 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+func Test_fallbackReason(t *testing.T) {
+	t.Parallel()
+	unreachable := errors.New("failed to get builder buildkit: dial tcp: i/o timeout")
+	for _, tc := range []struct {
+		name     string
+		info     *driver.Info
+		err      error
+		fallback string
+
+		reason       string
+		wantFallback string
+		wantErr      bool
+	}{
+		{name: "running", info: &driver.Info{Status: driver.Running, FallbackBuilder: "dr"}},
+		{name: "inactive is created", info: &driver.Info{Status: driver.Inactive}},
+		{name: "stopped falls back to the recorded builder", info: &driver.Info{Status: driver.Stopped, FallbackBuilder: "dr"}, reason: "no ready pods", wantFallback: "dr"},
+		{name: "stopped without fallback", info: &driver.Info{Status: driver.Stopped}, reason: "no ready pods"},
+		{name: "the flag overrides the recorded builder", info: &driver.Info{Status: driver.Stopped, FallbackBuilder: "dr"}, fallback: "other", reason: "no ready pods", wantFallback: "other"},
+		{name: "unreachable falls back to the flag", err: unreachable, fallback: "other", reason: unreachable.Error(), wantFallback: "other"},
+		{name: "unreachable without fallback fails", err: unreachable, wantErr: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			reason, fallback, err := fallbackReason(tc.info, tc.err, tc.fallback)
+			if tc.wantErr {
+				require.Equal(t, tc.err, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.reason, reason)
+			if tc.reason != "" {
+				assert.Equal(t, tc.wantFallback, fallback)
+			}
+		})
+	}
+}
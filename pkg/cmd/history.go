@@ -0,0 +1,161 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type historyOptions struct {
+	output string
+	limit  int
+}
+
+// cacheSummary is the share of the steps of r served from the cache
+func cacheSummary(r build.HistoryRecord) string {
+	if r.Steps == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d", r.CachedSteps, r.Steps)
+}
+
+func writeHistory(w io.Writer, records []build.HistoryRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "REF\tBUILD ID\tTARGET\tPOD\tSTARTED\tDURATION\tSTATUS\tCACHED\tEXPORTERS\tDIGEST\n")
+	for _, r := range records {
+		digest := r.Digest
+		if digest == "" {
+			digest = "-"
+		}
+		exporters := strings.Join(r.Exporters, ",")
+		if exporters == "" {
+			exporters = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Ref, r.BuildID, r.Target, r.Pod,
+			r.Start.Local().Format(time.RFC3339), r.Duration.Round(time.Second), r.Status(), cacheSummary(r), exporters, digest)
+	}
+	return tw.Flush()
+}
+
+func printHistoryRecord(w io.Writer, r build.HistoryRecord) {
+	fmt.Fprintf(w, "Ref:       %s\n", r.Ref)
+	fmt.Fprintf(w, "Build ID:  %s\n", r.BuildID)
+	fmt.Fprintf(w, "Target:    %s\n", r.Target)
+	fmt.Fprintf(w, "Pod:       %s\n", r.Pod)
+	if len(r.Platforms) > 0 {
+		fmt.Fprintf(w, "Platforms: %s\n", strings.Join(r.Platforms, ", "))
+	}
+	fmt.Fprintf(w, "Started:   %s\n", r.Start.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Duration:  %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "Status:    %s\n", r.Status())
+	if r.Steps > 0 {
+		fmt.Fprintf(w, "Cache:     %d of %d steps cached (%d%%)\n", r.CachedSteps, r.Steps, r.CachedSteps*100/r.Steps)
+	}
+	if len(r.Exporters) > 0 {
+		fmt.Fprintf(w, "Exporters: %s\n", strings.Join(r.Exporters, ", "))
+	}
+	if r.Image != "" {
+		fmt.Fprintf(w, "Image:     %s\n", r.Image)
+	}
+	if r.Digest != "" {
+		fmt.Fprintf(w, "Digest:    %s\n", r.Digest)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "Error:     %s\n", r.Error)
+	}
+}
+
+func historyCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	var options historyOptions
+
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the past builds of the builder",
+		Long: `List the past builds of the builder
+
+Each build is recorded on the builder pod it ran on, with when it ran, how
+long it took, its cache hits, outputs and image digest.  The records are kept
+until the pod restarts, within the --history-max-records and
+--history-max-age of the builder.`,
+		Args: ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateOutputFormat(options.output); err != nil {
+				return err
+			}
+			ctx := appcontext.Context()
+			d, err := rootBuilderDriver(ctx, rootOpts, cmd, args)
+			if err != nil {
+				return err
+			}
+			records, err := build.BuildHistory(ctx, d)
+			if err != nil {
+				return err
+			}
+			if options.limit > 0 && len(records) > options.limit {
+				records = records[:options.limit]
+			}
+			if options.output != "" {
+				if records == nil {
+					records = []build.HistoryRecord{}
+				}
+				return printOutput(streams.Out, options.output, records)
+			}
+			return writeHistory(streams.Out, records)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.output, "output", "o", "", "Print the build records as json or yaml")
+	flags.IntVar(&options.limit, "limit", 0, "Only list this many of the most recent builds (0 for all)")
+
+	return cmd
+}
+
+func inspectBuildCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	var options historyOptions
+
+	cmd := &cobra.Command{
+		Use:   "inspect REF",
+		Short: "Show the record of a past build, by its ref or build ID",
+		Args:  ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateOutputFormat(options.output); err != nil {
+				return err
+			}
+			ctx := appcontext.Context()
+			d, err := rootBuilderDriver(ctx, rootOpts, cmd, args)
+			if err != nil {
+				return err
+			}
+			records, err := build.InspectBuild(ctx, d, args[0])
+			if err != nil {
+				return err
+			}
+			if options.output != "" {
+				return printOutput(streams.Out, options.output, records)
+			}
+			for i, r := range records {
+				if i > 0 {
+					fmt.Fprintln(streams.Out)
+				}
+				printHistoryRecord(streams.Out, r)
+			}
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().StringVarP(&options.output, "output", "o", "", "Print the build records as json or yaml")
+
+	return cmd
+}
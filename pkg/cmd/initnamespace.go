@@ -0,0 +1,210 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+)
+
+type initNamespaceOptions struct {
+	name            string
+	podSecurity     string
+	quota           string
+	defaultRequests string
+	defaultLimits   string
+	max             string
+	users           []string
+	groups          []string
+	serviceAccounts []string
+}
+
+func runInitNamespace(streams genericclioptions.IOStreams, rootOpts *rootOptions, in initNamespaceOptions) error {
+	ctx := appcontext.Context()
+
+	opt := &manifest.NamespaceOpt{
+		Name:            in.name,
+		PodSecurity:     in.podSecurity,
+		Users:           in.users,
+		Groups:          in.groups,
+		ServiceAccounts: in.serviceAccounts,
+	}
+	var err error
+	if opt.Quota, err = manifest.ParseQuota(in.quota); err != nil {
+		return err
+	}
+	if opt.DefaultRequests, err = manifest.ParseResourceList(in.defaultRequests); err != nil {
+		return errors.Wrap(err, "invalid --default-requests")
+	}
+	if opt.DefaultLimits, err = manifest.ParseResourceList(in.defaultLimits); err != nil {
+		return errors.Wrap(err, "invalid --default-limits")
+	}
+	if opt.Max, err = manifest.ParseResourceList(in.max); err != nil {
+		return errors.Wrap(err, "invalid --max")
+	}
+	objs, err := manifest.NewNamespace(opt)
+	if err != nil {
+		return err
+	}
+
+	restConfig, err := rootOpts.configFlags.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	return applyNamespace(ctx, streams, clientset, objs)
+}
+
+// applyNamespace creates the objects of the build namespace or updates the
+// existing ones, the namespace only gets its pod security label
+func applyNamespace(ctx context.Context, streams genericclioptions.IOStreams, clientset kubernetes.Interface, objs *manifest.NamespaceObjects) error {
+	name := objs.Namespace.Name
+	report := func(kind, objName string, err error, existed bool) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply %s %q", kind, objName)
+		}
+		state := "created"
+		if existed {
+			state = "configured"
+		}
+		fmt.Fprintf(streams.Out, "%s/%s %s\n", kind, objName, state)
+		return nil
+	}
+
+	nsClient := clientset.CoreV1().Namespaces()
+	ns, err := nsClient.Get(ctx, name, metav1.GetOptions{})
+	existed := err == nil
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = nsClient.Create(ctx, objs.Namespace, metav1.CreateOptions{})
+	} else if err == nil && len(objs.Namespace.Labels) > 0 {
+		if ns.Labels == nil {
+			ns.Labels = map[string]string{}
+		}
+		for k, v := range objs.Namespace.Labels {
+			ns.Labels[k] = v
+		}
+		_, err = nsClient.Update(ctx, ns, metav1.UpdateOptions{})
+	}
+	if err := report("namespace", name, err, existed); err != nil {
+		return err
+	}
+
+	quotaClient := clientset.CoreV1().ResourceQuotas(name)
+	existingQuota, err := quotaClient.Get(ctx, objs.Quota.Name, metav1.GetOptions{})
+	existed = err == nil
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = quotaClient.Create(ctx, objs.Quota, metav1.CreateOptions{})
+	} else if err == nil {
+		objs.Quota.ResourceVersion = existingQuota.ResourceVersion
+		_, err = quotaClient.Update(ctx, objs.Quota, metav1.UpdateOptions{})
+	}
+	if err := report("resourcequota", objs.Quota.Name, err, existed); err != nil {
+		return err
+	}
+
+	limitClient := clientset.CoreV1().LimitRanges(name)
+	existingLimits, err := limitClient.Get(ctx, objs.LimitRange.Name, metav1.GetOptions{})
+	existed = err == nil
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = limitClient.Create(ctx, objs.LimitRange, metav1.CreateOptions{})
+	} else if err == nil {
+		objs.LimitRange.ResourceVersion = existingLimits.ResourceVersion
+		_, err = limitClient.Update(ctx, objs.LimitRange, metav1.UpdateOptions{})
+	}
+	if err := report("limitrange", objs.LimitRange.Name, err, existed); err != nil {
+		return err
+	}
+
+	npClient := clientset.NetworkingV1().NetworkPolicies(name)
+	existingNP, err := npClient.Get(ctx, objs.NetworkPolicy.Name, metav1.GetOptions{})
+	existed = err == nil
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = npClient.Create(ctx, objs.NetworkPolicy, metav1.CreateOptions{})
+	} else if err == nil {
+		objs.NetworkPolicy.ResourceVersion = existingNP.ResourceVersion
+		_, err = npClient.Update(ctx, objs.NetworkPolicy, metav1.UpdateOptions{})
+	}
+	if err := report("networkpolicy", objs.NetworkPolicy.Name, err, existed); err != nil {
+		return err
+	}
+
+	roleClient := clientset.RbacV1().Roles(name)
+	existingRole, err := roleClient.Get(ctx, objs.Role.Name, metav1.GetOptions{})
+	existed = err == nil
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = roleClient.Create(ctx, objs.Role, metav1.CreateOptions{})
+	} else if err == nil {
+		objs.Role.ResourceVersion = existingRole.ResourceVersion
+		_, err = roleClient.Update(ctx, objs.Role, metav1.UpdateOptions{})
+	}
+	if err := report("role", objs.Role.Name, err, existed); err != nil {
+		return err
+	}
+
+	if objs.RoleBinding == nil {
+		return nil
+	}
+	// The role ref of a binding is immutable, it's the same Role here
+	bindingClient := clientset.RbacV1().RoleBindings(name)
+	existingBinding, err := bindingClient.Get(ctx, objs.RoleBinding.Name, metav1.GetOptions{})
+	existed = err == nil
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = bindingClient.Create(ctx, objs.RoleBinding, metav1.CreateOptions{})
+	} else if err == nil {
+		objs.RoleBinding.ResourceVersion = existingBinding.ResourceVersion
+		_, err = bindingClient.Update(ctx, objs.RoleBinding, metav1.UpdateOptions{})
+	}
+	return report("rolebinding", objs.RoleBinding.Name, err, existed)
+}
+
+func initNamespaceCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	var options initNamespaceOptions
+
+	cmd := &cobra.Command{
+		Use:   "init-namespace [OPTIONS] NAMESPACE",
+		Short: "Create a namespace for builders with a quota, limits, network policy and RBAC",
+		Long: `Create a namespace for builders with a quota, limits, network policy and RBAC
+
+The ResourceQuota caps what the builders of the namespace consume together,
+the LimitRange gives the containers without requests and limits the defaults
+and caps their limits.  The network policy only admits traffic from the pods
+of the namespace.  The Role grants what creating builders and running builds
+on them needs, it's bound to the --bind-user, --bind-group and
+--bind-service-account.  Loading images on the nodes also needs reading the
+nodes, which only a ClusterRole can grant.
+
+Running it again updates the objects, an existing namespace keeps its labels.`,
+		Example: `  kubectl buildkit init-namespace builds --bind-group team-a --pod-security restricted
+  kubectl buildkit init-namespace ci --bind-service-account ci:runner --quota requests.cpu=64,requests.memory=256Gi,pods=50`,
+		Args: ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options.name = args[0]
+			return runInitNamespace(streams, rootOpts, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&options.podSecurity, "pod-security", "", "Pod Security Standard the namespace enforces (privileged, baseline, restricted), restricted namespaces get restricted builders")
+	flags.StringVar(&options.quota, "quota", manifest.DefaultNamespaceQuota, "Hard limits of the ResourceQuota of the namespace")
+	flags.StringVar(&options.defaultRequests, "default-requests", manifest.DefaultContainerRequests, "Requests of the containers setting none")
+	flags.StringVar(&options.defaultLimits, "default-limits", manifest.DefaultContainerLimits, "Limits of the containers setting none")
+	flags.StringVar(&options.max, "max", manifest.DefaultContainerMax, "Maximum limits of a container")
+	flags.StringSliceVar(&options.users, "bind-user", nil, "Users granted the builder role")
+	flags.StringSliceVar(&options.groups, "bind-group", nil, "Groups granted the builder role")
+	flags.StringSliceVar(&options.serviceAccounts, "bind-service-account", nil, "Service accounts granted the builder role, NAME in the namespace or NAMESPACE:NAME")
+
+	return cmd
+}
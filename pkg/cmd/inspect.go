@@ -0,0 +1,148 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type inspectOptions struct {
+	builder      string
+	repositories int
+	commonKubeOptions
+}
+
+// podCacheStats are the cache statistics of a builder pod, or the error
+// reading them
+type podCacheStats struct {
+	stats *build.CacheStats
+	err   error
+}
+
+func runInspect(streams genericclioptions.IOStreams, in inspectOptions) error {
+	ctx := appcontext.Context()
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	builders, err := d.List(ctx)
+	if err != nil {
+		return err
+	}
+	var b *driver.Builder
+	for i := range builders {
+		if builders[i].Name == in.builder {
+			b = &builders[i]
+		}
+	}
+	if b == nil {
+		return fmt.Errorf("builder %s not found", in.builder)
+	}
+	stats, err := builderCacheStats(ctx, d, in.repositories)
+	if err != nil {
+		return err
+	}
+	info, err := d.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(streams.Out, "Name:\t%s\n", b.Name)
+	fmt.Fprintf(streams.Out, "Driver:\t%s\n", b.Driver)
+	if info.MaxParallelBuilds > 0 {
+		fmt.Fprintf(streams.Out, "Builds:\t%d running, %d queued, %d at once\n", info.RunningBuilds, info.QueuedBuilds, info.MaxParallelBuilds)
+	}
+	fmt.Fprintf(streams.Out, "\nNodes:\n")
+	for _, n := range b.Nodes {
+		w := tabwriter.NewWriter(streams.Out, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(w, "Name:\t%s\n", n.Name)
+		fmt.Fprintf(w, "Status:\t%s\n", n.Status)
+		if n.Host != "" {
+			fmt.Fprintf(w, "Host:\t%s\n", n.Host)
+		}
+		fmt.Fprintf(w, "Platforms:\t%s\n", strings.Join(platformutil.FormatInGroups(n.Platforms), ", "))
+		if s, ok := stats[n.Name]; ok {
+			writeCacheStats(w, s)
+		}
+		w.Flush()
+		fmt.Fprintln(streams.Out)
+	}
+	return nil
+}
+
+// builderCacheStats reads the cache statistics of every running pod of the
+// builder, by pod name
+func builderCacheStats(ctx context.Context, d driver.Driver, repositories int) (map[string]podCacheStats, error) {
+	nodes, err := d.NodeClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]podCacheStats{}
+	for _, n := range nodes {
+		stats, err := build.GetCacheStats(ctx, n.BuildKitClient, repositories)
+		res[n.NodeName] = podCacheStats{stats: stats, err: err}
+		n.BuildKitClient.Close()
+	}
+	return res, nil
+}
+
+func writeCacheStats(w io.Writer, s podCacheStats) {
+	if s.err != nil {
+		fmt.Fprintf(w, "Cache:\tunavailable: %v\n", s.err)
+		return
+	}
+	fmt.Fprintf(w, "Cache:\t%s in %d entries\n", build.FormatBytes(s.stats.Size), s.stats.Entries)
+	if len(s.stats.Repositories) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Cached Repositories:\n")
+	for _, r := range s.stats.Repositories {
+		fmt.Fprintf(w, "  %s\t%s\n", r.Name, build.FormatBytes(r.Size))
+	}
+}
+
+func inspectCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := inspectOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "inspect [NAME]",
+		Short: "Inspect a builder and the build cache of its pods",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runInspect(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.IntVar(&options.repositories, "repositories", 5, "Number of cached image repositories to show per pod")
+
+	return cmd
+}
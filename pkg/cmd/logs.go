@@ -0,0 +1,68 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"time"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type logsOptions struct {
+	builder string
+	pod     string
+	follow  bool
+	tail    int64
+	since   time.Duration
+	commonKubeOptions
+}
+
+func runLogs(streams genericclioptions.IOStreams, in logsOptions) error {
+	ctx := appcontext.Context()
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	return d.Logs(ctx, in.pod, driver.LogOptions{Follow: in.follow, Tail: in.tail, Since: in.since}, streams.Out)
+}
+
+func logsCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := logsOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "logs [OPTIONS] [NAME]",
+		Short: "Print the buildkitd logs of the pods of a builder",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runLogs(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.BoolVarP(&options.follow, "follow", "f", false, "Stream the logs until interrupted")
+	flags.StringVar(&options.pod, "pod", "", "Only print the logs of this pod of the builder (default: all its pods, each line prefixed with its pod)")
+	flags.Int64Var(&options.tail, "tail", -1, "Number of lines to print from the end of the logs of each pod (default: all)")
+	flags.DurationVar(&options.since, "since", 0, "Only print the logs newer than this, eg. 10m")
+
+	return cmd
+}
@@ -9,17 +9,23 @@ import (
 
 	"github.com/moby/buildkit/util/appcontext"
 	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
 type lsOptions struct {
+	cache  bool
+	output string
 	commonKubeOptions
 }
 
 func runLs(streams genericclioptions.IOStreams, in lsOptions) error {
 	ctx := appcontext.Context()
+	if err := validateOutputFormat(in.output); err != nil {
+		return err
+	}
 
 	var builders []driver.Builder
 	for name, factory := range driver.GetFactories() {
@@ -34,12 +40,57 @@ func runLs(streams genericclioptions.IOStreams, in lsOptions) error {
 		builders = append(builders, b...)
 	}
 
+	if in.output != "" {
+		res := make([]builderOutput, 0, len(builders))
+		for _, b := range builders {
+			d, err := driver.GetDriver(ctx, b.Name, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+			if err != nil {
+				return err
+			}
+			var stats map[string]podCacheStats
+			if in.cache {
+				if stats, err = builderCacheStats(ctx, d, 0); err != nil {
+					return err
+				}
+			}
+			res = append(res, newBuilderOutput(ctx, b, d, stats))
+		}
+		return printOutput(streams.Out, in.output, res)
+	}
+
 	w := tabwriter.NewWriter(streams.Out, 0, 0, 1, ' ', 0)
-	fmt.Fprintf(w, "NAME\tNODE\tDRIVER\tSTATUS\tPLATFORMS\n")
+	if in.cache {
+		fmt.Fprintf(w, "NAME\tNODE\tHOST\tRUNTIME\tDRIVER\tSTATUS\tPLATFORMS\tCACHE\n")
+	} else {
+		fmt.Fprintf(w, "NAME\tNODE\tHOST\tRUNTIME\tDRIVER\tSTATUS\tPLATFORMS\n")
+	}
 
 	for _, b := range builders {
-		for _, n := range b.Nodes {
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.Name, n.Name, b.Driver, n.Status, strings.Join(platformutil.FormatInGroups(n.Platforms), ", "))
+		var stats map[string]podCacheStats
+		if in.cache {
+			d, err := driver.GetDriver(ctx, b.Name, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+			if err != nil {
+				return err
+			}
+			// Only the top repositories are shown by inspect
+			if stats, err = builderCacheStats(ctx, d, 0); err != nil {
+				return err
+			}
+		}
+		for _, n := range append(append([]driver.Node{}, b.Nodes...), b.Pending...) {
+			host := n.Host
+			if host == "" {
+				host = "<none>"
+			}
+			runtime := n.Runtime
+			if runtime == "" {
+				runtime = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s", b.Name, n.Name, host, runtime, b.Driver, n.Status, strings.Join(platformutil.FormatInGroups(n.Platforms), ", "))
+			if in.cache {
+				fmt.Fprintf(w, "\t%s", lsCacheColumn(stats, n.Name))
+			}
+			fmt.Fprintln(w)
 		}
 	}
 
@@ -48,6 +99,18 @@ func runLs(streams genericclioptions.IOStreams, in lsOptions) error {
 	return nil
 }
 
+// lsCacheColumn summarizes the cache of a pod, "-" for pods not running
+func lsCacheColumn(stats map[string]podCacheStats, pod string) string {
+	s, ok := stats[pod]
+	switch {
+	case !ok:
+		return "-"
+	case s.err != nil:
+		return "unavailable"
+	}
+	return fmt.Sprintf("%s (%d entries)", build.FormatBytes(s.stats.Size), s.stats.Entries)
+}
+
 func lsCmd(streams genericclioptions.IOStreams) *cobra.Command {
 	options := lsOptions{
 		commonKubeOptions: commonKubeOptions{
@@ -73,6 +136,8 @@ func lsCmd(streams genericclioptions.IOStreams) *cobra.Command {
 		SilenceUsage: true,
 	}
 	options.configFlags.AddFlags(cmd.Flags())
+	cmd.Flags().BoolVar(&options.cache, "cache", false, "Show the build cache size of each pod, so warm and cold pods can be told apart")
+	cmd.Flags().StringVarP(&options.output, "output", "o", "", "Print the builders as json or yaml instead of a table")
 
 	return cmd
 }
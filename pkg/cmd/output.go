@@ -0,0 +1,134 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// The builder management commands print what their tables show as JSON or
+// YAML with -o, for scripts.  The YAML is the JSON rendered as YAML, so both
+// have the same field names.
+
+const (
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// builderOutput describes a builder and its pods
+type builderOutput struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Driver    string `json:"driver"`
+	Rootless  bool   `json:"rootless"`
+	// Version is the buildkitd version of the pods, empty if none runs
+	Version string      `json:"version,omitempty"`
+	Pods    []podOutput `json:"pods"`
+}
+
+type podOutput struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Node is the Kubernetes node the pod is scheduled on
+	Node string `json:"node,omitempty"`
+	// Runtime is the container runtime of the node
+	Runtime   string          `json:"runtime,omitempty"`
+	Platforms []string        `json:"platforms,omitempty"`
+	Cache     *podCacheOutput `json:"cache,omitempty"`
+}
+
+type podCacheOutput struct {
+	Size    int64  `json:"size"`
+	Entries int    `json:"entries"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validateOutputFormat fails unless format is empty, json or yaml
+func validateOutputFormat(format string) error {
+	switch format {
+	case "", outputJSON, outputYAML:
+		return nil
+	}
+	return errors.Errorf("invalid output format %q, use json or yaml", format)
+}
+
+// printOutput writes v to w in format, json or yaml
+func printOutput(w io.Writer, format string, v interface{}) error {
+	dt, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == outputJSON {
+		_, err = w.Write(append(dt, '\n'))
+		return err
+	}
+	var m interface{}
+	if err := json.Unmarshal(dt, &m); err != nil {
+		return err
+	}
+	if dt, err = kyaml.Marshal(m); err != nil {
+		return err
+	}
+	_, err = w.Write(dt)
+	return err
+}
+
+// newBuilderOutput describes b, with the cache statistics of its pods if
+// stats is set
+func newBuilderOutput(ctx context.Context, b driver.Builder, d driver.Driver, stats map[string]podCacheStats) builderOutput {
+	res := builderOutput{
+		Name:      b.Name,
+		Namespace: b.Namespace,
+		Driver:    b.Driver,
+		Rootless:  b.Rootless,
+		Pods:      []podOutput{},
+	}
+	if d != nil && len(b.Nodes) > 0 {
+		// A builder without running pods has no version to report
+		res.Version, _ = d.GetVersion(ctx)
+	}
+	for _, n := range append(append([]driver.Node{}, b.Nodes...), b.Pending...) {
+		pod := podOutput{
+			Name:      n.Name,
+			Status:    n.Status,
+			Node:      n.Host,
+			Runtime:   n.Runtime,
+			Platforms: platformutil.Format(n.Platforms),
+		}
+		if s, ok := stats[n.Name]; ok {
+			pod.Cache = &podCacheOutput{}
+			if s.err != nil {
+				pod.Cache.Error = s.err.Error()
+			} else {
+				pod.Cache.Size = s.stats.Size
+				pod.Cache.Entries = s.stats.Entries
+			}
+		}
+		res.Pods = append(res.Pods, pod)
+	}
+	return res
+}
+
+// printBuilder prints the builder name of d in format
+func printBuilder(ctx context.Context, w io.Writer, format string, d driver.Driver, name string) error {
+	if name == "" {
+		name = "buildkit"
+	}
+	builders, err := d.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range builders {
+		if b.Name == name {
+			return printOutput(w, format, newBuilderOutput(ctx, b, d, nil))
+		}
+	}
+	return errors.Errorf("builder %s not found", name)
+}
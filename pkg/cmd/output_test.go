@@ -0,0 +1,230 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// listDriver lists a single builder, of buildkitd version
+type listDriver struct {
+	driver.Driver
+	builder driver.Builder
+	version string
+}
+
+func (d *listDriver) List(ctx context.Context) ([]driver.Builder, error) {
+	return []driver.Builder{d.builder}, nil
+}
+
+func (d *listDriver) GetVersion(ctx context.Context) (string, error) {
+	return d.version, nil
+}
+
+func testListDriver() *listDriver {
+	return &listDriver{
+		builder: driver.Builder{
+			Name:      "ci",
+			Driver:    "kubernetes",
+			Namespace: "builds",
+			Rootless:  true,
+			Nodes: []driver.Node{{
+				Name:      "ci-7d4b9c-x2x9k",
+				Status:    "Running",
+				Host:      "node-1",
+				Runtime:   "containerd",
+				Platforms: []specs.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			}},
+			Pending: []driver.Node{{Name: "ci-7d4b9c-q8tnm", Status: "Pending"}},
+		},
+		version: "v0.9.3",
+	}
+}
+
+// The JSON and YAML printed with -o are what scripts parse, their field
+// names are kept: each output is compared to its golden copy, and read back
+// into the value printed.
+func Test_printOutput(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	d := testListDriver()
+	stats := map[string]podCacheStats{
+		"ci-7d4b9c-x2x9k": {stats: &build.CacheStats{Size: 2048, Entries: 3}},
+		"ci-7d4b9c-q8tnm": {err: errors.New("pod is not running")},
+	}
+	for _, tc := range []struct {
+		name string
+		// print prints in the format, v is what is printed, decoded into a
+		// new value of its type
+		print func(format string) (string, error)
+		v     interface{}
+		new   func() interface{}
+		json  string
+		yaml  string
+	}{
+		{
+			name: "ls",
+			print: func(format string) (string, error) {
+				buf := &bytes.Buffer{}
+				err := printOutput(buf, format, []builderOutput{newBuilderOutput(ctx, d.builder, d, stats)})
+				return buf.String(), err
+			},
+			v:   []builderOutput{newBuilderOutput(ctx, d.builder, d, stats)},
+			new: func() interface{} { return &[]builderOutput{} },
+			json: `[
+  {
+    "name": "ci",
+    "namespace": "builds",
+    "driver": "kubernetes",
+    "rootless": true,
+    "version": "v0.9.3",
+    "pods": [
+      {
+        "name": "ci-7d4b9c-x2x9k",
+        "status": "Running",
+        "node": "node-1",
+        "runtime": "containerd",
+        "platforms": [
+          "linux/amd64",
+          "linux/arm64"
+        ],
+        "cache": {
+          "size": 2048,
+          "entries": 3
+        }
+      },
+      {
+        "name": "ci-7d4b9c-q8tnm",
+        "status": "Pending",
+        "cache": {
+          "size": 0,
+          "entries": 0,
+          "error": "pod is not running"
+        }
+      }
+    ]
+  }
+]
+`,
+			yaml: `- driver: kubernetes
+  name: ci
+  namespace: builds
+  pods:
+  - cache:
+      entries: 3
+      size: 2048
+    name: ci-7d4b9c-x2x9k
+    node: node-1
+    platforms:
+    - linux/amd64
+    - linux/arm64
+    runtime: containerd
+    status: Running
+  - cache:
+      entries: 0
+      error: pod is not running
+      size: 0
+    name: ci-7d4b9c-q8tnm
+    status: Pending
+  rootless: true
+  version: v0.9.3
+`,
+		},
+		{
+			name: "create",
+			print: func(format string) (string, error) {
+				buf := &bytes.Buffer{}
+				err := printBuilder(ctx, buf, format, &listDriver{builder: driver.Builder{Name: "buildkit", Driver: "kubernetes", Namespace: "default"}}, "")
+				return buf.String(), err
+			},
+			v:   builderOutput{Name: "buildkit", Driver: "kubernetes", Namespace: "default", Pods: []podOutput{}},
+			new: func() interface{} { return &builderOutput{} },
+			json: `{
+  "name": "buildkit",
+  "namespace": "default",
+  "driver": "kubernetes",
+  "rootless": false,
+  "pods": []
+}
+`,
+			yaml: `driver: kubernetes
+name: buildkit
+namespace: default
+pods: []
+rootless: false
+`,
+		},
+		{
+			name: "version",
+			print: func(format string) (string, error) {
+				buf := &bytes.Buffer{}
+				err := printOutput(buf, format, versionOutput{Client: "v0.1.5", BuilderError: "builder buildkit not found"})
+				return buf.String(), err
+			},
+			v:   versionOutput{Client: "v0.1.5", BuilderError: "builder buildkit not found"},
+			new: func() interface{} { return &versionOutput{} },
+			json: `{
+  "client": "v0.1.5",
+  "builderError": "builder buildkit not found"
+}
+`,
+			yaml: `builderError: builder buildkit not found
+client: v0.1.5
+`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			out, err := tc.print(outputJSON)
+			require.NoError(t, err)
+			require.Equal(t, tc.json, out)
+			v := tc.new()
+			require.NoError(t, json.Unmarshal([]byte(out), v))
+			require.Equal(t, tc.v, derefOutput(v))
+
+			out, err = tc.print(outputYAML)
+			require.NoError(t, err)
+			require.Equal(t, tc.yaml, out)
+			v = tc.new()
+			// The YAML has the field names of the JSON
+			var m interface{}
+			require.NoError(t, kyaml.Unmarshal([]byte(out), &m))
+			dt, err := json.Marshal(m)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(dt, v))
+			require.Equal(t, tc.v, derefOutput(v))
+		})
+	}
+}
+
+// derefOutput returns the value v points to
+func derefOutput(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *[]builderOutput:
+		return *v
+	case *builderOutput:
+		return *v
+	case *versionOutput:
+		return *v
+	}
+	return v
+}
+
+func Test_validateOutputFormat(t *testing.T) {
+	t.Parallel()
+	for _, format := range []string{"", outputJSON, outputYAML} {
+		require.NoError(t, validateOutputFormat(format))
+	}
+	require.EqualError(t, validateOutputFormat("table"), `invalid output format "table", use json or yaml`)
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/moby/buildkit/client"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+)
+
+// The outputs of a build are decided before it starts: the tags are
+// normalized and deduplicated, they name the image outputs without a name of
+// their own, and --push and --load apply to the output given, so
+// --print-outputs shows what the build would do without building.
+
+// plannedOutputs returns a copy of the outputs of o named after its tags
+func plannedOutputs(o build.Options) ([]client.ExportEntry, error) {
+	exports := make([]client.ExportEntry, len(o.Exports))
+	for i, e := range o.Exports {
+		attrs := make(map[string]string, len(e.Attrs))
+		for k, v := range e.Attrs {
+			attrs[k] = v
+		}
+		e.Attrs = attrs
+		exports[i] = e
+	}
+	if err := build.NameOutputs(exports, o.Tags); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// outputDestination describes where the output e goes
+func outputDestination(e client.ExportEntry) string {
+	switch e.Type {
+	case client.ExporterImage:
+		if push, _ := strconv.ParseBool(e.Attrs["push"]); push {
+			return "registry"
+		}
+		return "builder runtime"
+	case "runtime":
+		return "builder runtime"
+	case client.ExporterLocal:
+		return e.OutputDir
+	case build.ExporterPVC:
+		return e.Attrs["claim"] + ":" + e.Attrs["dest"]
+	}
+	if e.Output == nil {
+		return "builder runtime"
+	}
+	return "file"
+}
+
+// printOutputPlan prints the outputs of the targets, by target name
+func printOutputPlan(w io.Writer, targets map[string]build.Options) error {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tOUTPUT\tDESTINATION\tNAMES")
+	for _, name := range names {
+		exports, err := plannedOutputs(targets[name])
+		if err != nil {
+			return err
+		}
+		for _, e := range exports {
+			images := strings.ReplaceAll(e.Attrs["name"], ",", ", ")
+			if images == "" {
+				images = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, e.Type, outputDestination(e), images)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// The builders of --builder-pool are named NAME, in the namespace of the
+// builder, or NAMESPACE/NAME.  The build runs on the builder of the pod
+// chosen among the running pods of all of them, see driver.ChoosePoolNode,
+// everything else of the build then uses that builder as if it were given
+// with --builder.
+
+type poolBuilder struct {
+	name      string
+	namespace string
+}
+
+// parseBuilderPool parses the builders of --builder-pool
+func parseBuilderPool(pool []string) ([]poolBuilder, error) {
+	var res []poolBuilder
+	for _, s := range pool {
+		b := poolBuilder{name: s}
+		if parts := strings.SplitN(s, "/", 2); len(parts) == 2 {
+			b.namespace, b.name = parts[0], parts[1]
+		}
+		if b.name == "" || strings.Contains(b.name, "/") || (b.namespace == "" && strings.Contains(s, "/")) {
+			return nil, errors.Errorf("invalid builder %q of --builder-pool, use NAME or NAMESPACE/NAME", s)
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+func (b poolBuilder) String() string {
+	if b.namespace == "" {
+		return b.name
+	}
+	return b.namespace + "/" + b.name
+}
+
+// chooseFromPool points in at the builder of the pool the build runs on,
+// and returns the context the build prefers the chosen pod with
+func chooseFromPool(ctx context.Context, errOut io.Writer, in *buildOptions, contextPathHash string, platforms []specs.Platform) (context.Context, error) {
+	pool, err := parseBuilderPool(in.builderPool)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]clientcmd.ClientConfig, len(pool))
+	builders := make([]driver.PoolBuilder, len(pool))
+	for i, b := range pool {
+		configs[i] = in.KubeClientConfig
+		if b.namespace != "" {
+			configs[i] = namespacedClientConfig{config: in.KubeClientConfig, namespace: b.namespace}
+		}
+		d, err := getBuildDriver(ctx, configs[i], b.name, contextPathHash, in.size, in.nodes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to use builder %s of the pool", b)
+		}
+		builders[i] = driver.PoolBuilder{Name: b.String(), Driver: d}
+	}
+	i, node := driver.ChoosePoolNode(ctx, builders, contextPathHash, platforms)
+	in.builder = pool[i].name
+	in.KubeClientConfig = configs[i]
+	if node == "" {
+		fmt.Fprintf(errOut, "no builder of the pool has running pods, building on %s\n", pool[i])
+		return ctx, nil
+	}
+	fmt.Fprintf(errOut, "building on pod %s of builder %s of the pool\n", node, pool[i])
+	return driver.WithPreferredNode(ctx, node), nil
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type promoteOptions struct {
+	src                string
+	dst                string
+	progress           string
+	registrySecretName string
+	sourcePolicy       string
+	referrersMode      string
+}
+
+func runPromote(streams genericclioptions.IOStreams, rootOpts *rootOptions, cmd *cobra.Command, in promoteOptions) error {
+	ctx := appcontext.Context()
+	var policy *build.SourcePolicy
+	if in.sourcePolicy != "" {
+		var err error
+		if policy, err = build.LoadSourcePolicy(in.sourcePolicy); err != nil {
+			return err
+		}
+	}
+	if _, err := imagetools.ParseReferrersMode(in.referrersMode); err != nil {
+		return err
+	}
+	d, err := rootBuilderDriver(ctx, rootOpts, cmd, nil)
+	if err != nil {
+		return err
+	}
+	pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+	desc, err := build.Promote(ctx, d, in.src, in.dst, policy, in.registrySecretName, in.referrersMode, pw)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(streams.Out, "promoted %s to %s@%s\n", in.src, in.dst, desc.Digest)
+	return nil
+}
+
+func promoteCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	var options promoteOptions
+	cmd := &cobra.Command{
+		Use:   "promote SRC DST",
+		Short: "Copy an image to another repository with all its platforms and attestations, keeping its digest",
+		Long: `Copy an image to another repository, e.g. from a staging to a production registry.
+The layers are copied by the builder, and the image keeps its digest, platforms,
+attestations and referrers.  The registry secret of the builder needs credentials
+for both registries.`,
+		Args: ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options.src, options.dst = args[0], args[1]
+			return runPromote(streams, rootOpts, cmd, options)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&options.progress, "progress", "auto", "Set type of progress output (auto, plain, tty). Use plain to show container output")
+	flags.StringVar(&options.registrySecretName, "registry-secret", "", "Name of the registry secret, defaults to the builder name")
+	flags.StringVar(&options.sourcePolicy, "source-policy", "", "Source policy file (BuildKit JSON format) the source is evaluated against, and which must allow the destination unchanged")
+	flags.StringVar(&options.referrersMode, "referrers-mode", imagetools.ReferrersModeAuto, "How the referrers are stored in the destination: referrers (OCI 1.1 referrers API), tag (sha256-<digest> fallback tag) or auto")
+	return cmd
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type pruneOptions struct {
+	builder     string
+	all         bool
+	keepStorage string
+	filters     []string
+	commonKubeOptions
+}
+
+func runPrune(streams genericclioptions.IOStreams, in pruneOptions) error {
+	ctx := appcontext.Context()
+
+	opt := build.PruneOpt{All: in.all, Filters: in.filters}
+	if in.keepStorage != "" {
+		q, err := resource.ParseQuantity(in.keepStorage)
+		if err != nil {
+			return errors.Errorf("invalid --keep-storage %q", in.keepStorage)
+		}
+		opt.KeepStorage = q.Value()
+	}
+
+	d, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	// Every pod has its own cache, not only the one builds are routed to
+	nodes, err := d.NodeClients(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.Errorf("builder %s has no running pods", in.builder)
+	}
+
+	w := tabwriter.NewWriter(streams.Out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "POD\tRECORDS\tRECLAIMED")
+	var total int64
+	failed := 0
+	for _, n := range nodes {
+		res, err := build.Prune(ctx, n.BuildKitClient, opt)
+		n.BuildKitClient.Close()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\t-\tfailed: %v\n", n.NodeName, err)
+			continue
+		}
+		total += res.Reclaimed
+		fmt.Fprintf(w, "%s\t%d\t%s\n", n.NodeName, res.Records, build.FormatBytes(res.Reclaimed))
+	}
+	if len(nodes) > 1 {
+		fmt.Fprintf(w, "TOTAL\t\t%s\n", build.FormatBytes(total))
+	}
+	w.Flush()
+	if failed > 0 {
+		return errors.Errorf("failed to prune %d of %d pods of builder %s", failed, len(nodes), in.builder)
+	}
+	return nil
+}
+
+func pruneCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := pruneOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "prune [NAME]",
+		Short: "Remove the build cache of every pod of a builder",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runPrune(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.BoolVarP(&options.all, "all", "a", false, "Also remove the cache referenced by images, not only the unused cache")
+	flags.StringVar(&options.keepStorage, "keep-storage", "", "Size of the most recently used cache kept on each pod (e.g. 10Gi)")
+	flags.StringArrayVar(&options.filters, "filter", []string{}, "Remove only the cache records matching the filter (e.g. type==regular, description~=golang)")
+
+	return cmd
+}
@@ -0,0 +1,121 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// checkPushTo fails unless every target pushes a tagged image to mirror to
+// valid --push-to destinations, before building it
+func checkPushTo(in buildOptions, targets map[string]build.Options) error {
+	for _, o := range targets {
+		if !isPushing(o.Exports) || len(pushedNames(o)) == 0 {
+			return errors.Errorf("--push-to requires pushing a tagged image with --push")
+		}
+		if _, err := build.MirrorRefs(pushedNames(o)[0], in.pushTo); err != nil {
+			return err
+		}
+	}
+	if len(targets) > 1 {
+		for _, dst := range in.pushTo {
+			if !build.IsRegistryHost(dst) {
+				return errors.Errorf("--push-to %s must be a registry host when building several images", dst)
+			}
+		}
+	}
+	return nil
+}
+
+// splitRegistryTags leaves the pushing targets tagged for several registries
+// with the tags of the registry of their first tag, for the build to push
+// once, and returns the tags of the other registries by target.  Targets
+// naming their outputs with --output are pushed by the build as named.
+func splitRegistryTags(targets map[string]build.Options) (map[string][]string, error) {
+	res := map[string][]string{}
+	for name, o := range targets {
+		if !isPushing(o.Exports) || len(o.Tags) < 2 || len(pushedNames(o)) != len(o.Tags) {
+			continue
+		}
+		primary, others, err := build.SplitRegistryTags(o.Tags)
+		if err != nil {
+			return nil, err
+		}
+		if len(others) == 0 {
+			continue
+		}
+		o.Tags = primary
+		targets[name] = o
+		res[name] = others
+	}
+	return res, nil
+}
+
+// pushToMirrors pushes the images the targets pushed to the --push-to
+// destinations, and reports the outcome of each.  The build stands if a
+// mirror fails, the command fails once all were attempted.
+func pushToMirrors(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, targets map[string]build.Options, resp map[string]*client.SolveResponse, contextPathHash string) error {
+	destinations := map[string][]string{}
+	for name, o := range targets {
+		refs, err := build.MirrorRefs(pushedNames(o)[0], in.pushTo)
+		if err != nil {
+			return err
+		}
+		destinations[name] = refs
+	}
+	return promoteTargets(ctx, streams, in, targets, destinations, resp, contextPathHash, "--push-to destinations")
+}
+
+// pushRegistryTags pushes the images the targets pushed to the tags of their
+// other registries, split off by splitRegistryTags, and reports the outcome
+// of each like pushToMirrors
+func pushRegistryTags(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, targets map[string]build.Options, tags map[string][]string, resp map[string]*client.SolveResponse, contextPathHash string) error {
+	return promoteTargets(ctx, streams, in, targets, tags, resp, contextPathHash, "registries")
+}
+
+// promoteTargets promotes the image each target pushed to its destinations,
+// in parallel, failing once all were attempted if any failed
+func promoteTargets(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, targets map[string]build.Options, destinations map[string][]string, resp map[string]*client.SolveResponse, contextPathHash, what string) error {
+	d, err := getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash, in.size, in.nodes)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(destinations))
+	for name := range destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var results []build.MirrorResult
+	for _, name := range names {
+		o := targets[name]
+		r, ok := resp[name]
+		if !ok || r == nil || r.ExporterResponse["containerimage.digest"] == "" {
+			return errors.Errorf("the build of %s didn't report the digest it pushed", name)
+		}
+		src := pushedNames(o)[0] + "@" + r.ExporterResponse["containerimage.digest"]
+		pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+		results = append(results, build.PushMirrors(ctx, d, src, destinations[name], o.Inputs.SourcePolicy, in.registrySecretName, in.referrersMode, pw)...)
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(streams.ErrOut, "failed to push %s: %v\n", r.Destination, r.Err)
+			continue
+		}
+		fmt.Fprintf(streams.ErrOut, "pushed %s@%s\n", r.Destination, r.Desc.Digest)
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to push to %d of %d %s, the other images were pushed", failed, len(results), what)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type logoutOptions struct {
+	host               string
+	registrySecretName string
+	purgeCredentials   bool
+}
+
+func runLogout(streams genericclioptions.IOStreams, rootOpts *rootOptions, cmd *cobra.Command, in logoutOptions) error {
+	ctx := appcontext.Context()
+	d, err := rootBuilderDriver(ctx, rootOpts, cmd, nil)
+	if err != nil {
+		return err
+	}
+	if err := d.Logout(ctx, in.registrySecretName, in.host); err != nil {
+		return err
+	}
+	// Detached builds hold a copy of the credentials on the builder pods
+	if err := build.PurgeDetachedCredentials(ctx, d); err != nil {
+		return err
+	}
+	if in.host == "" {
+		fmt.Fprintln(streams.Out, "removed all registry credentials")
+	} else {
+		fmt.Fprintf(streams.Out, "removed credentials for %s\n", in.host)
+	}
+	return nil
+}
+
+func registryCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "registry",
+		Short: "Manage the registry credentials used by builders",
+	}
+
+	var options logoutOptions
+	logout := &cobra.Command{
+		Use:   "logout [HOST]",
+		Short: "Remove registry credentials from the builder's registry secret",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch {
+			case len(args) > 1:
+				return errors.Errorf("%q accepts at most 1 argument", cmd.CommandPath())
+			case len(args) == 0 && !options.purgeCredentials:
+				return errors.Errorf("specify a registry HOST or use --purge-credentials to remove all credentials")
+			case len(args) == 1 && options.purgeCredentials:
+				return errors.Errorf("--purge-credentials removes the credentials for every registry and can't be combined with HOST")
+			case len(args) == 1:
+				options.host = args[0]
+			}
+			return runLogout(streams, rootOpts, cmd, options)
+		},
+		SilenceUsage: true,
+	}
+	flags := logout.Flags()
+	flags.StringVar(&options.registrySecretName, "registry-secret", "", "Name of the registry secret, defaults to the builder name")
+	flags.BoolVar(&options.purgeCredentials, "purge-credentials", false, "Delete the registry secret and the credentials cached on the builder pods")
+
+	cmd.AddCommand(logout)
+	return cmd
+}
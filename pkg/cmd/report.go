@@ -0,0 +1,105 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// reportTarget is the target the build report is about, the default one or
+// else the first by name
+func reportTarget(targets map[string]build.Options) string {
+	if _, ok := targets["default"]; ok {
+		return "default"
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// reportResolver returns a resolver with the credentials of the builder, nil
+// unless the report is about a pushed image
+func reportResolver(ctx context.Context, in buildOptions, o build.Options, contextPathHash string) *imagetools.Resolver {
+	if !isPushing(o.Exports) || len(pushedNames(o)) == 0 {
+		return nil
+	}
+	d, err := getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash, in.size, in.nodes)
+	if err != nil {
+		logrus.Debugf("the report has no image size: %s", err)
+		return nil
+	}
+	return imagetools.New(imagetools.Opt{Auth: d.GetAuthWrapper(in.registrySecretName)})
+}
+
+// imageSize returns the size of the image ref, 0 if unknown, eg. as the tag
+// is pushed for the first time
+func imageSize(ctx context.Context, r *imagetools.Resolver, ref string) int64 {
+	if r == nil {
+		return 0
+	}
+	size, err := r.ImageSize(ctx, ref)
+	if err != nil {
+		logrus.Debugf("failed to read the size of %s: %s", ref, err)
+		return 0
+	}
+	return size
+}
+
+// writeBuildReports writes the reports of the build of o, failed with
+// buildErr if set
+func writeBuildReports(ctx context.Context, in buildOptions, o build.Options, resp *client.SolveResponse, buildErr error, duration time.Duration, graph *progress.Graph, r *imagetools.Resolver, previousSize int64, outputs map[string]string) error {
+	report := &build.BuildReport{Duration: duration}
+	if buildErr != nil {
+		report.Error = buildErr.Error()
+	}
+	if len(o.Tags) > 0 {
+		report.Image = o.Tags[0]
+	}
+	if resp != nil {
+		report.Digest = resp.ExporterResponse["containerimage.digest"]
+	}
+	report.AddSteps(graph.Vertexes())
+	// The checks need a local Dockerfile, remote ones are built unchecked
+	if _, dt, err := readLocalDockerfile(in, "--report"); err == nil {
+		if report.Findings, err = build.CheckDockerfile(dt); err == nil && report.Findings == nil {
+			report.Findings = []build.CheckResult{}
+		}
+	}
+	if r != nil && report.Digest != "" {
+		if named, err := reference.ParseNormalizedNamed(pushedNames(o)[0]); err == nil {
+			report.Size = imageSize(ctx, r, named.Name()+"@"+report.Digest)
+			report.PreviousSize = previousSize
+		}
+	}
+	for format, filename := range outputs {
+		if format != build.ReportOutputMarkdown {
+			continue
+		}
+		f, err := os.Create(filename)
+		if err != nil {
+			return errors.Wrap(err, "failed to create the build report")
+		}
+		err = report.WriteMarkdown(f)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to write the build report")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// The builder and namespace a command uses are resolved in this order, the
+// first one set wins:
+//
+//   1. the --builder and --namespace flags, or the builder NAME argument
+//   2. the KUBECTL_BUILDKIT_BUILDER (or BUILDX_BUILDER) and
+//      KUBECTL_BUILDKIT_NAMESPACE environment variables
+//   3. the per-user profile, for the current kubeconfig context or else for
+//      all of them
+//   4. the builder annotation of the current namespace, "name" or
+//      "namespace/name" for a builder shared from another namespace
+//   5. the builder and namespace of the cluster default ConfigMap
+//   6. the "buildkit" builder in the namespace of the kubeconfig context
+//
+// so a team sets its builder once on its namespace, and a cluster admin sets
+// the default of everyone else.  The cluster is only asked for the levels
+// it holds when the levels before them left the builder unset, and each of
+// its objects is read once by a command.
+
+const (
+	// BuilderEnv is the environment variable naming the builder
+	BuilderEnv = "KUBECTL_BUILDKIT_BUILDER"
+	// NamespaceEnv is the environment variable naming the namespace of the builder
+	NamespaceEnv = "KUBECTL_BUILDKIT_NAMESPACE"
+	// NamespaceBuilderAnnotation names the builder of the namespace it is set on
+	NamespaceBuilderAnnotation = "buildkit.mobyproject.org/builder"
+	// ClusterDefaultsNamespace and ClusterDefaultsConfigMap locate the
+	// ConfigMap of the cluster default builder, with builder and namespace keys
+	ClusterDefaultsNamespace = "kube-public"
+	ClusterDefaultsConfigMap = "buildkit-defaults"
+
+	defaultBuilder = "buildkit"
+)
+
+// The sources a builder or namespace was resolved from
+const (
+	sourceFlag       = "flag"
+	sourceArgument   = "argument"
+	sourceEnv        = "environment"
+	sourceProfile    = "profile"
+	sourceAnnotation = "namespace annotation"
+	sourceConfigMap  = "cluster default"
+	sourceDefault    = "default"
+	sourceKubeconfig = "kubeconfig"
+)
+
+// builderResolution is the builder and namespace a command uses, and where
+// each of them was set
+type builderResolution struct {
+	Builder         string
+	BuilderSource   string
+	Namespace       string
+	NamespaceSource string
+}
+
+// builderProfile is the per-user profile, its Contexts are by kubeconfig
+// context and take precedence
+type builderProfile struct {
+	Builder   string                    `json:"builder,omitempty"`
+	Namespace string                    `json:"namespace,omitempty"`
+	Contexts  map[string]builderProfile `json:"contexts,omitempty"`
+}
+
+// profilePath is the per-user profile
+func profilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kubectl-buildkit", "profile.json"), nil
+}
+
+// loadProfile returns the profile entries of the kubeconfig context, the
+// context's own entry first
+func loadProfile(kubeContext string) ([]builderProfile, string, error) {
+	filename, err := profilePath()
+	if err != nil {
+		return nil, "", err
+	}
+	dt, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, filename, nil
+		}
+		return nil, filename, err
+	}
+	var p builderProfile
+	if err := json.Unmarshal(dt, &p); err != nil {
+		return nil, filename, errors.Wrapf(err, "invalid profile %s", filename)
+	}
+	var res []builderProfile
+	if c, ok := p.Contexts[kubeContext]; ok {
+		res = append(res, c)
+	}
+	return append(res, p), filename, nil
+}
+
+// builderSources are where the builder is resolved from past the flags of
+// the command, replaced by the tests
+type builderSources struct {
+	getenv func(string) string
+	// profile loads the profile entries of a kubeconfig context, see loadProfile
+	profile func(kubeContext string) ([]builderProfile, string, error)
+	cluster clusterDefaults
+	// namespace is the namespace of the kubeconfig context
+	namespace func() (string, error)
+}
+
+// clusterDefaults reads the builder defaults set in the cluster
+type clusterDefaults interface {
+	// namespaceBuilder is the builder annotation of namespace, empty if unset
+	namespaceBuilder(namespace string) (string, error)
+	// defaults is the data of the cluster default ConfigMap
+	defaults() (map[string]string, error)
+}
+
+func kubeBuilderSources(kcc clientcmd.ClientConfig, cluster clusterDefaults) builderSources {
+	return builderSources{
+		getenv:  os.Getenv,
+		profile: loadProfile,
+		cluster: cluster,
+		namespace: func() (string, error) {
+			ns, _, err := kcc.Namespace()
+			return ns, err
+		},
+	}
+}
+
+// resolveBuilder resolves the builder and namespace of cmd, builder is the
+// builder NAME argument of the command, if any
+func resolveBuilder(cmd *cobra.Command, kcc clientcmd.ClientConfig, rawConfig api.Config, builder string, cluster clusterDefaults) (*builderResolution, error) {
+	return resolveBuilderFrom(cmd, rawConfig, builder, kubeBuilderSources(kcc, cluster))
+}
+
+func resolveBuilderFrom(cmd *cobra.Command, rawConfig api.Config, builder string, sources builderSources) (*builderResolution, error) {
+	res := &builderResolution{}
+	set := func(b, bSource, ns, nsSource string) {
+		if res.Builder == "" && b != "" {
+			res.Builder, res.BuilderSource = b, bSource
+		}
+		if res.Namespace == "" && ns != "" {
+			res.Namespace, res.NamespaceSource = ns, nsSource
+		}
+	}
+
+	set(builder, sourceArgument, "", "")
+	flagBuilder, _ := cmd.Flags().GetString("builder")
+	flagNamespace, _ := cmd.Flags().GetString("namespace")
+	set(flagBuilder, sourceFlag, flagNamespace, sourceFlag)
+
+	envBuilder := sources.getenv(BuilderEnv)
+	if envBuilder == "" {
+		envBuilder = sources.getenv("BUILDX_BUILDER")
+	}
+	set(envBuilder, sourceEnv, sources.getenv(NamespaceEnv), sourceEnv)
+
+	kubeContext := rawConfig.CurrentContext
+	if c, _ := cmd.Flags().GetString("context"); c != "" {
+		kubeContext = c
+	}
+	profiles, filename, err := sources.profile(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range profiles {
+		set(p.Builder, sourceProfile+" "+filename, p.Namespace, sourceProfile+" "+filename)
+	}
+
+	if res.Builder == "" {
+		if err := resolveFromCluster(sources, res, set); err != nil {
+			// The cluster defaults are optional, and may not be readable
+			logrus.Debugf("failed to read the builder defaults of the cluster: %v", err)
+		}
+	}
+
+	set(defaultBuilder, sourceDefault, "", "")
+	if res.Namespace == "" {
+		ns, err := sources.namespace()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot determine Kubernetes namespace, specify manually")
+		}
+		set("", "", ns, sourceKubeconfig)
+	}
+	return res, nil
+}
+
+// resolveFromCluster applies the builder annotation of the namespace, then
+// the cluster default ConfigMap if the namespace has none
+func resolveFromCluster(sources builderSources, res *builderResolution, set func(b, bSource, ns, nsSource string)) error {
+	namespace := res.Namespace
+	if namespace == "" {
+		var err error
+		if namespace, err = sources.namespace(); err != nil {
+			return err
+		}
+	}
+	if v, err := sources.cluster.namespaceBuilder(namespace); err != nil {
+		logrus.Debugf("failed to read the builder annotation of namespace %s: %v", namespace, err)
+	} else if v != "" {
+		name, builderNamespace := v, ""
+		if i := strings.Index(v, "/"); i >= 0 {
+			builderNamespace, name = v[:i], v[i+1:]
+		}
+		set(name, sourceAnnotation+" of "+namespace, builderNamespace, sourceAnnotation+" of "+namespace)
+		return nil
+	}
+
+	data, err := sources.cluster.defaults()
+	if err != nil {
+		return err
+	}
+	source := sourceConfigMap + " " + ClusterDefaultsNamespace + "/" + ClusterDefaultsConfigMap
+	set(data["builder"], source, data["namespace"], source)
+	return nil
+}
+
+// kubeClusterDefaults reads the cluster defaults from the API server, each
+// object once
+type kubeClusterDefaults struct {
+	kcc clientcmd.ClientConfig
+
+	mu         sync.Mutex
+	clientset  kubernetes.Interface
+	namespaces map[string]clusterLookup
+	configMap  *clusterLookup
+}
+
+// clusterLookup is the outcome of reading an object of the cluster
+type clusterLookup struct {
+	data map[string]string
+	err  error
+}
+
+func newKubeClusterDefaults(kcc clientcmd.ClientConfig) *kubeClusterDefaults {
+	return &kubeClusterDefaults{kcc: kcc, namespaces: map[string]clusterLookup{}}
+}
+
+// client returns the clientset of the cluster, with c.mu held
+func (c *kubeClusterDefaults) client() (kubernetes.Interface, error) {
+	if c.clientset != nil {
+		return c.clientset, nil
+	}
+	restConfig, err := c.kcc.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.clientset = clientset
+	return clientset, nil
+}
+
+func (c *kubeClusterDefaults) namespaceBuilder(namespace string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.namespaces[namespace]
+	if !ok {
+		l.err = c.get(func(ctx context.Context, clientset kubernetes.Interface) error {
+			ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+			if err == nil {
+				l.data = ns.Annotations
+			}
+			return err
+		})
+		c.namespaces[namespace] = l
+	}
+	return l.data[NamespaceBuilderAnnotation], l.err
+}
+
+func (c *kubeClusterDefaults) defaults() (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configMap == nil {
+		l := clusterLookup{}
+		l.err = c.get(func(ctx context.Context, clientset kubernetes.Interface) error {
+			cm, err := clientset.CoreV1().ConfigMaps(ClusterDefaultsNamespace).Get(ctx, ClusterDefaultsConfigMap, metav1.GetOptions{})
+			if err == nil {
+				l.data = cm.Data
+			}
+			return err
+		})
+		c.configMap = &l
+	}
+	return c.configMap.data, c.configMap.err
+}
+
+// get runs f with the clientset of the cluster, with c.mu held
+func (c *kubeClusterDefaults) get(f func(context.Context, kubernetes.Interface) error) error {
+	clientset, err := c.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return f(ctx, clientset)
+}
+
+// namespacedClientConfig overrides the namespace of a kubeconfig with the
+// resolved one
+type namespacedClientConfig struct {
+	config    clientcmd.ClientConfig
+	namespace string
+}
+
+func (c namespacedClientConfig) RawConfig() (api.Config, error) {
+	return c.config.RawConfig()
+}
+
+func (c namespacedClientConfig) ClientConfig() (*rest.Config, error) {
+	return c.config.ClientConfig()
+}
+
+func (c namespacedClientConfig) Namespace() (string, bool, error) {
+	return c.namespace, true, nil
+}
+
+func (c namespacedClientConfig) ConfigAccess() clientcmd.ConfigAccess {
+	return c.config.ConfigAccess()
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// fakeClusterDefaults are the defaults of a cluster, counting the lookups
+type fakeClusterDefaults struct {
+	annotations map[string]string
+	configMap   map[string]string
+	err         error
+
+	namespaceLookups []string
+	configMapLookups int
+}
+
+func (c *fakeClusterDefaults) namespaceBuilder(namespace string) (string, error) {
+	c.namespaceLookups = append(c.namespaceLookups, namespace)
+	return c.annotations[namespace], c.err
+}
+
+func (c *fakeClusterDefaults) defaults() (map[string]string, error) {
+	c.configMapLookups++
+	if c.configMap == nil {
+		return nil, errors.New("configmaps \"buildkit-defaults\" not found")
+	}
+	return c.configMap, nil
+}
+
+func resolveTestCmd(flags map[string]string) *cobra.Command {
+	cmd := &cobra.Command{}
+	for _, name := range []string{"builder", "namespace", "context"} {
+		cmd.Flags().String(name, "", "")
+	}
+	for name, v := range flags {
+		_ = cmd.Flags().Set(name, v)
+	}
+	return cmd
+}
+
+func Test_resolveBuilder(t *testing.T) {
+	t.Parallel()
+	profile := []builderProfile{
+		{Builder: "ctx-builder", Namespace: "ctx-ns"},
+		{Builder: "user-builder"},
+	}
+	for _, tc := range []struct {
+		name     string
+		argument string
+		flags    map[string]string
+		env      map[string]string
+		profile  []builderProfile
+		cluster  *fakeClusterDefaults
+
+		want builderResolution
+		// namespaceLookups are the namespaces whose annotation is read,
+		// configMap whether the cluster default ConfigMap is
+		namespaceLookups []string
+		configMap        bool
+	}{
+		{
+			name:     "argument",
+			argument: "arg",
+			flags:    map[string]string{"builder": "flagged"},
+			env:      map[string]string{BuilderEnv: "env"},
+			want:     builderResolution{"arg", sourceArgument, "kube-ns", sourceKubeconfig},
+		},
+		{
+			name:    "flags",
+			flags:   map[string]string{"builder": "flagged", "namespace": "flag-ns"},
+			env:     map[string]string{BuilderEnv: "env", NamespaceEnv: "env-ns"},
+			profile: profile,
+			want:    builderResolution{"flagged", sourceFlag, "flag-ns", sourceFlag},
+		},
+		{
+			name:    "environment",
+			env:     map[string]string{BuilderEnv: "env", NamespaceEnv: "env-ns"},
+			profile: profile,
+			want:    builderResolution{"env", sourceEnv, "env-ns", sourceEnv},
+		},
+		{
+			name: "buildx environment",
+			env:  map[string]string{"BUILDX_BUILDER": "buildx"},
+			want: builderResolution{"buildx", sourceEnv, "kube-ns", sourceKubeconfig},
+		},
+		{
+			name:    "profile",
+			profile: profile,
+			want:    builderResolution{"ctx-builder", sourceProfile + " profile.json", "ctx-ns", sourceProfile + " profile.json"},
+		},
+		{
+			name:    "profile of all contexts",
+			profile: profile[1:],
+			want:    builderResolution{"user-builder", sourceProfile + " profile.json", "kube-ns", sourceKubeconfig},
+		},
+		{
+			name:             "namespace annotation",
+			cluster:          &fakeClusterDefaults{annotations: map[string]string{"kube-ns": "shared/team"}, configMap: map[string]string{"builder": "cluster"}},
+			want:             builderResolution{"team", sourceAnnotation + " of kube-ns", "shared", sourceAnnotation + " of kube-ns"},
+			namespaceLookups: []string{"kube-ns"},
+		},
+		{
+			name:             "annotation of the namespace flag",
+			flags:            map[string]string{"namespace": "flag-ns"},
+			cluster:          &fakeClusterDefaults{annotations: map[string]string{"flag-ns": "team", "kube-ns": "other"}},
+			want:             builderResolution{"team", sourceAnnotation + " of flag-ns", "flag-ns", sourceFlag},
+			namespaceLookups: []string{"flag-ns"},
+		},
+		{
+			name:             "cluster default",
+			cluster:          &fakeClusterDefaults{configMap: map[string]string{"builder": "cluster", "namespace": "builds"}},
+			want:             builderResolution{"cluster", sourceConfigMap + " kube-public/buildkit-defaults", "builds", sourceConfigMap + " kube-public/buildkit-defaults"},
+			namespaceLookups: []string{"kube-ns"},
+			configMap:        true,
+		},
+		{
+			name:             "cluster default with an unreadable namespace",
+			cluster:          &fakeClusterDefaults{configMap: map[string]string{"builder": "cluster"}, err: errors.New("forbidden")},
+			want:             builderResolution{"cluster", sourceConfigMap + " kube-public/buildkit-defaults", "kube-ns", sourceKubeconfig},
+			namespaceLookups: []string{"kube-ns"},
+			configMap:        true,
+		},
+		{
+			name:             "default",
+			want:             builderResolution{defaultBuilder, sourceDefault, "kube-ns", sourceKubeconfig},
+			namespaceLookups: []string{"kube-ns"},
+			configMap:        true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cluster := tc.cluster
+			if cluster == nil {
+				cluster = &fakeClusterDefaults{}
+			}
+			sources := builderSources{
+				getenv: func(k string) string { return tc.env[k] },
+				profile: func(kubeContext string) ([]builderProfile, string, error) {
+					require.Equal(t, "prod", kubeContext)
+					return tc.profile, "profile.json", nil
+				},
+				cluster:   cluster,
+				namespace: func() (string, error) { return "kube-ns", nil },
+			}
+			res, err := resolveBuilderFrom(resolveTestCmd(tc.flags), api.Config{CurrentContext: "prod"}, tc.argument, sources)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, *res)
+			assert.Equal(t, tc.namespaceLookups, cluster.namespaceLookups, "namespace annotation lookups")
+			assert.Equal(t, tc.configMap, cluster.configMapLookups > 0, "cluster default lookup")
+			assert.LessOrEqual(t, cluster.configMapLookups, 1)
+		})
+	}
+}
+
+func Test_resolveBuilderContextFlag(t *testing.T) {
+	t.Parallel()
+	var kubeContext string
+	sources := builderSources{
+		getenv: func(string) string { return "" },
+		profile: func(c string) ([]builderProfile, string, error) {
+			kubeContext = c
+			return nil, "", nil
+		},
+		cluster:   &fakeClusterDefaults{},
+		namespace: func() (string, error) { return "", errors.New("no context") },
+	}
+	_, err := resolveBuilderFrom(resolveTestCmd(map[string]string{"context": "staging"}), api.Config{CurrentContext: "prod"}, "", sources)
+	require.Error(t, err, "the namespace of the kubeconfig can't be determined")
+	require.Equal(t, "staging", kubeContext)
+}
+
+func Test_runWhich(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	in := whichOptions{commonKubeOptions: commonKubeOptions{resolved: &builderResolution{"team", sourceAnnotation + " of ci", "shared", sourceAnnotation + " of ci"}}}
+	require.NoError(t, runWhich(genericclioptions.IOStreams{Out: buf}, in))
+	require.Equal(t, "Builder:     team     (namespace annotation of ci)\nNamespace:   shared   (namespace annotation of ci)\n", buf.String())
+}
+
+// countingClientset serves a Namespace and the cluster default ConfigMap,
+// counting the gets
+type countingClientset struct {
+	kubernetes.Interface
+	gets map[string]int
+}
+
+func (c *countingClientset) CoreV1() typedcorev1.CoreV1Interface {
+	return countingCoreV1{c: c}
+}
+
+type countingCoreV1 struct {
+	typedcorev1.CoreV1Interface
+	c *countingClientset
+}
+
+func (c countingCoreV1) Namespaces() typedcorev1.NamespaceInterface {
+	return countingNamespaces{c: c.c}
+}
+
+func (c countingCoreV1) ConfigMaps(namespace string) typedcorev1.ConfigMapInterface {
+	return countingConfigMaps{c: c.c}
+}
+
+type countingNamespaces struct {
+	typedcorev1.NamespaceInterface
+	c *countingClientset
+}
+
+func (n countingNamespaces) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Namespace, error) {
+	n.c.gets["namespace/"+name]++
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+}
+
+type countingConfigMaps struct {
+	typedcorev1.ConfigMapInterface
+	c *countingClientset
+}
+
+func (m countingConfigMaps) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.ConfigMap, error) {
+	m.c.gets["configmap/"+name]++
+	return &corev1.ConfigMap{Data: map[string]string{"builder": "cluster"}}, nil
+}
+
+func Test_kubeClusterDefaultsCache(t *testing.T) {
+	t.Parallel()
+	clientset := &countingClientset{gets: map[string]int{}}
+	c := newKubeClusterDefaults(nil)
+	c.clientset = clientset
+	sources := builderSources{
+		getenv:    func(string) string { return "" },
+		profile:   func(string) ([]builderProfile, string, error) { return nil, "", nil },
+		cluster:   c,
+		namespace: func() (string, error) { return "ci", nil },
+	}
+	for i := 0; i < 3; i++ {
+		res, err := resolveBuilderFrom(resolveTestCmd(nil), api.Config{}, "", sources)
+		require.NoError(t, err)
+		require.Equal(t, "cluster", res.Builder)
+	}
+	require.Equal(t, map[string]int{"namespace/ci": 1, "configmap/" + ClusterDefaultsConfigMap: 1}, clientset.gets)
+}
@@ -12,7 +12,8 @@ import (
 type rmOptions struct {
 	commonKubeOptions
 
-	builders []string
+	builders         []string
+	purgeCredentials bool
 }
 
 func runRm(streams genericclioptions.IOStreams, in rmOptions) error {
@@ -35,6 +36,11 @@ func runRm(streams genericclioptions.IOStreams, in rmOptions) error {
 					if err != nil {
 						return err
 					}
+					if in.purgeCredentials {
+						if err := d.Logout(ctx, "", ""); err != nil {
+							return err
+						}
+					}
 					err = d.Rm(ctx, false)
 					if err != nil {
 						return err
@@ -73,6 +79,7 @@ func rmCmd(streams genericclioptions.IOStreams) *cobra.Command {
 		SilenceUsage: true,
 	}
 	options.configFlags.AddFlags(cmd.Flags())
+	cmd.Flags().BoolVar(&options.purgeCredentials, "purge-credentials", false, "Also delete the builder's registry secret")
 
 	return cmd
 }
@@ -3,8 +3,6 @@
 package commands
 
 import (
-	"os"
-
 	//imagetoolscmd "github.com/docker/buildx/commands/imagetools"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -43,24 +41,36 @@ func addCommands(cmd *cobra.Command, streams genericclioptions.IOStreams) {
 
 	cmd.AddCommand(
 		buildCmd(streams, opts),
-		//bakeCmd(streams, opts),
+		bakeCmd(streams, opts),
 		createCmd(streams, opts),
+		updateCmd(streams, opts),
+		initNamespaceCmd(streams, opts),
+		exportConfigCmd(streams, opts),
 		rmCmd(streams),
 		lsCmd(streams),
+		registryCmd(streams, opts),
+		promoteCmd(streams, opts),
 		//useCmd(streams, opts),
-		//inspectCmd(streams, opts),
+		inspectCmd(streams, opts),
+		logsCmd(streams, opts),
+		debugCmd(streams, opts),
+		drainCmd(streams, opts),
+		uncordonCmd(streams, opts),
 		//stopCmd(streams, opts),
 		//installCmd(streams),
 		//uninstallCmd(streams),
 		versionCmd(streams, opts),
-		//pruneCmd(streams, opts),
-		//duCmd(streams, opts),
+		traceCmd(streams),
+		pruneCmd(streams, opts),
+		duCmd(streams, opts),
+		whichCmd(streams, opts),
+		cancelCmd(streams, opts),
 		//imagetoolscmd.RootCmd(streams),
 	)
 }
 
 func rootFlags(options *rootOptions, flags *pflag.FlagSet) {
-	flags.StringVar(&options.builder, "builder", os.Getenv("BUILDX_BUILDER"), "Override the configured builder instance")
+	flags.StringVar(&options.builder, "builder", "", "Override the configured builder instance, see 'kubectl buildkit which'")
 	options.configFlags.AddFlags(flags)
 }
 
@@ -0,0 +1,63 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+)
+
+// telemetryTimeout bounds exporting the telemetry of a build, an unreachable
+// collector or gateway mustn't hold up the CLI
+const telemetryTimeout = 10 * time.Second
+
+// exportBuildTelemetry sends the trace and pushes the metrics of the build,
+// failed with buildErr if set, of the target reported on, and writes the
+// trace to the --trace file.  The build doesn't depend on its telemetry,
+// failures are only warned about, but writing the file asked for fails.
+func exportBuildTelemetry(ctx context.Context, in buildOptions, targets map[string]build.Options, resp map[string]*client.SolveResponse, buildErr error, start time.Time, graph *progress.Graph) error {
+	name := reportTarget(targets)
+	o := targets[name]
+	m := &build.BuildMetrics{
+		Builder: in.builder,
+		Start:   start,
+	}
+	m.Duration = time.Since(start)
+	if m.Builder == "" {
+		m.Builder = defaultBuilder
+	}
+	if buildErr != nil {
+		m.Error = buildErr.Error()
+	}
+	if len(o.Tags) > 0 {
+		m.Image = o.Tags[0]
+	}
+	if r := resp[name]; r != nil {
+		m.Digest = r.ExporterResponse["containerimage.digest"]
+		m.Pod = r.ExporterResponse[build.ExporterResponsePod]
+	}
+	vertexes := graph.Vertexes()
+	m.AddGraph(vertexes, isPushing(o.Exports))
+
+	ctx, cancel := context.WithTimeout(ctx, telemetryTimeout)
+	defer cancel()
+	if in.otelEndpoint != "" {
+		if err := build.ExportTrace(ctx, in.otelEndpoint, m, vertexes); err != nil {
+			logrus.Warnf("failed to export the build trace: %s", err)
+		}
+	}
+	if in.metricsPush != "" {
+		if err := build.PushMetrics(ctx, in.metricsPush, m); err != nil {
+			logrus.Warnf("%s", err)
+		}
+	}
+	if in.traceFile != "" {
+		return build.WriteTrace(ctx, in.traceFile, m, vertexes)
+	}
+	return nil
+}
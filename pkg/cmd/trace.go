@@ -0,0 +1,95 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type traceViewOptions struct {
+	filename string
+	progress string
+}
+
+func runTraceView(streams genericclioptions.IOStreams, in traceViewOptions) error {
+	ctx := appcontext.Context()
+
+	f, err := os.Open(in.filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open trace")
+	}
+	defer f.Close()
+	spans, err := build.ReadTrace(f)
+	if err != nil {
+		return err
+	}
+	st, m, err := build.TraceStatus(spans)
+	if err != nil {
+		return err
+	}
+
+	pw := progress.NewPrinter(ctx, os.Stdout, in.progress)
+	ch := pw.Status()
+	ch <- st
+	close(ch)
+	<-pw.Done()
+	if err := pw.Err(); err != nil {
+		return err
+	}
+	printTraceSummary(streams, m)
+	return nil
+}
+
+// printTraceSummary prints the outcome of the build of a trace
+func printTraceSummary(streams genericclioptions.IOStreams, m *build.BuildMetrics) {
+	what := "build"
+	if m.Image != "" {
+		what += " of " + m.Image
+	}
+	if m.Pod != "" {
+		what += " on " + m.Pod
+	}
+	result := "succeeded"
+	if m.Error != "" {
+		result = "failed: " + m.Error
+	}
+	fmt.Fprintf(streams.Out, "%s %s in %s, %d steps, %d cached (%.0f%%)\n", what, result, m.Duration.Round(100*time.Millisecond), m.Steps, m.CachedSteps, 100*m.CacheHitRatio())
+}
+
+func traceCmd(streams genericclioptions.IOStreams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trace",
+		Short: "Work with build traces written by 'kubectl build --trace'",
+	}
+	cmd.AddCommand(traceViewCmd(streams))
+	return cmd
+}
+
+func traceViewCmd(streams genericclioptions.IOStreams) *cobra.Command {
+	options := traceViewOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "view FILE",
+		Short: "Render the steps of a build trace locally",
+		Args:  ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options.filename = args[0]
+			return runTraceView(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&options.progress, "progress", "plain", "Set type of progress output [auto, plain, tty]")
+
+	return cmd
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/build"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// unchangedBuildsDir is where the requests of the builds pushed with
+// --skip-unchanged are recorded
+func unchangedBuildsDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kubectl-build", "requests"), nil
+}
+
+// checkSkipUnchanged fails unless the build can be skipped when unchanged:
+// it must push its images and its whole request must be on the client
+func checkSkipUnchanged(in buildOptions, targets map[string]build.Options) error {
+	if in.contextPath == "-" || urlutil.IsGitURL(in.contextPath) || urlutil.IsURL(in.contextPath) {
+		return errors.Errorf("--skip-unchanged requires a local build context")
+	}
+	if in.dockerfileName == "-" {
+		return errors.Errorf("--skip-unchanged requires a local Dockerfile")
+	}
+	for _, o := range targets {
+		if len(o.Extracts) > 0 {
+			return errors.Errorf("--skip-unchanged can't be used with --extract")
+		}
+		for _, e := range o.Exports {
+			if e.Type != "image" || !isPushing([]client.ExportEntry{e}) {
+				return errors.Errorf("--skip-unchanged requires every output to push an image, not %q", e.Type)
+			}
+		}
+		if len(o.Exports) == 0 {
+			return errors.Errorf("--skip-unchanged requires pushing the image to a registry with --push")
+		}
+	}
+	return nil
+}
+
+// skipUnchanged returns the digest of the request of targets, and whether an
+// identical request was pushed within ttl with its tags unchanged since
+func skipUnchanged(ctx context.Context, streams genericclioptions.IOStreams, in buildOptions, targets map[string]build.Options, contextPathHash string, ttl time.Duration) (digest.Digest, bool, error) {
+	request, err := build.RequestDigest(targets)
+	if err != nil {
+		return "", false, err
+	}
+	dir, err := unchangedBuildsDir()
+	if err != nil {
+		return "", false, err
+	}
+	b, err := build.LoadUnchangedBuild(dir, request, ttl, time.Now())
+	if err != nil || b == nil {
+		return request, false, err
+	}
+	d, err := getBuildDriver(ctx, in.KubeClientConfig, in.builder, contextPathHash, in.size, in.nodes)
+	if err != nil {
+		return "", false, err
+	}
+	current, err := b.Current(ctx, imagetools.New(imagetools.Opt{Auth: d.GetAuthWrapper(in.registrySecretName)}))
+	if err != nil {
+		// The build finds out whether the registry is reachable
+		logrus.Warnf("building, failed to check the images of the previous build: %s", err)
+		return request, false, nil
+	}
+	if !current {
+		return request, false, nil
+	}
+	tags := make([]string, 0, len(b.Images))
+	for tag := range b.Images {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		fmt.Fprintf(streams.ErrOut, "build unchanged since %s, %s@%s\n", b.Time.Format(time.RFC3339), tag, b.Images[tag])
+	}
+	if in.imageIDFile != "" {
+		if err := ioutil.WriteFile(in.imageIDFile, []byte(b.Images[tags[0]]), 0644); err != nil {
+			return "", false, err
+		}
+	}
+	return request, true, nil
+}
+
+// recordUnchanged records the images pushed by the targets for request.
+// Failing to record only means the next build of the request runs.
+func recordUnchanged(request digest.Digest, targets map[string]build.Options, resp map[string]*client.SolveResponse) {
+	b := &build.UnchangedBuild{
+		Request: request,
+		Time:    time.Now(),
+		Images:  map[string]digest.Digest{},
+	}
+	for name, o := range targets {
+		r, ok := resp[name]
+		if !ok || r == nil {
+			return
+		}
+		dgst, err := digest.Parse(r.ExporterResponse["containerimage.digest"])
+		if err != nil {
+			return
+		}
+		for _, tag := range pushedNames(o) {
+			b.Images[tag] = dgst
+		}
+	}
+	dir, err := unchangedBuildsDir()
+	if err == nil {
+		err = build.SaveUnchangedBuild(dir, b)
+	}
+	if err != nil {
+		logrus.Warnf("failed to record the build for --skip-unchanged: %s", err)
+	}
+}
+
+// pushedNames returns the tags and output names the image of o is pushed as
+func pushedNames(o build.Options) []string {
+	names := append([]string{}, o.Tags...)
+	for _, e := range o.Exports {
+		for _, n := range strings.Split(e.Attrs["name"], ",") {
+			if n != "" {
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
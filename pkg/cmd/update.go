@@ -0,0 +1,225 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/version"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type updateOptions struct {
+	builder         string
+	image           string
+	flags           string
+	configFile      string
+	replicas        int
+	requests        string
+	limits          string
+	priorityClass   string
+	envs            []string
+	progress        string
+	wait            bool
+	waitTimeout     time.Duration
+	waitInterval    time.Duration
+	waitMaxInterval time.Duration
+	// maxParallelism and maxParallelBuilds limit the build steps each pod
+	// executes and the builds the builder runs at once
+	maxParallelism    int
+	maxParallelBuilds int
+	// changed reports whether the option of a flag was given
+	changed func(name string) bool
+	commonKubeOptions
+}
+
+// updateBuilderConfig sets the options given to update in cfg, the options
+// the builder was created with
+func updateBuilderConfig(cfg *driver.BuilderConfig, in updateOptions) error {
+	if cfg.DriverOpts == nil {
+		cfg.DriverOpts = map[string]string{}
+	}
+	if in.changed("image") {
+		cfg.DriverOpts["image"] = in.image
+	}
+	if in.changed("replicas") {
+		cfg.DriverOpts["replicas"] = strconv.Itoa(in.replicas)
+	}
+	if in.changed("requests") {
+		cfg.DriverOpts["requests"] = in.requests
+	}
+	if in.changed("limits") {
+		cfg.DriverOpts["limits"] = in.limits
+	}
+	if in.changed("priority-class") {
+		cfg.DriverOpts["priority-class"] = in.priorityClass
+	}
+	if in.changed("env") {
+		cfg.DriverOpts["env"] = strings.Join(in.envs, ";")
+	}
+	if in.changed("max-parallelism") {
+		cfg.DriverOpts["max-parallelism"] = strconv.Itoa(in.maxParallelism)
+	}
+	if in.changed("max-parallel-builds") {
+		cfg.DriverOpts["max-parallel-builds"] = strconv.Itoa(in.maxParallelBuilds)
+	}
+	if in.changed("buildkitd-flags") {
+		flags, err := shlex.Split(in.flags)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse buildkit flags")
+		}
+		cfg.BuildkitFlags = flags
+	}
+	if in.changed("buildkitd-config") {
+		dt, err := ioutil.ReadFile(in.configFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read the buildkitd config")
+		}
+		cfg.BuildkitdConfig = string(dt)
+	}
+	return nil
+}
+
+func runUpdate(streams genericclioptions.IOStreams, in updateOptions) error {
+	ctx := appcontext.Context()
+
+	current, err := driver.GetDriver(ctx, in.builder, nil, in.KubeClientConfig, []string{}, "", map[string]string{}, "")
+	if err != nil {
+		return err
+	}
+	cfg, err := current.ExportConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if err := updateBuilderConfig(cfg, in); err != nil {
+		return err
+	}
+	oldVersion, err := current.GetVersion(ctx)
+	if err != nil || oldVersion == "" {
+		oldVersion = "unknown"
+	}
+
+	driverFactory := driver.GetFactory(DefaultDriver, true)
+	if driverFactory == nil {
+		return errors.Errorf("failed to find driver %q", DefaultDriver)
+	}
+	dir, err := ioutil.TempDir("", "buildkit-config")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	configFile, driverOpts, err := writeBuilderConfigFiles(cfg, dir)
+	if err != nil {
+		return err
+	}
+	d, err := driver.GetDriver(ctx, in.builder, driverFactory, in.KubeClientConfig, cfg.BuildkitFlags, configFile, driverOpts, "" /*contextPathHash*/)
+	if err != nil {
+		return err
+	}
+
+	ctx = driver.WithWait(ctx, driver.WaitOpt{
+		NoWait:  !in.wait,
+		Backoff: driver.Backoff{Initial: in.waitInterval, Max: in.waitMaxInterval},
+	})
+	if in.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, in.waitTimeout)
+		defer cancel()
+	}
+	pw := progress.NewPrinter(ctx, os.Stderr, in.progress)
+	changes, err := d.Update(ctx, func(s *client.SolveStatus) {
+		pw.Status() <- s
+	})
+	close(pw.Status())
+	<-pw.Done()
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(streams.Out, "Builder %s is up to date\n", in.builder)
+		return nil
+	}
+	if !in.wait {
+		fmt.Fprintf(streams.Out, "Updated builder %s, its pods are rolling\n", in.builder)
+		return nil
+	}
+	newVersion, err := d.GetVersion(ctx)
+	if err != nil || newVersion == "" {
+		newVersion = "unknown"
+	}
+	fmt.Fprintf(streams.Out, "Updated builder %s\n", in.builder)
+	fmt.Fprintf(streams.Out, "buildkitd: %s -> %s\n", oldVersion, newVersion)
+	return nil
+}
+
+func updateCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := updateOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "update [OPTIONS] [NAME]",
+		Short: "Reconfigure an existing builder in place, rolling its pods",
+		Long: `Reconfigure an existing builder in place, rolling its pods
+
+The builder is rendered from the options it was created with and those
+given, and its pods are rolled if their spec changed, keeping its cache
+claims.  Without options the builder is updated to the defaults of this
+version of the CLI, eg. its buildkit image.  The buildkitd versions before
+and after the update are reported.`,
+		Example: `  kubectl buildkit update --image moby/buildkit:v0.9.0
+  kubectl buildkit update shared --requests cpu=4,memory=8Gi --limits memory=16Gi
+  kubectl buildkit update --max-parallelism 4 --max-parallel-builds 2`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			options.builder = options.resolved.Builder
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			options.changed = cmd.Flags().Changed
+			return runUpdate(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&options.image, "image", "", fmt.Sprintf("Specify an alternate buildkit image, empty for the default of this version (default: %s)", version.DefaultImage))
+	flags.StringVar(&options.flags, "buildkitd-flags", "", "Flags for buildkitd daemon")
+	flags.StringVar(&options.configFile, "buildkitd-config", "", "buildkitd.toml of the builder")
+	flags.IntVar(&options.replicas, "replicas", 1, "BuildKit deployment replica count")
+	flags.StringVar(&options.requests, "requests", "", "Resources requested for buildkitd in each builder pod (format: cpu=2,memory=4Gi[,ephemeral-storage=50Gi])")
+	flags.StringVar(&options.limits, "limits", "", "Resource limits of buildkitd in each builder pod (format: cpu=4,memory=8Gi[,ephemeral-storage=100Gi])")
+	flags.StringVar(&options.priorityClass, "priority-class", "", "PriorityClass of the builder pods")
+	flags.StringArrayVar(&options.envs, "env", []string{}, "Environment variables of buildkitd, replacing those of the builder, like http_proxy=http://my-proxy.com:8080")
+	flags.IntVar(&options.maxParallelism, "max-parallelism", 0, "Maximum number of build steps to execute concurrently in each builder pod (0 for unlimited)")
+	flags.IntVar(&options.maxParallelBuilds, "max-parallel-builds", 0, "Maximum number of builds to run on the builder at once, additional builds wait in a queue ordered by 'build --priority' (0 for unlimited)")
+	flags.StringVar(&options.progress, "progress", "auto", "Set type of progress output [auto, plain, tty]. Use plain to show container output")
+	flags.BoolVar(&options.wait, "wait", true, "Wait for the updated builder pods to be ready, reporting why pending pods aren't coming up")
+	flags.DurationVar(&options.waitTimeout, "wait-timeout", 0, "Fail if the updated builder pods aren't ready within this time, 0 for no limit")
+	flags.DurationVar(&options.waitInterval, "wait-interval", driver.DefaultBackoff.Initial, "First interval between checks of the builder pods, doubled after each check")
+	flags.DurationVar(&options.waitMaxInterval, "wait-max-interval", driver.DefaultBackoff.Max, "Longest interval between checks of the builder pods")
+
+	return cmd
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+)
+
+func Test_updateBuilderConfig(t *testing.T) {
+	t.Parallel()
+	cfg := &driver.BuilderConfig{DriverOpts: map[string]string{"image": "moby/buildkit:v0.9.0", "max-parallelism": "2", "replicas": "3"}}
+	in := updateOptions{
+		maxParallelism:    4,
+		maxParallelBuilds: 2,
+		replicas:          1,
+		changed: func(name string) bool {
+			return name == "max-parallelism" || name == "max-parallel-builds"
+		},
+	}
+	require.NoError(t, updateBuilderConfig(cfg, in))
+	require.Equal(t, map[string]string{
+		"image":               "moby/buildkit:v0.9.0",
+		"max-parallelism":     "4",
+		"max-parallel-builds": "2",
+		"replicas":            "3",
+	}, cfg.DriverOpts)
+}
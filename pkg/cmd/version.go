@@ -15,29 +15,47 @@ import (
 
 type versionOptions struct {
 	builder string
+	output  string
 	commonKubeOptions
 }
 
-func getBuilderVersion(ctx context.Context, in versionOptions) string {
+// versionOutput is the version information printed with -o
+type versionOutput struct {
+	Client  string `json:"client"`
+	Builder string `json:"builder,omitempty"`
+	// BuilderError is why the version of the builder is unknown
+	BuilderError string `json:"builderError,omitempty"`
+}
+
+func getBuilderVersion(ctx context.Context, in versionOptions) (string, error) {
 	driverName := in.builder
 	if driverName == "" {
 		driverName = "buildkit"
 	}
 	d, err := driver.GetDriver(ctx, driverName, nil, in.KubeClientConfig, []string{}, "" /* unused config file */, map[string]string{} /* DriverOpts unused */, "")
 	if err != nil {
-		return err.Error()
+		return "", err
 	}
-	version, err := d.GetVersion(ctx)
-	if err != nil {
-		return err.Error()
-	}
-	return version
+	return d.GetVersion(ctx)
 }
 
 func runVersion(streams genericclioptions.IOStreams, in versionOptions) error {
 	ctx := appcontext.Context()
-	builderVersion := getBuilderVersion(ctx, in)
+	if err := validateOutputFormat(in.output); err != nil {
+		return err
+	}
+	builderVersion, err := getBuilderVersion(ctx, in)
 
+	if in.output != "" {
+		res := versionOutput{Client: version.Version, Builder: builderVersion}
+		if err != nil {
+			res.BuilderError = err.Error()
+		}
+		return printOutput(streams.Out, in.output, res)
+	}
+	if err != nil {
+		builderVersion = err.Error()
+	}
 	fmt.Fprintf(streams.Out, "Client:  %s\n", version.Version)
 	fmt.Fprintf(streams.Out, "Builder: %s\n", builderVersion)
 	return nil
@@ -55,11 +73,10 @@ func versionCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cob
 		Use:   "version",
 		Short: "Show client and builder version information ",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			options.builder = rootOpts.builder
-
 			if err := options.Complete(cmd, args); err != nil {
 				return err
 			}
+			options.builder = options.resolved.Builder
 			if err := options.Validate(); err != nil {
 				return err
 			}
@@ -67,5 +84,6 @@ func versionCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cob
 			return runVersion(streams, options)
 		},
 	}
+	cmd.Flags().StringVarP(&options.output, "output", "o", "", "Print the versions as json or yaml")
 	return cmd
 }
@@ -0,0 +1,65 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package commands
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+type whichOptions struct {
+	commonKubeOptions
+}
+
+func runWhich(streams genericclioptions.IOStreams, in whichOptions) error {
+	w := tabwriter.NewWriter(streams.Out, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "Builder:\t%s\t(%s)\n", in.resolved.Builder, in.resolved.BuilderSource)
+	fmt.Fprintf(w, "Namespace:\t%s\t(%s)\n", in.resolved.Namespace, in.resolved.NamespaceSource)
+	return w.Flush()
+}
+
+func whichCmd(streams genericclioptions.IOStreams, rootOpts *rootOptions) *cobra.Command {
+	options := whichOptions{
+		commonKubeOptions: commonKubeOptions{
+			configFlags: genericclioptions.NewConfigFlags(true),
+			IOStreams:   streams,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "which [NAME]",
+		Short: "Show the builder and namespace builds use, and where they are set",
+		Long: `Show the builder and namespace builds use, and where they are set
+
+The first one set wins, in this order:
+  1. the --builder and --namespace flags, or the builder NAME argument
+  2. the ` + BuilderEnv + ` (or BUILDX_BUILDER) and ` + NamespaceEnv + `
+     environment variables
+  3. the per-user profile, kubectl-buildkit/profile.json in the user config
+     directory, for the current kubeconfig context or else for all of them:
+       {"builder": "buildkit", "contexts": {"prod": {"builder": "team-a", "namespace": "builds"}}}
+  4. the ` + NamespaceBuilderAnnotation + ` annotation of the current
+     namespace, "name" or "namespace/name" for a builder of another namespace
+  5. the builder and namespace keys of the ` + ClusterDefaultsNamespace + `/` + ClusterDefaultsConfigMap + ` ConfigMap
+  6. the "` + defaultBuilder + `" builder in the namespace of the kubeconfig context`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				options.builderArgument = args[0]
+			}
+			if err := options.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			return runWhich(streams, options)
+		},
+		SilenceUsage: true,
+	}
+
+	return cmd
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/imagetools"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/store"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // TODO - Will we want any other drivers, or is this driver abstraction overkill?
@@ -27,6 +28,11 @@ import (
 
 var ErrNotRunning = errors.Errorf("driver not running")
 var ErrNotConnecting = errors.Errorf("driver not connecting")
+var ErrPreempted = errors.Errorf("build preempted by a higher priority build")
+
+// ErrNoFailoverNode is returned by Clients when every node of the builder
+// is excluded with WithExcludedNodes
+var ErrNoFailoverNode = errors.Errorf("no other builder node to fail over to")
 
 type Status int
 
@@ -69,6 +75,82 @@ type Info struct {
 	Status Status
 	// DynamicNodes must be empty if the actual nodes are statically listed in the store
 	DynamicNodes []store.Node
+	// Notify lists the default build notification sinks configured on the builder
+	Notify []string
+	// EgressProxy is the proxy builds must use to reach the allowlisted hosts
+	EgressProxy string
+	// PackageProxy is the caching proxy of the builder pods for the downloads of builds
+	PackageProxy string
+	// DefaultPlatform is the platform built when a build doesn't request one
+	DefaultPlatform string
+	// RunCacheScope is set if the builder persists RUN cache mounts, keyed by this scope
+	RunCacheScope string
+	// RunCacheDir is where the persistent volume of the RUN cache mounts is mounted in the builder pods
+	RunCacheDir string
+	// RunCacheImage runs the copies between the cache mounts and their persistent volume
+	RunCacheImage string
+	// HostPaths are the node directories builds may mount
+	HostPaths []string
+	// HostPathDir is where the HostPaths are mounted in the builder pods, under their own path
+	HostPathDir string
+	// ScratchSize is the size of the scratch volume of each builder pod, empty if builds use the node's ephemeral storage
+	ScratchSize string
+	// OutputClaims are the PersistentVolumeClaims builds may write their image to
+	OutputClaims []string
+	// OutputClaimDir is where the OutputClaims are mounted in the builder pods, under their name
+	OutputClaimDir string
+	// FallbackBuilder is built on while the builder has no ready pods
+	FallbackBuilder string
+	// ReadOnlyRootFS is set if buildkitd runs with a read-only root filesystem
+	ReadOnlyRootFS bool
+	// HistoryMaxRecords is how many finished detached build records each pod keeps, 0 for no limit
+	HistoryMaxRecords int
+	// HistoryMaxAge is how long each pod keeps the records of finished detached builds, 0 for no limit
+	HistoryMaxAge time.Duration
+	// Emulation are the architectures the builder installed emulators for, "all" for all of those of its image
+	Emulation []string
+	// GCThreshold is the percentage of the disk of a builder pod used at which builds prune its cache, 0 to not prune
+	GCThreshold int
+	// GCKeepStorage is the size of the cache builds never prune
+	GCKeepStorage int64
+	// BuildIOLimits throttle the disk I/O of the builds by default
+	BuildIOLimits IOLimits
+	// AllowedEntitlements are the insecure entitlements builds may request, nil if unknown, eg. allowed by the config file of the builder
+	AllowedEntitlements []string
+	// Runtime is the container runtime of the nodes of the builder pods, containerd, docker or cri-o
+	Runtime string
+	// SharedCache is the repository of the registry the builder pods share their layer cache through
+	SharedCache string
+	// HTTPProxy and HTTPSProxy are the proxies of the builder, passed to the builds as their proxy args
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy lists the hosts builds reach without the proxies
+	NoProxy string
+	// MaxParallelBuilds is how many builds run on the builder at once, 0 for unlimited
+	MaxParallelBuilds int
+	// RunningBuilds and QueuedBuilds count the builds of the queue of a builder with MaxParallelBuilds
+	RunningBuilds int
+	QueuedBuilds  int
+}
+
+// LogOptions selects the buildkitd logs of Driver.Logs
+type LogOptions struct {
+	// Follow streams the logs until the context is done
+	Follow bool
+	// Tail is the number of lines from the end of the logs, all if negative
+	Tail int64
+	// Since only returns the logs newer than this, all if 0
+	Since time.Duration
+}
+
+// Event is a recent Kubernetes event of a builder or its pods
+type Event struct {
+	Time time.Time
+	// Object is the kind and name of the object of the event, eg. Pod/buildkit-abc
+	Object  string
+	Type    string
+	Reason  string
+	Message string
 }
 
 type Driver interface {
@@ -78,21 +160,82 @@ type Driver interface {
 	Stop(ctx context.Context, force bool) error
 	Rm(ctx context.Context, force bool) error
 	Clients(ctx context.Context) (*BuilderClients, error)
+	// NodeClients connects to every running pod of the builder, unlike
+	// Clients it doesn't choose one to build on
+	NodeClients(ctx context.Context) ([]NodeClient, error)
 	Features() map[Feature]bool
 	List(ctx context.Context) ([]Builder, error)
 	RuntimeSockProxy(ctx context.Context, name string) (net.Conn, error)
+	// LoadPods returns the pods images are loaded on the nodes of the label
+	// selector through, every node if it's empty, running loader pods on the
+	// nodes without a builder pod.  The returned func removes the loader pods.
+	LoadPods(ctx context.Context, nodeSelector string) ([]Node, func(), error)
 	GetVersion(ctx context.Context) (string, error)
 
+	// Exec runs a command in the named builder pod and waits for it to exit
+	Exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error
+
+	// Enqueue waits until the build may start on the builder, calling position
+	// while it waits.  The returned func must be called once the build is done,
+	// and the channel (if not nil) is closed if the build gets preempted.
+	Enqueue(ctx context.Context, id string, priority int, position func(int)) (func(), <-chan struct{}, error)
+
+	// RecordBuild records the start of the build id on the named builder pod,
+	// for correlating it with the builder's logs and events
+	RecordBuild(ctx context.Context, name, id string) error
+
+	// Logs writes the buildkitd logs of the named builder pod to w, of all
+	// the started pods if name is empty, each line prefixed with its pod
+	Logs(ctx context.Context, name string, opt LogOptions, w io.Writer) error
+	// Events returns the recent events of the builder and its pods, oldest first
+	Events(ctx context.Context) ([]Event, error)
+	// Drain keeps new builds off the builder pod named pod or the pods on
+	// the Kubernetes node, all the pods if both are empty, or lets them
+	// build again unless drain is set.  It returns the pods changed.
+	Drain(ctx context.Context, pod, node string, drain bool) ([]string, error)
+
 	// TODO - do we really need both?  Seems like some cleanup needed here...
 	GetAuthWrapper(string) imagetools.Auth
 	GetAuthProvider(secretName string, stderr io.Writer) session.Attachable
 	GetAuthHintMessage() string
+	// Logout removes the credentials for host from the registry secret, or
+	// the whole secret if host is empty
+	Logout(ctx context.Context, secretName, host string) error
+
+	// ExportConfig returns the options the builder was created with
+	ExportConfig(ctx context.Context) (*BuilderConfig, error)
+	// Manifests returns the objects creating the builder applies, without
+	// applying them
+	Manifests(ctx context.Context, l progress.Logger) ([]runtime.Object, error)
+	// Update rolls the pods of the existing builder to its options, and
+	// returns what changed
+	Update(ctx context.Context, l progress.Logger) ([]string, error)
+}
+
+// BuilderConfig is everything needed to create an equivalent builder, in
+// another cluster or namespace.  Registry credentials aren't part of it.
+type BuilderConfig struct {
+	Name          string            `json:"name"`
+	Driver        string            `json:"driver"`
+	BuildkitFlags []string          `json:"buildkitdFlags,omitempty"`
+	DriverOpts    map[string]string `json:"driverOpts,omitempty"`
+	// BuildkitdConfig is the content of a custom buildkitd.toml
+	BuildkitdConfig string `json:"buildkitdConfig,omitempty"`
+	// Patch is the content of the patch applied to the builder deployment
+	Patch string `json:"patch,omitempty"`
 }
 
 type Builder struct {
 	Name   string
 	Driver string
 	Nodes  []Node
+	// Pending are the pods which aren't running yet, eg. as no node can
+	// schedule them, the Nodes are built on
+	Pending []Node
+	// Namespace is the namespace of the builder
+	Namespace string
+	// Rootless is set if buildkitd runs as an unprivileged user
+	Rootless bool
 
 	// TODO consider adding these for a verbose listing
 	//Flags      []string
@@ -104,6 +247,10 @@ type Node struct {
 	Name      string
 	Status    string
 	Platforms []specs.Platform
+	// Host is the Kubernetes node the pod is scheduled on, empty until it is
+	Host string
+	// Runtime is the container runtime of the node of the pod, containerd, docker or cri-o
+	Runtime string
 }
 
 type BuilderClients struct {
@@ -119,6 +266,52 @@ type NodeClient struct {
 	BuildKitClient *client.Client
 }
 
+type platformsKey struct{}
+
+// WithPlatforms requests builder nodes able to build the platforms natively
+// from the Clients of drivers called with the returned context
+func WithPlatforms(ctx context.Context, platforms []specs.Platform) context.Context {
+	return context.WithValue(ctx, platformsKey{}, platforms)
+}
+
+// Platforms returns the platforms requested with WithPlatforms
+func Platforms(ctx context.Context) []specs.Platform {
+	platforms, _ := ctx.Value(platformsKey{}).([]specs.Platform)
+	return platforms
+}
+
+type excludedNodesKey struct{}
+
+// WithExcludedNodes keeps the Clients of drivers called with the returned
+// context from choosing the nodes, eg. those a build lost its connection to
+func WithExcludedNodes(ctx context.Context, nodes []string) context.Context {
+	return context.WithValue(ctx, excludedNodesKey{}, nodes)
+}
+
+// ExcludedNodes returns the nodes excluded with WithExcludedNodes
+func ExcludedNodes(ctx context.Context) []string {
+	nodes, _ := ctx.Value(excludedNodesKey{}).([]string)
+	return nodes
+}
+
+// BuildIDEnv tags the connections of a build to its builder pods with the ID
+// of the build, so it can be cancelled from another client
+const BuildIDEnv = "KUBECTL_BUILDKIT_BUILD_ID"
+
+type buildIDKey struct{}
+
+// WithBuildID tags the connections of the Clients of drivers called with the
+// returned context with the build id
+func WithBuildID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, buildIDKey{}, id)
+}
+
+// BuildID returns the build ID set with WithBuildID
+func BuildID(ctx context.Context) string {
+	id, _ := ctx.Value(buildIDKey{}).(string)
+	return id
+}
+
 func Boot(ctx context.Context, d Driver, pw progress.Writer) (*BuilderClients, error) {
 	err := fmt.Errorf("timeout before starting")
 	var info *Info
@@ -147,6 +340,9 @@ func Boot(ctx context.Context, d Driver, pw progress.Writer) (*BuilderClients, e
 			}
 		}
 		results, err = d.Clients(ctx)
+		if err == ErrNoFailoverNode {
+			return nil, err
+		}
 		if err != nil {
 			// TODO - is there a fail-fast scenario we want to catch here?
 			RandSleep(1000)
@@ -0,0 +1,92 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package driver
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The disk I/O limits of the builds
+const (
+	IOReadBPS   = "read-bps"
+	IOWriteBPS  = "write-bps"
+	IOReadIOPS  = "read-iops"
+	IOWriteIOPS = "write-iops"
+)
+
+// IOLimits throttle the disk I/O of the RUN containers of a build, by limit,
+// a limit of 0 being none
+type IOLimits map[string]int64
+
+// ParseIOLimits parses LIMIT=VALUE[,LIMIT=VALUE], the bandwidths read-bps
+// and write-bps as quantities of bytes per second (eg. 100Mi), the
+// read-iops and write-iops as operations per second
+func ParseIOLimits(s string) (IOLimits, error) {
+	if s == "" {
+		return nil, nil
+	}
+	res := IOLimits{}
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid io limit %q, use LIMIT=VALUE", field)
+		}
+		switch parts[0] {
+		case IOReadBPS, IOWriteBPS:
+			q, err := resource.ParseQuantity(parts[1])
+			if err != nil || q.Sign() < 0 {
+				return nil, errors.Errorf("invalid %s %q, use a quantity of bytes per second like 100Mi", parts[0], parts[1])
+			}
+			res[parts[0]] = q.Value()
+		case IOReadIOPS, IOWriteIOPS:
+			n, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("invalid %s %q, use a number of operations per second", parts[0], parts[1])
+			}
+			res[parts[0]] = n
+		default:
+			return nil, errors.Errorf("unknown io limit %q, use %s, %s, %s or %s", parts[0], IOReadBPS, IOWriteBPS, IOReadIOPS, IOWriteIOPS)
+		}
+	}
+	return res, nil
+}
+
+// String formats the limits as ParseIOLimits parses them
+func (l IOLimits) String() string {
+	res := make([]string, 0, len(l))
+	for k, v := range l {
+		res = append(res, k+"="+strconv.FormatInt(v, 10))
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// Override returns the limits of l overridden by those of o
+func (l IOLimits) Override(o IOLimits) IOLimits {
+	if len(o) == 0 {
+		return l
+	}
+	res := IOLimits{}
+	for k, v := range l {
+		res[k] = v
+	}
+	for k, v := range o {
+		res[k] = v
+	}
+	return res
+}
+
+// Limited reports whether any of the limits is set
+func (l IOLimits) Limited() bool {
+	for _, v := range l {
+		if v > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseIOLimits(t *testing.T) {
+	t.Parallel()
+	l, err := ParseIOLimits("")
+	require.NoError(t, err)
+	require.Nil(t, l)
+
+	l, err = ParseIOLimits("read-bps=100Mi,write-bps=50M,read-iops=1000,write-iops=0")
+	require.NoError(t, err)
+	require.Equal(t, IOLimits{IOReadBPS: 100 << 20, IOWriteBPS: 50000000, IOReadIOPS: 1000, IOWriteIOPS: 0}, l)
+	require.Equal(t, "read-bps=104857600,read-iops=1000,write-bps=50000000,write-iops=0", l.String())
+	back, err := ParseIOLimits(l.String())
+	require.NoError(t, err)
+	require.Equal(t, l, back)
+	require.True(t, l.Limited())
+	require.False(t, IOLimits{IOWriteIOPS: 0}.Limited())
+
+	require.Equal(t, IOLimits{IOReadBPS: 1, IOWriteBPS: 3}, IOLimits{IOReadBPS: 1, IOWriteBPS: 2}.Override(IOLimits{IOWriteBPS: 3}))
+
+	for _, s := range []string{"read-bps", "read-bps=-1", "read-iops=1.5", "iops=10"} {
+		_, err := ParseIOLimits(s)
+		require.Error(t, err, s)
+	}
+}
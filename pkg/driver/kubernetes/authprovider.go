@@ -24,13 +24,21 @@ import (
 )
 
 func (d *Driver) GetAuthProvider(secretName string, stderr io.Writer) session.Attachable {
-	if secretName == "" {
-		secretName = buildxNameToDeploymentName(d.InitConfig.Name)
+	return d.newAuthProvider(secretName)
+}
+
+// newAuthProvider reads the credentials of the image pull secret secretName,
+// the secret named after the builder if empty, which may not exist
+func (d *Driver) newAuthProvider(secretName string) *authProvider {
+	ap := &authProvider{
+		driver:   d,
+		name:     secretName,
+		required: secretName != "",
 	}
-	return &authProvider{
-		driver: d,
-		name:   secretName,
+	if secretName == "" {
+		ap.name = buildxNameToDeploymentName(d.InitConfig.Name)
 	}
+	return ap
 }
 
 func (d *Driver) GetAuthHintMessage() string {
@@ -41,11 +49,25 @@ type authProvider struct {
 	driver *Driver
 	name   string
 	secret *corev1.Secret
-	// softFailure bool
+	// required is set for a secret named with --registry-secret, which has to
+	// exist, unlike the default secret of the builder
+	required bool
 }
 
 func (ap *authProvider) GetAuthConfig(registryHostname string) (imagetools.AuthConfig, error) {
-	return imagetools.AuthConfig{}, fmt.Errorf("GetAuthConfig not yet implemented for kube secrets")
+	res, err := ap.Credentials(context.TODO(), &auth.CredentialsRequest{Host: registryHostname})
+	if err != nil {
+		return imagetools.AuthConfig{}, err
+	}
+	ac := imagetools.AuthConfig{
+		ServerAddress: registryHostname,
+		Username:      res.Username,
+		Password:      res.Secret,
+	}
+	if res.Username == "" && res.Secret != "" {
+		ac.IdentityToken, ac.Password = res.Secret, ""
+	}
+	return ac, nil
 }
 
 func (ap *authProvider) Register(server *grpc.Server) {
@@ -63,7 +85,6 @@ type credStore struct {
 }
 
 func (ap *authProvider) Credentials(ctx context.Context, req *auth.CredentialsRequest) (*auth.CredentialsResponse, error) {
-	registries := credStore{}
 	res := &auth.CredentialsResponse{}
 	if req.Host == "registry-1.docker.io" {
 		req.Host = "https://index.docker.io/v1/"
@@ -73,6 +94,12 @@ func (ap *authProvider) Credentials(ctx context.Context, req *auth.CredentialsRe
 		// This avoids causing problems for local builds (non-push) based on public images (allowing anonymous operation)
 		secret, err := ap.driver.secretClient.Get(ctx, ap.name, metav1.GetOptions{})
 		if err != nil {
+			if ap.required {
+				if kubeerrors.IsNotFound(err) {
+					return nil, errors.Errorf("registry secret %q not found in namespace %s", ap.name, ap.driver.namespace)
+				}
+				return nil, errors.Wrapf(err, "failed to read registry secret %q", ap.name)
+			}
 			if kubeerrors.IsNotFound(err) {
 				ap.driver.authHintMessage = fmt.Sprintf("unable to find secret \"%s\" - if you used a different name specify with --registry-secret - if you haven't created a secret yet follow these instructions https://kubernetes.io/docs/tasks/configure-pod-container/pull-image-private-registry/", ap.name)
 				return res, nil
@@ -83,17 +110,12 @@ func (ap *authProvider) Credentials(ctx context.Context, req *auth.CredentialsRe
 		ap.secret = secret
 	}
 
-	// Make sure the secret is a properly formatted registry secret
-	data, ok := ap.secret.Data[".dockerconfigjson"]
-	if !ok {
-		return nil, fmt.Errorf("malformed kubernetes registry secret - missing '.dockerconfigjson' data key")
-	}
-	err := json.Unmarshal(data, &registries)
+	auths, err := secretAuths(ap.secret)
 	if err != nil {
-		return nil, fmt.Errorf("malformed kubernetes registry secret - '.dockerconfigjson' didn't contain valid cred store: %w", err)
+		return nil, err
 	}
 
-	creds, found := registries.Auths[req.Host] // TODO this code needs work...
+	creds, found := lookupCreds(auths, req.Host)
 	if found {
 		if (creds.Username == "" || creds.Password == "") && creds.Auth != "" {
 			creds.Username, creds.Password, err = decodeAuth(creds.Auth)
@@ -115,6 +137,121 @@ func (ap *authProvider) Credentials(ctx context.Context, req *auth.CredentialsRe
 	return res, nil
 }
 
+// secretAuths returns the credentials of an image pull secret, a
+// kubernetes.io/dockerconfigjson secret or a legacy kubernetes.io/dockercfg
+// one, which has the auths of the config without the enclosing object
+func secretAuths(secret *corev1.Secret) (map[string]creds, error) {
+	if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		registries := credStore{}
+		if err := json.Unmarshal(data, &registries); err != nil {
+			return nil, fmt.Errorf("malformed kubernetes registry secret - '.dockerconfigjson' didn't contain valid cred store: %w", err)
+		}
+		return registries.Auths, nil
+	}
+	if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		auths := map[string]creds{}
+		if err := json.Unmarshal(data, &auths); err != nil {
+			return nil, fmt.Errorf("malformed kubernetes registry secret - '.dockercfg' didn't contain valid cred store: %w", err)
+		}
+		return auths, nil
+	}
+	return nil, fmt.Errorf("malformed kubernetes registry secret - missing '.dockerconfigjson' data key")
+}
+
+// Logout removes the credentials for host from the registry secret, the
+// secret is deleted once no credentials remain or if host is empty
+func (d *Driver) Logout(ctx context.Context, secretName, host string) error {
+	if secretName == "" {
+		secretName = buildxNameToDeploymentName(d.InitConfig.Name)
+	}
+	return retryOnConflict(ctx, "registry secret", secretName, func() error {
+		secret, err := d.secretClient.Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			if kubeerrors.IsNotFound(err) {
+				if host == "" {
+					// Nothing left to purge
+					return nil
+				}
+				return errors.Errorf("registry secret %q not found", secretName)
+			}
+			return err
+		}
+		if host == "" {
+			return d.secretClient.Delete(ctx, secretName, metav1.DeleteOptions{})
+		}
+
+		data, ok := secret.Data[".dockerconfigjson"]
+		if !ok {
+			return fmt.Errorf("malformed kubernetes registry secret - missing '.dockerconfigjson' data key")
+		}
+		// Preserve any fields other than auths the secret was created with
+		var cfg map[string]json.RawMessage
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("malformed kubernetes registry secret - '.dockerconfigjson' didn't contain valid cred store: %w", err)
+		}
+		auths := map[string]json.RawMessage{}
+		if raw, ok := cfg["auths"]; ok {
+			if err := json.Unmarshal(raw, &auths); err != nil {
+				return fmt.Errorf("malformed kubernetes registry secret - '.dockerconfigjson' didn't contain valid cred store: %w", err)
+			}
+		}
+		found := false
+		for k := range auths {
+			if registryHostKey(k) == registryHostKey(host) {
+				delete(auths, k)
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("no credentials for %s in registry secret %q", host, secretName)
+		}
+		if len(auths) == 0 {
+			// Unless another client added credentials since
+			return d.secretClient.Delete(ctx, secretName, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &secret.ResourceVersion},
+			})
+		}
+		raw, err := json.Marshal(auths)
+		if err != nil {
+			return err
+		}
+		cfg["auths"] = raw
+		secret.Data[".dockerconfigjson"], err = json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		_, err = d.secretClient.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// lookupCreds returns the credentials of host, keyed by the host itself or,
+// as written by docker login and such, by a URL of it
+func lookupCreds(auths map[string]creds, host string) (creds, bool) {
+	if c, ok := auths[host]; ok {
+		return c, true
+	}
+	key := registryHostKey(host)
+	for k, c := range auths {
+		if registryHostKey(k) == key {
+			return c, true
+		}
+	}
+	return creds{}, false
+}
+
+// registryHostKey normalizes the keys used in docker config files, which may
+// be bare hosts or URLs
+func registryHostKey(s string) string {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+	s = strings.SplitN(s, "/", 2)[0]
+	switch s {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return s
+}
+
 // TODO - to actually implement these properly, use buildkit/session/autrh/authprovider/authprovider.go for inspiration
 func (ap *authProvider) FetchToken(context.Context, *auth.FetchTokenRequest) (*auth.FetchTokenResponse, error) {
 	return nil, status.Errorf(codes.Unavailable, "client side tokens not yet implemented")
@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 )
 
 func Test_decodeAuth(t *testing.T) {
@@ -32,3 +34,51 @@ func Test_decodeAuth(t *testing.T) {
 	assert.Equal(t, username, "")
 	assert.Equal(t, password, "")
 }
+
+func Test_registryHostKey(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "docker.io", registryHostKey("https://index.docker.io/v1/"))
+	assert.Equal(t, "docker.io", registryHostKey("docker.io"))
+	assert.Equal(t, "registry.acme.com:5000", registryHostKey("http://registry.acme.com:5000/v2/"))
+	assert.Equal(t, "ghcr.io", registryHostKey("ghcr.io"))
+}
+
+func Test_lookupCreds(t *testing.T) {
+	t.Parallel()
+	auths := map[string]creds{
+		"https://index.docker.io/v1/":     {Username: "hub"},
+		"https://registry.acme.com:5000/": {Username: "acme"},
+		"ghcr.io":                         {Username: "gh"},
+	}
+	c, found := lookupCreds(auths, "ghcr.io")
+	assert.True(t, found)
+	assert.Equal(t, "gh", c.Username)
+	c, found = lookupCreds(auths, "registry.acme.com:5000")
+	assert.True(t, found)
+	assert.Equal(t, "acme", c.Username)
+	c, found = lookupCreds(auths, "https://index.docker.io/v1/")
+	assert.True(t, found)
+	assert.Equal(t, "hub", c.Username)
+	_, found = lookupCreds(auths, "quay.io")
+	assert.False(t, found)
+}
+
+func Test_secretAuths(t *testing.T) {
+	t.Parallel()
+	auths, err := secretAuths(&corev1.Secret{Data: map[string][]byte{
+		corev1.DockerConfigJsonKey: []byte(`{"auths":{"ghcr.io":{"username":"gh","password":"token"}}}`),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]creds{"ghcr.io": {Username: "gh", Password: "token"}}, auths)
+
+	auths, err = secretAuths(&corev1.Secret{Data: map[string][]byte{
+		corev1.DockerConfigKey: []byte(`{"https://index.docker.io/v1/":{"auth":"amRvZTpzdXBlcnNlY3JldA=="}}`),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]creds{"https://index.docker.io/v1/": {Auth: "amRvZTpzdXBlcnNlY3JldA=="}}, auths)
+
+	_, err = secretAuths(&corev1.Secret{Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`[]`)}})
+	assert.Error(t, err)
+	_, err = secretAuths(&corev1.Secret{Data: map[string][]byte{"token": []byte("secret")}})
+	assert.Error(t, err)
+}
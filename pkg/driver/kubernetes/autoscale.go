@@ -0,0 +1,129 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Builders created with scale-on-queue are scaled by the builds, like with
+// scale-down-idle, rather than by a controller in the cluster: there is no
+// metrics adapter to install, the build queue leases are the metric.  Each
+// ready pod then has room for max-parallel-builds builds, and a build which
+// has to queue raises the replicas to fit the builds running and queued, up
+// to replicas-max.  The replicas idle for scale-down-idle are removed by the
+// following builds, down to replicas-min.
+
+// DefaultScaleOnQueueIdle is how long the replicas of a builder created with
+// scale-on-queue may idle before builds scale them down, unless set
+const DefaultScaleOnQueueIdle = 10 * time.Minute
+
+// checkQueueScaling validates the scale-on-queue options, and defaults those
+// it needs
+func checkQueueScaling(opt *manifest.DeploymentOpt) error {
+	if !opt.ScaleOnQueue {
+		if opt.ReplicasMax > 0 {
+			return errors.Errorf("replicas-max requires scale-on-queue")
+		}
+		if opt.ReplicasMin > 0 && opt.Replicas < opt.ReplicasMin {
+			opt.Replicas = opt.ReplicasMin
+		}
+		return nil
+	}
+	switch {
+	case opt.ReplicasMax == 0:
+		return errors.Errorf("scale-on-queue requires replicas-max, the most replicas builds scale the builder up to")
+	case opt.ReplicasMax < opt.ReplicasMin:
+		return errors.Errorf("replicas-max %d is less than replicas-min %d", opt.ReplicasMax, opt.ReplicasMin)
+	case len(opt.ReplicaClasses) > 0:
+		return errors.Errorf("scale-on-queue can't be used with replica-classes")
+	}
+	if opt.MaxParallelBuilds == 0 {
+		// Builds queue for a pod of their own
+		opt.MaxParallelBuilds = 1
+	}
+	if opt.ScaleDownIdle == 0 {
+		opt.ScaleDownIdle = DefaultScaleOnQueueIdle
+	}
+	if opt.Replicas < opt.ReplicasMin {
+		opt.Replicas = opt.ReplicasMin
+	}
+	if opt.Replicas > opt.ReplicasMax {
+		opt.Replicas = opt.ReplicasMax
+	}
+	return nil
+}
+
+// queueScaling is how builds scale a builder created with scale-on-queue
+type queueScaling struct {
+	// perPod is the number of builds each pod runs at once
+	perPod int
+	min    int
+	max    int
+}
+
+// parseQueueScaling returns the scaling of depl, nil unless it was created
+// with scale-on-queue
+func parseQueueScaling(depl *appsv1.Deployment) *queueScaling {
+	if depl.ObjectMeta.Annotations[manifest.ScaleOnQueueAnnotation] != "true" {
+		return nil
+	}
+	s := &queueScaling{min: int(minReplicas(depl))}
+	s.perPod, _ = strconv.Atoi(depl.ObjectMeta.Annotations[manifest.MaxParallelBuildsAnnotation])
+	s.max, _ = strconv.Atoi(depl.ObjectMeta.Annotations[manifest.ReplicasMaxAnnotation])
+	if s.perPod <= 0 || s.max <= 0 {
+		return nil
+	}
+	return s
+}
+
+// minReplicas is the fewest replicas builds scale depl down to
+func minReplicas(depl *appsv1.Deployment) int32 {
+	if n, err := strconv.Atoi(depl.ObjectMeta.Annotations[manifest.ReplicasMinAnnotation]); err == nil && n > 1 {
+		return int32(n)
+	}
+	return 1
+}
+
+// capacity is the number of builds the ready pods of depl run at once
+func (s *queueScaling) capacity(depl *appsv1.Deployment) int {
+	ready := int(depl.Status.ReadyReplicas)
+	if ready < 1 {
+		ready = 1
+	}
+	return s.perPod * ready
+}
+
+// replicas is the number of replicas fitting the builds running and queued
+func (s *queueScaling) replicas(builds int) int32 {
+	n := (builds + s.perPod - 1) / s.perPod
+	if n < s.min {
+		n = s.min
+	}
+	if n > s.max {
+		n = s.max
+	}
+	return int32(n)
+}
+
+// scaleUpForQueue raises the replicas of the builder to fit the builds
+func (d *Driver) scaleUpForQueue(ctx context.Context, depl *appsv1.Deployment, s *queueScaling, builds int) error {
+	replicas := s.replicas(builds)
+	if depl.Spec.Replicas != nil && *depl.Spec.Replicas >= replicas {
+		return nil
+	}
+	logrus.Infof("scaling %s up to %d replicas for %d builds", depl.Name, replicas, builds)
+	depl = depl.DeepCopy()
+	depl.Spec.Replicas = &replicas
+	// A conflict means another build scaled it, the queue is checked again on the next poll
+	_, err := d.builderClient.Update(ctx, depl, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_checkQueueScaling(t *testing.T) {
+	t.Parallel()
+	opt := &manifest.DeploymentOpt{Replicas: 1, ScaleOnQueue: true, ReplicasMin: 2, ReplicasMax: 10}
+	require.NoError(t, checkQueueScaling(opt))
+	require.Equal(t, 2, opt.Replicas)
+	require.Equal(t, 1, opt.MaxParallelBuilds)
+	require.Equal(t, DefaultScaleOnQueueIdle, opt.ScaleDownIdle)
+
+	require.Error(t, checkQueueScaling(&manifest.DeploymentOpt{ScaleOnQueue: true}), "replicas-max is required")
+	require.Error(t, checkQueueScaling(&manifest.DeploymentOpt{ScaleOnQueue: true, ReplicasMin: 3, ReplicasMax: 2}))
+	require.Error(t, checkQueueScaling(&manifest.DeploymentOpt{ReplicasMax: 2}), "replicas-max requires scale-on-queue")
+}
+
+func Test_queueScaling(t *testing.T) {
+	t.Parallel()
+	depl := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		manifest.MaxParallelBuildsAnnotation: "2",
+	}}}
+	require.Nil(t, parseQueueScaling(depl))
+
+	depl.Annotations[manifest.ScaleOnQueueAnnotation] = "true"
+	depl.Annotations[manifest.ReplicasMinAnnotation] = "2"
+	depl.Annotations[manifest.ReplicasMaxAnnotation] = "5"
+	s := parseQueueScaling(depl)
+	require.Equal(t, &queueScaling{perPod: 2, min: 2, max: 5}, s)
+
+	require.Equal(t, 2, s.capacity(depl), "a pod is assumed while none is ready")
+	depl.Status.ReadyReplicas = 3
+	require.Equal(t, 6, s.capacity(depl))
+
+	require.Equal(t, int32(2), s.replicas(1))
+	require.Equal(t, int32(4), s.replicas(7))
+	require.Equal(t, int32(5), s.replicas(40))
+	require.Equal(t, int32(2), minReplicas(depl))
+}
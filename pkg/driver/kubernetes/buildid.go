@@ -0,0 +1,84 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Every build has an ID the CLI logs with it.  The builder pod running the
+// build records it in an Event and in an annotation, so the server side
+// telemetry of a build can be found from the ID reported by a user, the
+// Event dating the buildkitd logs of the build.
+
+const (
+	lastBuildIDAnnotation = "buildkit.mobyproject.org/last-build-id"
+	buildStartedReason    = "BuildStarted"
+)
+
+func (d *Driver) RecordBuild(ctx context.Context, name, id string) error {
+	pod, err := d.podClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if err := d.markPodBuildID(ctx, pod, id); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := d.eventClient.Create(ctx, buildStartedEvent(pod, id, time.Now()), metav1.CreateOptions{}); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("failed to record build %s on pod %s: %v", id, name, errs)
+	}
+	return nil
+}
+
+func (d *Driver) markPodBuildID(ctx context.Context, pod *corev1.Pod, id string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				lastBuildIDAnnotation: id,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = d.podClient.Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func buildStartedEvent(pod *corev1.Pod, id string, now time.Time) *corev1.Event {
+	host, _ := os.Hostname()
+	ts := metav1.NewTime(now)
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.Name + ".",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+		Reason:         buildStartedReason,
+		Message:        fmt.Sprintf("Build %s started by %s", id, host),
+		Type:           corev1.EventTypeNormal,
+		Source:         corev1.EventSource{Component: "kubectl-buildkit"},
+		FirstTimestamp: ts,
+		LastTimestamp:  ts,
+		Count:          1,
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_buildStartedEvent(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "buildkit-abc", Namespace: "ci", UID: "1234"}}
+	ev := buildStartedEvent(pod, "xyz", time.Now())
+	require.Equal(t, "buildkit-abc.", ev.GenerateName)
+	require.Equal(t, "ci", ev.Namespace)
+	require.Equal(t, "Pod", ev.InvolvedObject.Kind)
+	require.Equal(t, pod.UID, ev.InvolvedObject.UID)
+	require.Equal(t, buildStartedReason, ev.Reason)
+	require.Contains(t, ev.Message, "Build xyz started")
+}
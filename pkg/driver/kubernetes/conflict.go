@@ -0,0 +1,43 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// The Secrets, ConfigMaps and Leases of a builder are shared by every CLI
+// invocation using it, e.g. parallel CI jobs.  They are updated with
+// read-modify-write cycles which send the resourceVersion they read, so the
+// API server rejects an update racing with another one instead of one
+// silently clobbering the other, and the cycle is run again on the latest
+// version.
+
+// conflictRetries is the number of read-modify-write cycles attempted
+const conflictRetries = 5
+
+// retryOnConflict runs fn, a read-modify-write cycle of the object, again
+// while it races with another client, i.e. fails with a conflict, or to create
+// an object another client just created
+func retryOnConflict(ctx context.Context, kind, name string, fn func() error) error {
+	var err error
+	for i := 0; i < conflictRetries; i++ {
+		err = fn()
+		if !kubeerrors.IsConflict(err) && !kubeerrors.IsAlreadyExists(err) {
+			return err
+		}
+		logrus.Debugf("%s %q modified concurrently, retrying: %s", kind, name, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		driver.RandSleep(int64(100 * (i + 1)))
+	}
+	return errors.Errorf("%s %q is being modified concurrently by another client, gave up after %d attempts: %s", kind, name, conflictRetries, err)
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test_retryOnConflict(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	conflict := kubeerrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "buildkit", fmt.Errorf("the object has been modified"))
+
+	calls := 0
+	err := retryOnConflict(ctx, "secret", "buildkit", func() error {
+		calls++
+		if calls < 3 {
+			return conflict
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retryOnConflict(ctx, "secret", "buildkit", func() error {
+		calls++
+		return conflict
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `secret "buildkit" is being modified concurrently`)
+	assert.Equal(t, conflictRetries, calls)
+
+	// Other errors aren't retried
+	calls = 0
+	err = retryOnConflict(ctx, "secret", "buildkit", func() error {
+		calls++
+		return kubeerrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "buildkit")
+	})
+	assert.True(t, kubeerrors.IsNotFound(err))
+	assert.Equal(t, 1, calls)
+}
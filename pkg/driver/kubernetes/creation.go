@@ -1,14 +1,16 @@
 package kubernetes
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/podchooser"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -17,6 +19,102 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// rolloutConfig restarts the pods of the existing builder and its replica
+// classes on the updated buildkitd config
+func (d *Driver) rolloutConfig(ctx context.Context, sub progress.SubLogger) error {
+	contents := d.configMap.BinaryData[manifest.ConfigFileName]
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		if kubeerrors.IsNotFound(err) {
+			// Created with the config
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get builder %s", d.deployment.Name)
+	}
+	sub.Log(1, []byte(fmt.Sprintf("Restarting the pods of %s with the updated buildkitd config\n", d.deployment.Name)))
+	manifest.SetConfigDigest(depl, contents)
+	if _, err := d.builderClient.Update(ctx, depl, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "failed to restart builder %s", d.deployment.Name)
+	}
+	for _, class := range d.replicaClasses {
+		depl, err := d.deploymentClient.Get(ctx, class.Name, metav1.GetOptions{})
+		if err != nil {
+			if kubeerrors.IsNotFound(err) {
+				continue
+			}
+			return errors.Wrapf(err, "failed to get replica class %s", class.Name)
+		}
+		manifest.SetConfigDigest(depl, contents)
+		if _, err := d.deploymentClient.Update(ctx, depl, metav1.UpdateOptions{}); err != nil {
+			return errors.Wrapf(err, "failed to restart replica class %s", class.Name)
+		}
+	}
+	return nil
+}
+
+// rolloutResources updates the requests, limits and priority class of the
+// pods of an existing builder and its replica classes to those given, which
+// rolls their pods
+func (d *Driver) rolloutResources(ctx context.Context, sub progress.SubLogger) error {
+	err := retryOnConflict(ctx, "builder", d.deployment.Name, func() error {
+		depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+		if err != nil {
+			if kubeerrors.IsNotFound(err) {
+				// Created with them
+				return nil
+			}
+			return err
+		}
+		if !manifest.SetResources(depl, d.deployment) {
+			return nil
+		}
+		sub.Log(1, []byte(fmt.Sprintf("Rolling the pods of %s with the updated resources\n", d.deployment.Name)))
+		_, err = d.builderClient.Update(ctx, depl, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to update the resources of builder %s", d.deployment.Name)
+	}
+	for _, class := range d.replicaClasses {
+		err := retryOnConflict(ctx, "replica class", class.Name, func() error {
+			depl, err := d.deploymentClient.Get(ctx, class.Name, metav1.GetOptions{})
+			if err != nil {
+				if kubeerrors.IsNotFound(err) {
+					return nil
+				}
+				return err
+			}
+			if !manifest.SetResources(depl, class) {
+				return nil
+			}
+			sub.Log(1, []byte(fmt.Sprintf("Rolling the pods of %s with the updated resources\n", class.Name)))
+			_, err = d.deploymentClient.Update(ctx, depl, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update the resources of replica class %s", class.Name)
+		}
+	}
+	return nil
+}
+
+// Create the claim holding the buildkit state, an existing claim is kept
+// with its cache and size
+func (d *Driver) createCacheClaim(ctx context.Context) error {
+	_, err := d.claimClient.Get(ctx, d.cacheClaim.Name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.claimClient.Create(ctx, d.cacheClaim, metav1.CreateOptions{})
+		if kubeerrors.IsAlreadyExists(err) {
+			// Created by a concurrent build
+			err = nil
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create cache claim %q", d.cacheClaim.Name)
+	}
+	return nil
+}
+
 // Idempotently create the required ConfigMap
 // Will return latest error if context has expired, else will keep trying
 func (d *Driver) createConfigMap(ctx context.Context, sub progress.SubLogger) error {
@@ -30,10 +128,12 @@ func (d *Driver) createConfigMap(ctx context.Context, sub progress.SubLogger) er
 		default:
 		}
 
-		_, err = d.configMapClient.Get(ctx, d.configMap.Name, metav1.GetOptions{})
+		var existing *v1.ConfigMap
+		existing, err = d.configMapClient.Get(ctx, d.configMap.Name, metav1.GetOptions{})
 		if err != nil && kubeerrors.IsNotFound(err) {
 			// Doesn't exist, create it
 			latestVerb = "create"
+			d.configMap.ResourceVersion = ""
 			_, err = d.configMapClient.Create(ctx, d.configMap, metav1.CreateOptions{})
 		} else if err != nil {
 			// Unexpected Get failure...
@@ -41,11 +141,20 @@ func (d *Driver) createConfigMap(ctx context.Context, sub progress.SubLogger) er
 			driver.RandSleep(1000)
 			continue
 		} else if d.userSpecifiedConfig {
-			// err was nil, thus it already exists, and user passed a new config, so update it
+			// err was nil, thus it already exists, and user passed a new config, so update it.
+			// The version read makes an update racing with another client fail
+			// instead of overwriting it, the next attempt reads the latest one
 			latestVerb = "update"
+			d.configMap.ResourceVersion = existing.ResourceVersion
 			_, err = d.configMapClient.Update(ctx, d.configMap, metav1.UpdateOptions{})
+			if err == nil {
+				d.configUpdated = !bytes.Equal(existing.BinaryData[manifest.ConfigFileName], d.configMap.BinaryData[manifest.ConfigFileName])
+			}
 		}
-		if err != nil {
+		if kubeerrors.IsConflict(err) {
+			sub.Log(1, []byte(fmt.Sprintf("Warning \tconfigmap %s was modified concurrently by another client - retrying...\n", d.configMap.Name)))
+			driver.RandSleep(1000)
+		} else if err != nil {
 			// Either the Create or the Update failed
 			sub.Log(1, []byte(fmt.Sprintf("Warning \tfailed to %s configmap %s - retrying...\n", latestVerb, err)))
 			driver.RandSleep(1000)
@@ -54,6 +163,34 @@ func (d *Driver) createConfigMap(ctx context.Context, sub progress.SubLogger) er
 	return err
 }
 
+// Create the admin service of the builder, its spec is mostly immutable
+// (clusterIP) so an existing one is left as is
+func (d *Driver) createAdminService(ctx context.Context) error {
+	_, err := d.serviceClient.Get(ctx, d.adminService.Name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.serviceClient.Create(ctx, d.adminService, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create admin service %q", d.adminService.Name)
+	}
+	return nil
+}
+
+// Create or update the builder's NetworkPolicy
+func (d *Driver) createNetworkPolicy(ctx context.Context) error {
+	existing, err := d.networkPolicyClient.Get(ctx, d.networkPolicy.Name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.networkPolicyClient.Create(ctx, d.networkPolicy, metav1.CreateOptions{})
+	} else if err == nil {
+		d.networkPolicy.ResourceVersion = existing.ResourceVersion
+		_, err = d.networkPolicyClient.Update(ctx, d.networkPolicy, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create network policy %q", d.networkPolicy.Name)
+	}
+	return nil
+}
+
 // Idempotently create the required ConfigMap
 // Will return latest error if context has expired, else will keep trying
 func (d *Driver) createBuilder(ctx context.Context, sub progress.SubLogger, userSpecifiedRuntime bool) error {
@@ -94,17 +231,26 @@ func (d *Driver) createBuilder(ctx context.Context, sub progress.SubLogger, user
 		return nil
 	}
 	var zero64 int64
+	wait := driver.WaitOptions(ctx)
+	// pending is the last reason reported for a pod not being ready
+	pending := ""
 
-	for {
+	for attempt := 0; ; attempt++ {
 		select {
 		case <-ctx.Done():
-			return errors.Wrap(err, "timed out waiting for builder to become ready")
+			switch {
+			case pending != "":
+				return errors.Errorf("timed out waiting for builder to become ready: %s", pending)
+			case err != nil:
+				return errors.Wrap(err, "timed out waiting for builder to become ready")
+			}
+			return errors.New("timed out waiting for builder to become ready")
 		default:
 		}
 
-		depl, err = d.deploymentClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+		depl, err = d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
 		if err != nil && kubeerrors.IsNotFound(err) {
-			depl, err = d.deploymentClient.Create(ctx, d.deployment, metav1.CreateOptions{})
+			depl, err = d.builderClient.Create(ctx, d.deployment, metav1.CreateOptions{})
 			if err != nil {
 				driver.RandSleep(1000)
 				continue
@@ -120,6 +266,25 @@ func (d *Driver) createBuilder(ctx context.Context, sub progress.SubLogger, user
 			sub.Log(1, []byte(fmt.Sprintf("All %d replicas for %s online\n", d.minReplicas, d.deployment.Name)))
 			return nil
 		}
+		if wait.NoWait {
+			sub.Log(1, []byte(fmt.Sprintf("Created %s, not waiting for its pods\n", d.deployment.Name)))
+			return nil
+		}
+
+		// Tell why pods aren't coming up, events of the pods are only logged
+		// for replica sets and may have expired
+		if podList, err2 := d.podClient.List(ctx, metav1.ListOptions{LabelSelector: "app=" + d.deployment.Name}); err2 == nil {
+			for i := range podList.Items {
+				for _, reason := range podPendingReasons(&podList.Items[i]) {
+					msg := fmt.Sprintf("Pending \t%s \t%s\n", podList.Items[i].Name, reason)
+					if _, alreadyProcessed := reportedEvents[msg]; !alreadyProcessed {
+						reportedEvents[msg] = struct{}{}
+						sub.Log(1, []byte(msg))
+					}
+					pending = podList.Items[i].Name + ": " + reason
+				}
+			}
+		}
 
 		// Not all pods are ready, so inspect why, and take corrective action if necessary
 		// Check to see if we have any replicaset errors so we can log them
@@ -210,7 +375,7 @@ func (d *Driver) createBuilder(ctx context.Context, sub progress.SubLogger, user
 
 						// Set the resource version for atomic update to detect possible races with other CLIs
 						d.deployment.ObjectMeta.ResourceVersion = depl.ObjectMeta.ResourceVersion
-						depl2, err := d.deploymentClient.Update(ctx, d.deployment, metav1.UpdateOptions{})
+						depl2, err := d.builderClient.Update(ctx, d.deployment, metav1.UpdateOptions{})
 						if err != nil {
 							// TODO - may need to explore the failure modes here further to see if additional hardening/retry logic is called for
 							return errors.Wrapf(err, "error while calling deploymentClient.Update for %q - resourceVersion: %v", d.deployment.Name, &d.deployment.ObjectMeta.ResourceVersion)
@@ -243,8 +408,38 @@ func (d *Driver) createBuilder(ctx context.Context, sub progress.SubLogger, user
 				})
 			}
 		}
-		time.Sleep(500 * time.Millisecond)
+		// Checked at the top of the loop
+		_ = wait.Backoff.Sleep(ctx, attempt)
+	}
+}
+
+// podPendingReasons returns why pod isn't ready yet when it's stuck: it
+// can't be scheduled, or its containers are waiting for their image or
+// restarting
+func podPendingReasons(pod *v1.Pod) []string {
+	if pod.DeletionTimestamp != nil || podchooser.IsPodReady(pod) {
+		return nil
+	}
+	var res []string
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodScheduled && c.Status == v1.ConditionFalse && c.Reason != "" {
+			res = append(res, strings.TrimSpace(c.Reason+" "+c.Message))
+		}
+	}
+	statuses := append(pod.Status.InitContainerStatuses[:len(pod.Status.InitContainerStatuses):len(pod.Status.InitContainerStatuses)], pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		w := cs.State.Waiting
+		if w == nil {
+			continue
+		}
+		switch w.Reason {
+		case "", "ContainerCreating", "PodInitializing":
+			// Starting normally
+			continue
+		}
+		res = append(res, strings.TrimSpace(fmt.Sprintf("%s %s: %s", cs.Name, w.Reason, w.Message)))
 	}
+	return res
 }
 
 func (d *Driver) getReplicaSets(ctx context.Context, depl *appsv1.Deployment) ([]*appsv1.ReplicaSet, error) {
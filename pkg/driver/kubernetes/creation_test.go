@@ -0,0 +1,47 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_podPendingReasons(t *testing.T) {
+	t.Parallel()
+	unschedulable := &corev1.Pod{Status: corev1.PodStatus{
+		Conditions: []corev1.PodCondition{{
+			Type:    corev1.PodScheduled,
+			Status:  corev1.ConditionFalse,
+			Reason:  "Unschedulable",
+			Message: "0/3 nodes are available: 3 Insufficient memory.",
+		}},
+	}}
+	require.Equal(t, []string{"Unschedulable 0/3 nodes are available: 3 Insufficient memory."}, podPendingReasons(unschedulable))
+
+	pulling := &corev1.Pod{Status: corev1.PodStatus{
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name: "buildkitd",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+				Reason:  "ImagePullBackOff",
+				Message: `Back-off pulling image "moby/buildkit:typo"`,
+			}},
+		}},
+	}}
+	require.Equal(t, []string{`buildkitd ImagePullBackOff: Back-off pulling image "moby/buildkit:typo"`}, podPendingReasons(pulling))
+
+	creating := &corev1.Pod{Status: corev1.PodStatus{
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "buildkitd",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+		}},
+	}}
+	require.Empty(t, podPendingReasons(creating))
+
+	ready := &corev1.Pod{Status: corev1.PodStatus{
+		Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+	}}
+	require.Empty(t, podPendingReasons(ready))
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/podchooser"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// A drained builder pod is annotated with manifest.UnschedulableAnnotation,
+// which the pod choosers skip, so new builds land on the other pods while the
+// builds running on it finish.  The pod itself keeps running, eg. until the
+// maintenance of its node evicts it, and is uncordoned by removing the
+// annotation.
+
+func (d *Driver) Drain(ctx context.Context, pod, node string, drain bool) ([]string, error) {
+	pods, err := podchooser.ListPods(ctx, d.podClient, d.deployment)
+	if err != nil {
+		return nil, err
+	}
+	selected := selectPods(pods, pod, node)
+	if len(selected) == 0 {
+		switch {
+		case pod != "":
+			return nil, errors.Errorf("builder %s has no pod %s", d.deployment.Name, pod)
+		case node != "":
+			return nil, errors.Errorf("builder %s has no pod on node %s", d.deployment.Name, node)
+		}
+		return nil, errors.Errorf("builder %s has no pods", d.deployment.Name)
+	}
+	var value interface{}
+	if drain {
+		value = "true"
+	}
+	// A merge patch removes the annotation with a null value
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				manifest.UnschedulableAnnotation: value,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, p := range selected {
+		if isDrained(p) == drain {
+			continue
+		}
+		if _, err := d.podClient.Patch(ctx, p.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return changed, errors.Wrapf(err, "failed to annotate pod %s", p.Name)
+		}
+		changed = append(changed, p.Name)
+	}
+	return changed, nil
+}
+
+// selectPods returns the pods named pod and on the Kubernetes node
+// node, all of them if both are empty
+func selectPods(pods []*corev1.Pod, pod, node string) []*corev1.Pod {
+	var res []*corev1.Pod
+	for _, p := range pods {
+		if (pod == "" || p.Name == pod) && (node == "" || p.Spec.NodeName == node) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func isDrained(p *corev1.Pod) bool {
+	return p.Annotations[manifest.UnschedulableAnnotation] == "true"
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_selectPods(t *testing.T) {
+	t.Parallel()
+	pod := func(name, node string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.PodSpec{NodeName: node},
+		}
+	}
+	pods := []*corev1.Pod{pod("a", "worker-1"), pod("b", "worker-2"), pod("c", "worker-2")}
+	names := func(pods []*corev1.Pod) []string {
+		var res []string
+		for _, p := range pods {
+			res = append(res, p.Name)
+		}
+		return res
+	}
+	require.Equal(t, []string{"a", "b", "c"}, names(selectPods(pods, "", "")))
+	require.Equal(t, []string{"b"}, names(selectPods(pods, "b", "")))
+	require.Equal(t, []string{"b", "c"}, names(selectPods(pods, "", "worker-2")))
+	require.Empty(t, selectPods(pods, "a", "worker-2"))
+}
+
+func Test_podStatusDrained(t *testing.T) {
+	t.Parallel()
+	p := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{manifest.UnschedulableAnnotation: "true"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	require.True(t, isDrained(p))
+	require.Equal(t, "Running (Drained)", podStatus(p))
+
+	p.Annotations[manifest.UnschedulableAnnotation] = "false"
+	require.False(t, isDrained(p))
+	require.Equal(t, "Running", podStatus(p))
+}
@@ -5,15 +5,21 @@ package kubernetes
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/moby/buildkit/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/execconn"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
@@ -23,12 +29,15 @@ import (
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/store"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	clientappsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	clientcoordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
 	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
-	"k8s.io/client-go/rest"
+	clientnetworkingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
@@ -40,6 +49,8 @@ const (
 	// valid values for driver-opt loadbalance
 	LoadbalanceRandom = "random"
 	LoadbalanceSticky = "sticky"
+	// LoadbalanceLeastLoaded chooses the pod which seems to run the fewest builds, see Driver.podLoad
+	LoadbalanceLeastLoaded = "least-loaded"
 
 	// valid values for driver-opt worker
 	WorkerContainerd           = "containerd"
@@ -48,14 +59,19 @@ const (
 	DefaultContainerdSockPath  = "/run/containerd/containerd.sock"
 	DefaultDockerSockPath      = "/var/run/docker.sock"
 
-	//DefaultContainerRuntime    = "containerd" // TODO figure out a way to autodiscover this if not specified for better UX
-	DefaultContainerRuntime = "docker" // Temporary since most kubernetes clusters are still Docker based today...
+	// DefaultContainerRuntime is tried first when the runtime of the nodes can't be detected, see detectRuntimes
+	DefaultContainerRuntime = "docker"
 
 	// TODO - consider adding other default values here to aid users in fine-tuning by editing the configmap post deployment
 	DefaultConfigFileTemplate = `# Default buildkitd configuration.  Use --config <path/to/file> to override during create
 debug = false
 [worker.containerd]
   namespace = "{{ .ContainerdNamespace }}"
+{{- if .MaxParallelism }}
+  max-parallelism = {{ .MaxParallelism }}
+[worker.oci]
+  max-parallelism = {{ .MaxParallelism }}
+{{- end }}
 `
 )
 
@@ -65,19 +81,74 @@ type Driver struct {
 	minReplicas          int
 	deployment           *appsv1.Deployment
 	configMap            *corev1.ConfigMap
+	networkPolicy        *networkingv1.NetworkPolicy
+	egressProxy          *egressProxy
+	sharedCache          *sharedCache
 	clientset            *kubernetes.Clientset
 	deploymentClient     clientappsv1.DeploymentInterface
 	replicaSetClient     clientappsv1.ReplicaSetInterface
 	podClient            clientcorev1.PodInterface
 	configMapClient      clientcorev1.ConfigMapInterface
 	secretClient         clientcorev1.SecretInterface
+	leaseClient          clientcoordinationv1.LeaseInterface
+	networkPolicyClient  clientnetworkingv1.NetworkPolicyInterface
+	serviceClient        clientcorev1.ServiceInterface
 	podChooser           podchooser.PodChooser
 	eventClient          clientcorev1.EventInterface
 	userSpecifiedRuntime bool
 	userSpecifiedConfig  bool
 	namespace            string
 	loadbalance          string
+	ipFamily             string
 	authHintMessage      string
+	replicaClasses       []*appsv1.Deployment
+	replicaClass         string
+	// builderClient manages the builder's own pods, a Deployment or a DaemonSet
+	builderClient  workloadClient
+	deploymentKind string
+	preferNodes    []string
+	localNode      string
+	nodeClient     clientcorev1.NodeInterface
+	// cacheClaim holds the buildkit state with cache-storage=pvc
+	cacheClaim  *corev1.PersistentVolumeClaim
+	claimClient clientcorev1.PersistentVolumeClaimInterface
+	// tlsSecret is the TLS secret of the builder created, generated with
+	// tlsGenerate or else given
+	tlsSecret   *corev1.Secret
+	tlsGenerate bool
+	// tlsConfig is what clientTLS read from the builder, once tlsLoaded
+	tlsMu     sync.Mutex
+	tlsLoaded bool
+	tlsConfig *tls.Config
+	// configUpdated is set once the config of an existing builder changed
+	configUpdated bool
+	// userSpecifiedResources is set if the requests, limits or priority
+	// class were given, they are rolled out to an existing builder
+	userSpecifiedResources bool
+	// transportName is the transport of the builder, read with its TLS config
+	transportName string
+	// adminService is the admin service of the builder created, if enabled
+	adminService *corev1.Service
+	// securityProfile is the security profile option, a builder of the auto
+	// profile is restricted if its namespace requires it, once detected
+	securityProfile         string
+	securityProfileDetected bool
+	// runtimeNodes are the hostnames of the nodes of each runtime, once the
+	// runtimes of a builder of the auto runtime are detected on the nodes
+	// its options, kept for the detection, let it run on
+	runtimeNodes       map[string][]string
+	runtimesDetected   bool
+	runtimeDeployments []*appsv1.Deployment
+	deploymentOpt      *manifest.DeploymentOpt
+	// transportAuto is set for a builder of the auto transport, created with
+	// the port-forward transport if its creator may not exec in its pods
+	transportAuto     bool
+	transportDetected bool
+	// transportAccessAllowed are the transports the user may connect with,
+	// once reviewed, see transportAccess
+	transportAccessMu       sync.Mutex
+	transportAccessReviewed bool
+	transportAccessAllowed  map[string]bool
 }
 
 func (d *Driver) Bootstrap(ctx context.Context, l progress.Logger) error {
@@ -104,27 +175,90 @@ func isChildOf(objectMeta metav1.ObjectMeta, parentUID string) bool {
 
 // Idempotently create and wait for the builder to start up
 func (d *Driver) wait(ctx context.Context, sub progress.SubLogger) error {
+	if err := d.detectSecurityProfile(ctx, sub); err != nil {
+		return err
+	}
+	if err := d.detectRuntimes(ctx, sub); err != nil {
+		return err
+	}
+	if err := d.detectTransport(ctx, sub); err != nil {
+		return err
+	}
 	// Create the config map first
 	err := d.createConfigMap(ctx, sub)
 	if err != nil {
 		return err
 	}
 
+	if d.egressProxy != nil {
+		if err := d.createEgressProxy(ctx); err != nil {
+			return err
+		}
+	}
+	if d.sharedCache != nil {
+		if err := d.createSharedCache(ctx); err != nil {
+			return err
+		}
+	}
+	if d.networkPolicy != nil {
+		if err := d.createNetworkPolicy(ctx); err != nil {
+			return err
+		}
+	}
+	if d.cacheClaim != nil && d.deploymentKind != DeploymentKindStatefulSet {
+		if err := d.createCacheClaim(ctx); err != nil {
+			return err
+		}
+	}
+
+	if d.tlsSecret != nil {
+		if err := d.createTLSSecret(ctx); err != nil {
+			return err
+		}
+	}
+	if d.adminService != nil {
+		if err := d.createAdminService(ctx); err != nil {
+			return err
+		}
+	}
+	if d.configUpdated {
+		if err := d.rolloutConfig(ctx, sub); err != nil {
+			return err
+		}
+	}
+	if d.userSpecifiedResources {
+		if err := d.rolloutResources(ctx, sub); err != nil {
+			return err
+		}
+	}
+
+	// The replica classes start alongside, builds only wait for the builder's own pods
+	if err := d.createReplicaClasses(ctx); err != nil {
+		return err
+	}
+	if err := d.createRuntimeDeployments(ctx); err != nil {
+		return err
+	}
+
 	// Now try to converge to a running builder
 	return d.createBuilder(ctx, sub, d.userSpecifiedRuntime)
 }
 
 func (d *Driver) Info(ctx context.Context) (*driver.Info, error) {
-	depl, err := d.deploymentClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
 	if err != nil {
-		// TODO: return err if err != ErrNotFound
-		return &driver.Info{
-			Status: driver.Inactive,
-		}, nil
+		if kubeerrors.IsNotFound(err) {
+			return &driver.Info{
+				Status: driver.Inactive,
+			}, nil
+		}
+		// An unreachable or forbidden builder isn't one to create
+		return nil, errors.Wrapf(err, "failed to get builder %s", d.deployment.Name)
 	}
 	if depl.Status.ReadyReplicas <= 0 {
 		return &driver.Info{
-			Status: driver.Stopped,
+			Status:          driver.Stopped,
+			FallbackBuilder: depl.ObjectMeta.Annotations[manifest.FallbackBuilderAnnotation],
 		}, nil
 	}
 	pods, err := podchooser.ListRunningPods(ctx, d.podClient, depl)
@@ -132,17 +266,99 @@ func (d *Driver) Info(ctx context.Context) (*driver.Info, error) {
 		return nil, err
 	}
 	var dynNodes []store.Node
+	nodePlatforms := map[string][]specs.Platform{}
 	for _, p := range pods {
+		platforms, ok := nodePlatforms[p.Spec.NodeName]
+		if !ok {
+			platforms = d.nodePlatforms(ctx, p.Spec.NodeName)
+			nodePlatforms[p.Spec.NodeName] = platforms
+		}
 		node := store.Node{
 			Name: p.Name,
-			// Other fields are unset (TODO: detect real platforms)
+			// The native platform of the node, emulated platforms are not listed
+			Platforms: platforms,
 		}
 		dynNodes = append(dynNodes, node)
 	}
-	return &driver.Info{
+	var notify []string
+	if v := depl.ObjectMeta.Annotations[manifest.NotifyAnnotation]; v != "" {
+		if err := json.Unmarshal([]byte(v), &notify); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s annotation", manifest.NotifyAnnotation)
+		}
+	}
+	info := &driver.Info{
 		Status:       driver.Running,
 		DynamicNodes: dynNodes,
-	}, nil
+		Notify:       notify,
+		EgressProxy:  depl.ObjectMeta.Annotations[manifest.EgressProxyAnnotation],
+		PackageProxy: depl.ObjectMeta.Annotations[manifest.PackageProxyAnnotation],
+		SharedCache:  depl.ObjectMeta.Annotations[manifest.SharedCacheAnnotation],
+		HTTPProxy:    depl.ObjectMeta.Annotations[manifest.HTTPProxyAnnotation],
+		HTTPSProxy:   depl.ObjectMeta.Annotations[manifest.HTTPSProxyAnnotation],
+		NoProxy:      depl.ObjectMeta.Annotations[manifest.NoProxyAnnotation],
+
+		DefaultPlatform: depl.ObjectMeta.Annotations[manifest.DefaultPlatformAnnotation],
+		RunCacheScope:   depl.ObjectMeta.Annotations[manifest.RunCacheAnnotation],
+		RunCacheImage:   depl.Spec.Template.Spec.Containers[0].Image,
+		ScratchSize:     depl.ObjectMeta.Annotations[manifest.ScratchSizeAnnotation],
+		FallbackBuilder: depl.ObjectMeta.Annotations[manifest.FallbackBuilderAnnotation],
+		ReadOnlyRootFS:  depl.ObjectMeta.Annotations[manifest.ReadOnlyRootFSAnnotation] == "true",
+	}
+	if info.RunCacheScope != "" {
+		info.RunCacheDir = manifest.RunCacheMountPath
+	}
+	if v := depl.ObjectMeta.Annotations[manifest.HostPathsAnnotation]; v != "" {
+		info.HostPaths = strings.Split(v, ",")
+		info.HostPathDir = manifest.HostPathMountPath
+	}
+	if v := depl.ObjectMeta.Annotations[manifest.OutputClaimsAnnotation]; v != "" {
+		info.OutputClaims = strings.Split(v, ",")
+		info.OutputClaimDir = manifest.OutputClaimMountPath
+	}
+	if v := depl.ObjectMeta.Annotations[manifest.EmulationAnnotation]; v != "" {
+		info.Emulation = strings.Split(v, ",")
+	}
+	info.HistoryMaxRecords, _ = strconv.Atoi(depl.ObjectMeta.Annotations[manifest.HistoryMaxRecordsAnnotation])
+	info.HistoryMaxAge, _ = time.ParseDuration(depl.ObjectMeta.Annotations[manifest.HistoryMaxAgeAnnotation])
+	info.GCThreshold, _ = strconv.Atoi(depl.ObjectMeta.Annotations[manifest.GCThresholdAnnotation])
+	info.GCKeepStorage, _ = strconv.ParseInt(depl.ObjectMeta.Annotations[manifest.GCKeepStorageAnnotation], 10, 64)
+	info.BuildIOLimits, _ = driver.ParseIOLimits(depl.ObjectMeta.Annotations[manifest.BuildIOLimitsAnnotation])
+	if v, ok := depl.ObjectMeta.Annotations[manifest.AllowedEntitlementsAnnotation]; ok {
+		info.AllowedEntitlements = []string{}
+		if v != "" {
+			info.AllowedEntitlements = strings.Split(v, ",")
+		}
+	}
+	info.Runtime = depl.Spec.Template.ObjectMeta.Labels["runtime"]
+	if info.MaxParallelBuilds, _ = strconv.Atoi(depl.ObjectMeta.Annotations[manifest.MaxParallelBuildsAnnotation]); info.MaxParallelBuilds > 0 {
+		if scaling := parseQueueScaling(depl); scaling != nil {
+			info.MaxParallelBuilds = scaling.capacity(depl)
+		}
+		leases, slots, err := d.queueSlots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		info.RunningBuilds, info.QueuedBuilds = queueLength(leases, slots, time.Now())
+	}
+	return info, nil
+}
+
+func (d *Driver) ExportConfig(ctx context.Context) (*driver.BuilderConfig, error) {
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get builder %s", d.deployment.Name)
+	}
+	v, ok := depl.ObjectMeta.Annotations[manifest.CreateOptionsAnnotation]
+	if !ok {
+		return nil, errors.Errorf("builder %s was created by an older version which didn't record its options, recreate it to export it", depl.Name)
+	}
+	cfg := &driver.BuilderConfig{}
+	if err := json.Unmarshal([]byte(v), cfg); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", manifest.CreateOptionsAnnotation)
+	}
+	cfg.Name = depl.Name
+	cfg.Driver = DriverName
+	return cfg, nil
 }
 
 func (d *Driver) Stop(ctx context.Context, force bool) error {
@@ -151,39 +367,130 @@ func (d *Driver) Stop(ctx context.Context, force bool) error {
 }
 
 func (d *Driver) Rm(ctx context.Context, force bool) error {
-	if err := d.deploymentClient.Delete(ctx, d.deployment.Name, metav1.DeleteOptions{}); err != nil {
+	if err := d.rmReplicaClasses(ctx); err != nil {
+		return err
+	}
+	if err := d.rmRuntimeDeployments(ctx); err != nil {
+		return err
+	}
+	if err := d.rmLoaderPods(ctx); err != nil {
+		return err
+	}
+	// The claim, TLS secret and admin service are only known from the
+	// builder as created
+	var cacheClaim, tlsSecret, adminService string
+	if depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{}); err == nil {
+		cacheClaim = depl.ObjectMeta.Annotations[manifest.CacheClaimAnnotation]
+		tlsSecret = depl.ObjectMeta.Annotations[manifest.TLSSecretAnnotation]
+		adminService = depl.ObjectMeta.Annotations[manifest.AdminServiceAnnotation]
+	}
+	if err := d.builderClient.Delete(ctx, d.deployment.Name, metav1.DeleteOptions{}); err != nil {
 		return errors.Wrapf(err, "error while calling deploymentClient.Delete for %q", d.deployment.Name)
 	}
+	if cacheClaim != "" {
+		if err := d.rmCacheClaims(ctx, cacheClaim); err != nil {
+			return err
+		}
+	}
+	if tlsSecret != "" {
+		if err := d.rmTLSSecret(ctx, tlsSecret); err != nil {
+			return err
+		}
+	}
+	if adminService != "" {
+		if err := d.serviceClient.Delete(ctx, adminService, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error while calling serviceClient.Delete for %q", adminService)
+		}
+	}
 	// TODO - consider checking for our expected labels and preserve pre-existing ConfigMaps
 	if err := d.configMapClient.Delete(ctx, d.configMap.Name, metav1.DeleteOptions{}); err != nil {
 		return errors.Wrapf(err, "error while calling configMapClient.Delete for %q", d.configMap.Name)
 	}
+	// The builder may have been created without a network policy
+	if err := d.networkPolicyClient.Delete(ctx, d.deployment.Name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error while calling networkPolicyClient.Delete for %q", d.deployment.Name)
+	}
+	if err := d.rmSharedCache(ctx); err != nil {
+		return err
+	}
+	return d.rmEgressProxy(ctx)
+}
+
+// rmCacheClaims deletes the cache claim of the builder, and those of each of
+// its pods for a StatefulSet
+func (d *Driver) rmCacheClaims(ctx context.Context, cacheClaim string) error {
+	if err := d.claimClient.Delete(ctx, cacheClaim, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error while calling persistentVolumeClaimClient.Delete for %q", cacheClaim)
+	}
+	claims, err := d.claimClient.List(ctx, metav1.ListOptions{LabelSelector: manifest.CacheClaimLabel + "=" + d.deployment.Name})
+	if err != nil {
+		return errors.Wrapf(err, "error while listing the cache claims of %q", d.deployment.Name)
+	}
+	for _, claim := range claims.Items {
+		if err := d.claimClient.Delete(ctx, claim.Name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error while calling persistentVolumeClaimClient.Delete for %q", claim.Name)
+		}
+	}
 	return nil
 }
 
+// nodePlatforms returns the platform of the node from its labels, none if
+// the node can't be read
+func (d *Driver) nodePlatforms(ctx context.Context, name string) []specs.Platform {
+	if d.nodeClient == nil || name == "" {
+		return nil
+	}
+	node, err := d.nodeClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		// Reading nodes needs a cluster role the user may not have
+		logrus.Debugf("failed to get node %s: %s", name, err)
+		return nil
+	}
+	arch := node.Labels[corev1.LabelArchStable]
+	if arch == "" {
+		return nil
+	}
+	nodeOS := node.Labels[corev1.LabelOSStable]
+	if nodeOS == "" {
+		nodeOS = "linux"
+	}
+	return []specs.Platform{{OS: nodeOS, Architecture: arch}}
+}
+
 func (d *Driver) Clients(ctx context.Context) (*driver.BuilderClients, error) {
-	restClient := d.clientset.CoreV1().RESTClient()
-	restClientConfig, err := d.KubeClientConfig.ClientConfig()
+	transports, err := d.transports(ctx)
 	if err != nil {
 		return nil, err
 	}
-	pod, otherPods, err := d.podChooser.ChoosePod(ctx)
+	if err := podchooser.WaitForReadyPod(ctx, d.podClient, d.deployment, d.replicaClass, driver.WaitOptions(ctx).ReadyTimeout); err != nil {
+		return nil, err
+	}
+	pod, otherPods, err := d.podChooser.ChoosePod(ctx, driver.Platforms(ctx))
 	if err != nil {
 		return nil, err
 	}
+	if preferred := driver.PreferredNode(ctx); preferred != "" {
+		pod, otherPods = preferPod(pod, otherPods, preferred)
+	}
+	if excluded := driver.ExcludedNodes(ctx); len(excluded) > 0 {
+		if pod, otherPods, err = excludePods(pod, otherPods, excluded); err != nil {
+			return nil, err
+		}
+	}
 	if len(pod.Spec.Containers) == 0 {
 		return nil, errors.Errorf("pod %s does not have any container", pod.Name)
 	}
-	chosenNode, err := buildNodeClient(ctx, pod, restClient, restClientConfig)
+	chosenNode, err := buildNodeClient(ctx, pod, d.ipFamily, transports)
 	if err != nil {
 		return nil, err
 	}
+	d.recordPodUse(ctx, pod, otherPods)
 	res := &driver.BuilderClients{
 		ChosenNode: *chosenNode,
 		OtherNodes: []driver.NodeClient{},
 	}
 	for _, pod := range otherPods {
-		otherNode, err := buildNodeClient(ctx, pod, restClient, restClientConfig)
+		otherNode, err := buildNodeClient(ctx, pod, d.ipFamily, transports)
 		// TODO - consider allowing partial failure if a node is down but others are available...
 		if err != nil {
 			return nil, err
@@ -193,15 +500,124 @@ func (d *Driver) Clients(ctx context.Context) (*driver.BuilderClients, error) {
 	return res, err
 }
 
-func buildNodeClient(ctx context.Context, pod *corev1.Pod, restClient rest.Interface, restClientConfig *rest.Config) (*driver.NodeClient, error) {
-	containerName := pod.Spec.Containers[0].Name
-	cmd := []string{"buildctl", "dial-stdio"}
+func (d *Driver) NodeClients(ctx context.Context) ([]driver.NodeClient, error) {
+	transports, err := d.transports(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := podchooser.ListRunningPods(ctx, d.podClient, d.deployment)
+	if err != nil {
+		return nil, err
+	}
+	var res []driver.NodeClient
+	for _, pod := range pods {
+		if len(pod.Spec.Containers) == 0 {
+			continue
+		}
+		node, err := buildNodeClient(ctx, pod, d.ipFamily, transports)
+		if err != nil {
+			for _, n := range res {
+				n.BuildKitClient.Close()
+			}
+			return nil, err
+		}
+		res = append(res, *node)
+	}
+	return res, nil
+}
+
+// preferPod chooses the pod named preferred if it is one of the other pods,
+// the chosen pod becoming one of them
+func preferPod(pod *corev1.Pod, otherPods []*corev1.Pod, preferred string) (*corev1.Pod, []*corev1.Pod) {
+	for i, p := range otherPods {
+		if p.Name == preferred {
+			others := append(otherPods[:i:i], otherPods[i+1:]...)
+			return p, append([]*corev1.Pod{pod}, others...)
+		}
+	}
+	return pod, otherPods
+}
+
+// excludePods fails the chosen pod over to the first of the other pods if
+// it is excluded, and drops the excluded pods from the other pods
+func excludePods(pod *corev1.Pod, otherPods []*corev1.Pod, excluded []string) (*corev1.Pod, []*corev1.Pod, error) {
+	isExcluded := func(p *corev1.Pod) bool {
+		for _, name := range excluded {
+			if p.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	var chosen *corev1.Pod
+	if !isExcluded(pod) {
+		chosen = pod
+	}
+	var others []*corev1.Pod
+	for _, p := range otherPods {
+		switch {
+		case isExcluded(p):
+		case chosen == nil:
+			chosen = p
+		default:
+			others = append(others, p)
+		}
+	}
+	if chosen == nil {
+		return nil, nil, driver.ErrNoFailoverNode
+	}
+	return chosen, others, nil
+}
+
+// podLoad estimates the builds in flight on pod by its cache records in use,
+// buildkit v0.9 has no API listing the solves.  A build holds more than one
+// record while it runs and none while it waits for its sources, so the count
+// only orders the pods roughly.
+func (d *Driver) podLoad(ctx context.Context, pod *corev1.Pod) (int, error) {
+	transports, err := d.transports(ctx)
+	if err != nil {
+		return 0, err
+	}
+	node, err := buildNodeClient(ctx, pod, d.ipFamily, transports)
+	if err != nil {
+		return 0, err
+	}
+	defer node.BuildKitClient.Close()
+	du, err := node.BuildKitClient.DiskUsage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	load := 0
+	for _, u := range du {
+		if u.InUse {
+			load++
+		}
+	}
+	return load, nil
+}
+
+// podAddress returns the pod IP of the requested family on dual-stack
+// clusters, falling back to the primary pod IP
+func podAddress(pod *corev1.Pod, family string) string {
+	if family == manifest.IPFamilyIPv4 || family == manifest.IPFamilyIPv6 {
+		for _, ip := range pod.Status.PodIPs {
+			parsed := net.ParseIP(ip.IP)
+			if parsed != nil && (parsed.To4() != nil) == (family == manifest.IPFamilyIPv4) {
+				return ip.IP
+			}
+		}
+	}
+	return pod.Status.PodIP
+}
+
+// buildNodeClient connects to buildkitd on the pod with the first of
+// transports that can
+func buildNodeClient(ctx context.Context, pod *corev1.Pod, ipFamily string, transports []Transport) (*driver.NodeClient, error) {
 	nodeClient := &driver.NodeClient{
 		NodeName:    pod.Name,
-		ClusterAddr: pod.Status.PodIP,
+		ClusterAddr: podAddress(pod, ipFamily),
 	}
-	conn, err := execconn.ExecConn(restClient, restClientConfig,
-		pod.Namespace, pod.Name, containerName, cmd)
+	conn, err := dialBuildkitd(ctx, pod, transports)
 	if err != nil {
 		return nil, err
 	}
@@ -237,33 +653,42 @@ func (d *Driver) RuntimeSockProxy(ctx context.Context, name string) (net.Conn, e
 		return nil, err
 	}
 
-	for _, pod := range pods {
+	var pod *corev1.Pod
+	for _, p := range pods {
 		// TODO - this should really be node name based not pod name based
-		if pod.Name != name {
-			continue
+		if p.Name == name {
+			pod = p
+			break
 		}
-
-		if len(pod.Spec.Containers) == 0 {
-			return nil, errors.Errorf("pod %s does not have any container", pod.Name)
-		}
-		containerName := pod.Spec.Containers[0].Name
-
-		runtime := pod.ObjectMeta.Labels["runtime"]
-		var sockPath string
-		switch runtime {
-		case "containerd":
-			sockPath = "unix://" + DefaultContainerdSockPath
-		case "docker":
-			sockPath = "unix://" + DefaultDockerSockPath
-		default:
-			return nil, fmt.Errorf("unexpected runtime label (%v) on pod (%s)", runtime, pod.Name)
+	}
+	if pod == nil {
+		// Not one of the builder pods, a loader pod of a build loading the
+		// image on more nodes
+		if pod = d.loaderPod(ctx, name); pod == nil {
+			return nil, fmt.Errorf("no available builder pods for %s", name)
 		}
-		cmd := []string{"buildctl", "--addr", sockPath, "dial-stdio"}
-		return execconn.ExecConn(restClient, restClientConfig,
-			pod.Namespace, pod.Name, containerName, cmd)
 	}
 
-	return nil, fmt.Errorf("no available builder pods for %s", name)
+	if len(pod.Spec.Containers) == 0 {
+		return nil, errors.Errorf("pod %s does not have any container", pod.Name)
+	}
+	containerName := manifest.BuilderContainer(pod)
+
+	runtime := pod.ObjectMeta.Labels["runtime"]
+	var sockPath string
+	switch runtime {
+	case "containerd":
+		sockPath = "unix://" + DefaultContainerdSockPath
+	case "docker":
+		sockPath = "unix://" + DefaultDockerSockPath
+	case manifest.RuntimeCRIO:
+		return nil, errors.Errorf("pod %s runs on a CRI-O node, images can't be loaded into CRI-O", pod.Name)
+	default:
+		return nil, fmt.Errorf("unexpected runtime label (%v) on pod (%s)", runtime, pod.Name)
+	}
+	cmd := []string{"buildctl", "--addr", sockPath, "dial-stdio"}
+	return execconn.ExecConn(restClient, restClientConfig,
+		pod.Namespace, pod.Name, containerName, cmd)
 
 }
 
@@ -273,14 +698,14 @@ func (d *Driver) GetVersion(ctx context.Context) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	pod, _, err := d.podChooser.ChoosePod(ctx)
+	pod, _, err := d.podChooser.ChoosePod(ctx, nil)
 	if err != nil {
 		return "", err
 	}
 	if len(pod.Spec.Containers) == 0 {
 		return "", errors.Errorf("pod %s does not have any container", pod.Name)
 	}
-	containerName := pod.Spec.Containers[0].Name
+	containerName := manifest.BuilderContainer(pod)
 	cmd := []string{"buildkitd", "--version"}
 	buf := &bytes.Buffer{}
 
@@ -316,9 +741,54 @@ func (d *Driver) GetVersion(ctx context.Context) (string, error) {
 	return strings.TrimSpace(buf.String()), err
 }
 
+func (d *Driver) Exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	restClient := d.clientset.CoreV1().RESTClient()
+	restClientConfig, err := d.KubeClientConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+	pods, err := podchooser.ListRunningPods(ctx, d.podClient, d.deployment)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Name != name {
+			continue
+		}
+		if len(pod.Spec.Containers) == 0 {
+			return errors.Errorf("pod %s does not have any container", pod.Name)
+		}
+		req := restClient.
+			Post().
+			Namespace(pod.Namespace).
+			Resource("pods").
+			Name(pod.Name).
+			SubResource("exec").
+			VersionedParams(&corev1.PodExecOptions{
+				Container: manifest.BuilderContainer(pod),
+				Command:   cmd,
+				Stdin:     stdin != nil,
+				Stdout:    stdout != nil,
+				Stderr:    stderr != nil,
+				TTY:       false,
+			}, scheme.ParameterCodec)
+		exec, err := remotecommand.NewSPDYExecutor(restClientConfig, "POST", req.URL())
+		if err != nil {
+			return err
+		}
+		return exec.Stream(remotecommand.StreamOptions{
+			Stdin:  stdin,
+			Stdout: stdout,
+			Stderr: stderr,
+			Tty:    false,
+		})
+	}
+	return errors.Errorf("no available builder pods for %s", name)
+}
+
 func (d *Driver) List(ctx context.Context) ([]driver.Builder, error) {
 	var builders []driver.Builder
-	depls, err := d.deploymentClient.List(ctx, metav1.ListOptions{})
+	depls, err := d.builderClient.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to lookup builder deployments")
 	}
@@ -327,30 +797,59 @@ func (d *Driver) List(ctx context.Context) ([]driver.Builder, error) {
 		if _, found := depl.ObjectMeta.Annotations[manifest.AnnotationKey]; !found {
 			continue
 		}
+		// The pods of replica classes and runtime deployments are listed with their builder
+		if _, found := depl.ObjectMeta.Labels[manifest.ReplicaClassLabel]; found {
+			continue
+		}
+		if _, found := depl.ObjectMeta.Labels[manifest.RuntimeDeploymentLabel]; found {
+			continue
+		}
 		builder := driver.Builder{
-			Name:   depl.ObjectMeta.Name,
-			Driver: DriverName,
+			Name:      depl.ObjectMeta.Name,
+			Driver:    DriverName,
+			Namespace: depl.ObjectMeta.Namespace,
+			Rootless:  isRootless(depl.ObjectMeta.Labels["rootless"]),
 		}
-		pods, err := podchooser.ListRunningPods(ctx, d.podClient, &depl)
+		pods, err := podchooser.ListPods(ctx, d.podClient, &depl)
 		if err != nil {
 			return nil, err
 		}
 		for _, p := range pods {
 			node := driver.Node{
-				// TODO this isn't ideal - Need a good way to translate between pod name and node hostname
-				//Name:   p.Spec.NodeName,
-				//Name:   p.Status.HostIP,
-				Name:   p.Name,
-				Status: p.Status.Message, // TODO - this seems to be blank, need to look at kubectl CLI magic...
+				Name:    p.Name,
+				Status:  podStatus(p),
+				Host:    p.Spec.NodeName,
+				Runtime: p.ObjectMeta.Labels["runtime"],
 				// Other fields are unset (TODO: detect real platforms)
 			}
-			builder.Nodes = append(builder.Nodes, node)
+			if p.Status.Phase == corev1.PodRunning {
+				builder.Nodes = append(builder.Nodes, node)
+			} else {
+				builder.Pending = append(builder.Pending, node)
+			}
 		}
 		builders = append(builders, builder)
 	}
 	return builders, nil
 }
 
+// podStatus is the phase of the pod, with the reason it isn't scheduled if
+// it can't be
+func podStatus(p *corev1.Pod) string {
+	if p.DeletionTimestamp != nil {
+		return "Terminating"
+	}
+	if isDrained(p) {
+		return string(p.Status.Phase) + " (Drained)"
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse && c.Reason != "" {
+			return string(p.Status.Phase) + " (" + c.Reason + ")"
+		}
+	}
+	return string(p.Status.Phase)
+}
+
 func (d *Driver) Factory() driver.Factory {
 	return d.factory
 }
@@ -375,8 +874,21 @@ func (d *Driver) Features() map[driver.Feature]bool {
 	// Query the pod to figure out the runtime
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	pod, _, err := d.podChooser.ChoosePod(ctx)
-	if err == nil && len(pod.Spec.Containers) > 0 && !isRootless(pod.ObjectMeta.Labels["rootless"]) {
+	pod, _, err := d.podChooser.ChoosePod(ctx, nil)
+	if err != nil || len(pod.Spec.Containers) == 0 {
+		return res
+	}
+	pods := []*corev1.Pod{pod}
+	if pod.ObjectMeta.Labels["runtime"] == manifest.RuntimeCRIO {
+		// Images are loaded on the nodes of the other runtimes of the builder
+		if running, err := podchooser.ListRunningPods(ctx, d.podClient, d.deployment); err == nil {
+			pods = running
+		}
+	}
+	for _, pod := range pods {
+		if isRootless(pod.ObjectMeta.Labels["rootless"]) {
+			continue
+		}
 		switch pod.ObjectMeta.Labels["runtime"] {
 		case "containerd":
 			res[driver.ContainerdExporter] = true
@@ -390,12 +902,5 @@ func (d *Driver) Features() map[driver.Feature]bool {
 }
 
 func (d *Driver) GetAuthWrapper(secretName string) imagetools.Auth {
-	if secretName == "" {
-		secretName = buildxNameToDeploymentName(d.InitConfig.Name)
-	}
-
-	return &authProvider{
-		driver: d,
-		name:   secretName,
-	}
+	return d.newAuthProvider(secretName)
 }
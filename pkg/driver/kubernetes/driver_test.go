@@ -0,0 +1,44 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	appsv1 "k8s.io/api/apps/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// getErrWorkloads is a builder client whose Get fails with err
+type getErrWorkloads struct {
+	workloadClient
+	err error
+}
+
+func (w getErrWorkloads) Get(ctx context.Context, name string, opts metav1.GetOptions) (*appsv1.Deployment, error) {
+	return nil, w.err
+}
+
+func Test_InfoGetError(t *testing.T) {
+	t.Parallel()
+	resource := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	d := &Driver{deployment: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "buildkit"}}}
+
+	d.builderClient = getErrWorkloads{err: kubeerrors.NewNotFound(resource, "buildkit")}
+	info, err := d.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, driver.Inactive, info.Status)
+
+	d.builderClient = getErrWorkloads{err: kubeerrors.NewForbidden(resource, "buildkit", nil)}
+	_, err = d.Info(context.Background())
+	require.Error(t, err)
+	assert.True(t, kubeerrors.IsForbidden(errors.Cause(err)))
+	assert.Contains(t, err.Error(), "failed to get builder buildkit")
+}
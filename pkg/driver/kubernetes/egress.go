@@ -0,0 +1,110 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// egressProxy holds the objects enforcing the builder's egress allowlist
+type egressProxy struct {
+	name          string
+	configMap     *corev1.ConfigMap
+	deployment    *appsv1.Deployment
+	service       *corev1.Service
+	networkPolicy *networkingv1.NetworkPolicy
+}
+
+func newEgressProxy(opt *manifest.DeploymentOpt) (*egressProxy, error) {
+	cm, depl, svc, err := manifest.NewEgressProxy(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &egressProxy{
+		name:          manifest.EgressProxyName(opt),
+		configMap:     cm,
+		deployment:    depl,
+		service:       svc,
+		networkPolicy: manifest.NewEgressProxyNetworkPolicy(opt),
+	}, nil
+}
+
+// Create or update the egress proxy, so a changed allowlist takes effect
+// when the builder is recreated
+func (d *Driver) createEgressProxy(ctx context.Context) error {
+	p := d.egressProxy
+	wrap := func(err error, kind string) error {
+		return errors.Wrapf(err, "failed to create egress proxy %s %q", kind, p.name)
+	}
+
+	err := retryOnConflict(ctx, "configmap", p.name, func() error {
+		existingCM, err := d.configMapClient.Get(ctx, p.name, metav1.GetOptions{})
+		if err != nil && kubeerrors.IsNotFound(err) {
+			p.configMap.ResourceVersion = ""
+			_, err = d.configMapClient.Create(ctx, p.configMap, metav1.CreateOptions{})
+		} else if err == nil {
+			p.configMap.ResourceVersion = existingCM.ResourceVersion
+			_, err = d.configMapClient.Update(ctx, p.configMap, metav1.UpdateOptions{})
+		}
+		return err
+	})
+	if err != nil {
+		return wrap(err, "configmap")
+	}
+
+	existingDepl, err := d.deploymentClient.Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.deploymentClient.Create(ctx, p.deployment, metav1.CreateOptions{})
+	} else if err == nil {
+		p.deployment.ResourceVersion = existingDepl.ResourceVersion
+		_, err = d.deploymentClient.Update(ctx, p.deployment, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return wrap(err, "deployment")
+	}
+
+	// The service spec is mostly immutable (clusterIP) so it's only created
+	_, err = d.serviceClient.Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.serviceClient.Create(ctx, p.service, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return wrap(err, "service")
+	}
+
+	existingNP, err := d.networkPolicyClient.Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.networkPolicyClient.Create(ctx, p.networkPolicy, metav1.CreateOptions{})
+	} else if err == nil {
+		p.networkPolicy.ResourceVersion = existingNP.ResourceVersion
+		_, err = d.networkPolicyClient.Update(ctx, p.networkPolicy, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return wrap(err, "network policy")
+	}
+	return nil
+}
+
+// rmEgressProxy removes the egress proxy, the builder may have been created without one
+func (d *Driver) rmEgressProxy(ctx context.Context) error {
+	name := manifest.EgressProxyName(&manifest.DeploymentOpt{Name: d.deployment.Name})
+	for kind, del := range map[string]func() error{
+		"deployment":     func() error { return d.deploymentClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+		"service":        func() error { return d.serviceClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+		"configmap":      func() error { return d.configMapClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+		"network policy": func() error { return d.networkPolicyClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+	} {
+		if err := del(); err != nil && !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete egress proxy %s %q", kind, name)
+		}
+	}
+	return nil
+}
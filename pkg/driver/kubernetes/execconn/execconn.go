@@ -53,7 +53,10 @@ func ExecConn(restClient rest.Interface, restConfig *rest.Config, namespace, pod
 		})
 		if serr != nil {
 			logrus.Error(serr)
+			stdoutW.CloseWithError(serr)
+			return
 		}
+		stdoutW.Close()
 	}()
 	return kc, nil
 }
@@ -0,0 +1,147 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package execconn
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// portForwardProtocol is the port forwarding protocol of the API server, as
+// spoken by kubectl port-forward
+const portForwardProtocol = "portforward.k8s.io"
+
+// PortForwardConn connects to port on the loopback address of the pod
+// through the API server, like kubectl port-forward but without a listener
+func PortForwardConn(restClient rest.Interface, restConfig *rest.Config, namespace, pod string, port int) (net.Conn, error) {
+	req := restClient.
+		Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(pod).
+		SubResource("portforward")
+	transport, upgrader, err := spdy.RoundTripperFor(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
+	streamConn, protocol, err := dialer.Dial(portForwardProtocol)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to forward port %d of pod %s", port, pod)
+	}
+	if protocol != portForwardProtocol {
+		streamConn.Close()
+		return nil, errors.Errorf("failed to forward port %d of pod %s: unsupported protocol %q", port, pod, protocol)
+	}
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(port))
+	headers.Set(corev1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		streamConn.Close()
+		return nil, errors.Wrapf(err, "failed to forward port %d of pod %s", port, pod)
+	}
+	// Nothing is written to the error stream
+	errorStream.Close()
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		streamConn.Close()
+		return nil, errors.Wrapf(err, "failed to forward port %d of pod %s", port, pod)
+	}
+
+	c := &portForwardConn{
+		conn:       streamConn,
+		stream:     dataStream,
+		localAddr:  dummyAddr{network: "dummy", s: "dummy-0"},
+		remoteAddr: dummyAddr{network: pod, s: pod + ":" + strconv.Itoa(port)},
+	}
+	go func() {
+		// The API server reports there why the port can't be reached, eg. as
+		// nothing listens on it, and closes the data stream
+		message, err := ioutil.ReadAll(errorStream)
+		if err == nil && len(message) > 0 {
+			c.setErr(errors.Errorf("failed to forward port %d of pod %s: %s", port, pod, strings.TrimSpace(string(message))))
+		}
+	}()
+	return c, nil
+}
+
+type portForwardConn struct {
+	conn       httpstream.Connection
+	stream     httpstream.Stream
+	errMu      sync.Mutex
+	err        error
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *portForwardConn) setErr(err error) {
+	c.errMu.Lock()
+	c.err = err
+	c.errMu.Unlock()
+}
+
+// forwardErr returns the error of the API server instead of err if any
+func (c *portForwardConn) forwardErr(err error) error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+func (c *portForwardConn) Read(p []byte) (int, error) {
+	n, err := c.stream.Read(p)
+	if err != nil {
+		err = c.forwardErr(err)
+	}
+	return n, err
+}
+
+func (c *portForwardConn) Write(p []byte) (int, error) {
+	n, err := c.stream.Write(p)
+	if err != nil {
+		err = c.forwardErr(err)
+	}
+	return n, err
+}
+
+func (c *portForwardConn) CloseWrite() error {
+	return c.stream.Close()
+}
+
+func (c *portForwardConn) Close() error {
+	c.conn.RemoveStreams(c.stream)
+	return c.conn.Close()
+}
+
+func (c *portForwardConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+func (c *portForwardConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+func (c *portForwardConn) SetDeadline(t time.Time) error {
+	return nil
+}
+func (c *portForwardConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (c *portForwardConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -5,17 +5,24 @@ package kubernetes
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/pkg/errors"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/podchooser"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/platformutil"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/version"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp" // register GCP auth provider
 )
@@ -82,23 +89,58 @@ func (f *factory) New(ctx context.Context, cfg driver.InitConfig) (driver.Driver
 	}
 
 	d.deploymentClient = clientset.AppsV1().Deployments(d.namespace)
+	d.builderClient = &builderWorkloads{
+		deployments:  d.deploymentClient,
+		daemonSets:   clientset.AppsV1().DaemonSets(d.namespace),
+		statefulSets: clientset.AppsV1().StatefulSets(d.namespace),
+		kind:         d.deploymentKind,
+		cacheClaim:   d.cacheClaim,
+	}
 	d.replicaSetClient = clientset.AppsV1().ReplicaSets(d.namespace)
 	d.podClient = clientset.CoreV1().Pods(d.namespace)
 	d.eventClient = clientset.CoreV1().Events(d.namespace)
 	d.configMapClient = clientset.CoreV1().ConfigMaps(d.namespace)
 	d.secretClient = clientset.CoreV1().Secrets(d.namespace)
+	d.leaseClient = clientset.CoordinationV1().Leases(d.namespace)
+	d.networkPolicyClient = clientset.NetworkingV1().NetworkPolicies(d.namespace)
+	d.serviceClient = clientset.CoreV1().Services(d.namespace)
+	d.nodeClient = clientset.CoreV1().Nodes()
+	d.claimClient = clientset.CoreV1().PersistentVolumeClaims(d.namespace)
 
 	switch d.loadbalance {
 	case LoadbalanceSticky:
 		d.podChooser = &podchooser.StickyPodChooser{
-			Key:        cfg.ContextPathHash,
-			PodClient:  d.podClient,
-			Deployment: d.deployment,
+			Key:          cfg.ContextPathHash,
+			PodClient:    d.podClient,
+			NodeClient:   d.nodeClient,
+			Deployment:   d.deployment,
+			ReplicaClass: d.replicaClass,
 		}
 	case LoadbalanceRandom:
 		d.podChooser = &podchooser.RandomPodChooser{
-			PodClient:  d.podClient,
-			Deployment: d.deployment,
+			PodClient:    d.podClient,
+			NodeClient:   d.nodeClient,
+			Deployment:   d.deployment,
+			ReplicaClass: d.replicaClass,
+		}
+	case LoadbalanceLeastLoaded:
+		d.podChooser = &podchooser.LeastLoadedPodChooser{
+			PodClient:    d.podClient,
+			NodeClient:   d.nodeClient,
+			Deployment:   d.deployment,
+			ReplicaClass: d.replicaClass,
+			Load:         d.podLoad,
+		}
+	}
+	if len(d.preferNodes) > 0 || d.localNode != "" {
+		d.podChooser = &podchooser.NodePodChooser{
+			PodClient:    d.podClient,
+			NodeClient:   d.nodeClient,
+			Deployment:   d.deployment,
+			ReplicaClass: d.replicaClass,
+			Nodes:        d.preferNodes,
+			LocalNode:    d.localNode,
+			Fallback:     d.podChooser,
 		}
 	}
 
@@ -120,9 +162,16 @@ func (d *Driver) initDriverFromConfig() error {
 		ContainerdNamespace:    DefaultContainerdNamespace,
 		DockerSockHostPath:     DefaultDockerSockPath,
 		Environments:           make(map[string]string),
+
+		MeshExcludeOutboundPorts: manifest.DefaultMeshExcludeOutboundPorts,
 	}
 
+	// Unless another transport is given
+	d.transportAuto = true
 	imageOverride := ""
+	patchFile := ""
+	tlsEnabled := false
+	tlsSecret := ""
 	var err error
 	for k, v := range cfg.DriverOpts {
 		switch k {
@@ -147,6 +196,7 @@ func (d *Driver) initDriverFromConfig() error {
 			switch v {
 			case LoadbalanceSticky:
 			case LoadbalanceRandom:
+			case LoadbalanceLeastLoaded:
 			default:
 				return errors.Errorf("invalid loadbalance %q", v)
 			}
@@ -174,12 +224,391 @@ func (d *Driver) initDriverFromConfig() error {
 				d.userSpecifiedRuntime = true
 			case "containerd":
 				d.userSpecifiedRuntime = true
+			case manifest.RuntimeCRIO:
+				d.userSpecifiedRuntime = true
 			default:
 				return errors.Errorf("invalid runtime %q", v)
 			}
 			deploymentOpt.ContainerRuntime = v
 		case "custom-config":
 			deploymentOpt.CustomConfig = v
+		case "max-parallelism":
+			deploymentOpt.MaxParallelism, err = strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			if deploymentOpt.MaxParallelism < 0 {
+				return errors.Errorf("invalid max-parallelism %d", deploymentOpt.MaxParallelism)
+			}
+		case "max-parallel-builds":
+			deploymentOpt.MaxParallelBuilds, err = strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			if deploymentOpt.MaxParallelBuilds < 0 {
+				return errors.Errorf("invalid max-parallel-builds %d", deploymentOpt.MaxParallelBuilds)
+			}
+		case "preemption-priority":
+			deploymentOpt.PreemptionPriority, err = strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			if deploymentOpt.PreemptionPriority < 0 {
+				return errors.Errorf("invalid preemption-priority %d", deploymentOpt.PreemptionPriority)
+			}
+		case "notify":
+			if v != "" {
+				if err := json.Unmarshal([]byte(v), &deploymentOpt.Notify); err != nil {
+					return errors.Wrap(err, "invalid notify, expected a JSON list of sinks")
+				}
+			}
+		case "network-policy":
+			deploymentOpt.NetworkPolicy, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "network-policy-egress":
+			if v != "" {
+				deploymentOpt.NetworkPolicyEgress = strings.Split(v, ",")
+			}
+		case "egress-allow":
+			if v != "" {
+				deploymentOpt.EgressAllow = strings.Split(v, ",")
+			}
+		case "egress-proxy-image":
+			deploymentOpt.EgressProxyImage = v
+		case "package-proxy":
+			deploymentOpt.PackageProxy, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "package-proxy-image":
+			deploymentOpt.PackageProxyImage = v
+		case "package-proxy-size":
+			deploymentOpt.PackageProxySize = v
+		case "http-proxy", "https-proxy":
+			if v != "" {
+				if _, err := manifest.ParseProxyURL(v); err != nil {
+					return err
+				}
+			}
+			if k == "http-proxy" {
+				deploymentOpt.HTTPProxy = v
+			} else {
+				deploymentOpt.HTTPSProxy = v
+			}
+		case "no-proxy":
+			deploymentOpt.NoProxy = v
+		case "security-profile":
+			switch v {
+			case "", manifest.SecurityProfileAuto, manifest.SecurityProfileDefault, manifest.SecurityProfileRestricted:
+			default:
+				return errors.Errorf("invalid security-profile %q, use %s, %s or %s", v, manifest.SecurityProfileAuto, manifest.SecurityProfileDefault, manifest.SecurityProfileRestricted)
+			}
+			deploymentOpt.SecurityProfile = v
+		case "seccomp-profile":
+			deploymentOpt.SeccompProfile = v
+		case "shared-cache":
+			deploymentOpt.SharedCache, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "shared-cache-image":
+			deploymentOpt.SharedCacheImage = v
+		case "shared-cache-size":
+			if v != "" {
+				if _, err := resource.ParseQuantity(v); err != nil {
+					return errors.Errorf("invalid shared-cache-size %q, use a quantity like 50Gi", v)
+				}
+			}
+			deploymentOpt.SharedCacheSize = v
+		case "mesh-compatible":
+			deploymentOpt.MeshCompatible, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "mesh-exclude-outbound-ports":
+			deploymentOpt.MeshExcludeOutboundPorts = nil
+			for _, p := range strings.Split(v, ",") {
+				if p == "" {
+					continue
+				}
+				port, err := strconv.Atoi(p)
+				if err != nil || port <= 0 || port > 65535 {
+					return errors.Errorf("invalid mesh-exclude-outbound-ports port %q", p)
+				}
+				deploymentOpt.MeshExcludeOutboundPorts = append(deploymentOpt.MeshExcludeOutboundPorts, port)
+			}
+		case "default-platform":
+			if v != "" {
+				pp, err := platformutil.Parse([]string{v})
+				if err != nil {
+					return err
+				}
+				if len(pp) != 1 {
+					return errors.Errorf("default-platform must be a single platform")
+				}
+				deploymentOpt.DefaultPlatform = platforms.Format(pp[0])
+			}
+		case "ip-family":
+			if _, _, err := manifest.IPFamilies(v); err != nil {
+				return err
+			}
+			deploymentOpt.IPFamily = v
+			d.ipFamily = v
+		case "run-cache-claim":
+			deploymentOpt.RunCacheClaim = v
+		case "run-cache-scope":
+			switch v {
+			case "", manifest.RunCacheScopeID, manifest.RunCacheScopeProject:
+			default:
+				return errors.Errorf("invalid run-cache-scope %q, use %s or %s", v, manifest.RunCacheScopeID, manifest.RunCacheScopeProject)
+			}
+			deploymentOpt.RunCacheScope = v
+		case "patch":
+			patchFile = v
+		case "scale-on-queue":
+			deploymentOpt.ScaleOnQueue, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "replicas-min":
+			deploymentOpt.ReplicasMin, err = strconv.Atoi(v)
+			if err != nil || deploymentOpt.ReplicasMin < 0 {
+				return errors.Errorf("invalid replicas-min %q", v)
+			}
+		case "replicas-max":
+			deploymentOpt.ReplicasMax, err = strconv.Atoi(v)
+			if err != nil || deploymentOpt.ReplicasMax < 0 {
+				return errors.Errorf("invalid replicas-max %q", v)
+			}
+		case "scale-down-idle":
+			if v != "" {
+				deploymentOpt.ScaleDownIdle, err = time.ParseDuration(v)
+				if err != nil || deploymentOpt.ScaleDownIdle < 0 {
+					return errors.Errorf("invalid scale-down-idle duration %q", v)
+				}
+			}
+		case "allow-host-paths":
+			for _, p := range strings.Split(v, ",") {
+				if p == "" {
+					continue
+				}
+				if !path.IsAbs(p) || path.Clean(p) == "/" {
+					return errors.Errorf("invalid host path %q, use an absolute path other than /", p)
+				}
+				if strings.ContainsAny(p, ",:;|&$`'\"\\<>(){}*?[] \t\n") {
+					return errors.Errorf("invalid host path %q, paths can't contain shell or list separators", p)
+				}
+				deploymentOpt.AllowHostPaths = append(deploymentOpt.AllowHostPaths, path.Clean(p))
+			}
+		case "replica-classes":
+			for _, spec := range strings.Split(v, ";") {
+				if spec == "" {
+					continue
+				}
+				c, err := manifest.ParseReplicaClass(spec)
+				if err != nil {
+					return err
+				}
+				deploymentOpt.ReplicaClasses = append(deploymentOpt.ReplicaClasses, c)
+			}
+		case "fallback-builder":
+			deploymentOpt.FallbackBuilder = v
+		case "history-max-records":
+			if v != "" {
+				deploymentOpt.HistoryMaxRecords, err = strconv.Atoi(v)
+				if err != nil || deploymentOpt.HistoryMaxRecords < 0 {
+					return errors.Errorf("invalid history-max-records %q", v)
+				}
+			}
+		case "history-max-age":
+			if v != "" {
+				deploymentOpt.HistoryMaxAge, err = time.ParseDuration(v)
+				if err != nil || deploymentOpt.HistoryMaxAge < 0 {
+					return errors.Errorf("invalid history-max-age duration %q", v)
+				}
+			}
+		case "gc-threshold":
+			if v != "" {
+				deploymentOpt.GCThreshold, err = strconv.Atoi(v)
+				if err != nil || deploymentOpt.GCThreshold < 0 || deploymentOpt.GCThreshold > 100 {
+					return errors.Errorf("invalid gc-threshold %q, use a percentage of the disk", v)
+				}
+			}
+		case "gc-keep-storage":
+			if v != "" {
+				q, err := resource.ParseQuantity(v)
+				if err != nil || q.Sign() < 0 {
+					return errors.Errorf("invalid gc-keep-storage %q", v)
+				}
+				deploymentOpt.GCKeepStorage = q.Value()
+			}
+		case "build-io-limits":
+			limits, err := driver.ParseIOLimits(v)
+			if err != nil {
+				return errors.Wrap(err, "invalid build-io-limits")
+			}
+			deploymentOpt.BuildIOLimits = limits.String()
+		case "binfmt-image":
+			deploymentOpt.BinfmtImage = v
+		case "binfmt-platforms":
+			deploymentOpt.BinfmtPlatforms = nil
+			for _, p := range strings.Split(v, ",") {
+				if p != "" {
+					deploymentOpt.BinfmtPlatforms = append(deploymentOpt.BinfmtPlatforms, p)
+				}
+			}
+		case "tls":
+			tlsEnabled, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "tls-secret":
+			tlsSecret = v
+		case "admin-service":
+			deploymentOpt.AdminService, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "metrics-port":
+			if v != "" {
+				deploymentOpt.MetricsPort, err = strconv.Atoi(v)
+				if err != nil || deploymentOpt.MetricsPort < 0 || deploymentOpt.MetricsPort > 65535 || deploymentOpt.MetricsPort == manifest.TLSPort {
+					return errors.Errorf("invalid metrics-port %q, use a port other than %d", v, manifest.TLSPort)
+				}
+			}
+		case "transport":
+			switch v {
+			case "", manifest.TransportAuto:
+				d.transportAuto = true
+			case manifest.TransportExec, manifest.TransportPortForward, manifest.TransportTCP:
+				d.transportAuto = false
+				deploymentOpt.Transport = v
+			default:
+				return errors.Errorf("invalid transport %q, use %s, %s, %s or %s", v, manifest.TransportAuto, manifest.TransportExec, manifest.TransportPortForward, manifest.TransportTCP)
+			}
+		case "node-selector":
+			for _, l := range strings.Split(v, ",") {
+				if l == "" {
+					continue
+				}
+				key, value, err := manifest.ParseNodeSelector(l)
+				if err != nil {
+					return err
+				}
+				if deploymentOpt.NodeSelector == nil {
+					deploymentOpt.NodeSelector = map[string]string{}
+				}
+				deploymentOpt.NodeSelector[key] = value
+			}
+		case "tolerations":
+			for _, t := range strings.Split(v, ",") {
+				if t == "" {
+					continue
+				}
+				toleration, err := manifest.ParseToleration(t)
+				if err != nil {
+					return err
+				}
+				deploymentOpt.Tolerations = append(deploymentOpt.Tolerations, toleration)
+			}
+		case "requests":
+			if deploymentOpt.Requests, err = manifest.ParseResourceList(v); err != nil {
+				return err
+			}
+			d.userSpecifiedResources = d.userSpecifiedResources || len(deploymentOpt.Requests) > 0
+		case "limits":
+			if deploymentOpt.Limits, err = manifest.ParseResourceList(v); err != nil {
+				return err
+			}
+			d.userSpecifiedResources = d.userSpecifiedResources || len(deploymentOpt.Limits) > 0
+		case "priority-class":
+			deploymentOpt.PriorityClassName = v
+			d.userSpecifiedResources = d.userSpecifiedResources || v != ""
+		case "affinity":
+			if v != "" {
+				if deploymentOpt.Affinity, err = manifest.ParseAffinity([]byte(v)); err != nil {
+					return err
+				}
+			}
+		case "read-only-root-fs":
+			deploymentOpt.ReadOnlyRootFS, err = strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+		case "writable-paths":
+			for _, p := range strings.Split(v, ",") {
+				if p == "" {
+					continue
+				}
+				if !path.IsAbs(p) || path.Clean(p) == "/" {
+					return errors.Errorf("invalid writable path %q, use an absolute path other than /", p)
+				}
+				deploymentOpt.WritablePaths = append(deploymentOpt.WritablePaths, path.Clean(p))
+			}
+		case "replica-class":
+			d.replicaClass = v
+		case "deployment-kind":
+			switch v {
+			case "", DeploymentKindDeployment, DeploymentKindDaemonSet, DeploymentKindStatefulSet:
+			default:
+				return errors.Errorf("invalid deployment-kind %q, use %s, %s or %s", v, DeploymentKindDeployment, DeploymentKindDaemonSet, DeploymentKindStatefulSet)
+			}
+			d.deploymentKind = v
+		case "prefer-nodes":
+			d.preferNodes = nil
+			for _, n := range strings.Split(v, ",") {
+				if n != "" {
+					d.preferNodes = append(d.preferNodes, n)
+				}
+			}
+		case "local-node":
+			d.localNode = v
+		case "output-claims":
+			for _, c := range strings.Split(v, ",") {
+				if c != "" {
+					deploymentOpt.OutputClaims = append(deploymentOpt.OutputClaims, c)
+				}
+			}
+		case "scratch-size":
+			if v != "" {
+				if _, err := resource.ParseQuantity(v); err != nil {
+					return errors.Errorf("invalid scratch-size %q, use a quantity like 100Gi", v)
+				}
+			}
+			deploymentOpt.ScratchSize = v
+		case "scratch-storage-class":
+			deploymentOpt.ScratchStorageClass = v
+		case "cache-storage":
+			switch v {
+			case "", "none":
+				deploymentOpt.CacheStorage = ""
+			case manifest.CacheStoragePVC:
+				deploymentOpt.CacheStorage = v
+			default:
+				return errors.Errorf("invalid cache-storage %q, use %s or none", v, manifest.CacheStoragePVC)
+			}
+		case "cache-size":
+			if v != "" {
+				if _, err := resource.ParseQuantity(v); err != nil {
+					return errors.Errorf("invalid cache-size %q, use a quantity like 50Gi", v)
+				}
+			}
+			deploymentOpt.CacheSize = v
+		case "storage-class":
+			deploymentOpt.CacheStorageClass = v
+		case "allow-insecure-entitlements":
+			for _, e := range strings.Split(v, ",") {
+				switch e {
+				case "":
+					continue
+				case "network.host", "security.insecure":
+				default:
+					return errors.Errorf("invalid entitlement %q", e)
+				}
+				deploymentOpt.AllowInsecureEntitlements = append(deploymentOpt.AllowInsecureEntitlements, e)
+			}
 		case "env":
 			// Split over comma for multiple key/value
 			for _, item := range strings.Split(v, ";") {
@@ -197,6 +626,25 @@ func (d *Driver) initDriverFromConfig() error {
 		deploymentOpt.ContainerRuntime = DefaultContainerRuntime
 	}
 
+	d.securityProfile = deploymentOpt.SecurityProfile
+	if deploymentOpt.SecurityProfile == manifest.SecurityProfileRestricted {
+		// The restricted standard only admits non-root pods, which can't
+		// write to their root filesystem, nor use the containerd socket
+		if !deploymentOpt.Rootless {
+			deploymentOpt.Rootless = true
+			deploymentOpt.Image = version.DefaultRootlessImage
+		}
+		if deploymentOpt.Worker == "auto" {
+			deploymentOpt.Worker = WorkerRunc
+		}
+		deploymentOpt.ReadOnlyRootFS = true
+		if err := manifest.CheckRestricted(deploymentOpt); err != nil {
+			return err
+		}
+	} else if deploymentOpt.SeccompProfile != "" {
+		return errors.Errorf("seccomp-profile requires security-profile %s", manifest.SecurityProfileRestricted)
+	}
+
 	// Wire up defaults based on the chosen runtime
 	if deploymentOpt.ContainerRuntime == "containerd" && deploymentOpt.Worker == "auto" {
 		deploymentOpt.Worker = WorkerContainerd
@@ -206,11 +654,103 @@ func (d *Driver) initDriverFromConfig() error {
 		// into the stable engine packaging.  In the future, we may want to default to containerd
 		deploymentOpt.Worker = WorkerRunc
 	}
+	if deploymentOpt.ContainerRuntime == manifest.RuntimeCRIO {
+		// CRI-O has no containerd for the worker to store its images in
+		switch deploymentOpt.Worker {
+		case "", "auto":
+			deploymentOpt.Worker = WorkerRunc
+		case WorkerContainerd:
+			return errors.Errorf("containerd worker needs the containerd runtime, the %s nodes use the 'runc' worker", manifest.RuntimeCRIO)
+		}
+	}
 
 	// Sanity check settings for incompatibilities
 	if deploymentOpt.Rootless && deploymentOpt.Worker == WorkerContainerd {
 		return fmt.Errorf("containerd worker does not support rootless mode - use 'runc' worker")
 	}
+	if deploymentOpt.Rootless && deploymentOpt.BuildIOLimits != "" {
+		// The builds are limited by cgroups the CLI creates on the pods
+		return errors.Errorf("build-io-limits requires a builder created without --rootless")
+	}
+	if deploymentOpt.ScratchSize != "" && deploymentOpt.Worker == WorkerContainerd {
+		// The snapshots of the containerd worker live in the node's containerd
+		return fmt.Errorf("scratch volumes are not supported with the containerd worker - use 'runc' worker")
+	}
+	if deploymentOpt.CacheStorage == manifest.CacheStoragePVC {
+		// The claim holds the state of a single buildkitd, each pod of a
+		// StatefulSet has its own
+		switch {
+		case deploymentOpt.Worker == WorkerContainerd:
+			return fmt.Errorf("cache storage is not supported with the containerd worker - use 'runc' worker")
+		case deploymentOpt.ScratchSize != "":
+			return errors.Errorf("cache-storage=%s and scratch-size can't be used together, size the cache with cache-size", manifest.CacheStoragePVC)
+		case d.deploymentKind == DeploymentKindDaemonSet:
+			return errors.Errorf("cache-storage=%s can't be used with deployment-kind %s", manifest.CacheStoragePVC, DeploymentKindDaemonSet)
+		case deploymentOpt.Replicas > 1 && d.deploymentKind != DeploymentKindStatefulSet:
+			return errors.Errorf("cache-storage=%s requires a single builder replica, or deployment-kind %s", manifest.CacheStoragePVC, DeploymentKindStatefulSet)
+		case len(deploymentOpt.ReplicaClasses) > 0:
+			return errors.Errorf("cache-storage=%s can't be used with replica-classes", manifest.CacheStoragePVC)
+		}
+		d.cacheClaim, err = manifest.NewCacheClaim(deploymentOpt)
+		if err != nil {
+			return err
+		}
+	} else if deploymentOpt.CacheSize != "" || (deploymentOpt.CacheStorageClass != "" && !deploymentOpt.SharedCache) {
+		return errors.Errorf("cache-size and storage-class require cache-storage=%s", manifest.CacheStoragePVC)
+	}
+	if deploymentOpt.ReadOnlyRootFS {
+		if err := manifest.CheckReadOnlyRootFS(deploymentOpt); err != nil {
+			return err
+		}
+	} else if len(deploymentOpt.WritablePaths) > 0 {
+		return errors.Errorf("writable-paths requires read-only-root-fs")
+	}
+
+	if len(deploymentOpt.BinfmtPlatforms) > 0 && deploymentOpt.BinfmtImage == "" {
+		// There is no default image, the public one isn't reachable from disconnected clusters
+		return errors.Errorf("binfmt-platforms requires binfmt-image, the image of the emulators to install")
+	}
+
+	if err := checkQueueScaling(deploymentOpt); err != nil {
+		return err
+	}
+
+	if tlsEnabled || tlsSecret != "" {
+		// The certificates are generated unless an existing secret is given
+		d.tlsGenerate = tlsSecret == ""
+		if d.tlsGenerate {
+			tlsSecret = manifest.TLSSecretName(deploymentName)
+		}
+		deploymentOpt.TLSSecret = tlsSecret
+		d.tlsSecret = manifest.NewTLSSecret(deploymentOpt, nil)
+	}
+	if deploymentOpt.Transport != "" && deploymentOpt.Transport != manifest.TransportExec && deploymentOpt.TLSSecret == "" {
+		// Without TLS buildkitd only serves the unix socket in the pod
+		return errors.Errorf("transport %s needs tls", deploymentOpt.Transport)
+	}
+	if deploymentOpt.AdminService {
+		if deploymentOpt.TLSSecret == "" {
+			// The admin clients are only authenticated by their certificate
+			return errors.Errorf("admin-service needs tls")
+		}
+		if d.adminService, err = manifest.NewAdminService(deploymentOpt); err != nil {
+			return err
+		}
+	}
+
+	if d.deploymentKind == DeploymentKindDaemonSet {
+		// A DaemonSet runs one pod per node, they can't be scaled independently
+		switch {
+		case deploymentOpt.Replicas > 1:
+			return errors.Errorf("replicas can't be set with deployment-kind %s, it runs a builder pod on every node", DeploymentKindDaemonSet)
+		case len(deploymentOpt.ReplicaClasses) > 0:
+			return errors.Errorf("replica-classes can't be used with deployment-kind %s", DeploymentKindDaemonSet)
+		case deploymentOpt.ScaleDownIdle > 0:
+			return errors.Errorf("scale-down-idle can't be used with deployment-kind %s", DeploymentKindDaemonSet)
+		case deploymentOpt.ScaleOnQueue:
+			return errors.Errorf("scale-on-queue can't be used with deployment-kind %s", DeploymentKindDaemonSet)
+		}
+	}
 
 	// TODO consider warning that in rootless mode you can't auto-load the images into the runtime (push or local only)
 
@@ -221,8 +761,59 @@ func (d *Driver) initDriverFromConfig() error {
 	if err != nil {
 		return err
 	}
+	var patch []byte
+	if patchFile != "" {
+		patch, err = ioutil.ReadFile(patchFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read patch")
+		}
+		if d.deployment, err = manifest.PatchDeployment(d.deployment, patch); err != nil {
+			return errors.Wrapf(err, "failed to patch builder with %s", patchFile)
+		}
+	}
+	for _, c := range deploymentOpt.ReplicaClasses {
+		d.replicaClasses = append(d.replicaClasses, manifest.NewReplicaClassDeployment(d.deployment, c))
+	}
+	d.deploymentOpt = deploymentOpt
+	if err := d.initRuntimeDeployments(patch); err != nil {
+		return err
+	}
 	d.minReplicas = deploymentOpt.Replicas
+	if len(deploymentOpt.EgressAllow) > 0 && (deploymentOpt.HTTPProxy != "" || deploymentOpt.HTTPSProxy != "") {
+		return errors.Errorf("http-proxy and https-proxy can't be combined with egress-allow, the builds go through the egress proxy")
+	} else if deploymentOpt.NoProxy != "" && deploymentOpt.HTTPProxy == "" && deploymentOpt.HTTPSProxy == "" {
+		return errors.Errorf("no-proxy requires http-proxy or https-proxy")
+	}
+	if len(deploymentOpt.EgressAllow) > 0 {
+		// The allowlist is only enforced if the builder can't bypass the proxy
+		deploymentOpt.NetworkPolicy = true
+		d.egressProxy, err = newEgressProxy(deploymentOpt)
+		if err != nil {
+			return err
+		}
+	} else if deploymentOpt.EgressProxyImage != "" {
+		return errors.Errorf("egress-proxy-image requires egress-allow")
+	}
+	if !deploymentOpt.PackageProxy && (deploymentOpt.PackageProxyImage != "" || deploymentOpt.PackageProxySize != "") {
+		return errors.Errorf("package-proxy-image and package-proxy-size require package-proxy")
+	}
+	if deploymentOpt.SharedCache {
+		if d.sharedCache, err = newSharedCache(deploymentOpt); err != nil {
+			return err
+		}
+	} else if deploymentOpt.SharedCacheImage != "" || deploymentOpt.SharedCacheSize != "" {
+		return errors.Errorf("shared-cache-image and shared-cache-size require shared-cache")
+	}
+	if deploymentOpt.NetworkPolicy {
+		d.networkPolicy, err = manifest.NewNetworkPolicy(deploymentOpt)
+		if err != nil {
+			return err
+		}
+	} else if len(deploymentOpt.NetworkPolicyEgress) > 0 {
+		return errors.Errorf("network-policy-egress requires network-policy")
+	}
 
+	exported := driver.BuilderConfig{BuildkitFlags: cfg.BuildkitFlags}
 	if cfg.ConfigFile == "" {
 		// TODO might want to do substitution after parsing with the buildkitd.LoadFile instead of template...
 		tmpl, err := template.New("config").Parse(DefaultConfigFileTemplate)
@@ -234,8 +825,14 @@ func (d *Driver) initDriverFromConfig() error {
 		if err != nil {
 			return err
 		}
+		if deploymentOpt.SharedCache {
+			buf.WriteString(manifest.SharedCacheConfig(deploymentOpt))
+		}
 		d.configMap = manifest.NewConfigMap(deploymentOpt, buf.Bytes())
 	} else {
+		if deploymentOpt.MaxParallelism > 0 {
+			return errors.Errorf("max-parallelism can not be combined with a custom config file, set max-parallelism in the config file instead")
+		}
 		data, err := ioutil.ReadFile(cfg.ConfigFile)
 		if err != nil {
 			return fmt.Errorf("failed to load config file: %w", err)
@@ -243,9 +840,44 @@ func (d *Driver) initDriverFromConfig() error {
 		// TODO - parse the config file with buildkit/cmd/buildkitd.LoadFile(path)
 		//        and make sure things get wired up properly, and/or error out if the
 		//        user tries to set properties that should be in the config file
+		if deploymentOpt.SharedCache && !bytes.Contains(data, []byte(manifest.SharedCacheHost(deploymentOpt))) {
+			// buildkitd reaches the shared cache over plain HTTP
+			data = append(append(append([]byte{}, data...), '\n'), manifest.SharedCacheConfig(deploymentOpt)...)
+		}
+		if bytes.Contains(data, []byte("insecure-entitlements")) {
+			// The config file allows entitlements of its own
+			for _, depl := range append(append([]*appsv1.Deployment{d.deployment}, d.replicaClasses...), d.runtimeDeployments...) {
+				delete(depl.ObjectMeta.Annotations, manifest.AllowedEntitlementsAnnotation)
+			}
+		}
 		d.configMap = manifest.NewConfigMap(deploymentOpt, data)
 		d.userSpecifiedConfig = true
+		exported.BuildkitdConfig = string(data)
+	}
+	for _, depl := range append(append([]*appsv1.Deployment{d.deployment}, d.replicaClasses...), d.runtimeDeployments...) {
+		manifest.SetConfigDigest(depl, d.configMap.BinaryData[manifest.ConfigFileName])
+	}
+	return recordCreateOptions(d.deployment, exported, cfg.DriverOpts, patch)
+}
+
+// recordCreateOptions annotates the deployment with the options it's created
+// with, file options are recorded by content so they can be exported
+func recordCreateOptions(depl *appsv1.Deployment, exported driver.BuilderConfig, driverOpts map[string]string, patch []byte) error {
+	exported.DriverOpts = make(map[string]string, len(driverOpts))
+	for k, v := range driverOpts {
+		if k != "patch" {
+			exported.DriverOpts[k] = v
+		}
+	}
+	exported.Patch = string(patch)
+	dt, err := json.Marshal(exported)
+	if err != nil {
+		return err
+	}
+	if depl.Annotations == nil {
+		depl.Annotations = map[string]string{}
 	}
+	depl.Annotations[manifest.CreateOptionsAnnotation] = string(dt)
 	return nil
 }
 
@@ -4,10 +4,19 @@ package kubernetes
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/require"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func Test_GetDefaultFactory(t *testing.T) {
@@ -17,3 +26,463 @@ func Test_GetDefaultFactory(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, factory)
 }
+
+func Test_initDriverFromConfig(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name: "test",
+			DriverOpts: map[string]string{
+				"max-parallelism": "4",
+			},
+		},
+	}
+	err := d.initDriverFromConfig()
+	require.NoError(t, err)
+	require.Contains(t, string(d.configMap.BinaryData["buildkitd.toml"]), "max-parallelism = 4")
+
+	d.InitConfig.DriverOpts["max-parallelism"] = "-1"
+	err = d.initDriverFromConfig()
+	require.Error(t, err)
+}
+
+func Test_initDriverFromConfigDaemonSet(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name: "test",
+			DriverOpts: map[string]string{
+				"deployment-kind": "daemonset",
+				"rootless":        "true",
+				"worker":          "runc",
+			},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, DeploymentKindDaemonSet, d.deploymentKind)
+
+	d.InitConfig.DriverOpts["replicas"] = "3"
+	require.Error(t, d.initDriverFromConfig())
+
+	d.InitConfig.DriverOpts["replicas"] = "1"
+	d.InitConfig.DriverOpts["deployment-kind"] = "job"
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigCacheStorage(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name: "test",
+			DriverOpts: map[string]string{
+				"cache-storage": "pvc",
+				"cache-size":    "50Gi",
+				"worker":        "runc",
+			},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "test-cache", d.cacheClaim.Name)
+	require.Equal(t, "50Gi", d.cacheClaim.Spec.Resources.Requests.Storage().String())
+
+	d.InitConfig.DriverOpts["replicas"] = "2"
+	require.Error(t, d.initDriverFromConfig(), "the claim holds the state of a single pod")
+
+	d.InitConfig.DriverOpts["deployment-kind"] = "statefulset"
+	require.NoError(t, d.initDriverFromConfig(), "each pod has its own claim")
+	d.InitConfig.DriverOpts["deployment-kind"] = "daemonset"
+	d.InitConfig.DriverOpts["replicas"] = "1"
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts["deployment-kind"] = "deployment"
+
+	d.InitConfig.DriverOpts["replicas"] = "1"
+	d.InitConfig.DriverOpts["cache-storage"] = "none"
+	require.Error(t, d.initDriverFromConfig(), "cache-size without a claim")
+}
+
+func Test_podAddress(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{Status: corev1.PodStatus{
+		PodIP:  "10.1.2.3",
+		PodIPs: []corev1.PodIP{{IP: "10.1.2.3"}, {IP: "fd00::1:2:3"}},
+	}}
+	require.Equal(t, "10.1.2.3", podAddress(pod, ""))
+	require.Equal(t, "10.1.2.3", podAddress(pod, "ipv4"))
+	require.Equal(t, "fd00::1:2:3", podAddress(pod, "ipv6"))
+}
+
+func Test_excludePods(t *testing.T) {
+	t.Parallel()
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	a, b, c := pod("a"), pod("b"), pod("c")
+	chosen, others, err := excludePods(a, []*corev1.Pod{b, c}, []string{"a"})
+	require.NoError(t, err)
+	require.Equal(t, "b", chosen.Name)
+	require.Equal(t, []*corev1.Pod{c}, others)
+
+	chosen, others, err = excludePods(a, []*corev1.Pod{b, c}, []string{"b"})
+	require.NoError(t, err)
+	require.Equal(t, "a", chosen.Name)
+	require.Equal(t, []*corev1.Pod{c}, others)
+
+	_, _, err = excludePods(a, []*corev1.Pod{b}, []string{"a", "b"})
+	require.Equal(t, driver.ErrNoFailoverNode, err)
+}
+
+func Test_preferPod(t *testing.T) {
+	t.Parallel()
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	a, b, c := pod("a"), pod("b"), pod("c")
+	chosen, others := preferPod(a, []*corev1.Pod{b, c}, "c")
+	require.Equal(t, "c", chosen.Name)
+	require.Equal(t, []*corev1.Pod{a, b}, others)
+
+	chosen, others = preferPod(a, []*corev1.Pod{b, c}, "a")
+	require.Equal(t, "a", chosen.Name)
+	require.Equal(t, []*corev1.Pod{b, c}, others)
+
+	// Not running anymore
+	chosen, others = preferPod(a, []*corev1.Pod{b, c}, "d")
+	require.Equal(t, "a", chosen.Name)
+	require.Equal(t, []*corev1.Pod{b, c}, others)
+}
+
+func Test_initDriverFromConfigRecordsOptions(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "patch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	patch := filepath.Join(dir, "patch.yaml")
+	require.NoError(t, ioutil.WriteFile(patch, []byte("spec:\n  replicas: 3\n"), 0600))
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:          "test",
+			BuildkitFlags: []string{"--debug"},
+			DriverOpts: map[string]string{
+				"replicas": "2",
+				"patch":    patch,
+			},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	cfg := driver.BuilderConfig{}
+	require.NoError(t, json.Unmarshal([]byte(d.deployment.Annotations[manifest.CreateOptionsAnnotation]), &cfg))
+	require.Equal(t, []string{"--debug"}, cfg.BuildkitFlags)
+	require.Equal(t, map[string]string{"replicas": "2"}, cfg.DriverOpts)
+	require.Equal(t, "spec:\n  replicas: 3\n", cfg.Patch)
+	require.Empty(t, cfg.BuildkitdConfig)
+}
+
+func Test_initDriverFromConfigBinfmt(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name: "test",
+			DriverOpts: map[string]string{
+				"binfmt-platforms": "arm64,riscv64",
+			},
+		},
+	}
+	require.Error(t, d.initDriverFromConfig(), "no default image")
+
+	d.InitConfig.DriverOpts["binfmt-image"] = "registry.internal/binfmt:latest"
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "arm64,riscv64", d.deployment.Annotations[manifest.EmulationAnnotation])
+	require.Equal(t, "registry.internal/binfmt:latest", d.deployment.Spec.Template.Spec.InitContainers[0].Image)
+}
+
+func Test_initDriverFromConfigTLS(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"tls": "true"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.True(t, d.tlsGenerate)
+	require.Equal(t, "test-tls", d.tlsSecret.Name)
+	require.Equal(t, "test-tls", d.deployment.Annotations[manifest.TLSSecretAnnotation])
+
+	d.InitConfig.DriverOpts = map[string]string{"tls-secret": "buildkit-certs"}
+	require.NoError(t, d.initDriverFromConfig())
+	require.False(t, d.tlsGenerate)
+	require.Equal(t, "buildkit-certs", d.tlsSecret.Name)
+}
+
+func Test_initDriverFromConfigDigest(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "buildkitd-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "buildkitd.toml")
+	contents := []byte("[registry.\"docker.io\"]\n  mirrors = [\"mirror.registry.internal\"]\n")
+	require.NoError(t, ioutil.WriteFile(config, contents, 0600))
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			ConfigFile: config,
+			DriverOpts: map[string]string{"replica-classes": "name=large,replicas=1,cpu=8"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.True(t, d.userSpecifiedConfig)
+	require.Equal(t, contents, d.configMap.BinaryData[manifest.ConfigFileName])
+	expected := digest.FromBytes(contents).String()
+	require.Equal(t, expected, d.deployment.Spec.Template.Annotations[manifest.ConfigDigestAnnotation])
+	require.Len(t, d.replicaClasses, 1)
+	require.Equal(t, expected, d.replicaClasses[0].Spec.Template.Annotations[manifest.ConfigDigestAnnotation])
+}
+
+func Test_initDriverFromConfigScheduling(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name: "test",
+			DriverOpts: map[string]string{
+				"node-selector":   "pool=build,disktype=ssd",
+				"tolerations":     "dedicated=build:NoSchedule,gpu",
+				"affinity":        `{"nodeAffinity":{"preferredDuringSchedulingIgnoredDuringExecution":[{"weight":1,"preference":{"matchExpressions":[{"key":"zone","operator":"In","values":["a"]}]}}]}}`,
+				"replica-classes": "name=large,replicas=1,cpu=8",
+			},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	for _, depl := range []*appsv1.Deployment{d.deployment, d.replicaClasses[0]} {
+		spec := depl.Spec.Template.Spec
+		require.Equal(t, map[string]string{"pool": "build", "disktype": "ssd"}, spec.NodeSelector)
+		require.Len(t, spec.Tolerations, 2)
+		require.Equal(t, corev1.TolerationOpExists, spec.Tolerations[1].Operator)
+		require.NotNil(t, spec.Affinity.NodeAffinity)
+	}
+
+	d.InitConfig.DriverOpts = map[string]string{"tolerations": "dedicated:Sometimes"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigResources(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"requests": "cpu=2,memory=4Gi", "limits": "", "priority-class": ""},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.True(t, d.userSpecifiedResources)
+	require.Equal(t, "4Gi", d.deployment.Spec.Template.Spec.Containers[0].Resources.Requests.Memory().String())
+
+	// Builds don't reset the resources of the builder they use
+	d = &Driver{InitConfig: driver.InitConfig{Name: "test", DriverOpts: map[string]string{}}}
+	require.NoError(t, d.initDriverFromConfig())
+	require.False(t, d.userSpecifiedResources)
+
+	d.InitConfig.DriverOpts = map[string]string{"limits": "memory=8"}
+	require.NoError(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"limits": "disk=8Gi"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigGC(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"gc-threshold": "85", "gc-keep-storage": "10Gi"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "85", d.deployment.ObjectMeta.Annotations[manifest.GCThresholdAnnotation])
+	require.Equal(t, "10737418240", d.deployment.ObjectMeta.Annotations[manifest.GCKeepStorageAnnotation])
+
+	d.InitConfig.DriverOpts = map[string]string{"gc-threshold": "0", "gc-keep-storage": "10Gi"}
+	require.NoError(t, d.initDriverFromConfig())
+	require.NotContains(t, d.deployment.ObjectMeta.Annotations, manifest.GCThresholdAnnotation)
+
+	d.InitConfig.DriverOpts = map[string]string{"gc-threshold": "101"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"gc-keep-storage": "lots"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigBuildIOLimits(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"build-io-limits": "write-bps=50Mi,read-iops=1000"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "read-iops=1000,write-bps=52428800", d.deployment.ObjectMeta.Annotations[manifest.BuildIOLimitsAnnotation])
+
+	d.InitConfig.DriverOpts = map[string]string{"build-io-limits": "write-bps=50Mi", "rootless": "true"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"build-io-limits": "iops=10"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigMetricsPort(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"metrics-port": "9090"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "9090", d.deployment.ObjectMeta.Annotations[manifest.MetricsPortAnnotation])
+
+	d.InitConfig.DriverOpts = map[string]string{"metrics-port": "0"}
+	require.NoError(t, d.initDriverFromConfig())
+	require.NotContains(t, d.deployment.ObjectMeta.Annotations, manifest.MetricsPortAnnotation)
+	for _, v := range []string{"http", "70000", "1234"} {
+		d.InitConfig.DriverOpts = map[string]string{"metrics-port": v}
+		require.Error(t, d.initDriverFromConfig(), v)
+	}
+}
+
+func Test_initDriverFromConfigTransport(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"transport": "port-forward", "tls": "true"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, manifest.TransportPortForward, d.deployment.ObjectMeta.Annotations[manifest.TransportAnnotation])
+	require.False(t, d.transportAuto)
+
+	d.InitConfig.DriverOpts = map[string]string{"transport": "exec"}
+	require.NoError(t, d.initDriverFromConfig())
+	require.NotContains(t, d.deployment.ObjectMeta.Annotations, manifest.TransportAnnotation)
+	require.False(t, d.transportAuto)
+
+	// Created with exec unless its creator may only port-forward, see detectTransport
+	d.InitConfig.DriverOpts = map[string]string{"transport": "auto"}
+	require.NoError(t, d.initDriverFromConfig())
+	require.NotContains(t, d.deployment.ObjectMeta.Annotations, manifest.TransportAnnotation)
+	require.True(t, d.transportAuto)
+
+	// Only exec reaches buildkitd without its TLS listener
+	d.InitConfig.DriverOpts = map[string]string{"transport": "tcp"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"transport": "quic", "tls": "true"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigAdminService(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"admin-service": "true", "tls": "true"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "test-admin", d.adminService.Name)
+
+	d.adminService = nil
+	d.InitConfig.DriverOpts = map[string]string{"admin-service": "false"}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Nil(t, d.adminService)
+
+	// The admin clients authenticate with the certificates of the builder
+	d.InitConfig.DriverOpts = map[string]string{"admin-service": "true"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigSharedCache(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"shared-cache": "true", "shared-cache-size": "20Gi", "storage-class": "fast"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "test-shared-cache", d.sharedCache.name)
+	require.Equal(t, "fast", *d.sharedCache.claim.Spec.StorageClassName)
+	require.Equal(t, "test-shared-cache:5000/cache", d.deployment.ObjectMeta.Annotations[manifest.SharedCacheAnnotation])
+	require.Contains(t, string(d.configMap.BinaryData[manifest.ConfigFileName]), `[registry."test-shared-cache:5000"]`)
+
+	d.sharedCache = nil
+	d.InitConfig.DriverOpts = map[string]string{"shared-cache-size": "20Gi"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"shared-cache": "true", "shared-cache-size": "big"}
+	require.Error(t, d.initDriverFromConfig())
+	require.Nil(t, d.sharedCache)
+}
+
+func Test_initDriverFromConfigProxy(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"http-proxy": "http://proxy:3128", "no-proxy": ".corp"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, "http://proxy:3128", d.deployment.ObjectMeta.Annotations[manifest.HTTPProxyAnnotation])
+
+	d.InitConfig.DriverOpts = map[string]string{"https-proxy": "proxy:3128"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"no-proxy": ".corp"}
+	require.Error(t, d.initDriverFromConfig())
+	// The egress proxy is the only proxy of an allowlisted builder
+	d.InitConfig.DriverOpts = map[string]string{"http-proxy": "http://proxy:3128", "egress-allow": "github.com"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigSecurityProfile(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"security-profile": "restricted", "runtime": "containerd"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, manifest.SecurityProfileRestricted, d.securityProfile)
+	spec := d.deployment.Spec.Template.Spec
+	require.True(t, *spec.SecurityContext.RunAsNonRoot)
+	require.True(t, *spec.Containers[0].SecurityContext.ReadOnlyRootFilesystem)
+	require.Contains(t, spec.Containers[0].Args, "--oci-worker-no-process-sandbox")
+
+	d.InitConfig.DriverOpts = map[string]string{"security-profile": "restricted", "worker": "containerd", "runtime": "containerd"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"seccomp-profile": "profiles/buildkitd.json"}
+	require.Error(t, d.initDriverFromConfig())
+	d.InitConfig.DriverOpts = map[string]string{"security-profile": "baseline"}
+	require.Error(t, d.initDriverFromConfig())
+}
+
+func Test_initDriverFromConfigRuntimes(t *testing.T) {
+	t.Parallel()
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"runtime": "containerd", "worker": "auto"},
+		},
+		runtimeNodes: map[string][]string{
+			manifest.RuntimeContainerd: {"node-a", "node-b"},
+			manifest.RuntimeCRIO:       {"node-c"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	require.Equal(t, WorkerContainerd, d.deployment.Spec.Template.Labels["worker"])
+	require.Equal(t, manifest.RuntimeCRIO, d.deployment.ObjectMeta.Annotations[manifest.RuntimesAnnotation])
+	require.Len(t, d.runtimeDeployments, 1)
+	crio := d.runtimeDeployments[0]
+	require.Equal(t, "test-crio", crio.Name)
+	require.Equal(t, WorkerRunc, crio.Spec.Template.Labels["worker"])
+	require.Equal(t, d.deployment.Spec.Template.Annotations[manifest.ConfigDigestAnnotation], crio.Spec.Template.Annotations[manifest.ConfigDigestAnnotation])
+
+	d.InitConfig.DriverOpts = map[string]string{"runtime": "cri-o", "worker": "containerd"}
+	require.Error(t, d.initDriverFromConfig())
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/podchooser"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// LoadPods returns the pods images are loaded on the nodes of nodeSelector
+// through, all the nodes if it's empty.  The builder pods able to load
+// images are used on their node, a loader pod is run on each of the other
+// nodes.  The returned func removes the loader pods.
+func (d *Driver) LoadPods(ctx context.Context, nodeSelector string) ([]driver.Node, func(), error) {
+	if d.nodeClient == nil {
+		return nil, nil, errors.New("loading images on the nodes needs listing them")
+	}
+	nodes, err := d.nodeClient.List(ctx, metav1.ListOptions{LabelSelector: nodeSelector})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list the nodes to load the image on")
+	}
+	if len(nodes.Items) == 0 {
+		return nil, nil, errors.Errorf("no nodes match %q to load the image on", nodeSelector)
+	}
+	pods, err := podchooser.ListRunningPods(ctx, d.podClient, d.deployment)
+	if err != nil {
+		return nil, nil, err
+	}
+	builderPods := map[string]*corev1.Pod{}
+	for _, pod := range pods {
+		if manifest.CanLoad(pod) {
+			builderPods[pod.Spec.NodeName] = pod
+		}
+	}
+
+	var res []driver.Node
+	var loaders []string
+	cleanup := func() {
+		// Not the build's context, which may be done
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for _, name := range loaders {
+			if err := d.podClient.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+				logrus.Warnf("failed to delete loader pod %s: %s", name, err)
+			}
+		}
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if pod, ok := builderPods[node.Name]; ok {
+			res = append(res, driver.Node{Name: pod.Name, Host: node.Name, Runtime: pod.Labels["runtime"]})
+			continue
+		}
+		runtime := manifest.NodeRuntime(node.Status.NodeInfo.ContainerRuntimeVersion)
+		if runtime != manifest.RuntimeContainerd && runtime != manifest.RuntimeDocker {
+			logrus.Warnf("image not loaded on node %s, images can't be loaded into its runtime %s", node.Name, node.Status.NodeInfo.ContainerRuntimeVersion)
+			continue
+		}
+		if node.Spec.Unschedulable {
+			logrus.Warnf("image not loaded on node %s, it's cordoned", node.Name)
+			continue
+		}
+		pod, err := manifest.NewLoaderPod(d.deploymentOpt, node.Name, runtime)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		pod, err = d.podClient.Create(ctx, pod, metav1.CreateOptions{})
+		if err != nil {
+			cleanup()
+			return nil, nil, errors.Wrapf(err, "failed to create the loader pod of node %s", node.Name)
+		}
+		loaders = append(loaders, pod.Name)
+		res = append(res, driver.Node{Name: pod.Name, Host: node.Name, Runtime: runtime})
+	}
+	if err := d.waitForLoaderPods(ctx, loaders); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return res, cleanup, nil
+}
+
+// waitForLoaderPods waits for the loader pods to run, up to the ready timeout
+// of the builder pods
+func (d *Driver) waitForLoaderPods(ctx context.Context, names []string) error {
+	wait := driver.WaitOptions(ctx)
+	ctx, cancel := context.WithTimeout(ctx, wait.ReadyTimeout)
+	defer cancel()
+	for _, name := range names {
+		for attempt := 0; ; attempt++ {
+			pod, err := d.podClient.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return errors.Wrapf(err, "failed to get loader pod %s", name)
+			}
+			if pod.Status.Phase == corev1.PodRunning {
+				break
+			}
+			if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+				return errors.Errorf("loader pod %s on node %s exited: %s", name, pod.Spec.NodeName, pod.Status.Message)
+			}
+			if err := wait.Backoff.Sleep(ctx, attempt); err != nil {
+				return errors.Wrapf(err, "loader pod %s on node %s isn't running", name, pod.Spec.NodeName)
+			}
+		}
+	}
+	return nil
+}
+
+// loaderPod returns the loader pod of the builder named name, nil if there's
+// none
+func (d *Driver) loaderPod(ctx context.Context, name string) *corev1.Pod {
+	pod, err := d.podClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil || pod.Labels[manifest.LoaderLabel] != d.deployment.Name || pod.Status.Phase != corev1.PodRunning {
+		return nil
+	}
+	return pod
+}
+
+// rmLoaderPods removes the loader pods left behind by builds which didn't
+// clean up after themselves
+func (d *Driver) rmLoaderPods(ctx context.Context) error {
+	err := d.podClient.DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{manifest.LoaderLabel: d.deployment.Name}).String(),
+	})
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return errors.Wrap(err, "failed to delete the loader pods")
+	}
+	return nil
+}
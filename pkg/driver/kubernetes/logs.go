@@ -0,0 +1,156 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/podchooser"
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The logs of buildkitd and the events of the builder are what is looked at
+// first when a build hangs.  They are read through the Kubernetes API like
+// kubectl logs and kubectl get events would, without having to find the
+// pods of the builder first.
+
+func (d *Driver) Logs(ctx context.Context, name string, opt driver.LogOptions, w io.Writer) error {
+	pods, err := podchooser.ListPods(ctx, d.podClient, d.deployment)
+	if err != nil {
+		return err
+	}
+	var selected []*corev1.Pod
+	for _, p := range pods {
+		switch {
+		case name != "" && p.Name == name:
+			selected = append(selected, p)
+		case name == "" && p.Status.Phase != corev1.PodPending:
+			// Pending pods have no logs yet
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) == 0 {
+		if name != "" {
+			return errors.Errorf("builder %s has no pod %s", d.deployment.Name, name)
+		}
+		return errors.Errorf("builder %s has no started pods", d.deployment.Name)
+	}
+	mu := &sync.Mutex{}
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, p := range selected {
+		p := p
+		eg.Go(func() error {
+			stream, err := d.podClient.GetLogs(p.Name, podLogOptions(p, opt)).Stream(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read the logs of %s", p.Name)
+			}
+			defer stream.Close()
+			prefix := ""
+			if len(selected) > 1 {
+				prefix = "[" + p.Name + "] "
+			}
+			return copyLines(w, mu, prefix, stream)
+		})
+	}
+	return eg.Wait()
+}
+
+func podLogOptions(p *corev1.Pod, opt driver.LogOptions) *corev1.PodLogOptions {
+	res := &corev1.PodLogOptions{
+		Container: manifest.BuilderContainer(p),
+		Follow:    opt.Follow,
+	}
+	if opt.Tail >= 0 {
+		tail := opt.Tail
+		res.TailLines = &tail
+	}
+	if opt.Since > 0 {
+		since := int64(math.Ceil(opt.Since.Seconds()))
+		res.SinceSeconds = &since
+	}
+	return res
+}
+
+// copyLines copies r to w a whole line at a time, prefixed with prefix, so
+// the lines of several pods don't interleave
+func copyLines(w io.Writer, mu *sync.Mutex, prefix string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			mu.Lock()
+			_, werr := io.WriteString(w, prefix+line)
+			mu.Unlock()
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Driver) Events(ctx context.Context) ([]driver.Event, error) {
+	pods, err := podchooser.ListPods(ctx, d.podClient, d.deployment)
+	if err != nil {
+		return nil, err
+	}
+	objects := map[string]bool{d.deployment.Name: true}
+	for _, p := range pods {
+		objects[p.Name] = true
+		for _, o := range p.OwnerReferences {
+			objects[o.Name] = true
+		}
+	}
+	events, err := d.eventClient.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list events")
+	}
+	return builderEvents(events.Items, objects), nil
+}
+
+// builderEvents returns the events of the named objects, oldest first
+func builderEvents(events []corev1.Event, objects map[string]bool) []driver.Event {
+	var res []driver.Event
+	for _, e := range events {
+		if !objects[e.InvolvedObject.Name] {
+			continue
+		}
+		t := e.LastTimestamp.Time
+		if t.IsZero() {
+			t = e.EventTime.Time
+		}
+		if t.IsZero() {
+			t = e.CreationTimestamp.Time
+		}
+		res = append(res, driver.Event{
+			Time:    t,
+			Object:  e.InvolvedObject.Kind + "/" + e.InvolvedObject.Name,
+			Type:    e.Type,
+			Reason:  e.Reason,
+			Message: strings.TrimSpace(e.Message),
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_copyLines(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	require.NoError(t, copyLines(buf, &sync.Mutex{}, "[buildkit-abc] ", strings.NewReader("time=1 msg=started\ntime=2 msg=solving")))
+	require.Equal(t, "[buildkit-abc] time=1 msg=started\n[buildkit-abc] time=2 msg=solving\n", buf.String())
+}
+
+func Test_podLogOptions(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "buildkitd"}}}}
+	opt := podLogOptions(pod, driver.LogOptions{Follow: true, Tail: -1})
+	require.True(t, opt.Follow)
+	require.Nil(t, opt.TailLines)
+	require.Nil(t, opt.SinceSeconds)
+
+	opt = podLogOptions(pod, driver.LogOptions{Tail: 100, Since: 1500 * time.Millisecond})
+	require.Equal(t, int64(100), *opt.TailLines)
+	require.Equal(t, int64(2), *opt.SinceSeconds)
+}
+
+func Test_builderEvents(t *testing.T) {
+	t.Parallel()
+	earlier := metav1.NewTime(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+	later := metav1.NewTime(earlier.Add(time.Minute))
+	events := []corev1.Event{
+		{
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "buildkit-abc"},
+			LastTimestamp:  later,
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container\n",
+		},
+		{
+			InvolvedObject: corev1.ObjectReference{Kind: "Deployment", Name: "buildkit"},
+			EventTime:      metav1.NewMicroTime(earlier.Time),
+			Type:           corev1.EventTypeNormal,
+			Reason:         "ScalingReplicaSet",
+		},
+		{InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "other-xyz"}, LastTimestamp: earlier},
+	}
+	res := builderEvents(events, map[string]bool{"buildkit": true, "buildkit-abc": true})
+	require.Equal(t, []driver.Event{
+		{Time: earlier.Time, Object: "Deployment/buildkit", Type: "Normal", Reason: "ScalingReplicaSet"},
+		{Time: later.Time, Object: "Pod/buildkit-abc", Type: "Warning", Reason: "BackOff", Message: "Back-off restarting failed container"},
+	}, res)
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The admin service lets dashboards and controllers manage a builder without
+// exec access to its pods.  It is a headless Service of the TLS port of the
+// builder pods, so each pod has its own address for its cache statistics and
+// prunes, served by the control API of buildkitd to the clients with a
+// certificate of the CA of the builder.  The build queue is read from its
+// Leases.
+
+const (
+	// AdminServiceAnnotation records the admin service of the builder
+	AdminServiceAnnotation = "buildkit.mobyproject.org/admin-service"
+
+	adminPortName = "buildkitd"
+)
+
+// AdminServiceName is the name of the admin service of a builder
+func AdminServiceName(name string) string {
+	return name + "-admin"
+}
+
+// NewAdminService returns the headless Service of the TLS port of the builder pods
+func NewAdminService(opt *DeploymentOpt) (*corev1.Service, error) {
+	families, familyPolicy, err := IPFamilies(opt.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   opt.Namespace,
+			Name:        AdminServiceName(opt.Name),
+			Labels:      labels(opt),
+			Annotations: annotations(opt),
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:      corev1.ClusterIPNone,
+			Selector:       map[string]string{"app": opt.Name},
+			IPFamilies:     families,
+			IPFamilyPolicy: familyPolicy,
+			Ports: []corev1.ServicePort{
+				{Name: adminPortName, Port: TLSPort, TargetPort: intstr.FromInt(TLSPort)},
+			},
+		},
+	}, nil
+}
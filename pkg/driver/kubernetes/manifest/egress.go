@@ -0,0 +1,249 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The egress allowlist is enforced by running an allowlisting proxy next to
+// the builder.  The builder's NetworkPolicy only permits egress to the proxy
+// (and allowlisted CIDRs), so RUN steps sharing the pod network can't bypass it.
+
+const (
+	// DefaultEgressProxyImage is the squid image used for the egress proxy
+	DefaultEgressProxyImage = "docker.io/ubuntu/squid:5.2-22.04_beta"
+
+	// EgressProxyAnnotation records the URL of the egress proxy on the builder deployment
+	EgressProxyAnnotation = "buildkit.mobyproject.org/egress-proxy"
+
+	// EgressProxySuffix names the egress proxy of a builder after it.  Builder
+	// names can't end with it, so the proxy objects and their app label never
+	// are those of another builder.
+	EgressProxySuffix = "-egress"
+
+	egressProxyPort = 3128
+)
+
+// EgressProxyName is the name of the proxy Deployment, Service and ConfigMap for a builder
+func EgressProxyName(opt *DeploymentOpt) string {
+	return opt.Name + EgressProxySuffix
+}
+
+// EgressProxyURL is the proxy address used by the builder and its builds
+func EgressProxyURL(opt *DeploymentOpt) string {
+	return fmt.Sprintf("http://%s:%d", EgressProxyName(opt), egressProxyPort)
+}
+
+// splitEgressAllow separates the allowlist into domains, matched by the
+// proxy, and CIDRs which are also reachable directly
+func splitEgressAllow(allow []string) (domains []string, cidrs []string, err error) {
+	for _, a := range allow {
+		a = strings.TrimSpace(a)
+		if _, ipNet, err := net.ParseCIDR(a); err == nil {
+			cidrs = append(cidrs, ipNet.String())
+			continue
+		}
+		if ip := net.ParseIP(a); ip != nil {
+			if ip.To4() != nil {
+				cidrs = append(cidrs, a+"/32")
+			} else {
+				cidrs = append(cidrs, a+"/128")
+			}
+			continue
+		}
+		d := strings.ToLower(strings.TrimPrefix(a, "*"))
+		if d == "" || strings.ContainsAny(d, "/:* ") || strings.Contains(strings.TrimPrefix(d, "."), "..") {
+			return nil, nil, errors.Errorf("invalid egress allowlist entry %q, use a domain, *.domain, IP or CIDR", a)
+		}
+		domains = append(domains, d)
+	}
+	return domains, cidrs, nil
+}
+
+// EgressProxyConfig renders the squid configuration for the allowlist
+func EgressProxyConfig(opt *DeploymentOpt) (string, error) {
+	domains, cidrs, err := splitEgressAllow(opt.EgressAllow)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "http_port %d\n", egressProxyPort)
+	sb.WriteString("acl SSL_ports port 443\n")
+	sb.WriteString("acl CONNECT method CONNECT\n")
+	sb.WriteString("http_access deny CONNECT !SSL_ports\n")
+	if len(domains) > 0 {
+		fmt.Fprintf(&sb, "acl allowed_domains dstdomain %s\n", strings.Join(domains, " "))
+		sb.WriteString("http_access allow allowed_domains\n")
+	}
+	if len(cidrs) > 0 {
+		fmt.Fprintf(&sb, "acl allowed_nets dst %s\n", strings.Join(cidrs, " "))
+		sb.WriteString("http_access allow allowed_nets\n")
+	}
+	sb.WriteString("http_access deny all\n")
+	sb.WriteString("cache deny all\n")
+	sb.WriteString("access_log stdio:/dev/stdout\n")
+	sb.WriteString("cache_log stdio:/dev/stderr\n")
+	return sb.String(), nil
+}
+
+func egressProxyLabels(opt *DeploymentOpt) map[string]string {
+	return map[string]string{
+		"app":     EgressProxyName(opt),
+		"builder": opt.Name,
+	}
+}
+
+// NewEgressProxy returns the ConfigMap, Deployment and Service of the egress proxy
+func NewEgressProxy(opt *DeploymentOpt) (*corev1.ConfigMap, *appsv1.Deployment, *corev1.Service, error) {
+	config, err := EgressProxyConfig(opt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	families, familyPolicy, err := IPFamilies(opt.IPFamily)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	name := EgressProxyName(opt)
+	labels := egressProxyLabels(opt)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(config))
+	image := opt.EgressProxyImage
+	if image == "" {
+		image = DefaultEgressProxyImage
+	}
+	// Not annotated with AnnotationKey so the proxy isn't listed as a builder
+	objectMeta := metav1.ObjectMeta{
+		Namespace: opt.Namespace,
+		Name:      name,
+		Labels:    labels,
+	}
+	cm := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: objectMeta,
+		Data: map[string]string{
+			"squid.conf": config,
+		},
+	}
+	replicas := int32(1)
+	d := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: objectMeta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						// Restart the proxy when the allowlist changes
+						"buildkit.mobyproject.org/egress-config": fmt.Sprintf("%x", h.Sum32()),
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "squid",
+							Image: image,
+							Ports: []corev1.ContainerPort{
+								{Name: "proxy", ContainerPort: egressProxyPort},
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(egressProxyPort)},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "squid-config",
+									MountPath: "/etc/squid/squid.conf",
+									SubPath:   "squid.conf",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "squid-config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: name,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	svc := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: objectMeta,
+		Spec: corev1.ServiceSpec{
+			Selector:       labels,
+			IPFamilies:     families,
+			IPFamilyPolicy: familyPolicy,
+			Ports: []corev1.ServicePort{
+				{Name: "proxy", Port: egressProxyPort, TargetPort: intstr.FromInt(egressProxyPort)},
+			},
+		},
+	}
+	if opt.SecurityProfile == SecurityProfileRestricted {
+		restrictPodSpec(&d.Spec.Template.Spec, opt)
+	}
+	return cm, d, svc, nil
+}
+
+// NewEgressProxyNetworkPolicy only admits the builder pods to the proxy
+func NewEgressProxyNetworkPolicy(opt *DeploymentOpt) *networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	port := intstr.FromInt(egressProxyPort)
+	return &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1.SchemeGroupVersion.String(),
+			Kind:       "NetworkPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: opt.Namespace,
+			Name:      EgressProxyName(opt),
+			Labels:    egressProxyLabels(opt),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: egressProxyLabels(opt),
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": opt.Name}}},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Images are loaded into the runtime of a node through the runtime socket of
+// a builder pod on the node.  To load an image on nodes without a builder pod
+// able to, a loader pod is run on each of them for the duration of the build:
+// the builder image idling with the runtime socket of its node mounted, which
+// buildctl dial-stdio connects to like in the builder pods.  The loader pods
+// are pinned to their node, tolerate its taints and expire on their own if the
+// CLI doesn't remove them.
+
+const (
+	// LoaderLabel names the builder of a loader pod
+	LoaderLabel = "buildkit.mobyproject.org/loader"
+
+	// LoaderPodLifetime is how long a loader pod runs at most, in seconds
+	LoaderPodLifetime = 3600
+)
+
+// NewLoaderPod returns the pod loading images on node into its runtime, the
+// socket of the runtime mounted at the path the builder pods mount it
+func NewLoaderPod(opt *DeploymentOpt, node, runtime string) (*corev1.Pod, error) {
+	if opt.SecurityProfile == SecurityProfileRestricted {
+		return nil, fmt.Errorf("security-profile %s can't mount the runtime socket of the nodes to load images on them", SecurityProfileRestricted)
+	}
+	var hostPath, mountPath string
+	switch runtime {
+	case RuntimeContainerd:
+		hostPath, mountPath = opt.ContainerdSockHostPath, "/run/containerd/containerd.sock"
+	case RuntimeDocker:
+		hostPath, mountPath = opt.DockerSockHostPath, "/run/docker.sock"
+	default:
+		return nil, fmt.Errorf("images can't be loaded into the %s runtime of node %s", runtime, node)
+	}
+	hostPathSocket := corev1.HostPathSocket
+	root := int64(0)
+	lifetime := int64(LoaderPodLifetime)
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Pod",
+		},
+		// Without the app label of the builder, so it isn't one of its pods
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    opt.Namespace,
+			GenerateName: opt.Name + "-load-",
+			Labels: map[string]string{
+				LoaderLabel: opt.Name,
+				"runtime":   runtime,
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:              node,
+			RestartPolicy:         corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &lifetime,
+			// Pinned to the node, whatever its taints
+			Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{
+				{
+					Name:    containerName,
+					Image:   opt.Image,
+					Command: []string{"sleep", strconv.Itoa(LoaderPodLifetime)},
+					// The rootless image runs as a user the socket denies
+					SecurityContext: &corev1.SecurityContext{RunAsUser: &root},
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "runtime-sock",
+							MountPath: mountPath,
+						},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "runtime-sock",
+					VolumeSource: corev1.VolumeSource{
+						HostPath: &corev1.HostPathVolumeSource{
+							Path: hostPath,
+							Type: &hostPathSocket,
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// CanLoad reports whether images can be loaded into the runtime of the node
+// of the builder pod through its runtime socket
+func CanLoad(pod *corev1.Pod) bool {
+	switch pod.Labels["runtime"] {
+	case RuntimeContainerd:
+		return pod.Labels["worker"] == "containerd"
+	case RuntimeDocker:
+		return pod.Labels["rootless"] != "true"
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_NewLoaderPod(t *testing.T) {
+	t.Parallel()
+	opt := &DeploymentOpt{
+		Namespace:              "builds",
+		Name:                   "builder",
+		Image:                  "moby/buildkit:test",
+		ContainerdSockHostPath: "/run/k3s/containerd/containerd.sock",
+		DockerSockHostPath:     "/var/run/docker.sock",
+	}
+	pod, err := NewLoaderPod(opt, "node-1", RuntimeContainerd)
+	require.NoError(t, err)
+	require.Equal(t, "builder-load-", pod.GenerateName)
+	require.Equal(t, "builder", pod.Labels[LoaderLabel])
+	require.Equal(t, RuntimeContainerd, pod.Labels["runtime"])
+	require.NotContains(t, pod.Labels, "app")
+	require.Equal(t, "node-1", pod.Spec.NodeName)
+	require.Equal(t, corev1.RestartPolicyNever, pod.Spec.RestartPolicy)
+	require.Equal(t, containerName, pod.Spec.Containers[0].Name)
+	require.Equal(t, "/run/containerd/containerd.sock", pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+	require.Equal(t, opt.ContainerdSockHostPath, pod.Spec.Volumes[0].HostPath.Path)
+
+	pod, err = NewLoaderPod(opt, "node-2", RuntimeDocker)
+	require.NoError(t, err)
+	require.Equal(t, "/run/docker.sock", pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+	require.Equal(t, opt.DockerSockHostPath, pod.Spec.Volumes[0].HostPath.Path)
+
+	_, err = NewLoaderPod(opt, "node-3", RuntimeCRIO)
+	require.Error(t, err)
+	opt.SecurityProfile = SecurityProfileRestricted
+	_, err = NewLoaderPod(opt, "node-1", RuntimeContainerd)
+	require.Error(t, err)
+}
+
+func Test_CanLoad(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{}
+	pod.Labels = map[string]string{"runtime": RuntimeContainerd, "worker": "containerd", "rootless": "false"}
+	require.True(t, CanLoad(pod))
+	pod.Labels["worker"] = "runc"
+	require.False(t, CanLoad(pod))
+	pod.Labels = map[string]string{"runtime": RuntimeDocker, "worker": "runc", "rootless": "false"}
+	require.True(t, CanLoad(pod))
+	pod.Labels["rootless"] = "true"
+	require.False(t, CanLoad(pod))
+	pod.Labels = map[string]string{"runtime": RuntimeCRIO}
+	require.False(t, CanLoad(pod))
+}
@@ -3,11 +3,19 @@
 package manifest
 
 import (
+	"encoding/json"
 	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/version"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -25,13 +33,215 @@ type DeploymentOpt struct {
 	ContainerRuntime       string
 	CustomConfig           string
 	Environments           map[string]string
+	// AllowInsecureEntitlements lists the entitlements builds may request from this builder
+	AllowInsecureEntitlements []string
+	// MaxParallelism limits how many build steps execute concurrently in a pod (0 for unlimited)
+	MaxParallelism int
+	// MaxParallelBuilds limits how many builds run on the builder at once, excess builds are queued (0 for unlimited)
+	MaxParallelBuilds int
+	// PreemptionPriority is the build priority at which queued builds may preempt lower priority running builds (0 to disable)
+	PreemptionPriority int
+	// Notify lists the default build completion notification sinks for builds on this builder
+	Notify []string
+	// NetworkPolicy restricts the builder pod traffic with a NetworkPolicy
+	NetworkPolicy bool
+	// NetworkPolicyEgress lists the destinations the builder may reach, see ParseEgressRule
+	NetworkPolicyEgress []string
+	// EgressAllow lists the domains (or *.domain) and CIDRs builds may reach through the egress proxy
+	EgressAllow []string
+	// EgressProxyImage overrides the image of the egress proxy
+	EgressProxyImage string
+	// MeshCompatible configures the injected Istio or Linkerd sidecar for the builder pods
+	MeshCompatible bool
+	// MeshExcludeOutboundPorts bypass the sidecar with MeshCompatible
+	MeshExcludeOutboundPorts []int
+	// DefaultPlatform is built for builds that don't specify a platform, instead of the builder's native platform
+	DefaultPlatform string
+	// IPFamily selects the address family of the services created for the builder, see IPFamilies
+	IPFamily string
+	// RunCacheClaim is an existing PersistentVolumeClaim persisting the RUN cache mounts of builds
+	RunCacheClaim string
+	// RunCacheScope keys the persisted cache mounts by cache ID or by project, see RunCacheScopeID
+	RunCacheScope string
+	// ScaleDownIdle is how long replicas may go without a build before builds scale them down (0 to disable)
+	ScaleDownIdle time.Duration
+	// AllowHostPaths are the node directories builds may mount with --mount-host
+	AllowHostPaths []string
+	// ScratchSize sizes a generic ephemeral volume holding the buildkit state of each pod, instead of the node's ephemeral storage
+	ScratchSize string
+	// ScratchStorageClass provisions the ScratchSize volumes, the cluster default if unset
+	ScratchStorageClass string
+	// OutputClaims are existing PersistentVolumeClaims builds may write their image to
+	OutputClaims []string
+	// ReplicaClasses are additional sets of builder pods builds may request, see NewReplicaClassDeployment
+	ReplicaClasses []ReplicaClass
+	// FallbackBuilder is built on while the builder has no ready pods, NAME[,namespace=NS][,context=CTX]
+	FallbackBuilder string
+	// ReadOnlyRootFS runs buildkitd with a read-only root filesystem, see ReadOnlyRootFSWritablePaths
+	ReadOnlyRootFS bool
+	// WritablePaths are directories of the builder image kept writable with ReadOnlyRootFS, on top of the defaults
+	WritablePaths []string
+	// HistoryMaxRecords is how many finished detached build records each pod keeps (0 for no limit)
+	HistoryMaxRecords int
+	// HistoryMaxAge is how long each pod keeps the records of finished detached builds (0 for no limit)
+	HistoryMaxAge time.Duration
+	// CacheStorage keeps the buildkit state on a PersistentVolumeClaim with CacheStoragePVC, instead of the pod's ephemeral storage
+	CacheStorage string
+	// CacheSize is the size of the CacheStorage claim, DefaultCacheSize if unset
+	CacheSize string
+	// CacheStorageClass provisions the CacheStorage claim, the cluster default if unset
+	CacheStorageClass string
+	// BinfmtImage installs the QEMU emulators of BinfmtPlatforms on the node of each pod before buildkitd starts
+	BinfmtImage string
+	// BinfmtPlatforms are the architectures BinfmtImage installs, all of those it has if empty
+	BinfmtPlatforms []string
+	// ScaleOnQueue has builds scale the builder up, up to ReplicasMax, when they queue on its pods, MaxParallelBuilds is then per pod
+	ScaleOnQueue bool
+	// ReplicasMin is the fewest replicas builds scale the builder down to (0 for 1)
+	ReplicasMin int
+	// ReplicasMax is the most replicas builds scale the builder up to with ScaleOnQueue
+	ReplicasMax int
+	// TLSSecret holds the CA and certificates buildkitd and the CLI authenticate each other with, see NewTLSSecret
+	TLSSecret string
+	// NodeSelector are the labels of the nodes the builder pods may run on
+	NodeSelector map[string]string
+	// Tolerations let the builder pods run on the tainted nodes, see ParseToleration
+	Tolerations []corev1.Toleration
+	// Affinity constrains the nodes of the builder pods, see addScheduling
+	Affinity *corev1.Affinity
+	// Requests and Limits are the resources of buildkitd in each builder pod, see ParseResourceList
+	Requests corev1.ResourceList
+	Limits   corev1.ResourceList
+	// PriorityClassName is the priority class of the builder pods
+	PriorityClassName string
+	// GCThreshold is the percentage of the disk of the pods used at which builds prune their cache, 0 to not prune
+	GCThreshold int
+	// GCKeepStorage is the size of the cache builds never prune
+	GCKeepStorage int64
+	// BuildIOLimits throttle the disk I/O of the builds by default, see driver.ParseIOLimits
+	BuildIOLimits string
+	// Transport is how the CLI connects to buildkitd, see the Transport constants
+	Transport string
+	// AdminService exposes the TLS port of the builder pods with a headless Service, see NewAdminService
+	AdminService bool
+	// MetricsPort serves the metrics of buildkitd on this port of the pods for Prometheus to scrape, 0 to not serve them
+	MetricsPort int
+	// PackageProxy runs a caching proxy sidecar for the downloads of the builds, see addPackageProxy
+	PackageProxy bool
+	// PackageProxyImage overrides the image of the package proxy
+	PackageProxyImage string
+	// PackageProxySize is the size of the cache of the package proxy, DefaultPackageProxySize if unset
+	PackageProxySize string
+	// SharedCache runs a registry the builder pods share their layer cache through, see NewSharedCache
+	SharedCache bool
+	// SharedCacheImage overrides the registry image of the shared cache
+	SharedCacheImage string
+	// SharedCacheSize is the size of the claim of the shared cache, DefaultSharedCacheSize if unset
+	SharedCacheSize string
+	// HTTPProxy and HTTPSProxy are the proxies of buildkitd and the builds, see ParseProxyURL
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy lists the hosts reached without the proxies, comma separated
+	NoProxy string
+	// SecurityProfile is SecurityProfileRestricted for a builder complying with the restricted Pod Security Standard
+	SecurityProfile string
+	// SeccompProfile is the Localhost seccomp profile of the restricted profile, RuntimeDefault if unset
+	SeccompProfile string
 }
 
 const (
 	containerName = "buildkitd"
 	AnnotationKey = "buildkit.mobyproject.org/builder"
+
+	// MaxParallelBuildsAnnotation records the build queue capacity on the deployment
+	MaxParallelBuildsAnnotation = "buildkit.mobyproject.org/max-parallel-builds"
+	// PreemptionPriorityAnnotation records the priority at which queued builds may preempt running builds
+	PreemptionPriorityAnnotation = "buildkit.mobyproject.org/preemption-priority"
+	// NotifyAnnotation records the default notification sinks, a JSON list
+	NotifyAnnotation = "buildkit.mobyproject.org/notify"
+	// DefaultPlatformAnnotation records the platform built when builds don't specify one
+	DefaultPlatformAnnotation = "buildkit.mobyproject.org/default-platform"
+	// ScaleDownIdleAnnotation records how long replicas may idle before builds scale them down
+	ScaleDownIdleAnnotation = "buildkit.mobyproject.org/scale-down-idle"
+	// ScaleOnQueueAnnotation is set if builds scale the builder up when they queue, MaxParallelBuildsAnnotation is then per pod
+	ScaleOnQueueAnnotation = "buildkit.mobyproject.org/scale-on-queue"
+	// ReplicasMinAnnotation and ReplicasMaxAnnotation record the bounds builds scale the builder within
+	ReplicasMinAnnotation = "buildkit.mobyproject.org/replicas-min"
+	ReplicasMaxAnnotation = "buildkit.mobyproject.org/replicas-max"
+	// CreateOptionsAnnotation records the options the builder was created with, see driver.BuilderConfig
+	CreateOptionsAnnotation = "buildkit.mobyproject.org/create-options"
+	// RunCacheAnnotation records the scope of the persisted RUN cache mounts
+	RunCacheAnnotation = "buildkit.mobyproject.org/run-cache"
+
+	// RunCacheMountPath is where the RunCacheClaim is mounted in the builder pods
+	RunCacheMountPath = "/var/lib/buildkit-run-cache"
+	// RunCacheScopeID shares a persisted cache mount between all builds using its ID
+	RunCacheScopeID = "id"
+	// RunCacheScopeProject keeps the cache mounts of each project apart
+	RunCacheScopeProject = "project"
+
+	// HostPathsAnnotation records the host paths builds may mount, comma separated
+	HostPathsAnnotation = "buildkit.mobyproject.org/host-paths"
+	// HostPathMountPath is where the allowed host paths are mounted in the builder pods, under their own path
+	HostPathMountPath = "/var/lib/buildkit-host-paths"
+	// ScratchSizeAnnotation records the size of the scratch volume of the builder pods
+	ScratchSizeAnnotation = "buildkit.mobyproject.org/scratch-size"
+	// OutputClaimsAnnotation records the claims builds may write their image to, comma separated
+	OutputClaimsAnnotation = "buildkit.mobyproject.org/output-claims"
+	// OutputClaimMountPath is where the OutputClaims are mounted in the builder pods, under their name
+	OutputClaimMountPath = "/var/lib/buildkit-outputs"
+	// FallbackBuilderAnnotation records the builder to build on while this one is unavailable
+	FallbackBuilderAnnotation = "buildkit.mobyproject.org/fallback-builder"
+	// ReadOnlyRootFSAnnotation is set if the builder runs with a read-only root filesystem
+	ReadOnlyRootFSAnnotation = "buildkit.mobyproject.org/read-only-root-fs"
+	// AllowedEntitlementsAnnotation records the insecure entitlements builds may request, comma separated, unset if unknown
+	AllowedEntitlementsAnnotation = "buildkit.mobyproject.org/allowed-entitlements"
+	// HistoryMaxRecordsAnnotation records how many finished detached build records each pod keeps
+	HistoryMaxRecordsAnnotation = "buildkit.mobyproject.org/history-max-records"
+	// HistoryMaxAgeAnnotation records how long each pod keeps the records of finished detached builds
+	HistoryMaxAgeAnnotation = "buildkit.mobyproject.org/history-max-age"
+	// GCThresholdAnnotation records the percentage of the disk of the pods used at which builds prune their cache
+	GCThresholdAnnotation = "buildkit.mobyproject.org/gc-threshold"
+	// GCKeepStorageAnnotation records the size in bytes of the cache builds never prune
+	GCKeepStorageAnnotation = "buildkit.mobyproject.org/gc-keep-storage"
+	// BuildIOLimitsAnnotation records the disk I/O limits of the builds
+	BuildIOLimitsAnnotation = "buildkit.mobyproject.org/build-io-limits"
+	// CacheClaimAnnotation records the claim holding the buildkit state, deleted with the builder
+	CacheClaimAnnotation = "buildkit.mobyproject.org/cache-claim"
+
+	// EmulationAnnotation records the architectures emulated by the builder pods, comma separated
+	EmulationAnnotation = "buildkit.mobyproject.org/emulation"
+	// BinfmtAll installs all the emulators of the BinfmtImage
+	BinfmtAll = "all"
+	// BinfmtContainerName is the init container installing the emulators of the builder pods
+	BinfmtContainerName = "binfmt"
+
+	// CacheClaimLabel labels the cache claims of a builder with its name, each
+	// pod of a StatefulSet builder has its own
+	CacheClaimLabel = "buildkit.mobyproject.org/cache-of"
+	// CacheVolumeName is the volume of the builder pods holding the buildkit
+	// state with CacheStoragePVC
+	CacheVolumeName = "cache"
+
+	// ConfigFileName is the buildkitd config of the builder ConfigMap
+	ConfigFileName = "buildkitd.toml"
+	// ConfigDigestAnnotation records the digest of the buildkitd config the pods run with
+	ConfigDigestAnnotation = "buildkit.mobyproject.org/config-digest"
+
+	// UnschedulableAnnotation set to "true" on a builder pod drains it, new
+	// builds don't choose it while those it runs finish
+	UnschedulableAnnotation = "buildkit.mobyproject.org/unschedulable"
+
+	// CacheStoragePVC keeps the buildkit state of the builder on a PersistentVolumeClaim
+	CacheStoragePVC = "pvc"
+	// DefaultCacheSize is the size of the CacheStoragePVC claim unless set
+	DefaultCacheSize = "20Gi"
 )
 
+// readinessCommand only succeeds once buildkitd serves requests with at least
+// one initialized worker, listed after the header line
+var readinessCommand = []string{"sh", "-c", "buildctl debug workers | tail -n +2 | grep -q ."}
+
 func labels(opt *DeploymentOpt) map[string]string {
 	return map[string]string{
 		"app":      opt.Name,
@@ -47,11 +257,160 @@ func annotations(opt *DeploymentOpt) map[string]string {
 	}
 }
 
+func deploymentAnnotations(opt *DeploymentOpt) map[string]string {
+	res := annotations(opt)
+	if opt.MaxParallelBuilds > 0 {
+		res[MaxParallelBuildsAnnotation] = strconv.Itoa(opt.MaxParallelBuilds)
+	}
+	if opt.PreemptionPriority > 0 {
+		res[PreemptionPriorityAnnotation] = strconv.Itoa(opt.PreemptionPriority)
+	}
+	if len(opt.Notify) > 0 {
+		// Sink URLs may hold commas
+		dt, _ := json.Marshal(opt.Notify)
+		res[NotifyAnnotation] = string(dt)
+	}
+	if len(opt.EgressAllow) > 0 {
+		res[EgressProxyAnnotation] = EgressProxyURL(opt)
+	}
+	if opt.DefaultPlatform != "" {
+		res[DefaultPlatformAnnotation] = opt.DefaultPlatform
+	}
+	if opt.ScaleDownIdle > 0 {
+		res[ScaleDownIdleAnnotation] = opt.ScaleDownIdle.String()
+	}
+	if opt.ScaleOnQueue {
+		res[ScaleOnQueueAnnotation] = "true"
+		res[ReplicasMaxAnnotation] = strconv.Itoa(opt.ReplicasMax)
+	}
+	if opt.ReplicasMin > 0 {
+		res[ReplicasMinAnnotation] = strconv.Itoa(opt.ReplicasMin)
+	}
+	if opt.RunCacheClaim != "" {
+		scope := opt.RunCacheScope
+		if scope == "" {
+			scope = RunCacheScopeID
+		}
+		res[RunCacheAnnotation] = scope
+	}
+	if len(opt.AllowHostPaths) > 0 {
+		res[HostPathsAnnotation] = strings.Join(opt.AllowHostPaths, ",")
+	}
+	if opt.CacheStorage == CacheStoragePVC {
+		res[CacheClaimAnnotation] = CacheClaimName(opt.Name)
+	}
+	if opt.ScratchSize != "" {
+		res[ScratchSizeAnnotation] = opt.ScratchSize
+	}
+	if len(opt.OutputClaims) > 0 {
+		res[OutputClaimsAnnotation] = strings.Join(opt.OutputClaims, ",")
+	}
+	if opt.FallbackBuilder != "" {
+		res[FallbackBuilderAnnotation] = opt.FallbackBuilder
+	}
+	if opt.BinfmtImage != "" {
+		res[EmulationAnnotation] = strings.Join(binfmtPlatforms(opt), ",")
+	}
+	if opt.ReadOnlyRootFS {
+		res[ReadOnlyRootFSAnnotation] = "true"
+	}
+	res[AllowedEntitlementsAnnotation] = strings.Join(allowedEntitlements(opt), ",")
+	if opt.HistoryMaxRecords > 0 {
+		res[HistoryMaxRecordsAnnotation] = strconv.Itoa(opt.HistoryMaxRecords)
+	}
+	if opt.HistoryMaxAge > 0 {
+		res[HistoryMaxAgeAnnotation] = opt.HistoryMaxAge.String()
+	}
+	if opt.GCThreshold > 0 {
+		res[GCThresholdAnnotation] = strconv.Itoa(opt.GCThreshold)
+		if opt.GCKeepStorage > 0 {
+			res[GCKeepStorageAnnotation] = strconv.FormatInt(opt.GCKeepStorage, 10)
+		}
+	}
+	if opt.BuildIOLimits != "" {
+		res[BuildIOLimitsAnnotation] = opt.BuildIOLimits
+	}
+	if opt.TLSSecret != "" {
+		res[TLSSecretAnnotation] = opt.TLSSecret
+	}
+	if opt.Transport != "" && opt.Transport != TransportExec {
+		res[TransportAnnotation] = opt.Transport
+	}
+	if opt.AdminService {
+		res[AdminServiceAnnotation] = AdminServiceName(opt.Name)
+	}
+	if opt.MetricsPort > 0 {
+		res[MetricsPortAnnotation] = strconv.Itoa(opt.MetricsPort)
+	}
+	if opt.PackageProxy {
+		res[PackageProxyAnnotation] = PackageProxyURL()
+	}
+	if opt.SharedCache {
+		res[SharedCacheAnnotation] = SharedCacheRepository(opt)
+	}
+	if hasProxy(opt) {
+		if opt.HTTPProxy != "" {
+			res[HTTPProxyAnnotation] = opt.HTTPProxy
+		}
+		if opt.HTTPSProxy != "" {
+			res[HTTPSProxyAnnotation] = opt.HTTPSProxy
+		}
+		res[NoProxyAnnotation] = noProxy(opt)
+	}
+	if len(opt.ReplicaClasses) > 0 {
+		names := make([]string, len(opt.ReplicaClasses))
+		for i, c := range opt.ReplicaClasses {
+			names[i] = c.Name
+		}
+		res[ReplicaClassesAnnotation] = strings.Join(names, ",")
+	}
+	return res
+}
+
+// allowedEntitlements are the insecure entitlements buildkitd allows, with
+// AllowInsecureEntitlements or its own flags
+func allowedEntitlements(opt *DeploymentOpt) []string {
+	res := append([]string{}, opt.AllowInsecureEntitlements...)
+	for i, f := range opt.BuildkitFlags {
+		switch {
+		case strings.HasPrefix(f, "--allow-insecure-entitlement="):
+			res = append(res, strings.TrimPrefix(f, "--allow-insecure-entitlement="))
+		case f == "--allow-insecure-entitlement" && i+1 < len(opt.BuildkitFlags):
+			res = append(res, opt.BuildkitFlags[i+1])
+		}
+	}
+	sort.Strings(res)
+	for i := 1; i < len(res); i++ {
+		if res[i] == res[i-1] {
+			res = append(res[:i], res[i+1:]...)
+			i--
+		}
+	}
+	return res
+}
+
 func environments(opt *DeploymentOpt) []corev1.EnvVar {
 	envs := make([]corev1.EnvVar, 0, len(opt.Environments))
 	for name, value := range opt.Environments {
 		envs = append(envs, corev1.EnvVar{Name: name, Value: value})
 	}
+	httpProxy, httpsProxy := opt.HTTPProxy, opt.HTTPSProxy
+	if len(opt.EgressAllow) > 0 {
+		// buildkitd pulls base images and frontends through the egress proxy too
+		httpProxy = EgressProxyURL(opt)
+		httpsProxy = httpProxy
+	}
+	if httpProxy != "" || httpsProxy != "" {
+		for _, e := range []corev1.EnvVar{
+			{Name: "HTTP_PROXY", Value: httpProxy},
+			{Name: "HTTPS_PROXY", Value: httpsProxy},
+			{Name: "NO_PROXY", Value: noProxy(opt)},
+		} {
+			if _, ok := opt.Environments[e.Name]; !ok && e.Value != "" {
+				envs = append(envs, e)
+			}
+		}
+	}
 
 	return envs
 }
@@ -61,11 +420,14 @@ func NewDeployment(opt *DeploymentOpt) (*appsv1.Deployment, error) {
 	selectorLabels := map[string]string{
 		"app": labels["app"],
 	}
-	annotations := annotations(opt)
+	annotations := deploymentAnnotations(opt)
 	environments := environments(opt)
 	replicas := int32(opt.Replicas)
 	privileged := true
 	args := opt.BuildkitFlags
+	for _, e := range opt.AllowInsecureEntitlements {
+		args = append(args, "--allow-insecure-entitlement="+e)
+	}
 	d := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: appsv1.SchemeGroupVersion.String(),
@@ -98,9 +460,13 @@ func NewDeployment(opt *DeploymentOpt) (*appsv1.Deployment, error) {
 							ReadinessProbe: &corev1.Probe{
 								Handler: corev1.Handler{
 									Exec: &corev1.ExecAction{
-										Command: []string{"buildctl", "debug", "workers"},
+										Command: readinessCommand,
 									},
 								},
+								PeriodSeconds: 5,
+								// buildctl may be slow to answer while builds saturate the pod
+								TimeoutSeconds:   5,
+								FailureThreshold: 3,
 							},
 							VolumeMounts: []corev1.VolumeMount{
 								{
@@ -148,13 +514,360 @@ func NewDeployment(opt *DeploymentOpt) (*appsv1.Deployment, error) {
 			return nil, err
 		}
 	}
+	if opt.MeshCompatible {
+		toMeshCompatible(d, opt)
+	}
+	if opt.RunCacheClaim != "" {
+		addRunCacheMount(d, opt)
+	}
+	if len(opt.AllowHostPaths) > 0 {
+		addHostPathMounts(d, opt)
+	}
+	if opt.ScratchSize != "" {
+		if err := addScratchVolume(d, opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt.CacheStorage == CacheStoragePVC {
+		addCacheVolume(d, opt)
+	}
+	if len(opt.OutputClaims) > 0 {
+		addOutputClaimMounts(d, opt)
+	}
+	if opt.BinfmtImage != "" {
+		addBinfmtInstaller(d, opt)
+	}
+	if opt.TLSSecret != "" {
+		addTLSListener(d, opt)
+	}
+	if opt.MetricsPort > 0 {
+		addMetricsListener(d, opt)
+	}
+	if len(opt.NodeSelector) > 0 || len(opt.Tolerations) > 0 || opt.Affinity != nil {
+		addScheduling(d, opt)
+	}
+	if len(opt.Requests) > 0 || len(opt.Limits) > 0 || opt.PriorityClassName != "" {
+		addResources(d, opt)
+	}
+	if opt.PackageProxy {
+		if err := addPackageProxy(d, opt); err != nil {
+			return nil, err
+		}
+	}
+	// Last, the paths mounted so far are already writable
+	if opt.ReadOnlyRootFS {
+		toReadOnlyRootFS(d, opt)
+	}
+	if opt.SecurityProfile == SecurityProfileRestricted {
+		toRestricted(d, opt)
+	}
 	return d, nil
 }
 
+// IP families for DeploymentOpt.IPFamily, the cluster default is used if unset
+const (
+	IPFamilyIPv4      = "ipv4"
+	IPFamilyIPv6      = "ipv6"
+	IPFamilyDualStack = "dual"
+)
+
+// IPFamilies returns the service IP families and policy for family
+func IPFamilies(family string) ([]corev1.IPFamily, *corev1.IPFamilyPolicyType, error) {
+	single := corev1.IPFamilyPolicySingleStack
+	dual := corev1.IPFamilyPolicyRequireDualStack
+	switch family {
+	case "", "auto":
+		return nil, nil, nil
+	case IPFamilyIPv4:
+		return []corev1.IPFamily{corev1.IPv4Protocol}, &single, nil
+	case IPFamilyIPv6:
+		return []corev1.IPFamily{corev1.IPv6Protocol}, &single, nil
+	case IPFamilyDualStack:
+		return nil, &dual, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid IP family %q, use ipv4, ipv6 or dual", family)
+	}
+}
+
+// DefaultMeshExcludeOutboundPorts bypass the mesh sidecar by default, git over
+// SSH is a server speaks first protocol which stalls the sidecar's protocol detection
+var DefaultMeshExcludeOutboundPorts = []int{22}
+
+// toMeshCompatible keeps buildkitd from starting before the sidecar proxy can
+// route its traffic, and marks buildkitd as the container to exec into as the
+// sidecar may be injected ahead of it
+func toMeshCompatible(d *appsv1.Deployment, opt *DeploymentOpt) {
+	if d.Spec.Template.ObjectMeta.Annotations == nil {
+		d.Spec.Template.ObjectMeta.Annotations = make(map[string]string, 5)
+	}
+	annotations := d.Spec.Template.ObjectMeta.Annotations
+	annotations["kubectl.kubernetes.io/default-container"] = containerName
+	// Istio
+	annotations["proxy.istio.io/config"] = `{"holdApplicationUntilProxyStarts": true}`
+	// Linkerd
+	annotations["config.linkerd.io/proxy-await"] = "enabled"
+	if len(opt.MeshExcludeOutboundPorts) > 0 {
+		ports := make([]string, len(opt.MeshExcludeOutboundPorts))
+		for i, p := range opt.MeshExcludeOutboundPorts {
+			ports[i] = strconv.Itoa(p)
+		}
+		annotations["traffic.sidecar.istio.io/excludeOutboundPorts"] = strings.Join(ports, ",")
+		annotations["config.linkerd.io/skip-outbound-ports"] = strings.Join(ports, ",")
+	}
+}
+
+// addRunCacheMount mounts the claim the RUN cache mounts are persisted to.
+// The claim is shared by all replicas, so it needs a ReadWriteMany access
+// mode for builders with more than one replica.
+func addRunCacheMount(d *appsv1.Deployment, opt *DeploymentOpt) {
+	d.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+		d.Spec.Template.Spec.Containers[0].VolumeMounts,
+		corev1.VolumeMount{
+			Name:      "run-cache",
+			MountPath: RunCacheMountPath,
+		},
+	)
+	d.Spec.Template.Spec.Volumes = append(
+		d.Spec.Template.Spec.Volumes,
+		corev1.Volume{
+			Name: "run-cache",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: opt.RunCacheClaim,
+				},
+			},
+		},
+	)
+}
+
+// addHostPathMounts mounts the allowed host paths read-only, a node missing
+// one of the directories can't run the builder pods
+func addHostPathMounts(d *appsv1.Deployment, opt *DeploymentOpt) {
+	hostPathType := corev1.HostPathDirectory
+	for i, p := range opt.AllowHostPaths {
+		name := fmt.Sprintf("host-path-%d", i)
+		d.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+			d.Spec.Template.Spec.Containers[0].VolumeMounts,
+			corev1.VolumeMount{
+				Name:      name,
+				MountPath: path.Join(HostPathMountPath, p),
+				ReadOnly:  true,
+			},
+		)
+		d.Spec.Template.Spec.Volumes = append(
+			d.Spec.Template.Spec.Volumes,
+			corev1.Volume{
+				Name: name,
+				VolumeSource: corev1.VolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{
+						Path: p,
+						Type: &hostPathType,
+					},
+				},
+			},
+		)
+	}
+}
+
+// addOutputClaimMounts mounts the claims builds may write their image to.
+// The claims are shared by all replicas, so they need a ReadWriteMany access
+// mode for builders with more than one replica.
+func addOutputClaimMounts(d *appsv1.Deployment, opt *DeploymentOpt) {
+	for i, claim := range opt.OutputClaims {
+		name := fmt.Sprintf("output-claim-%d", i)
+		d.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+			d.Spec.Template.Spec.Containers[0].VolumeMounts,
+			corev1.VolumeMount{
+				Name:      name,
+				MountPath: path.Join(OutputClaimMountPath, claim),
+			},
+		)
+		d.Spec.Template.Spec.Volumes = append(
+			d.Spec.Template.Spec.Volumes,
+			corev1.Volume{
+				Name: name,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: claim,
+					},
+				},
+			},
+		)
+	}
+}
+
+// addScratchVolume stores the snapshots and cache of buildkitd on a generic
+// ephemeral volume, so large builds neither hit the ephemeral-storage limit
+// of the pod nor get the pod evicted under node disk pressure.  The volume is
+// provisioned with each pod and deleted with it.
+func addScratchVolume(d *appsv1.Deployment, opt *DeploymentOpt) error {
+	size, err := resource.ParseQuantity(opt.ScratchSize)
+	if err != nil {
+		return fmt.Errorf("invalid scratch size %q: %w", opt.ScratchSize, err)
+	}
+	d.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+		d.Spec.Template.Spec.Containers[0].VolumeMounts,
+		corev1.VolumeMount{
+			Name:      "scratch",
+			MountPath: statePath(d, opt),
+		},
+	)
+	claim := corev1.PersistentVolumeClaimSpec{
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceStorage: size,
+			},
+		},
+	}
+	if opt.ScratchStorageClass != "" {
+		claim.StorageClassName = &opt.ScratchStorageClass
+	}
+	d.Spec.Template.Spec.Volumes = append(
+		d.Spec.Template.Spec.Volumes,
+		corev1.Volume{
+			Name: "scratch",
+			VolumeSource: corev1.VolumeSource{
+				Ephemeral: &corev1.EphemeralVolumeSource{
+					VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{"app": opt.Name},
+						},
+						Spec: claim,
+					},
+				},
+			},
+		},
+	)
+	return nil
+}
+
+// statePath returns the directory of the buildkit state in the builder
+// pods, making volumes mounted there writable by the rootless user
+func statePath(d *appsv1.Deployment, opt *DeploymentOpt) string {
+	if !opt.Rootless {
+		return "/var/lib/buildkit"
+	}
+	// The rootless image runs as user 1000
+	if d.Spec.Template.Spec.SecurityContext == nil {
+		d.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	fsGroup := int64(1000)
+	d.Spec.Template.Spec.SecurityContext.FSGroup = &fsGroup
+	return "/home/user/.local/share/buildkit"
+}
+
+// CacheClaimName returns the name of the claim holding the buildkit state of
+// the builder name with CacheStoragePVC
+func CacheClaimName(name string) string {
+	return name + "-cache"
+}
+
+// NewCacheClaim returns the claim the builder keeps its buildkit state on, so
+// the layer cache survives the pod restarting or being rescheduled
+func NewCacheClaim(opt *DeploymentOpt) (*corev1.PersistentVolumeClaim, error) {
+	sizeStr := opt.CacheSize
+	if sizeStr == "" {
+		sizeStr = DefaultCacheSize
+	}
+	size, err := resource.ParseQuantity(sizeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache size %q: %w", sizeStr, err)
+	}
+	claim := &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "PersistentVolumeClaim",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: opt.Namespace,
+			Name:      CacheClaimName(opt.Name),
+			Labels:    map[string]string{"app": opt.Name, CacheClaimLabel: opt.Name},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+	if opt.CacheStorageClass != "" {
+		claim.Spec.StorageClassName = &opt.CacheStorageClass
+	}
+	return claim, nil
+}
+
+// addCacheVolume keeps the buildkit state on the claim of NewCacheClaim.  A
+// single buildkitd may use it at once, the old pod is stopped before its
+// replacement starts.
+func addCacheVolume(d *appsv1.Deployment, opt *DeploymentOpt) {
+	d.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	d.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+		d.Spec.Template.Spec.Containers[0].VolumeMounts,
+		corev1.VolumeMount{
+			Name:      CacheVolumeName,
+			MountPath: statePath(d, opt),
+		},
+	)
+	d.Spec.Template.Spec.Volumes = append(
+		d.Spec.Template.Spec.Volumes,
+		corev1.Volume{
+			Name: CacheVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: CacheClaimName(opt.Name),
+				},
+			},
+		},
+	)
+}
+
+func binfmtPlatforms(opt *DeploymentOpt) []string {
+	if len(opt.BinfmtPlatforms) == 0 {
+		return []string{BinfmtAll}
+	}
+	return opt.BinfmtPlatforms
+}
+
+// addBinfmtInstaller registers the QEMU emulators of BinfmtImage in the
+// kernel of the node before buildkitd starts, so it detects them.  The image
+// is mirrored by the user for disconnected clusters, it must run the binfmt
+// installer of tonistiigi/binfmt.  The handlers are kernel wide, registering
+// them needs a privileged container even for rootless builders.
+func addBinfmtInstaller(d *appsv1.Deployment, opt *DeploymentOpt) {
+	privileged := true
+	d.Spec.Template.Spec.InitContainers = append(
+		d.Spec.Template.Spec.InitContainers,
+		corev1.Container{
+			Name:  BinfmtContainerName,
+			Image: opt.BinfmtImage,
+			Args:  []string{"--install", strings.Join(binfmtPlatforms(opt), ",")},
+			SecurityContext: &corev1.SecurityContext{
+				Privileged: &privileged,
+			},
+		},
+	)
+}
+
+// BuilderContainer returns the buildkitd container of a builder pod, builders
+// created by older versions only have a single container
+func BuilderContainer(pod *corev1.Pod) string {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == containerName {
+			return c.Name
+		}
+	}
+	return pod.Spec.Containers[0].Name
+}
+
 func toRootless(d *appsv1.Deployment) error {
 	d.Spec.Template.Spec.Containers[0].Args = append(
 		d.Spec.Template.Spec.Containers[0].Args,
 		"--oci-worker-no-process-sandbox",
+		// Rootless buildkitd reads its config from the home of the user otherwise
+		"--config", "/etc/buildkit/"+ConfigFileName,
 	)
 	d.Spec.Template.Spec.Containers[0].SecurityContext = nil
 	if d.Spec.Template.ObjectMeta.Annotations == nil {
@@ -366,7 +1079,16 @@ func NewConfigMap(opt *DeploymentOpt, contents []byte) *corev1.ConfigMap {
 			Annotations: annotations(opt),
 		},
 		BinaryData: map[string][]byte{
-			"buildkitd.toml": contents,
+			ConfigFileName: contents,
 		},
 	}
 }
+
+// SetConfigDigest annotates the pods of d with the digest of the buildkitd
+// config, buildkitd only reads it on start so a different one rolls them
+func SetConfigDigest(d *appsv1.Deployment, contents []byte) {
+	if d.Spec.Template.ObjectMeta.Annotations == nil {
+		d.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+	}
+	d.Spec.Template.ObjectMeta.Annotations[ConfigDigestAnnotation] = digest.FromBytes(contents).String()
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// buildkitd serves its debug handlers on its debug address, and the BuildKit
+// images which export metrics serve them there at MetricsPath in the
+// Prometheus format.  A builder created with a metrics port has buildkitd
+// listen on it in the pod network and annotates its pods for the Prometheus
+// scrape configurations which discover pods by their prometheus.io
+// annotations.  The debug handlers have no authentication, the port is only
+// opened to the cluster network by the network policy of the builder.
+
+const (
+	// MetricsPortAnnotation records the metrics port of the builder pods
+	MetricsPortAnnotation = "buildkit.mobyproject.org/metrics-port"
+	// MetricsPath is where buildkitd serves its Prometheus metrics
+	MetricsPath = "/metrics"
+
+	metricsPortName = "metrics"
+)
+
+// addMetricsListener serves the debug address of buildkitd on
+// opt.MetricsPort and annotates the pods to be scraped
+func addMetricsListener(d *appsv1.Deployment, opt *DeploymentOpt) {
+	container := &d.Spec.Template.Spec.Containers[0]
+	container.Args = append(container.Args, "--debugaddr", "0.0.0.0:"+strconv.Itoa(opt.MetricsPort))
+	container.Ports = append(container.Ports, corev1.ContainerPort{
+		Name:          metricsPortName,
+		ContainerPort: int32(opt.MetricsPort),
+		Protocol:      corev1.ProtocolTCP,
+	})
+	if d.Spec.Template.ObjectMeta.Annotations == nil {
+		d.Spec.Template.ObjectMeta.Annotations = make(map[string]string, 3)
+	}
+	annotations := d.Spec.Template.ObjectMeta.Annotations
+	annotations["prometheus.io/scrape"] = "true"
+	annotations["prometheus.io/port"] = strconv.Itoa(opt.MetricsPort)
+	annotations["prometheus.io/path"] = MetricsPath
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A build namespace is dedicated to builders: a ResourceQuota caps what its
+// builders consume together and a LimitRange sizes the pods without requests
+// and limits, so the quota admits them.  The default network policy only
+// admits traffic from the pods of the namespace, each builder keeps its own
+// policy, and a Role grants the users of the builders what the CLI needs to
+// create them and run builds.  Reading the nodes, to load images on them, is
+// granted cluster wide and is left to the cluster administrators.
+
+const (
+	// NamespaceObjectsName names the quota, limit range, network policy and
+	// role of a build namespace
+	NamespaceObjectsName = "buildkit"
+
+	// DefaultNamespaceQuota is the recommended quota of a build namespace
+	DefaultNamespaceQuota = "requests.cpu=16,requests.memory=64Gi,limits.cpu=32,limits.memory=128Gi,pods=20,persistentvolumeclaims=20,requests.storage=500Gi"
+	// DefaultContainerRequests are the requests of the containers setting none
+	DefaultContainerRequests = "cpu=250m,memory=512Mi"
+	// DefaultContainerLimits are the limits of the containers setting none
+	DefaultContainerLimits = "cpu=4,memory=8Gi"
+	// DefaultContainerMax caps the limits of a container
+	DefaultContainerMax = "cpu=16,memory=64Gi"
+)
+
+// podSecurityLevels are the Pod Security Standards a namespace may enforce
+var podSecurityLevels = []string{"privileged", "baseline", SecurityProfileRestricted}
+
+// NamespaceOpt configures a build namespace
+type NamespaceOpt struct {
+	Name string
+
+	// PodSecurity is the Pod Security Standard the namespace enforces,
+	// unchanged if empty
+	PodSecurity string
+
+	Quota           corev1.ResourceList
+	DefaultRequests corev1.ResourceList
+	DefaultLimits   corev1.ResourceList
+	Max             corev1.ResourceList
+
+	// Users, Groups and ServiceAccounts ("name" in the namespace or
+	// "namespace:name") are bound to the builder role
+	Users           []string
+	Groups          []string
+	ServiceAccounts []string
+}
+
+// NamespaceObjects are the objects of a build namespace, RoleBinding is nil
+// without subjects
+type NamespaceObjects struct {
+	Namespace     *corev1.Namespace
+	Quota         *corev1.ResourceQuota
+	LimitRange    *corev1.LimitRange
+	NetworkPolicy *networkingv1.NetworkPolicy
+	Role          *rbacv1.Role
+	RoleBinding   *rbacv1.RoleBinding
+}
+
+// ParseQuota parses the hard limits of a ResourceQuota in the form
+// name=quantity[,name=quantity...], eg. requests.cpu=16,pods=20
+func ParseQuota(s string) (corev1.ResourceList, error) {
+	res := corev1.ResourceList{}
+	for _, field := range strings.Split(s, ",") {
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid quota %q, use name=quantity", field)
+		}
+		q, err := resource.ParseQuantity(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s quantity %q: %w", parts[0], parts[1], err)
+		}
+		res[corev1.ResourceName(parts[0])] = q
+	}
+	return res, nil
+}
+
+// NewNamespace returns the objects of the build namespace of opt
+func NewNamespace(opt *NamespaceOpt) (*NamespaceObjects, error) {
+	if opt.PodSecurity != "" && !stringIn(opt.PodSecurity, podSecurityLevels) {
+		return nil, fmt.Errorf("invalid pod security %q, use %s", opt.PodSecurity, strings.Join(podSecurityLevels, ", "))
+	}
+	subjects, err := namespaceSubjects(opt)
+	if err != nil {
+		return nil, err
+	}
+	meta := metav1.ObjectMeta{
+		Namespace: opt.Name,
+		Name:      NamespaceObjectsName,
+	}
+
+	ns := &corev1.Namespace{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Namespace",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   opt.Name,
+			Labels: map[string]string{},
+		},
+	}
+	if opt.PodSecurity != "" {
+		ns.Labels[PodSecurityEnforceLabel] = opt.PodSecurity
+	}
+
+	res := &NamespaceObjects{
+		Namespace: ns,
+		Quota: &corev1.ResourceQuota{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: corev1.SchemeGroupVersion.String(),
+				Kind:       "ResourceQuota",
+			},
+			ObjectMeta: meta,
+			Spec:       corev1.ResourceQuotaSpec{Hard: opt.Quota},
+		},
+		LimitRange: &corev1.LimitRange{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: corev1.SchemeGroupVersion.String(),
+				Kind:       "LimitRange",
+			},
+			ObjectMeta: meta,
+			Spec: corev1.LimitRangeSpec{
+				Limits: []corev1.LimitRangeItem{{
+					Type:           corev1.LimitTypeContainer,
+					Default:        opt.DefaultLimits,
+					DefaultRequest: opt.DefaultRequests,
+					Max:            opt.Max,
+				}},
+			},
+		},
+		NetworkPolicy: &networkingv1.NetworkPolicy{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: networkingv1.SchemeGroupVersion.String(),
+				Kind:       "NetworkPolicy",
+			},
+			ObjectMeta: meta,
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+				}},
+			},
+		},
+		Role: &rbacv1.Role{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "Role",
+			},
+			ObjectMeta: meta,
+			Rules:      builderRules(),
+		},
+	}
+	if len(subjects) > 0 {
+		res.RoleBinding = &rbacv1.RoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "RoleBinding",
+			},
+			ObjectMeta: meta,
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     NamespaceObjectsName,
+			},
+			Subjects: subjects,
+		}
+	}
+	return res, nil
+}
+
+// builderRules grant what the CLI uses to create builders, their companion
+// pods and registry secrets, and to run builds on them
+func builderRules() []rbacv1.PolicyRule {
+	manage := []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{"apps"},
+			Resources: []string{"deployments", "daemonsets", "statefulsets", "replicasets"},
+			Verbs:     manage,
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods", "services", "configmaps", "secrets", "persistentvolumeclaims"},
+			Verbs:     manage,
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods/exec", "pods/portforward"},
+			Verbs:     []string{"create"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods/log"},
+			Verbs:     []string{"get"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"events"},
+			Verbs:     []string{"get", "list", "watch", "create"},
+		},
+		{
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs:     manage,
+		},
+		{
+			APIGroups: []string{"networking.k8s.io"},
+			Resources: []string{"networkpolicies"},
+			Verbs:     manage,
+		},
+	}
+}
+
+func namespaceSubjects(opt *NamespaceOpt) ([]rbacv1.Subject, error) {
+	var subjects []rbacv1.Subject
+	for _, u := range opt.Users {
+		subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: u})
+	}
+	for _, g := range opt.Groups {
+		subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: g})
+	}
+	for _, sa := range opt.ServiceAccounts {
+		namespace, name := opt.Name, sa
+		if i := strings.Index(sa, ":"); i >= 0 {
+			namespace, name = sa[:i], sa[i+1:]
+		}
+		if namespace == "" || name == "" {
+			return nil, fmt.Errorf("invalid service account %q, use name or namespace:name", sa)
+		}
+		subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: name})
+	}
+	return subjects, nil
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
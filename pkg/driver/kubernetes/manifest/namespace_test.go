@@ -0,0 +1,65 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func Test_ParseQuota(t *testing.T) {
+	t.Parallel()
+	res, err := ParseQuota("requests.cpu=16,pods=20")
+	require.NoError(t, err)
+	require.Equal(t, corev1.ResourceList{
+		"requests.cpu": resource.MustParse("16"),
+		"pods":         resource.MustParse("20"),
+	}, res)
+	_, err = ParseQuota(DefaultNamespaceQuota)
+	require.NoError(t, err)
+	for _, in := range []string{"pods", "=1", "requests.memory=lots"} {
+		_, err := ParseQuota(in)
+		require.Error(t, err, in)
+	}
+}
+
+func Test_NewNamespace(t *testing.T) {
+	t.Parallel()
+	quota, err := ParseQuota(DefaultNamespaceQuota)
+	require.NoError(t, err)
+	opt := &NamespaceOpt{
+		Name:            "builds",
+		PodSecurity:     SecurityProfileRestricted,
+		Quota:           quota,
+		Groups:          []string{"team-a"},
+		ServiceAccounts: []string{"runner", "ci:deployer"},
+	}
+	objs, err := NewNamespace(opt)
+	require.NoError(t, err)
+	require.True(t, EnforcesRestricted(objs.Namespace.Labels))
+	require.Equal(t, "builds", objs.Quota.Namespace)
+	require.Equal(t, quota, objs.Quota.Spec.Hard)
+	require.Equal(t, corev1.LimitTypeContainer, objs.LimitRange.Spec.Limits[0].Type)
+	require.Len(t, objs.NetworkPolicy.Spec.Ingress, 1)
+	require.NotEmpty(t, objs.Role.Rules)
+	require.Equal(t, []rbacv1.Subject{
+		{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "team-a"},
+		{Kind: rbacv1.ServiceAccountKind, Namespace: "builds", Name: "runner"},
+		{Kind: rbacv1.ServiceAccountKind, Namespace: "ci", Name: "deployer"},
+	}, objs.RoleBinding.Subjects)
+
+	// Without subjects the role isn't bound
+	objs, err = NewNamespace(&NamespaceOpt{Name: "builds"})
+	require.NoError(t, err)
+	require.Empty(t, objs.Namespace.Labels)
+	require.Nil(t, objs.RoleBinding)
+
+	_, err = NewNamespace(&NamespaceOpt{Name: "builds", PodSecurity: "strict"})
+	require.Error(t, err)
+	_, err = NewNamespace(&NamespaceOpt{Name: "builds", ServiceAccounts: []string{"ci:"}})
+	require.Error(t, err)
+}
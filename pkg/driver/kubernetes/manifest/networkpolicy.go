@@ -0,0 +1,187 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// defaultEgressPorts are allowed to any destination when no egress
+// destinations are configured, covering registries and HTTP(S) proxies
+var defaultEgressPorts = []int{80, 443}
+
+// meshControlPlanePorts are the Istio (xDS) and Linkerd (identity, destination
+// and policy) ports the sidecar must reach in mesh compatible mode
+var meshControlPlanePorts = []int{15012, 8080, 8086, 8090}
+
+// EgressRule allows traffic to a CIDR, on a single TCP port if Port is set
+type EgressRule struct {
+	CIDR string
+	Port int
+}
+
+// ParseEgressRule parses "CIDR", "CIDR:port", "IP" or "IP:port", IPv6
+// addresses with a port must be bracketed as in [fd00::1]:5000
+func ParseEgressRule(s string) (EgressRule, error) {
+	var rule EgressRule
+	addr := s
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		if j := strings.Index(s[i:], ":"); j >= 0 {
+			addr = s[:i+j]
+			port, err := strconv.Atoi(s[i+j+1:])
+			if err != nil {
+				return rule, errors.Errorf("invalid port in egress rule %q", s)
+			}
+			rule.Port = port
+		}
+	} else if host, port, err := net.SplitHostPort(s); err == nil {
+		addr = host
+		if rule.Port, err = strconv.Atoi(port); err != nil {
+			return rule, errors.Errorf("invalid port in egress rule %q", s)
+		}
+	}
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return rule, errors.Errorf("invalid egress rule %q, network policies require an IP address or CIDR", s)
+		}
+		if ip.To4() != nil {
+			addr += "/32"
+		} else {
+			addr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return rule, errors.Errorf("invalid egress rule %q, network policies require an IP address or CIDR", s)
+	}
+	if rule.Port < 0 || rule.Port > 65535 {
+		return rule, errors.Errorf("invalid port in egress rule %q", s)
+	}
+	rule.CIDR = ipNet.String()
+	return rule, nil
+}
+
+// NewNetworkPolicy restricts the builder pods to no ingress, buildkit is only
+// reached through exec which the kubelet handles outside the pod network, and
+// egress to DNS plus the configured destinations or the egress proxy
+func NewNetworkPolicy(opt *DeploymentOpt) (*networkingv1.NetworkPolicy, error) {
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+	dns := intstr.FromInt(53)
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dns},
+				{Protocol: &tcp, Port: &dns},
+			},
+		},
+	}
+	if opt.MeshCompatible {
+		rule := networkingv1.NetworkPolicyEgressRule{}
+		for _, p := range meshControlPlanePorts {
+			port := intstr.FromInt(p)
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &port})
+		}
+		egress = append(egress, rule)
+	}
+	if ports := proxyPorts(opt); len(ports) > 0 {
+		rule := networkingv1.NetworkPolicyEgressRule{}
+		for _, p := range ports {
+			port := intstr.FromInt(p)
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &port})
+		}
+		egress = append(egress, rule)
+	}
+	if opt.SharedCache {
+		cache := intstr.FromInt(sharedCachePort)
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: sharedCacheLabels(opt)}}},
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &cache}},
+		})
+	}
+	if len(opt.EgressAllow) > 0 {
+		// Everything else has to go through the egress proxy, allowlisted
+		// CIDRs can be reached directly as the proxy can't match them by name
+		proxy := intstr.FromInt(egressProxyPort)
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: egressProxyLabels(opt)}}},
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &proxy}},
+		})
+		_, cidrs, err := splitEgressAllow(opt.EgressAllow)
+		if err != nil {
+			return nil, err
+		}
+		for _, cidr := range cidrs {
+			egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+				To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: cidr}}},
+			})
+		}
+	} else if len(opt.NetworkPolicyEgress) == 0 {
+		rule := networkingv1.NetworkPolicyEgressRule{}
+		for _, p := range defaultEgressPorts {
+			port := intstr.FromInt(p)
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &port})
+		}
+		egress = append(egress, rule)
+	}
+	for _, s := range opt.NetworkPolicyEgress {
+		r, err := ParseEgressRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rule := networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: r.CIDR}}},
+		}
+		if r.Port != 0 {
+			port := intstr.FromInt(r.Port)
+			rule.Ports = []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}}
+		}
+		egress = append(egress, rule)
+	}
+
+	ingress := []networkingv1.NetworkPolicyIngressRule{}
+	if opt.Transport == TransportTCP || opt.AdminService {
+		// Only clients with a certificate of the CA get past the TLS listener
+		port := intstr.FromInt(TLSPort)
+		ingress = append(ingress, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+		})
+	}
+	if opt.MetricsPort > 0 {
+		// Scraped by Prometheus from within the cluster
+		port := intstr.FromInt(opt.MetricsPort)
+		ingress = append(ingress, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+		})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1.SchemeGroupVersion.String(),
+			Kind:       "NetworkPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   opt.Namespace,
+			Name:        opt.Name,
+			Labels:      labels(opt),
+			Annotations: annotations(opt),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": opt.Name},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Ingress:     ingress,
+			Egress:      egress,
+		},
+	}, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The package proxy is a caching squid sidecar of the builder pods.  RUN
+// steps share the network of the pod, builds get the proxy on the loopback
+// address as their predefined proxy args, so the packages apt, apk or pip
+// download over plain HTTP are cached in the pod for the next builds.  HTTPS
+// downloads are only tunnelled through it.  With an egress allowlist, the
+// package proxy forwards everything to the egress proxy, or else to the HTTP
+// proxy of the builder.
+
+const (
+	// PackageProxyAnnotation records the URL of the package proxy on the builder deployment
+	PackageProxyAnnotation = "buildkit.mobyproject.org/package-proxy"
+	// DefaultPackageProxySize is the size of the cache of the package proxy
+	DefaultPackageProxySize = "10Gi"
+
+	packageProxyContainerName = "package-proxy"
+	packageProxyPort          = 3129
+	packageProxyVolumeName    = "package-proxy-cache"
+	packageProxyCacheDir      = "/var/spool/squid"
+)
+
+// PackageProxyURL is the address of the package proxy for the builds
+func PackageProxyURL() string {
+	return fmt.Sprintf("http://127.0.0.1:%d", packageProxyPort)
+}
+
+// packageProxySize returns the size of the cache of the package proxy
+func packageProxySize(opt *DeploymentOpt) (resource.Quantity, error) {
+	s := opt.PackageProxySize
+	if s == "" {
+		s = DefaultPackageProxySize
+	}
+	size, err := resource.ParseQuantity(s)
+	if err != nil {
+		return size, fmt.Errorf("invalid package proxy size %q: %w", s, err)
+	}
+	return size, nil
+}
+
+// packageProxyConfig renders the squid configuration of the package proxy,
+// caching up to size bytes
+func packageProxyConfig(opt *DeploymentOpt, size int64) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "http_port %d\n", packageProxyPort)
+	sb.WriteString("acl SSL_ports port 443\n")
+	sb.WriteString("acl CONNECT method CONNECT\n")
+	sb.WriteString("http_access deny CONNECT !SSL_ports\n")
+	// Only the builds of the pod are served, from the loopback address
+	sb.WriteString("http_access allow localhost\n")
+	sb.WriteString("http_access deny all\n")
+	if len(opt.EgressAllow) > 0 {
+		fmt.Fprintf(&sb, "cache_peer %s parent %d 0 no-query default\n", EgressProxyName(opt), egressProxyPort)
+		sb.WriteString("never_direct allow all\n")
+	} else if peer := proxyPeer(opt); peer != "" {
+		sb.WriteString(peer + "\n")
+		sb.WriteString("never_direct allow all\n")
+	}
+	// Leave room under the size limit of the volume for the index of squid
+	fmt.Fprintf(&sb, "cache_dir ufs %s %d 16 256\n", packageProxyCacheDir, size*9/10/(1<<20))
+	sb.WriteString("maximum_object_size 1 GB\n")
+	// Package files never change once published, their indexes do
+	sb.WriteString("refresh_pattern -i \\.(deb|udeb|rpm|apk|whl|tgz|gem|jar|zip)$ 129600 100% 129600 refresh-ims\n")
+	sb.WriteString("refresh_pattern . 0 20% 4320\n")
+	sb.WriteString("pid_filename none\n")
+	sb.WriteString("access_log stdio:/dev/stdout\n")
+	sb.WriteString("cache_log stdio:/dev/stderr\n")
+	return sb.String()
+}
+
+// addPackageProxy runs the package proxy next to buildkitd, its cache on an
+// emptyDir volume of the pod
+func addPackageProxy(d *appsv1.Deployment, opt *DeploymentOpt) error {
+	size, err := packageProxySize(opt)
+	if err != nil {
+		return err
+	}
+	image := opt.PackageProxyImage
+	if image == "" {
+		image = DefaultEgressProxyImage
+	}
+	config := packageProxyConfig(opt, size.Value())
+	container := corev1.Container{
+		Name:  packageProxyContainerName,
+		Image: image,
+		// The configuration is written to the cache volume, the root
+		// filesystem may be read-only
+		Command: []string{"sh", "-c", `printf '%s' "$SQUID_CONFIG" > ` + packageProxyCacheDir + `/squid.conf && ` +
+			`squid -N -z -f ` + packageProxyCacheDir + `/squid.conf && ` +
+			`exec squid -N -f ` + packageProxyCacheDir + `/squid.conf`},
+		Env: []corev1.EnvVar{{Name: "SQUID_CONFIG", Value: config}},
+		ReadinessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(packageProxyPort)},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{{Name: packageProxyVolumeName, MountPath: packageProxyCacheDir}},
+	}
+	if opt.ReadOnlyRootFS {
+		readOnly := true
+		container.SecurityContext = &corev1.SecurityContext{ReadOnlyRootFilesystem: &readOnly}
+	}
+	d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, container)
+	d.Spec.Template.Spec.Volumes = append(d.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: packageProxyVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &size},
+		},
+	})
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// PatchDeployment applies a user supplied patch to the generated builder
+// deployment.  A YAML or JSON list is applied as a JSON patch (RFC 6902),
+// anything else as a strategic merge patch of the Deployment, eg. merging
+// containers and their env by name.
+func PatchDeployment(d *appsv1.Deployment, patch []byte) (*appsv1.Deployment, error) {
+	patchJSON, err := yaml.ToJSON(patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse patch")
+	}
+	orig, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	if bytes.HasPrefix(bytes.TrimSpace(patchJSON), []byte("[")) {
+		p, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid JSON patch")
+		}
+		if patched, err = p.Apply(orig); err != nil {
+			return nil, errors.Wrap(err, "failed to apply JSON patch")
+		}
+	} else {
+		if patched, err = strategicpatch.StrategicMergePatch(orig, patchJSON, appsv1.Deployment{}); err != nil {
+			return nil, errors.Wrap(err, "failed to apply strategic merge patch")
+		}
+	}
+
+	res := &appsv1.Deployment{}
+	if err := json.Unmarshal(patched, res); err != nil {
+		return nil, errors.Wrap(err, "patched deployment is invalid")
+	}
+	// The driver looks the builder up by name and label, and execs into buildkitd
+	if res.Name != d.Name || res.Namespace != d.Namespace {
+		return nil, errors.Errorf("patch must not change the name or namespace of the builder")
+	}
+	if res.Spec.Selector == nil || res.Spec.Selector.MatchLabels["app"] != d.Spec.Selector.MatchLabels["app"] ||
+		res.Spec.Template.Labels["app"] != d.Spec.Template.Labels["app"] {
+		return nil, errors.Errorf("patch must not change the app label of the builder")
+	}
+	// A strategic merge patch lists the containers it names first, buildkitd
+	// is moved back to the front
+	containers := res.Spec.Template.Spec.Containers
+	for i, c := range containers {
+		if c.Name == containerName {
+			copy(containers[1:i+1], containers[:i])
+			containers[0] = c
+			break
+		}
+	}
+	if len(containers) == 0 || containers[0].Name != containerName {
+		return nil, errors.Errorf("patch must keep the %s container in the pod template", containerName)
+	}
+	return res, nil
+}
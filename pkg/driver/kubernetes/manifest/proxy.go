@@ -0,0 +1,104 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Clusters behind a corporate proxy set HTTPProxy, HTTPSProxy and NoProxy on
+// the builder.  buildkitd pulls the base images and frontends through the
+// proxy, and the builds get it as their predefined proxy args, recorded on
+// the deployment for them.  The package proxy forwards to the HTTP proxy.
+// The egress proxy is the proxy of the builder with an allowlist, the two
+// can't be combined.
+
+const (
+	// HTTPProxyAnnotation records the HTTP proxy of the builder on the deployment
+	HTTPProxyAnnotation = "buildkit.mobyproject.org/http-proxy"
+	// HTTPSProxyAnnotation records the HTTPS proxy of the builder on the deployment
+	HTTPSProxyAnnotation = "buildkit.mobyproject.org/https-proxy"
+	// NoProxyAnnotation records the hosts reached without the proxy on the deployment
+	NoProxyAnnotation = "buildkit.mobyproject.org/no-proxy"
+)
+
+// ParseProxyURL checks the address of a proxy, a URL with a host like
+// http://proxy.example.com:3128
+func ParseProxyURL(in string) (*url.URL, error) {
+	u, err := url.Parse(in)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("invalid proxy %q, use a URL like http://proxy.example.com:3128", in)
+	}
+	return u, nil
+}
+
+// hasProxy is set if the builder pods go through a proxy of their own
+func hasProxy(opt *DeploymentOpt) bool {
+	return opt.HTTPProxy != "" || opt.HTTPSProxy != ""
+}
+
+// noProxy lists the hosts buildkitd reaches directly when it goes through a
+// proxy, the addresses of the pod and the shared cache are always listed
+func noProxy(opt *DeploymentOpt) string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if opt.SharedCache {
+		hosts = append(hosts, SharedCacheName(opt))
+	}
+	for _, h := range strings.Split(opt.NoProxy, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return strings.Join(hosts, ",")
+}
+
+// proxyPorts are the ports of the proxies, the network policy lets the pods
+// reach them as the proxies may be known by name only
+func proxyPorts(opt *DeploymentOpt) []int {
+	var ports []int
+	for _, p := range []string{opt.HTTPProxy, opt.HTTPSProxy} {
+		if port := proxyPort(p); port > 0 && (len(ports) == 0 || ports[0] != port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+func proxyPort(proxy string) int {
+	u, err := ParseProxyURL(proxy)
+	if err != nil {
+		return 0
+	}
+	if p, err := strconv.Atoi(u.Port()); err == nil {
+		return p
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// proxyPeer returns the squid cache_peer line of the package proxy
+// forwarding to the HTTP proxy of the builder, the HTTPS proxy without one
+func proxyPeer(opt *DeploymentOpt) string {
+	proxy := opt.HTTPProxy
+	if proxy == "" {
+		proxy = opt.HTTPSProxy
+	}
+	u, err := ParseProxyURL(proxy)
+	if err != nil {
+		return ""
+	}
+	line := "cache_peer " + u.Hostname() + " parent " + strconv.Itoa(proxyPort(proxy)) + " 0 no-query default"
+	if u.Scheme == "https" {
+		line += " tls"
+	}
+	if u.User != nil {
+		line += " login=" + u.User.String()
+	}
+	return line
+}
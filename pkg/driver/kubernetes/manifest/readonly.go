@@ -0,0 +1,136 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Admission policies may require containers to run with a read-only root
+// filesystem.  buildkitd then only writes to emptyDir volumes declared for
+// its state, its socket and the temporary files of builds, or to the volumes
+// other options mount in their place.
+
+// ReadOnlyRootFSWritablePaths are the directories kept writable for
+// buildkitd with a read-only root filesystem
+func ReadOnlyRootFSWritablePaths(opt *DeploymentOpt) []string {
+	paths := []string{"/var/lib/buildkit", "/run", "/tmp"}
+	if opt.Rootless {
+		paths = []string{"/home/user/.local/share/buildkit", "/run/user/1000", "/tmp"}
+	}
+	return append(paths, opt.WritablePaths...)
+}
+
+// CheckReadOnlyRootFS returns an error listing each option of opt having
+// buildkitd write outside of the writable paths
+func CheckReadOnlyRootFS(opt *DeploymentOpt) error {
+	writable := ReadOnlyRootFSWritablePaths(opt)
+	var problems []string
+	for _, w := range buildkitdWrites(opt) {
+		if !underAny(path.Clean(w.dir), writable) {
+			problems = append(problems, fmt.Sprintf("%s %s is read-only, add it to the writable paths", w.option, w.dir))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("read-only-root-fs: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// buildkitdWrite is a directory buildkitd writes to, set by option
+type buildkitdWrite struct {
+	option, dir string
+}
+
+// buildkitdWrites returns the directories the flags and the configuration of
+// opt have buildkitd write to, other than its defaults
+func buildkitdWrites(opt *DeploymentOpt) []buildkitdWrite {
+	var res []buildkitdWrite
+	for i, flag := range opt.BuildkitFlags {
+		name, value := flag, ""
+		if j := strings.Index(flag, "="); j >= 0 {
+			name, value = flag[:j], flag[j+1:]
+		} else if i+1 < len(opt.BuildkitFlags) {
+			value = opt.BuildkitFlags[i+1]
+		}
+		switch {
+		case name == "--root":
+			res = append(res, buildkitdWrite{"buildkitd --root", value})
+		case name == "--addr" && strings.HasPrefix(value, "unix://"):
+			res = append(res, buildkitdWrite{"the socket directory of buildkitd --addr", path.Dir(strings.TrimPrefix(value, "unix://"))})
+		}
+	}
+	if root := configRoot(opt.CustomConfig); root != "" {
+		res = append(res, buildkitdWrite{"the root of the buildkitd config", root})
+	}
+	return res
+}
+
+// configRoot returns the root directory set by the buildkitd configuration,
+// its top-level root key
+func configRoot(config string) string {
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			// The keys of the tables follow
+			return ""
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "root" {
+			return strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		}
+	}
+	return ""
+}
+
+func toReadOnlyRootFS(d *appsv1.Deployment, opt *DeploymentOpt) {
+	container := &d.Spec.Template.Spec.Containers[0]
+	if container.SecurityContext == nil {
+		// Rootless builders don't have a security context
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	readOnly := true
+	container.SecurityContext.ReadOnlyRootFilesystem = &readOnly
+	// The emulator installer only writes to the binfmt_misc filesystem
+	for i := range d.Spec.Template.Spec.InitContainers {
+		if c := &d.Spec.Template.Spec.InitContainers[i]; c.Name == BinfmtContainerName {
+			c.SecurityContext.ReadOnlyRootFilesystem = &readOnly
+		}
+	}
+	mounted := map[string]bool{}
+	for _, m := range container.VolumeMounts {
+		mounted[path.Clean(m.MountPath)] = true
+	}
+	for i, p := range ReadOnlyRootFSWritablePaths(opt) {
+		if mounted[path.Clean(p)] {
+			continue
+		}
+		name := fmt.Sprintf("writable-%d", i)
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: p,
+		})
+		d.Spec.Template.Spec.Volumes = append(d.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+}
+
+// underAny reports whether p is one of the dirs, or below one
+func underAny(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// A builder may have replica classes next to its own pods, each a Deployment
+// of pods with their own resource requests.  The pods of all classes carry the
+// app label of the builder so they're listed with it, the replica class label
+// tells them apart.  The ReplicaSets of the deployments select their pods by
+// template hash, so the overlapping selector of the builder deployment doesn't
+// make them fight over pods.
+
+const (
+	// ReplicaClassLabel names the replica class of a builder pod and deployment
+	ReplicaClassLabel = "buildkit.mobyproject.org/replica-class"
+	// ReplicaClassesAnnotation records the replica classes of a builder, comma separated
+	ReplicaClassesAnnotation = "buildkit.mobyproject.org/replica-classes"
+)
+
+var replicaClassNameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// ReplicaClass is a set of builder pods builds request by name
+type ReplicaClass struct {
+	Name     string
+	Replicas int
+	Requests corev1.ResourceList
+}
+
+// ParseReplicaClass parses name=<class>,replicas=<n>[,cpu=<quantity>][,memory=<quantity>]
+func ParseReplicaClass(s string) (ReplicaClass, error) {
+	c := ReplicaClass{Replicas: 1, Requests: corev1.ResourceList{}}
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return c, fmt.Errorf("invalid replica class field %q", field)
+		}
+		switch parts[0] {
+		case "name":
+			c.Name = parts[1]
+		case "replicas":
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return c, fmt.Errorf("invalid replica class replicas %q", parts[1])
+			}
+			c.Replicas = n
+		case "cpu", "memory":
+			q, err := resource.ParseQuantity(parts[1])
+			if err != nil {
+				return c, fmt.Errorf("invalid replica class %s %q: %w", parts[0], parts[1], err)
+			}
+			c.Requests[corev1.ResourceName(parts[0])] = q
+		default:
+			return c, fmt.Errorf("unknown replica class field %q", parts[0])
+		}
+	}
+	if !replicaClassNameRe.MatchString(c.Name) {
+		return c, fmt.Errorf("invalid replica class name %q, use lower case letters, digits and dashes", c.Name)
+	}
+	return c, nil
+}
+
+// ReplicaClassDeploymentName is the name of the deployment of a replica class
+func ReplicaClassDeploymentName(builder, class string) string {
+	return builder + "-" + class
+}
+
+// NewReplicaClassDeployment derives the deployment of a replica class from
+// the builder deployment d
+func NewReplicaClassDeployment(d *appsv1.Deployment, c ReplicaClass) *appsv1.Deployment {
+	res := d.DeepCopy()
+	res.Name = ReplicaClassDeploymentName(d.Name, c.Name)
+	delete(res.Annotations, ReplicaClassesAnnotation)
+	replicas := int32(c.Replicas)
+	res.Spec.Replicas = &replicas
+	res.Labels[ReplicaClassLabel] = c.Name
+	res.Spec.Selector.MatchLabels[ReplicaClassLabel] = c.Name
+	res.Spec.Template.Labels[ReplicaClassLabel] = c.Name
+	container := &res.Spec.Template.Spec.Containers[0]
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+	for name, q := range c.Requests {
+		container.Resources.Requests[name] = q
+	}
+	return res
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_ParseReplicaClass(t *testing.T) {
+	t.Parallel()
+	c, err := ParseReplicaClass("name=large,replicas=2,cpu=8,memory=32Gi")
+	require.NoError(t, err)
+	require.Equal(t, "large", c.Name)
+	require.Equal(t, 2, c.Replicas)
+	require.Equal(t, "8", c.Requests.Cpu().String())
+	require.Equal(t, "32Gi", c.Requests.Memory().String())
+
+	for _, s := range []string{"replicas=2", "name=Large", "name=large,replicas=-1", "name=large,gpu=1", "name=large,cpu=lots"} {
+		_, err := ParseReplicaClass(s)
+		require.Error(t, err, s)
+	}
+}
+
+func Test_NewReplicaClassDeployment(t *testing.T) {
+	t.Parallel()
+	c, err := ParseReplicaClass("name=large,replicas=2,cpu=8")
+	require.NoError(t, err)
+	d, err := NewDeployment(&DeploymentOpt{Name: "buildkit", Replicas: 4, ReplicaClasses: []ReplicaClass{c}})
+	require.NoError(t, err)
+	require.Equal(t, "large", d.Annotations[ReplicaClassesAnnotation])
+
+	cd := NewReplicaClassDeployment(d, c)
+	require.Equal(t, "buildkit-large", cd.Name)
+	require.Equal(t, int32(2), *cd.Spec.Replicas)
+	require.NotContains(t, cd.Annotations, ReplicaClassesAnnotation)
+	require.Equal(t, map[string]string{"app": "buildkit", ReplicaClassLabel: "large"}, cd.Spec.Selector.MatchLabels)
+	require.Equal(t, "large", cd.Spec.Template.Labels[ReplicaClassLabel])
+	require.Equal(t, "8", cd.Spec.Template.Spec.Containers[0].Resources.Requests.Cpu().String())
+
+	// The builder deployment is left alone
+	require.Equal(t, int32(4), *d.Spec.Replicas)
+	require.NotContains(t, d.Spec.Template.Labels, ReplicaClassLabel)
+	require.Empty(t, d.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU])
+}
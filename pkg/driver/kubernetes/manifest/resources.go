@@ -0,0 +1,86 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ParseResourceList parses the requests or limits of the builder pods in
+// the form cpu=<quantity>,memory=<quantity>[,ephemeral-storage=<quantity>]
+func ParseResourceList(s string) (corev1.ResourceList, error) {
+	res := corev1.ResourceList{}
+	for _, field := range strings.Split(s, ",") {
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid resource %q, use name=quantity", field)
+		}
+		switch corev1.ResourceName(parts[0]) {
+		case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+		default:
+			return nil, fmt.Errorf("unsupported resource %q, use cpu, memory or ephemeral-storage", parts[0])
+		}
+		q, err := resource.ParseQuantity(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s quantity %q: %w", parts[0], parts[1], err)
+		}
+		res[corev1.ResourceName(parts[0])] = q
+	}
+	return res, nil
+}
+
+// addResources sets the requests and limits of buildkitd and the priority
+// class of the builder pods
+func addResources(d *appsv1.Deployment, opt *DeploymentOpt) {
+	container := &d.Spec.Template.Spec.Containers[0]
+	for name, q := range opt.Requests {
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = q
+	}
+	for name, q := range opt.Limits {
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = corev1.ResourceList{}
+		}
+		container.Resources.Limits[name] = q
+	}
+	d.Spec.Template.Spec.PriorityClassName = opt.PriorityClassName
+}
+
+// SetResources sets the requests and limits of buildkitd and the priority
+// class of the pods of d to those of desired, it returns false if they are
+// the same already
+func SetResources(d, desired *appsv1.Deployment) bool {
+	container := &d.Spec.Template.Spec.Containers[0]
+	want := desired.Spec.Template.Spec.Containers[0].Resources
+	if resourceListEqual(container.Resources.Requests, want.Requests) &&
+		resourceListEqual(container.Resources.Limits, want.Limits) &&
+		d.Spec.Template.Spec.PriorityClassName == desired.Spec.Template.Spec.PriorityClassName {
+		return false
+	}
+	container.Resources.Requests = want.Requests.DeepCopy()
+	container.Resources.Limits = want.Limits.DeepCopy()
+	d.Spec.Template.Spec.PriorityClassName = desired.Spec.Template.Spec.PriorityClassName
+	return true
+}
+
+func resourceListEqual(a, b corev1.ResourceList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, q := range a {
+		if other, ok := b[name]; !ok || q.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
+}
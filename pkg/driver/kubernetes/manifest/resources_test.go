@@ -0,0 +1,49 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func Test_ParseResourceList(t *testing.T) {
+	t.Parallel()
+	res, err := ParseResourceList("cpu=500m,memory=4Gi")
+	require.NoError(t, err)
+	require.Equal(t, corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("500m"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+	}, res)
+	for _, in := range []string{"cpu", "gpu=1", "memory=lots"} {
+		_, err := ParseResourceList(in)
+		require.Error(t, err, in)
+	}
+}
+
+func Test_SetResources(t *testing.T) {
+	t.Parallel()
+	requests, err := ParseResourceList("cpu=2,memory=4Gi")
+	require.NoError(t, err)
+	limits, err := ParseResourceList("memory=8Gi")
+	require.NoError(t, err)
+	opt := &DeploymentOpt{Name: "buildkit", Requests: requests, Limits: limits, PriorityClassName: "builds"}
+	desired, err := NewDeployment(opt)
+	require.NoError(t, err)
+	require.Equal(t, requests, desired.Spec.Template.Spec.Containers[0].Resources.Requests)
+	require.Equal(t, limits, desired.Spec.Template.Spec.Containers[0].Resources.Limits)
+	require.Equal(t, "builds", desired.Spec.Template.Spec.PriorityClassName)
+
+	live, err := NewDeployment(&DeploymentOpt{Name: "buildkit"})
+	require.NoError(t, err)
+	require.True(t, SetResources(live, desired))
+	require.Equal(t, desired.Spec.Template.Spec, live.Spec.Template.Spec)
+	require.False(t, SetResources(live, desired))
+
+	// Equal quantities in another form don't roll the pods
+	live.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("2000m")
+	require.False(t, SetResources(live, desired))
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The restricted security profile makes the builder admissible in namespaces
+// enforcing the restricted Pod Security Standard: buildkitd runs rootless
+// with a read-only root filesystem, as a non-root user without added
+// capabilities or privilege escalation, under the RuntimeDefault seccomp
+// profile or a Localhost one installed on the nodes.  Rootless buildkitd
+// creates user namespaces for the builds, which the RuntimeDefault profile
+// of most runtimes denies, a Localhost profile allowing unshare and mount
+// is then needed.  The companion pods of the builder get the same security
+// context.  With the auto profile the driver creates a restricted builder in
+// the namespaces enforcing the standard, see EnforcesRestricted.
+
+const (
+	// SecurityProfileAuto creates a restricted builder in the namespaces enforcing the restricted standard
+	SecurityProfileAuto = "auto"
+	// SecurityProfileDefault creates the builder as configured, privileged unless rootless
+	SecurityProfileDefault = "default"
+	// SecurityProfileRestricted complies with the restricted Pod Security Standard
+	SecurityProfileRestricted = "restricted"
+
+	// PodSecurityEnforceLabel is the namespace label of the Pod Security Standard admission enforces
+	PodSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+
+	// restrictedUser is the user of the rootless image
+	restrictedUser = int64(1000)
+)
+
+// EnforcesRestricted reports whether the namespace of labels admits only pods
+// complying with the restricted Pod Security Standard
+func EnforcesRestricted(labels map[string]string) bool {
+	return labels[PodSecurityEnforceLabel] == SecurityProfileRestricted
+}
+
+// CheckRestricted returns an error for the options needing privileges the
+// restricted profile doesn't grant
+func CheckRestricted(opt *DeploymentOpt) error {
+	switch {
+	case !opt.Rootless:
+		return fmt.Errorf("security-profile %s requires rootless", SecurityProfileRestricted)
+	case opt.Worker == "containerd":
+		return fmt.Errorf("security-profile %s can't use the containerd socket of the nodes, use the runc worker", SecurityProfileRestricted)
+	case len(opt.AllowHostPaths) > 0:
+		return fmt.Errorf("security-profile %s can't mount host paths", SecurityProfileRestricted)
+	case opt.BinfmtImage != "":
+		return fmt.Errorf("security-profile %s can't install emulators, they need a privileged container", SecurityProfileRestricted)
+	}
+	return nil
+}
+
+// restrictPodSpec sets the security contexts of the restricted profile on the
+// pod and each of its containers
+func restrictPodSpec(spec *corev1.PodSpec, opt *DeploymentOpt) {
+	nonRoot := true
+	noEscalation := false
+	user := restrictedUser
+	seccomp := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	if opt.SeccompProfile != "" {
+		profile := opt.SeccompProfile
+		seccomp = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}
+	}
+	spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsNonRoot:   &nonRoot,
+		RunAsUser:      &user,
+		RunAsGroup:     &user,
+		FSGroup:        &user,
+		SeccompProfile: seccomp,
+	}
+	restrict := func(c *corev1.Container) {
+		if c.SecurityContext == nil {
+			c.SecurityContext = &corev1.SecurityContext{}
+		}
+		c.SecurityContext.Privileged = nil
+		c.SecurityContext.AllowPrivilegeEscalation = &noEscalation
+		c.SecurityContext.RunAsNonRoot = &nonRoot
+		c.SecurityContext.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+	}
+	for i := range spec.InitContainers {
+		restrict(&spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		restrict(&spec.Containers[i])
+	}
+}
+
+// toRestricted applies the restricted profile to the builder, replacing the
+// unconfined profiles of rootless builders
+func toRestricted(d *appsv1.Deployment, opt *DeploymentOpt) {
+	restrictPodSpec(&d.Spec.Template.Spec, opt)
+	annotations := d.Spec.Template.ObjectMeta.Annotations
+	delete(annotations, "container.apparmor.security.beta.kubernetes.io/"+containerName)
+	delete(annotations, "container.seccomp.security.alpha.kubernetes.io/"+containerName)
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The nodes report their container runtime in their node info, eg.
+// containerd://1.6.8.  A builder of the auto runtime is created for the
+// runtime of the nodes it may run on.  On a cluster mixing runtimes, the
+// builder pods are kept to the nodes of the most common runtime, and a
+// runtime deployment of the builder per other runtime runs pods mounting the
+// socket of that runtime on its nodes.  The runtime label of each pod tells
+// which runtime images are loaded into through it.  CRI-O keeps its images in
+// containers/storage buildkitd can't write to, the pods on CRI-O nodes use
+// the runc worker and images aren't loaded on their nodes.
+
+const (
+	RuntimeContainerd = "containerd"
+	RuntimeDocker     = "docker"
+	RuntimeCRIO       = "cri-o"
+
+	// RuntimeDeploymentLabel names the runtime of a runtime deployment
+	RuntimeDeploymentLabel = "buildkit.mobyproject.org/runtime-deployment"
+	// RuntimesAnnotation records the runtimes of the runtime deployments of a builder, comma separated
+	RuntimesAnnotation = "buildkit.mobyproject.org/runtimes"
+)
+
+// runtimePreference orders the runtimes used by as many nodes
+var runtimePreference = []string{RuntimeContainerd, RuntimeDocker, RuntimeCRIO}
+
+// NodeRuntime returns the runtime of a node from its container runtime
+// version, empty if it isn't one the builder supports
+func NodeRuntime(version string) string {
+	name := strings.SplitN(version, "://", 2)[0]
+	for _, r := range runtimePreference {
+		if name == r {
+			return r
+		}
+	}
+	return ""
+}
+
+// SchedulableNode reports whether the builder pods of opt may run on node,
+// by the node selector and the taints they tolerate
+func SchedulableNode(opt *DeploymentOpt, node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for k, v := range opt.NodeSelector {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range opt.Tolerations {
+			if opt.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// PrimaryRuntime is the runtime of the most nodes of runtimeNodes
+func PrimaryRuntime(runtimeNodes map[string][]string) string {
+	primary := ""
+	for _, r := range runtimePreference {
+		if len(runtimeNodes[r]) > len(runtimeNodes[primary]) {
+			primary = r
+		}
+	}
+	return primary
+}
+
+// SortedRuntimes lists the runtimes of runtimeNodes in order of preference
+func SortedRuntimes(runtimeNodes map[string][]string) []string {
+	var res []string
+	for _, r := range runtimePreference {
+		if len(runtimeNodes[r]) > 0 {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// RuntimeDeploymentName is the name of the runtime deployment of a builder
+func RuntimeDeploymentName(builder, runtime string) string {
+	return builder + "-" + strings.Replace(runtime, "-", "", -1)
+}
+
+// NewRuntimeDeployment names the deployment d, created for the runtime of
+// opt, as the runtime deployment of the builder.  Its pods carry the runtime
+// deployment label, like those of replica classes their own label.
+func NewRuntimeDeployment(d *appsv1.Deployment, opt *DeploymentOpt, nodes []string) *appsv1.Deployment {
+	d.Name = RuntimeDeploymentName(opt.Name, opt.ContainerRuntime)
+	d.Labels[RuntimeDeploymentLabel] = opt.ContainerRuntime
+	d.Spec.Selector.MatchLabels[RuntimeDeploymentLabel] = opt.ContainerRuntime
+	d.Spec.Template.Labels[RuntimeDeploymentLabel] = opt.ContainerRuntime
+	delete(d.Annotations, ReplicaClassesAnnotation)
+	PinToNodes(d, nodes)
+	return d
+}
+
+// PinToNodes keeps the pods of d to the nodes of the hostnames, in addition
+// to the node affinity they have
+func PinToNodes(d *appsv1.Deployment, hostnames []string) {
+	values := append([]string{}, hostnames...)
+	sort.Strings(values)
+	req := corev1.NodeSelectorRequirement{
+		Key:      corev1.LabelHostname,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   values,
+	}
+	spec := &d.Spec.Template.Spec
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := spec.Affinity.NodeAffinity
+	if na.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		na.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	terms := &na.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(*terms) == 0 {
+		*terms = []corev1.NodeSelectorTerm{{}}
+	}
+	// The terms are ORed, each of them must keep to the nodes
+	for i := range *terms {
+		(*terms)[i].MatchExpressions = append((*terms)[i].MatchExpressions, req)
+	}
+}
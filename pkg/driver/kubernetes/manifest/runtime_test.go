@@ -0,0 +1,68 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_NodeRuntime(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, RuntimeContainerd, NodeRuntime("containerd://1.6.8"))
+	require.Equal(t, RuntimeDocker, NodeRuntime("docker://20.10.17"))
+	require.Equal(t, RuntimeCRIO, NodeRuntime("cri-o://1.24.1"))
+	require.Equal(t, "", NodeRuntime("rkt://1.0"))
+}
+
+func Test_PrimaryRuntime(t *testing.T) {
+	t.Parallel()
+	runtimeNodes := map[string][]string{
+		RuntimeCRIO:       {"a", "b"},
+		RuntimeContainerd: {"c"},
+	}
+	require.Equal(t, RuntimeCRIO, PrimaryRuntime(runtimeNodes))
+	require.Equal(t, []string{RuntimeContainerd, RuntimeCRIO}, SortedRuntimes(runtimeNodes))
+	// Ties go to the preferred runtime
+	runtimeNodes[RuntimeContainerd] = append(runtimeNodes[RuntimeContainerd], "d")
+	require.Equal(t, RuntimeContainerd, PrimaryRuntime(runtimeNodes))
+}
+
+func Test_SchedulableNode(t *testing.T) {
+	t.Parallel()
+	node := &corev1.Node{}
+	node.Labels = map[string]string{"pool": "builds"}
+	node.Spec.Taints = []corev1.Taint{{Key: "builds", Effect: corev1.TaintEffectNoSchedule}}
+	opt := &DeploymentOpt{NodeSelector: map[string]string{"pool": "builds"}}
+	require.False(t, SchedulableNode(opt, node))
+	toleration, err := ParseToleration("builds")
+	require.NoError(t, err)
+	opt.Tolerations = []corev1.Toleration{toleration}
+	require.True(t, SchedulableNode(opt, node))
+	opt.NodeSelector["pool"] = "other"
+	require.False(t, SchedulableNode(opt, node))
+}
+
+func Test_NewRuntimeDeployment(t *testing.T) {
+	t.Parallel()
+	opt := &DeploymentOpt{Name: "buildkit", ContainerRuntime: RuntimeCRIO, Worker: "runc", Replicas: 1}
+	d, err := NewDeployment(opt)
+	require.NoError(t, err)
+	d = NewRuntimeDeployment(d, opt, []string{"node-b", "node-a"})
+	require.Equal(t, "buildkit-crio", d.Name)
+	require.Equal(t, RuntimeCRIO, d.Labels[RuntimeDeploymentLabel])
+	require.Equal(t, RuntimeCRIO, d.Spec.Template.Labels["runtime"])
+	terms := d.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	require.Len(t, terms, 1)
+	require.Equal(t, []corev1.NodeSelectorRequirement{{
+		Key:      corev1.LabelHostname,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{"node-a", "node-b"},
+	}}, terms[0].MatchExpressions)
+	// CRI-O pods don't mount a runtime socket
+	for _, v := range d.Spec.Template.Spec.Volumes {
+		require.NotContains(t, []string{"containerd-sock", "docker-sock"}, v.Name)
+	}
+}
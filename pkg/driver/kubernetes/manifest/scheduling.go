@@ -0,0 +1,100 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// The builder pods can be kept to dedicated build nodes with a node selector,
+// tolerations of the taints of those nodes and an affinity.  They apply to
+// the pods of the replica classes too.
+
+// ParseNodeSelector parses a key=value label the builder nodes must have
+func ParseNodeSelector(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.Errorf("invalid node selector %q, use key=value", s)
+	}
+	if errs := validation.IsQualifiedName(parts[0]); len(errs) > 0 {
+		return "", "", errors.Errorf("invalid node selector key %q: %s", parts[0], strings.Join(errs, ", "))
+	}
+	if errs := validation.IsValidLabelValue(parts[1]); len(errs) > 0 {
+		return "", "", errors.Errorf("invalid node selector value %q: %s", parts[1], strings.Join(errs, ", "))
+	}
+	return parts[0], parts[1], nil
+}
+
+// ParseToleration parses a toleration in the form of the taints of kubectl
+// taint, key[=value][:effect].  Without a value any value of the key is
+// tolerated, and without an effect all its effects.
+func ParseToleration(in string) (corev1.Toleration, error) {
+	t := corev1.Toleration{Operator: corev1.TolerationOpExists}
+	s := in
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		t.Effect = corev1.TaintEffect(s[i+1:])
+		s = s[:i]
+		switch t.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return t, errors.Errorf("invalid toleration effect %q, use NoSchedule, PreferNoSchedule or NoExecute", t.Effect)
+		}
+	}
+	parts := strings.SplitN(s, "=", 2)
+	t.Key = parts[0]
+	if len(parts) == 2 {
+		t.Operator = corev1.TolerationOpEqual
+		t.Value = parts[1]
+	}
+	if t.Key == "" {
+		return t, errors.Errorf("invalid toleration %q, use key[=value][:effect]", in)
+	}
+	if errs := validation.IsQualifiedName(t.Key); len(errs) > 0 {
+		return t, errors.Errorf("invalid toleration key %q: %s", t.Key, strings.Join(errs, ", "))
+	}
+	return t, nil
+}
+
+// ParseAffinity parses a YAML or JSON pod affinity
+func ParseAffinity(dt []byte) (*corev1.Affinity, error) {
+	dt, err := yaml.ToJSON(dt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse affinity")
+	}
+	var affinity corev1.Affinity
+	decoder := json.NewDecoder(strings.NewReader(string(dt)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&affinity); err != nil {
+		return nil, errors.Wrap(err, "invalid affinity")
+	}
+	return &affinity, nil
+}
+
+// addScheduling keeps the pods to the nodes of the options, the spreading
+// of the pods over the nodes is kept unless the affinity has its own pod
+// anti-affinity
+func addScheduling(d *appsv1.Deployment, opt *DeploymentOpt) {
+	spec := &d.Spec.Template.Spec
+	if len(opt.NodeSelector) > 0 {
+		spec.NodeSelector = map[string]string{}
+		for k, v := range opt.NodeSelector {
+			spec.NodeSelector[k] = v
+		}
+	}
+	spec.Tolerations = append(spec.Tolerations, opt.Tolerations...)
+	if opt.Affinity == nil {
+		return
+	}
+	affinity := opt.Affinity.DeepCopy()
+	if affinity.PodAntiAffinity == nil && spec.Affinity != nil {
+		affinity.PodAntiAffinity = spec.Affinity.PodAntiAffinity
+	}
+	spec.Affinity = affinity
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_ParseToleration(t *testing.T) {
+	t.Parallel()
+	for in, expected := range map[string]corev1.Toleration{
+		"dedicated=build:NoSchedule": {Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "build", Effect: corev1.TaintEffectNoSchedule},
+		"dedicated:NoExecute":        {Key: "dedicated", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute},
+		"example.com/build=true":     {Key: "example.com/build", Operator: corev1.TolerationOpEqual, Value: "true"},
+		"dedicated":                  {Key: "dedicated", Operator: corev1.TolerationOpExists},
+	} {
+		toleration, err := ParseToleration(in)
+		require.NoError(t, err, in)
+		require.Equal(t, expected, toleration, in)
+	}
+	for _, in := range []string{"", ":NoSchedule", "dedicated:Never", "bad key=x"} {
+		_, err := ParseToleration(in)
+		require.Error(t, err, in)
+	}
+}
+
+func Test_ParseNodeSelector(t *testing.T) {
+	t.Parallel()
+	key, value, err := ParseNodeSelector("node-role.kubernetes.io/build=")
+	require.NoError(t, err)
+	require.Equal(t, "node-role.kubernetes.io/build", key)
+	require.Equal(t, "", value)
+	for _, in := range []string{"build", "=build", "pool=a b"} {
+		_, _, err := ParseNodeSelector(in)
+		require.Error(t, err, in)
+	}
+}
+
+func Test_addScheduling(t *testing.T) {
+	t.Parallel()
+	toleration, err := ParseToleration("dedicated=build:NoSchedule")
+	require.NoError(t, err)
+	affinity, err := ParseAffinity([]byte(`
+nodeAffinity:
+  requiredDuringSchedulingIgnoredDuringExecution:
+    nodeSelectorTerms:
+    - matchExpressions:
+      - key: kubernetes.io/arch
+        operator: In
+        values: [amd64]
+`))
+	require.NoError(t, err)
+	opt := &DeploymentOpt{
+		Name:             "buildkit",
+		ContainerRuntime: "docker",
+		NodeSelector:     map[string]string{"pool": "build"},
+		Tolerations:      []corev1.Toleration{toleration},
+		Affinity:         affinity,
+	}
+	d, err := NewDeployment(opt)
+	require.NoError(t, err)
+	spec := d.Spec.Template.Spec
+	require.Equal(t, map[string]string{"pool": "build"}, spec.NodeSelector)
+	require.Equal(t, []corev1.Toleration{toleration}, spec.Tolerations)
+	require.Equal(t, affinity.NodeAffinity, spec.Affinity.NodeAffinity)
+	// The docker runtime pods are still spread over the nodes
+	require.NotNil(t, spec.Affinity.PodAntiAffinity)
+
+	_, err = ParseAffinity([]byte(`nodeAfinity: {}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Each builder pod has a layer cache of its own, a build landing on another
+// pod than the previous build of the image starts cold.  buildkitd can't
+// share its state between pods, so with a shared cache the builder runs a
+// registry next to its pods instead, on a claim of its own, which the builds
+// import their cache from and export it to.  Layers built on one pod are then
+// pulled by the others over the cluster network rather than through an
+// external registry.  buildkitd reaches the registry over plain HTTP, only
+// the builder pods are admitted to it.
+
+const (
+	// DefaultSharedCacheImage is the registry image of the shared cache
+	DefaultSharedCacheImage = "docker.io/library/registry:2.8.1"
+	// DefaultSharedCacheSize is the size of the claim of the shared cache
+	DefaultSharedCacheSize = "50Gi"
+
+	// SharedCacheAnnotation records the repository of the shared cache on the builder deployment
+	SharedCacheAnnotation = "buildkit.mobyproject.org/shared-cache"
+
+	sharedCachePort = 5000
+)
+
+// SharedCacheName is the name of the registry Deployment, Service, claim and
+// NetworkPolicy of the shared cache of a builder
+func SharedCacheName(opt *DeploymentOpt) string {
+	return opt.Name + "-shared-cache"
+}
+
+// SharedCacheHost is the address the builder pods reach the shared cache at,
+// the name of its Service in their namespace
+func SharedCacheHost(opt *DeploymentOpt) string {
+	return fmt.Sprintf("%s:%d", SharedCacheName(opt), sharedCachePort)
+}
+
+// SharedCacheRepository is the repository the builds cache to
+func SharedCacheRepository(opt *DeploymentOpt) string {
+	return SharedCacheHost(opt) + "/cache"
+}
+
+// SharedCacheConfig is the buildkitd config of the plain HTTP shared cache
+func SharedCacheConfig(opt *DeploymentOpt) string {
+	return fmt.Sprintf("[registry.%q]\n  http = true\n", SharedCacheHost(opt))
+}
+
+func sharedCacheLabels(opt *DeploymentOpt) map[string]string {
+	return map[string]string{
+		"app":     SharedCacheName(opt),
+		"builder": opt.Name,
+	}
+}
+
+// NewSharedCache returns the Deployment, Service and claim of the shared cache
+func NewSharedCache(opt *DeploymentOpt) (*appsv1.Deployment, *corev1.Service, *corev1.PersistentVolumeClaim, error) {
+	families, familyPolicy, err := IPFamilies(opt.IPFamily)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sizeStr := opt.SharedCacheSize
+	if sizeStr == "" {
+		sizeStr = DefaultSharedCacheSize
+	}
+	size, err := resource.ParseQuantity(sizeStr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid shared cache size %q: %w", sizeStr, err)
+	}
+	image := opt.SharedCacheImage
+	if image == "" {
+		image = DefaultSharedCacheImage
+	}
+	name := SharedCacheName(opt)
+	labels := sharedCacheLabels(opt)
+	// Not annotated with AnnotationKey so the registry isn't listed as a builder
+	objectMeta := metav1.ObjectMeta{
+		Namespace: opt.Namespace,
+		Name:      name,
+		Labels:    labels,
+	}
+	claim := &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "PersistentVolumeClaim",
+		},
+		ObjectMeta: objectMeta,
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+	if opt.CacheStorageClass != "" {
+		claim.Spec.StorageClassName = &opt.CacheStorageClass
+	}
+	replicas := int32(1)
+	d := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: objectMeta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			// The claim is mounted by a single pod at once
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "registry",
+							Image: image,
+							Env: []corev1.EnvVar{
+								{Name: "REGISTRY_HTTP_ADDR", Value: fmt.Sprintf(":%d", sharedCachePort)},
+								{Name: "REGISTRY_STORAGE_DELETE_ENABLED", Value: "true"},
+							},
+							Ports: []corev1.ContainerPort{
+								{Name: "registry", ContainerPort: sharedCachePort},
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									HTTPGet: &corev1.HTTPGetAction{Path: "/v2/", Port: intstr.FromInt(sharedCachePort)},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "cache",
+									MountPath: "/var/lib/registry",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "cache",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: name,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	svc := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: objectMeta,
+		Spec: corev1.ServiceSpec{
+			Selector:       labels,
+			IPFamilies:     families,
+			IPFamilyPolicy: familyPolicy,
+			Ports: []corev1.ServicePort{
+				{Name: "registry", Port: sharedCachePort, TargetPort: intstr.FromInt(sharedCachePort)},
+			},
+		},
+	}
+	if opt.SecurityProfile == SecurityProfileRestricted {
+		restrictPodSpec(&d.Spec.Template.Spec, opt)
+	}
+	return d, svc, claim, nil
+}
+
+// NewSharedCacheNetworkPolicy only admits the builder pods to the shared cache
+func NewSharedCacheNetworkPolicy(opt *DeploymentOpt) *networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	port := intstr.FromInt(sharedCachePort)
+	return &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1.SchemeGroupVersion.String(),
+			Kind:       "NetworkPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: opt.Namespace,
+			Name:      SharedCacheName(opt),
+			Labels:    sharedCacheLabels(opt),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: sharedCacheLabels(opt),
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": opt.Name}}},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package manifest
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The CLI reaches buildkitd through buildctl dial-stdio exec'd in the pod,
+// which trusts whichever pod matches the labels of the builder.  With a TLS
+// secret, buildkitd also listens on the loopback address of the pod with
+// mutual TLS, or on every address of the pod for the tcp transport and the
+// admin service, and the CLI tunnels its TLS connection through dial-stdio to
+// it: buildkitd only serves clients with a certificate of the CA, and the CLI
+// only talks to a buildkitd with one.  The in-pod unix socket stays as is for
+// the probes and the detached builds.
+
+const (
+	// TLSSecretAnnotation records the Secret of the CA and certificates of the builder
+	TLSSecretAnnotation = "buildkit.mobyproject.org/tls-secret"
+	// TLSAddress is the address buildkitd listens on with mutual TLS
+	TLSAddress = "tcp://127.0.0.1:1234"
+	// TLSPodAddress is TLSAddress on every address of the pod, for the tcp transport
+	TLSPodAddress = "tcp://0.0.0.0:1234"
+	// TLSPort is the port of TLSAddress and TLSPodAddress
+	TLSPort = 1234
+	// TLSServerName is the name the certificate of buildkitd is for
+	TLSServerName = "buildkitd"
+
+	// The keys of the TLS secret, the CA, the certificate and key of
+	// buildkitd, and those of the CLI
+	TLSCACertKey     = "ca.crt"
+	TLSCertKey       = corev1.TLSCertKey
+	TLSKeyKey        = corev1.TLSPrivateKeyKey
+	TLSClientCertKey = "client.crt"
+	TLSClientKeyKey  = "client.key"
+
+	tlsVolumeName = "buildkitd-tls"
+	tlsMountPath  = "/etc/buildkit-tls"
+)
+
+// The transports of the CLI to buildkitd: buildctl dial-stdio exec'd in the
+// pod, TLSPort forwarded through the API server, or TLSPort of the pod IP
+// dialed from within the cluster.  All but exec need a TLS secret.  The auto
+// transport picks exec or port-forward by what the creator of the builder is
+// granted, it's never recorded.
+const (
+	// TransportAnnotation records the transport of the builder, exec if unset
+	TransportAnnotation = "buildkit.mobyproject.org/transport"
+
+	TransportAuto        = "auto"
+	TransportExec        = "exec"
+	TransportPortForward = "port-forward"
+	TransportTCP         = "tcp"
+)
+
+// TLSSecretName is the name of the TLS secret generated for a builder
+func TLSSecretName(name string) string {
+	return name + "-tls"
+}
+
+// NewTLSSecret returns the TLS secret of the builder with the certificates
+// and keys of data, by their TLS*Key
+func NewTLSSecret(opt *DeploymentOpt, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   opt.Namespace,
+			Name:        opt.TLSSecret,
+			Labels:      labels(opt),
+			Annotations: annotations(opt),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+}
+
+// unixAddress is the default socket of buildkitd, which has to be listed
+// with the TLS address
+func unixAddress(opt *DeploymentOpt) string {
+	if opt.Rootless {
+		return "unix:///run/user/1000/buildkit/buildkitd.sock"
+	}
+	return "unix:///run/buildkit/buildkitd.sock"
+}
+
+// tlsListenAddress is the address buildkitd listens on with mutual TLS
+func tlsListenAddress(opt *DeploymentOpt) string {
+	if opt.Transport == TransportTCP || opt.AdminService {
+		return TLSPodAddress
+	}
+	return TLSAddress
+}
+
+// addTLSListener mounts the CA and certificate of buildkitd, but not those
+// of the CLI, and serves TLSAddress with them
+func addTLSListener(d *appsv1.Deployment, opt *DeploymentOpt) {
+	container := &d.Spec.Template.Spec.Containers[0]
+	container.Args = append(container.Args,
+		"--addr", unixAddress(opt),
+		"--addr", tlsListenAddress(opt),
+		"--tlscacert", tlsMountPath+"/"+TLSCACertKey,
+		"--tlscert", tlsMountPath+"/"+TLSCertKey,
+		"--tlskey", tlsMountPath+"/"+TLSKeyKey,
+	)
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      tlsVolumeName,
+		MountPath: tlsMountPath,
+		ReadOnly:  true,
+	})
+	mode := int32(0400)
+	if opt.Rootless {
+		// The files are owned by root, buildkitd runs as the user of the image
+		mode = 0444
+	}
+	d.Spec.Template.Spec.Volumes = append(d.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: tlsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: opt.TLSSecret,
+				Items: []corev1.KeyToPath{
+					{Key: TLSCACertKey, Path: TLSCACertKey},
+					{Key: TLSCertKey, Path: TLSCertKey},
+					{Key: TLSKeyKey, Path: TLSKeyKey},
+				},
+				DefaultMode: &mode,
+			},
+		},
+	})
+}
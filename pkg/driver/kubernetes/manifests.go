@@ -0,0 +1,80 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Manifests returns the objects creating the builder applies, in the order
+// it applies them, for them to be applied by other means.  The security
+// profile, runtimes and transport are detected as on create when the
+// cluster can be read, a generated TLS secret carries its certificates.  A
+// builder created from them is used by builds like one created by the CLI.
+func (d *Driver) Manifests(ctx context.Context, l progress.Logger) ([]runtime.Object, error) {
+	err := progress.Wrap("[internal] rendering the builder manifests", l, func(sub progress.SubLogger) error {
+		if err := d.detectSecurityProfile(ctx, sub); err != nil {
+			return err
+		}
+		if err := d.detectRuntimes(ctx, sub); err != nil {
+			return err
+		}
+		return d.detectTransport(ctx, sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := []runtime.Object{d.configMap}
+	if p := d.egressProxy; p != nil {
+		res = append(res, p.configMap, p.deployment, p.service, p.networkPolicy)
+	}
+	if c := d.sharedCache; c != nil {
+		res = append(res, c.claim, c.deployment, c.service)
+		if c.networkPolicy != nil {
+			res = append(res, c.networkPolicy)
+		}
+	}
+	if d.networkPolicy != nil {
+		res = append(res, d.networkPolicy)
+	}
+	if d.cacheClaim != nil && d.deploymentKind != DeploymentKindStatefulSet {
+		res = append(res, d.cacheClaim)
+	}
+	// A given TLS secret is the user's to apply
+	if d.tlsSecret != nil && d.tlsGenerate {
+		secret := d.tlsSecret.DeepCopy()
+		if secret.Data, err = generateTLSCertificates(time.Now()); err != nil {
+			return nil, errors.Wrap(err, "failed to generate the TLS certificates of the builder")
+		}
+		res = append(res, secret)
+	}
+	if d.adminService != nil {
+		res = append(res, d.adminService)
+	}
+	for _, depl := range d.replicaClasses {
+		res = append(res, depl)
+	}
+	for _, depl := range d.runtimeDeployments {
+		res = append(res, depl)
+	}
+	return append(res, builderObject(d.deploymentKind, d.deployment, d.cacheClaim)), nil
+}
+
+// builderObject returns the builder depl as the workload of kind
+func builderObject(kind string, depl *appsv1.Deployment, cacheClaim *corev1.PersistentVolumeClaim) runtime.Object {
+	switch kind {
+	case DeploymentKindDaemonSet:
+		return daemonSetFromDeployment(depl)
+	case DeploymentKindStatefulSet:
+		return statefulSetFromDeployment(depl, cacheClaim)
+	}
+	return depl
+}
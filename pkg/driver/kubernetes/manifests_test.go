@@ -0,0 +1,57 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_Manifests(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	discard := func(*client.SolveStatus) {}
+	d := &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"tls": "true", "admin-service": "true"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	objs, err := d.Manifests(ctx, discard)
+	require.NoError(t, err)
+	var kinds []string
+	for _, obj := range objs {
+		kinds = append(kinds, obj.GetObjectKind().GroupVersionKind().Kind)
+	}
+	require.Equal(t, []string{"ConfigMap", "Secret", "Service", "Deployment"}, kinds)
+	secret := objs[1].(*corev1.Secret)
+	require.NotEmpty(t, secret.Data[manifest.TLSCACertKey])
+	_, err = clientTLSConfig(secret)
+	require.NoError(t, err)
+	// Rendering doesn't generate the secret of the builder
+	require.Empty(t, d.tlsSecret.Data)
+
+	// A given secret isn't rendered
+	d = &Driver{
+		InitConfig: driver.InitConfig{
+			Name:       "test",
+			DriverOpts: map[string]string{"tls-secret": "mine", "deployment-kind": "statefulset"},
+		},
+	}
+	require.NoError(t, d.initDriverFromConfig())
+	objs, err = d.Manifests(ctx, discard)
+	require.NoError(t, err)
+	require.Len(t, objs, 2)
+	ss, ok := objs[1].(*appsv1.StatefulSet)
+	require.True(t, ok)
+	require.Equal(t, "StatefulSet", ss.Kind)
+	require.Equal(t, "test", ss.Name)
+}
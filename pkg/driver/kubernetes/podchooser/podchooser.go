@@ -7,10 +7,15 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/serialx/hashring"
 	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,23 +23,29 @@ import (
 )
 
 type PodChooser interface {
-	// Returns the selected pod, and zero or more other unselected pods
-	ChoosePod(ctx context.Context) (*corev1.Pod, []*corev1.Pod, error)
+	// Returns the selected pod, and zero or more other unselected pods.
+	// The pods are chosen among those running on nodes of the architecture
+	// of one of the platforms built, if any do, see ListPlatformPods.
+	ChoosePod(ctx context.Context, platforms []specs.Platform) (*corev1.Pod, []*corev1.Pod, error)
 }
 
 type RandomPodChooser struct {
 	RandSource rand.Source
 	PodClient  clientcorev1.PodInterface
+	// NodeClient reads the architecture of the nodes, pods aren't chosen by platform if nil
+	NodeClient clientcorev1.NodeInterface
 	Deployment *appsv1.Deployment
+	// ReplicaClass chooses among the pods of this replica class, the builder's own pods if empty
+	ReplicaClass string
 }
 
-func (pc *RandomPodChooser) ChoosePod(ctx context.Context) (*corev1.Pod, []*corev1.Pod, error) {
-	pods, err := ListRunningPods(ctx, pc.PodClient, pc.Deployment)
+func (pc *RandomPodChooser) ChoosePod(ctx context.Context, platforms []specs.Platform) (*corev1.Pod, []*corev1.Pod, error) {
+	pods, err := ListPlatformPods(ctx, pc.PodClient, pc.NodeClient, pc.Deployment, pc.ReplicaClass, platforms)
 	if err != nil {
 		return nil, nil, err
 	}
 	if len(pods) == 0 {
-		return nil, nil, fmt.Errorf("no builder pods are running")
+		return nil, nil, noPodsError(pc.ReplicaClass)
 	}
 	randSource := pc.RandSource
 	if randSource == nil {
@@ -46,38 +57,44 @@ func (pc *RandomPodChooser) ChoosePod(ctx context.Context) (*corev1.Pod, []*core
 	return pods[n], append(pods[0:n], pods[n+1:]...), nil
 }
 
+// StickyPodChooser chooses the pod for Key on a consistent hash ring, so the
+// builds of a context keep using the same layer cache.  The pods of a
+// StatefulSet are placed on the ring by their ordinal among all the replicas,
+// running or not, so a key returns to its pod once it is back.
 type StickyPodChooser struct {
-	Key        string
-	PodClient  clientcorev1.PodInterface
+	Key       string
+	PodClient clientcorev1.PodInterface
+	// NodeClient reads the architecture of the nodes, pods aren't chosen by platform if nil
+	NodeClient clientcorev1.NodeInterface
 	Deployment *appsv1.Deployment
+	// ReplicaClass chooses among the pods of this replica class, the builder's own pods if empty
+	ReplicaClass string
 }
 
-func (pc *StickyPodChooser) ChoosePod(ctx context.Context) (*corev1.Pod, []*corev1.Pod, error) {
-	pods, err := ListRunningPods(ctx, pc.PodClient, pc.Deployment)
+func (pc *StickyPodChooser) ChoosePod(ctx context.Context, platforms []specs.Platform) (*corev1.Pod, []*corev1.Pod, error) {
+	pods, err := ListPlatformPods(ctx, pc.PodClient, pc.NodeClient, pc.Deployment, pc.ReplicaClass, platforms)
 	if err != nil {
 		return nil, nil, err
 	}
 	if len(pods) == 0 {
-		return nil, nil, fmt.Errorf("no builder pods are running")
+		return nil, nil, noPodsError(pc.ReplicaClass)
 	}
-	var podNames []string
-	podMap := make(map[string]*corev1.Pod, len(pods))
-	for _, pod := range pods {
-		podNames = append(podNames, pod.Name)
-		podMap[pod.Name] = pod
+	replicas := 0
+	if pc.Deployment != nil && pc.Deployment.Spec.Replicas != nil {
+		replicas = int(*pc.Deployment.Spec.Replicas)
 	}
-	ring := hashring.New(podNames)
-	chosen, ok := ring.GetNode(pc.Key)
-	if !ok {
+	chosenPod := stickyPod(pods, pc.Key, replicas)
+	if chosenPod == nil {
 		// NOTREACHED
 		logrus.Errorf("no pod found for key %q", pc.Key)
 		rpc := &RandomPodChooser{
-			PodClient:  pc.PodClient,
-			Deployment: pc.Deployment,
+			PodClient:    pc.PodClient,
+			NodeClient:   pc.NodeClient,
+			Deployment:   pc.Deployment,
+			ReplicaClass: pc.ReplicaClass,
 		}
-		return rpc.ChoosePod(ctx)
+		return rpc.ChoosePod(ctx, platforms)
 	}
-	chosenPod := podMap[chosen]
 	otherPods := make([]*corev1.Pod, len(pods)-1)
 	i := 0
 	for _, pod := range pods {
@@ -91,7 +108,247 @@ func (pc *StickyPodChooser) ChoosePod(ctx context.Context) (*corev1.Pod, []*core
 	return chosenPod, otherPods, nil
 }
 
+// stickyPod returns the pod of key on the ring of the pods, weighted by
+// podWeights, or of the ordinals of the replicas if they are all StatefulSet
+// pods, which share their size
+func stickyPod(pods []*corev1.Pod, key string, replicas int) *corev1.Pod {
+	ordinals := make(map[string]*corev1.Pod, len(pods))
+	for _, pod := range pods {
+		ordinal, ok := StatefulSetOrdinal(pod)
+		if !ok {
+			ordinals = nil
+			break
+		}
+		if ordinal >= replicas {
+			replicas = ordinal + 1
+		}
+		ordinals[strconv.Itoa(ordinal)] = pod
+	}
+	if ordinals != nil {
+		nodes := make([]string, replicas)
+		for i := range nodes {
+			nodes[i] = strconv.Itoa(i)
+		}
+		chosen, _ := hashring.New(nodes).GetNodes(key, len(nodes))
+		for _, ordinal := range chosen {
+			if pod, ok := ordinals[ordinal]; ok {
+				return pod
+			}
+		}
+		return nil
+	}
+	podMap := make(map[string]*corev1.Pod, len(pods))
+	for _, pod := range pods {
+		podMap[pod.Name] = pod
+	}
+	chosen, ok := hashring.NewWithWeights(podWeights(pods)).GetNode(key)
+	if !ok {
+		return nil
+	}
+	return podMap[chosen]
+}
+
+// podWeights weighs the pods on the ring by the CPU their containers
+// request, in tenths of the smallest request, so larger pods get
+// proportionally more keys.  Pods without requests weigh as the smallest,
+// and all the pods the same if none has any, as the ring is unweighted then.
+func podWeights(pods []*corev1.Pod) map[string]int {
+	requests := make(map[string]int64, len(pods))
+	var smallest int64
+	for _, pod := range pods {
+		var cpu int64
+		for _, c := range pod.Spec.Containers {
+			cpu += c.Resources.Requests.Cpu().MilliValue()
+		}
+		requests[pod.Name] = cpu
+		if cpu > 0 && (smallest == 0 || cpu < smallest) {
+			smallest = cpu
+		}
+	}
+	weights := make(map[string]int, len(pods))
+	for name, cpu := range requests {
+		weights[name] = 10
+		if cpu > 0 {
+			weights[name] = int(cpu * 10 / smallest)
+		}
+	}
+	return weights
+}
+
+// StatefulSetOrdinal returns the ordinal of a pod run by a StatefulSet, the
+// suffix of its name, and false for other pods
+func StatefulSetOrdinal(pod *corev1.Pod) (int, bool) {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind != "StatefulSet" || !strings.HasPrefix(pod.Name, ref.Name+"-") {
+			continue
+		}
+		ordinal, err := strconv.Atoi(strings.TrimPrefix(pod.Name, ref.Name+"-"))
+		return ordinal, err == nil && ordinal >= 0
+	}
+	return 0, false
+}
+
+// PodLoad estimates the number of builds in flight on a pod
+type PodLoad func(ctx context.Context, pod *corev1.Pod) (int, error)
+
+// LeastLoadedPodChooser chooses the pod with the lowest load, among the pods
+// with the same load at random.  The load is a heuristic: buildkitd doesn't
+// report its solves, Load counts what stands for them, eg. the cache records
+// in use.  The pods whose load can't be read within podLoadTimeout are left
+// out, if none can be read the pod is chosen at random.
+type LeastLoadedPodChooser struct {
+	RandSource rand.Source
+	PodClient  clientcorev1.PodInterface
+	// NodeClient reads the architecture of the nodes, pods aren't chosen by platform if nil
+	NodeClient clientcorev1.NodeInterface
+	Deployment *appsv1.Deployment
+	// ReplicaClass chooses among the pods of this replica class, the builder's own pods if empty
+	ReplicaClass string
+	Load         PodLoad
+}
+
+func (pc *LeastLoadedPodChooser) ChoosePod(ctx context.Context, platforms []specs.Platform) (*corev1.Pod, []*corev1.Pod, error) {
+	pods, err := ListPlatformPods(ctx, pc.PodClient, pc.NodeClient, pc.Deployment, pc.ReplicaClass, platforms)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pods) == 0 {
+		return nil, nil, noPodsError(pc.ReplicaClass)
+	}
+	randSource := pc.RandSource
+	if randSource == nil {
+		randSource = rand.NewSource(time.Now().UnixNano())
+	}
+	rnd := rand.New(randSource)
+	loads := podLoads(ctx, pods, pc.Load)
+	n := leastLoaded(loads, rnd)
+	if n < 0 {
+		logrus.Debugf("LeastLoadedPodChooser.ChoosePod(): no load read, falling back to a random pod")
+		n = rnd.Int() % len(pods)
+	}
+	logrus.Debugf("LeastLoadedPodChooser.ChoosePod(): loads=%v, n=%d", loads, n)
+	return pods[n], append(pods[0:n:n], pods[n+1:]...), nil
+}
+
+// podLoadTimeout bounds the time spent reading the load of the pods, every
+// build waits for it and a busy buildkitd may be slow to answer
+const podLoadTimeout = 2 * time.Second
+
+// podLoads reads the load of the pods in parallel, -1 for the pods whose
+// load can't be read
+func podLoads(ctx context.Context, pods []*corev1.Pod, load PodLoad) []int {
+	ctx, cancel := context.WithTimeout(ctx, podLoadTimeout)
+	defer cancel()
+	loads := make([]int, len(pods))
+	var wg sync.WaitGroup
+	for i, pod := range pods {
+		wg.Add(1)
+		go func(i int, pod *corev1.Pod) {
+			defer wg.Done()
+			l, err := load(ctx, pod)
+			if err != nil {
+				logrus.Debugf("failed to read the load of pod %s: %s", pod.Name, err)
+				l = -1
+			}
+			loads[i] = l
+		}(i, pod)
+	}
+	wg.Wait()
+	return loads
+}
+
+// leastLoaded returns the index of the lowest load, ties are broken at
+// random, -1 if no load is known
+func leastLoaded(loads []int, rnd *rand.Rand) int {
+	var least []int
+	for i, l := range loads {
+		switch {
+		case l < 0:
+		case len(least) == 0 || l < loads[least[0]]:
+			least = []int{i}
+		case l == loads[least[0]]:
+			least = append(least, i)
+		}
+	}
+	if len(least) == 0 {
+		return -1
+	}
+	return least[rnd.Intn(len(least))]
+}
+
+// NodePodChooser chooses the pod running on the first of Nodes that has one,
+// so the build uses the layer cache of that node, and otherwise defers to
+// Fallback.  LocalNode, the node running the client, is preferred after Nodes
+// when the pods are run by a DaemonSet, which has one on every node.
+type NodePodChooser struct {
+	PodClient clientcorev1.PodInterface
+	// NodeClient reads the architecture of the nodes, pods aren't chosen by platform if nil
+	NodeClient clientcorev1.NodeInterface
+	Deployment *appsv1.Deployment
+	// ReplicaClass chooses among the pods of this replica class, the builder's own pods if empty
+	ReplicaClass string
+	Nodes        []string
+	LocalNode    string
+	Fallback     PodChooser
+}
+
+func (pc *NodePodChooser) ChoosePod(ctx context.Context, platforms []specs.Platform) (*corev1.Pod, []*corev1.Pod, error) {
+	pods, err := ListPlatformPods(ctx, pc.PodClient, pc.NodeClient, pc.Deployment, pc.ReplicaClass, platforms)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := pc.Nodes
+	if pc.LocalNode != "" && len(pods) > 0 && IsDaemonSetPod(pods[0]) {
+		nodes = append(nodes[:len(nodes):len(nodes)], pc.LocalNode)
+	}
+	n := podOnNode(pods, nodes)
+	if n < 0 {
+		logrus.Debugf("NodePodChooser.ChoosePod(): no pod on %v", nodes)
+		return pc.Fallback.ChoosePod(ctx, platforms)
+	}
+	return pods[n], append(pods[0:n:n], pods[n+1:]...), nil
+}
+
+// podOnNode returns the index of the pod running on the first of the nodes
+// running one, -1 if none does
+func podOnNode(pods []*corev1.Pod, nodes []string) int {
+	for _, node := range nodes {
+		for i, pod := range pods {
+			if pod.Spec.NodeName == node {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// IsDaemonSetPod reports if the pod is run by a DaemonSet
+func IsDaemonSetPod(pod *corev1.Pod) bool {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
+
 func ListRunningPods(ctx context.Context, client clientcorev1.PodInterface, depl *appsv1.Deployment) ([]*corev1.Pod, error) {
+	pods, err := ListPods(ctx, client, depl)
+	if err != nil {
+		return nil, err
+	}
+	var runningPods []*corev1.Pod
+	for _, pod := range pods {
+		if isPodRunning(pod) {
+			logrus.Debugf("pod runnning: %q", pod.Name)
+			runningPods = append(runningPods, pod)
+		}
+	}
+	return runningPods, nil
+}
+
+// podSelector selects the pods of the builder
+func podSelector(depl *appsv1.Deployment) (string, error) {
 	name := depl.ObjectMeta.Name
 	if name == "" {
 		name = "buildkit" // TODO should be constant someplace...
@@ -102,27 +359,124 @@ func ListRunningPods(ctx context.Context, client clientcorev1.PodInterface, depl
 		},
 	}
 	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return "", err
+	}
+	return selector.String(), nil
+}
+
+// ListPods returns all the pods of the builder, scheduled or not, sorted by name
+func ListPods(ctx context.Context, client clientcorev1.PodInterface, depl *appsv1.Deployment) ([]*corev1.Pod, error) {
+	selector, err := podSelector(depl)
 	if err != nil {
 		return nil, err
 	}
 	listOpts := metav1.ListOptions{
-		LabelSelector: selector.String(),
+		LabelSelector: selector,
 	}
 	podList, err := client.List(ctx, listOpts)
 	if err != nil {
 		return nil, err
 	}
-	// TODO further filter pods based on Annotations
-	var runningPods []*corev1.Pod
+	// The pods new builds may choose are filtered by ListReadyPods
+	pods := make([]*corev1.Pod, len(podList.Items))
 	for i := range podList.Items {
-		pod := &podList.Items[i]
-		if pod.Status.Phase == corev1.PodRunning {
-			logrus.Debugf("pod runnning: %q", pod.Name)
-			runningPods = append(runningPods, pod)
-		}
+		pods[i] = &podList.Items[i]
 	}
-	sort.Slice(runningPods, func(i, j int) bool {
-		return runningPods[i].Name < runningPods[j].Name
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
 	})
-	return runningPods, nil
+	return pods, nil
+}
+
+// ListReadyPods returns the pods of the replica class new builds may use,
+// see IsPodSchedulable
+func ListReadyPods(ctx context.Context, client clientcorev1.PodInterface, depl *appsv1.Deployment, replicaClass string) ([]*corev1.Pod, error) {
+	running, err := ListRunningPods(ctx, client, depl)
+	if err != nil {
+		return nil, err
+	}
+	var pods []*corev1.Pod
+	for _, pod := range running {
+		if pod.Labels[manifest.ReplicaClassLabel] == replicaClass && IsPodSchedulable(pod) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// ListPlatformPods returns the ready pods of the replica class, see
+// ListReadyPods, running on nodes of the architecture of one of the platforms.
+// Without platforms, or if no pod runs on a node of theirs, they are all
+// returned, the builder may emulate the other architectures.
+func ListPlatformPods(ctx context.Context, client clientcorev1.PodInterface, nodeClient clientcorev1.NodeInterface, depl *appsv1.Deployment, replicaClass string, platforms []specs.Platform) ([]*corev1.Pod, error) {
+	pods, err := ListReadyPods(ctx, client, depl, replicaClass)
+	if err != nil || len(platforms) == 0 || nodeClient == nil {
+		return pods, err
+	}
+	nodeArchs := map[string]string{}
+	for _, pod := range pods {
+		name := pod.Spec.NodeName
+		if _, ok := nodeArchs[name]; ok || name == "" {
+			continue
+		}
+		node, err := nodeClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			// Reading nodes needs a cluster role the user may not have
+			logrus.Debugf("not choosing pods by platform, failed to get node %s: %s", name, err)
+			return pods, nil
+		}
+		nodeArchs[name] = node.Labels[corev1.LabelArchStable]
+	}
+	if matching := platformPods(pods, nodeArchs, platforms); len(matching) > 0 {
+		return matching, nil
+	}
+	logrus.Debugf("no builder pods on nodes of platforms %v, building with emulation", platforms)
+	return pods, nil
+}
+
+// platformPods keeps the pods on nodes of the architecture of one of the
+// platforms, nodeArchs maps the node names to their architecture
+func platformPods(pods []*corev1.Pod, nodeArchs map[string]string, platforms []specs.Platform) []*corev1.Pod {
+	var res []*corev1.Pod
+	for _, pod := range pods {
+		for _, p := range platforms {
+			if arch := nodeArchs[pod.Spec.NodeName]; arch != "" && arch == p.Architecture {
+				res = append(res, pod)
+				break
+			}
+		}
+	}
+	return res
+}
+
+func noPodsError(replicaClass string) error {
+	if replicaClass != "" {
+		return fmt.Errorf("no builder pods of replica class %q are running and ready", replicaClass)
+	}
+	return fmt.Errorf("no builder pods are running and ready")
+}
+
+// isPodRunning reports if the pod runs and isn't terminating, as the pods
+// replaced by a rollout do until they stop
+func isPodRunning(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil
+}
+
+// IsPodSchedulable reports if new builds may choose the pod: it runs, isn't
+// terminating, its buildkitd passes the readiness probe, so builds don't race
+// a worker still initializing its snapshotter, and it isn't drained with
+// manifest.UnschedulableAnnotation
+func IsPodSchedulable(pod *corev1.Pod) bool {
+	return isPodRunning(pod) && IsPodReady(pod) && pod.Annotations[manifest.UnschedulableAnnotation] != "true"
+}
+
+// IsPodReady reports if the pod's Ready condition is true
+func IsPodReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
 }
@@ -0,0 +1,190 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package podchooser
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/serialx/hashring"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_IsPodReady(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+	require.False(t, IsPodReady(pod))
+
+	pod.Status.Conditions = []corev1.PodCondition{
+		{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+		{Type: corev1.PodReady, Status: corev1.ConditionFalse},
+	}
+	require.False(t, IsPodReady(pod))
+
+	pod.Status.Conditions[1].Status = corev1.ConditionTrue
+	require.True(t, IsPodReady(pod))
+}
+
+func Test_leastLoaded(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	require.Equal(t, 1, leastLoaded([]int{3, 0, 2}, rnd))
+	require.Equal(t, 0, leastLoaded([]int{5}, rnd))
+
+	// Ties are spread across the pods
+	seen := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		seen[leastLoaded([]int{1, 4, 1, 1}, rnd)] = true
+	}
+	require.Equal(t, map[int]bool{0: true, 2: true, 3: true}, seen)
+
+	// The pods whose load is unknown are left out
+	require.Equal(t, 2, leastLoaded([]int{-1, 4, 1}, rnd))
+	require.Equal(t, -1, leastLoaded([]int{-1, -1}, rnd))
+}
+
+func Test_podLoads(t *testing.T) {
+	t.Parallel()
+	pods := []*corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "idle"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "busy"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "hung"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "broken"}},
+	}
+	start := time.Now()
+	loads := podLoads(context.Background(), pods, func(ctx context.Context, pod *corev1.Pod) (int, error) {
+		switch pod.Name {
+		case "busy":
+			return 3, nil
+		case "hung":
+			<-ctx.Done()
+			return 0, ctx.Err()
+		case "broken":
+			return 0, errors.New("connection refused")
+		}
+		return 0, nil
+	})
+	require.Equal(t, []int{0, 3, -1, -1}, loads)
+	// The pods are read in parallel, the hung one only until the timeout
+	require.Less(t, int64(time.Since(start)), int64(podLoadTimeout+time.Second))
+}
+
+func Test_podOnNode(t *testing.T) {
+	t.Parallel()
+	pods := []*corev1.Pod{
+		{Spec: corev1.PodSpec{NodeName: "node-a"}},
+		{Spec: corev1.PodSpec{NodeName: "node-b"}},
+	}
+	require.Equal(t, 1, podOnNode(pods, []string{"node-b", "node-a"}))
+	require.Equal(t, 0, podOnNode(pods, []string{"node-c", "node-a"}))
+	require.Equal(t, -1, podOnNode(pods, []string{"node-c"}))
+	require.Equal(t, -1, podOnNode(pods, nil))
+}
+
+func Test_IsDaemonSetPod(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "buildkit-5d8f"}},
+	}}
+	require.False(t, IsDaemonSetPod(pod))
+	pod.OwnerReferences[0] = metav1.OwnerReference{Kind: "DaemonSet", Name: "buildkit"}
+	require.True(t, IsDaemonSetPod(pod))
+}
+
+func Test_platformPods(t *testing.T) {
+	t.Parallel()
+	amd64 := &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node-a"}}
+	arm64 := &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node-b"}}
+	unknown := &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node-c"}}
+	pods := []*corev1.Pod{amd64, arm64, unknown}
+	nodeArchs := map[string]string{"node-a": "amd64", "node-b": "arm64"}
+
+	require.Equal(t, []*corev1.Pod{arm64}, platformPods(pods, nodeArchs, []specs.Platform{{OS: "linux", Architecture: "arm64"}}))
+	require.Equal(t, []*corev1.Pod{amd64, arm64}, platformPods(pods, nodeArchs, []specs.Platform{
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "linux", Architecture: "amd64"},
+	}))
+	require.Empty(t, platformPods(pods, nodeArchs, []specs.Platform{{OS: "linux", Architecture: "s390x"}}))
+}
+
+func Test_stickyPodStatefulSet(t *testing.T) {
+	t.Parallel()
+	pod := func(name, owner string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: owner}},
+		}}
+	}
+	ordinal, ok := StatefulSetOrdinal(pod("buildkit-2", "buildkit"))
+	require.True(t, ok)
+	require.Equal(t, 2, ordinal)
+	_, ok = StatefulSetOrdinal(pod("buildkit-5d8f", "buildkit"))
+	require.False(t, ok)
+	_, ok = StatefulSetOrdinal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "buildkit-1"}})
+	require.False(t, ok)
+
+	pods := []*corev1.Pod{pod("buildkit-0", "buildkit"), pod("buildkit-1", "buildkit"), pod("buildkit-2", "buildkit")}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		chosen := stickyPod(pods, key, 3)
+		require.NotNil(t, chosen)
+
+		// The key moves while its pod is down, and returns once it is back
+		var others []*corev1.Pod
+		for _, p := range pods {
+			if p != chosen {
+				others = append(others, p)
+			}
+		}
+		moved := stickyPod(others, key, 3)
+		require.NotNil(t, moved)
+		require.NotEqual(t, chosen.Name, moved.Name)
+
+		restarted := pod(chosen.Name, "buildkit")
+		back := stickyPod(append(others, restarted), key, 3)
+		require.Equal(t, chosen.Name, back.Name)
+		require.Equal(t, chosen.Name, stickyPod(pods, key, 3).Name)
+	}
+}
+
+func Test_stickyPodWeights(t *testing.T) {
+	t.Parallel()
+	pod := func(name, cpu string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "buildkitd"}}},
+		}
+		if cpu != "" {
+			p.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}
+		}
+		return p
+	}
+	require.Equal(t, map[string]int{"a": 10, "b": 30, "c": 10}, podWeights([]*corev1.Pod{pod("a", "500m"), pod("b", "1500m"), pod("c", "")}))
+	require.Equal(t, map[string]int{"a": 10, "b": 10}, podWeights([]*corev1.Pod{pod("a", ""), pod("b", "")}))
+
+	// Pods of the same size keep the keys of the unweighted ring
+	same := []*corev1.Pod{pod("a", "1"), pod("b", "1"), pod("c", "1")}
+	ring := hashring.New([]string{"a", "b", "c"})
+	for i := 0; i < 50; i++ {
+		key := "/src/" + strconv.Itoa(i)
+		want, _ := ring.GetNode(key)
+		require.Equal(t, want, stickyPod(same, key, 0).Name)
+	}
+
+	// A pod three times the size gets about three times the keys
+	pods := []*corev1.Pod{pod("small", "1"), pod("large", "3")}
+	large := 0
+	for i := 0; i < 1000; i++ {
+		if stickyPod(pods, "/src/"+strconv.Itoa(i), 0).Name == "large" {
+			large++
+		}
+	}
+	require.InDelta(t, 750, large, 100)
+}
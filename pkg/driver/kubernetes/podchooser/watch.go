@@ -0,0 +1,114 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package podchooser
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// A build started right after the builder was created, scaled or rolled out
+// would find its pods still starting.  Rather than failing on a single List,
+// builds watch the pods of the builder until one of them runs and its
+// buildkitd passes the readiness probe.
+
+// WaitForReadyPod returns once new builds may choose a pod of the replica
+// class, see IsPodSchedulable, and fails after timeout.
+func WaitForReadyPod(ctx context.Context, client clientcorev1.PodInterface, depl *appsv1.Deployment, replicaClass string, timeout time.Duration) error {
+	selector, err := podSelector(depl)
+	if err != nil {
+		return err
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	waiting := false
+	for {
+		podList, err := client.List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+		pods := map[string]*corev1.Pod{}
+		for i := range podList.Items {
+			pods[podList.Items[i].Name] = &podList.Items[i]
+		}
+		if hasSchedulablePod(pods, replicaClass) {
+			return nil
+		}
+		if !waiting {
+			logrus.Debugf("waiting up to %s for a builder pod to be ready", timeout)
+			waiting = true
+		}
+		w, err := client.Watch(ctx, metav1.ListOptions{
+			LabelSelector:   selector,
+			ResourceVersion: podList.ResourceVersion,
+		})
+		if err != nil {
+			return err
+		}
+		done, err := watchReadyPod(ctx, w, deadline.C, pods, replicaClass)
+		w.Stop()
+		if done {
+			return err
+		}
+		if err != nil {
+			logrus.Debugf("watching the builder pods failed, listing them again: %s", err)
+		}
+	}
+}
+
+// watchReadyPod updates pods with the events of w until one of them is
+// ready, done is false if the watch ended before
+func watchReadyPod(ctx context.Context, w watch.Interface, deadline <-chan time.Time, pods map[string]*corev1.Pod, replicaClass string) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-deadline:
+			return true, errors.Wrap(noPodsError(replicaClass), "timed out waiting for the builder")
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			switch ev.Type {
+			case watch.Added, watch.Modified:
+				if pod, ok := ev.Object.(*corev1.Pod); ok {
+					pods[pod.Name] = pod
+				}
+			case watch.Deleted:
+				if pod, ok := ev.Object.(*corev1.Pod); ok {
+					delete(pods, pod.Name)
+				}
+			case watch.Error:
+				// Eg. the resource version expired, the pods are listed again
+				if status, ok := ev.Object.(*metav1.Status); ok {
+					return false, &kubeerrors.StatusError{ErrStatus: *status}
+				}
+				return false, errors.Errorf("unexpected watch error %v", ev.Object)
+			}
+			if hasSchedulablePod(pods, replicaClass) {
+				return true, nil
+			}
+		}
+	}
+}
+
+// hasSchedulablePod reports whether new builds may choose one of the pods of
+// the replica class
+func hasSchedulablePod(pods map[string]*corev1.Pod, replicaClass string) bool {
+	for _, pod := range pods {
+		if pod.Labels[manifest.ReplicaClassLabel] == replicaClass && IsPodSchedulable(pod) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package podchooser
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func testPod(name string, phase corev1.PodPhase, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.PodStatus{
+			Phase:      phase,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func Test_hasSchedulablePod(t *testing.T) {
+	t.Parallel()
+	pods := map[string]*corev1.Pod{"a": testPod("a", corev1.PodPending, false)}
+	require.False(t, hasSchedulablePod(pods, ""))
+	pods["b"] = testPod("b", corev1.PodRunning, false)
+	require.False(t, hasSchedulablePod(pods, ""))
+
+	// A pod replaced by a rollout is ready until it stops
+	terminating := testPod("c", corev1.PodRunning, true)
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	pods["c"] = terminating
+	require.False(t, hasSchedulablePod(pods, ""))
+	drained := testPod("d", corev1.PodRunning, true)
+	drained.Annotations = map[string]string{manifest.UnschedulableAnnotation: "true"}
+	pods["d"] = drained
+	require.False(t, hasSchedulablePod(pods, ""))
+
+	pods["e"] = testPod("e", corev1.PodRunning, true)
+	require.True(t, hasSchedulablePod(pods, ""))
+	// The pods of other replica classes don't count
+	require.False(t, hasSchedulablePod(pods, "large"))
+}
+
+func Test_watchReadyPod(t *testing.T) {
+	t.Parallel()
+	w := watch.NewFakeWithChanSize(3, false)
+	w.Add(testPod("a", corev1.PodPending, false))
+	w.Modify(testPod("a", corev1.PodRunning, false))
+	w.Modify(testPod("a", corev1.PodRunning, true))
+	pods := map[string]*corev1.Pod{}
+	done, err := watchReadyPod(context.Background(), w, nil, pods, "")
+	require.True(t, done)
+	require.NoError(t, err)
+
+	// A watch closed by the server is watched again
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Add(testPod("b", corev1.PodRunning, false))
+	w.Stop()
+	done, err = watchReadyPod(context.Background(), w, nil, map[string]*corev1.Pod{}, "")
+	require.False(t, done)
+	require.NoError(t, err)
+
+	// Pods running but not ready fail once the time is up
+	deadline := make(chan time.Time, 1)
+	deadline <- time.Now()
+	done, err = watchReadyPod(context.Background(), watch.NewFake(), deadline, map[string]*corev1.Pod{"b": testPod("b", corev1.PodRunning, false)}, "")
+	require.True(t, done)
+	require.Error(t, err)
+}
@@ -0,0 +1,426 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Builds waiting for (or holding) a slot on a builder are represented by a
+// Lease per build.  The CLIs cooperate by ordering the waiting leases for the
+// builder by priority then age, and a build may start once the running builds
+// plus the builds ahead of it fit within the builder's max-parallel-builds.
+// Leases are renewed while the CLI runs, so entries from CLIs which crashed
+// expire and are cleaned up by the remaining builds.
+//
+// The builds holding a slot are recorded in one more Lease of the builder, the
+// slots Lease.  A build claims its slot with a read-modify-write of that Lease,
+// so two CLIs seeing the same free slot can't both take it: the update sent
+// with the resourceVersion read fails for the second one, which then counts
+// the slots again.
+//
+// If the builder has a preemption priority, the build at the head of the queue
+// with at least that priority may mark a running build of lower priority as
+// preempted.  The preempted CLI notices on its next renewal, cancels its build
+// and joins the queue again.
+
+const (
+	queueLabel              = "buildkit.mobyproject.org/queue"
+	queuePriorityAnnotation = "buildkit.mobyproject.org/priority"
+	queueStateAnnotation    = "buildkit.mobyproject.org/queue-state"
+	queueStateRunning       = "running"
+	queueStatePreempted     = "preempted"
+	queuePreemptedBy        = "buildkit.mobyproject.org/preempted-by"
+	queueSlotsAnnotation    = "buildkit.mobyproject.org/slots"
+
+	queueLeaseDuration = 30 * time.Second
+	queuePollInterval  = 2 * time.Second
+)
+
+func (d *Driver) Enqueue(ctx context.Context, id string, priority int, position func(int)) (func(), <-chan struct{}, error) {
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		if kubeerrors.IsNotFound(err) {
+			// Not created yet, so nothing else can be running on it
+			return func() {}, nil, nil
+		}
+		return nil, nil, err
+	}
+	capacity, _ := strconv.Atoi(depl.ObjectMeta.Annotations[manifest.MaxParallelBuildsAnnotation])
+	if capacity <= 0 {
+		return func() {}, nil, nil
+	}
+	scaling := parseQueueScaling(depl)
+	if scaling != nil {
+		capacity = scaling.capacity(depl)
+	}
+	preemptionPriority, _ := strconv.Atoi(depl.ObjectMeta.Annotations[manifest.PreemptionPriorityAnnotation])
+	canPreempt := preemptionPriority > 0 && priority >= preemptionPriority
+
+	holder, _ := os.Hostname()
+	duration := int32(queueLeaseDuration / time.Second)
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := d.leaseClient.Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   d.deployment.Name + "-build-" + id,
+			Labels: map[string]string{queueLabel: d.deployment.Name},
+			Annotations: map[string]string{
+				queuePriorityAnnotation: strconv.Itoa(priority),
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to join the build queue")
+	}
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	preempted := make(chan struct{})
+	go d.renewQueueLease(renewCtx, lease.Name, preempted)
+	release := func() {
+		cancel()
+		if err := d.releaseQueueSlot(context.Background(), lease.Name); err != nil && !kubeerrors.IsNotFound(err) {
+			// The slot is freed once the lease is gone
+			logrus.Debugf("failed to free the build queue slot of %s: %s", lease.Name, err)
+		}
+		if err := d.leaseClient.Delete(context.Background(), lease.Name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+			logrus.Warnf("failed to remove build queue entry %s: %s", lease.Name, err)
+		}
+	}
+
+	lastPos := -1
+	for {
+		leases, err := d.queueLeases(ctx)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		if scaling != nil {
+			if depl, err = d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{}); err == nil {
+				capacity = scaling.capacity(depl)
+			} else {
+				logrus.Debugf("failed to get builder %s: %s", d.deployment.Name, err)
+			}
+		}
+		_, _, stale := queuePosition(leases, nil, lease.Name, time.Now())
+		for _, name := range stale {
+			_ = d.leaseClient.Delete(ctx, name, metav1.DeleteOptions{})
+		}
+		pos, victim, err := d.claimQueueSlot(ctx, leases, lease.Name, priority, capacity, canPreempt)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		if victim != "" {
+			// The slot of the victim is ours already, it only has to stop
+			logrus.Infof("preempting build %s", victim)
+			if err := d.setQueueLeaseState(ctx, victim, queueStatePreempted, lease.Name); err != nil {
+				logrus.Debugf("failed to preempt %s: %s", victim, err)
+			}
+		}
+		if pos < 0 {
+			if err := d.setQueueLeaseState(ctx, lease.Name, queueStateRunning, ""); err != nil {
+				release()
+				return nil, nil, err
+			}
+			return release, preempted, nil
+		}
+		if scaling != nil && depl != nil {
+			if err := d.scaleUpForQueue(ctx, depl, scaling, pos+1); err != nil {
+				logrus.Debugf("failed to scale up %s: %s", depl.Name, err)
+			}
+		}
+		if pos != lastPos {
+			position(pos - capacity + 1)
+			lastPos = pos
+		}
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, nil, ctx.Err()
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// queueSlot is a build holding a slot of the builder
+type queueSlot struct {
+	Priority int       `json:"priority"`
+	Since    time.Time `json:"since"`
+}
+
+// queueSlotsName is the name of the slots Lease of the builder
+func queueSlotsName(builder string) string {
+	return builder + "-build-slots"
+}
+
+// claimQueueSlot takes a free slot for the build of lease name, or the slot of
+// a running build of lower priority with canPreempt, in a single update of the
+// slots Lease.  It returns -1 and the build preempted, if any, once the slot
+// is taken, or else the position of the build in the queue.  Slots held by
+// expired leases are freed on the way.
+func (d *Driver) claimQueueSlot(ctx context.Context, leases []coordinationv1.Lease, name string, priority, capacity int, canPreempt bool) (int, string, error) {
+	slotsName := queueSlotsName(d.deployment.Name)
+	pos, victim := -1, ""
+	err := retryOnConflict(ctx, "build queue slots", slotsName, func() error {
+		slotsLease, err := d.leaseClient.Get(ctx, slotsName, metav1.GetOptions{})
+		if kubeerrors.IsNotFound(err) {
+			slotsLease, err = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: slotsName}}, nil
+		}
+		if err != nil {
+			return err
+		}
+		slots := parseQueueSlots(slotsLease)
+		now := time.Now()
+		pruneQueueSlots(slots, leases, now)
+		running, index, _ := queuePosition(leases, slots, name, now)
+		pos, victim = running+index, ""
+		switch {
+		case pos < capacity:
+		case canPreempt && index == 0:
+			if victim = preemptionVictim(slots, priority); victim == "" {
+				return nil
+			}
+			delete(slots, victim)
+		default:
+			return nil
+		}
+		slots[name] = queueSlot{Priority: priority, Since: now}
+		dt, err := json.Marshal(slots)
+		if err != nil {
+			return err
+		}
+		if slotsLease.Annotations == nil {
+			slotsLease.Annotations = map[string]string{}
+		}
+		slotsLease.Annotations[queueSlotsAnnotation] = string(dt)
+		if slotsLease.ResourceVersion == "" {
+			_, err = d.leaseClient.Create(ctx, slotsLease, metav1.CreateOptions{})
+		} else {
+			_, err = d.leaseClient.Update(ctx, slotsLease, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			pos = -1
+		}
+		return err
+	})
+	if err != nil {
+		return 0, "", errors.Wrap(err, "failed to claim a slot of the build queue")
+	}
+	return pos, victim, nil
+}
+
+// releaseQueueSlot frees the slot of the build of lease name, if it has one
+func (d *Driver) releaseQueueSlot(ctx context.Context, name string) error {
+	slotsName := queueSlotsName(d.deployment.Name)
+	return retryOnConflict(ctx, "build queue slots", slotsName, func() error {
+		slotsLease, err := d.leaseClient.Get(ctx, slotsName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		slots := parseQueueSlots(slotsLease)
+		if _, ok := slots[name]; !ok {
+			return nil
+		}
+		delete(slots, name)
+		dt, err := json.Marshal(slots)
+		if err != nil {
+			return err
+		}
+		slotsLease.Annotations[queueSlotsAnnotation] = string(dt)
+		_, err = d.leaseClient.Update(ctx, slotsLease, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// parseQueueSlots returns the slots recorded by the slots Lease, by the name of
+// the lease of their build
+func parseQueueSlots(l *coordinationv1.Lease) map[string]queueSlot {
+	slots := map[string]queueSlot{}
+	if v := l.Annotations[queueSlotsAnnotation]; v != "" {
+		if err := json.Unmarshal([]byte(v), &slots); err != nil {
+			logrus.Debugf("invalid build queue slots %s: %s", l.Name, err)
+		}
+	}
+	return slots
+}
+
+// pruneQueueSlots frees the slots of the builds whose lease expired, or is
+// gone.  A build claims its slot after creating its lease, so a lease missing
+// from a listing older than the slot may only be listed next time.
+func pruneQueueSlots(slots map[string]queueSlot, leases []coordinationv1.Lease, now time.Time) {
+	listed := map[string]coordinationv1.Lease{}
+	for _, l := range leases {
+		listed[l.Name] = l
+	}
+	for name, slot := range slots {
+		l, ok := listed[name]
+		switch {
+		case ok && (queueLeaseExpired(l, now) || l.Annotations[queueStateAnnotation] == queueStatePreempted):
+		case !ok && now.Sub(slot.Since) > queueLeaseDuration:
+		default:
+			continue
+		}
+		delete(slots, name)
+	}
+}
+
+func (d *Driver) setQueueLeaseState(ctx context.Context, name, state, by string) error {
+	// The renewal may race with us
+	err := retryOnConflict(ctx, "build queue entry", name, func() error {
+		lease, err := d.leaseClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[queueStateAnnotation] = state
+		if by != "" {
+			lease.Annotations[queuePreemptedBy] = by
+		}
+		_, err = d.leaseClient.Update(ctx, lease, metav1.UpdateOptions{})
+		return err
+	})
+	return errors.Wrap(err, "failed to update the build queue")
+}
+
+func (d *Driver) renewQueueLease(ctx context.Context, name string, preempted chan struct{}) {
+	ticker := time.NewTicker(queueLeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lease, err := d.leaseClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			logrus.Debugf("failed to get build queue entry %s: %s", name, err)
+			continue
+		}
+		if lease.Annotations[queueStateAnnotation] == queueStatePreempted {
+			close(preempted)
+			return
+		}
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.RenewTime = &now
+		if _, err := d.leaseClient.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			logrus.Debugf("failed to renew build queue entry %s: %s", name, err)
+		}
+	}
+}
+
+func queueLeaseExpired(l coordinationv1.Lease, now time.Time) bool {
+	return l.Spec.RenewTime != nil && l.Spec.LeaseDurationSeconds != nil &&
+		l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds)*time.Second).Before(now)
+}
+
+// queuePosition returns the number of builds holding a slot and the zero
+// based index of the named lease amongst the waiting builds, along with the
+// names of expired leases which should be removed.  Preempted builds no
+// longer hold their slot.
+func queuePosition(leases []coordinationv1.Lease, slots map[string]queueSlot, name string, now time.Time) (int, int, []string) {
+	var stale []string
+	waiting := make([]coordinationv1.Lease, 0, len(leases))
+	for _, l := range leases {
+		if l.Name != name && queueLeaseExpired(l, now) {
+			stale = append(stale, l.Name)
+			continue
+		}
+		if _, ok := slots[l.Name]; ok || l.Annotations[queueStateAnnotation] == queueStatePreempted {
+			continue
+		}
+		waiting = append(waiting, l)
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		pi, _ := strconv.Atoi(waiting[i].Annotations[queuePriorityAnnotation])
+		pj, _ := strconv.Atoi(waiting[j].Annotations[queuePriorityAnnotation])
+		if pi != pj {
+			return pi > pj
+		}
+		ti, tj := waiting[i].CreationTimestamp, waiting[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return waiting[i].Name < waiting[j].Name
+	})
+	for i, l := range waiting {
+		if l.Name == name {
+			return len(slots), i, stale
+		}
+	}
+	// Our own lease hasn't shown up in the listing yet, assume the back of the queue
+	return len(slots), len(waiting), stale
+}
+
+// queueLength returns the number of running and waiting builds of the
+// leases and slots, the expired ones left out
+func queueLength(leases []coordinationv1.Lease, slots map[string]queueSlot, now time.Time) (int, int) {
+	pruneQueueSlots(slots, leases, now)
+	// No lease has an empty name, so they are all counted as waiting
+	running, waiting, _ := queuePosition(leases, slots, "", now)
+	return running, waiting
+}
+
+// queueLeases returns the leases of the builds of the queue of the builder
+func (d *Driver) queueLeases(ctx context.Context) ([]coordinationv1.Lease, error) {
+	leases, err := d.leaseClient.List(ctx, metav1.ListOptions{LabelSelector: queueLabel + "=" + d.deployment.Name})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the build queue")
+	}
+	return leases.Items, nil
+}
+
+// queueSlots returns the leases of the queue of the builder and its slots,
+// what 'inspect' shows of the queue the builds wait in
+func (d *Driver) queueSlots(ctx context.Context) ([]coordinationv1.Lease, map[string]queueSlot, error) {
+	leases, err := d.queueLeases(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	slotsLease, err := d.leaseClient.Get(ctx, queueSlotsName(d.deployment.Name), metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		return leases, map[string]queueSlot{}, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get the build queue slots")
+	}
+	return leases, parseQueueSlots(slotsLease), nil
+}
+
+// preemptionVictim picks the build holding a slot to preempt for a build of
+// the given priority, by the priorities the slots recorded: the lowest
+// priority build which started most recently (losing the least work), or ""
+// if there is no build of lower priority
+func preemptionVictim(slots map[string]queueSlot, priority int) string {
+	victim := ""
+	var victimSlot queueSlot
+	for name, slot := range slots {
+		if slot.Priority >= priority {
+			continue
+		}
+		if victim == "" || slot.Priority < victimSlot.Priority ||
+			slot.Priority == victimSlot.Priority && (slot.Since.After(victimSlot.Since) || slot.Since.Equal(victimSlot.Since) && name < victim) {
+			victim, victimSlot = name, slot
+		}
+	}
+	return victim
+}
@@ -0,0 +1,242 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientcoordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+func testQueueLease(name string, priority int, created, renewed time.Time, running bool) coordinationv1.Lease {
+	duration := int32(30)
+	renew := metav1.NewMicroTime(renewed)
+	l := coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+			Annotations: map[string]string{
+				queuePriorityAnnotation: strconv.Itoa(priority),
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renew,
+		},
+	}
+	if running {
+		l.Annotations[queueStateAnnotation] = queueStateRunning
+	}
+	return l
+}
+
+func Test_queuePosition(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	leases := []coordinationv1.Lease{
+		testQueueLease("running-low", 0, now.Add(-10*time.Minute), now, true),
+		testQueueLease("pr-1", 0, now.Add(-5*time.Minute), now, false),
+		testQueueLease("pr-2", 0, now.Add(-4*time.Minute), now, false),
+		testQueueLease("release", 10, now.Add(-1*time.Minute), now, false),
+		testQueueLease("crashed", 0, now.Add(-20*time.Minute), now.Add(-5*time.Minute), false),
+	}
+	slots := map[string]queueSlot{"running-low": {Since: now.Add(-9 * time.Minute)}}
+
+	running, index, stale := queuePosition(leases, slots, "release", now)
+	assert.Equal(t, 1, running)
+	assert.Equal(t, 0, index)
+	assert.Equal(t, []string{"crashed"}, stale)
+
+	_, index, _ = queuePosition(leases, slots, "pr-1", now)
+	assert.Equal(t, 1, index)
+	_, index, _ = queuePosition(leases, slots, "pr-2", now)
+	assert.Equal(t, 2, index)
+
+	// Not listed yet
+	_, index, _ = queuePosition(leases, slots, "new", now)
+	assert.Equal(t, 3, index)
+
+	running, waiting := queueLength(leases, slots, now)
+	assert.Equal(t, 1, running)
+	assert.Equal(t, 3, waiting)
+
+	// Preempted builds give up their slot
+	leases[0].Annotations[queueStateAnnotation] = queueStatePreempted
+	running, _ = queueLength(leases, slots, now)
+	assert.Equal(t, 0, running)
+}
+
+func Test_pruneQueueSlots(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	leases := []coordinationv1.Lease{
+		testQueueLease("running", 0, now.Add(-10*time.Minute), now, true),
+		testQueueLease("crashed", 0, now.Add(-20*time.Minute), now.Add(-5*time.Minute), true),
+	}
+	slots := map[string]queueSlot{
+		"running": {Since: now.Add(-9 * time.Minute)},
+		"crashed": {Since: now.Add(-19 * time.Minute)},
+		// Claimed after the listing
+		"new":      {Since: now.Add(-time.Second)},
+		"released": {Since: now.Add(-time.Hour)},
+	}
+	pruneQueueSlots(slots, leases, now)
+	assert.Equal(t, []string{"new", "running"}, queueSlotNames(slots))
+}
+
+func queueSlotNames(slots map[string]queueSlot) []string {
+	var res []string
+	for name := range slots {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// fakeLeases stores Leases, rejecting the updates of a stale resourceVersion
+// as the API server does
+type fakeLeases struct {
+	clientcoordinationv1.LeaseInterface
+
+	mu      sync.Mutex
+	leases  map[string]coordinationv1.Lease
+	version int
+}
+
+func (f *fakeLeases) Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.leases[name]
+	if !ok {
+		return nil, kubeerrors.NewNotFound(coordinationv1.Resource("leases"), name)
+	}
+	l.Annotations = copyStrings(l.Annotations)
+	return &l, nil
+}
+
+func (f *fakeLeases) Create(ctx context.Context, l *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.leases[l.Name]; ok {
+		return nil, kubeerrors.NewAlreadyExists(coordinationv1.Resource("leases"), l.Name)
+	}
+	return f.store(l), nil
+}
+
+func (f *fakeLeases) Update(ctx context.Context, l *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leases[l.Name].ResourceVersion != l.ResourceVersion {
+		return nil, kubeerrors.NewConflict(coordinationv1.Resource("leases"), l.Name, errors.New("the object has been modified"))
+	}
+	return f.store(l), nil
+}
+
+func (f *fakeLeases) store(l *coordinationv1.Lease) *coordinationv1.Lease {
+	f.version++
+	stored := *l
+	stored.ResourceVersion = strconv.Itoa(f.version)
+	stored.Annotations = copyStrings(l.Annotations)
+	f.leases[l.Name] = stored
+	return &stored
+}
+
+func copyStrings(m map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
+
+func Test_claimQueueSlot(t *testing.T) {
+	t.Parallel()
+	leaseClient := &fakeLeases{leases: map[string]coordinationv1.Lease{}}
+	d := &Driver{
+		deployment:  &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "buildkit"}},
+		leaseClient: leaseClient,
+	}
+	now := time.Now()
+	var leases []coordinationv1.Lease
+	for i := 0; i < 8; i++ {
+		leases = append(leases, testQueueLease(fmt.Sprintf("build-%d", i), 0, now, now, false))
+	}
+
+	// Every build saw two free slots, only two of them may take one
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var claimed []string
+	for _, l := range leases {
+		name := l.Name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pos, _, err := d.claimQueueSlot(context.Background(), leases, name, 0, 2, false)
+			if assert.NoError(t, err) && pos < 0 {
+				mu.Lock()
+				claimed = append(claimed, name)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, claimed, 2)
+	slotsLease, err := leaseClient.Get(context.Background(), queueSlotsName("buildkit"), metav1.GetOptions{})
+	require.NoError(t, err)
+	sort.Strings(claimed)
+	require.Equal(t, claimed, queueSlotNames(parseQueueSlots(slotsLease)))
+
+	// Full
+	pos, victim, err := d.claimQueueSlot(context.Background(), leases, "build-7", 0, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, "", victim)
+	require.True(t, pos >= 2)
+
+	// Freed
+	require.NoError(t, d.releaseQueueSlot(context.Background(), claimed[0]))
+	slotsLease, err = leaseClient.Get(context.Background(), queueSlotsName("buildkit"), metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, claimed[1:], queueSlotNames(parseQueueSlots(slotsLease)))
+
+	// A build of higher priority takes over the slot of the running one
+	leases = append(leases, testQueueLease("release", 10, now, now, false))
+	pos, victim, err = d.claimQueueSlot(context.Background(), leases, "release", 10, 1, true)
+	require.NoError(t, err)
+	require.Equal(t, -1, pos)
+	require.Equal(t, claimed[1], victim)
+	slotsLease, err = leaseClient.Get(context.Background(), queueSlotsName("buildkit"), metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"release"}, queueSlotNames(parseQueueSlots(slotsLease)))
+	require.Equal(t, 10, parseQueueSlots(slotsLease)["release"].Priority)
+}
+
+func Test_preemptionVictim(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	slots := map[string]queueSlot{
+		"nightly": {Priority: 5, Since: now.Add(-30 * time.Minute)},
+		"pr-old":  {Priority: 0, Since: now.Add(-20 * time.Minute)},
+		// Queued long before, started last
+		"pr-new": {Priority: 0, Since: now.Add(-2 * time.Minute)},
+	}
+	assert.Equal(t, "pr-new", preemptionVictim(slots, 10))
+	assert.Equal(t, "pr-new", preemptionVictim(slots, 5))
+	assert.Equal(t, "", preemptionVictim(slots, 0))
+	delete(slots, "pr-new")
+	delete(slots, "pr-old")
+	assert.Equal(t, "nightly", preemptionVictim(slots, 10))
+	assert.Equal(t, "", preemptionVictim(slots, 5))
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// createReplicaClasses creates the deployments of the replica classes which
+// don't exist yet, existing ones are left as they are like the builder
+func (d *Driver) createReplicaClasses(ctx context.Context) error {
+	for _, depl := range d.replicaClasses {
+		_, err := d.deploymentClient.Get(ctx, depl.Name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get replica class %s", depl.Name)
+		}
+		if _, err := d.deploymentClient.Create(ctx, depl, metav1.CreateOptions{}); err != nil && !kubeerrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create replica class %s", depl.Name)
+		}
+	}
+	return nil
+}
+
+// rmReplicaClasses removes the replica classes recorded on the builder
+func (d *Driver) rmReplicaClasses(ctx context.Context) error {
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		// Reported by the removal of the builder
+		return nil
+	}
+	for _, class := range strings.Split(depl.ObjectMeta.Annotations[manifest.ReplicaClassesAnnotation], ",") {
+		if class == "" {
+			continue
+		}
+		name := manifest.ReplicaClassDeploymentName(d.deployment.Name, class)
+		if err := d.deploymentClient.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error while calling deploymentClient.Delete for %q", name)
+		}
+	}
+	return nil
+}
+
+// buildDeploymentName is the deployment of the pods builds run on
+func (d *Driver) buildDeploymentName() string {
+	if d.replicaClass != "" {
+		return manifest.ReplicaClassDeploymentName(d.deployment.Name, d.replicaClass)
+	}
+	return d.deployment.Name
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// detectRuntimes re-initializes a builder of the auto runtime for the
+// runtimes of the nodes it may run on.  Without access to the nodes the
+// builder is created for the default runtime, and for the other one if its
+// pods fail to start.
+func (d *Driver) detectRuntimes(ctx context.Context, sub progress.SubLogger) error {
+	if d.runtimesDetected || d.userSpecifiedRuntime || d.nodeClient == nil {
+		return nil
+	}
+	d.runtimesDetected = true
+	nodes, err := d.nodeClient.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(d.deploymentOpt.NodeSelector).String(),
+	})
+	if err != nil {
+		logrus.Debugf("failed to list the nodes to detect their runtime: %s", err)
+		return nil
+	}
+	runtimeNodes := map[string][]string{}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !manifest.SchedulableNode(d.deploymentOpt, node) {
+			continue
+		}
+		runtime := manifest.NodeRuntime(node.Status.NodeInfo.ContainerRuntimeVersion)
+		if runtime == "" {
+			logrus.Debugf("node %s runs the unsupported runtime %s", node.Name, node.Status.NodeInfo.ContainerRuntimeVersion)
+			continue
+		}
+		hostname := node.Labels[corev1.LabelHostname]
+		if hostname == "" {
+			hostname = node.Name
+		}
+		runtimeNodes[runtime] = append(runtimeNodes[runtime], hostname)
+	}
+	if len(runtimeNodes) == 0 {
+		return nil
+	}
+	runtimes := manifest.SortedRuntimes(runtimeNodes)
+	primary := manifest.PrimaryRuntime(runtimeNodes)
+	if len(runtimes) > 1 {
+		d.runtimeNodes = runtimeNodes
+		sub.Log(1, []byte(fmt.Sprintf("the nodes run %s, creating a %s builder with pods for each runtime\n", strings.Join(runtimes, ", "), primary)))
+	} else {
+		sub.Log(1, []byte(fmt.Sprintf("the nodes run %s, creating a %s builder\n", primary, primary)))
+	}
+	if d.InitConfig.DriverOpts == nil {
+		d.InitConfig.DriverOpts = map[string]string{}
+	}
+	d.InitConfig.DriverOpts["runtime"] = primary
+	return d.initDriverFromConfig()
+}
+
+// initRuntimeDeployments keeps the builder pods to the nodes of its runtime,
+// and derives the runtime deployments of the other runtimes of runtimeNodes
+// from the options of the builder
+func (d *Driver) initRuntimeDeployments(patch []byte) error {
+	d.runtimeDeployments = nil
+	if len(d.runtimeNodes) < 2 {
+		return nil
+	}
+	opt := d.deploymentOpt
+	for _, depl := range append([]*appsv1.Deployment{d.deployment}, d.replicaClasses...) {
+		manifest.PinToNodes(depl, d.runtimeNodes[opt.ContainerRuntime])
+	}
+	if d.cacheClaim != nil || (d.deploymentKind != "" && d.deploymentKind != DeploymentKindDeployment) {
+		// The claim and the pods of DaemonSets and StatefulSets belong to the builder
+		logrus.Warnf("builder %s only runs on the %s nodes, its cache storage or deployment kind can't be split by runtime", opt.Name, opt.ContainerRuntime)
+		return nil
+	}
+	var runtimes []string
+	for _, runtime := range manifest.SortedRuntimes(d.runtimeNodes) {
+		if runtime == opt.ContainerRuntime {
+			continue
+		}
+		runtimeOpt := *opt
+		runtimeOpt.ContainerRuntime = runtime
+		runtimeOpt.Worker = WorkerRunc
+		if worker := d.InitConfig.DriverOpts["worker"]; runtime == manifest.RuntimeContainerd && (worker == "" || worker == "auto") &&
+			!opt.Rootless && opt.ScratchSize == "" {
+			runtimeOpt.Worker = WorkerContainerd
+		}
+		depl, err := manifest.NewDeployment(&runtimeOpt)
+		if err != nil {
+			return err
+		}
+		if patch != nil {
+			if depl, err = manifest.PatchDeployment(depl, patch); err != nil {
+				return errors.Wrapf(err, "failed to patch the %s pods of the builder", runtime)
+			}
+		}
+		d.runtimeDeployments = append(d.runtimeDeployments, manifest.NewRuntimeDeployment(depl, &runtimeOpt, d.runtimeNodes[runtime]))
+		runtimes = append(runtimes, runtime)
+	}
+	d.deployment.Annotations[manifest.RuntimesAnnotation] = strings.Join(runtimes, ",")
+	return nil
+}
+
+// createRuntimeDeployments creates the runtime deployments which don't
+// exist yet, existing ones are left as they are like the builder
+func (d *Driver) createRuntimeDeployments(ctx context.Context) error {
+	for _, depl := range d.runtimeDeployments {
+		_, err := d.deploymentClient.Get(ctx, depl.Name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get runtime deployment %s", depl.Name)
+		}
+		if _, err := d.deploymentClient.Create(ctx, depl, metav1.CreateOptions{}); err != nil && !kubeerrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create runtime deployment %s", depl.Name)
+		}
+	}
+	return nil
+}
+
+// rmRuntimeDeployments removes the runtime deployments recorded on the builder
+func (d *Driver) rmRuntimeDeployments(ctx context.Context) error {
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		// Reported by the removal of the builder
+		return nil
+	}
+	for _, runtime := range strings.Split(depl.ObjectMeta.Annotations[manifest.RuntimesAnnotation], ",") {
+		if runtime == "" {
+			continue
+		}
+		name := manifest.RuntimeDeploymentName(d.deployment.Name, runtime)
+		if err := d.deploymentClient.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete runtime deployment %s", name)
+		}
+	}
+	return nil
+}
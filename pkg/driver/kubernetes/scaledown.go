@@ -0,0 +1,106 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The pod chosen for a build is annotated with the time of the build and a
+// pod deletion cost growing with it, so when the ReplicaSet scales in (for any
+// reason) the pods which built least recently, with the coldest caches, are
+// removed first.  Builders created with a scale-down idle duration are scaled
+// in by the builds themselves, removing the pods idle for longer.
+
+const (
+	lastBuildAnnotation       = "buildkit.mobyproject.org/last-build"
+	podDeletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+)
+
+// recordPodUse marks pod as used for a build and scales in idle replicas
+func (d *Driver) recordPodUse(ctx context.Context, pod *corev1.Pod, otherPods []*corev1.Pod) {
+	now := time.Now()
+	if err := d.markPodUsed(ctx, pod, now); err != nil {
+		logrus.Debugf("failed to record the build on pod %s: %s", pod.Name, err)
+	}
+	if len(otherPods) == 0 {
+		return
+	}
+	if err := d.scaleDownIdle(ctx, otherPods, now); err != nil {
+		logrus.Debugf("failed to scale down idle replicas of %s: %s", d.buildDeploymentName(), err)
+	}
+}
+
+func (d *Driver) markPodUsed(ctx context.Context, pod *corev1.Pod, now time.Time) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				lastBuildAnnotation: now.UTC().Format(time.RFC3339),
+				// Minutes fit the int32 cost for the foreseeable future
+				podDeletionCostAnnotation: strconv.FormatInt(now.Unix()/60, 10),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = d.podClient.Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// scaleDownIdle removes the replicas that didn't build for the builder's
+// scale-down idle duration, the pod in use is never counted as idle
+func (d *Driver) scaleDownIdle(ctx context.Context, otherPods []*corev1.Pod, now time.Time) error {
+	depl, err := d.builderClient.Get(ctx, d.buildDeploymentName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	idle, err := time.ParseDuration(depl.ObjectMeta.Annotations[manifest.ScaleDownIdleAnnotation])
+	if err != nil || idle <= 0 || depl.Spec.Replicas == nil {
+		return nil
+	}
+	cold := idlePods(otherPods, idle, now)
+	replicas := *depl.Spec.Replicas - int32(len(cold))
+	if min := minReplicas(depl); replicas < min {
+		replicas = min
+	}
+	if replicas >= *depl.Spec.Replicas {
+		return nil
+	}
+	logrus.Infof("scaling %s down to %d replicas, %d idle for over %s", depl.Name, replicas, len(cold), idle)
+	depl.Spec.Replicas = &replicas
+	// A conflict means another build changed the builder, it retries on its next build
+	_, err = d.builderClient.Update(ctx, depl, metav1.UpdateOptions{})
+	return err
+}
+
+// idlePods returns the pods which didn't build within idle of now, least
+// recently used first.  Pods that never built are idle since their creation.
+func idlePods(pods []*corev1.Pod, idle time.Duration, now time.Time) []*corev1.Pod {
+	lastUse := func(pod *corev1.Pod) time.Time {
+		if t, err := time.Parse(time.RFC3339, pod.Annotations[lastBuildAnnotation]); err == nil {
+			return t
+		}
+		return pod.CreationTimestamp.Time
+	}
+	var res []*corev1.Pod
+	for _, pod := range pods {
+		if now.Sub(lastUse(pod)) > idle {
+			res = append(res, pod)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return lastUse(res[i]).Before(lastUse(res[j]))
+	})
+	return res
+}
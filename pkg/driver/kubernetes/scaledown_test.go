@@ -0,0 +1,34 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_idlePods(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	pod := func(name string, created time.Time, lastBuild string) *corev1.Pod {
+		p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(created)}}
+		if lastBuild != "" {
+			p.Annotations = map[string]string{lastBuildAnnotation: lastBuild}
+		}
+		return p
+	}
+	pods := []*corev1.Pod{
+		pod("warm", now.Add(-48*time.Hour), now.Add(-time.Minute).Format(time.RFC3339)),
+		pod("cold", now.Add(-48*time.Hour), now.Add(-3*time.Hour).Format(time.RFC3339)),
+		pod("unused", now.Add(-5*time.Hour), ""),
+		pod("new", now.Add(-time.Minute), ""),
+	}
+	idle := idlePods(pods, time.Hour, now)
+	require.Len(t, idle, 2)
+	require.Equal(t, "unused", idle[0].Name)
+	require.Equal(t, "cold", idle[1].Name)
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// detectSecurityProfile re-initializes a builder of the auto security
+// profile with the restricted profile if its namespace enforces the
+// restricted Pod Security Standard, which would reject its pods otherwise
+func (d *Driver) detectSecurityProfile(ctx context.Context, sub progress.SubLogger) error {
+	if d.securityProfileDetected || d.clientset == nil {
+		return nil
+	}
+	d.securityProfileDetected = true
+	if d.securityProfile != "" && d.securityProfile != manifest.SecurityProfileAuto {
+		return nil
+	}
+	ns, err := d.clientset.CoreV1().Namespaces().Get(ctx, d.namespace, metav1.GetOptions{})
+	if err != nil {
+		// The builder is created as configured without access to its namespace
+		logrus.Debugf("failed to read the pod security of namespace %s: %s", d.namespace, err)
+		return nil
+	}
+	if !manifest.EnforcesRestricted(ns.Labels) {
+		return nil
+	}
+	sub.Log(1, []byte(fmt.Sprintf("namespace %s enforces the restricted Pod Security Standard, creating a %s builder\n", d.namespace, manifest.SecurityProfileRestricted)))
+	if d.InitConfig.DriverOpts == nil {
+		d.InitConfig.DriverOpts = map[string]string{}
+	}
+	d.InitConfig.DriverOpts["security-profile"] = manifest.SecurityProfileRestricted
+	return d.initDriverFromConfig()
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sharedCache holds the objects of the registry the builder pods share their
+// layer cache through
+type sharedCache struct {
+	name          string
+	claim         *corev1.PersistentVolumeClaim
+	deployment    *appsv1.Deployment
+	service       *corev1.Service
+	networkPolicy *networkingv1.NetworkPolicy
+}
+
+func newSharedCache(opt *manifest.DeploymentOpt) (*sharedCache, error) {
+	depl, svc, claim, err := manifest.NewSharedCache(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedCache{
+		name:          manifest.SharedCacheName(opt),
+		claim:         claim,
+		deployment:    depl,
+		service:       svc,
+		networkPolicy: manifest.NewSharedCacheNetworkPolicy(opt),
+	}, nil
+}
+
+// Create or update the shared cache, the claim keeps the cache of a
+// recreated builder
+func (d *Driver) createSharedCache(ctx context.Context) error {
+	c := d.sharedCache
+	wrap := func(err error, kind string) error {
+		return errors.Wrapf(err, "failed to create shared cache %s %q", kind, c.name)
+	}
+
+	_, err := d.claimClient.Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.claimClient.Create(ctx, c.claim, metav1.CreateOptions{})
+		if kubeerrors.IsAlreadyExists(err) {
+			// Created by a concurrent build
+			err = nil
+		}
+	}
+	if err != nil {
+		return wrap(err, "claim")
+	}
+
+	existingDepl, err := d.deploymentClient.Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.deploymentClient.Create(ctx, c.deployment, metav1.CreateOptions{})
+	} else if err == nil {
+		c.deployment.ResourceVersion = existingDepl.ResourceVersion
+		_, err = d.deploymentClient.Update(ctx, c.deployment, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return wrap(err, "deployment")
+	}
+
+	// The service spec is mostly immutable (clusterIP) so it's only created
+	_, err = d.serviceClient.Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.serviceClient.Create(ctx, c.service, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return wrap(err, "service")
+	}
+
+	existingNP, err := d.networkPolicyClient.Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		_, err = d.networkPolicyClient.Create(ctx, c.networkPolicy, metav1.CreateOptions{})
+	} else if err == nil {
+		c.networkPolicy.ResourceVersion = existingNP.ResourceVersion
+		_, err = d.networkPolicyClient.Update(ctx, c.networkPolicy, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return wrap(err, "network policy")
+	}
+	return nil
+}
+
+// rmSharedCache removes the shared cache and its claim, the builder may have
+// been created without one
+func (d *Driver) rmSharedCache(ctx context.Context) error {
+	name := manifest.SharedCacheName(&manifest.DeploymentOpt{Name: d.deployment.Name})
+	for kind, del := range map[string]func() error{
+		"deployment":     func() error { return d.deploymentClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+		"service":        func() error { return d.serviceClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+		"claim":          func() error { return d.claimClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+		"network policy": func() error { return d.networkPolicyClient.Delete(ctx, name, metav1.DeleteOptions{}) },
+	} {
+		if err := del(); err != nil && !kubeerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete shared cache %s %q", kind, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The TLS secret of a builder is generated on create unless an existing one
+// is given, it has the CA, the certificate of buildkitd for TLSServerName
+// and the client certificate of the CLI.  Users who can read the secret can
+// build, the builds of the others fail to connect.
+
+// TLSCertValidity is how long the certificates generated for a builder are
+// valid, delete the secret and recreate the builder to renew them
+const TLSCertValidity = 5 * 365 * 24 * time.Hour
+
+// generateTLSCertificates returns the data of a TLS secret with a new CA,
+// and the buildkitd and client certificates it issued
+func generateTLSCertificates(now time.Time) (map[string][]byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "buildkit CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(TLSCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{
+		manifest.TLSCACertKey: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+	}
+	issue := func(cn string, usage x509.ExtKeyUsage, dnsNames []string, ips []net.IP, certKey, keyKey string) error {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		serial, err := newSerialNumber()
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(TLSCertValidity),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     dnsNames,
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		data[certKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		data[keyKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+		return nil
+	}
+	if err := issue(manifest.TLSServerName, x509.ExtKeyUsageServerAuth, []string{manifest.TLSServerName}, []net.IP{net.IPv4(127, 0, 0, 1)}, manifest.TLSCertKey, manifest.TLSKeyKey); err != nil {
+		return nil, err
+	}
+	if err := issue("kubectl-buildkit", x509.ExtKeyUsageClientAuth, nil, nil, manifest.TLSClientCertKey, manifest.TLSClientKeyKey); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// clientTLSConfig returns the configuration the CLI connects to buildkitd
+// with from the TLS secret, and checks the certificate of buildkitd was
+// issued by its CA
+func clientTLSConfig(secret *corev1.Secret) (*tls.Config, error) {
+	for _, k := range []string{manifest.TLSCACertKey, manifest.TLSCertKey, manifest.TLSClientCertKey, manifest.TLSClientKeyKey} {
+		if len(secret.Data[k]) == 0 {
+			return nil, errors.Errorf("TLS secret %s has no %s", secret.Name, k)
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[manifest.TLSCACertKey]) {
+		return nil, errors.Errorf("TLS secret %s has no valid CA certificate in %s", secret.Name, manifest.TLSCACertKey)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[manifest.TLSClientCertKey], secret.Data[manifest.TLSClientKeyKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid client certificate in TLS secret %s", secret.Name)
+	}
+	block, _ := pem.Decode(secret.Data[manifest.TLSCertKey])
+	if block == nil {
+		return nil, errors.Errorf("TLS secret %s has no valid certificate in %s", secret.Name, manifest.TLSCertKey)
+	}
+	server, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid certificate in TLS secret %s", secret.Name)
+	}
+	if _, err := server.Verify(x509.VerifyOptions{DNSName: manifest.TLSServerName, Roots: pool}); err != nil {
+		return nil, errors.Wrapf(err, "the buildkitd certificate of TLS secret %s is not valid for %s", secret.Name, manifest.TLSServerName)
+	}
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		ServerName:   manifest.TLSServerName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// createTLSSecret generates the TLS secret of the builder unless it exists,
+// an existing secret given on create has to
+func (d *Driver) createTLSSecret(ctx context.Context) error {
+	secret, err := d.secretClient.Get(ctx, d.tlsSecret.Name, metav1.GetOptions{})
+	if err == nil {
+		_, err = clientTLSConfig(secret)
+		return err
+	}
+	if !kubeerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get TLS secret %s", d.tlsSecret.Name)
+	}
+	if !d.tlsGenerate {
+		return errors.Errorf("TLS secret %s not found, it needs the %s, %s, %s, %s and %s keys", d.tlsSecret.Name,
+			manifest.TLSCACertKey, manifest.TLSCertKey, manifest.TLSKeyKey, manifest.TLSClientCertKey, manifest.TLSClientKeyKey)
+	}
+	secret = d.tlsSecret.DeepCopy()
+	if secret.Data, err = generateTLSCertificates(time.Now()); err != nil {
+		return errors.Wrap(err, "failed to generate the TLS certificates of the builder")
+	}
+	if _, err := d.secretClient.Create(ctx, secret, metav1.CreateOptions{}); err != nil && !kubeerrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error while calling secretClient.Create for %q", secret.Name)
+	}
+	return nil
+}
+
+// rmTLSSecret deletes the TLS secret generated for the builder, one given
+// on create is left
+func (d *Driver) rmTLSSecret(ctx context.Context, name string) error {
+	secret, err := d.secretClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if kubeerrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get TLS secret %s", name)
+	}
+	if secret.Labels["app"] != d.deployment.Name {
+		return nil
+	}
+	if err := d.secretClient.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error while calling secretClient.Delete for %q", name)
+	}
+	return nil
+}
+
+// clientTLS returns the configuration to connect to buildkitd with, nil if
+// the builder wasn't created with a TLS secret, and records the transport of
+// the builder.  They are read from the builder as created, pods found by its
+// labels don't decide them.
+func (d *Driver) clientTLS(ctx context.Context) (*tls.Config, error) {
+	d.tlsMu.Lock()
+	defer d.tlsMu.Unlock()
+	if d.tlsLoaded {
+		return d.tlsConfig, nil
+	}
+	depl, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get builder %s", d.deployment.Name)
+	}
+	d.transportName = depl.ObjectMeta.Annotations[manifest.TransportAnnotation]
+	if name := depl.ObjectMeta.Annotations[manifest.TLSSecretAnnotation]; name != "" {
+		secret, err := d.secretClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read TLS secret %s of builder %s, builds need to be allowed to get it", name, d.deployment.Name)
+		}
+		if d.tlsConfig, err = clientTLSConfig(secret); err != nil {
+			return nil, err
+		}
+	}
+	d.tlsLoaded = true
+	return d.tlsConfig, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// serverTLSConfig is how buildkitd serves with --tlscacert, --tlscert and
+// --tlskey of the secret
+func serverTLSConfig(t *testing.T, data map[string][]byte) *tls.Config {
+	cert, err := tls.X509KeyPair(data[manifest.TLSCertKey], data[manifest.TLSKeyKey])
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(data[manifest.TLSCACertKey]))
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func handshake(server, client *tls.Config) (error, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn := tls.Server(c1, server)
+		serverErr <- conn.Handshake()
+		conn.Close()
+	}()
+	conn := tls.Client(c2, client)
+	err := conn.Handshake()
+	conn.Close()
+	return <-serverErr, err
+}
+
+func Test_generateTLSCertificates(t *testing.T) {
+	t.Parallel()
+	data, err := generateTLSCertificates(time.Now())
+	require.NoError(t, err)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "buildkit-tls"}, Data: data}
+	client, err := clientTLSConfig(secret)
+	require.NoError(t, err)
+	require.Equal(t, manifest.TLSServerName, client.ServerName)
+
+	serverErr, clientErr := handshake(serverTLSConfig(t, data), client)
+	require.NoError(t, serverErr)
+	require.NoError(t, clientErr)
+
+	// Neither trusts the certificates of another builder
+	other, err := generateTLSCertificates(time.Now())
+	require.NoError(t, err)
+	serverErr, clientErr = handshake(serverTLSConfig(t, other), client)
+	require.Error(t, clientErr)
+	require.Error(t, serverErr)
+	otherClient, err := clientTLSConfig(&corev1.Secret{Data: other})
+	require.NoError(t, err)
+	serverErr, _ = handshake(serverTLSConfig(t, data), otherClient)
+	require.Error(t, serverErr)
+}
+
+func Test_clientTLSConfig(t *testing.T) {
+	t.Parallel()
+	data, err := generateTLSCertificates(time.Now())
+	require.NoError(t, err)
+	other, err := generateTLSCertificates(time.Now())
+	require.NoError(t, err)
+
+	missing := map[string][]byte{}
+	for k, v := range data {
+		missing[k] = v
+	}
+	delete(missing, manifest.TLSClientKeyKey)
+	_, err = clientTLSConfig(&corev1.Secret{Data: missing})
+	require.Error(t, err)
+
+	mismatched := map[string][]byte{}
+	for k, v := range data {
+		mismatched[k] = v
+	}
+	mismatched[manifest.TLSCertKey] = other[manifest.TLSCertKey]
+	_, err = clientTLSConfig(&corev1.Secret{Data: mismatched})
+	require.Error(t, err, "buildkitd certificate of another CA")
+}
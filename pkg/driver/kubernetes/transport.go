@@ -0,0 +1,281 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/execconn"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/exec"
+)
+
+// The CLI connects to buildkitd on a builder pod with the transport the
+// builder was created with, buildctl dial-stdio exec'd in the pod unless the
+// builder has a TLS listener, which the port-forward transport reaches
+// through the API server and the tcp transport on the pod IP, from within
+// the cluster, without a process in the pod in between.  A transport a pod
+// doesn't support, eg. as it predates the builder's TLS listener, or that
+// fails to connect, falls back to the next one down to exec, which every
+// pod supports.  A build cancelled from another client has its buildctl
+// killed, which closes its exec connection; the connections of the other
+// transports are tied to a process tagged with the build ID the same way.
+
+// tcpDialTimeout bounds dialing the pod IP, which outside of the cluster
+// usually doesn't answer at all
+const tcpDialTimeout = 5 * time.Second
+
+// Transport connects the CLI to buildkitd on a builder pod
+type Transport interface {
+	// Name is the name of the transport, see the manifest.Transport constants
+	Name() string
+	// Supported is nil if the transport can connect to buildkitd on pod, or
+	// else why not
+	Supported(pod *corev1.Pod) error
+	// Dial connects to buildkitd on pod
+	Dial(ctx context.Context, pod *corev1.Pod) (net.Conn, error)
+}
+
+// transportFallbacks are the transports tried, in order, after each one
+var transportFallbacks = map[string][]string{
+	manifest.TransportTCP:         {manifest.TransportPortForward, manifest.TransportExec},
+	manifest.TransportPortForward: {manifest.TransportExec},
+	manifest.TransportExec:        nil,
+}
+
+// transportConfig is what the transports connect with, tlsConfig is nil
+// unless the builder has a TLS secret
+type transportConfig struct {
+	restClient rest.Interface
+	restConfig *rest.Config
+	tlsConfig  *tls.Config
+	ipFamily   string
+}
+
+// newTransports returns the transport name and its fallbacks
+func newTransports(name string, c transportConfig) ([]Transport, error) {
+	if name == "" {
+		name = manifest.TransportExec
+	}
+	fallbacks, ok := transportFallbacks[name]
+	if !ok {
+		return nil, errors.Errorf("unknown transport %q", name)
+	}
+	var res []Transport
+	for _, n := range append([]string{name}, fallbacks...) {
+		switch n {
+		case manifest.TransportExec:
+			res = append(res, &execTransport{c})
+		case manifest.TransportPortForward:
+			res = append(res, &portForwardTransport{c})
+		case manifest.TransportTCP:
+			res = append(res, &tcpTransport{c})
+		}
+	}
+	return res, nil
+}
+
+// transports returns the transports to connect to the pods of the builder
+// with, in the order they are tried
+func (d *Driver) transports(ctx context.Context) ([]Transport, error) {
+	restConfig, err := d.KubeClientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := d.clientTLS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transports, err := newTransports(d.transportName, transportConfig{
+		restClient: d.clientset.CoreV1().RESTClient(),
+		restConfig: restConfig,
+		tlsConfig:  tlsConfig,
+		ipFamily:   d.ipFamily,
+	})
+	if err != nil {
+		return nil, err
+	}
+	permitted := permittedTransports(transports, d.transportAccess(ctx))
+	if len(permitted) == 0 {
+		return nil, deniedTransportError(transports, d.namespace, d.deployment.Name)
+	}
+	return permitted, nil
+}
+
+// dialBuildkitd connects to buildkitd on pod with the first of transports
+// that supports the pod and connects
+func dialBuildkitd(ctx context.Context, pod *corev1.Pod, transports []Transport) (net.Conn, error) {
+	if len(transports) == 0 {
+		return nil, errors.Errorf("no transport to connect to pod %s", pod.Name)
+	}
+	var err error
+	for _, t := range transports {
+		if err = t.Supported(pod); err != nil {
+			logrus.Debugf("transport %s can't connect to pod %s: %s", t.Name(), pod.Name, err)
+			continue
+		}
+		var conn net.Conn
+		if conn, err = t.Dial(ctx, pod); err == nil {
+			return conn, nil
+		}
+		logrus.Debugf("transport %s failed to connect to pod %s: %s", t.Name(), pod.Name, err)
+	}
+	return nil, err
+}
+
+// listensOn is true if buildkitd on pod listens on addr
+func listensOn(pod *corev1.Pod, addr string) bool {
+	name := manifest.BuilderContainer(pod)
+	for _, c := range pod.Spec.Containers {
+		if c.Name != name {
+			continue
+		}
+		for _, arg := range c.Args {
+			if arg == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// execTransport execs buildctl dial-stdio in the pod, through to the TLS
+// listener if any
+type execTransport struct {
+	transportConfig
+}
+
+func (t *execTransport) Name() string {
+	return manifest.TransportExec
+}
+
+func (t *execTransport) Supported(pod *corev1.Pod) error {
+	return nil
+}
+
+func (t *execTransport) Dial(ctx context.Context, pod *corev1.Pod) (net.Conn, error) {
+	cmd := []string{"buildctl", "dial-stdio"}
+	if t.tlsConfig != nil {
+		cmd = []string{"buildctl", "--addr", manifest.TLSAddress, "dial-stdio"}
+	}
+	if id := driver.BuildID(ctx); id != "" {
+		// Killing the tagged buildctl closes the session, which cancels the solve
+		cmd = append([]string{"env", driver.BuildIDEnv + "=" + id}, cmd...)
+	}
+	conn, err := execconn.ExecConn(t.restClient, t.restConfig,
+		pod.Namespace, pod.Name, manifest.BuilderContainer(pod), cmd)
+	if err != nil {
+		return nil, err
+	}
+	if t.tlsConfig != nil {
+		conn = tls.Client(conn, t.tlsConfig.Clone())
+	}
+	return conn, nil
+}
+
+// portForwardTransport forwards the TLS port of the pod through the API
+// server
+type portForwardTransport struct {
+	transportConfig
+}
+
+func (t *portForwardTransport) Name() string {
+	return manifest.TransportPortForward
+}
+
+func (t *portForwardTransport) Supported(pod *corev1.Pod) error {
+	if t.tlsConfig == nil || !(listensOn(pod, manifest.TLSAddress) || listensOn(pod, manifest.TLSPodAddress)) {
+		return errors.New("buildkitd has no TLS listener")
+	}
+	return nil
+}
+
+func (t *portForwardTransport) Dial(ctx context.Context, pod *corev1.Pod) (net.Conn, error) {
+	conn, err := execconn.PortForwardConn(t.restClient, t.restConfig, pod.Namespace, pod.Name, manifest.TLSPort)
+	if err != nil {
+		return nil, err
+	}
+	return t.withCancelSentinel(ctx, pod, tls.Client(conn, t.tlsConfig.Clone())), nil
+}
+
+// tcpTransport dials the TLS port of the pod IP
+type tcpTransport struct {
+	transportConfig
+}
+
+func (t *tcpTransport) Name() string {
+	return manifest.TransportTCP
+}
+
+func (t *tcpTransport) Supported(pod *corev1.Pod) error {
+	switch {
+	case t.tlsConfig == nil || !listensOn(pod, manifest.TLSPodAddress):
+		return errors.New("buildkitd doesn't listen on the pod IP")
+	case podAddress(pod, t.ipFamily) == "":
+		return errors.New("the pod has no IP")
+	}
+	return nil
+}
+
+func (t *tcpTransport) Dial(ctx context.Context, pod *corev1.Pod) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: tcpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(podAddress(pod, t.ipFamily), strconv.Itoa(manifest.TLSPort)))
+	if err != nil {
+		return nil, err
+	}
+	return t.withCancelSentinel(ctx, pod, tls.Client(conn, t.tlsConfig.Clone())), nil
+}
+
+// withCancelSentinel ties conn to a process in pod tagged with the build ID
+// of ctx, if any, like the buildctl of an exec connection: conn is closed
+// once cancel kills it.  A build whose sentinel can't be exec'd, eg. as exec
+// isn't permitted, can't be cancelled from another client.
+func (c transportConfig) withCancelSentinel(ctx context.Context, pod *corev1.Pod, conn net.Conn) net.Conn {
+	id := driver.BuildID(ctx)
+	if id == "" {
+		return conn
+	}
+	cmd := []string{"env", driver.BuildIDEnv + "=" + id, "sh", "-c", "exec cat > /dev/null"}
+	sentinel, err := execconn.ExecConn(c.restClient, c.restConfig, pod.Namespace, pod.Name, manifest.BuilderContainer(pod), cmd)
+	if err != nil {
+		logrus.Debugf("build %s can't be cancelled on pod %s: %s", id, pod.Name, err)
+		return conn
+	}
+	return closeOnKill(conn, sentinel)
+}
+
+// closeOnKill closes conn once the process of sentinel exits with a code,
+// as killed.  The sentinel failing otherwise leaves conn open.  Closing the
+// returned conn ends the sentinel.
+func closeOnKill(conn net.Conn, sentinel io.ReadWriteCloser) net.Conn {
+	go func() {
+		_, err := io.Copy(ioutil.Discard, sentinel)
+		var exitErr exec.CodeExitError
+		if errors.As(err, &exitErr) {
+			conn.Close()
+		}
+	}()
+	return &sentinelConn{Conn: conn, sentinel: sentinel}
+}
+
+// sentinelConn ends its sentinel with the connection
+type sentinelConn struct {
+	net.Conn
+	sentinel io.Closer
+}
+
+func (c *sentinelConn) Close() error {
+	c.sentinel.Close()
+	return c.Conn.Close()
+}
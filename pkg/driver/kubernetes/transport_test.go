@@ -0,0 +1,183 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/exec"
+)
+
+type fakeTransport struct {
+	name        string
+	unsupported error
+	dialErr     error
+	dialed      bool
+}
+
+func (t *fakeTransport) Name() string {
+	return t.name
+}
+
+func (t *fakeTransport) Supported(pod *corev1.Pod) error {
+	return t.unsupported
+}
+
+func (t *fakeTransport) Dial(ctx context.Context, pod *corev1.Pod) (net.Conn, error) {
+	t.dialed = true
+	if t.dialErr != nil {
+		return nil, t.dialErr
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func transportNames(transports []Transport) []string {
+	var res []string
+	for _, t := range transports {
+		res = append(res, t.Name())
+	}
+	return res
+}
+
+func Test_newTransports(t *testing.T) {
+	t.Parallel()
+	transports, err := newTransports("", transportConfig{})
+	require.NoError(t, err)
+	require.Equal(t, []string{manifest.TransportExec}, transportNames(transports))
+
+	transports, err = newTransports(manifest.TransportPortForward, transportConfig{})
+	require.NoError(t, err)
+	require.Equal(t, []string{manifest.TransportPortForward, manifest.TransportExec}, transportNames(transports))
+
+	transports, err = newTransports(manifest.TransportTCP, transportConfig{})
+	require.NoError(t, err)
+	require.Equal(t, []string{manifest.TransportTCP, manifest.TransportPortForward, manifest.TransportExec}, transportNames(transports))
+
+	_, err = newTransports("quic", transportConfig{})
+	require.Error(t, err)
+}
+
+func Test_dialBuildkitd(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{}
+	tcp := &fakeTransport{name: manifest.TransportTCP, unsupported: errors.New("no pod IP")}
+	portForward := &fakeTransport{name: manifest.TransportPortForward, dialErr: errors.New("forbidden")}
+	exec := &fakeTransport{name: manifest.TransportExec}
+	conn, err := dialBuildkitd(context.Background(), pod, []Transport{tcp, portForward, exec})
+	require.NoError(t, err)
+	conn.Close()
+	require.False(t, tcp.dialed)
+	require.True(t, portForward.dialed)
+	require.True(t, exec.dialed)
+
+	// The error of the last transport tried is returned
+	exec.dialErr = errors.New("exec failed")
+	_, err = dialBuildkitd(context.Background(), pod, []Transport{portForward, exec})
+	require.EqualError(t, err, "exec failed")
+	_, err = dialBuildkitd(context.Background(), pod, nil)
+	require.Error(t, err)
+}
+
+func Test_transportSupported(t *testing.T) {
+	t.Parallel()
+	pod := func(args ...string) *corev1.Pod {
+		return &corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "buildkitd", Args: args}},
+			},
+			Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+		}
+	}
+	c := transportConfig{tlsConfig: &tls.Config{}}
+	require.NoError(t, (&execTransport{}).Supported(pod()))
+
+	require.NoError(t, (&portForwardTransport{c}).Supported(pod("--addr", manifest.TLSAddress)))
+	require.NoError(t, (&portForwardTransport{c}).Supported(pod("--addr", manifest.TLSPodAddress)))
+	require.Error(t, (&portForwardTransport{c}).Supported(pod()))
+	// The pod listens on TLS but the builder has no TLS secret to connect with
+	require.Error(t, (&portForwardTransport{}).Supported(pod("--addr", manifest.TLSAddress)))
+
+	require.NoError(t, (&tcpTransport{c}).Supported(pod("--addr", manifest.TLSPodAddress)))
+	// Pods rolled out before the builder listened on the pod IP
+	require.Error(t, (&tcpTransport{c}).Supported(pod("--addr", manifest.TLSAddress)))
+	noIP := pod("--addr", manifest.TLSPodAddress)
+	noIP.Status.PodIP = ""
+	require.Error(t, (&tcpTransport{c}).Supported(noIP))
+}
+
+func Test_permittedTransports(t *testing.T) {
+	t.Parallel()
+	transports, err := newTransports(manifest.TransportTCP, transportConfig{})
+	require.NoError(t, err)
+	require.Equal(t, transports, permittedTransports(transports, nil))
+
+	permitted := permittedTransports(transports, map[string]bool{manifest.TransportPortForward: true})
+	require.Equal(t, []string{manifest.TransportTCP, manifest.TransportPortForward}, transportNames(permitted))
+	permitted = permittedTransports(transports, map[string]bool{manifest.TransportExec: true})
+	require.Equal(t, []string{manifest.TransportTCP, manifest.TransportExec}, transportNames(permitted))
+
+	exec, err := newTransports(manifest.TransportExec, transportConfig{})
+	require.NoError(t, err)
+	require.Empty(t, permittedTransports(exec, map[string]bool{manifest.TransportPortForward: true}))
+	err = deniedTransportError(exec, "builds", "builder")
+	require.Contains(t, err.Error(), "pods/exec in namespace builds")
+	require.Contains(t, err.Error(), "--transport port-forward")
+}
+
+// fakeSentinel is the stdout of a sentinel process
+type fakeSentinel struct {
+	*io.PipeReader
+	closed chan struct{}
+}
+
+func (s *fakeSentinel) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (s *fakeSentinel) Close() error {
+	close(s.closed)
+	return s.PipeReader.Close()
+}
+
+func Test_closeOnKill(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name   string
+		err    error
+		closed bool
+	}{
+		{name: "killed", err: exec.CodeExitError{Err: errors.New("command terminated with non-zero exit code"), Code: 137}, closed: true},
+		{name: "exec denied", err: errors.New("unable to upgrade connection: Forbidden"), closed: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			conn, peer := net.Pipe()
+			r, w := io.Pipe()
+			sentinel := &fakeSentinel{PipeReader: r, closed: make(chan struct{})}
+			c := closeOnKill(conn, sentinel)
+			w.CloseWithError(tc.err)
+
+			peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := peer.Read(make([]byte, 1))
+			if tc.closed {
+				require.Equal(t, io.EOF, err)
+			} else {
+				ne, ok := err.(net.Error)
+				require.True(t, ok && ne.Timeout(), err)
+			}
+			require.NoError(t, c.Close())
+			<-sentinel.closed
+		})
+	}
+}
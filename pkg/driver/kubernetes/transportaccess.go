@@ -0,0 +1,115 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The exec transport needs creating pods/exec and the port-forward transport
+// pods/portforward, which namespaces denying exec often still grant.  A
+// builder of the auto transport, the default, is created with the exec
+// transport if its creator may exec in the pods of its namespace, or else
+// with TLS and the port-forward transport.  Each CLI leaves out the
+// transports its user isn't granted, as reviewed by the API server.
+
+// transportSubresources are the pod subresources the transports create
+var transportSubresources = map[string]string{
+	manifest.TransportExec:        "exec",
+	manifest.TransportPortForward: "portforward",
+}
+
+// transportAccess returns whether the user may create the pod subresource
+// of each transport, by transport name, nil if it couldn't be reviewed
+func (d *Driver) transportAccess(ctx context.Context) map[string]bool {
+	d.transportAccessMu.Lock()
+	defer d.transportAccessMu.Unlock()
+	if d.transportAccessReviewed {
+		return d.transportAccessAllowed
+	}
+	d.transportAccessReviewed = true
+	res := map[string]bool{}
+	for name, subresource := range transportSubresources {
+		review, err := d.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   d.namespace,
+					Verb:        "create",
+					Resource:    "pods",
+					Subresource: subresource,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			logrus.Debugf("failed to review the access to pods/%s: %s", subresource, err)
+			return nil
+		}
+		res[name] = review.Status.Allowed
+	}
+	d.transportAccessAllowed = res
+	return res
+}
+
+// permittedTransports leaves the transports the user isn't granted out of
+// transports, all of them are kept if access is nil
+func permittedTransports(transports []Transport, access map[string]bool) []Transport {
+	if access == nil {
+		return transports
+	}
+	var res []Transport
+	for _, t := range transports {
+		if _, ok := transportSubresources[t.Name()]; ok && !access[t.Name()] {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// deniedTransportError explains why none of transports may connect
+func deniedTransportError(transports []Transport, namespace, builder string) error {
+	var subresources []string
+	for _, t := range transports {
+		if subresource, ok := transportSubresources[t.Name()]; ok {
+			subresources = append(subresources, "pods/"+subresource)
+		}
+	}
+	err := errors.Errorf("connecting to builder %s needs creating %s in namespace %s, which you aren't granted", builder, strings.Join(subresources, " or "), namespace)
+	if len(subresources) == 1 && transports[0].Name() == manifest.TransportExec {
+		return errors.Wrapf(err, "recreate the builder with --tls --transport %s if you may port-forward", manifest.TransportPortForward)
+	}
+	return err
+}
+
+// detectTransport re-initializes a new builder of the auto transport with
+// TLS and the port-forward transport if its creator may port-forward to its
+// pods but not exec in them.  An existing builder keeps its transport.
+func (d *Driver) detectTransport(ctx context.Context, sub progress.SubLogger) error {
+	if !d.transportAuto || d.transportDetected || d.clientset == nil {
+		return nil
+	}
+	d.transportDetected = true
+	if _, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{}); err == nil {
+		return nil
+	}
+	access := d.transportAccess(ctx)
+	if access == nil || access[manifest.TransportExec] || !access[manifest.TransportPortForward] {
+		return nil
+	}
+	sub.Log(1, []byte(fmt.Sprintf("you may port-forward to the pods of namespace %s but not exec in them, creating a builder with tls and the %s transport\n", d.namespace, manifest.TransportPortForward)))
+	if d.InitConfig.DriverOpts == nil {
+		d.InitConfig.DriverOpts = map[string]string{}
+	}
+	d.InitConfig.DriverOpts["transport"] = manifest.TransportPortForward
+	d.InitConfig.DriverOpts["tls"] = "true"
+	return d.initDriverFromConfig()
+}
@@ -0,0 +1,280 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/progress"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// An update renders the builder from its options, as creating it would, and
+// compares it with the workloads running: the image, buildkitd arguments,
+// environment, resources and config of the pods, and the other options
+// recorded on the builder.  The pod template of the workloads which differ
+// is replaced, rolling their pods with the strategy of their kind, and their
+// cache claims are kept.  The replicas are only set when their option
+// changed, those of an autoscaled builder are left to the builds.
+
+// updatedOptions are the options whose change shows in the pod spec
+var updatedOptions = map[string]bool{
+	"image":          true,
+	"env":            true,
+	"requests":       true,
+	"limits":         true,
+	"priority-class": true,
+}
+
+// Update rolls the pods of the existing builder, its replica classes and
+// runtime deployments which differ from its options, waiting for the
+// updated pods to be ready unless the wait options say not to.  It returns
+// the changes, none if the builder is up to date.
+func (d *Driver) Update(ctx context.Context, l progress.Logger) ([]string, error) {
+	var changes []string
+	err := progress.Wrap("[internal] updating buildkit", l, func(sub progress.SubLogger) error {
+		if _, err := d.builderClient.Get(ctx, d.deployment.Name, metav1.GetOptions{}); err != nil {
+			if kubeerrors.IsNotFound(err) {
+				return errors.Errorf("builder %s doesn't exist, create it with 'kubectl buildkit create'", d.deployment.Name)
+			}
+			return errors.Wrapf(err, "failed to get builder %s", d.deployment.Name)
+		}
+		if err := d.detectSecurityProfile(ctx, sub); err != nil {
+			return err
+		}
+		if err := d.detectRuntimes(ctx, sub); err != nil {
+			return err
+		}
+		if err := d.detectTransport(ctx, sub); err != nil {
+			return err
+		}
+		if err := d.createConfigMap(ctx, sub); err != nil {
+			return err
+		}
+
+		var updated []workloadUpdate
+		for _, w := range d.updateWorkloads() {
+			var workloadChanges []string
+			err := retryOnConflict(ctx, "builder", w.desired.Name, func() error {
+				current, err := w.client.Get(ctx, w.desired.Name, metav1.GetOptions{})
+				if err != nil {
+					if kubeerrors.IsNotFound(err) && w.desired != d.deployment {
+						// Created below like on create
+						return nil
+					}
+					return err
+				}
+				workloadChanges = builderChanges(current, w.desired)
+				if len(workloadChanges) == 0 {
+					return nil
+				}
+				applyBuilderSpec(current, w.desired, recordedOptions(current).DriverOpts["replicas"] != recordedOptions(w.desired).DriverOpts["replicas"])
+				_, err = w.client.Update(ctx, current, metav1.UpdateOptions{})
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to update %s", w.desired.Name)
+			}
+			if len(workloadChanges) == 0 {
+				continue
+			}
+			for _, change := range workloadChanges {
+				if w.desired != d.deployment {
+					change = w.desired.Name + ": " + change
+				}
+				sub.Log(1, []byte(change+"\n"))
+				changes = append(changes, change)
+			}
+			updated = append(updated, w)
+		}
+		if err := d.createReplicaClasses(ctx); err != nil {
+			return err
+		}
+		if err := d.createRuntimeDeployments(ctx); err != nil {
+			return err
+		}
+		if len(updated) == 0 {
+			sub.Log(1, []byte(fmt.Sprintf("%s is up to date\n", d.deployment.Name)))
+			return nil
+		}
+		for _, w := range updated {
+			if err := d.waitRollout(ctx, sub, w.client, w.desired.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// workloadUpdate is a workload of the builder and the client managing it
+type workloadUpdate struct {
+	client  workloadClient
+	desired *appsv1.Deployment
+}
+
+// updateWorkloads returns the builder, first, and its other deployments
+func (d *Driver) updateWorkloads() []workloadUpdate {
+	res := []workloadUpdate{{client: d.builderClient, desired: d.deployment}}
+	for _, depl := range append(append([]*appsv1.Deployment{}, d.replicaClasses...), d.runtimeDeployments...) {
+		res = append(res, workloadUpdate{client: d.deploymentClient, desired: depl})
+	}
+	return res
+}
+
+// recordedOptions returns the options recorded on depl, none if it was
+// created by an older version
+func recordedOptions(depl *appsv1.Deployment) driver.BuilderConfig {
+	var cfg driver.BuilderConfig
+	_ = json.Unmarshal([]byte(depl.ObjectMeta.Annotations[manifest.CreateOptionsAnnotation]), &cfg)
+	return cfg
+}
+
+// builderChanges describes how the desired workload differs from the
+// current one
+func builderChanges(current, desired *appsv1.Deployment) []string {
+	var changes []string
+	cur := current.Spec.Template.Spec.Containers[0]
+	want := desired.Spec.Template.Spec.Containers[0]
+	if cur.Image != want.Image {
+		changes = append(changes, fmt.Sprintf("image %s -> %s", cur.Image, want.Image))
+	}
+	if strings.Join(cur.Args, " ") != strings.Join(want.Args, " ") {
+		changes = append(changes, fmt.Sprintf("buildkitd args %q -> %q", strings.Join(cur.Args, " "), strings.Join(want.Args, " ")))
+	}
+	if (len(cur.Env) > 0 || len(want.Env) > 0) && !reflect.DeepEqual(cur.Env, want.Env) {
+		changes = append(changes, "environment")
+	}
+	if a, b := formatResourceList(cur.Resources.Requests), formatResourceList(want.Resources.Requests); a != b {
+		changes = append(changes, fmt.Sprintf("requests %q -> %q", a, b))
+	}
+	if a, b := formatResourceList(cur.Resources.Limits), formatResourceList(want.Resources.Limits); a != b {
+		changes = append(changes, fmt.Sprintf("limits %q -> %q", a, b))
+	}
+	if a, b := current.Spec.Template.Spec.PriorityClassName, desired.Spec.Template.Spec.PriorityClassName; a != b {
+		changes = append(changes, fmt.Sprintf("priority class %q -> %q", a, b))
+	}
+	if current.Spec.Template.ObjectMeta.Annotations[manifest.ConfigDigestAnnotation] != desired.Spec.Template.ObjectMeta.Annotations[manifest.ConfigDigestAnnotation] {
+		changes = append(changes, "buildkitd config")
+	}
+
+	curOpts, wantOpts := recordedOptions(current), recordedOptions(desired)
+	keys := map[string]bool{}
+	for k := range curOpts.DriverOpts {
+		keys[k] = true
+	}
+	for k := range wantOpts.DriverOpts {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		if !updatedOptions[k] && curOpts.DriverOpts[k] != wantOpts.DriverOpts[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		changes = append(changes, fmt.Sprintf("%s %q -> %q", k, curOpts.DriverOpts[k], wantOpts.DriverOpts[k]))
+	}
+	if curOpts.Patch != wantOpts.Patch {
+		changes = append(changes, "patch")
+	}
+	return changes
+}
+
+// applyBuilderSpec sets the pods and options of current to those of
+// desired, and its replicas with replicas
+func applyBuilderSpec(current, desired *appsv1.Deployment, replicas bool) {
+	current.Spec.Template = *desired.Spec.Template.DeepCopy()
+	current.Spec.Strategy = desired.Spec.Strategy
+	if replicas {
+		current.Spec.Replicas = desired.Spec.Replicas
+	}
+	if current.ObjectMeta.Annotations == nil {
+		current.ObjectMeta.Annotations = map[string]string{}
+	}
+	for k, v := range desired.ObjectMeta.Annotations {
+		current.ObjectMeta.Annotations[k] = v
+	}
+	if current.ObjectMeta.Labels == nil {
+		current.ObjectMeta.Labels = map[string]string{}
+	}
+	for k, v := range desired.ObjectMeta.Labels {
+		current.ObjectMeta.Labels[k] = v
+	}
+}
+
+// formatResourceList formats the requests or limits as they are given
+func formatResourceList(l corev1.ResourceList) string {
+	var res []string
+	for name, q := range l {
+		res = append(res, string(name)+"="+q.String())
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// rolloutDone reports whether all the pods of depl run its latest spec and
+// are ready
+func rolloutDone(depl *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if depl.Spec.Replicas != nil {
+		replicas = *depl.Spec.Replicas
+	}
+	return depl.Status.ObservedGeneration >= depl.Generation &&
+		depl.Status.UpdatedReplicas >= replicas &&
+		depl.Status.Replicas <= depl.Status.UpdatedReplicas &&
+		depl.Status.ReadyReplicas >= replicas
+}
+
+// waitRollout waits for the pods of the workload name to be updated and
+// ready, logging why pending pods aren't coming up
+func (d *Driver) waitRollout(ctx context.Context, sub progress.SubLogger, client workloadClient, name string) error {
+	wait := driver.WaitOptions(ctx)
+	if wait.NoWait {
+		sub.Log(1, []byte(fmt.Sprintf("Updated %s, not waiting for its pods\n", name)))
+		return nil
+	}
+	return sub.Wrap(fmt.Sprintf("waiting for the pods of %s to be updated", name), func() error {
+		reported := map[string]bool{}
+		pending := ""
+		for attempt := 0; ; attempt++ {
+			depl, err := client.Get(ctx, name, metav1.GetOptions{})
+			if err == nil && rolloutDone(depl) {
+				sub.Log(1, []byte(fmt.Sprintf("All %d replicas for %s updated\n", depl.Status.ReadyReplicas, name)))
+				return nil
+			}
+			if err == nil {
+				if podList, err2 := d.podClient.List(ctx, metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(depl.Spec.Selector)}); err2 == nil {
+					for i := range podList.Items {
+						for _, reason := range podPendingReasons(&podList.Items[i]) {
+							msg := fmt.Sprintf("Pending \t%s \t%s\n", podList.Items[i].Name, reason)
+							if !reported[msg] {
+								reported[msg] = true
+								sub.Log(1, []byte(msg))
+							}
+							pending = podList.Items[i].Name + ": " + reason
+						}
+					}
+				}
+			}
+			if err := wait.Backoff.Sleep(ctx, attempt); err != nil {
+				if pending != "" {
+					return errors.Errorf("timed out waiting for the pods of %s to be updated: %s", name, pending)
+				}
+				return errors.Errorf("timed out waiting for the pods of %s to be updated", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+func Test_builderChanges(t *testing.T) {
+	t.Parallel()
+	render := func(opts map[string]string) *appsv1.Deployment {
+		d := &Driver{InitConfig: driver.InitConfig{Name: "test", DriverOpts: opts}}
+		require.NoError(t, d.initDriverFromConfig())
+		return d.deployment
+	}
+	current := render(map[string]string{"image": "moby/buildkit:v0.8.3", "replicas": "2"})
+	require.Empty(t, builderChanges(current, render(map[string]string{"image": "moby/buildkit:v0.8.3", "replicas": "2"})))
+
+	desired := render(map[string]string{"image": "moby/buildkit:v0.9.0", "replicas": "3", "requests": "cpu=2,memory=4Gi", "notify": `["webhook:https://example.com/hook?events=failed,done"]`})
+	require.Equal(t, []string{
+		"image moby/buildkit:v0.8.3 -> moby/buildkit:v0.9.0",
+		`requests "" -> "cpu=2,memory=4Gi"`,
+		`notify "" -> "[\"webhook:https://example.com/hook?events=failed,done\"]"`,
+		`replicas "2" -> "3"`,
+	}, builderChanges(current, desired))
+	require.Equal(t, `["webhook:https://example.com/hook?events=failed,done"]`, desired.Annotations[manifest.NotifyAnnotation])
+
+	// The replicas of an autoscaled builder are kept unless given
+	scaled := current.DeepCopy()
+	replicas := int32(5)
+	scaled.Spec.Replicas = &replicas
+	applyBuilderSpec(scaled, desired, false)
+	require.Equal(t, int32(5), *scaled.Spec.Replicas)
+	require.Equal(t, "moby/buildkit:v0.9.0", scaled.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, desired.Annotations[manifest.CreateOptionsAnnotation], scaled.Annotations[manifest.CreateOptionsAnnotation])
+	require.Empty(t, builderChanges(scaled, desired))
+	applyBuilderSpec(scaled, desired, true)
+	require.Equal(t, int32(3), *scaled.Spec.Replicas)
+}
+
+func Test_rolloutDone(t *testing.T) {
+	t.Parallel()
+	replicas := int32(2)
+	depl := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &replicas}}
+	depl.Generation = 4
+	depl.Status = appsv1.DeploymentStatus{ObservedGeneration: 3, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}
+	require.False(t, rolloutDone(depl))
+	// An old pod is still running
+	depl.Status = appsv1.DeploymentStatus{ObservedGeneration: 4, Replicas: 3, UpdatedReplicas: 2, ReadyReplicas: 2}
+	require.False(t, rolloutDone(depl))
+	depl.Status = appsv1.DeploymentStatus{ObservedGeneration: 4, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 1}
+	require.False(t, rolloutDone(depl))
+	depl.Status = appsv1.DeploymentStatus{ObservedGeneration: 4, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}
+	require.True(t, rolloutDone(depl))
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientappsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+)
+
+// The builder pods are run by a Deployment, by a DaemonSet to have a
+// builder, and its layer cache, on every node, or by a StatefulSet for pods
+// whose names, and cache claims, survive their restarts.  The driver handles
+// all of them through the Deployment API: a DaemonSet is converted to a
+// Deployment with as many replicas as nodes it is scheduled on, a StatefulSet
+// to one of its replicas, and back when written.  Existing builders are found
+// whatever their kind, the kind requested at creation only matters when the
+// builder doesn't exist yet.
+
+const (
+	// valid values for driver-opt deployment-kind
+	DeploymentKindDeployment  = "deployment"
+	DeploymentKindDaemonSet   = "daemonset"
+	DeploymentKindStatefulSet = "statefulset"
+)
+
+// workloadClient is the part of the Deployment API the driver uses for the
+// builder's own pods
+type workloadClient interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*appsv1.Deployment, error)
+	Create(ctx context.Context, depl *appsv1.Deployment, opts metav1.CreateOptions) (*appsv1.Deployment, error)
+	Update(ctx context.Context, depl *appsv1.Deployment, opts metav1.UpdateOptions) (*appsv1.Deployment, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+	List(ctx context.Context, opts metav1.ListOptions) (*appsv1.DeploymentList, error)
+}
+
+// builderWorkloads manages the builder as a Deployment, a DaemonSet or a
+// StatefulSet
+type builderWorkloads struct {
+	deployments  clientappsv1.DeploymentInterface
+	daemonSets   clientappsv1.DaemonSetInterface
+	statefulSets clientappsv1.StatefulSetInterface
+	// kind is the kind builders are created as
+	kind string
+	// cacheClaim is the template of the cache claim of each StatefulSet pod,
+	// if any
+	cacheClaim *corev1.PersistentVolumeClaim
+}
+
+func (w *builderWorkloads) Get(ctx context.Context, name string, opts metav1.GetOptions) (*appsv1.Deployment, error) {
+	depl, err := w.deployments.Get(ctx, name, opts)
+	if err == nil || !kubeerrors.IsNotFound(err) {
+		return depl, err
+	}
+	ss, err2 := w.statefulSets.Get(ctx, name, opts)
+	if err2 == nil {
+		return deploymentFromStatefulSet(ss), nil
+	} else if !kubeerrors.IsNotFound(err2) {
+		return nil, err2
+	}
+	ds, err2 := w.daemonSets.Get(ctx, name, opts)
+	if err2 != nil {
+		if kubeerrors.IsNotFound(err2) {
+			return nil, err
+		}
+		return nil, err2
+	}
+	return deploymentFromDaemonSet(ds), nil
+}
+
+func (w *builderWorkloads) Create(ctx context.Context, depl *appsv1.Deployment, opts metav1.CreateOptions) (*appsv1.Deployment, error) {
+	switch w.kind {
+	case DeploymentKindDaemonSet:
+	case DeploymentKindStatefulSet:
+		ss, err := w.statefulSets.Create(ctx, statefulSetFromDeployment(depl, w.cacheClaim), opts)
+		if err != nil {
+			return nil, err
+		}
+		return deploymentFromStatefulSet(ss), nil
+	default:
+		return w.deployments.Create(ctx, depl, opts)
+	}
+	ds, err := w.daemonSets.Create(ctx, daemonSetFromDeployment(depl), opts)
+	if err != nil {
+		return nil, err
+	}
+	return deploymentFromDaemonSet(ds), nil
+}
+
+func (w *builderWorkloads) Update(ctx context.Context, depl *appsv1.Deployment, opts metav1.UpdateOptions) (*appsv1.Deployment, error) {
+	res, err := w.deployments.Update(ctx, depl, opts)
+	if err == nil || !kubeerrors.IsNotFound(err) {
+		return res, err
+	}
+	ss, err2 := w.statefulSets.Update(ctx, statefulSetFromDeployment(depl, w.cacheClaim), opts)
+	if err2 == nil {
+		return deploymentFromStatefulSet(ss), nil
+	} else if !kubeerrors.IsNotFound(err2) {
+		return nil, err2
+	}
+	ds, err2 := w.daemonSets.Update(ctx, daemonSetFromDeployment(depl), opts)
+	if err2 != nil {
+		if kubeerrors.IsNotFound(err2) {
+			return nil, err
+		}
+		return nil, err2
+	}
+	return deploymentFromDaemonSet(ds), nil
+}
+
+func (w *builderWorkloads) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	err := w.deployments.Delete(ctx, name, opts)
+	if err == nil || !kubeerrors.IsNotFound(err) {
+		return err
+	}
+	if err2 := w.statefulSets.Delete(ctx, name, opts); !kubeerrors.IsNotFound(err2) {
+		return err2
+	}
+	if err2 := w.daemonSets.Delete(ctx, name, opts); !kubeerrors.IsNotFound(err2) {
+		return err2
+	}
+	return err
+}
+
+func (w *builderWorkloads) List(ctx context.Context, opts metav1.ListOptions) (*appsv1.DeploymentList, error) {
+	res, err := w.deployments.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	sss, err := w.statefulSets.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sss.Items {
+		res.Items = append(res.Items, *deploymentFromStatefulSet(&sss.Items[i]))
+	}
+	dss, err := w.daemonSets.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dss.Items {
+		res.Items = append(res.Items, *deploymentFromDaemonSet(&dss.Items[i]))
+	}
+	return res, nil
+}
+
+// daemonSetFromDeployment runs the pods of depl on every node, the replicas
+// and rollout strategy of the deployment don't apply
+func daemonSetFromDeployment(depl *appsv1.Deployment) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "DaemonSet",
+		},
+		ObjectMeta: depl.ObjectMeta,
+		Spec: appsv1.DaemonSetSpec{
+			Selector:             depl.Spec.Selector,
+			Template:             depl.Spec.Template,
+			MinReadySeconds:      depl.Spec.MinReadySeconds,
+			RevisionHistoryLimit: depl.Spec.RevisionHistoryLimit,
+		},
+	}
+}
+
+// deploymentFromDaemonSet presents ds as a deployment with a replica for
+// every node it should run on
+func deploymentFromDaemonSet(ds *appsv1.DaemonSet) *appsv1.Deployment {
+	replicas := ds.Status.DesiredNumberScheduled
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: ds.ObjectMeta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas:             &replicas,
+			Selector:             ds.Spec.Selector,
+			Template:             ds.Spec.Template,
+			MinReadySeconds:      ds.Spec.MinReadySeconds,
+			RevisionHistoryLimit: ds.Spec.RevisionHistoryLimit,
+		},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration:  ds.Status.ObservedGeneration,
+			Replicas:            ds.Status.CurrentNumberScheduled,
+			UpdatedReplicas:     ds.Status.UpdatedNumberScheduled,
+			ReadyReplicas:       ds.Status.NumberReady,
+			AvailableReplicas:   ds.Status.NumberAvailable,
+			UnavailableReplicas: ds.Status.NumberUnavailable,
+		},
+	}
+}
+
+// statefulSetFromDeployment runs the pods of depl with stable names, started
+// and updated one at a time.  With a cacheClaim the cache volume of the pods
+// is replaced by a claim of each pod, kept across its restarts.
+func statefulSetFromDeployment(depl *appsv1.Deployment, cacheClaim *corev1.PersistentVolumeClaim) *appsv1.StatefulSet {
+	ss := &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "StatefulSet",
+		},
+		ObjectMeta: depl.ObjectMeta,
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:            depl.Spec.Replicas,
+			Selector:            depl.Spec.Selector,
+			Template:            *depl.Spec.Template.DeepCopy(),
+			ServiceName:         depl.ObjectMeta.Name,
+			PodManagementPolicy: appsv1.OrderedReadyPodManagement,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.RollingUpdateStatefulSetStrategyType,
+			},
+			MinReadySeconds:      depl.Spec.MinReadySeconds,
+			RevisionHistoryLimit: depl.Spec.RevisionHistoryLimit,
+		},
+	}
+	if cacheClaim == nil {
+		return ss
+	}
+	volumes := ss.Spec.Template.Spec.Volumes[:0]
+	for _, v := range ss.Spec.Template.Spec.Volumes {
+		if v.Name != manifest.CacheVolumeName {
+			volumes = append(volumes, v)
+		}
+	}
+	ss.Spec.Template.Spec.Volumes = volumes
+	ss.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   manifest.CacheVolumeName,
+			Labels: cacheClaim.Labels,
+		},
+		Spec: cacheClaim.Spec,
+	}}
+	return ss
+}
+
+// deploymentFromStatefulSet presents ss as a deployment with its replicas
+func deploymentFromStatefulSet(ss *appsv1.StatefulSet) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: ss.ObjectMeta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas:             ss.Spec.Replicas,
+			Selector:             ss.Spec.Selector,
+			Template:             ss.Spec.Template,
+			MinReadySeconds:      ss.Spec.MinReadySeconds,
+			RevisionHistoryLimit: ss.Spec.RevisionHistoryLimit,
+		},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration:  ss.Status.ObservedGeneration,
+			Replicas:            ss.Status.Replicas,
+			UpdatedReplicas:     ss.Status.UpdatedReplicas,
+			ReadyReplicas:       ss.Status.ReadyReplicas,
+			AvailableReplicas:   ss.Status.ReadyReplicas,
+			UnavailableReplicas: ss.Status.Replicas - ss.Status.ReadyReplicas,
+		},
+	}
+}
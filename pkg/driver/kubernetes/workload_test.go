@@ -0,0 +1,87 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/driver/kubernetes/manifest"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_daemonSetFromDeployment(t *testing.T) {
+	t.Parallel()
+	depl, err := manifest.NewDeployment(&manifest.DeploymentOpt{
+		Name:             "buildkit",
+		Image:            "moby/buildkit:rootless",
+		Replicas:         3,
+		Rootless:         true,
+		ContainerRuntime: "containerd",
+		Environments:     map[string]string{},
+	})
+	require.NoError(t, err)
+	ds := daemonSetFromDeployment(depl)
+	assert.Equal(t, "DaemonSet", ds.Kind)
+	assert.Equal(t, depl.ObjectMeta, ds.ObjectMeta)
+	assert.Equal(t, depl.Spec.Selector, ds.Spec.Selector)
+	assert.Equal(t, depl.Spec.Template, ds.Spec.Template)
+
+	ds.Status = appsv1.DaemonSetStatus{
+		DesiredNumberScheduled: 4,
+		CurrentNumberScheduled: 4,
+		NumberReady:            2,
+	}
+	ds.ObjectMeta.ResourceVersion = "42"
+	back := deploymentFromDaemonSet(ds)
+	require.NotNil(t, back.Spec.Replicas)
+	assert.Equal(t, int32(4), *back.Spec.Replicas)
+	assert.Equal(t, int32(2), back.Status.ReadyReplicas)
+	assert.Equal(t, "42", back.ObjectMeta.ResourceVersion)
+	assert.Equal(t, depl.Spec.Template, back.Spec.Template)
+	assert.Equal(t, metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}, back.TypeMeta)
+}
+
+func Test_statefulSetFromDeployment(t *testing.T) {
+	t.Parallel()
+	opt := &manifest.DeploymentOpt{
+		Name:             "buildkit",
+		Image:            "moby/buildkit:rootless",
+		Replicas:         3,
+		Rootless:         true,
+		ContainerRuntime: "containerd",
+		Worker:           "runc",
+		CacheStorage:     manifest.CacheStoragePVC,
+		Environments:     map[string]string{},
+	}
+	depl, err := manifest.NewDeployment(opt)
+	require.NoError(t, err)
+	claim, err := manifest.NewCacheClaim(opt)
+	require.NoError(t, err)
+
+	ss := statefulSetFromDeployment(depl, claim)
+	assert.Equal(t, "StatefulSet", ss.Kind)
+	assert.Equal(t, depl.ObjectMeta, ss.ObjectMeta)
+	assert.Equal(t, depl.Spec.Replicas, ss.Spec.Replicas)
+	assert.Equal(t, "buildkit", ss.Spec.ServiceName)
+	assert.Equal(t, appsv1.OrderedReadyPodManagement, ss.Spec.PodManagementPolicy)
+	require.Len(t, ss.Spec.VolumeClaimTemplates, 1)
+	assert.Equal(t, manifest.CacheVolumeName, ss.Spec.VolumeClaimTemplates[0].Name)
+	assert.Equal(t, "buildkit", ss.Spec.VolumeClaimTemplates[0].Labels[manifest.CacheClaimLabel])
+	for _, v := range ss.Spec.Template.Spec.Volumes {
+		assert.NotEqual(t, manifest.CacheVolumeName, v.Name, "the pods mount their own claim")
+	}
+	// The deployment itself is left as is
+	assert.NotEqual(t, depl.Spec.Template.Spec.Volumes, ss.Spec.Template.Spec.Volumes)
+
+	ss.Status = appsv1.StatefulSetStatus{Replicas: 3, ReadyReplicas: 2}
+	back := deploymentFromStatefulSet(ss)
+	assert.Equal(t, depl.Spec.Replicas, back.Spec.Replicas)
+	assert.Equal(t, int32(2), back.Status.ReadyReplicas)
+	assert.Equal(t, int32(1), back.Status.UnavailableReplicas)
+	assert.Equal(t, metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}, back.TypeMeta)
+
+	assert.Empty(t, statefulSetFromDeployment(depl, nil).Spec.VolumeClaimTemplates)
+}
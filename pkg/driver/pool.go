@@ -0,0 +1,102 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package driver
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/serialx/hashring"
+	"github.com/sirupsen/logrus"
+)
+
+// A pool spreads builds over several builders, eg. one per namespace or
+// region.  The running pods of all the builders are put on one consistent
+// hash ring, as the sticky pod chooser does with the pods of a builder, so
+// the builds of a context keep landing on the same pod.  Builders without
+// running pods, or which can't be reached, are left out until they have
+// some, their builds failing over to the pods of the others.
+
+// PoolBuilder is a builder of a pool
+type PoolBuilder struct {
+	Name   string
+	Driver Driver
+}
+
+// ChoosePoolNode returns the index of the builder of the pool the build of
+// key runs on and the name of its pod, among the running pods of all the
+// builders on nodes of the architecture of one of platforms if any are.  The
+// first builder is returned without a pod if none has running pods, for the
+// build to start it.
+func ChoosePoolNode(ctx context.Context, builders []PoolBuilder, key string, platforms []specs.Platform) (int, string) {
+	infos := make([]*Info, len(builders))
+	var wg sync.WaitGroup
+	for i, b := range builders {
+		wg.Add(1)
+		go func(i int, b PoolBuilder) {
+			defer wg.Done()
+			info, err := b.Driver.Info(ctx)
+			if err != nil {
+				logrus.Warnf("builder %s of the pool is left out: %s", b.Name, err)
+				return
+			}
+			infos[i] = info
+		}(i, b)
+	}
+	wg.Wait()
+
+	var all, matching []string
+	for i, info := range infos {
+		if info == nil || info.Status != Running {
+			continue
+		}
+		for _, n := range info.DynamicNodes {
+			// Pods of builders in different namespaces may share their name
+			member := strconv.Itoa(i) + "/" + n.Name
+			all = append(all, member)
+			if nodeMatchesPlatforms(n.Platforms, platforms) {
+				matching = append(matching, member)
+			}
+		}
+	}
+	if len(matching) > 0 {
+		all = matching
+	}
+	chosen, ok := hashring.New(all).GetNode(key)
+	if !ok {
+		return 0, ""
+	}
+	parts := strings.SplitN(chosen, "/", 2)
+	i, _ := strconv.Atoi(parts[0])
+	return i, parts[1]
+}
+
+// nodeMatchesPlatforms reports whether a node of the native platforms
+// builds one of platforms without emulation
+func nodeMatchesPlatforms(native, platforms []specs.Platform) bool {
+	for _, n := range native {
+		for _, p := range platforms {
+			if n.Architecture == p.Architecture {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type preferredNodeKey struct{}
+
+// WithPreferredNode makes the Clients of drivers called with the returned
+// context choose the node if it runs, eg. the one chosen among a pool
+func WithPreferredNode(ctx context.Context, node string) context.Context {
+	return context.WithValue(ctx, preferredNodeKey{}, node)
+}
+
+// PreferredNode returns the node preferred with WithPreferredNode
+func PreferredNode(ctx context.Context) string {
+	node, _ := ctx.Value(preferredNodeKey{}).(string)
+	return node
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package driver
+
+import (
+	"context"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/buildkit-cli-for-kubectl/pkg/store"
+)
+
+type fakePoolDriver struct {
+	Driver
+	info *Info
+	err  error
+}
+
+func (d *fakePoolDriver) Info(ctx context.Context) (*Info, error) {
+	return d.info, d.err
+}
+
+func runningInfo(arch string, pods ...string) *Info {
+	info := &Info{Status: Running}
+	for _, pod := range pods {
+		info.DynamicNodes = append(info.DynamicNodes, store.Node{
+			Name:      pod,
+			Platforms: []specs.Platform{{OS: "linux", Architecture: arch}},
+		})
+	}
+	return info
+}
+
+func Test_ChoosePoolNode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	pool := []PoolBuilder{
+		{Name: "frontend", Driver: &fakePoolDriver{info: runningInfo("amd64", "buildkit-a", "buildkit-b")}},
+		{Name: "eu/backend", Driver: &fakePoolDriver{info: runningInfo("arm64", "buildkit-a")}},
+	}
+
+	// Sticky to the context
+	i, node := ChoosePoolNode(ctx, pool, "/src/app", nil)
+	for n := 0; n < 5; n++ {
+		i2, node2 := ChoosePoolNode(ctx, pool, "/src/app", nil)
+		require.Equal(t, i, i2)
+		require.Equal(t, node, node2)
+	}
+	seen := map[int]bool{}
+	for _, key := range []string{"/src/a", "/src/b", "/src/c", "/src/d", "/src/e", "/src/f", "/src/g", "/src/h"} {
+		i, _ := ChoosePoolNode(ctx, pool, key, nil)
+		seen[i] = true
+	}
+	require.Len(t, seen, 2)
+
+	// The pods of the native platform
+	i, node = ChoosePoolNode(ctx, pool, "/src/app", []specs.Platform{{OS: "linux", Architecture: "arm64"}})
+	require.Equal(t, 1, i)
+	require.Equal(t, "buildkit-a", node)
+
+	// Failing over from builders without running pods or unreachable
+	failover := []PoolBuilder{
+		{Name: "frontend", Driver: &fakePoolDriver{info: &Info{Status: Stopped}}},
+		{Name: "down", Driver: &fakePoolDriver{err: errors.New("connection refused")}},
+		{Name: "eu/backend", Driver: &fakePoolDriver{info: runningInfo("amd64", "buildkit-c")}},
+	}
+	i, node = ChoosePoolNode(ctx, failover, "/src/app", nil)
+	require.Equal(t, 2, i)
+	require.Equal(t, "buildkit-c", node)
+
+	i, node = ChoosePoolNode(ctx, failover[:2], "/src/app", nil)
+	require.Equal(t, 0, i)
+	require.Equal(t, "", node)
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"time"
+)
+
+// Backoff spaces the polls of a builder coming up, from Initial doubling up
+// to Max
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// DefaultBackoff polls quickly for builders already starting and settles on
+// a slower pace for pods waiting for a node or an image pull
+var DefaultBackoff = Backoff{Initial: 500 * time.Millisecond, Max: 10 * time.Second}
+
+// Delay returns the delay before the poll following attempt, counted from 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	if delay <= 0 {
+		delay = DefaultBackoff.Initial
+	}
+	for i := 0; i < attempt && (b.Max <= 0 || delay < b.Max); i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// Sleep waits the delay of attempt, give or take a quarter not to poll in
+// lockstep with other clients, it returns early with the error of ctx
+func (b Backoff) Sleep(ctx context.Context, attempt int) error {
+	delay := b.Delay(attempt)
+	if jitter, err := rand.Int(rand.Reader, big.NewInt(int64(delay/2)+1)); err == nil {
+		delay += time.Duration(jitter.Int64()) - delay/4
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// DefaultReadyTimeout is how long Clients wait for a ready builder pod
+const DefaultReadyTimeout = 2 * time.Minute
+
+// WaitOpt configures how Bootstrap waits for the builder to become ready
+type WaitOpt struct {
+	// NoWait returns once the builder is created, without waiting for its pods
+	NoWait  bool
+	Backoff Backoff
+	// ReadyTimeout is how long Clients wait for a ready builder pod, 0 for
+	// DefaultReadyTimeout
+	ReadyTimeout time.Duration
+}
+
+type waitKey struct{}
+
+// WithWait configures the Bootstrap of drivers called with the returned context
+func WithWait(ctx context.Context, opt WaitOpt) context.Context {
+	return context.WithValue(ctx, waitKey{}, opt)
+}
+
+// WaitOptions returns the options set with WithWait, waiting with the
+// DefaultBackoff if unset
+func WaitOptions(ctx context.Context) WaitOpt {
+	opt, ok := ctx.Value(waitKey{}).(WaitOpt)
+	if !ok {
+		opt.Backoff = DefaultBackoff
+	}
+	if opt.ReadyTimeout <= 0 {
+		opt.ReadyTimeout = DefaultReadyTimeout
+	}
+	return opt
+}
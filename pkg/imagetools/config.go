@@ -0,0 +1,62 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Entrypoint returns the entrypoint and command of the image in, those of its
+// first Linux image for an index
+func (r *Resolver) Entrypoint(ctx context.Context, in string) ([]string, error) {
+	dt, desc, err := r.Get(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if desc.MediaType == "" {
+		if desc.MediaType, err = detectMediaType(dt); err != nil {
+			return nil, err
+		}
+	}
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		if err := json.Unmarshal(dt, &idx); err != nil {
+			return nil, errors.Wrapf(err, "invalid index %s", in)
+		}
+		var found bool
+		for _, m := range idx.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" {
+				if dt, err = r.GetDescriptor(ctx, in, m); err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("%s has no Linux image", in)
+		}
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+	default:
+		return nil, errors.Errorf("unsupported media type %s of %s", desc.MediaType, in)
+	}
+	var mfst ocispec.Manifest
+	if err := json.Unmarshal(dt, &mfst); err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest %s", in)
+	}
+	dt, err = r.GetDescriptor(ctx, in, mfst.Config)
+	if err != nil {
+		return nil, err
+	}
+	var img ocispec.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return nil, errors.Wrapf(err, "invalid image config %s", in)
+	}
+	return append(append([]string{}, img.Config.Entrypoint...), img.Config.Cmd...), nil
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// An image is copied between repositories preserving its digest by pushing
+// the exact index, manifests and configs it was fetched with.  The layers of
+// the platform images are expected in the destination already, the layers of
+// attestation manifests, which have no platform, are small and copied along.
+
+// ImageTree is an image fetched from a registry, with the platform images,
+// manifests and configs it is made of
+type ImageTree struct {
+	Root ocispec.Descriptor
+	// Images are the platform images of the index, or the image itself
+	Images []PlatformImage
+
+	// blobs are pushed in order, the children of a manifest or index first
+	blobs []treeBlob
+}
+
+// PlatformImage is a runnable image of an ImageTree
+type PlatformImage struct {
+	Platform ocispec.Platform
+	Manifest ocispec.Descriptor
+	Config   []byte
+}
+
+type treeBlob struct {
+	desc ocispec.Descriptor
+	dt   []byte
+}
+
+// FetchTree fetches the index or manifest of the image in, with its
+// manifests and configs
+func (r *Resolver) FetchTree(ctx context.Context, in string) (*ImageTree, error) {
+	dt, root, err := r.Get(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if root.MediaType == "" {
+		if root.MediaType, err = detectMediaType(dt); err != nil {
+			return nil, err
+		}
+	}
+	tree := &ImageTree{Root: root}
+	switch root.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		if err := json.Unmarshal(dt, &idx); err != nil {
+			return nil, errors.Wrapf(err, "invalid index %s", in)
+		}
+		for _, m := range idx.Manifests {
+			if err := r.fetchTreeManifest(ctx, in, tree, m); err != nil {
+				return nil, err
+			}
+		}
+		tree.blobs = append(tree.blobs, treeBlob{desc: root, dt: dt})
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		if err := r.fetchTreeManifest(ctx, in, tree, root); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("unsupported media type %s of %s", root.MediaType, in)
+	}
+	return tree, nil
+}
+
+func (r *Resolver) fetchTreeManifest(ctx context.Context, in string, tree *ImageTree, desc ocispec.Descriptor) error {
+	dt, err := r.GetDescriptor(ctx, in, desc)
+	if err != nil {
+		return err
+	}
+	var mfst ocispec.Manifest
+	if err := json.Unmarshal(dt, &mfst); err != nil {
+		return errors.Wrapf(err, "invalid manifest %s", desc.Digest)
+	}
+	config, err := r.GetDescriptor(ctx, in, mfst.Config)
+	if err != nil {
+		return err
+	}
+	tree.blobs = append(tree.blobs, treeBlob{desc: mfst.Config, dt: config})
+
+	platform := desc.Platform
+	if platform == nil {
+		var p ocispec.Platform
+		if err := json.Unmarshal(config, &p); err == nil && p.OS != "" {
+			p = platforms.Normalize(p)
+			platform = &p
+		}
+	}
+	if platform == nil || platform.OS == "unknown" {
+		// Attestations and other artifacts, their layers aren't filesystems
+		for _, l := range mfst.Layers {
+			layer, err := r.GetDescriptor(ctx, in, l)
+			if err != nil {
+				return err
+			}
+			tree.blobs = append(tree.blobs, treeBlob{desc: l, dt: layer})
+		}
+	} else {
+		tree.Images = append(tree.Images, PlatformImage{Platform: *platform, Manifest: desc, Config: config})
+	}
+	tree.blobs = append(tree.blobs, treeBlob{desc: desc, dt: dt})
+	return nil
+}
+
+// PushTree pushes the manifests and configs of the tree to the repository of
+// name, then tags its root with the tag of name
+func (r *Resolver) PushTree(ctx context.Context, name reference.Named, tree *ImageTree) error {
+	repo := reference.TrimNamed(name)
+	for _, b := range tree.blobs {
+		if b.desc.Digest == tree.Root.Digest {
+			continue
+		}
+		var ref reference.Named = repo
+		switch b.desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+			var err error
+			if ref, err = reference.WithDigest(repo, b.desc.Digest); err != nil {
+				return err
+			}
+		}
+		// Attestation media types are unknown to containerd, name their refs to keep it quiet
+		blobCtx := remotes.WithMediaTypeKeyPrefix(ctx, b.desc.MediaType, "blob")
+		if err := r.Push(blobCtx, ref, b.desc, b.dt); err != nil {
+			return errors.Wrapf(err, "failed to push %s", b.desc.Digest)
+		}
+	}
+	for _, b := range tree.blobs {
+		if b.desc.Digest == tree.Root.Digest {
+			return errors.Wrapf(r.Push(ctx, name, b.desc, b.dt), "failed to push %s", name)
+		}
+	}
+	return nil
+}
+
+// CopyReferrers copies the artifacts referring to subject in the repository
+// of src, found through the referrers tag schema, to the repository of dst.
+// It returns the number of artifacts copied.
+func (r *Resolver) CopyReferrers(ctx context.Context, src, dst reference.Named, subject digest.Digest, mode string) (int, error) {
+	src, dst = reference.TrimNamed(src), reference.TrimNamed(dst)
+	tagged, err := reference.WithTag(src, ReferrersTag(subject))
+	if err != nil {
+		return 0, err
+	}
+	dt, _, err := r.Get(ctx, tagged.String())
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to fetch referrers index %s", tagged)
+	}
+	var idx referrersIndex
+	if err := json.Unmarshal(dt, &idx); err != nil {
+		return 0, errors.Wrapf(err, "invalid referrers index %s", tagged)
+	}
+	mode, err = ParseReferrersMode(mode)
+	if err != nil {
+		return 0, err
+	}
+	for _, desc := range idx.Manifests {
+		dt, err := r.GetDescriptor(ctx, src.String(), desc.Descriptor)
+		if err != nil {
+			return 0, err
+		}
+		var mfst artifactManifest
+		if err := json.Unmarshal(dt, &mfst); err != nil {
+			return 0, errors.Wrapf(err, "invalid referrer manifest %s", desc.Digest)
+		}
+		for _, b := range append([]ocispec.Descriptor{mfst.Config}, mfst.Layers...) {
+			blob, err := r.GetDescriptor(ctx, src.String(), b)
+			if err != nil {
+				return 0, err
+			}
+			blobCtx := remotes.WithMediaTypeKeyPrefix(ctx, b.MediaType, "blob")
+			if err := r.Push(blobCtx, dst, b, blob); err != nil {
+				return 0, errors.Wrap(err, "failed to push referrer blob")
+			}
+		}
+		manifestRef, err := reference.WithDigest(dst, desc.Digest)
+		if err != nil {
+			return 0, err
+		}
+		if err := r.Push(ctx, manifestRef, desc.Descriptor, dt); err != nil {
+			return 0, errors.Wrap(err, "failed to push referrer manifest")
+		}
+		supported := r.subjects.has(desc.Digest)
+		switch {
+		case mode == ReferrersModeAPI && !supported:
+			return 0, errors.Errorf("%s doesn't support the OCI referrers API, use --referrers-mode=auto or --referrers-mode=tag", reference.Domain(dst))
+		case mode == ReferrersModeTag || !supported:
+			if err := r.updateReferrersTag(ctx, dst, subject, desc); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(idx.Manifests), nil
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (reg *testRegistry) putBlob(mediaType string, dt []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+	reg.blobs[desc.Digest.String()] = dt
+	return desc
+}
+
+func (reg *testRegistry) putManifest(t *testing.T, tag, mediaType string, v interface{}) ocispec.Descriptor {
+	dt, err := json.Marshal(v)
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+	for _, k := range []string{tag, desc.Digest.String()} {
+		reg.manifests[k], reg.types[k] = dt, mediaType
+	}
+	return desc
+}
+
+func registryName(t *testing.T, reg *testRegistry, repo string) reference.Named {
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	name, err := reference.ParseNormalizedNamed(strings.TrimPrefix(srv.URL, "http://") + "/" + repo)
+	require.NoError(t, err)
+	return name
+}
+
+func Test_CopyTree(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := newTestRegistry(false)
+	srcName := registryName(t, src, "staging/app")
+
+	config := src.putBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`))
+	layer := src.putBlob(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	image := src.putManifest(t, "", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	image.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	attConfig := src.putBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"unknown","os":"unknown"}`))
+	statement := src.putBlob("application/vnd.in-toto+json", []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`))
+	att := src.putManifest(t, "", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    attConfig,
+		Layers:    []ocispec.Descriptor{statement},
+	})
+	att.Platform = &ocispec.Platform{OS: "unknown", Architecture: "unknown"}
+	root := src.putManifest(t, "v1", ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{image, att},
+	})
+	_, err := New(Opt{}).PushReferrer(ctx, srcName, root, Referrer{ArtifactType: ArtifactTypeSPDX, Data: []byte(`{}`)}, ReferrersModeTag)
+	require.NoError(t, err)
+
+	// The pusher remembers what it pushed regardless of the registry, a
+	// resolver which pushed to src would skip the same manifests for dst
+	r := New(Opt{})
+
+	tree, err := r.FetchTree(ctx, srcName.String()+":v1")
+	require.NoError(t, err)
+	assert.Equal(t, root.Digest, tree.Root.Digest)
+	require.Len(t, tree.Images, 1)
+	assert.Equal(t, "amd64", tree.Images[0].Platform.Architecture)
+	assert.Equal(t, image.Digest, tree.Images[0].Manifest.Digest)
+
+	dst := newTestRegistry(false)
+	dstName, err := reference.WithTag(registryName(t, dst, "prod/app"), "v1")
+	require.NoError(t, err)
+	require.NoError(t, r.PushTree(ctx, dstName, tree))
+	assert.Equal(t, src.manifests["v1"], dst.manifests["v1"])
+	assert.Contains(t, dst.manifests, image.Digest.String())
+	assert.Contains(t, dst.blobs, config.Digest.String())
+	assert.Contains(t, dst.blobs, statement.Digest.String(), "attestation layers are copied")
+	assert.NotContains(t, dst.blobs, layer.Digest.String(), "image layers are pushed by the builder")
+
+	n, err := r.CopyReferrers(ctx, srcName, dstName, root.Digest, ReferrersModeAuto)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, src.manifests[ReferrersTag(root.Digest)], dst.manifests[ReferrersTag(root.Digest)])
+
+	n, err = r.CopyReferrers(ctx, srcName, dstName, image.Digest, ReferrersModeAuto)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -46,16 +46,19 @@ type Opt struct {
 }
 
 type Resolver struct {
-	r remotes.Resolver
+	r        remotes.Resolver
+	subjects *subjectRecorder
 }
 
 func New(opt Opt) *Resolver {
+	subjects := newSubjectRecorder(http.DefaultClient.Transport)
 	resolver := docker.NewResolver(docker.ResolverOptions{
-		Client:      http.DefaultClient,
+		Client:      &http.Client{Transport: subjects},
 		Credentials: toCredentialsFunc(opt.Auth),
 	})
 	return &Resolver{
-		r: resolver,
+		r:        resolver,
+		subjects: subjects,
 	}
 }
 
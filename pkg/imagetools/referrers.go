@@ -0,0 +1,269 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ReferrersModeAuto uses the referrers API and falls back to the tag
+	// scheme when the registry doesn't support it
+	ReferrersModeAuto = "auto"
+	// ReferrersModeAPI requires registry support for the OCI 1.1 referrers API
+	ReferrersModeAPI = "referrers"
+	// ReferrersModeTag always maintains the sha256-<digest> fallback tag
+	ReferrersModeTag = "tag"
+
+	ArtifactTypeSPDX            = "application/spdx+json"
+	ArtifactTypeInToto          = "application/vnd.in-toto+json"
+	ArtifactTypeNotarySignature = "application/vnd.cncf.notary.signature"
+	ArtifactTypeCosignSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+	mediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+)
+
+// Referrer is an artifact attached to an image, such as an SBOM, provenance or a signature
+type Referrer struct {
+	ArtifactType string
+	// MediaType of Data, defaults to ArtifactType
+	MediaType   string
+	Data        []byte
+	Annotations map[string]string
+}
+
+// The vendored image-spec predates OCI 1.1 so the subject and artifactType
+// fields are declared here
+type referrerDescriptor struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+type artifactManifest struct {
+	specs.Versioned
+	MediaType    string               `json:"mediaType"`
+	ArtifactType string               `json:"artifactType,omitempty"`
+	Config       ocispec.Descriptor   `json:"config"`
+	Layers       []ocispec.Descriptor `json:"layers"`
+	Subject      *ocispec.Descriptor  `json:"subject,omitempty"`
+	Annotations  map[string]string    `json:"annotations,omitempty"`
+}
+
+type referrersIndex struct {
+	specs.Versioned
+	MediaType string               `json:"mediaType"`
+	Manifests []referrerDescriptor `json:"manifests"`
+}
+
+// ParseReferrersMode validates a referrer storage mode, "" selects ReferrersModeAuto
+func ParseReferrersMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ReferrersModeAuto, nil
+	case ReferrersModeAuto, ReferrersModeAPI, ReferrersModeTag:
+		return mode, nil
+	}
+	return "", errors.Errorf("unsupported referrers mode %q, use auto, referrers or tag", mode)
+}
+
+// PushReferrer pushes ref as an artifact manifest with subject set to the
+// image in the repository of name.  Registries without the referrers API
+// discover it through an index tagged with the fallback tag of the subject.
+func (r *Resolver) PushReferrer(ctx context.Context, name reference.Named, subject ocispec.Descriptor, ref Referrer, mode string) (ocispec.Descriptor, error) {
+	mode, err := ParseReferrersMode(mode)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	name = reference.TrimNamed(name)
+
+	emptyConfig := []byte("{}")
+	config := ocispec.Descriptor{
+		MediaType: mediaTypeEmptyJSON,
+		Digest:    digest.FromBytes(emptyConfig),
+		Size:      int64(len(emptyConfig)),
+	}
+	mediaType := ref.MediaType
+	if mediaType == "" {
+		mediaType = ref.ArtifactType
+	}
+	layer := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(ref.Data),
+		Size:      int64(len(ref.Data)),
+	}
+	// Artifact media types are unknown to containerd, name their refs to keep it quiet
+	blobCtx := remotes.WithMediaTypeKeyPrefix(ctx, config.MediaType, "config")
+	blobCtx = remotes.WithMediaTypeKeyPrefix(blobCtx, layer.MediaType, "layer")
+	for _, blob := range []struct {
+		desc ocispec.Descriptor
+		dt   []byte
+	}{{config, emptyConfig}, {layer, ref.Data}} {
+		if err := r.Push(blobCtx, name, blob.desc, blob.dt); err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to push referrer blob")
+		}
+	}
+
+	subject = ocispec.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	dt, err := json.Marshal(artifactManifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: ref.ArtifactType,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      &subject,
+		Annotations:  ref.Annotations,
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal referrer manifest")
+	}
+	desc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.FromBytes(dt),
+		Size:        int64(len(dt)),
+		Annotations: ref.Annotations,
+	}
+	manifestRef, err := reference.WithDigest(name, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := r.Push(ctx, manifestRef, desc, dt); err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to push referrer manifest")
+	}
+
+	supported := r.subjects.has(desc.Digest)
+	switch {
+	case mode == ReferrersModeAPI && !supported:
+		return ocispec.Descriptor{}, errors.Errorf("%s doesn't support the OCI referrers API, use --referrers-mode=auto or --referrers-mode=tag", reference.Domain(name))
+	case mode == ReferrersModeTag || !supported:
+		if err := r.updateReferrersTag(ctx, name, subject.Digest, referrerDescriptor{Descriptor: desc, ArtifactType: ref.ArtifactType}); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// ReferrersTag returns the tag used by the referrers tag schema for subject
+func ReferrersTag(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Encoded()
+}
+
+// updateReferrersTag adds desc to the index tagged with the fallback tag of subject
+func (r *Resolver) updateReferrersTag(ctx context.Context, name reference.Named, subject digest.Digest, desc referrerDescriptor) error {
+	tagged, err := reference.WithTag(name, ReferrersTag(subject))
+	if err != nil {
+		return err
+	}
+	idx := referrersIndex{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	dt, _, err := r.Get(ctx, tagged.String())
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(dt, &idx); err != nil {
+			return errors.Wrapf(err, "invalid referrers index %s", tagged)
+		}
+	case !errdefs.IsNotFound(err):
+		return errors.Wrapf(err, "failed to fetch referrers index %s", tagged)
+	}
+	for _, m := range idx.Manifests {
+		if m.Digest == desc.Digest {
+			return nil
+		}
+	}
+	idx.Manifests = append(idx.Manifests, desc)
+	dt, err = json.Marshal(idx)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal referrers index")
+	}
+	return r.Push(ctx, tagged, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}, dt)
+}
+
+// subjectRecorder remembers the manifests accepted by a registry which
+// acknowledged their subject, the containerd pusher doesn't expose the
+// response headers
+type subjectRecorder struct {
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	digests map[digest.Digest]struct{}
+}
+
+func newSubjectRecorder(next http.RoundTripper) *subjectRecorder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &subjectRecorder{next: next, digests: map[digest.Digest]struct{}{}}
+}
+
+func (s *subjectRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := s.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPut || resp.Header.Get("OCI-Subject") == "" {
+		return resp, err
+	}
+	if dir, obj := path.Split(req.URL.Path); strings.HasSuffix(dir, "/manifests/") {
+		if dgst, err := digest.Parse(obj); err == nil {
+			s.mu.Lock()
+			s.digests[dgst] = struct{}{}
+			s.mu.Unlock()
+		}
+	}
+	return resp, nil
+}
+
+func (s *subjectRecorder) has(dgst digest.Digest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.digests[dgst]
+	return ok
+}
+
+// Referrers returns the manifests of the referrers of subject in the
+// repository of in with the given artifact type, as listed by the index of
+// the fallback tag of subject.  No referrers are found unless they were
+// pushed with the tag scheme.
+func (r *Resolver) Referrers(ctx context.Context, in string, subject digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	name, err := parseRef(in)
+	if err != nil {
+		return nil, err
+	}
+	tagged, err := reference.WithTag(reference.TrimNamed(name), ReferrersTag(subject))
+	if err != nil {
+		return nil, err
+	}
+	dt, _, err := r.Get(ctx, tagged.String())
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to fetch referrers index %s", tagged)
+	}
+	var idx referrersIndex
+	if err := json.Unmarshal(dt, &idx); err != nil {
+		return nil, errors.Wrapf(err, "invalid referrers index %s", tagged)
+	}
+	var res []ocispec.Descriptor
+	for _, m := range idx.Manifests {
+		if m.ArtifactType == artifactType {
+			res = append(res, m.Descriptor)
+		}
+	}
+	return res, nil
+}
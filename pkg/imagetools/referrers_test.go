@@ -0,0 +1,153 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is a minimal in memory registry, optionally supporting the referrers API
+type testRegistry struct {
+	referrers bool
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+}
+
+func newTestRegistry(referrers bool) *testRegistry {
+	return &testRegistry{
+		referrers: referrers,
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+	}
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	kind, obj := parts[len(parts)-2], parts[len(parts)-1]
+	switch {
+	case kind == "manifests" && r.Method == http.MethodPut:
+		dt, _ := ioutil.ReadAll(r.Body)
+		dgst := digest.FromBytes(dt).String()
+		reg.manifests[obj], reg.manifests[dgst] = dt, dt
+		reg.types[obj], reg.types[dgst] = r.Header.Get("Content-Type"), r.Header.Get("Content-Type")
+		var m struct {
+			Subject *ocispec.Descriptor `json:"subject"`
+		}
+		if reg.referrers && json.Unmarshal(dt, &m) == nil && m.Subject != nil {
+			w.Header().Set("OCI-Subject", m.Subject.Digest.String())
+		}
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests":
+		dt, ok := reg.manifests[obj]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", reg.types[obj])
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(dt).String())
+		w.Write(dt)
+	case kind == "blobs" && (r.Method == http.MethodHead || r.Method == http.MethodGet):
+		dt, ok := reg.blobs[obj]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(dt)
+	case kind == "uploads" && obj == "" && r.Method == http.MethodPost:
+		w.Header().Set("Location", r.URL.Path+"upload")
+		w.WriteHeader(http.StatusAccepted)
+	case parts[len(parts)-3] == "blobs" && kind == "uploads" && r.Method == http.MethodPut:
+		dt, _ := ioutil.ReadAll(r.Body)
+		reg.blobs[r.URL.Query().Get("digest")] = dt
+		w.Header().Set("Docker-Content-Digest", r.URL.Query().Get("digest"))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func pushReferrerTo(t *testing.T, reg *testRegistry, mode string) (reference.Named, digest.Digest, error) {
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	name, err := reference.ParseNormalizedNamed(strings.TrimPrefix(srv.URL, "http://") + "/acme/app")
+	require.NoError(t, err)
+
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image"), Size: 5}
+	_, err = New(Opt{}).PushReferrer(context.Background(), name, subject, Referrer{
+		ArtifactType: ArtifactTypeSPDX,
+		Data:         []byte(`{"spdxVersion":"SPDX-2.3"}`),
+	}, mode)
+	return name, subject.Digest, err
+}
+
+func Test_PushReferrer(t *testing.T) {
+	t.Parallel()
+
+	reg := newTestRegistry(true)
+	_, subject, err := pushReferrerTo(t, reg, ReferrersModeAuto)
+	require.NoError(t, err)
+	assert.NotContains(t, reg.manifests, ReferrersTag(subject), "referrers capable registries don't need the fallback tag")
+	var found bool
+	for _, dt := range reg.manifests {
+		var m artifactManifest
+		require.NoError(t, json.Unmarshal(dt, &m))
+		if m.Subject != nil && m.Subject.Digest == subject {
+			found = true
+			assert.Equal(t, ArtifactTypeSPDX, m.ArtifactType)
+			assert.Equal(t, mediaTypeEmptyJSON, m.Config.MediaType)
+			require.Len(t, m.Layers, 1)
+			assert.Contains(t, reg.blobs, m.Layers[0].Digest.String())
+		}
+	}
+	assert.True(t, found)
+
+	reg = newTestRegistry(false)
+	_, subject, err = pushReferrerTo(t, reg, ReferrersModeAuto)
+	require.NoError(t, err)
+	require.Contains(t, reg.manifests, ReferrersTag(subject))
+	var idx referrersIndex
+	require.NoError(t, json.Unmarshal(reg.manifests[ReferrersTag(subject)], &idx))
+	require.Len(t, idx.Manifests, 1)
+	assert.Equal(t, ArtifactTypeSPDX, idx.Manifests[0].ArtifactType)
+
+	_, _, err = pushReferrerTo(t, newTestRegistry(false), ReferrersModeAPI)
+	assert.Error(t, err)
+
+	reg = newTestRegistry(true)
+	_, subject, err = pushReferrerTo(t, reg, ReferrersModeTag)
+	require.NoError(t, err)
+	assert.Contains(t, reg.manifests, ReferrersTag(subject))
+}
+
+func Test_ParseReferrersMode(t *testing.T) {
+	t.Parallel()
+	mode, err := ParseReferrersMode("")
+	require.NoError(t, err)
+	assert.Equal(t, ReferrersModeAuto, mode)
+	_, err = ParseReferrersMode("attached")
+	assert.Error(t, err)
+}
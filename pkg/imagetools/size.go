@@ -0,0 +1,66 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ImageSize returns the compressed size of the configs and layers of the
+// platform images of in, as pulled from the registry.  The attestation
+// manifests of an index don't count.
+func (r *Resolver) ImageSize(ctx context.Context, in string) (int64, error) {
+	dt, root, err := r.Get(ctx, in)
+	if err != nil {
+		return 0, err
+	}
+	if root.MediaType == "" {
+		if root.MediaType, err = detectMediaType(dt); err != nil {
+			return 0, err
+		}
+	}
+	switch root.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		if err := json.Unmarshal(dt, &idx); err != nil {
+			return 0, errors.Wrapf(err, "invalid index %s", in)
+		}
+		var size int64
+		for _, m := range idx.Manifests {
+			if m.Platform != nil && m.Platform.OS == "unknown" {
+				continue
+			}
+			mdt, err := r.GetDescriptor(ctx, in, m)
+			if err != nil {
+				return 0, err
+			}
+			s, err := manifestSize(mdt)
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid manifest %s", m.Digest)
+			}
+			size += s
+		}
+		return size, nil
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		size, err := manifestSize(dt)
+		return size, errors.Wrapf(err, "invalid manifest %s", in)
+	}
+	return 0, errors.Errorf("unsupported media type %s of %s", root.MediaType, in)
+}
+
+func manifestSize(dt []byte) (int64, error) {
+	var mfst ocispec.Manifest
+	if err := json.Unmarshal(dt, &mfst); err != nil {
+		return 0, err
+	}
+	size := mfst.Config.Size
+	for _, l := range mfst.Layers {
+		size += l.Size
+	}
+	return size, nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package imagetools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImageSize(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	reg := newTestRegistry(false)
+	name := registryName(t, reg, "team/app")
+
+	config := reg.putBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`))
+	layer := reg.putBlob(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	image := reg.putManifest(t, "single", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer, layer},
+	})
+	image.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	attConfig := reg.putBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"unknown","os":"unknown"}`))
+	statement := reg.putBlob("application/vnd.in-toto+json", []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`))
+	att := reg.putManifest(t, "", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    attConfig,
+		Layers:    []ocispec.Descriptor{statement},
+	})
+	att.Platform = &ocispec.Platform{OS: "unknown", Architecture: "unknown"}
+	reg.putManifest(t, "index", ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{image, att},
+	})
+
+	r := New(Opt{})
+	expected := config.Size + 2*layer.Size
+	size, err := r.ImageSize(ctx, name.String()+":single")
+	require.NoError(t, err)
+	require.Equal(t, expected, size)
+	size, err = r.ImageSize(ctx, name.String()+":index")
+	require.NoError(t, err)
+	require.Equal(t, expected, size)
+
+	_, err = r.ImageSize(ctx, name.String()+":missing")
+	require.Error(t, err)
+}
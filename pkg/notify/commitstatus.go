@@ -0,0 +1,187 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+
+	StatePending = "pending"
+	StateSuccess = "success"
+	StateFailure = "failure"
+
+	commitStatusContext = "kubectl-buildkit"
+)
+
+// CommitStatus reports the build state on the commit being built
+type CommitStatus struct {
+	Provider string
+	APIURL   string
+	// Project is "owner/repo" for GitHub or the project path for GitLab
+	Project string
+	SHA     string
+	Token   string
+}
+
+// DetectCommitStatus inspects the git checkout in dir to find the commit and
+// the hosting provider of the origin remote.  provider may be "auto" to infer
+// it from the remote host.  If token is empty GITHUB_TOKEN or GITLAB_TOKEN is used.
+func DetectCommitStatus(dir, provider, token string) (*CommitStatus, error) {
+	remote, err := git(dir, "remote", "get-url", "origin")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to detect git remote for commit status")
+	}
+	sha, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to detect git commit for commit status")
+	}
+	cs, err := parseRemote(remote, provider)
+	if err != nil {
+		return nil, err
+	}
+	cs.SHA = sha
+	cs.Token = token
+	if cs.Token == "" {
+		switch cs.Provider {
+		case ProviderGitHub:
+			cs.Token = os.Getenv("GITHUB_TOKEN")
+		case ProviderGitLab:
+			cs.Token = os.Getenv("GITLAB_TOKEN")
+		}
+	}
+	if cs.Token == "" {
+		return nil, errors.Errorf("no token available to report %s commit status, set %s_TOKEN or use --commit-status-secret", cs.Provider, strings.ToUpper(cs.Provider))
+	}
+	return cs, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseRemote translates https, ssh and scp style remotes into the API
+// location of the project
+func parseRemote(remote, provider string) (*CommitStatus, error) {
+	var host, path string
+	if u, err := url.Parse(remote); err == nil && u.Scheme != "" && u.Host != "" {
+		host, path = u.Hostname(), u.Path
+	} else if i := strings.Index(remote, ":"); i > 0 && !strings.Contains(remote[:i], "/") {
+		// scp style: git@github.com:owner/repo.git
+		host, path = remote[:i], remote[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	} else {
+		return nil, errors.Errorf("unsupported git remote %q for commit status", remote)
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+
+	if provider == "" || provider == "auto" {
+		switch {
+		case strings.Contains(host, ProviderGitHub):
+			provider = ProviderGitHub
+		case strings.Contains(host, ProviderGitLab):
+			provider = ProviderGitLab
+		default:
+			return nil, errors.Errorf("unable to detect the provider of %s, use --commit-status=github or --commit-status=gitlab", host)
+		}
+	}
+	cs := &CommitStatus{Provider: provider, Project: path}
+	switch provider {
+	case ProviderGitHub:
+		cs.APIURL = "https://api.github.com"
+		if host != "github.com" {
+			cs.APIURL = "https://" + host + "/api/v3"
+		}
+	case ProviderGitLab:
+		cs.APIURL = "https://" + host + "/api/v4"
+	default:
+		return nil, errors.Errorf("unsupported commit status provider %q", provider)
+	}
+	return cs, nil
+}
+
+// Report sets the commit status to one of StatePending, StateSuccess or StateFailure
+func (c *CommitStatus) Report(ctx context.Context, state, description, targetURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := c.request(state, description, targetURL)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to report commit status")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("failed to report commit status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *CommitStatus) request(state, description, targetURL string) (*http.Request, error) {
+	switch c.Provider {
+	case ProviderGitHub:
+		body, err := json.Marshal(map[string]string{
+			"state":       state,
+			"context":     commitStatusContext,
+			"description": description,
+			"target_url":  targetURL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, c.APIURL+"/repos/"+c.Project+"/statuses/"+c.SHA, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "token "+c.Token)
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	case ProviderGitLab:
+		// GitLab names the states slightly differently
+		switch state {
+		case StatePending:
+			state = "running"
+		case StateFailure:
+			state = "failed"
+		}
+		q := url.Values{}
+		q.Set("state", state)
+		q.Set("name", commitStatusContext)
+		q.Set("description", description)
+		if targetURL != "" {
+			q.Set("target_url", targetURL)
+		}
+		req, err := http.NewRequest(http.MethodPost, c.APIURL+"/projects/"+url.PathEscape(c.Project)+"/statuses/"+c.SHA+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("PRIVATE-TOKEN", c.Token)
+		return req, nil
+	}
+	return nil, errors.Errorf("unsupported commit status provider %q", c.Provider)
+}
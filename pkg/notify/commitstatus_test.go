@@ -0,0 +1,71 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRemote(t *testing.T) {
+	t.Parallel()
+	for remote, expected := range map[string]CommitStatus{
+		"https://github.com/acme/app.git":          {Provider: ProviderGitHub, APIURL: "https://api.github.com", Project: "acme/app"},
+		"git@github.com:acme/app.git":              {Provider: ProviderGitHub, APIURL: "https://api.github.com", Project: "acme/app"},
+		"ssh://git@github.acme.com/acme/app":       {Provider: ProviderGitHub, APIURL: "https://github.acme.com/api/v3", Project: "acme/app"},
+		"https://gitlab.com/acme/group/app.git":    {Provider: ProviderGitLab, APIURL: "https://gitlab.com/api/v4", Project: "acme/group/app"},
+		"git@gitlab.acme.com:acme/group/app.git":   {Provider: ProviderGitLab, APIURL: "https://gitlab.acme.com/api/v4", Project: "acme/group/app"},
+		"https://user:pw@gitlab.com/acme/app.git/": {Provider: ProviderGitLab, APIURL: "https://gitlab.com/api/v4", Project: "acme/app"},
+	} {
+		cs, err := parseRemote(remote, "auto")
+		require.NoError(t, err, remote)
+		assert.Equal(t, expected, *cs, remote)
+	}
+
+	_, err := parseRemote("https://git.acme.com/acme/app.git", "auto")
+	assert.Error(t, err)
+	cs, err := parseRemote("https://git.acme.com/acme/app.git", ProviderGitLab)
+	require.NoError(t, err)
+	assert.Equal(t, "https://git.acme.com/api/v4", cs.APIURL)
+}
+
+func Test_CommitStatusReport(t *testing.T) {
+	t.Parallel()
+	requests := make(chan *http.Request, 2)
+	bodies := make(chan map[string]string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		if r.Header.Get("Content-Type") == "application/json" {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		requests <- r
+		bodies <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	gh := &CommitStatus{Provider: ProviderGitHub, APIURL: srv.URL, Project: "acme/app", SHA: "abc123", Token: "secret"}
+	require.NoError(t, gh.Report(context.Background(), StatePending, "Build started", "https://ci/1"))
+	r, body := <-requests, <-bodies
+	assert.Equal(t, "/repos/acme/app/statuses/abc123", r.URL.Path)
+	assert.Equal(t, "token secret", r.Header.Get("Authorization"))
+	assert.Equal(t, map[string]string{"state": "pending", "context": "kubectl-buildkit", "description": "Build started", "target_url": "https://ci/1"}, body)
+
+	gl := &CommitStatus{Provider: ProviderGitLab, APIURL: srv.URL, Project: "acme/group/app", SHA: "abc123", Token: "secret"}
+	require.NoError(t, gl.Report(context.Background(), StateFailure, "Build failed", ""))
+	r = <-requests
+	<-bodies
+	assert.Equal(t, "/projects/acme%2Fgroup%2Fapp/statuses/abc123", r.URL.RawPath)
+	assert.Equal(t, "secret", r.Header.Get("PRIVATE-TOKEN"))
+	assert.Equal(t, "failed", r.URL.Query().Get("state"))
+	assert.Equal(t, "kubectl-buildkit", r.URL.Query().Get("name"))
+}
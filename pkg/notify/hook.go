@@ -0,0 +1,62 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HookPreBuild  = "pre-build"
+	HookPostBuild = "post-build"
+	HookPostPush  = "post-push"
+)
+
+// Hooks are local commands run around the phases of a build, with the build
+// described in their environment, see Event.Environ
+type Hooks struct {
+	PreBuild  []string
+	PostBuild []string
+	PostPush  []string
+}
+
+// Environ describes the event in BUILDKIT_ environment variables
+func (ev Event) Environ() []string {
+	return []string{
+		"BUILDKIT_BUILDER=" + ev.Builder,
+		"BUILDKIT_BUILD_ID=" + ev.BuildID,
+		"BUILDKIT_STATUS=" + ev.Status,
+		"BUILDKIT_TAGS=" + strings.Join(ev.Tags, ","),
+		"BUILDKIT_DIGEST=" + ev.Digest,
+		fmt.Sprintf("BUILDKIT_DURATION_SECONDS=%.3f", ev.DurationSeconds),
+		"BUILDKIT_ERROR=" + ev.Error,
+		"BUILDKIT_LOG_URL=" + ev.LogURL,
+	}
+}
+
+// RunHooks runs the commands of a hook with sh, or cmd on Windows, one after
+// the other, and stops at the first one failing
+func RunHooks(ctx context.Context, hook string, commands []string, ev Event, stdout, stderr io.Writer) error {
+	for _, command := range commands {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		}
+		cmd.Env = append(os.Environ(), ev.Environ()...)
+		cmd.Env = append(cmd.Env, "BUILDKIT_HOOK="+hook)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "%s hook %q failed", hook, command)
+		}
+	}
+	return nil
+}
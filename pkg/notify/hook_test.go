@@ -0,0 +1,26 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package notify
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RunHooks(t *testing.T) {
+	t.Parallel()
+	ev := Event{Builder: "buildkit", BuildID: "abc", Status: "succeeded", Tags: []string{"a:1", "b:2"}, Digest: "sha256:1234"}
+	var out bytes.Buffer
+	err := RunHooks(context.Background(), HookPostPush, []string{`echo "$BUILDKIT_HOOK $BUILDKIT_BUILD_ID $BUILDKIT_STATUS $BUILDKIT_TAGS $BUILDKIT_DIGEST"`}, ev, &out, &out)
+	require.NoError(t, err)
+	require.Equal(t, "post-push abc succeeded a:1,b:2 sha256:1234\n", out.String())
+
+	out.Reset()
+	err = RunHooks(context.Background(), HookPreBuild, []string{"exit 3", "echo not reached"}, ev, &out, &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `pre-build hook "exit 3" failed`)
+	require.Empty(t, out.String())
+}
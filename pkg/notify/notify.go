@@ -0,0 +1,134 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SinkWebhook = "webhook"
+	SinkSlack   = "slack"
+)
+
+// Sink is a destination for build completion notifications
+type Sink struct {
+	Kind string
+	URL  string
+}
+
+// Event describes a completed build
+type Event struct {
+	Builder         string   `json:"builder"`
+	BuildID         string   `json:"buildID,omitempty"`
+	Status          string   `json:"status"`
+	Tags            []string `json:"tags,omitempty"`
+	Digest          string   `json:"digest,omitempty"`
+	DurationSeconds float64  `json:"durationSeconds"`
+	Error           string   `json:"error,omitempty"`
+	LogURL          string   `json:"logURL,omitempty"`
+}
+
+// ParseSinks parses notification sinks in the form "webhook:<url>" or
+// "slack:<url>", a bare URL is treated as a webhook
+func ParseSinks(in []string) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(in))
+	for _, s := range in {
+		sink := Sink{Kind: SinkWebhook, URL: s}
+		if parts := strings.SplitN(s, ":", 2); len(parts) == 2 {
+			switch parts[0] {
+			case SinkWebhook, SinkSlack:
+				sink = Sink{Kind: parts[0], URL: parts[1]}
+			}
+		}
+		if !strings.HasPrefix(sink.URL, "http://") && !strings.HasPrefix(sink.URL, "https://") {
+			return nil, errors.Errorf("invalid notification sink %q, expected webhook:<url> or slack:<url>", s)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// Send posts the event to every sink, returning the first error encountered
+func Send(ctx context.Context, sinks []Sink, ev Event) error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := send(ctx, sink, ev); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to notify %s", sink.URL)
+		}
+	}
+	return firstErr
+}
+
+func send(ctx context.Context, sink Sink, ev Event) error {
+	var body interface{} = ev
+	if sink.Kind == SinkSlack {
+		body = map[string]string{"text": slackText(ev)}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, sink.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+func slackText(ev Event) string {
+	var sb strings.Builder
+	name := strings.Join(ev.Tags, ", ")
+	if name == "" {
+		name = "build"
+	}
+	fmt.Fprintf(&sb, "*%s* %s on builder %s after %s", name, ev.Status, ev.Builder, time.Duration(ev.DurationSeconds*float64(time.Second)).Round(time.Second))
+	if ev.Digest != "" {
+		fmt.Fprintf(&sb, "\n`%s`", ev.Digest)
+	}
+	if ev.Error != "" {
+		fmt.Fprintf(&sb, "\n```%s```", ev.Error)
+	}
+	if ev.BuildID != "" {
+		fmt.Fprintf(&sb, "\nbuild ID `%s`", ev.BuildID)
+	}
+	if ev.LogURL != "" {
+		fmt.Fprintf(&sb, "\n<%s|build log>", ev.LogURL)
+	}
+	return sb.String()
+}
+
+// LogURL returns a link to the job running this build when running under a
+// well known CI system, or "" otherwise
+func LogURL() string {
+	if server, repo, run := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"); server != "" && repo != "" && run != "" {
+		return server + "/" + repo + "/actions/runs/" + run
+	}
+	for _, env := range []string{"CI_JOB_URL", "BUILD_URL"} {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+	}
+	return ""
+}
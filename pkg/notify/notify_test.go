@@ -0,0 +1,58 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseSinks(t *testing.T) {
+	t.Parallel()
+	sinks, err := ParseSinks([]string{"https://example.com/hook", "slack:https://hooks.slack.com/services/x", "webhook:http://ci.local/notify"})
+	require.NoError(t, err)
+	assert.Equal(t, []Sink{
+		{Kind: SinkWebhook, URL: "https://example.com/hook"},
+		{Kind: SinkSlack, URL: "https://hooks.slack.com/services/x"},
+		{Kind: SinkWebhook, URL: "http://ci.local/notify"},
+	}, sinks)
+
+	_, err = ParseSinks([]string{"email:someone@example.com"})
+	assert.Error(t, err)
+}
+
+func Test_Send(t *testing.T) {
+	t.Parallel()
+	bodies := make(chan map[string]interface{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	ev := Event{
+		Builder:         "buildkit",
+		Status:          "succeeded",
+		Tags:            []string{"acme.com/app:1.0"},
+		Digest:          "sha256:abc",
+		DurationSeconds: 61,
+	}
+	err := Send(context.Background(), []Sink{{Kind: SinkWebhook, URL: srv.URL}, {Kind: SinkSlack, URL: srv.URL}}, ev)
+	require.NoError(t, err)
+
+	webhook := <-bodies
+	assert.Equal(t, "sha256:abc", webhook["digest"])
+	assert.Equal(t, "succeeded", webhook["status"])
+	slack := <-bodies
+	assert.Contains(t, slack["text"], "*acme.com/app:1.0* succeeded on builder buildkit after 1m1s")
+}
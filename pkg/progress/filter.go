@@ -0,0 +1,147 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// redactedMask replaces the redacted strings of the progress output
+const redactedMask = "****"
+
+// LogFilter clips the logs of the progress output to a number of lines per
+// step and a total size, and masks strings in the logs, step names and
+// errors.  Log chunks are redacted one at a time, so a string split across two
+// chunks of a step's output isn't masked.
+type LogFilter struct {
+	// MaxStepLines is the number of log lines shown per step, 0 for no limit
+	MaxStepLines int
+	// MaxBytes is the size of the logs shown for the whole build, 0 for no limit
+	MaxBytes int64
+	// Redact are the patterns masked in the progress output
+	Redact []*regexp.Regexp
+
+	mu           sync.Mutex
+	lines        map[digest.Digest]int
+	clippedSteps map[digest.Digest]bool
+	bytes        int64
+	clipped      bool
+}
+
+// RedactEnv returns patterns matching the values of the environment
+// variables whose names match any of the shell patterns in names
+func RedactEnv(names []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		for _, name := range names {
+			ok, err := path.Match(name, parts[0])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid environment variable pattern %q", name)
+			}
+			if ok {
+				res = append(res, regexp.MustCompile(regexp.QuoteMeta(parts[1])))
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// Filter returns the status with its logs clipped and redacted, the status
+// given is left unmodified
+func (f *LogFilter) Filter(st *client.SolveStatus) *client.SolveStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lines == nil {
+		f.lines = map[digest.Digest]int{}
+		f.clippedSteps = map[digest.Digest]bool{}
+	}
+	res := &client.SolveStatus{Statuses: st.Statuses}
+	for _, v := range st.Vertexes {
+		v2 := *v
+		v2.Name = f.redact(v.Name)
+		v2.Error = f.redact(v.Error)
+		res.Vertexes = append(res.Vertexes, &v2)
+	}
+	for _, l := range st.Logs {
+		if data := f.clip(l); len(data) > 0 {
+			l2 := *l
+			l2.Data = []byte(f.redact(string(data)))
+			res.Logs = append(res.Logs, &l2)
+		}
+	}
+	return res
+}
+
+// clip returns the data of the log which fits in the limits, with a notice
+// in place of the data cut
+func (f *LogFilter) clip(l *client.VertexLog) []byte {
+	if f.MaxBytes > 0 && f.bytes >= f.MaxBytes {
+		if f.clipped {
+			return nil
+		}
+		f.clipped = true
+		return []byte(f.bytesNotice())
+	}
+	data := l.Data
+	if f.MaxStepLines > 0 {
+		seen := f.lines[l.Vertex]
+		if seen >= f.MaxStepLines {
+			if f.clippedSteps[l.Vertex] {
+				return nil
+			}
+			f.clippedSteps[l.Vertex] = true
+			return []byte(f.linesNotice())
+		}
+		n := bytes.Count(data, []byte("\n"))
+		if seen+n > f.MaxStepLines || (seen+n == f.MaxStepLines && !bytes.HasSuffix(data, []byte("\n"))) {
+			at := 0
+			for i := 0; i < f.MaxStepLines-seen; i++ {
+				at += bytes.IndexByte(data[at:], '\n') + 1
+			}
+			data = append(data[:at:at], f.linesNotice()...)
+			n = f.MaxStepLines - seen
+			f.clippedSteps[l.Vertex] = true
+		}
+		f.lines[l.Vertex] = seen + n
+	}
+	if f.MaxBytes > 0 {
+		if f.bytes+int64(len(data)) > f.MaxBytes {
+			at := f.MaxBytes - f.bytes
+			f.bytes = f.MaxBytes
+			f.clipped = true
+			return append(data[:at:at], "\n"+f.bytesNotice()...)
+		}
+		f.bytes += int64(len(data))
+	}
+	return data
+}
+
+func (f *LogFilter) linesNotice() string {
+	return fmt.Sprintf("[output clipped, log limit of %d lines per step reached]\n", f.MaxStepLines)
+}
+
+func (f *LogFilter) bytesNotice() string {
+	return fmt.Sprintf("[output clipped, log limit of %d bytes reached]\n", f.MaxBytes)
+}
+
+func (f *LogFilter) redact(s string) string {
+	for _, re := range f.Redact {
+		s = re.ReplaceAllLiteralString(s, redactedMask)
+	}
+	return s
+}
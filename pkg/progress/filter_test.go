@@ -0,0 +1,72 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package progress
+
+import (
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func logStatus(vtx digest.Digest, data string) *client.SolveStatus {
+	return &client.SolveStatus{Logs: []*client.VertexLog{{Vertex: vtx, Data: []byte(data)}}}
+}
+
+func logData(st *client.SolveStatus) string {
+	res := ""
+	for _, l := range st.Logs {
+		res += string(l.Data)
+	}
+	return res
+}
+
+func Test_LogFilterStepLines(t *testing.T) {
+	t.Parallel()
+	f := &LogFilter{MaxStepLines: 3}
+	require.Equal(t, "a\nb\n", logData(f.Filter(logStatus("v1", "a\nb\n"))))
+	require.Equal(t, "c\n[output clipped, log limit of 3 lines per step reached]\n", logData(f.Filter(logStatus("v1", "c\nd\ne\n"))))
+	require.Equal(t, "", logData(f.Filter(logStatus("v1", "f\n"))))
+	// Other steps have their own limit
+	require.Equal(t, "x\ny\nz\n", logData(f.Filter(logStatus("v2", "x\ny\nz\n"))))
+	require.Equal(t, "[output clipped, log limit of 3 lines per step reached]\n", logData(f.Filter(logStatus("v2", "more\n"))))
+}
+
+func Test_LogFilterMaxBytes(t *testing.T) {
+	t.Parallel()
+	f := &LogFilter{MaxBytes: 6}
+	require.Equal(t, "abcd", logData(f.Filter(logStatus("v1", "abcd"))))
+	require.Equal(t, "ef\n[output clipped, log limit of 6 bytes reached]\n", logData(f.Filter(logStatus("v2", "efgh"))))
+	require.Equal(t, "", logData(f.Filter(logStatus("v1", "ijkl"))))
+}
+
+func Test_LogFilterRedact(t *testing.T) {
+	t.Parallel()
+	f := &LogFilter{Redact: []*regexp.Regexp{regexp.MustCompile(`s3cr[e]t`)}}
+	in := &client.SolveStatus{
+		Vertexes: []*client.Vertex{{Digest: "v1", Name: "RUN echo s3cret", Error: "s3cret failed"}},
+		Logs:     []*client.VertexLog{{Vertex: "v1", Data: []byte("s3cret\n")}},
+	}
+	out := f.Filter(in)
+	require.Equal(t, "RUN echo ****", out.Vertexes[0].Name)
+	require.Equal(t, "**** failed", out.Vertexes[0].Error)
+	require.Equal(t, "****\n", logData(out))
+	// The original status is left alone
+	require.Equal(t, "RUN echo s3cret", in.Vertexes[0].Name)
+	require.Equal(t, "s3cret\n", logData(in))
+}
+
+func Test_RedactEnv(t *testing.T) {
+	os.Setenv("TEST_REDACT_TOKEN", "tok.en")
+	defer os.Unsetenv("TEST_REDACT_TOKEN")
+	res, err := RedactEnv([]string{"TEST_REDACT_*"})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.True(t, res[0].MatchString("tok.en"))
+	require.False(t, res[0].MatchString("tokxen"))
+	_, err = RedactEnv([]string{"["})
+	require.Error(t, err)
+}
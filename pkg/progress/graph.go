@@ -0,0 +1,327 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// GraphVertex is a single node in the recorded build graph
+type GraphVertex struct {
+	Digest          digest.Digest   `json:"digest"`
+	Name            string          `json:"name"`
+	Inputs          []digest.Digest `json:"inputs,omitempty"`
+	Cached          bool            `json:"cached"`
+	Started         *time.Time      `json:"started,omitempty"`
+	Completed       *time.Time      `json:"completed,omitempty"`
+	DurationSeconds float64         `json:"durationSeconds,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	// Bytes is the size of what the statuses of the vertex reported
+	// transferring, eg. the layers pushed by an export
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// Graph accumulates the vertices reported during a solve so the
+// resolved build graph can be exported once the build completes
+type Graph struct {
+	mu       sync.Mutex
+	order    []digest.Digest
+	vertexes map[digest.Digest]*GraphVertex
+	// statusBytes are the bytes of each status of a vertex, by status ID
+	statusBytes map[digest.Digest]map[string]int64
+}
+
+func NewGraph() *Graph {
+	return &Graph{
+		vertexes:    map[digest.Digest]*GraphVertex{},
+		statusBytes: map[digest.Digest]map[string]int64{},
+	}
+}
+
+func (g *Graph) vertex(dgst digest.Digest) *GraphVertex {
+	gv, ok := g.vertexes[dgst]
+	if !ok {
+		gv = &GraphVertex{Digest: dgst}
+		g.vertexes[dgst] = gv
+		g.order = append(g.order, dgst)
+	}
+	return gv
+}
+
+// Record merges the vertex updates from a status message into the graph
+func (g *Graph) Record(st *client.SolveStatus) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, v := range st.Vertexes {
+		gv := g.vertex(v.Digest)
+		gv.Name = v.Name
+		if len(v.Inputs) > 0 {
+			gv.Inputs = v.Inputs
+		}
+		gv.Cached = v.Cached
+		if v.Started != nil {
+			gv.Started = v.Started
+		}
+		if v.Completed != nil {
+			gv.Completed = v.Completed
+		}
+		if gv.Started != nil && gv.Completed != nil {
+			gv.DurationSeconds = gv.Completed.Sub(*gv.Started).Seconds()
+		}
+		if v.Error != "" {
+			gv.Error = v.Error
+		}
+	}
+	for _, s := range st.Statuses {
+		n := s.Total
+		if s.Current > n {
+			n = s.Current
+		}
+		if g.statusBytes[s.Vertex] == nil {
+			g.statusBytes[s.Vertex] = map[string]int64{}
+		}
+		gv := g.vertex(s.Vertex)
+		gv.Bytes += n - g.statusBytes[s.Vertex][s.ID]
+		g.statusBytes[s.Vertex][s.ID] = n
+	}
+}
+
+// Vertexes returns the recorded vertices in the order they were first seen
+func (g *Graph) Vertexes() []GraphVertex {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]GraphVertex, 0, len(g.order))
+	for _, dgst := range g.order {
+		out = append(out, *g.vertexes[dgst])
+	}
+	return out
+}
+
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Vertexes []GraphVertex `json:"vertexes"`
+	}{
+		Vertexes: g.Vertexes(),
+	})
+}
+
+func (g *Graph) WriteDOT(w io.Writer) error {
+	vertexes := g.Vertexes()
+	known := make(map[digest.Digest]struct{}, len(vertexes))
+	for _, v := range vertexes {
+		known[v.Digest] = struct{}{}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "digraph build {")
+	fmt.Fprintln(&buf, "  node [shape=box];")
+	for _, v := range vertexes {
+		// The label is escaped before the line breaks are added
+		label := dotEscape(v.Name)
+		if v.Cached {
+			label += "\\n(cached)"
+		} else if v.Started != nil && v.Completed != nil {
+			label += fmt.Sprintf("\\n%.1fs", v.DurationSeconds)
+		}
+		attrs := fmt.Sprintf(`label="%s"`, label)
+		switch {
+		case v.Error != "":
+			attrs += ", color=red"
+		case v.Cached:
+			attrs += ", color=blue"
+		}
+		fmt.Fprintf(&buf, "  %s [%s];\n", dotQuote(v.Digest.String()), attrs)
+	}
+	for _, v := range vertexes {
+		for _, in := range v.Inputs {
+			// Inputs that were never reported (eg. filtered internal vertices) are skipped
+			if _, ok := known[in]; !ok {
+				continue
+			}
+			fmt.Fprintf(&buf, "  %s -> %s;\n", dotQuote(in.String()), dotQuote(v.Digest.String()))
+		}
+	}
+	fmt.Fprintln(&buf, "}")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteFile writes the graph in the format implied by the file extension
+func (g *Graph) WriteFile(filename string) error {
+	var buf bytes.Buffer
+	var err error
+	switch GraphFormat(filename) {
+	case "dot":
+		err = g.WriteDOT(&buf)
+	case "json":
+		err = g.WriteJSON(&buf)
+	default:
+		return errors.Errorf("unsupported graph format for %q, use a .dot or .json file", filename)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// GraphFormat returns "dot" or "json" based on the filename, or "" if unrecognized
+func GraphFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".dot", ".gv":
+		return "dot"
+	case ".json":
+		return "json"
+	}
+	return ""
+}
+
+// dotEscaper escapes the characters of a DOT string which end it or which
+// graphviz would take for an escape sequence, the newlines of multi-line RUN
+// steps are line breaks
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+func dotEscape(s string) string {
+	return dotEscaper.Replace(s)
+}
+
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
+
+// Tee returns a Writer which forwards every status update to the wrapped
+// Writer and hands it to fn.  fn runs on a goroutine of its own, the updates
+// queued for it, so a slow fn doesn't hold up the build writing its progress.
+// The Writer is done once fn got every update.
+func Tee(in Writer, fn func(*client.SolveStatus)) Writer {
+	w := &teeWriter{Writer: in, status: make(chan *client.SolveStatus), done: make(chan struct{})}
+	q := &statusQueue{wake: make(chan struct{}, 1)}
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		for {
+			batch, closed := q.take()
+			for _, st := range batch {
+				fn(st)
+			}
+			if closed && len(batch) == 0 {
+				return
+			}
+			if len(batch) == 0 {
+				<-q.wake
+			}
+		}
+	}()
+	go func() {
+		defer q.close()
+		for {
+			select {
+			case <-in.Done():
+				return
+			case st, ok := <-w.status:
+				if !ok {
+					close(in.Status())
+					return
+				}
+				q.push(st)
+				in.Status() <- st
+			}
+		}
+	}()
+	go func() {
+		<-in.Done()
+		<-recorded
+		close(w.done)
+	}()
+	return w
+}
+
+// statusQueue holds the status updates a Tee hasn't handed to its fn yet
+type statusQueue struct {
+	mu      sync.Mutex
+	pending []*client.SolveStatus
+	closed  bool
+	wake    chan struct{}
+}
+
+func (q *statusQueue) push(st *client.SolveStatus) {
+	q.mu.Lock()
+	q.pending = append(q.pending, st)
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *statusQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *statusQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending updates, and whether no more will be pushed
+func (q *statusQueue) take() ([]*client.SolveStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	batch := q.pending
+	q.pending = nil
+	return batch, q.closed
+}
+
+// Filter returns a Writer which forwards the status updates returned by fn
+// to the wrapped Writer, instead of the updates written to it
+func Filter(in Writer, fn func(*client.SolveStatus) *client.SolveStatus) Writer {
+	w := &teeWriter{Writer: in, status: make(chan *client.SolveStatus)}
+	go func() {
+		for {
+			select {
+			case <-in.Done():
+				return
+			case st, ok := <-w.status:
+				if !ok {
+					close(in.Status())
+					return
+				}
+				in.Status() <- fn(st)
+			}
+		}
+	}()
+	return w
+}
+
+type teeWriter struct {
+	Writer
+	status chan *client.SolveStatus
+	// done overrides the Done of the wrapped Writer if set
+	done chan struct{}
+}
+
+func (t *teeWriter) Status() chan *client.SolveStatus {
+	return t.status
+}
+
+func (t *teeWriter) Done() <-chan struct{} {
+	if t.done != nil {
+		return t.done
+	}
+	return t.Writer.Done()
+}
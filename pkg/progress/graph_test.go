@@ -0,0 +1,152 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Graph(t *testing.T) {
+	t.Parallel()
+	base := digest.FromString("base")
+	run := digest.FromString("run")
+	started := time.Now()
+	completed := started.Add(2 * time.Second)
+
+	g := NewGraph()
+	g.Record(&client.SolveStatus{
+		Vertexes: []*client.Vertex{
+			{Digest: base, Name: "FROM alpine", Cached: true},
+			{Digest: run, Name: "RUN make", Inputs: []digest.Digest{base}, Started: &started},
+		},
+	})
+	g.Record(&client.SolveStatus{
+		Vertexes: []*client.Vertex{
+			{Digest: run, Name: "RUN make", Started: &started, Completed: &completed},
+		},
+	})
+
+	vertexes := g.Vertexes()
+	require.Len(t, vertexes, 2)
+	require.True(t, vertexes[0].Cached)
+	require.Equal(t, []digest.Digest{base}, vertexes[1].Inputs)
+	require.Equal(t, 2.0, vertexes[1].DurationSeconds)
+
+	var buf bytes.Buffer
+	require.NoError(t, g.WriteDOT(&buf))
+	require.Contains(t, buf.String(), "digraph build {")
+	require.Contains(t, buf.String(), `"`+base.String()+`" -> "`+run.String()+`";`)
+	require.Contains(t, buf.String(), "(cached)")
+
+	buf.Reset()
+	require.NoError(t, g.WriteJSON(&buf))
+	var out struct {
+		Vertexes []GraphVertex `json:"vertexes"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Len(t, out.Vertexes, 2)
+}
+
+func Test_GraphBytes(t *testing.T) {
+	t.Parallel()
+	export := digest.FromString("export")
+	g := NewGraph()
+	g.Record(&client.SolveStatus{
+		Vertexes: []*client.Vertex{{Digest: export, Name: "exporting to image"}},
+		Statuses: []*client.VertexStatus{
+			{ID: "layer-1", Vertex: export, Current: 10, Total: 100},
+			{ID: "layer-2", Vertex: export, Current: 50},
+		},
+	})
+	g.Record(&client.SolveStatus{
+		Statuses: []*client.VertexStatus{{ID: "layer-1", Vertex: export, Current: 100, Total: 100}},
+	})
+	vertexes := g.Vertexes()
+	require.Len(t, vertexes, 1)
+	require.Equal(t, int64(150), vertexes[0].Bytes)
+}
+
+func Test_GraphFormat(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "dot", GraphFormat("out.dot"))
+	require.Equal(t, "json", GraphFormat("out.JSON"))
+	require.Equal(t, "", GraphFormat("out.txt"))
+}
+
+func Test_dotQuote(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, `"RUN echo \"a\\b\""`, dotQuote(`RUN echo "a\b"`))
+	require.Equal(t, `"RUN <<EOF\necho a\nEOF"`, dotQuote("RUN <<EOF\r\necho a\nEOF"))
+
+	g := NewGraph()
+	g.Record(&client.SolveStatus{
+		Vertexes: []*client.Vertex{{Digest: digest.FromString("copy"), Name: `COPY C:\src .`, Cached: true}},
+	})
+	var buf bytes.Buffer
+	require.NoError(t, g.WriteDOT(&buf))
+	require.Contains(t, buf.String(), `[label="COPY C:\\src .\n(cached)", color=blue];`)
+}
+
+// statusSink is a Writer receiving the status updates until its channel is
+// closed
+type statusSink struct {
+	status chan *client.SolveStatus
+	done   chan struct{}
+	got    []*client.SolveStatus
+}
+
+func newStatusSink() *statusSink {
+	s := &statusSink{status: make(chan *client.SolveStatus), done: make(chan struct{})}
+	go func() {
+		for st := range s.status {
+			s.got = append(s.got, st)
+		}
+		close(s.done)
+	}()
+	return s
+}
+
+func (s *statusSink) Done() <-chan struct{}            { return s.done }
+func (s *statusSink) Err() error                       { return nil }
+func (s *statusSink) Status() chan *client.SolveStatus { return s.status }
+
+func Test_Tee(t *testing.T) {
+	t.Parallel()
+	sink := newStatusSink()
+	release := make(chan struct{})
+	var recorded []*client.SolveStatus
+	w := Tee(sink, func(st *client.SolveStatus) {
+		<-release
+		recorded = append(recorded, st)
+	})
+
+	// The updates reach the wrapped Writer while fn is blocked
+	updates := []*client.SolveStatus{{}, {}, {}}
+	for _, st := range updates {
+		select {
+		case w.Status() <- st:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the status update is held up by fn")
+		}
+	}
+	close(w.Status())
+	<-sink.Done()
+	require.Equal(t, updates, sink.got)
+
+	// Done waits for fn to get every update
+	select {
+	case <-w.Done():
+		t.Fatal("done before fn got the updates")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-w.Done()
+	require.Equal(t, updates, recorded)
+}
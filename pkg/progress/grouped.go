@@ -0,0 +1,306 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package progress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/opencontainers/go-digest"
+)
+
+// The steps of builds with several targets are prefixed with the name of
+// their target.  Interleaved in a single list they are hard to follow, so the
+// grouped display shows a summary line per target instead, with the steps in
+// progress listed under the targets still building.  Targets collapse to their
+// summary line once done, the failed steps and their last log lines are
+// printed when the build ends.
+
+const (
+	// ModeGrouped is the progress mode grouping the steps by target on a terminal
+	ModeGrouped = "grouped"
+
+	groupedRefreshInterval = 150 * time.Millisecond
+	// groupedErrorLogLines is the number of log lines printed with a failed step
+	groupedErrorLogLines = 10
+)
+
+// MultiTargetMode returns the progress mode of a build of that many targets,
+// builds of several targets are displayed grouped unless another mode is set
+func MultiTargetMode(mode string, targets int) string {
+	if mode == "auto" && targets > 1 && os.Getenv("BUILDKIT_PROGRESS") == "" {
+		return ModeGrouped
+	}
+	return mode
+}
+
+func displayGrouped(ctx context.Context, c console.Console, out io.Writer, ch chan *client.SolveStatus) error {
+	if c == nil {
+		// Not a terminal, the plain output is already readable
+		return progressui.DisplaySolveStatus(ctx, "", nil, out, ch)
+	}
+	g := newGroupDisplay()
+	ticker := time.NewTicker(groupedRefreshInterval)
+	defer ticker.Stop()
+	printed := 0
+	render := func() {
+		width := 80
+		if size, err := c.Size(); err == nil && size.Width > 0 {
+			width = int(size.Width)
+		}
+		printed = repaint(out, printed, g.lines(width, time.Now()))
+	}
+	for {
+		select {
+		case st, ok := <-ch:
+			if !ok {
+				render()
+				g.writeErrors(out)
+				return nil
+			}
+			g.update(st)
+		case <-ticker.C:
+			render()
+		}
+	}
+}
+
+// repaint replaces the previous lines printed with lines, it returns the
+// number of lines now on display
+func repaint(out io.Writer, previous int, lines []string) int {
+	buf := &bytes.Buffer{}
+	if previous > 0 {
+		fmt.Fprintf(buf, "\x1b[%dA", previous)
+	}
+	for _, l := range lines {
+		fmt.Fprintf(buf, "\x1b[2K%s\n", l)
+	}
+	for i := len(lines); i < previous; i++ {
+		buf.WriteString("\x1b[2K\n")
+	}
+	n := len(lines)
+	if previous > n {
+		// Move back above the cleared lines
+		fmt.Fprintf(buf, "\x1b[%dA", previous-n)
+	}
+	_, _ = out.Write(buf.Bytes())
+	return n
+}
+
+type groupDisplay struct {
+	groups   []*targetGroup
+	byName   map[string]*targetGroup
+	vertexes map[digest.Digest]*groupVertex
+}
+
+type targetGroup struct {
+	name     string
+	vertexes []*groupVertex
+}
+
+type groupVertex struct {
+	name      string
+	started   *time.Time
+	completed *time.Time
+	cached    bool
+	err       string
+	logs      []string
+	// partial is the last log line until it is terminated
+	partial string
+}
+
+func newGroupDisplay() *groupDisplay {
+	return &groupDisplay{
+		byName:   map[string]*targetGroup{},
+		vertexes: map[digest.Digest]*groupVertex{},
+	}
+}
+
+func (g *groupDisplay) update(st *client.SolveStatus) {
+	for _, v := range st.Vertexes {
+		gv, ok := g.vertexes[v.Digest]
+		if !ok {
+			target, name := splitTarget(v.Name)
+			grp, ok := g.byName[target]
+			if !ok {
+				grp = &targetGroup{name: target}
+				g.byName[target] = grp
+				g.groups = append(g.groups, grp)
+			}
+			gv = &groupVertex{name: name}
+			g.vertexes[v.Digest] = gv
+			grp.vertexes = append(grp.vertexes, gv)
+		}
+		if v.Started != nil {
+			gv.started = v.Started
+		}
+		if v.Completed != nil {
+			gv.completed = v.Completed
+		}
+		gv.cached = gv.cached || v.Cached
+		if v.Error != "" {
+			gv.err = v.Error
+		}
+	}
+	for _, l := range st.Logs {
+		gv, ok := g.vertexes[l.Vertex]
+		if !ok {
+			continue
+		}
+		parts := strings.Split(gv.partial+string(l.Data), "\n")
+		gv.partial = parts[len(parts)-1]
+		gv.logs = append(gv.logs, parts[:len(parts)-1]...)
+		if len(gv.logs) > groupedErrorLogLines {
+			gv.logs = gv.logs[len(gv.logs)-groupedErrorLogLines:]
+		}
+	}
+}
+
+// splitTarget splits the target prefix added by MultiWriter.WithPrefix from
+// a step name, "[web 2/5] RUN make" belongs to web as "[2/5] RUN make"
+func splitTarget(name string) (string, string) {
+	if !strings.HasPrefix(name, "[") {
+		return "", name
+	}
+	end := strings.IndexAny(name, " ]")
+	if end < 0 {
+		return "", name
+	}
+	target := name[1:end]
+	if name[end] == ']' {
+		return target, strings.TrimPrefix(name[end+1:], " ")
+	}
+	return target, "[" + name[end+1:]
+}
+
+func (g *groupDisplay) lines(width int, now time.Time) []string {
+	nameWidth := 0
+	for _, grp := range g.groups {
+		if len(grp.name) > nameWidth {
+			nameWidth = len(grp.name)
+		}
+	}
+	var res []string
+	for _, grp := range g.groups {
+		res = append(res, clip(grp.summary(nameWidth, now), width))
+		if grp.state() != "running" {
+			continue
+		}
+		for _, v := range grp.vertexes {
+			if v.started == nil || v.completed != nil {
+				continue
+			}
+			line := fmt.Sprintf("    => %s %s", v.name, formatElapsed(now.Sub(*v.started)))
+			if last := v.lastLog(); last != "" {
+				line += "  " + last
+			}
+			res = append(res, clip(line, width))
+		}
+	}
+	return res
+}
+
+func (grp *targetGroup) state() string {
+	state := "done"
+	for _, v := range grp.vertexes {
+		switch {
+		case v.err != "":
+			return "failed"
+		case v.completed == nil:
+			state = "running"
+		}
+	}
+	return state
+}
+
+func (grp *targetGroup) summary(nameWidth int, now time.Time) string {
+	var done, cached int
+	var start, end *time.Time
+	for _, v := range grp.vertexes {
+		if v.completed != nil {
+			done++
+			if v.cached {
+				cached++
+			}
+			if end == nil || v.completed.After(*end) {
+				end = v.completed
+			}
+		}
+		if v.started != nil && (start == nil || v.started.Before(*start)) {
+			start = v.started
+		}
+	}
+	state := grp.state()
+	elapsed := time.Duration(0)
+	switch {
+	case start == nil:
+	case state == "running" || end == nil:
+		elapsed = now.Sub(*start)
+	default:
+		elapsed = end.Sub(*start)
+	}
+	name := grp.name
+	if name == "" {
+		name = "build"
+	}
+	line := fmt.Sprintf("%-9s %-*s %d/%d steps", "["+state+"]", nameWidth, name, done, len(grp.vertexes))
+	if cached > 0 {
+		line += fmt.Sprintf(", %d cached", cached)
+	}
+	return line + "  " + formatElapsed(elapsed)
+}
+
+// writeErrors prints the failed steps with their last log lines
+func (g *groupDisplay) writeErrors(out io.Writer) {
+	for _, grp := range g.groups {
+		for _, v := range grp.vertexes {
+			if v.err == "" {
+				continue
+			}
+			if grp.name != "" {
+				fmt.Fprintf(out, "ERROR [%s] %s: %s\n", grp.name, v.name, v.err)
+			} else {
+				fmt.Fprintf(out, "ERROR %s: %s\n", v.name, v.err)
+			}
+			for _, l := range v.allLogs() {
+				fmt.Fprintf(out, "    %s\n", l)
+			}
+		}
+	}
+}
+
+func (v *groupVertex) allLogs() []string {
+	if v.partial != "" {
+		return append(v.logs[:len(v.logs):len(v.logs)], v.partial)
+	}
+	return v.logs
+}
+
+func (v *groupVertex) lastLog() string {
+	logs := v.allLogs()
+	if len(logs) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(logs[len(logs)-1])
+}
+
+func formatElapsed(d time.Duration) string {
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+// clip shortens a line to fit in width columns
+func clip(line string, width int) string {
+	r := []rune(line)
+	if width <= 3 || len(r) <= width {
+		return line
+	}
+	return string(r[:width-3]) + "..."
+}
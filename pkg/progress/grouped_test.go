@@ -0,0 +1,70 @@
+// Copyright (C) 2021 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+package progress
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_splitTarget(t *testing.T) {
+	t.Parallel()
+	for name, want := range map[string][2]string{
+		"[web 2/5] RUN make":     {"web", "[2/5] RUN make"},
+		"[api] exporting layers": {"api", "exporting layers"},
+		"[web internal] load":    {"web", "[internal] load"},
+		"RUN make":               {"", "RUN make"},
+	} {
+		target, step := splitTarget(name)
+		assert.Equal(t, want, [2]string{target, step}, name)
+	}
+}
+
+func Test_groupDisplay(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	at := func(s int) *time.Time {
+		ts := start.Add(time.Duration(s) * time.Second)
+		return &ts
+	}
+	g := newGroupDisplay()
+	g.update(&client.SolveStatus{
+		Vertexes: []*client.Vertex{
+			{Digest: "sha256:1", Name: "[web 1/2] FROM alpine", Started: at(0), Completed: at(1), Cached: true},
+			{Digest: "sha256:2", Name: "[web 2/2] RUN make", Started: at(1)},
+			{Digest: "sha256:3", Name: "[api 1/1] RUN go build", Started: at(0), Completed: at(4)},
+			{Digest: "sha256:4", Name: "[worker 1/1] RUN false", Started: at(0), Completed: at(2), Error: "exit code: 1"},
+		},
+		Logs: []*client.VertexLog{
+			{Vertex: "sha256:2", Data: []byte("cc -c main.c\ncc -o app")},
+			{Vertex: "sha256:4", Data: []byte("failing\n")},
+		},
+	})
+	lines := g.lines(200, *at(10))
+	require.Equal(t, []string{
+		"[running] web    1/2 steps, 1 cached  10.0s",
+		"    => [2/2] RUN make 9.0s  cc -o app",
+		"[done]    api    1/1 steps  4.0s",
+		"[failed]  worker 1/1 steps  2.0s",
+	}, lines)
+	assert.Equal(t, "[running] ...", clip(lines[0], 13))
+
+	buf := &bytes.Buffer{}
+	g.writeErrors(buf)
+	assert.Equal(t, "ERROR [worker] [1/1] RUN false: exit code: 1\n    failing\n", buf.String())
+}
+
+func Test_repaint(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	assert.Equal(t, 2, repaint(buf, 0, []string{"a", "b"}))
+	assert.Equal(t, "\x1b[2Ka\n\x1b[2Kb\n", buf.String())
+	buf.Reset()
+	assert.Equal(t, 1, repaint(buf, 2, []string{"c"}))
+	assert.Equal(t, "\x1b[2A\x1b[2Kc\n\x1b[2K\n\x1b[1A", buf.String())
+}
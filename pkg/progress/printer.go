@@ -47,11 +47,15 @@ func NewPrinter(ctx context.Context, out console.File, mode string) Writer {
 
 	go func() {
 		var c console.Console
-		if cons, err := console.ConsoleFromFile(out); err == nil && (mode == "auto" || mode == "tty") {
+		if cons, err := console.ConsoleFromFile(out); err == nil && (mode == "auto" || mode == "tty" || mode == ModeGrouped) {
 			c = cons
 		}
 		// not using shared context to not disrupt display but let is finish reporting errors
-		pw.err = progressui.DisplaySolveStatus(ctx, "", c, out, statusCh)
+		if mode == ModeGrouped {
+			pw.err = displayGrouped(ctx, c, out, statusCh)
+		} else {
+			pw.err = progressui.DisplaySolveStatus(ctx, "", c, out, statusCh)
+		}
 		close(doneCh)
 	}()
 	return pw